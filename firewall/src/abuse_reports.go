@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AbuseReportConfig lets the chat report what only it can see, such as a
+// client flooding a channel with messages. Reports against an IP add Weight
+// (1 by default) to its aggregation key's count, and Threshold within
+// WindowMinutes auto-blocks the key for BlockDurationMinutes. Reports against
+// a user take away the relaxed rate limit of that user's fw_trust cookie for
+// as long.
+type AbuseReportConfig struct {
+	Enabled              bool `json:"enabled"`
+	Threshold            int  `json:"threshold"`
+	WindowMinutes        int  `json:"window_minutes"`
+	BlockDurationMinutes int  `json:"block_duration_minutes"`
+}
+
+func normalizeAbuseReportConfig(config AbuseReportConfig) AbuseReportConfig {
+	if config.Threshold <= 0 {
+		config.Threshold = 3
+	}
+	if config.WindowMinutes <= 0 {
+		config.WindowMinutes = 10
+	}
+	if config.BlockDurationMinutes <= 0 {
+		config.BlockDurationMinutes = 60
+	}
+	return config
+}
+
+// AbuseReports holds recent reports per aggregation key and the users whose
+// trust cookies are currently ignored.
+type AbuseReports struct {
+	mutex      sync.Mutex
+	reports    map[string][]time.Time
+	distrusted map[string]time.Time
+}
+
+func NewAbuseReports() *AbuseReports {
+	return &AbuseReports{
+		reports:    make(map[string][]time.Time),
+		distrusted: make(map[string]time.Time),
+	}
+}
+
+// Record adds weight reports against key and returns how many fall within
+// window of now.
+func (ar *AbuseReports) Record(key string, weight int, now time.Time, window time.Duration) int {
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+
+	var valid []time.Time
+	for _, report := range ar.reports[key] {
+		if now.Sub(report) < window {
+			valid = append(valid, report)
+		}
+	}
+	for i := 0; i < weight; i++ {
+		valid = append(valid, now)
+	}
+	ar.reports[key] = valid
+	return len(valid)
+}
+
+func (ar *AbuseReports) Forget(key string) {
+	ar.mutex.Lock()
+	delete(ar.reports, key)
+	ar.mutex.Unlock()
+}
+
+func (ar *AbuseReports) Distrust(user string, until time.Time) {
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+
+	if current, exists := ar.distrusted[user]; !exists || current.Before(until) {
+		ar.distrusted[user] = until
+	}
+}
+
+func (ar *AbuseReports) IsDistrusted(user string, now time.Time) bool {
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+
+	until, exists := ar.distrusted[user]
+	return exists && now.Before(until)
+}
+
+func (ar *AbuseReports) Cleanup(now time.Time, window time.Duration) {
+	ar.mutex.Lock()
+	defer ar.mutex.Unlock()
+
+	for key, reports := range ar.reports {
+		if len(reports) == 0 || now.Sub(reports[len(reports)-1]) >= window {
+			delete(ar.reports, key)
+		}
+	}
+	for user, until := range ar.distrusted {
+		if now.After(until) {
+			delete(ar.distrusted, user)
+		}
+	}
+}
+
+func (fw *Firewall) abuseReportConfig() AbuseReportConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.AbuseReports
+}
+
+type abuseReport struct {
+	IP     string `json:"ip"`
+	User   string `json:"user"`
+	Reason string `json:"reason"`
+	Weight int    `json:"weight"`
+}
+
+type abuseReportResponse struct {
+	Key          string     `json:"key,omitempty"`
+	Reports      int        `json:"reports,omitempty"`
+	BlockedUntil *time.Time `json:"blocked_until,omitempty"`
+	User         string     `json:"user,omitempty"`
+}
+
+// applyAbuseReport feeds one report into the auto-block system.
+func (fw *Firewall) applyAbuseReport(report abuseReport) (abuseReportResponse, error) {
+	config := fw.abuseReportConfig()
+	if !config.Enabled {
+		return abuseReportResponse{}, fmt.Errorf("abuse reports are disabled")
+	}
+	if report.IP == "" && report.User == "" {
+		return abuseReportResponse{}, fmt.Errorf("ip or user is required")
+	}
+	weight := min(max(report.Weight, 1), config.Threshold)
+	reason := strings.TrimSpace(report.Reason)
+	if reason == "" {
+		reason = "unspecified"
+	}
+
+	now := fw.clock.Now()
+	blockDuration := time.Duration(config.BlockDurationMinutes) * time.Minute
+	var response abuseReportResponse
+
+	if report.User != "" {
+		fw.abuseReports.Distrust(report.User, now.Add(blockDuration))
+		response.User = report.User
+		if fw.logger != nil {
+			fw.logger.LogWarning("ABUSE", "Chat reported user %s (%s) - trust cookie ignored for %dm", report.User, reason, config.BlockDurationMinutes)
+		}
+	}
+
+	if report.IP != "" {
+		ip := net.ParseIP(report.IP)
+		if ip == nil {
+			return abuseReportResponse{}, fmt.Errorf("invalid ip %q", report.IP)
+		}
+		key := fw.aggregationKey(ip.String())
+		count := fw.abuseReports.Record(key, weight, now, time.Duration(config.WindowMinutes)*time.Minute)
+		response.Key, response.Reports = key, count
+		fw.recordRisk(ip.String(), key, RiskSignalAbuseReport, weight)
+
+		if count >= config.Threshold {
+			fw.abuseReports.Forget(key)
+			until := now.Add(blockDuration)
+			fw.attemptsMutex.Lock()
+			fw.autoBlockLocked(key, "ABUSE_REPORTED", until)
+			fw.attemptsMutex.Unlock()
+			response.BlockedUntil = &until
+			if fw.logger != nil {
+				fw.logger.LogBlocked(ip.String(), "ABUSE_REPORTED",
+					fmt.Sprintf("%s blocked for %dm after %d reports from the chat (last: %s)", key, config.BlockDurationMinutes, count, reason))
+			}
+		} else if fw.logger != nil {
+			fw.logger.LogWarning("ABUSE", "Chat reported %s (%s) - %d/%d reports", key, reason, count, config.Threshold)
+		}
+	}
+	return response, nil
+}
+
+func (fw *Firewall) handleAbuseReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var report abuseReport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&report); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	response, err := fw.applyAbuseReport(report)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// startAbuseReportServer serves POST /reports on REPORT_ADDR for the chat
+// backend, which sits on a network the admin API isn't exposed to. Callers
+// authenticate with REPORT_TOKEN as a bearer token; that token grants nothing
+// else, so the chat never holds admin credentials.
+func (fw *Firewall) startAbuseReportServer() {
+	addr := getEnv("REPORT_ADDR", "off")
+	if addr == "off" {
+		return
+	}
+	token := os.Getenv("REPORT_TOKEN")
+	if token == "" {
+		fw.logger.LogError("ABUSE", "Abuse report API not started: REPORT_TOKEN is not set")
+		return
+	}
+	if _, port, err := net.SplitHostPort(addr); err == nil && port == fmt.Sprint(fw.firewallPort) {
+		fw.logger.LogError("ABUSE", "Abuse report API not started: REPORT_ADDR %s shares the proxied port", addr)
+		return
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		fw.logger.LogError("ABUSE", "Abuse report API not started: %v", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reports", fw.handleAbuseReport)
+	server := &http.Server{
+		Handler:           adminAuth{token: token}.Wrap(mux),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	fw.logger.LogStartup("Abuse report API listening on %s", listener.Addr())
+	go func() {
+		<-fw.shutdown
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fw.logger.LogError("ABUSE", "Abuse report server stopped: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultAccessLogPath = "/var/log/shared/firewall/access.log"
+
+type AccessLogConfig struct {
+	Enabled bool   `json:"enabled"`
+	Path    string `json:"path"`
+}
+
+func normalizeAccessLogConfig(config AccessLogConfig) AccessLogConfig {
+	if config.Path == "" {
+		config.Path = DefaultAccessLogPath
+	}
+	return config
+}
+
+// AccessLogger writes one combined-format line per proxied request, with the
+// request duration in seconds appended (as nginx's $request_time), so GoAccess
+// and awstats can read it directly.
+type AccessLogger struct {
+	mutex sync.Mutex
+	file  *os.File
+	path  string
+}
+
+func NewAccessLogger() *AccessLogger {
+	return &AccessLogger{}
+}
+
+func (al *AccessLogger) Write(path, line string) error {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	if al.file == nil || al.path != path {
+		if al.file != nil {
+			al.file.Close()
+			al.file = nil
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		al.file = file
+		al.path = path
+	}
+
+	_, err := al.file.WriteString(line + "\n")
+	return err
+}
+
+func (al *AccessLogger) Close() {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	if al.file != nil {
+		al.file.Close()
+		al.file = nil
+	}
+}
+
+func formatCombinedLog(ip string, record ResponseRecord, now time.Time) string {
+	requestLine := "-"
+	referer, userAgent := "-", "-"
+	if req := record.Request; req != nil {
+		requestLine = strings.TrimSpace(req.Method + " " + req.Target + " " + req.Proto)
+		if req.Referer != "" {
+			referer = req.Referer
+		}
+		if req.UserAgent != "" {
+			userAgent = req.UserAgent
+		}
+	}
+
+	return fmt.Sprintf(`%s - - [%s] "%s" %d %d "%s" "%s" %.3f`,
+		ip,
+		now.Format("02/Jan/2006:15:04:05 -0700"),
+		escapeLogField(requestLine),
+		record.Status,
+		record.BodyBytes,
+		escapeLogField(referer),
+		escapeLogField(userAgent),
+		record.Duration.Seconds())
+}
+
+func escapeLogField(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
+
+func (fw *Firewall) logAccess(ip string, record ResponseRecord) {
+	fw.rulesMutex.RLock()
+	config := fw.rules.AccessLog
+	fw.rulesMutex.RUnlock()
+
+	if !config.Enabled {
+		return
+	}
+
+	if err := fw.accessLog.Write(config.Path, formatCombinedLog(ip, record, time.Now())); err != nil {
+		fw.logErrorRateLimited("access_log", "ACCESS_LOG", "Failed to write access log %s: %v", config.Path, err)
+	}
+}
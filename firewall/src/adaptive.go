@@ -0,0 +1,179 @@
+package main
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultAdaptiveEvaluationSeconds = 10
+	DefaultAdaptiveMinResponses      = 20
+	DefaultAdaptiveMinFactor         = 0.2
+	DefaultAdaptiveTightenFactor     = 0.5
+	DefaultAdaptiveRecoveryStep      = 0.1
+)
+
+// AdaptiveRateLimit scales the per-IP per-minute limits (global and
+// per-endpoint) down while the firewall is under load: when the global
+// connection rate or the upstream error rate crosses its threshold, the limits
+// are multiplied by TightenFactor each evaluation, down to MinFactor. Once
+// healthy again they recover by RecoveryStep per evaluation. A threshold of 0
+// disables that signal. The hourly auto-block threshold is left alone so load
+// never turns into long bans.
+type AdaptiveRateLimit struct {
+	Enabled                 bool    `json:"enabled"`
+	EvaluationSeconds       int     `json:"evaluation_seconds"`
+	ConnectionRateThreshold float64 `json:"connection_rate_threshold"`
+	ErrorRateThreshold      float64 `json:"error_rate_threshold"`
+	MinResponses            int     `json:"min_responses"`
+	MinFactor               float64 `json:"min_factor"`
+	TightenFactor           float64 `json:"tighten_factor"`
+	RecoveryStep            float64 `json:"recovery_step"`
+}
+
+func normalizeAdaptiveRateLimit(config AdaptiveRateLimit) AdaptiveRateLimit {
+	if config.EvaluationSeconds <= 0 {
+		config.EvaluationSeconds = DefaultAdaptiveEvaluationSeconds
+	}
+	if config.MinResponses <= 0 {
+		config.MinResponses = DefaultAdaptiveMinResponses
+	}
+	if config.MinFactor <= 0 || config.MinFactor > 1 {
+		config.MinFactor = DefaultAdaptiveMinFactor
+	}
+	if config.TightenFactor <= 0 || config.TightenFactor >= 1 {
+		config.TightenFactor = DefaultAdaptiveTightenFactor
+	}
+	if config.RecoveryStep <= 0 {
+		config.RecoveryStep = DefaultAdaptiveRecoveryStep
+	}
+	return config
+}
+
+// AdaptiveLimiter holds the current limit factor (1 = configured limits).
+type AdaptiveLimiter struct {
+	factorBits     atomic.Uint64
+	upstreamErrors atomic.Uint64
+}
+
+func NewAdaptiveLimiter() *AdaptiveLimiter {
+	al := &AdaptiveLimiter{}
+	al.setFactor(1)
+	return al
+}
+
+func (al *AdaptiveLimiter) Factor() float64 {
+	return math.Float64frombits(al.factorBits.Load())
+}
+
+func (al *AdaptiveLimiter) setFactor(factor float64) {
+	al.factorBits.Store(math.Float64bits(factor))
+}
+
+// Scale applies the current factor to a limit, never going below 1.
+func (al *AdaptiveLimiter) Scale(limit int) int {
+	factor := al.Factor()
+	if factor >= 1 {
+		return limit
+	}
+	return max(1, int(float64(limit)*factor))
+}
+
+// RecordUpstreamError counts failures that never produced a response, such as
+// the upstream refusing connections.
+func (al *AdaptiveLimiter) RecordUpstreamError() {
+	al.upstreamErrors.Add(1)
+}
+
+// loadSample is a reading of the cumulative counters the controller compares
+// between evaluations.
+type loadSample struct {
+	connections    uint64
+	responses      uint64
+	serverErrors   uint64
+	upstreamErrors uint64
+}
+
+func (fw *Firewall) sampleLoad() loadSample {
+	responses := fw.responseStats.Snapshot()
+	return loadSample{
+		connections:    fw.trafficStats.Snapshot().Connections,
+		responses:      responses.Responses,
+		serverErrors:   responses.StatusClasses["5xx"],
+		upstreamErrors: fw.adaptive.upstreamErrors.Load(),
+	}
+}
+
+func (fw *Firewall) evaluateAdaptiveLimits(config AdaptiveRateLimit, previous, current loadSample) {
+	connectionRate := float64(current.connections-previous.connections) / float64(config.EvaluationSeconds)
+
+	failedDials := current.upstreamErrors - previous.upstreamErrors
+	attempts := current.responses - previous.responses + failedDials
+	errorRate := 0.0
+	if attempts >= uint64(config.MinResponses) {
+		errorRate = float64(current.serverErrors-previous.serverErrors+failedDials) / float64(attempts)
+	}
+
+	overloaded := (config.ConnectionRateThreshold > 0 && connectionRate > config.ConnectionRateThreshold) ||
+		(config.ErrorRateThreshold > 0 && errorRate > config.ErrorRateThreshold)
+
+	factor := fw.adaptive.Factor()
+	next := factor
+	if overloaded {
+		next = math.Max(config.MinFactor, factor*config.TightenFactor)
+	} else if factor < 1 {
+		next = math.Min(1, factor+config.RecoveryStep)
+	}
+	if next == factor {
+		return
+	}
+	fw.adaptive.setFactor(next)
+
+	if fw.logger == nil {
+		return
+	}
+	switch {
+	case overloaded:
+		fw.logger.LogWarning("ADAPTIVE", "Tightening per-IP rate limits to %.0f%% - connection rate %.1f/s, upstream error rate %.1f%%",
+			next*100, connectionRate, errorRate*100)
+	case next == 1:
+		fw.logger.LogInfo("ADAPTIVE", "Load back to normal - per-IP rate limits restored")
+	default:
+		fw.logger.LogInfo("ADAPTIVE", "Relaxing per-IP rate limits to %.0f%%", next*100)
+	}
+}
+
+func (fw *Firewall) adaptiveWatcher() {
+	var previous loadSample
+	primed := false
+	elapsed := 0
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fw.rulesMutex.RLock()
+		config := fw.rules.AdaptiveRateLimit
+		fw.rulesMutex.RUnlock()
+
+		if !config.Enabled {
+			fw.adaptive.setFactor(1)
+			primed = false
+			continue
+		}
+		if !primed {
+			previous, primed, elapsed = fw.sampleLoad(), true, 0
+			continue
+		}
+
+		elapsed++
+		if elapsed < config.EvaluationSeconds {
+			continue
+		}
+		elapsed = 0
+
+		current := fw.sampleLoad()
+		fw.evaluateAdaptiveLimits(config, previous, current)
+		previous = current
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+var staticAddressClasses = map[string][]string{
+	"private":    {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"},
+	"loopback":   {"127.0.0.0/8", "::1/128"},
+	"link-local": {"169.254.0.0/16", "fe80::/10"},
+}
+
+// addressClassNetworks expands a built-in class name used in whitelist or
+// blocked_ips into concrete networks. docker_bridge resolves to the subnets
+// of the container's own interfaces, i.e. whatever networks compose attached
+// us to in this environment.
+func addressClassNetworks(name string) ([]*net.IPNet, bool) {
+	name = strings.ReplaceAll(strings.ToLower(name), "_", "-")
+
+	if name == "docker-bridge" {
+		return localInterfaceNetworks(), true
+	}
+
+	cidrs, exists := staticAddressClasses[name]
+	if !exists {
+		return nil, false
+	}
+
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+			networks = append(networks, ipNet)
+		}
+	}
+	return networks, true
+}
+
+func localInterfaceNetworks() []*net.IPNet {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var networks []*net.IPNet
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			networks = append(networks, &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask})
+		}
+	}
+	return networks
+}
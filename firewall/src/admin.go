@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultAdminAddr = "127.0.0.1:5002"
+
+// StatsResponse is the document served by the admin /stats endpoint.
+type StatsResponse struct {
+	Uptime            string                        `json:"uptime"`
+	ActiveConnections int64                         `json:"active_connections"`
+	HalfOpen          int                           `json:"half_open_connections"`
+	Saturation        SaturationSnapshot            `json:"saturation"`
+	Watchdog          WatchdogStatus                `json:"watchdog"`
+	MemoryBudget      MemoryBudgetStatus            `json:"memory_budget"`
+	RuleGroups        []RuleGroupStatus             `json:"rule_groups"`
+	TrackedIPs        int                           `json:"tracked_ips"`
+	AutoBlockedIPs    int                           `json:"auto_blocked_ips"`
+	Responses         ResponseStatsSnapshot         `json:"responses"`
+	Traffic           TrafficStatsSnapshot          `json:"traffic"`
+	Transfer          TransferStatsSnapshot         `json:"transfer"`
+	Latency           LatencyStatsSnapshot          `json:"latency"`
+	SLO               []SLOStatus                   `json:"slo"`
+	RateLimitFactor   float64                       `json:"rate_limit_factor"`
+	FlaggedIPs        []FlaggedIP                   `json:"flagged_ips"`
+	Countries         []CountEntry                  `json:"countries,omitempty"`
+	Protocols         map[string]ProtocolStatsEntry `json:"protocols"`
+	Tenants           map[string]ProtocolStatsEntry `json:"tenants,omitempty"`
+	APIClients        map[string]ProtocolStatsEntry `json:"api_clients,omitempty"`
+	DecisionCache     DecisionCacheStats            `json:"decision_cache"`
+	Panics            uint64                        `json:"panics"`
+}
+
+// startAdminServer serves management endpoints on ADMIN_ADDR, which is a
+// host:port or unix:/path/to/socket. ADMIN_INTERFACE binds the TCP listener to
+// that interface's address instead of the host in ADMIN_ADDR. It is kept off
+// the proxied listener; set ADMIN_ADDR=off to disable it entirely.
+func (fw *Firewall) startAdminServer() {
+	addr := getEnv("ADMIN_ADDR", DefaultAdminAddr)
+	if addr == "off" {
+		return
+	}
+
+	auth := adminAuthFromEnv(fw.clock.Now)
+	listener, err := fw.adminListener(addr, getEnv("ADMIN_INTERFACE", ""), auth.Enabled())
+	if err != nil {
+		fw.logger.LogError("ADMIN", "Admin API not started: %v", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", fw.handleStats)
+	mux.HandleFunc("/appeals", fw.handleAppeal)
+	mux.HandleFunc("/blocklist", fw.handleBlocklist)
+	mux.HandleFunc("/rules/snapshots", fw.handleSnapshots)
+	mux.HandleFunc("/rules/rollback", fw.handleRollback)
+	mux.HandleFunc("/rules/staged", fw.handleStagedRules)
+	mux.HandleFunc("/simulate", fw.handleSimulate)
+	mux.HandleFunc("/connections", fw.handleConnections)
+	mux.HandleFunc("/connections/kill", fw.handleKillConnection)
+	mux.HandleFunc("/ip-lists", fw.handleIPLists)
+	mux.HandleFunc("/rule-groups", fw.handleRuleGroups)
+	mux.HandleFunc("/rule-conflicts", fw.handleRuleConflicts)
+	mux.HandleFunc("/risk-scores", fw.handleRiskScores)
+	mux.HandleFunc("/quotas", fw.handleQuotas)
+	mux.HandleFunc("/api-keys", fw.handleAPIKeys)
+	mux.HandleFunc("/cluster", fw.handleCluster)
+	mux.HandleFunc("/health", fw.handleHealth)
+	mux.HandleFunc("/state", fw.handleState)
+
+	signer := adminSignerFromEnv(fw.clock.Now)
+	server := &http.Server{
+		Handler:           auth.Wrap(signer.Wrap(mux)),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	fw.logger.LogStartup("Admin API listening on %s (auth: %s, signed mutations: %t)", listener.Addr(), auth, signer.Enabled())
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fw.logger.LogError("ADMIN", "Admin server stopped: %v", err)
+		}
+	}()
+}
+
+// adminListener refuses the proxied port, and any non-loopback TCP address
+// unless authentication is configured.
+func (fw *Firewall) adminListener(addr, iface string, authenticated bool) (net.Listener, error) {
+	if path, isUnix := strings.CutPrefix(addr, "unix:"); isUnix {
+		os.Remove(path)
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+		}
+		os.Chmod(path, 0660)
+		return listener, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ADMIN_ADDR %q: %v", addr, err)
+	}
+	if port == strconv.Itoa(fw.firewallPort) {
+		return nil, fmt.Errorf("ADMIN_ADDR %s shares the proxied port %d", addr, fw.firewallPort)
+	}
+
+	if iface != "" {
+		host, err = interfaceAddress(iface)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ip := net.ParseIP(host)
+	if (ip == nil || !ip.IsLoopback()) && host != "localhost" && !authenticated {
+		return nil, fmt.Errorf("refusing to expose the admin API on %s without ADMIN_TOKEN or ADMIN_USER/ADMIN_PASSWORD", net.JoinHostPort(host, port))
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", net.JoinHostPort(host, port), err)
+	}
+	return listener, nil
+}
+
+// interfaceAddress returns the first IPv4 address of a network interface, or
+// its first address of any kind.
+func interfaceAddress(name string) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("ADMIN_INTERFACE %s: %v", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("ADMIN_INTERFACE %s: %v", name, err)
+	}
+
+	var fallback string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP.String(), nil
+		}
+		if fallback == "" {
+			fallback = ipNet.IP.String()
+		}
+	}
+	if fallback == "" {
+		return "", fmt.Errorf("ADMIN_INTERFACE %s has no addresses", name)
+	}
+	return fallback, nil
+}
+
+// adminAuth guards the admin API and gives each caller a role. ADMIN_TOKEN
+// and basic auth (ADMIN_USER/ADMIN_PASSWORD) are admin; ADMIN_OPERATOR_TOKENS
+// and ADMIN_VIEWER_TOKENS are comma-separated bearer tokens for the lesser
+// roles, and OIDC bearer tokens get the role their claims name. Viewers can
+// be handed out widely: they read everything but change nothing.
+type adminAuth struct {
+	token          string
+	user           string
+	password       string
+	operatorTokens []string
+	viewerTokens   []string
+	oidc           *oidcVerifier
+	now            func() time.Time
+}
+
+func adminAuthFromEnv(now func() time.Time) adminAuth {
+	return adminAuth{
+		token:          os.Getenv("ADMIN_TOKEN"),
+		user:           os.Getenv("ADMIN_USER"),
+		password:       os.Getenv("ADMIN_PASSWORD"),
+		operatorTokens: splitAdminTokens(os.Getenv("ADMIN_OPERATOR_TOKENS")),
+		viewerTokens:   splitAdminTokens(os.Getenv("ADMIN_VIEWER_TOKENS")),
+		oidc:           oidcVerifierFromEnv(),
+		now:            now,
+	}
+}
+
+func (aa adminAuth) Enabled() bool {
+	return aa.tokensEnabled() || aa.basicEnabled() || aa.oidc != nil
+}
+
+func (aa adminAuth) tokensEnabled() bool {
+	return aa.token != "" || len(aa.operatorTokens) > 0 || len(aa.viewerTokens) > 0
+}
+
+func (aa adminAuth) basicEnabled() bool {
+	return aa.user != "" && aa.password != ""
+}
+
+func (aa adminAuth) String() string {
+	var methods []string
+	if aa.tokensEnabled() {
+		methods = append(methods, "bearer token")
+	}
+	if aa.basicEnabled() {
+		methods = append(methods, "basic")
+	}
+	if aa.oidc != nil {
+		methods = append(methods, "OIDC")
+	}
+	if len(methods) == 0 {
+		return "none"
+	}
+	return strings.Join(methods, " or ")
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func secureContains(tokens []string, token string) bool {
+	found := false
+	for _, candidate := range tokens {
+		found = secureEqual(candidate, token) || found
+	}
+	return found
+}
+
+// role returns what r's credentials allow, or AdminRoleNone.
+func (aa adminAuth) role(r *http.Request) AdminRole {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && bearer != "" {
+		switch {
+		case aa.token != "" && secureEqual(bearer, aa.token):
+			return AdminRoleAdmin
+		case secureContains(aa.operatorTokens, bearer):
+			return AdminRoleOperator
+		case secureContains(aa.viewerTokens, bearer):
+			return AdminRoleViewer
+		case aa.oidc != nil && strings.Count(bearer, ".") == 2:
+			if role, err := aa.oidc.Role(bearer, aa.now()); err == nil {
+				return role
+			}
+		}
+	}
+	if aa.basicEnabled() {
+		if user, password, ok := r.BasicAuth(); ok && secureEqual(user, aa.user) && secureEqual(password, aa.password) {
+			return AdminRoleAdmin
+		}
+	}
+	return AdminRoleNone
+}
+
+func (aa adminAuth) Wrap(next http.Handler) http.Handler {
+	if !aa.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := aa.role(r)
+		if role == AdminRoleNone {
+			if aa.basicEnabled() {
+				w.Header().Set("WWW-Authenticate", `Basic realm="firewall admin"`)
+			}
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		if required := adminRequiredRole(r); role < required {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("%s %s needs the %s role", r.Method, r.URL.Path, required)})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (fw *Firewall) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	activeConnections, trackedIPs, autoBlocked := fw.connectionGauges()
+	halfOpen, _ := fw.halfOpen.Counts("")
+
+	writeJSON(w, http.StatusOK, StatsResponse{
+		Uptime:            fw.clock.Now().Sub(fw.startTime).Round(time.Second).String(),
+		ActiveConnections: activeConnections,
+		HalfOpen:          halfOpen,
+		Saturation:        fw.saturationSnapshot(),
+		Watchdog:          fw.watchdog.Status(),
+		MemoryBudget:      fw.memory.Status(),
+		RuleGroups:        fw.ruleGroupStatuses(),
+		TrackedIPs:        trackedIPs,
+		AutoBlockedIPs:    autoBlocked,
+		Responses:         fw.responseStats.Snapshot(),
+		Traffic:           fw.trafficSnapshot(),
+		Transfer:          fw.transfers.Snapshot(fw.clock.Now()),
+		Latency:           fw.latencyStats.Snapshot(),
+		SLO:               fw.slo.Snapshot(),
+		RateLimitFactor:   fw.adaptive.Factor(),
+		FlaggedIPs:        fw.anomaly.Flagged(fw.clock.Now()),
+		Countries:         fw.countries.Snapshot(fw.clock.Now()),
+		Protocols:         fw.protocolStats.Snapshot(),
+		Tenants:           fw.tenantStats.Snapshot(),
+		APIClients:        fw.apiClientStats.Snapshot(),
+		DecisionCache:     fw.decisions.Stats(),
+		Panics:            fw.panics.Load(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func (fw *Firewall) connectionGauges() (active int64, tracked int, autoBlocked int) {
+	active, _ = fw.connSlots.Usage()
+
+	fw.attemptsMutex.RLock()
+	tracked = len(fw.connectionAttempts)
+	autoBlocked = len(fw.autoBlockedIPs)
+	fw.attemptsMutex.RUnlock()
+
+	return active, tracked, autoBlocked
+}
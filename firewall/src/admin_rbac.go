@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdminRole is what a caller of the admin API may do. Each role includes
+// the ones below it.
+type AdminRole int
+
+const (
+	AdminRoleNone AdminRole = iota
+	// AdminRoleViewer reads everything: dashboards, stats, simulations.
+	AdminRoleViewer
+	// AdminRoleOperator also runs day-to-day actions that leave the rules
+	// alone, like killing connections or refreshing the IP lists.
+	AdminRoleOperator
+	// AdminRoleAdmin also changes the rules, lists and API keys.
+	AdminRoleAdmin
+)
+
+func (role AdminRole) String() string {
+	switch role {
+	case AdminRoleViewer:
+		return "viewer"
+	case AdminRoleOperator:
+		return "operator"
+	case AdminRoleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+func parseAdminRole(name string) AdminRole {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "viewer":
+		return AdminRoleViewer
+	case "operator":
+		return AdminRoleOperator
+	case "admin":
+		return AdminRoleAdmin
+	}
+	return AdminRoleNone
+}
+
+// adminMutationRoles is the role each endpoint needs for anything but GET
+// and HEAD, which viewers may always do. Endpoints not listed change the
+// rules and need admin; /appeals is one, as a granted appeal drops the
+// client from the blocked list in rules.json.
+var adminMutationRoles = map[string]AdminRole{
+	"/simulate":         AdminRoleViewer, // POST only runs a simulation
+	"/connections/kill": AdminRoleOperator,
+	"/ip-lists":         AdminRoleOperator, // POST refreshes the feeds
+	"/rules/snapshots":  AdminRoleOperator,
+}
+
+func adminRequiredRole(r *http.Request) AdminRole {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return AdminRoleViewer
+	}
+	if role, listed := adminMutationRoles[r.URL.Path]; listed {
+		return role
+	}
+	return AdminRoleAdmin
+}
+
+// splitAdminTokens parses a comma-separated token list.
+func splitAdminTokens(value string) []string {
+	var tokens []string
+	for _, token := range strings.Split(value, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+const (
+	DefaultOIDCRolesClaim = "roles"
+	oidcJWKSMinRefresh    = time.Minute
+	oidcClockSkew         = time.Minute
+)
+
+// oidcVerifier accepts bearer JWTs from an OpenID Connect provider, signed
+// with RS256 or ES256 by a key in the provider's JWKS, issued by issuer for
+// audience and unexpired. The role is the highest one named in rolesClaim,
+// a string or list, which may be a dotted path such as
+// "realm_access.roles".
+type oidcVerifier struct {
+	issuer     string
+	audience   string
+	jwksURL    string
+	rolesClaim string
+	client     *http.Client
+
+	mutex   sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// oidcVerifierFromEnv configures OIDC from ADMIN_OIDC_ISSUER and
+// ADMIN_OIDC_AUDIENCE, both required, ADMIN_OIDC_JWKS_URL, found through
+// discovery when unset, and ADMIN_OIDC_ROLES_CLAIM.
+func oidcVerifierFromEnv() *oidcVerifier {
+	issuer := strings.TrimRight(os.Getenv("ADMIN_OIDC_ISSUER"), "/")
+	audience := os.Getenv("ADMIN_OIDC_AUDIENCE")
+	if issuer == "" || audience == "" {
+		return nil
+	}
+	return newOIDCVerifier(issuer, audience, os.Getenv("ADMIN_OIDC_JWKS_URL"), getEnv("ADMIN_OIDC_ROLES_CLAIM", DefaultOIDCRolesClaim))
+}
+
+func newOIDCVerifier(issuer, audience, jwksURL, rolesClaim string) *oidcVerifier {
+	return &oidcVerifier{
+		issuer:     issuer,
+		audience:   audience,
+		jwksURL:    jwksURL,
+		rolesClaim: rolesClaim,
+		client:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+}
+
+// Role verifies token and returns the role it grants.
+func (ov *oidcVerifier) Role(token string, now time.Time) (AdminRole, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return AdminRoleNone, errors.New("not a JWT")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return AdminRoleNone, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return AdminRoleNone, err
+	}
+	key, err := ov.key(header.Kid, now)
+	if err != nil {
+		return AdminRoleNone, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return AdminRoleNone, err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return AdminRoleNone, err
+	}
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != ov.issuer:
+		return AdminRoleNone, fmt.Errorf("issuer %q not trusted", claims.Issuer)
+	case !jwtAudienceContains(claims.Audience, ov.audience):
+		return AdminRoleNone, errors.New("token not issued for this audience")
+	case claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(oidcClockSkew)):
+		return AdminRoleNone, errors.New("token expired")
+	case claims.NotBefore != 0 && now.Add(oidcClockSkew).Before(time.Unix(claims.NotBefore, 0)):
+		return AdminRoleNone, errors.New("token not valid yet")
+	}
+
+	var all map[string]interface{}
+	if err := decodeJWTPart(parts[1], &all); err != nil {
+		return AdminRoleNone, err
+	}
+	var value interface{} = all
+	for _, field := range strings.Split(ov.rolesClaim, ".") {
+		object, _ := value.(map[string]interface{})
+		value = object[field]
+	}
+	var names []interface{}
+	switch value := value.(type) {
+	case string:
+		names = []interface{}{value}
+	case []interface{}:
+		names = value
+	}
+	role := AdminRoleNone
+	for _, name := range names {
+		if name, ok := name.(string); ok {
+			role = max(role, parseAdminRole(name))
+		}
+	}
+	return role, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func jwtAudienceContains(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	json.Unmarshal(raw, &list)
+	for _, entry := range list {
+		if entry == audience {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "RS256":
+		if key, ok := key.(*rsa.PublicKey); ok {
+			return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+		}
+	case "ES256":
+		if key, ok := key.(*ecdsa.PublicKey); ok && len(signature) == 64 {
+			r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+			if ecdsa.Verify(key, digest[:], r, s) {
+				return nil
+			}
+			return errors.New("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	return fmt.Errorf("signing key doesn't fit %s", alg)
+}
+
+// key returns the provider key kid, fetching the JWKS when the key is
+// unknown, for key rotation, but not more than once a minute. The fetch
+// runs outside the lock, so tokens signed by known keys are verified while
+// it is under way; the new keys replace the cached ones once it succeeds.
+func (ov *oidcVerifier) key(kid string, now time.Time) (crypto.PublicKey, error) {
+	ov.mutex.Lock()
+	if key, found := ov.keys[kid]; found {
+		ov.mutex.Unlock()
+		return key, nil
+	}
+	if !ov.fetched.IsZero() && now.Sub(ov.fetched) < oidcJWKSMinRefresh {
+		ov.mutex.Unlock()
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	ov.fetched = now
+	ov.mutex.Unlock()
+
+	keys, err := ov.fetchKeys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the provider's keys: %v", err)
+	}
+	ov.mutex.Lock()
+	ov.keys = keys
+	ov.mutex.Unlock()
+	if key, found := keys[kid]; found {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (ov *oidcVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	jwksURL := ov.jwksURL
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := ov.getJSON(ov.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		if discovery.JWKSURI == "" {
+			return nil, errors.New("discovery document has no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := ov.getJSON(jwksURL, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if key := jwk.publicKey(); key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (ov *oidcVerifier) getJSON(url string, v interface{}) error {
+	resp, err := ov.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// publicKey returns the RSA or P-256 key, or nil for anything else.
+func (jwk jsonWebKey) publicKey() crypto.PublicKey {
+	decode := func(value string) *big.Int {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(data) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(data)
+	}
+	switch {
+	case jwk.Kty == "RSA":
+		n, e := decode(jwk.N), decode(jwk.E)
+		if n == nil || e == nil || !e.IsInt64() {
+			return nil
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case jwk.Kty == "EC" && jwk.Crv == "P-256":
+		x, y := decode(jwk.X), decode(jwk.Y)
+		if x == nil || y == nil || !elliptic.P256().IsOnCurve(x, y) {
+			return nil
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	}
+	return nil
+}
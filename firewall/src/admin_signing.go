@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	AdminTimestampHeader = "X-Admin-Timestamp"
+	AdminNonceHeader     = "X-Admin-Nonce"
+	AdminSignatureHeader = "X-Admin-Signature"
+
+	DefaultAdminReplayWindow = 5 * time.Minute
+	// adminSignedBodyLimit caps the body read to check a signature; the
+	// largest admin bodies are whole rule sets.
+	adminSignedBodyLimit = 8 << 20
+	adminMaxNonceLength  = 128
+)
+
+// adminSigner protects the mutating admin endpoints against replay when
+// ADMIN_SIGNING_KEY is set. Every request other than GET, HEAD and OPTIONS
+// must carry a Unix timestamp, a nonce, and the hex HMAC-SHA256 under the
+// key of
+//
+//	METHOD\nREQUEST-URI\nTIMESTAMP\nNONCE\nhex(SHA-256(body))
+//
+// A timestamp further than ADMIN_REPLAY_WINDOW_SECONDS from now is refused,
+// and so is a nonce already seen within that window, so a captured
+// block/unblock can be neither resent nor kept for later. It comes on top of
+// adminAuth, which still decides who may call the API at all.
+type adminSigner struct {
+	key    []byte
+	window time.Duration
+	now    func() time.Time
+
+	mutex  sync.Mutex
+	nonces map[string]time.Time
+}
+
+func newAdminSigner(key string, window time.Duration, now func() time.Time) *adminSigner {
+	if window <= 0 {
+		window = DefaultAdminReplayWindow
+	}
+	return &adminSigner{key: []byte(key), window: window, now: now, nonces: make(map[string]time.Time)}
+}
+
+func adminSignerFromEnv(now func() time.Time) *adminSigner {
+	window := time.Duration(getEnvInt("ADMIN_REPLAY_WINDOW_SECONDS", int(DefaultAdminReplayWindow/time.Second))) * time.Second
+	return newAdminSigner(os.Getenv("ADMIN_SIGNING_KEY"), window, now)
+}
+
+func (as *adminSigner) Enabled() bool {
+	return len(as.key) > 0
+}
+
+func adminSignature(key []byte, method, uri, timestamp, nonce string, body []byte) string {
+	bodySum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, method+"\n"+uri+"\n"+timestamp+"\n"+nonce+"\n"+hex.EncodeToString(bodySum[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signAdminRequest adds the replay protection headers to req, whose body
+// is body.
+func signAdminRequest(req *http.Request, key string, body []byte, now time.Time) error {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	nonce := hex.EncodeToString(random)
+	req.Header.Set(AdminTimestampHeader, timestamp)
+	req.Header.Set(AdminNonceHeader, nonce)
+	req.Header.Set(AdminSignatureHeader, adminSignature([]byte(key), req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+	return nil
+}
+
+func adminRequestMutates(r *http.Request) bool {
+	return r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions
+}
+
+// verify checks r's signature and records its nonce. The reason is for the
+// caller; it never says which part of the signature was wrong.
+func (as *adminSigner) verify(r *http.Request, body []byte) (string, bool) {
+	timestamp := r.Header.Get(AdminTimestampHeader)
+	nonce := r.Header.Get(AdminNonceHeader)
+	signature := r.Header.Get(AdminSignatureHeader)
+	if timestamp == "" || nonce == "" || signature == "" || len(nonce) > adminMaxNonceLength {
+		return "mutating requests must be signed", false
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "invalid " + AdminTimestampHeader, false
+	}
+	now := as.now()
+	if skew := now.Sub(time.Unix(unix, 0)); skew > as.window || skew < -as.window {
+		return "request timestamp outside the replay window", false
+	}
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	expected := adminSignature(as.key, r.Method, uri, timestamp, nonce, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "invalid signature", false
+	}
+
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	for seen, expires := range as.nonces {
+		if now.After(expires) {
+			delete(as.nonces, seen)
+		}
+	}
+	if _, replayed := as.nonces[nonce]; replayed {
+		return "nonce already used", false
+	}
+	// A nonce has to be remembered for as long as its timestamp is accepted.
+	as.nonces[nonce] = time.Unix(unix, 0).Add(as.window)
+	return "", true
+}
+
+func (as *adminSigner) Wrap(next http.Handler) http.Handler {
+	if !as.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !adminRequestMutates(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, adminSignedBodyLimit))
+		if err != nil {
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "request body too large"})
+			return
+		}
+		if reason, ok := as.verify(r, body); !ok {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": reason})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
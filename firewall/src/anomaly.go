@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	AnomalyHistorySize      = 64
+	AnomalyMinInterval      = 100 * time.Millisecond
+	AnomalyIntervalBuckets  = 16
+	AnomalyMinIntervals     = 8
+	AnomalyProfileIdleAfter = 10 * time.Minute
+
+	AnomalyActionLimit = "limit"
+	AnomalyActionBlock = "block"
+)
+
+// AnomalyDetection scores each client on its recent requests: how regular the
+// gaps between them are (low entropy suggests a script on a timer), how many
+// distinct paths it walks (scanners rarely repeat one) and how many of its
+// requests fail. A client scoring at least Threshold over at least
+// MinRequests requests is flagged for FlagMinutes: "limit" multiplies its
+// per-minute limit by LimitFactor, "block" auto-blocks it.
+type AnomalyDetection struct {
+	Enabled        bool    `json:"enabled"`
+	MinRequests    int     `json:"min_requests"`
+	Threshold      float64 `json:"threshold"`
+	IntervalWeight float64 `json:"interval_weight"`
+	PathWeight     float64 `json:"path_weight"`
+	ErrorWeight    float64 `json:"error_weight"`
+	Action         string  `json:"action"`
+	LimitFactor    float64 `json:"limit_factor"`
+	FlagMinutes    int     `json:"flag_minutes"`
+}
+
+func normalizeAnomalyDetection(config AnomalyDetection) AnomalyDetection {
+	if config.MinRequests <= 0 {
+		config.MinRequests = 20
+	}
+	if config.MinRequests > AnomalyHistorySize {
+		config.MinRequests = AnomalyHistorySize
+	}
+	if config.Threshold <= 0 || config.Threshold > 1 {
+		config.Threshold = 0.7
+	}
+	if config.IntervalWeight < 0 || config.PathWeight < 0 || config.ErrorWeight < 0 ||
+		config.IntervalWeight+config.PathWeight+config.ErrorWeight == 0 {
+		config.IntervalWeight, config.PathWeight, config.ErrorWeight = 0.4, 0.3, 0.3
+	}
+	if config.Action != AnomalyActionBlock {
+		config.Action = AnomalyActionLimit
+	}
+	if config.LimitFactor <= 0 || config.LimitFactor > 1 {
+		config.LimitFactor = 0.25
+	}
+	if config.FlagMinutes <= 0 {
+		config.FlagMinutes = 30
+	}
+	return config
+}
+
+type behaviorProfile struct {
+	lastSeen     time.Time
+	arrivals     []time.Time
+	paths        []string
+	failures     []bool
+	score        float64
+	flaggedUntil time.Time
+}
+
+func pushBounded[T any](items []T, item T) []T {
+	items = append(items, item)
+	if len(items) > AnomalyHistorySize {
+		items = items[len(items)-AnomalyHistorySize:]
+	}
+	return items
+}
+
+// intervalRegularity is 1 - normalized entropy of the (log-bucketed) gaps
+// between requests. Bursts closer than AnomalyMinInterval, like a browser
+// fetching a page's assets, count as one arrival.
+func (bp *behaviorProfile) intervalRegularity() (float64, bool) {
+	buckets := make(map[int]int)
+	intervals := 0
+	last := time.Time{}
+	for _, arrival := range bp.arrivals {
+		if !last.IsZero() {
+			gap := arrival.Sub(last)
+			if gap < AnomalyMinInterval {
+				continue
+			}
+			bucket := int(math.Log2(float64(gap / time.Millisecond)))
+			buckets[min(bucket, AnomalyIntervalBuckets-1)]++
+			intervals++
+		}
+		last = arrival
+	}
+	if intervals < AnomalyMinIntervals {
+		return 0, false
+	}
+
+	entropy := 0.0
+	for _, count := range buckets {
+		p := float64(count) / float64(intervals)
+		entropy -= p * math.Log2(p)
+	}
+	maxEntropy := math.Log2(float64(min(intervals, AnomalyIntervalBuckets)))
+	return 1 - entropy/maxEntropy, true
+}
+
+// pathDiversity maps the share of distinct paths from 0.5..1 onto 0..1;
+// normal browsing revisits the same pages and assets.
+func (bp *behaviorProfile) pathDiversity() float64 {
+	if len(bp.paths) == 0 {
+		return 0
+	}
+	distinct := make(map[string]struct{}, len(bp.paths))
+	for _, p := range bp.paths {
+		distinct[p] = struct{}{}
+	}
+	ratio := float64(len(distinct)) / float64(len(bp.paths))
+	return math.Max(0, (ratio-0.5)/0.5)
+}
+
+func (bp *behaviorProfile) errorRatio() float64 {
+	if len(bp.failures) == 0 {
+		return 0
+	}
+	failed := 0
+	for _, failure := range bp.failures {
+		if failure {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(bp.failures))
+}
+
+func (bp *behaviorProfile) computeScore(config AnomalyDetection) (float64, string) {
+	regularity, haveIntervals := bp.intervalRegularity()
+	diversity := bp.pathDiversity()
+	errors := bp.errorRatio()
+
+	weighted := config.PathWeight*diversity + config.ErrorWeight*errors
+	totalWeight := config.PathWeight + config.ErrorWeight
+	if haveIntervals {
+		weighted += config.IntervalWeight * regularity
+		totalWeight += config.IntervalWeight
+	}
+	if totalWeight == 0 {
+		return 0, ""
+	}
+
+	details := fmt.Sprintf("interval regularity %.2f, path diversity %.2f, error ratio %.2f", regularity, diversity, errors)
+	return weighted / totalWeight, details
+}
+
+type FlaggedIP struct {
+	Key          string    `json:"key"`
+	Score        float64   `json:"score"`
+	FlaggedUntil time.Time `json:"flagged_until"`
+}
+
+// AnomalyDetector keeps a behavior profile per client key.
+type AnomalyDetector struct {
+	mutex    sync.Mutex
+	profiles map[string]*behaviorProfile
+}
+
+func NewAnomalyDetector() *AnomalyDetector {
+	return &AnomalyDetector{profiles: make(map[string]*behaviorProfile)}
+}
+
+// profile returns key's profile, creating it if there is room. Callers hold
+// ad.mutex.
+func (ad *AnomalyDetector) profile(key string, now time.Time) *behaviorProfile {
+	if bp, exists := ad.profiles[key]; exists {
+		return bp
+	}
+	if len(ad.profiles) >= MaxTrackedIPs {
+		ad.removeIdle(now)
+		if len(ad.profiles) >= MaxTrackedIPs {
+			return nil
+		}
+	}
+	bp := &behaviorProfile{}
+	ad.profiles[key] = bp
+	return bp
+}
+
+func (ad *AnomalyDetector) removeIdle(now time.Time) int {
+	removed := 0
+	for key, bp := range ad.profiles {
+		if now.Sub(bp.lastSeen) > AnomalyProfileIdleAfter && now.After(bp.flaggedUntil) {
+			delete(ad.profiles, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (ad *AnomalyDetector) Cleanup(now time.Time) int {
+	ad.mutex.Lock()
+	defer ad.mutex.Unlock()
+
+	return ad.removeIdle(now)
+}
+
+func (ad *AnomalyDetector) RecordRequest(key, requestPath string, now time.Time) {
+	ad.mutex.Lock()
+	defer ad.mutex.Unlock()
+
+	bp := ad.profile(key, now)
+	if bp == nil {
+		return
+	}
+	bp.lastSeen = now
+	bp.arrivals = pushBounded(bp.arrivals, now)
+	bp.paths = pushBounded(bp.paths, normalizeRequestPath(requestPath))
+}
+
+// RecordResponse adds the outcome of one of key's requests and rescores it.
+// It reports whether key has just been flagged.
+func (ad *AnomalyDetector) RecordResponse(key string, status int, config AnomalyDetection, now time.Time) (bool, float64, string) {
+	ad.mutex.Lock()
+	defer ad.mutex.Unlock()
+
+	bp := ad.profile(key, now)
+	if bp == nil {
+		return false, 0, ""
+	}
+	bp.failures = pushBounded(bp.failures, status >= 400)
+
+	if len(bp.paths) < config.MinRequests {
+		return false, 0, ""
+	}
+
+	score, details := bp.computeScore(config)
+	bp.score = score
+	if score < config.Threshold || now.Before(bp.flaggedUntil) {
+		return false, score, details
+	}
+	bp.flaggedUntil = now.Add(time.Duration(config.FlagMinutes) * time.Minute)
+	return true, score, details
+}
+
+func (ad *AnomalyDetector) IsFlagged(key string, now time.Time) bool {
+	ad.mutex.Lock()
+	defer ad.mutex.Unlock()
+
+	bp, exists := ad.profiles[key]
+	return exists && now.Before(bp.flaggedUntil)
+}
+
+func (ad *AnomalyDetector) Flagged(now time.Time) []FlaggedIP {
+	ad.mutex.Lock()
+	defer ad.mutex.Unlock()
+
+	flagged := []FlaggedIP{}
+	for key, bp := range ad.profiles {
+		if now.Before(bp.flaggedUntil) {
+			flagged = append(flagged, FlaggedIP{Key: key, Score: bp.score, FlaggedUntil: bp.flaggedUntil})
+		}
+	}
+	sort.Slice(flagged, func(i, j int) bool {
+		return flagged[i].Score > flagged[j].Score
+	})
+	return flagged
+}
+
+func (fw *Firewall) anomalyDetection() AnomalyDetection {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.AnomalyDetection
+}
+
+func (fw *Firewall) recordAnomalyResponse(ip, key string, status int) {
+	config := fw.anomalyDetection()
+	if !config.Enabled {
+		return
+	}
+
+	flagged, score, details := fw.anomaly.RecordResponse(key, status, config, fw.clock.Now())
+	if flagged {
+		fw.recordRisk(ip, key, RiskSignalAnomaly, 1)
+	}
+	if !flagged || fw.logger == nil {
+		return
+	}
+
+	if config.Action == AnomalyActionBlock {
+		fw.attemptsMutex.Lock()
+		fw.autoBlockLocked(key, "ANOMALY", fw.clock.Now().Add(time.Duration(config.FlagMinutes)*time.Minute))
+		fw.attemptsMutex.Unlock()
+
+		fw.logger.LogBlocked(ip, "ANOMALY",
+			fmt.Sprintf("%s blocked for %dm - behavior score %.2f (%s)", key, config.FlagMinutes, score, details))
+		return
+	}
+	fw.logger.LogAnomaly(ip, score, details, fmt.Sprintf("rate limit x%.2f for %dm", config.LimitFactor, config.FlagMinutes))
+}
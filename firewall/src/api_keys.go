@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAPIKeyHeader  = "X-API-Key"
+	DefaultAPIKeysFile   = "/var/log/shared/firewall/api_keys.json"
+	APIKeyCheckInterval  = 5 * time.Second
+	apiKeyPrefix         = "dck_"
+	apiKeyRandomBytes    = 24
+	apiKeyFingerprintLen = 8
+)
+
+var (
+	errAPIClientExists  = errors.New("API client already exists")
+	errUnknownAPIClient = errors.New("unknown API client")
+)
+
+// APIKeyConfig recognizes chat bots and integrations by the key they send
+// in Header. Keys are registered in File, which holds only their SHA-256,
+// or through the admin API, and map to named clients that are governed
+// apart from anonymous traffic: a client's requests skip the per-IP rate
+// limit, which is made for people, and count instead against the client's
+// own max_attempts_per_minute across all its addresses. Clients get their
+// own stats, and quotas per api_key count per client. A key that isn't
+// registered is ignored, or refused with 401 when RejectInvalid is set.
+type APIKeyConfig struct {
+	Enabled       bool   `json:"enabled"`
+	Header        string `json:"header"`
+	File          string `json:"file"`
+	RejectInvalid bool   `json:"reject_invalid"`
+}
+
+func normalizeAPIKeyConfig(config APIKeyConfig) APIKeyConfig {
+	config.Header = strings.TrimSpace(config.Header)
+	if config.Header == "" {
+		config.Header = DefaultAPIKeyHeader
+	}
+	if config.File == "" {
+		config.File = DefaultAPIKeysFile
+	}
+	return config
+}
+
+func (fw *Firewall) apiKeyConfig() APIKeyConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.APIKeys
+}
+
+// APIClient is one registered key, as stored in the keys file.
+type APIClient struct {
+	Name                 string    `json:"name"`
+	KeySHA256            string    `json:"key_sha256"`
+	MaxAttemptsPerMinute int       `json:"max_attempts_per_minute"`
+	Disabled             bool      `json:"disabled,omitempty"`
+	Created              time.Time `json:"created"`
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyStore holds the registered clients of the keys file.
+type APIKeyStore struct {
+	mutex   sync.RWMutex
+	path    string
+	modTime time.Time
+	clients []APIClient
+}
+
+func NewAPIKeyStore() *APIKeyStore {
+	return &APIKeyStore{}
+}
+
+// Lookup returns the enabled client whose key is key.
+func (ks *APIKeyStore) Lookup(key string) (APIClient, bool) {
+	hash := []byte(hashAPIKey(key))
+
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	for _, client := range ks.clients {
+		if subtle.ConstantTimeCompare(hash, []byte(client.KeySHA256)) == 1 {
+			return client, !client.Disabled
+		}
+	}
+	return APIClient{}, false
+}
+
+func (ks *APIKeyStore) Clients() []APIClient {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	return append([]APIClient(nil), ks.clients...)
+}
+
+// Refresh reloads path when it is new or changed on disk. A missing file
+// is an empty one.
+func (ks *APIKeyStore) Refresh(path string) error {
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		ks.mutex.Lock()
+		ks.path, ks.modTime, ks.clients = path, time.Time{}, nil
+		ks.mutex.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ks.mutex.RLock()
+	unchanged := ks.path == path && ks.modTime.Equal(stat.ModTime())
+	ks.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var clients []APIClient
+	if err := json.Unmarshal(data, &clients); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	for i := range clients {
+		clients[i].Name = strings.ToLower(strings.TrimSpace(clients[i].Name))
+		clients[i].KeySHA256 = strings.ToLower(clients[i].KeySHA256)
+	}
+
+	ks.mutex.Lock()
+	ks.path, ks.modTime, ks.clients = path, stat.ModTime(), clients
+	ks.mutex.Unlock()
+	return nil
+}
+
+// update applies change to the clients and writes them to path.
+func (ks *APIKeyStore) update(path string, change func(clients []APIClient) ([]APIClient, error)) error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	clients, err := change(append([]APIClient(nil), ks.clients...))
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(clients, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	ks.path, ks.clients = path, clients
+	if stat, err := os.Stat(path); err == nil {
+		ks.modTime = stat.ModTime()
+	}
+	return nil
+}
+
+// Create registers a client under a new random key, which is returned and
+// not kept anywhere.
+func (ks *APIKeyStore) Create(path, name string, maxAttemptsPerMinute int, now time.Time) (string, error) {
+	random := make([]byte, apiKeyRandomBytes)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(random)
+
+	err := ks.update(path, func(clients []APIClient) ([]APIClient, error) {
+		for _, client := range clients {
+			if client.Name == name {
+				return nil, errAPIClientExists
+			}
+		}
+		return append(clients, APIClient{Name: name, KeySHA256: hashAPIKey(key), MaxAttemptsPerMinute: maxAttemptsPerMinute, Created: now.UTC()}), nil
+	})
+	return key, err
+}
+
+// Revoke removes the client called name.
+func (ks *APIKeyStore) Revoke(path, name string) error {
+	return ks.update(path, func(clients []APIClient) ([]APIClient, error) {
+		for i, client := range clients {
+			if client.Name == name {
+				return append(clients[:i], clients[i+1:]...), nil
+			}
+		}
+		return nil, errUnknownAPIClient
+	})
+}
+
+func (fw *Firewall) apiKeyWatcher() {
+	ticker := time.NewTicker(APIKeyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if config := fw.apiKeyConfig(); config.Enabled {
+			if err := fw.apiKeys.Refresh(config.File); err != nil {
+				fw.logErrorRateLimited("api_keys", "API_KEY", "Failed to load API keys: %v", err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-fw.shutdown:
+			return
+		}
+	}
+}
+
+func init() {
+	RegisterMiddleware(Middleware{Name: "api_key", Stage: StageRequest, Handle: apiKeyMiddleware})
+}
+
+// apiKeyMiddleware recognizes the request's API client and applies the
+// client's own rate limit. It must run before trust_cookie, which lets
+// recognized clients past the per-IP rate limit.
+func apiKeyMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	config := fw.apiKeyConfig()
+	key := ms.Head.Header.Get(config.Header)
+	if !config.Enabled || key == "" {
+		return true
+	}
+	client, found := fw.apiKeys.Lookup(key)
+	if !found {
+		if !config.RejectInvalid {
+			ms.Record.Event("unrecognized API key")
+			return true
+		}
+		ms.Block("INVALID_API_KEY", "unregistered or disabled API key in "+config.Header)
+		fw.writeHTTPError(ms.Conn, ms.ConnID, http.StatusUnauthorized, "Invalid API key.", 0)
+		return false
+	}
+
+	ms.APIClient = &client
+	ms.Record.APIClient = client.Name
+	if ms.Whitelisted || client.MaxAttemptsPerMinute <= 0 {
+		return true
+	}
+	limit := fw.adaptive.Scale(client.MaxAttemptsPerMinute)
+	if attempts := fw.countAttempt("api_client:" + client.Name); attempts > limit {
+		ms.Block("API_KEY_RATE_LIMIT", fmt.Sprintf("%d/%d requests per minute from API client %s", attempts, limit, client.Name))
+		fw.writeHTTPError(ms.Conn, ms.ConnID, http.StatusTooManyRequests, "Too many requests for this API key.", time.Minute)
+		return false
+	}
+	return true
+}
+
+type apiClientStatus struct {
+	APIClient
+	Stats ProtocolStatsEntry `json:"stats"`
+}
+
+// handleAPIKeys lists the registered clients with their stats, registers
+// one with POST ?name=[&max_attempts_per_minute=], answering its key once,
+// and revokes one with DELETE ?name=.
+func (fw *Firewall) handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	config := fw.apiKeyConfig()
+	name := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("name")))
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		limit, err := strconv.Atoi(r.URL.Query().Get("max_attempts_per_minute"))
+		if r.URL.Query().Get("max_attempts_per_minute") == "" {
+			limit, err = 0, nil
+		}
+		if name == "" || err != nil || limit < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name is required and max_attempts_per_minute must be a count"})
+			return
+		}
+		key, err := fw.apiKeys.Create(config.File, name, limit, fw.clock.Now())
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errAPIClientExists) {
+				status = http.StatusConflict
+			}
+			writeJSON(w, status, map[string]string{"error": err.Error()})
+			return
+		}
+		if fw.logger != nil {
+			fw.logger.LogInfo("API_KEY", "Registered API client %s", name)
+		}
+		writeJSON(w, http.StatusCreated, map[string]string{"name": name, "key": key})
+		return
+	case http.MethodDelete:
+		if err := fw.apiKeys.Revoke(config.File, name); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errUnknownAPIClient) {
+				status = http.StatusNotFound
+			}
+			writeJSON(w, status, map[string]string{"error": err.Error()})
+			return
+		}
+		if fw.logger != nil {
+			fw.logger.LogInfo("API_KEY", "Revoked API client %s", name)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := fw.apiClientStats.Snapshot()
+	clients := []apiClientStatus{}
+	for _, client := range fw.apiKeys.Clients() {
+		client.KeySHA256 = client.KeySHA256[:min(len(client.KeySHA256), apiKeyFingerprintLen)]
+		clients = append(clients, apiClientStatus{APIClient: client, Stats: stats[client.Name]})
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"clients": clients})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAppealValidHours   = 24
+	DefaultAppealAllowMinutes = 60
+	MaxAppealAllowMinutes     = 7 * 24 * 60
+)
+
+// AppealConfig puts a signed appeal token on the block page shown to
+// auto-blocked clients (often innocent users behind a shared NAT). An admin
+// who receives the token can redeem it through the admin API to let that
+// client through for AllowMinutes.
+type AppealConfig struct {
+	Enabled      bool `json:"enabled"`
+	ValidHours   int  `json:"valid_hours"`
+	AllowMinutes int  `json:"allow_minutes"`
+}
+
+func normalizeAppealConfig(config AppealConfig) AppealConfig {
+	if config.ValidHours <= 0 {
+		config.ValidHours = DefaultAppealValidHours
+	}
+	if config.AllowMinutes <= 0 {
+		config.AllowMinutes = DefaultAppealAllowMinutes
+	}
+	return config
+}
+
+// Appeals signs and redeems appeal tokens and holds the resulting temporary
+// allowances. The signing key comes from APPEAL_SECRET; without it a random
+// key is used and tokens don't survive a restart.
+type Appeals struct {
+	secret []byte
+
+	mutex    sync.Mutex
+	allowed  map[string]time.Time
+	redeemed map[string]time.Time
+}
+
+func NewAppeals(secret string) *Appeals {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &Appeals{
+		secret:   key,
+		allowed:  make(map[string]time.Time),
+		redeemed: make(map[string]time.Time),
+	}
+}
+
+func (a *Appeals) sign(payload string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a token naming key, valid until validFor from now.
+func (a *Appeals) Issue(key string, validFor time.Duration, now time.Time) string {
+	payload := key + "|" + strconv.FormatInt(now.Add(validFor).Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + a.sign(payload)
+}
+
+// Verify checks that token is genuine and unexpired, without redeeming it,
+// and returns the key it names and its expiry.
+func (a *Appeals) Verify(token string, now time.Time) (string, time.Time, error) {
+	encoded, signature, found := strings.Cut(strings.TrimSpace(token), ".")
+	if !found {
+		return "", time.Time{}, fmt.Errorf("malformed token")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("malformed token")
+	}
+	payload := string(raw)
+	if !hmac.Equal([]byte(signature), []byte(a.sign(payload))) {
+		return "", time.Time{}, fmt.Errorf("invalid signature")
+	}
+
+	key, expiryField, found := strings.Cut(payload, "|")
+	expiryUnix, err := strconv.ParseInt(expiryField, 10, 64)
+	if !found || err != nil {
+		return "", time.Time{}, fmt.Errorf("malformed token")
+	}
+	expiry := time.Unix(expiryUnix, 0)
+	if now.After(expiry) {
+		return "", time.Time{}, fmt.Errorf("token expired at %s", expiry.UTC().Format(time.RFC3339))
+	}
+	return key, expiry, nil
+}
+
+// Redeem checks token and, if it is genuine, unexpired and not used before,
+// lets its key through until now+allowFor.
+func (a *Appeals) Redeem(token string, allowFor time.Duration, now time.Time) (string, time.Time, error) {
+	key, expiry, err := a.Verify(token, now)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	_, signature, _ := strings.Cut(strings.TrimSpace(token), ".")
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, used := a.redeemed[signature]; used {
+		return "", time.Time{}, fmt.Errorf("token already redeemed")
+	}
+	a.redeemed[signature] = expiry
+
+	until := now.Add(allowFor)
+	a.allowed[key] = until
+	return key, until, nil
+}
+
+func (a *Appeals) IsAllowed(key string, now time.Time) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	until, exists := a.allowed[key]
+	return exists && now.Before(until)
+}
+
+func (a *Appeals) Cleanup(now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for key, until := range a.allowed {
+		if now.After(until) {
+			delete(a.allowed, key)
+		}
+	}
+	for signature, expiry := range a.redeemed {
+		if now.After(expiry) {
+			delete(a.redeemed, signature)
+		}
+	}
+}
+
+func (fw *Firewall) appealConfig() AppealConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.Appeals
+}
+
+// rejectAutoBlocked answers a blocked client. Auto-blocked clients get a page
+// with an appeal token when appeals are enabled; everyone else goes through
+// rejectBlocked.
+func (fw *Firewall) rejectAutoBlocked(conn net.Conn, requestID, key string) {
+	remaining := fw.autoBlockRemaining(key)
+	config := fw.appealConfig()
+	if !config.Enabled || remaining == 0 {
+		fw.rejectBlocked(conn, requestID, http.StatusForbidden, "Access from your network has been blocked.", remaining)
+		return
+	}
+
+	drainRequest(conn)
+	data := newErrorPageData(conn, requestID, http.StatusForbidden,
+		"Access from your network has been blocked because of unusual traffic.", remaining)
+	data.AppealToken = fw.appeals.Issue(key, time.Duration(config.ValidHours)*time.Hour, fw.clock.Now())
+	fw.writeErrorPage(conn, data)
+}
+
+// grantAppeal lifts key's auto-block, including the copy persisted to the
+// blocked list by the DDoS auto-block.
+func (fw *Firewall) grantAppeal(key string) {
+	fw.attemptsMutex.Lock()
+	delete(fw.autoBlockedIPs, key)
+	delete(fw.hourlyAttempts, key)
+	delete(fw.loginFailures, key)
+	fw.attemptsMutex.Unlock()
+	fw.portScans.Forget(key)
+	fw.abuseReports.Forget(key)
+	fw.riskScores.Forget(key)
+
+	fw.removeFromBlockedList(key)
+}
+
+type appealRequest struct {
+	Token   string `json:"token"`
+	Minutes int    `json:"minutes"`
+}
+
+type appealResponse struct {
+	Key          string    `json:"key"`
+	AllowedUntil time.Time `json:"allowed_until"`
+}
+
+func (fw *Firewall) handleAppeal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req appealRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+
+	minutes := req.Minutes
+	if minutes <= 0 {
+		minutes = fw.appealConfig().AllowMinutes
+	}
+	minutes = min(minutes, MaxAppealAllowMinutes)
+
+	key, until, err := fw.appeals.Redeem(req.Token, time.Duration(minutes)*time.Minute, fw.clock.Now())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	fw.grantAppeal(key)
+
+	if fw.logger != nil {
+		fw.logger.LogInfo("APPEAL", "Appeal accepted for %s - allowed until %s", key, until.Format(time.RFC3339))
+	}
+	writeJSON(w, http.StatusOK, appealResponse{Key: key, AllowedUntil: until})
+}
@@ -0,0 +1,92 @@
+package main
+
+import "fmt"
+
+const DefaultASNDatabase = "/var/log/shared/firewall/GeoLite2-ASN.mmdb"
+
+// ASNRateLimit replaces max_attempts_per_minute for clients announced by
+// ASN, e.g. a stricter limit for bulletproof hosting networks.
+type ASNRateLimit struct {
+	ASN                  uint32 `json:"asn"`
+	MaxAttemptsPerMinute int    `json:"max_attempts_per_minute"`
+}
+
+func normalizeASNRateLimits(limits []ASNRateLimit) []ASNRateLimit {
+	valid := make([]ASNRateLimit, 0, len(limits))
+	for _, limit := range limits {
+		if limit.ASN != 0 && limit.MaxAttemptsPerMinute > 0 {
+			valid = append(valid, limit)
+		}
+	}
+	return valid
+}
+
+// lookupASN returns the autonomous system announcing ip (or the network of an
+// aggregation key), if the ASN database is loaded and knows it.
+func (fw *Firewall) lookupASN(ipOrKey string) (uint32, string, bool) {
+	record, found := fw.asnDB.Lookup(lookupIP(ipOrKey))
+	if !found {
+		return 0, "", false
+	}
+	fields, ok := record.(map[string]interface{})
+	if !ok {
+		return 0, "", false
+	}
+	asn := mmdbUint(fields["autonomous_system_number"])
+	org, _ := fields["autonomous_system_organization"].(string)
+	return uint32(asn), org, asn != 0
+}
+
+// asnPolicy returns the rules that apply per ASN, so callers can skip the
+// lookup when none are configured.
+func (fw *Firewall) asnPolicy() ([]uint32, []ASNRateLimit) {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.BlockedASNs, fw.rules.ASNRateLimits
+}
+
+// isBlockedASN reports whether ip belongs to one of blocked_asns, and which.
+func (fw *Firewall) isBlockedASN(ip string) (uint32, string, bool) {
+	blocked, _ := fw.asnPolicy()
+	if len(blocked) == 0 {
+		return 0, "", false
+	}
+
+	asn, org, found := fw.lookupASN(ip)
+	if !found {
+		return 0, "", false
+	}
+	for _, blockedASN := range blocked {
+		if asn == blockedASN {
+			return asn, org, true
+		}
+	}
+	return 0, "", false
+}
+
+// asnRateLimit returns the per-minute limit override for key's ASN.
+func (fw *Firewall) asnRateLimit(key string) (int, bool) {
+	_, limits := fw.asnPolicy()
+	if len(limits) == 0 {
+		return 0, false
+	}
+
+	asn, _, found := fw.lookupASN(key)
+	if !found {
+		return 0, false
+	}
+	for _, limit := range limits {
+		if limit.ASN == asn {
+			return limit.MaxAttemptsPerMinute, true
+		}
+	}
+	return 0, false
+}
+
+func formatASN(asn uint32, org string) string {
+	if org == "" {
+		return fmt.Sprintf("AS%d", asn)
+	}
+	return fmt.Sprintf("AS%d (%s)", asn, org)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BenchConfig describes a load/attack run. Each scenario runs when its rate
+// or count is positive; all of them run at the same time so legit traffic is
+// measured while the firewall is under attack.
+type BenchConfig struct {
+	Target      string
+	Host        string
+	Duration    time.Duration
+	Timeout     time.Duration
+	Concurrency int
+
+	LegitRate   int
+	LegitPath   string
+	LegitSource string
+
+	FloodRate   int
+	FloodPath   string
+	FloodSource string
+
+	Slowloris         int
+	SlowlorisInterval time.Duration
+}
+
+// benchScenario counts outcomes for one kind of traffic. A connection counts
+// as blocked when the firewall refused it (403, 421, 429, 503) or closed it
+// without answering.
+type benchScenario struct {
+	attempts atomic.Int64
+	allowed  atomic.Int64
+	blocked  atomic.Int64
+	errors   atomic.Int64
+	latency  *LatencyHistogram
+
+	holdMutex sync.Mutex
+	held      []time.Duration
+}
+
+func newBenchScenario() *benchScenario {
+	return &benchScenario{latency: NewLatencyHistogram()}
+}
+
+type BenchScenarioReport struct {
+	Attempts  int64   `json:"attempts"`
+	Allowed   int64   `json:"allowed"`
+	Blocked   int64   `json:"blocked"`
+	Errors    int64   `json:"errors"`
+	BlockRate float64 `json:"block_rate"`
+	P50       float64 `json:"p50_ms"`
+	P90       float64 `json:"p90_ms"`
+	P99       float64 `json:"p99_ms"`
+
+	// Slowloris only: how long connections stayed open before the
+	// firewall cut them off, and how many outlived the run.
+	MedianHoldSeconds float64 `json:"median_hold_seconds,omitempty"`
+	StillOpen         int64   `json:"still_open,omitempty"`
+}
+
+func (bs *benchScenario) report() BenchScenarioReport {
+	snapshot := bs.latency.Snapshot()
+	report := BenchScenarioReport{
+		Attempts: bs.attempts.Load(),
+		Allowed:  bs.allowed.Load(),
+		Blocked:  bs.blocked.Load(),
+		Errors:   bs.errors.Load(),
+		P50:      snapshot.P50,
+		P90:      snapshot.P90,
+		P99:      snapshot.P99,
+	}
+	if answered := report.Allowed + report.Blocked; answered > 0 {
+		report.BlockRate = float64(report.Blocked) / float64(answered)
+	}
+
+	bs.holdMutex.Lock()
+	held := append([]time.Duration(nil), bs.held...)
+	bs.holdMutex.Unlock()
+	if len(held) > 0 {
+		sort.Slice(held, func(i, j int) bool { return held[i] < held[j] })
+		report.MedianHoldSeconds = held[len(held)/2].Seconds()
+	}
+	return report
+}
+
+func benchDialer(source string, timeout time.Duration) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout}
+	if source != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(source)}
+	}
+	return dialer
+}
+
+func benchRequest(host, path string, legit bool) string {
+	var request strings.Builder
+	fmt.Fprintf(&request, "GET %s HTTP/1.1\r\nHost: %s\r\n", path, host)
+	if legit {
+		request.WriteString("User-Agent: Mozilla/5.0 (X11; Linux x86_64) firewall-bench\r\n")
+		request.WriteString("Accept: text/html,application/json;q=0.9,*/*;q=0.8\r\nAccept-Language: en\r\n")
+	}
+	request.WriteString("Connection: close\r\n\r\n")
+	return request.String()
+}
+
+func isFirewallRefusal(status int) bool {
+	switch status {
+	case http.StatusForbidden, http.StatusMisdirectedRequest, http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// runBenchRequest makes one request on a fresh connection and records the
+// outcome and the time to the status line.
+func runBenchRequest(config BenchConfig, scenario *benchScenario, source, path string, legit bool) {
+	scenario.attempts.Add(1)
+	started := time.Now()
+
+	conn, err := benchDialer(source, config.Timeout).Dial("tcp", config.Target)
+	if err != nil {
+		scenario.errors.Add(1)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(config.Timeout))
+
+	if _, err := conn.Write([]byte(benchRequest(config.Host, path, legit))); err != nil {
+		scenario.blocked.Add(1)
+		return
+	}
+
+	statusLine, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			scenario.errors.Add(1)
+		} else {
+			scenario.blocked.Add(1)
+		}
+		return
+	}
+	scenario.latency.Observe(time.Since(started))
+
+	fields := strings.Fields(statusLine)
+	status := 0
+	if len(fields) >= 2 {
+		status, _ = strconv.Atoi(fields[1])
+	}
+	if isFirewallRefusal(status) {
+		scenario.blocked.Add(1)
+	} else {
+		scenario.allowed.Add(1)
+	}
+}
+
+// runBenchSlowloris holds a connection open by sending one more header line
+// every interval, never finishing the request.
+func runBenchSlowloris(config BenchConfig, scenario *benchScenario, deadline time.Time) {
+	scenario.attempts.Add(1)
+	started := time.Now()
+
+	conn, err := benchDialer(config.FloodSource, config.Timeout).Dial("tcp", config.Target)
+	if err != nil {
+		scenario.errors.Add(1)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n", config.Host)
+	go func() {
+		// Anything the firewall sends back ends the connection for us.
+		buf := make([]byte, 512)
+		conn.SetReadDeadline(deadline.Add(time.Second))
+		conn.Read(buf)
+		conn.Close()
+	}()
+
+	for n := 0; time.Now().Before(deadline); n++ {
+		time.Sleep(min(config.SlowlorisInterval, time.Until(deadline)))
+		if !time.Now().Before(deadline) {
+			break
+		}
+		if _, err := fmt.Fprintf(conn, "X-Bench-%d: %d\r\n", n, n); err != nil {
+			held := time.Since(started)
+			scenario.holdMutex.Lock()
+			scenario.held = append(scenario.held, held)
+			scenario.holdMutex.Unlock()
+			scenario.blocked.Add(1)
+			return
+		}
+	}
+	scenario.allowed.Add(1)
+}
+
+// runRated starts fn rate times a second until deadline, with at most
+// concurrency calls in flight; ticks that find no free slot are dropped.
+func runRated(rate, concurrency int, deadline time.Time, wg *sync.WaitGroup, fn func()) {
+	defer wg.Done()
+
+	slots := make(chan struct{}, concurrency)
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+
+	var inFlight sync.WaitGroup
+	for now := range ticker.C {
+		if !now.Before(deadline) {
+			break
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			continue
+		}
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			defer func() { <-slots }()
+			fn()
+		}()
+	}
+	inFlight.Wait()
+}
+
+func runBench(config BenchConfig) map[string]BenchScenarioReport {
+	deadline := time.Now().Add(config.Duration)
+	scenarios := make(map[string]*benchScenario)
+	var wg sync.WaitGroup
+
+	if config.LegitRate > 0 {
+		legit := newBenchScenario()
+		scenarios["legit"] = legit
+		wg.Add(1)
+		go runRated(config.LegitRate, config.Concurrency, deadline, &wg, func() {
+			runBenchRequest(config, legit, config.LegitSource, config.LegitPath, true)
+		})
+	}
+
+	if config.FloodRate > 0 {
+		flood := newBenchScenario()
+		scenarios["flood"] = flood
+		wg.Add(1)
+		go runRated(config.FloodRate, config.Concurrency, deadline, &wg, func() {
+			runBenchRequest(config, flood, config.FloodSource, config.FloodPath, false)
+		})
+	}
+
+	if config.Slowloris > 0 {
+		slowloris := newBenchScenario()
+		scenarios["slowloris"] = slowloris
+		for i := 0; i < config.Slowloris; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runBenchSlowloris(config, slowloris, deadline)
+			}()
+		}
+	}
+
+	wg.Wait()
+
+	reports := make(map[string]BenchScenarioReport, len(scenarios))
+	for name, scenario := range scenarios {
+		report := scenario.report()
+		if name == "slowloris" {
+			report.StillOpen = report.Allowed
+		}
+		reports[name] = report
+	}
+	return reports
+}
+
+func runBenchCommand(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	var config BenchConfig
+	flags.StringVar(&config.Target, "target", "127.0.0.1:5001", "firewall address to test")
+	flags.StringVar(&config.Host, "host", "", "Host header (default: the target)")
+	flags.DurationVar(&config.Duration, "duration", 10*time.Second, "how long to run")
+	flags.DurationVar(&config.Timeout, "timeout", 5*time.Second, "per-connection timeout")
+	flags.IntVar(&config.Concurrency, "concurrency", 200, "maximum in-flight connections per scenario")
+	flags.IntVar(&config.LegitRate, "legit-rate", 5, "legitimate requests per second")
+	flags.StringVar(&config.LegitPath, "legit-path", "/", "path requested by legitimate clients")
+	flags.StringVar(&config.LegitSource, "legit-source", "", "local address for legitimate clients")
+	flags.IntVar(&config.FloodRate, "flood-rate", 0, "flood connections per second")
+	flags.StringVar(&config.FloodPath, "flood-path", "/", "path requested by the flood")
+	flags.StringVar(&config.FloodSource, "flood-source", "", "local address for flood and slowloris connections")
+	flags.IntVar(&config.Slowloris, "slowloris", 0, "number of slowloris connections")
+	flags.DurationVar(&config.SlowlorisInterval, "slowloris-interval", 10*time.Second, "delay between slowloris header lines")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if config.Host == "" {
+		config.Host = config.Target
+	}
+	if config.Concurrency <= 0 || config.Duration <= 0 || config.SlowlorisInterval <= 0 {
+		fmt.Fprintln(os.Stderr, "duration, concurrency and slowloris-interval must be positive")
+		return 2
+	}
+	if config.LegitRate <= 0 && config.FloodRate <= 0 && config.Slowloris <= 0 {
+		fmt.Fprintln(os.Stderr, "nothing to do: set -legit-rate, -flood-rate or -slowloris")
+		return 2
+	}
+
+	fmt.Fprintf(os.Stderr, "Running against %s for %v...\n", config.Target, config.Duration)
+	reports := runBench(config)
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(reports)
+		return 0
+	}
+
+	fmt.Printf("%-10s %9s %9s %9s %7s %8s %9s %9s %9s\n", "scenario", "attempts", "allowed", "blocked", "errors", "blocked%", "p50 ms", "p90 ms", "p99 ms")
+	for _, name := range []string{"legit", "flood", "slowloris"} {
+		report, exists := reports[name]
+		if !exists {
+			continue
+		}
+		fmt.Printf("%-10s %9d %9d %9d %7d %7.1f%% %9.1f %9.1f %9.1f\n", name, report.Attempts, report.Allowed, report.Blocked,
+			report.Errors, report.BlockRate*100, report.P50, report.P90, report.P99)
+	}
+	if report, exists := reports["slowloris"]; exists {
+		fmt.Printf("slowloris: %d still open at the end, median time before cut-off %.1fs\n", report.StillOpen, report.MedianHoldSeconds)
+	}
+	return 0
+}
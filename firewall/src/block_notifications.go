@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	DefaultBlockNotificationsPath = "/var/log/shared/firewall/blocks.json"
+	DefaultBlockLiftsPath         = "/var/log/shared/firewall/unblock.json"
+
+	BlockSourceAuto        = "auto"
+	BlockSourceBlockedIPs  = "blocked_ips"
+	BlockSourceAlwaysBlock = "always_block"
+
+	// MaxBlockLiftsSize bounds the lift file the frontend drops.
+	MaxBlockLiftsSize = 1 << 20
+)
+
+// BlockNotificationsConfig keeps Path, in the shared volume, listing every
+// active block for the DockerChat admin frontend: auto-blocks, blocked_ips
+// and always_block. The file is rewritten within a second of any change,
+// expiries included. To lift blocks the frontend writes a JSON array of the
+// listed IPs to LiftPath; the firewall lifts those that came from auto-blocks
+// or blocked_ips, the way a granted appeal does, and deletes the file.
+type BlockNotificationsConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Path     string `json:"path"`
+	LiftPath string `json:"lift_path"`
+}
+
+func normalizeBlockNotificationsConfig(config BlockNotificationsConfig) BlockNotificationsConfig {
+	if config.Path == "" {
+		config.Path = DefaultBlockNotificationsPath
+	}
+	if config.LiftPath == "" {
+		config.LiftPath = DefaultBlockLiftsPath
+	}
+	return config
+}
+
+func (fw *Firewall) blockNotificationsConfig() BlockNotificationsConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.BlockNotifications
+}
+
+// BlockNotice is one active block in blocks.json. ExpiresAt is null for
+// blocks that last until lifted.
+type BlockNotice struct {
+	IP        string     `json:"ip"`
+	Reason    string     `json:"reason"`
+	Source    string     `json:"source"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type blockNotificationsFile struct {
+	UpdatedAt time.Time     `json:"updated_at"`
+	Blocks    []BlockNotice `json:"blocks"`
+}
+
+// activeBlocks lists the blocks in force at now, sorted by IP.
+func (fw *Firewall) activeBlocks(now time.Time) []BlockNotice {
+	blocks := []BlockNotice{}
+
+	fw.attemptsMutex.RLock()
+	for key, until := range fw.autoBlockedIPs {
+		if !now.Before(until) {
+			continue
+		}
+		reason := fw.autoBlockReasons[key]
+		if reason == "" {
+			reason = "AUTO_BLOCK"
+		}
+		expires := until.UTC()
+		blocks = append(blocks, BlockNotice{IP: key, Reason: reason, Source: BlockSourceAuto, ExpiresAt: &expires})
+	}
+	fw.attemptsMutex.RUnlock()
+
+	fw.rulesMutex.RLock()
+	for source, list := range map[string]RuleEntryList{
+		BlockSourceBlockedIPs:  fw.rules.BlockedIPs,
+		BlockSourceAlwaysBlock: fw.rules.AlwaysBlock,
+	} {
+		for _, entry := range list {
+			if !entry.ExpiresAt.IsZero() && !now.Before(entry.ExpiresAt) {
+				continue
+			}
+			notice := BlockNotice{IP: entry.Entry, Reason: entry.Comment, Source: source}
+			if notice.Reason == "" {
+				notice.Reason = source
+			}
+			if !entry.ExpiresAt.IsZero() {
+				expires := entry.ExpiresAt.UTC()
+				notice.ExpiresAt = &expires
+			}
+			blocks = append(blocks, notice)
+		}
+	}
+	fw.rulesMutex.RUnlock()
+
+	sort.Slice(blocks, func(i, j int) bool {
+		if blocks[i].IP != blocks[j].IP {
+			return blocks[i].IP < blocks[j].IP
+		}
+		return blocks[i].Source < blocks[j].Source
+	})
+	return blocks
+}
+
+// applyBlockLifts lifts the blocks listed in the lift file and removes it.
+func (fw *Firewall) applyBlockLifts(config BlockNotificationsConfig) error {
+	data, err := os.ReadFile(config.LiftPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer os.Remove(config.LiftPath)
+	if len(data) > MaxBlockLiftsSize {
+		return fmt.Errorf("%s is larger than %d bytes", config.LiftPath, MaxBlockLiftsSize)
+	}
+
+	var ips []string
+	if err := json.Unmarshal(data, &ips); err != nil {
+		return fmt.Errorf("%s is not a JSON array of IPs: %v", config.LiftPath, err)
+	}
+	for _, ip := range ips {
+		fw.grantAppeal(ip)
+		if fw.logger != nil {
+			fw.logger.LogInfo("BLOCKS", "Block on %s lifted from the admin frontend", ip)
+		}
+	}
+	return nil
+}
+
+// syncBlockNotifications applies pending lifts, then rewrites the blocks
+// file when the active blocks differ from last, the blocks last written. It
+// returns the blocks now on disk.
+func (fw *Firewall) syncBlockNotifications(config BlockNotificationsConfig, last []byte) ([]byte, error) {
+	if err := fw.applyBlockLifts(config); err != nil {
+		fw.logErrorRateLimited("block_lifts", "BLOCKS", "Failed to apply block lifts: %v", err)
+	}
+
+	now := fw.clock.Now()
+	blocks := fw.activeBlocks(now)
+	current, err := json.Marshal(blocks)
+	if err != nil {
+		return last, err
+	}
+	if last != nil && string(current) == string(last) {
+		return last, nil
+	}
+
+	data, err := json.Marshal(blockNotificationsFile{UpdatedAt: now.UTC(), Blocks: blocks})
+	if err != nil {
+		return last, err
+	}
+	if err := writeFileAtomic(config.Path, data, 0644); err != nil {
+		return last, err
+	}
+	return current, nil
+}
+
+func (fw *Firewall) blockNotificationsWatcher() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var last []byte
+	var path string
+	for {
+		select {
+		case <-fw.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		config := fw.blockNotificationsConfig()
+		if !config.Enabled {
+			last = nil
+			continue
+		}
+		if config.Path != path {
+			last, path = nil, config.Path
+		}
+		written, err := fw.syncBlockNotifications(config, last)
+		if err != nil {
+			fw.logErrorRateLimited("block_notifications", "BLOCKS", "Failed to write %s: %v", config.Path, err)
+		}
+		last = written
+	}
+}
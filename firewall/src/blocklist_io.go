@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	BlocklistFormatPlain = "plain"
+	BlocklistFormatNginx = "nginx"
+	BlocklistFormatCSV   = "csv"
+
+	MaxBlocklistImportSize = 16 << 20
+)
+
+// BlockEntry is one member of the effective block set.
+type BlockEntry struct {
+	Entry   string
+	Source  string
+	Expires time.Time
+	Comment string
+}
+
+// rulesBlockEntries lists the blocked_ips of the rules as BlockEntries.
+func rulesBlockEntries(blocked RuleEntryList) []BlockEntry {
+	entries := make([]BlockEntry, 0, len(blocked))
+	for _, blockedIP := range blocked {
+		entries = append(entries, BlockEntry{Entry: blockedIP.Entry, Source: "rules", Expires: blockedIP.ExpiresAt, Comment: blockedIP.Comment})
+	}
+	return entries
+}
+
+func validBlocklistFormat(format string) bool {
+	switch format {
+	case BlocklistFormatPlain, BlocklistFormatNginx, BlocklistFormatCSV:
+		return true
+	}
+	return false
+}
+
+// normalizeBlockEntry canonicalizes an IP or CIDR ("10.1.2.3/8" becomes
+// "10.0.0.0/8"), so imports dedupe against existing entries.
+func normalizeBlockEntry(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return "", false
+		}
+		return ipNet.String(), true
+	}
+	if ip := net.ParseIP(value); ip != nil {
+		return ip.String(), true
+	}
+	return "", false
+}
+
+// parseBlocklist reads entries in the given format. Lines that aren't an IP
+// or CIDR are returned separately; nginx "allow" lines and "deny all" are
+// skipped, and a CSV header row is ignored.
+func parseBlocklist(r io.Reader, format string) ([]string, []string, error) {
+	var entries, invalid []string
+	add := func(value string) {
+		if entry, ok := normalizeBlockEntry(value); ok {
+			entries = append(entries, entry)
+		} else {
+			invalid = append(invalid, value)
+		}
+	}
+
+	if format == BlocklistFormatCSV {
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		reader.Comment = '#'
+		for row := 0; ; row++ {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(record) == 0 || strings.TrimSpace(record[0]) == "" {
+				continue
+			}
+			if _, ok := normalizeBlockEntry(record[0]); !ok && row == 0 {
+				continue
+			}
+			add(record[0])
+		}
+		return entries, invalid, nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if format == BlocklistFormatNginx {
+			fields := strings.Fields(strings.TrimSuffix(line, ";"))
+			if len(fields) != 2 || fields[0] != "deny" || fields[1] == "all" {
+				continue
+			}
+			line = fields[1]
+		}
+		add(line)
+	}
+	return entries, invalid, scanner.Err()
+}
+
+func writeBlocklist(w io.Writer, format string, entries []BlockEntry) error {
+	switch format {
+	case BlocklistFormatCSV:
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"entry", "source", "expires", "comment"})
+		for _, entry := range entries {
+			expires := ""
+			if !entry.Expires.IsZero() {
+				expires = entry.Expires.UTC().Format(time.RFC3339)
+			}
+			writer.Write([]string{entry.Entry, entry.Source, expires, entry.Comment})
+		}
+		writer.Flush()
+		return writer.Error()
+	case BlocklistFormatNginx:
+		for _, entry := range entries {
+			if _, err := fmt.Fprintf(w, "deny %s;\n", entry.Entry); err != nil {
+				return err
+			}
+		}
+	default:
+		for _, entry := range entries {
+			if _, err := fmt.Fprintln(w, entry.Entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergeBlockedIPs adds entries to current (or replaces it), keeping the
+// existing order and dropping duplicates. Entries already in current keep
+// their metadata. It returns how many were new.
+func mergeBlockedIPs(current, entries RuleEntryList, replace bool) (RuleEntryList, int) {
+	var merged RuleEntryList
+	if !replace {
+		merged = append(merged, current...)
+	}
+	seen := make(map[string]bool, len(merged)+len(entries))
+	for _, entry := range merged {
+		seen[entry.Entry] = true
+	}
+
+	existing := make(map[string]RuleEntry, len(current))
+	for _, entry := range current {
+		existing[entry.Entry] = entry
+	}
+
+	added := 0
+	for _, entry := range entries {
+		if seen[entry.Entry] {
+			continue
+		}
+		seen[entry.Entry] = true
+		if previous, ok := existing[entry.Entry]; ok {
+			merged = append(merged, previous)
+			continue
+		}
+		merged = append(merged, entry)
+		added++
+	}
+	return merged, added
+}
+
+// importedEntries stamps imported blocklist entries with who imported them
+// and when.
+func importedEntries(entries []string, createdBy string, now time.Time) RuleEntryList {
+	list := make(RuleEntryList, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, RuleEntry{Entry: entry, CreatedBy: createdBy, CreatedAt: now.UTC()})
+	}
+	return list
+}
+
+// effectiveBlockSet is the blocked list from the rules plus auto-blocks still
+// in force.
+func (fw *Firewall) effectiveBlockSet() []BlockEntry {
+	fw.rulesMutex.RLock()
+	entries := rulesBlockEntries(fw.rules.BlockedIPs)
+	listed := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		listed[entry.Entry] = true
+	}
+	fw.rulesMutex.RUnlock()
+
+	now := fw.clock.Now()
+	var autoBlocked []BlockEntry
+	fw.attemptsMutex.RLock()
+	for key, expiry := range fw.autoBlockedIPs {
+		if now.Before(expiry) && !listed[key] {
+			autoBlocked = append(autoBlocked, BlockEntry{Entry: key, Source: "auto_block", Expires: expiry})
+		}
+	}
+	fw.attemptsMutex.RUnlock()
+
+	sort.Slice(autoBlocked, func(i, j int) bool {
+		return autoBlocked[i].Entry < autoBlocked[j].Entry
+	})
+	return append(entries, autoBlocked...)
+}
+
+// importBlocklist merges entries into the rules' blocked list and saves it.
+func (fw *Firewall) importBlocklist(entries []string, replace bool) (int, int, error) {
+	fw.rulesMutex.Lock()
+	defer fw.rulesMutex.Unlock()
+
+	merged, added := mergeBlockedIPs(fw.rules.BlockedIPs, importedEntries(entries, "admin-api", fw.clock.Now()), replace)
+
+	updated := *fw.rules
+	updated.BlockedIPs = merged
+	data, err := json.MarshalIndent(&updated, "", "  ")
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := fw.writeRulesFile(data); err != nil {
+		return 0, 0, err
+	}
+
+	fw.rules = &updated
+	fw.parsedRules = ParseRules(fw.rules)
+	return added, len(merged), nil
+}
+
+type blocklistImportResponse struct {
+	Added   int      `json:"added"`
+	Total   int      `json:"total"`
+	Invalid []string `json:"invalid,omitempty"`
+}
+
+// handleBlocklist exports the effective block set on GET and imports into the
+// rules' blocked list on POST (?mode=replace to replace rather than merge).
+// ?format= picks plain (default), nginx or csv.
+func (fw *Firewall) handleBlocklist(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = BlocklistFormatPlain
+	}
+	if !validBlocklistFormat(format) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format must be plain, nginx or csv"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		contentType := "text/plain; charset=utf-8"
+		if format == BlocklistFormatCSV {
+			contentType = "text/csv; charset=utf-8"
+		}
+		w.Header().Set("Content-Type", contentType)
+		writeBlocklist(w, format, fw.effectiveBlockSet())
+
+	case http.MethodPost:
+		entries, invalid, err := parseBlocklist(http.MaxBytesReader(w, r.Body, MaxBlocklistImportSize), format)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		added, total, err := fw.importBlocklist(entries, r.URL.Query().Get("mode") == "replace")
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		if fw.logger != nil {
+			fw.logger.LogInfo("RULES", "Imported %s blocklist - %d new entries, %d total, %d invalid lines skipped", format, added, total, len(invalid))
+		}
+		writeJSON(w, http.StatusOK, blocklistImportResponse{Added: added, Total: total, Invalid: invalid})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	DefaultBodyInspectionMaxBodyBytes         = 1 << 20
+	DefaultBodyInspectionMaxDecompressedBytes = 4 << 20
+	DefaultBodyInspectionMaxExpansionRatio    = 100
+)
+
+var (
+	errBodyEncoding      = errors.New("unsupported content encoding")
+	errBodyCorrupt       = errors.New("corrupt compressed body")
+	errDecompressionBomb = errors.New("decompressed body over its limit")
+
+	gzipMagic = []byte{0x1f, 0x8b, 0x08}
+)
+
+// BodyInspection holds requests to Paths (prefixes, every path if empty)
+// back until their body is read, for policies that read body. It only
+// holds anything while such policies exist, globally or for the request's
+// tenant. Bodies compressed with gzip or deflate, by Content-Encoding or
+// recognisably gzip without it, are inflated first, to no more than
+// MaxDecompressedBytes and MaxExpansionRatio times their size as sent.
+// Requests whose body is over MaxBodyBytes as sent, or inflates past
+// either limit, are refused with 413 rather than inspected in part; bodies
+// in encodings the firewall cannot read, with 415. Whitelisted clients are
+// not held.
+type BodyInspection struct {
+	Enabled              bool     `json:"enabled"`
+	Paths                []string `json:"paths"`
+	MaxBodyBytes         int64    `json:"max_body_bytes"`
+	MaxDecompressedBytes int64    `json:"max_decompressed_bytes"`
+	MaxExpansionRatio    float64  `json:"max_expansion_ratio"`
+}
+
+func normalizeBodyInspection(inspection BodyInspection) BodyInspection {
+	if inspection.MaxBodyBytes <= 0 {
+		inspection.MaxBodyBytes = DefaultBodyInspectionMaxBodyBytes
+	}
+	if inspection.MaxDecompressedBytes <= 0 {
+		inspection.MaxDecompressedBytes = DefaultBodyInspectionMaxDecompressedBytes
+	}
+	if inspection.MaxExpansionRatio < 1 {
+		inspection.MaxExpansionRatio = DefaultBodyInspectionMaxExpansionRatio
+	}
+	return inspection
+}
+
+func (fw *Firewall) bodyInspection() BodyInspection {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.BodyInspection
+}
+
+func hasBodyPolicies(policies []compiledPolicy) bool {
+	for _, policy := range policies {
+		if policy.Stage == StageBody {
+			return true
+		}
+	}
+	return false
+}
+
+// inspectsBody reports whether the request ms is checking, to path, is
+// held for its body.
+func (fw *Firewall) inspectsBody(inspection BodyInspection, ms *MiddlewareState, path string) bool {
+	if !inspection.Enabled || ms.Whitelisted {
+		return false
+	}
+	covered := len(inspection.Paths) == 0
+	for _, prefix := range inspection.Paths {
+		if strings.HasPrefix(path, prefix) {
+			covered = true
+			break
+		}
+	}
+	if !covered {
+		return false
+	}
+	return hasBodyPolicies(fw.policies()) || ms.Tenant != nil && hasBodyPolicies(ms.Tenant.policies)
+}
+
+// inspectBody decodes a held request body and runs the body policies on
+// it, answering the client itself when the request is refused. err is why
+// the body could not be read, if it could not.
+func (fw *Firewall) inspectBody(inspection BodyInspection, header http.Header, body []byte, err error, ms *MiddlewareState) bool {
+	if err == nil {
+		body, err = decodeBody(inspection, header.Get("Content-Encoding"), body)
+	}
+	if err != nil {
+		status, reason, message := http.StatusBadRequest, "BODY_MALFORMED", "Malformed request body."
+		switch {
+		case errors.Is(err, errBodyTooLarge):
+			status, reason, message = http.StatusRequestEntityTooLarge, "BODY_TOO_LARGE", "Request body too large."
+		case errors.Is(err, errDecompressionBomb):
+			status, reason, message = http.StatusRequestEntityTooLarge, "DECOMPRESSION_BOMB", "Request body too large."
+		case errors.Is(err, errBodyEncoding):
+			status, reason, message = http.StatusUnsupportedMediaType, "BODY_ENCODING", "Unsupported request body encoding."
+		}
+		ms.Block(reason, fmt.Sprintf("%s %s: %v", ms.IP, ms.Head.Path(), err))
+		fw.writeHTTPError(ms.Conn, ms.ConnID, status, message, 0)
+		return false
+	}
+
+	ms.Body = body
+	defer func() { ms.Body = nil }()
+	if !fw.applyPolicies(fw.policies(), StageBody, ms) {
+		return false
+	}
+	return ms.Tenant == nil || fw.applyPolicies(ms.Tenant.policies, StageBody, ms)
+}
+
+// decodeBody undoes encoding, a Content-Encoding list, on body. Inflating
+// stops at the smaller of the decompressed size and expansion limits.
+func decodeBody(inspection BodyInspection, encoding string, body []byte) ([]byte, error) {
+	var codings []string
+	for _, coding := range strings.Split(encoding, ",") {
+		if coding = strings.ToLower(strings.TrimSpace(coding)); coding != "" && coding != "identity" {
+			codings = append(codings, coding)
+		}
+	}
+	if len(codings) == 0 && bytes.HasPrefix(body, gzipMagic) {
+		codings = []string{"gzip"}
+	}
+	if len(codings) == 0 {
+		return body, nil
+	}
+
+	limit, limitName := inspection.MaxDecompressedBytes, "max_decompressed_bytes"
+	if byRatio := int64(inspection.MaxExpansionRatio * float64(len(body))); byRatio < limit {
+		limit, limitName = byRatio, "max_expansion_ratio"
+	}
+	// Codings are listed in the order they were applied.
+	for i := len(codings) - 1; i >= 0; i-- {
+		var reader io.Reader
+		var err error
+		switch codings[i] {
+		case "gzip", "x-gzip":
+			reader, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			// Deflate is meant to be zlib-wrapped, but some clients send
+			// raw deflate.
+			if reader, err = zlib.NewReader(bytes.NewReader(body)); err != nil {
+				reader, err = flate.NewReader(bytes.NewReader(body)), nil
+			}
+		default:
+			return nil, fmt.Errorf("%w %q", errBodyEncoding, codings[i])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errBodyCorrupt, err)
+		}
+		decoded, err := io.ReadAll(io.LimitReader(reader, limit+1))
+		if int64(len(decoded)) > limit {
+			return nil, fmt.Errorf("%w: inflates past %s (%d bytes)", errDecompressionBomb, limitName, limit)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errBodyCorrupt, err)
+		}
+		body = decoded
+	}
+	return body, nil
+}
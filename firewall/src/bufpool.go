@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+const (
+	CopyBufferSize       = 32 * 1024
+	MaxPooledRequestSize = 64 * 1024
+)
+
+// poolBuffers turns the pools off when false, so benchmarks can measure
+// what they save.
+var poolBuffers = true
+
+var readerPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReaderSize(nil, BufferSize)
+	},
+}
+
+var requestBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, BufferSize)
+		return &buf
+	},
+}
+
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, CopyBufferSize)
+		return &buf
+	},
+}
+
+func acquireReader(r io.Reader) *bufio.Reader {
+	if !poolBuffers {
+		return bufio.NewReaderSize(r, BufferSize)
+	}
+	reader := readerPool.Get().(*bufio.Reader)
+	reader.Reset(r)
+	return reader
+}
+
+func releaseReader(reader *bufio.Reader) {
+	if !poolBuffers {
+		return
+	}
+	reader.Reset(nil)
+	readerPool.Put(reader)
+}
+
+func acquireRequestBuffer() []byte {
+	if !poolBuffers {
+		return make([]byte, 0, BufferSize)
+	}
+	return (*requestBufferPool.Get().(*[]byte))[:0]
+}
+
+// releaseRequestBuffer returns buf to the pool. Buffers that grew past
+// MaxPooledRequestSize are dropped so one huge request doesn't pin memory.
+func releaseRequestBuffer(buf []byte) {
+	if !poolBuffers || buf == nil || cap(buf) > MaxPooledRequestSize {
+		return
+	}
+	buf = buf[:0]
+	requestBufferPool.Put(&buf)
+}
+
+func acquireCopyBuffer() *[]byte {
+	if !poolBuffers {
+		buf := make([]byte, CopyBufferSize)
+		return &buf
+	}
+	return copyBufferPool.Get().(*[]byte)
+}
+
+func releaseCopyBuffer(buf *[]byte) {
+	if !poolBuffers {
+		return
+	}
+	copyBufferPool.Put(buf)
+}
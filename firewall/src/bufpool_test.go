@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// benchmarkPools runs benchmark with the buffer pools on and off, so
+//
+//	go test -run '^$' -bench . -benchmem
+//
+// shows what the pools save per connection.
+func benchmarkPools(b *testing.B, benchmark func(b *testing.B)) {
+	for _, pooled := range []bool{true, false} {
+		name := "pooled"
+		if !pooled {
+			name = "unpooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			poolBuffers = pooled
+			defer func() { poolBuffers = true }()
+			b.ReportAllocs()
+			benchmark(b)
+		})
+	}
+}
+
+func BenchmarkParseRequestHead(b *testing.B) {
+	request := []byte("POST /api/messages?channel=general HTTP/1.1\r\n" +
+		"Host: chat.example\r\n" +
+		"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0\r\n" +
+		"Accept: application/json\r\n" +
+		"Accept-Language: en-US,en;q=0.5\r\n" +
+		"Content-Type: application/json\r\n" +
+		"Content-Length: 2\r\n" +
+		"Cookie: session=0123456789abcdef\r\n\r\n{}")
+
+	benchmarkPools(b, func(b *testing.B) {
+		source := bytes.NewReader(request)
+		for i := 0; i < b.N; i++ {
+			source.Reset(request)
+			reader := acquireReader(source)
+			head, err := parseRequestHead(reader)
+			if err != nil {
+				b.Fatal(err)
+			}
+			head.Release()
+			releaseReader(reader)
+		}
+	})
+}
+
+func BenchmarkHandleConnection(b *testing.B) {
+	benchmarkPools(b, func(b *testing.B) {
+		h := newTestHarness(b, Rules{MaxAttemptsPerMinute: 1 << 30})
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			// A minute apart, the requests stay under the per-IP flood
+			// and hourly limits.
+			h.clock.Advance(time.Minute)
+			if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+				b.Fatalf("request %d got %d", i+1, status)
+			}
+		}
+	})
+}
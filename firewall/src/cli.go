@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const DefaultRulesFile = "/var/log/shared/firewall/rules.json"
+
+// runCommand handles the command-line verbs; with no arguments the firewall
+// just runs.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "blocklist":
+		return runBlocklistCommand(args[1:])
+	case "bench":
+		return runBenchCommand(args[1:])
+	case "top":
+		return runTopCommand(args[1:])
+	case "query":
+		return runQueryCommand(args[1:])
+	case "admin":
+		return runAdminCommand(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\nusage: firewall [blocklist import|export | bench | top | query | admin]\n", args[0])
+	return 2
+}
+
+func runBlocklistCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "import" && args[0] != "export") {
+		fmt.Fprintln(os.Stderr, "usage: firewall blocklist import|export [-format plain|nginx|csv] [-rules path] [-replace] [file]")
+		return 2
+	}
+	verb := args[0]
+
+	flags := flag.NewFlagSet("blocklist "+verb, flag.ContinueOnError)
+	format := flags.String("format", BlocklistFormatPlain, "plain, nginx or csv")
+	rulesPath := flags.String("rules", DefaultRulesFile, "rules file to read and update")
+	replace := flags.Bool("replace", false, "replace the blocked list instead of merging (import)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if !validBlocklistFormat(*format) {
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		return 2
+	}
+
+	data, err := os.ReadFile(*rulesPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read rules: %v\n", err)
+		return 1
+	}
+	var rules Rules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse rules: %v\n", err)
+		return 1
+	}
+
+	if verb == "export" {
+		if err := writeBlocklist(os.Stdout, *format, rulesBlockEntries(rules.BlockedIPs)); err != nil {
+			fmt.Fprintf(os.Stderr, "export failed: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	var input io.Reader = os.Stdin
+	if flags.NArg() > 0 && flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open %s: %v\n", flags.Arg(0), err)
+			return 1
+		}
+		defer file.Close()
+		input = file
+	}
+
+	entries, invalid, err := parseBlocklist(input, *format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse blocklist: %v\n", err)
+		return 1
+	}
+	for _, line := range invalid {
+		fmt.Fprintf(os.Stderr, "skipping invalid entry %q\n", line)
+	}
+
+	merged, added := mergeBlockedIPs(rules.BlockedIPs, importedEntries(entries, "cli", time.Now()), *replace)
+	rules.BlockedIPs = merged
+
+	key, err := loadRulesKey()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	out, err := json.MarshalIndent(&rules, "", "  ")
+	if err == nil {
+		err = writeSignedRules(*rulesPath, out, key)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save rules: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("%d new entries, %d total\n", added, len(merged))
+	return 0
+}
+
+// runAdminCommand sends one request to the admin API of a running firewall
+// and prints the answer, e.g. "firewall admin DELETE /blocklist?ip=...". It
+// authenticates and signs like the server expects from the ADMIN_*
+// variables, so mutations work when replay protection is on.
+func runAdminCommand(args []string) int {
+	flags := flag.NewFlagSet("admin", flag.ContinueOnError)
+	addr := flags.String("admin", getEnv("ADMIN_ADDR", DefaultAdminAddr), "admin API address, host:port or unix:/path")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 2 || flags.NArg() > 3 {
+		fmt.Fprintln(os.Stderr, "usage: firewall admin [-admin addr] METHOD /path [body file, - for stdin]")
+		return 2
+	}
+	if *addr == "off" {
+		fmt.Fprintln(os.Stderr, "the admin API is disabled (ADMIN_ADDR=off); set -admin")
+		return 2
+	}
+
+	var body []byte
+	if flags.NArg() == 3 {
+		var err error
+		if flags.Arg(2) == "-" {
+			body, err = io.ReadAll(os.Stdin)
+		} else {
+			body, err = os.ReadFile(flags.Arg(2))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read the body: %v\n", err)
+			return 1
+		}
+	}
+
+	resp, err := newAdminClient(*addr).do(strings.ToUpper(flags.Arg(0)), flags.Arg(1), body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to reach the admin API at %s: %v\n", *addr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode >= 300 {
+		fmt.Fprintf(os.Stderr, "%s %s: %s\n", flags.Arg(0), flags.Arg(1), resp.Status)
+		return 1
+	}
+	return 0
+}
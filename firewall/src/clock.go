@@ -0,0 +1,16 @@
+package main
+
+import "time"
+
+// Clock is where the firewall gets the time for rate-limit windows and block
+// expiries. Tests and the simulation endpoint substitute their own; socket
+// deadlines and latency measurements always use the real time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
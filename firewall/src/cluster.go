@@ -0,0 +1,466 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultClusterListen = ":7946"
+	DefaultClusterFanout = 3
+
+	ClusterVerdictAutoBlock = "auto_block"
+	ClusterVerdictSynFlood  = "syn_flood"
+
+	MaxGossipHops       = 3
+	MaxClusterMessage   = 1400
+	ClusterMaxClockSkew = time.Minute
+	clusterQueueSize    = 1024
+)
+
+// ClusterConfig makes firewall replicas share their verdicts: every
+// auto-block and SYN-flood verdict is sent over UDP to all Peers, and each
+// peer that hears a verdict first passes it on to Fanout random peers, so it
+// still spreads when some links are down. Messages are signed with
+// CLUSTER_SECRET, which every replica must share; without it the cluster
+// stays off. Listen is only read at startup; Peers can change at any time.
+//
+// With RateLimitSync the replicas also share per-IP connection counts every
+// SyncIntervalSeconds, so max_attempts_per_minute holds for the cluster as a
+// whole however the load balancer spreads a client: the leader (the lowest
+// node name heard from) adds up everyone's counts and sends the totals back,
+// and each replica only admits what the others have left of the budget.
+// Without fresh totals a replica falls back to its own counts.
+type ClusterConfig struct {
+	Enabled             bool     `json:"enabled"`
+	NodeName            string   `json:"node_name"`
+	Listen              string   `json:"listen"`
+	Peers               []string `json:"peers"`
+	Fanout              int      `json:"fanout"`
+	RateLimitSync       bool     `json:"rate_limit_sync"`
+	SyncIntervalSeconds int      `json:"sync_interval_seconds"`
+}
+
+func normalizeClusterConfig(config ClusterConfig) ClusterConfig {
+	if config.NodeName == "" {
+		config.NodeName, _ = os.Hostname()
+	}
+	if config.Listen == "" {
+		config.Listen = DefaultClusterListen
+	}
+	if config.Fanout <= 0 {
+		config.Fanout = DefaultClusterFanout
+	}
+	if config.SyncIntervalSeconds <= 0 {
+		config.SyncIntervalSeconds = DefaultSyncIntervalSeconds
+	}
+	return config
+}
+
+func (fw *Firewall) clusterConfig() ClusterConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.Cluster
+}
+
+// ClusterMessage is one datagram between replicas: a verdict (auto_block,
+// syn_flood), a heartbeat, or a chunk of rate-limit counters. A verdict's
+// Seconds is how long it still holds when sent, so replicas don't need
+// synchronized clocks to agree on when it ends.
+type ClusterMessage struct {
+	ID     string `json:"id"`
+	Node   string `json:"node"`
+	Kind   string `json:"kind"`
+	SentAt int64  `json:"sent_at"`
+	Hops   int    `json:"hops,omitempty"`
+
+	Key     string `json:"key,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Seconds int    `json:"seconds,omitempty"`
+
+	Round    int64          `json:"round,omitempty"`
+	Counters map[string]int `json:"counters,omitempty"`
+}
+
+type clusterPeer struct {
+	addr     string
+	lastSeen time.Time
+	received uint64
+}
+
+type clusterPeerInfo struct {
+	Node     string `json:"node"`
+	Addr     string `json:"addr"`
+	LastSeen string `json:"last_seen"`
+	Received uint64 `json:"received"`
+}
+
+// Cluster sends and receives verdicts for one replica.
+type Cluster struct {
+	secret []byte
+	conn   net.PacketConn
+	queue  chan ClusterMessage
+
+	mutex    sync.Mutex
+	seen     map[string]time.Time
+	peers    map[string]*clusterPeer
+	sent     uint64
+	received uint64
+	rejected uint64
+
+	counts *ClusterCounts
+}
+
+func NewCluster(secret string) *Cluster {
+	return &Cluster{
+		secret: []byte(secret),
+		queue:  make(chan ClusterMessage, clusterQueueSize),
+		seen:   make(map[string]time.Time),
+		peers:  make(map[string]*clusterPeer),
+		counts: NewClusterCounts(),
+	}
+}
+
+func (c *Cluster) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// encode returns the signature followed by the JSON verdict.
+func (c *Cluster) encode(verdict ClusterMessage) ([]byte, error) {
+	payload, err := json.Marshal(verdict)
+	if err != nil {
+		return nil, err
+	}
+	return append(c.sign(payload), payload...), nil
+}
+
+func (c *Cluster) decode(datagram []byte, now time.Time) (ClusterMessage, error) {
+	var verdict ClusterMessage
+	if len(datagram) <= sha256.Size {
+		return verdict, fmt.Errorf("short message")
+	}
+	signature, payload := datagram[:sha256.Size], datagram[sha256.Size:]
+	if !hmac.Equal(signature, c.sign(payload)) {
+		return verdict, fmt.Errorf("invalid signature")
+	}
+	if err := json.Unmarshal(payload, &verdict); err != nil {
+		return verdict, fmt.Errorf("malformed message")
+	}
+	sentAt := time.Unix(verdict.SentAt, 0)
+	if sentAt.Before(now.Add(-ClusterMaxClockSkew)) || sentAt.After(now.Add(ClusterMaxClockSkew)) {
+		return verdict, fmt.Errorf("stale message from %s", verdict.Node)
+	}
+	return verdict, nil
+}
+
+// firstSighting records a verdict ID and reports whether it is new. IDs are
+// remembered for twice the accepted clock skew, which covers any replay that
+// decode would still accept.
+func (c *Cluster) firstSighting(id string, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for seenID, at := range c.seen {
+		if now.Sub(at) > 2*ClusterMaxClockSkew {
+			delete(c.seen, seenID)
+		}
+	}
+	if _, seen := c.seen[id]; seen {
+		return false
+	}
+	c.seen[id] = now
+	return true
+}
+
+func newVerdictID() string {
+	id := make([]byte, 12)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// publishVerdict queues a local verdict for the other replicas. It never
+// blocks, so it is safe to call with attemptsMutex held; when the queue is
+// full the verdict is dropped.
+func (fw *Firewall) publishVerdict(kind, key, reason string, duration time.Duration) {
+	if fw.cluster == nil {
+		return
+	}
+	verdict := ClusterMessage{
+		ID:      newVerdictID(),
+		Kind:    kind,
+		Key:     key,
+		Reason:  reason,
+		Seconds: int(duration.Round(time.Second) / time.Second),
+	}
+	select {
+	case fw.cluster.queue <- verdict:
+	default:
+	}
+}
+
+// autoBlockLocked auto-blocks key until the given time and tells the other
+// replicas. Callers must hold attemptsMutex.
+func (fw *Firewall) autoBlockLocked(key, reason string, until time.Time) {
+	if current, exists := fw.autoBlockedIPs[key]; exists && current.After(until) {
+		return
+	}
+	fw.autoBlockedIPs[key] = until
+	fw.autoBlockReasons[key] = reason
+	fw.publishVerdict(ClusterVerdictAutoBlock, key, reason, until.Sub(fw.clock.Now()))
+}
+
+// startCluster opens the gossip socket when the cluster is enabled.
+func (fw *Firewall) startCluster() error {
+	config := fw.clusterConfig()
+	if !config.Enabled {
+		return nil
+	}
+	secret := os.Getenv("CLUSTER_SECRET")
+	if secret == "" {
+		return fmt.Errorf("cluster enabled but CLUSTER_SECRET is not set")
+	}
+
+	conn, err := net.ListenPacket("udp", config.Listen)
+	if err != nil {
+		return fmt.Errorf("cluster listen on %s: %v", config.Listen, err)
+	}
+	cluster := NewCluster(secret)
+	cluster.conn = conn
+	fw.cluster = cluster
+	fw.logger.LogStartup("Cluster node %s listening on %s with %d peers", config.NodeName, conn.LocalAddr(), len(config.Peers))
+
+	go func() {
+		<-fw.shutdown
+		conn.Close()
+	}()
+	go fw.clusterSender()
+	go fw.clusterReceiver()
+	go fw.clusterSyncWatcher()
+	return nil
+}
+
+func (fw *Firewall) clusterSender() {
+	for verdict := range fw.cluster.queue {
+		fw.broadcast(verdict, fw.clusterConfig().Peers)
+	}
+}
+
+// broadcast stamps a locally originated message and sends it to peers.
+func (fw *Firewall) broadcast(message ClusterMessage, peers []string) {
+	message.Node = fw.clusterConfig().NodeName
+	message.SentAt = fw.clock.Now().Unix()
+	if message.ID == "" {
+		message.ID = newVerdictID()
+	}
+	fw.cluster.firstSighting(message.ID, fw.clock.Now())
+	fw.sendMessage(message, peers, "")
+}
+
+// sendMessage sends a message to peers, skipping the one it came from.
+func (fw *Firewall) sendMessage(message ClusterMessage, peers []string, from string) {
+	datagram, err := fw.cluster.encode(message)
+	if err != nil || len(datagram) > MaxClusterMessage {
+		return
+	}
+
+	for _, peer := range peers {
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			fw.logErrorRateLimited("cluster_"+peer, "CLUSTER", "Bad peer address %s: %v", peer, err)
+			continue
+		}
+		if addr.String() == from {
+			continue
+		}
+		if _, err := fw.cluster.conn.WriteTo(datagram, addr); err != nil {
+			fw.logErrorRateLimited("cluster_"+peer, "CLUSTER", "Send to %s failed: %v", peer, err)
+			continue
+		}
+		fw.cluster.mutex.Lock()
+		fw.cluster.sent++
+		fw.cluster.mutex.Unlock()
+	}
+}
+
+func (fw *Firewall) clusterReceiver() {
+	buf := make([]byte, MaxClusterMessage+1)
+	for {
+		n, addr, err := fw.cluster.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-fw.shutdown:
+				return
+			default:
+				fw.logErrorRateLimited("cluster_receive", "CLUSTER", "Receive failed: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+		}
+		fw.handleClusterMessage(buf[:n], addr.String())
+	}
+}
+
+func (fw *Firewall) handleClusterMessage(datagram []byte, from string) {
+	now := fw.clock.Now()
+	verdict, err := fw.cluster.decode(datagram, now)
+	if err != nil {
+		fw.cluster.mutex.Lock()
+		fw.cluster.rejected++
+		fw.cluster.mutex.Unlock()
+		fw.logErrorRateLimited("cluster_reject_"+from, "CLUSTER", "Rejected message from %s: %v", from, err)
+		return
+	}
+
+	config := fw.clusterConfig()
+	if verdict.Node == config.NodeName {
+		return
+	}
+
+	fw.cluster.mutex.Lock()
+	fw.cluster.received++
+	peer, exists := fw.cluster.peers[verdict.Node]
+	if !exists && len(fw.cluster.peers) < MaxTrackedIPs {
+		peer = &clusterPeer{}
+		fw.cluster.peers[verdict.Node] = peer
+	}
+	if peer != nil && verdict.Hops == 0 {
+		peer.addr, peer.lastSeen = from, now
+	}
+	if peer != nil {
+		peer.received++
+	}
+	fw.cluster.mutex.Unlock()
+
+	if !fw.cluster.firstSighting(verdict.ID, now) {
+		return
+	}
+
+	switch verdict.Kind {
+	case ClusterHeartbeat:
+		return
+	case ClusterCounterReport:
+		fw.cluster.counts.AddReport(verdict.Node, verdict.Round, verdict.Counters, now)
+		return
+	case ClusterCounterTotals:
+		fw.cluster.counts.AddTotals(verdict.Round, verdict.Counters, now)
+		return
+	}
+
+	if verdict.Seconds <= 0 {
+		return
+	}
+	fw.applyVerdict(verdict, now)
+
+	if verdict.Hops < MaxGossipHops {
+		verdict.Hops++
+		fw.sendMessage(verdict, randomPeers(config.Peers, config.Fanout), from)
+	}
+}
+
+// applyVerdict enforces a peer's verdict locally. It is not published again
+// as a local one; gossip forwarding already spreads it.
+func (fw *Firewall) applyVerdict(verdict ClusterMessage, now time.Time) {
+	until := now.Add(time.Duration(verdict.Seconds) * time.Second)
+
+	switch verdict.Kind {
+	case ClusterVerdictAutoBlock:
+		fw.attemptsMutex.Lock()
+		if current, exists := fw.autoBlockedIPs[verdict.Key]; !exists || current.Before(until) {
+			fw.autoBlockedIPs[verdict.Key] = until
+			fw.autoBlockReasons[verdict.Key] = "PEER_" + verdict.Reason
+		}
+		fw.attemptsMutex.Unlock()
+	case ClusterVerdictSynFlood:
+		fw.synFloodMutex.Lock()
+		if current, exists := fw.peerSynFloods[verdict.Key]; !exists || current.Before(until) {
+			fw.peerSynFloods[verdict.Key] = until
+		}
+		fw.synFloodMutex.Unlock()
+	default:
+		return
+	}
+
+	if fw.logger != nil {
+		fw.logger.LogBlocked(verdict.Key, "PEER_"+verdictReason(verdict.Kind),
+			fmt.Sprintf("%s for %ds from node %s: %s", verdict.Kind, verdict.Seconds, verdict.Node, verdict.Reason))
+	}
+}
+
+func verdictReason(kind string) string {
+	if kind == ClusterVerdictSynFlood {
+		return "SYN_FLOOD"
+	}
+	return "AUTO_BLOCK"
+}
+
+// randomPeers picks up to n of peers.
+func randomPeers(peers []string, n int) []string {
+	shuffled := append([]string(nil), peers...)
+	for i := len(shuffled) - 1; i > 0; i-- {
+		j, _ := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		shuffled[i], shuffled[j.Int64()] = shuffled[j.Int64()], shuffled[i]
+	}
+	if len(shuffled) > n {
+		shuffled = shuffled[:n]
+	}
+	return shuffled
+}
+
+type clusterStatus struct {
+	Node     string            `json:"node"`
+	Leader   string            `json:"leader"`
+	Listen   string            `json:"listen"`
+	Peers    []string          `json:"peers"`
+	Heard    []clusterPeerInfo `json:"heard_from"`
+	Sent     uint64            `json:"sent"`
+	Received uint64            `json:"received"`
+	Rejected uint64            `json:"rejected"`
+}
+
+func (fw *Firewall) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if fw.cluster == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "cluster mode is off"})
+		return
+	}
+
+	config := fw.clusterConfig()
+	status := clusterStatus{
+		Node:   config.NodeName,
+		Listen: fw.cluster.conn.LocalAddr().String(),
+		Peers:  config.Peers,
+		Heard:  []clusterPeerInfo{},
+	}
+
+	status.Leader, _ = fw.clusterLeader()
+
+	fw.cluster.mutex.Lock()
+	for node, peer := range fw.cluster.peers {
+		status.Heard = append(status.Heard, clusterPeerInfo{
+			Node:     node,
+			Addr:     peer.addr,
+			LastSeen: peer.lastSeen.UTC().Format(time.RFC3339),
+			Received: peer.received,
+		})
+	}
+	status.Sent, status.Received, status.Rejected = fw.cluster.sent, fw.cluster.received, fw.cluster.rejected
+	fw.cluster.mutex.Unlock()
+
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ClusterHeartbeat     = "heartbeat"
+	ClusterCounterReport = "counters"
+	ClusterCounterTotals = "totals"
+
+	DefaultSyncIntervalSeconds = 5
+	MaxSyncedKeys              = 200
+	MinSyncedAttempts          = 2
+	countersPerMessage         = 20
+)
+
+type counterRound struct {
+	round  int64
+	counts map[string]int
+	at     time.Time
+}
+
+// ClusterCounts holds the per-IP connection counts exchanged for
+// rate_limit_sync. The leader keeps the latest report of every replica;
+// every replica keeps the leader's latest totals and its own counts as it
+// reported them, so it can tell how many connections the others saw.
+type ClusterCounts struct {
+	mutex   sync.Mutex
+	reports map[string]*counterRound
+	totals  counterRound
+	local   map[string]int
+}
+
+func NewClusterCounts() *ClusterCounts {
+	return &ClusterCounts{
+		reports: make(map[string]*counterRound),
+		local:   make(map[string]int),
+	}
+}
+
+// merge adds a chunk of counters to round, starting over when the chunk
+// belongs to a newer round than the one held.
+func (cr *counterRound) merge(round int64, counters map[string]int, now time.Time) {
+	if round < cr.round {
+		return
+	}
+	if round > cr.round || cr.counts == nil {
+		cr.round, cr.counts = round, make(map[string]int, len(counters))
+	}
+	for key, count := range counters {
+		cr.counts[key] = count
+	}
+	cr.at = now
+}
+
+// AddReport stores a chunk of a replica's counts.
+func (cc *ClusterCounts) AddReport(node string, round int64, counters map[string]int, now time.Time) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	report, exists := cc.reports[node]
+	if !exists {
+		if len(cc.reports) >= MaxTrackedIPs {
+			return
+		}
+		report = &counterRound{}
+		cc.reports[node] = report
+	}
+	report.merge(round, counters, now)
+}
+
+// AddTotals stores a chunk of the leader's cluster-wide counts.
+func (cc *ClusterCounts) AddTotals(round int64, counters map[string]int, now time.Time) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	cc.totals.merge(round, counters, now)
+}
+
+// SetLocal records the counts this replica just reported.
+func (cc *ClusterCounts) SetLocal(counts map[string]int) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	cc.local = counts
+}
+
+// Aggregate sums local with the reports received within maxAge, dropping
+// older ones, and keeps the result as the current totals.
+func (cc *ClusterCounts) Aggregate(round int64, local map[string]int, now time.Time, maxAge time.Duration) map[string]int {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	totals := make(map[string]int, len(local))
+	for key, count := range local {
+		totals[key] = count
+	}
+	for node, report := range cc.reports {
+		if now.Sub(report.at) > maxAge {
+			delete(cc.reports, node)
+			continue
+		}
+		for key, count := range report.counts {
+			totals[key] += count
+		}
+	}
+	cc.local = local
+	cc.totals = counterRound{round: round, counts: totals, at: now}
+	return totals
+}
+
+// Remote returns how many connections from key the other replicas saw over
+// the last minute, according to totals no older than maxAge.
+func (cc *ClusterCounts) Remote(key string, now time.Time, maxAge time.Duration) int {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	if cc.totals.counts == nil || now.Sub(cc.totals.at) > maxAge {
+		return 0
+	}
+	return max(0, cc.totals.counts[key]-cc.local[key])
+}
+
+func (fw *Firewall) syncInterval() time.Duration {
+	return time.Duration(fw.clusterConfig().SyncIntervalSeconds) * time.Second
+}
+
+// remoteAttempts is how many of key's connections over the last minute went
+// to other replicas, when rate_limit_sync is on.
+func (fw *Firewall) remoteAttempts(key string) int {
+	if fw.cluster == nil || !fw.clusterConfig().RateLimitSync {
+		return 0
+	}
+	return fw.cluster.counts.Remote(key, fw.clock.Now(), 3*fw.syncInterval())
+}
+
+// clusterLeader returns the replica that aggregates counters: the lowest
+// node name among this one and the peers heard from recently.
+func (fw *Firewall) clusterLeader() (string, string) {
+	config := fw.clusterConfig()
+	now := fw.clock.Now()
+	leader, addr := config.NodeName, ""
+
+	fw.cluster.mutex.Lock()
+	defer fw.cluster.mutex.Unlock()
+
+	for node, peer := range fw.cluster.peers {
+		if now.Sub(peer.lastSeen) <= 3*fw.syncInterval() && node < leader {
+			leader, addr = node, peer.addr
+		}
+	}
+	return leader, addr
+}
+
+// localRateCounts returns this replica's busiest keys over the last minute.
+func (fw *Firewall) localRateCounts() map[string]int {
+	now := fw.clock.Now()
+	counts := make(map[string]uint64)
+
+	fw.attemptsMutex.RLock()
+	for key, attempts := range fw.connectionAttempts {
+		if count := countSince(attempts, time.Minute, now); count >= MinSyncedAttempts {
+			counts[key] = uint64(count)
+		}
+	}
+	fw.attemptsMutex.RUnlock()
+
+	local := make(map[string]int, len(counts))
+	for _, entry := range topEntries(counts, MaxSyncedKeys) {
+		local[entry.Key] = int(entry.Count)
+	}
+	return local
+}
+
+// chunkCounters splits counts into pieces that fit in one datagram. There is
+// always at least one, so an empty round still reaches the peers.
+func chunkCounters(counts map[string]int) []map[string]int {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	chunks := []map[string]int{{}}
+	for _, key := range keys {
+		if len(chunks[len(chunks)-1]) == countersPerMessage {
+			chunks = append(chunks, map[string]int{})
+		}
+		chunks[len(chunks)-1][key] = counts[key]
+	}
+	return chunks
+}
+
+// syncRateCounters runs one exchange round: every replica sends a heartbeat
+// to all peers and its counts to the leader, and the leader sends the
+// cluster-wide totals back to everyone.
+func (fw *Firewall) syncRateCounters() {
+	config := fw.clusterConfig()
+	fw.broadcast(ClusterMessage{Kind: ClusterHeartbeat}, config.Peers)
+	if !config.RateLimitSync {
+		return
+	}
+
+	now := fw.clock.Now()
+	round := now.UnixNano()
+	local := fw.localRateCounts()
+
+	leader, addr := fw.clusterLeader()
+	if leader == config.NodeName {
+		totals := fw.cluster.counts.Aggregate(round, local, now, 3*fw.syncInterval())
+		for _, chunk := range chunkCounters(totals) {
+			fw.broadcast(ClusterMessage{Kind: ClusterCounterTotals, Round: round, Counters: chunk}, config.Peers)
+		}
+		return
+	}
+
+	fw.cluster.counts.SetLocal(local)
+	for _, chunk := range chunkCounters(local) {
+		fw.broadcast(ClusterMessage{Kind: ClusterCounterReport, Round: round, Counters: chunk}, []string{addr})
+	}
+}
+
+func (fw *Firewall) clusterSyncWatcher() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	elapsed := 0
+	for {
+		select {
+		case <-ticker.C:
+			elapsed++
+			if elapsed < fw.clusterConfig().SyncIntervalSeconds {
+				continue
+			}
+			elapsed = 0
+			fw.syncRateCounters()
+		case <-fw.shutdown:
+			return
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errConnectionKilled = errors.New("killed by operator")
+	errRequestRefused   = errors.New("later request refused")
+	errBodyRefused      = errors.New("request body refused")
+)
+
+// ActiveConnection is the live view of a proxied connection. Byte counts and
+// the last activity time are updated as data flows, so they can be read while
+// the connection is open.
+type ActiveConnection struct {
+	ID        string
+	IP        string
+	Port      int
+	StartedAt time.Time
+	BytesIn   atomic.Int64
+	BytesOut  atomic.Int64
+
+	upstream     atomic.Pointer[string]
+	lastActivity atomic.Int64
+	upgraded     atomic.Bool
+	idle         IdleTimeoutConfig
+	cancel       context.CancelCauseFunc
+}
+
+func (ac *ActiveConnection) SetUpstream(addr string) {
+	ac.upstream.Store(&addr)
+}
+
+func (ac *ActiveConnection) Upstream() string {
+	if addr := ac.upstream.Load(); addr != nil {
+		return *addr
+	}
+	return ""
+}
+
+func (ac *ActiveConnection) touch() {
+	ac.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (ac *ActiveConnection) IdleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, ac.lastActivity.Load()))
+}
+
+// MarkUpgraded records that the connection switched protocols (WebSocket).
+func (ac *ActiveConnection) MarkUpgraded() {
+	ac.upgraded.Store(true)
+}
+
+func (ac *ActiveConnection) Upgraded() bool {
+	return ac.upgraded.Load()
+}
+
+func (ac *ActiveConnection) IdleLimit() time.Duration {
+	return ac.idle.limit(ac.Upgraded())
+}
+
+// ConnectionRegistry tracks connections that passed the admission checks
+// until they close.
+type ConnectionRegistry struct {
+	mutex sync.RWMutex
+	conns map[string]*ActiveConnection
+}
+
+func NewConnectionRegistry() *ConnectionRegistry {
+	return &ConnectionRegistry{
+		conns: make(map[string]*ActiveConnection),
+	}
+}
+
+func (cr *ConnectionRegistry) Add(record *ConnectionRecord, cancel context.CancelCauseFunc) *ActiveConnection {
+	ac := &ActiveConnection{
+		ID:        record.ID,
+		IP:        record.IP,
+		Port:      record.Port,
+		StartedAt: record.StartedAt,
+		cancel:    cancel,
+	}
+	ac.lastActivity.Store(record.StartedAt.UnixNano())
+
+	cr.mutex.Lock()
+	cr.conns[ac.ID] = ac
+	cr.mutex.Unlock()
+	return ac
+}
+
+func (cr *ConnectionRegistry) Remove(id string) {
+	cr.mutex.Lock()
+	delete(cr.conns, id)
+	cr.mutex.Unlock()
+}
+
+// List returns the open connections, oldest first.
+func (cr *ConnectionRegistry) List() []*ActiveConnection {
+	cr.mutex.RLock()
+	conns := make([]*ActiveConnection, 0, len(cr.conns))
+	for _, ac := range cr.conns {
+		conns = append(conns, ac)
+	}
+	cr.mutex.RUnlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].StartedAt.Before(conns[j].StartedAt)
+	})
+	return conns
+}
+
+// Kill cancels the connection with the given ID, or every connection from ip
+// when id is empty. It returns the IDs that were cancelled.
+func (cr *ConnectionRegistry) Kill(id, ip string) []string {
+	cr.mutex.RLock()
+	var targets []*ActiveConnection
+	if id != "" {
+		if ac, exists := cr.conns[id]; exists {
+			targets = append(targets, ac)
+		}
+	} else {
+		for _, ac := range cr.conns {
+			if ac.IP == ip {
+				targets = append(targets, ac)
+			}
+		}
+	}
+	cr.mutex.RUnlock()
+
+	killed := make([]string, 0, len(targets))
+	for _, ac := range targets {
+		ac.cancel(errConnectionKilled)
+		killed = append(killed, ac.ID)
+	}
+	sort.Strings(killed)
+	return killed
+}
+
+// activityReader reads one direction of a proxied connection. Every read adds
+// to n, marks the connection active and pushes the socket deadlines forward
+// by the idle limit, so a transfer only times out once it stalls. The read
+// deadline on dst moves too: traffic one way keeps the other way's pending
+// read alive.
+type activityReader struct {
+	src, dst net.Conn
+	n        *atomic.Int64
+	live     *ActiveConnection
+}
+
+func (ar *activityReader) Read(p []byte) (int, error) {
+	ar.src.SetReadDeadline(time.Now().Add(ar.live.IdleLimit()))
+	n, err := ar.src.Read(p)
+	if n > 0 {
+		ar.n.Add(int64(n))
+		ar.live.touch()
+
+		deadline := time.Now().Add(ar.live.IdleLimit())
+		ar.dst.SetReadDeadline(deadline)
+		ar.dst.SetWriteDeadline(deadline)
+	}
+	return n, err
+}
+
+type connectionInfo struct {
+	ID       string `json:"id"`
+	IP       string `json:"ip"`
+	Port     int    `json:"port"`
+	Upstream string `json:"upstream,omitempty"`
+	Started  string `json:"started"`
+	Duration string `json:"duration"`
+	Idle     string `json:"idle"`
+	Upgraded bool   `json:"upgraded,omitempty"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+}
+
+type killRequest struct {
+	ID string `json:"id"`
+	IP string `json:"ip"`
+}
+
+func (fw *Firewall) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	infos := []connectionInfo{}
+	for _, ac := range fw.connections.List() {
+		infos = append(infos, connectionInfo{
+			ID:       ac.ID,
+			IP:       ac.IP,
+			Port:     ac.Port,
+			Upstream: ac.Upstream(),
+			Started:  ac.StartedAt.UTC().Format(time.RFC3339),
+			Duration: now.Sub(ac.StartedAt).Round(time.Millisecond).String(),
+			Idle:     ac.IdleFor(now).Round(time.Millisecond).String(),
+			Upgraded: ac.Upgraded(),
+			BytesIn:  ac.BytesIn.Load(),
+			BytesOut: ac.BytesOut.Load(),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"connections": infos})
+}
+
+// handleKillConnection closes one connection by ID, or all connections from an
+// IP, without touching the rules.
+func (fw *Firewall) handleKillConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req killRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	if (req.ID == "") == (req.IP == "") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "set exactly one of id or ip"})
+		return
+	}
+	if req.IP != "" && net.ParseIP(req.IP) == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "ip must be an IP address"})
+		return
+	}
+	if req.IP != "" {
+		req.IP = net.ParseIP(req.IP).String()
+	}
+
+	killed := fw.connections.Kill(req.ID, req.IP)
+	if len(killed) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no matching connection"})
+		return
+	}
+
+	if fw.logger != nil {
+		fw.logger.LogWarning("ADMIN", "Killed %d connection(s) by operator request: %v", len(killed), killed)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"killed": killed})
+}
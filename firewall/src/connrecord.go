@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	VerdictAllowed = "ALLOWED"
+	VerdictBlocked = "BLOCKED"
+	VerdictError   = "ERROR"
+)
+
+type ConnectionLogConfig struct {
+	DebugDetail bool `json:"debug_detail"`
+}
+
+// ConnectionRecord accumulates what happened to one client connection so it
+// can be logged as a single summary line when the connection closes.
+type ConnectionRecord struct {
+	ID        string
+	IP        string
+	Port      int
+	Hostname  string
+	StartedAt time.Time
+	Verdict   string
+	Reason    string
+	Rule      string
+	Protocol  string
+	Upstream  string
+	Canary    bool
+	Tenant    string
+	APIClient string
+	Requests  int
+	BytesIn   int64
+	BytesOut  int64
+	ParseTime time.Duration
+	DialTime  time.Duration
+	FirstByte time.Duration
+
+	// mutex guards detail, Verdict and Reason, which both directions of a
+	// proxied connection update.
+	mutex  sync.Mutex
+	detail []string
+}
+
+func newConnectionRecord(id, ip string, port int) *ConnectionRecord {
+	return &ConnectionRecord{
+		ID:        id,
+		IP:        ip,
+		Port:      port,
+		StartedAt: time.Now(),
+	}
+}
+
+// Event notes a step for the debug detail line, stamped with the time since
+// accept.
+func (cr *ConnectionRecord) Event(format string, args ...interface{}) {
+	event := fmt.Sprintf("+%s %s", time.Since(cr.StartedAt).Round(time.Microsecond), fmt.Sprintf(format, args...))
+	cr.mutex.Lock()
+	cr.detail = append(cr.detail, event)
+	cr.mutex.Unlock()
+}
+
+func (cr *ConnectionRecord) Block(reason string) {
+	cr.mutex.Lock()
+	cr.Verdict = VerdictBlocked
+	cr.Reason = reason
+	cr.mutex.Unlock()
+}
+
+func (cr *ConnectionRecord) Fail(reason string) {
+	cr.mutex.Lock()
+	cr.Verdict = VerdictError
+	cr.Reason = reason
+	cr.mutex.Unlock()
+}
+
+func (cr *ConnectionRecord) Summary() string {
+	verdict := cr.Verdict
+	if verdict == "" {
+		verdict = VerdictAllowed
+	}
+	if cr.Reason != "" {
+		verdict += " (" + cr.Reason + ")"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "IP: %s:%d", cr.IP, cr.Port)
+	if cr.Hostname != "" {
+		fmt.Fprintf(&b, " (%s)", cr.Hostname)
+	}
+	fmt.Fprintf(&b, " - Verdict: %s", verdict)
+	if cr.Tenant != "" {
+		fmt.Fprintf(&b, " - Tenant: %s", cr.Tenant)
+	}
+	if cr.APIClient != "" {
+		fmt.Fprintf(&b, " - API client: %s", cr.APIClient)
+	}
+	if cr.Rule != "" {
+		fmt.Fprintf(&b, " - Rule: %s", cr.Rule)
+	}
+	if cr.Protocol != "" {
+		fmt.Fprintf(&b, " - Protocol: %s", cr.Protocol)
+	}
+	if cr.Upstream != "" {
+		fmt.Fprintf(&b, " - Upstream: %s", cr.Upstream)
+		if cr.Canary {
+			b.WriteString(" (canary)")
+		}
+	}
+	fmt.Fprintf(&b, " - Requests: %d - Bytes in/out: %d/%d - Duration: %s",
+		cr.Requests, cr.BytesIn, cr.BytesOut, time.Since(cr.StartedAt).Round(time.Microsecond))
+	if cr.ParseTime > 0 {
+		fmt.Fprintf(&b, " - Parse: %s", cr.ParseTime.Round(time.Microsecond))
+	}
+	if cr.DialTime > 0 {
+		fmt.Fprintf(&b, " - Dial: %s", cr.DialTime.Round(time.Microsecond))
+	}
+	if cr.FirstByte > 0 {
+		fmt.Fprintf(&b, " - First byte: %s", cr.FirstByte.Round(time.Microsecond))
+	}
+	return b.String()
+}
+
+func (cr *ConnectionRecord) Detail() string {
+	return strings.Join(cr.detail, "; ")
+}
+
+func (fw *Firewall) connectionLogConfig() ConnectionLogConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.ConnectionLog
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CORSPolicy is enforced on requests under Paths that carry an Origin other
+// than the one they were sent to. Preflights are answered by the firewall;
+// cross-origin requests from origins, or with methods, the policy doesn't
+// allow are refused before reaching the chat. "*" in AllowedOrigins allows any
+// origin. Like host validation it applies to the first request on a
+// connection.
+type CORSPolicy struct {
+	Enabled          bool     `json:"enabled"`
+	Paths            []string `json:"paths"`
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAgeSeconds    int      `json:"max_age_seconds"`
+}
+
+func normalizeCORSPolicy(policy CORSPolicy) CORSPolicy {
+	if len(policy.Paths) == 0 {
+		policy.Paths = []string{"/api"}
+	}
+	for i, p := range policy.Paths {
+		policy.Paths[i] = normalizeRequestPath(p)
+	}
+	for i, origin := range policy.AllowedOrigins {
+		policy.AllowedOrigins[i] = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")
+	}
+	if len(policy.AllowedMethods) == 0 {
+		policy.AllowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	}
+	for i, method := range policy.AllowedMethods {
+		policy.AllowedMethods[i] = strings.ToUpper(strings.TrimSpace(method))
+	}
+	if len(policy.AllowedHeaders) == 0 {
+		policy.AllowedHeaders = []string{"Content-Type", "Authorization"}
+	}
+	for i, name := range policy.AllowedHeaders {
+		policy.AllowedHeaders[i] = http.CanonicalHeaderKey(strings.TrimSpace(name))
+	}
+	if policy.MaxAgeSeconds <= 0 {
+		policy.MaxAgeSeconds = 600
+	}
+	return policy
+}
+
+func (policy CORSPolicy) covers(requestPath string) bool {
+	normalized := normalizeRequestPath(requestPath)
+	for _, p := range policy.Paths {
+		if pathHasPrefix(normalized, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy CORSPolicy) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range policy.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy CORSPolicy) allowsMethod(method string) bool {
+	for _, allowed := range policy.AllowedMethods {
+		if allowed == method {
+			return true
+		}
+	}
+	// Simple methods need no listing, as in the CORS protocol itself.
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+func (policy CORSPolicy) allowsHeader(name string) bool {
+	name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+	for _, allowed := range policy.AllowedHeaders {
+		if allowed == "*" || allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isSameOrigin reports whether origin names the host the request was sent
+// to. Browsers send Origin on same-origin POSTs too.
+func isSameOrigin(origin, host string) bool {
+	parsed, err := url.Parse(origin)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	return strings.EqualFold(parsed.Host, host)
+}
+
+func isPreflight(head *RequestHead) bool {
+	return head.Method == http.MethodOptions && head.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// checkCORS applies the policy to a request head. It returns the reason to
+// refuse the request with, or "" when it may proceed; preflight reports
+// whether the firewall should answer it itself.
+func (policy CORSPolicy) checkCORS(head *RequestHead) (reason string, preflight bool) {
+	origin := head.Header.Get("Origin")
+	if !policy.Enabled || origin == "" || head.Opaque || !policy.covers(head.Path()) {
+		return "", false
+	}
+	if isSameOrigin(origin, head.Host()) {
+		return "", false
+	}
+	if !policy.allowsOrigin(origin) {
+		return "origin " + origin + " not allowed", false
+	}
+
+	if !isPreflight(head) {
+		if !policy.allowsMethod(head.Method) {
+			return "method " + head.Method + " not allowed from " + origin, false
+		}
+		return "", false
+	}
+
+	method := head.Header.Get("Access-Control-Request-Method")
+	if !policy.allowsMethod(method) {
+		return "method " + method + " not allowed from " + origin, true
+	}
+	for _, requested := range strings.Split(head.Header.Get("Access-Control-Request-Headers"), ",") {
+		if strings.TrimSpace(requested) != "" && !policy.allowsHeader(requested) {
+			return "header " + strings.TrimSpace(requested) + " not allowed from " + origin, true
+		}
+	}
+	return "", true
+}
+
+func (fw *Firewall) corsPolicy() CORSPolicy {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.CORS
+}
+
+// writeCORSPreflight answers an allowed preflight request.
+func (fw *Firewall) writeCORSPreflight(conn net.Conn, requestID string, policy CORSPolicy, head *RequestHead) {
+	origin := head.Header.Get("Origin")
+
+	var response bytes.Buffer
+	response.WriteString("HTTP/1.1 204 No Content\r\n")
+	if len(policy.AllowedOrigins) == 1 && policy.AllowedOrigins[0] == "*" && !policy.AllowCredentials {
+		response.WriteString("Access-Control-Allow-Origin: *\r\n")
+	} else {
+		fmt.Fprintf(&response, "Access-Control-Allow-Origin: %s\r\nVary: Origin\r\n", origin)
+	}
+	fmt.Fprintf(&response, "Access-Control-Allow-Methods: %s\r\n", strings.Join(policy.AllowedMethods, ", "))
+	fmt.Fprintf(&response, "Access-Control-Allow-Headers: %s\r\n", strings.Join(policy.AllowedHeaders, ", "))
+	if policy.AllowCredentials {
+		response.WriteString("Access-Control-Allow-Credentials: true\r\n")
+	}
+	fmt.Fprintf(&response, "Access-Control-Max-Age: %d\r\n", policy.MaxAgeSeconds)
+	if requestID != "" {
+		fmt.Fprintf(&response, "%s: %s\r\n", RequestIDHeader, requestID)
+	}
+	response.WriteString("Content-Length: 0\r\nConnection: close\r\n\r\n")
+
+	conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	conn.Write(response.Bytes())
+}
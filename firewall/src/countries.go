@@ -0,0 +1,220 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCountryDatabase = "/var/log/shared/firewall/GeoLite2-Country.mmdb"
+
+	CountryActionAllow = "allow"
+	CountryActionDeny  = "deny"
+)
+
+// CountryBudget caps the connections admitted per minute from one country.
+type CountryBudget struct {
+	Country                 string `json:"country"`
+	MaxConnectionsPerMinute int    `json:"max_connections_per_minute"`
+}
+
+// CountryPolicy filters clients by the country their IP is located in (ISO
+// 3166 codes, from country_database). With DefaultAction "deny" only
+// Allowed countries get in; with "allow" everyone but Blocked does. Clients
+// whose country is unknown get UnknownAction.
+//
+// Budgets cap the connections admitted per minute from a single country, to
+// blunt a botnet concentrated in one place without shutting that country
+// out: DefaultBudget applies to every country without its own entry in
+// Budgets (0: no cap).
+type CountryPolicy struct {
+	Enabled       bool            `json:"enabled"`
+	DefaultAction string          `json:"default_action"`
+	UnknownAction string          `json:"unknown_action"`
+	Allowed       []string        `json:"allowed"`
+	Blocked       []string        `json:"blocked"`
+	DefaultBudget int             `json:"default_budget"`
+	Budgets       []CountryBudget `json:"budgets"`
+}
+
+func normalizeCountryCodes(codes []string) []string {
+	valid := make([]string, 0, len(codes))
+	for _, code := range codes {
+		if code = strings.ToUpper(strings.TrimSpace(code)); len(code) == 2 {
+			valid = append(valid, code)
+		}
+	}
+	return valid
+}
+
+func normalizeCountryPolicy(policy CountryPolicy) CountryPolicy {
+	if policy.DefaultAction != CountryActionDeny {
+		policy.DefaultAction = CountryActionAllow
+	}
+	if policy.UnknownAction != CountryActionDeny {
+		policy.UnknownAction = CountryActionAllow
+	}
+	policy.Allowed = normalizeCountryCodes(policy.Allowed)
+	policy.Blocked = normalizeCountryCodes(policy.Blocked)
+	if policy.DefaultBudget < 0 {
+		policy.DefaultBudget = 0
+	}
+
+	budgets := make([]CountryBudget, 0, len(policy.Budgets))
+	for _, budget := range policy.Budgets {
+		budget.Country = strings.ToUpper(strings.TrimSpace(budget.Country))
+		if len(budget.Country) == 2 && budget.MaxConnectionsPerMinute > 0 {
+			budgets = append(budgets, budget)
+		}
+	}
+	policy.Budgets = budgets
+	return policy
+}
+
+func containsCountry(codes []string, country string) bool {
+	for _, code := range codes {
+		if code == country {
+			return true
+		}
+	}
+	return false
+}
+
+// Admits reports whether the policy lets country in at all.
+func (policy CountryPolicy) Admits(country string) bool {
+	switch {
+	case country == "":
+		return policy.UnknownAction == CountryActionAllow
+	case containsCountry(policy.Blocked, country):
+		return false
+	case containsCountry(policy.Allowed, country):
+		return true
+	}
+	return policy.DefaultAction == CountryActionAllow
+}
+
+// Budget returns the per-minute connection cap for country, 0 for none.
+func (policy CountryPolicy) Budget(country string) int {
+	for _, budget := range policy.Budgets {
+		if budget.Country == country {
+			return budget.MaxConnectionsPerMinute
+		}
+	}
+	return policy.DefaultBudget
+}
+
+func (fw *Firewall) countryPolicy() CountryPolicy {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.Countries
+}
+
+// lookupCountry returns the ISO code of the country ip is located in,
+// falling back to the country its network is registered in.
+func (fw *Firewall) lookupCountry(ip string) string {
+	record, found := fw.countryDB.Lookup(lookupIP(ip))
+	if !found {
+		return ""
+	}
+	fields, ok := record.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	for _, name := range []string{"country", "registered_country"} {
+		country, _ := fields[name].(map[string]interface{})
+		if code, _ := country["iso_code"].(string); code != "" {
+			return code
+		}
+	}
+	return ""
+}
+
+type countryWindow struct {
+	minute   time.Time
+	current  int
+	previous int
+}
+
+// CountryBudgets counts admitted connections per country over a sliding
+// minute, estimated from the current and previous minute's counts.
+type CountryBudgets struct {
+	mutex   sync.Mutex
+	windows map[string]*countryWindow
+}
+
+func NewCountryBudgets() *CountryBudgets {
+	return &CountryBudgets{
+		windows: make(map[string]*countryWindow),
+	}
+}
+
+func (cw *countryWindow) advance(now time.Time) {
+	minute := now.Truncate(time.Minute)
+	switch {
+	case minute.Equal(cw.minute):
+	case minute.Sub(cw.minute) == time.Minute:
+		cw.minute, cw.previous, cw.current = minute, cw.current, 0
+	default:
+		cw.minute, cw.previous, cw.current = minute, 0, 0
+	}
+}
+
+func (cw *countryWindow) count(now time.Time) int {
+	elapsed := float64(now.Sub(cw.minute)) / float64(time.Minute)
+	return cw.current + int(float64(cw.previous)*(1-elapsed))
+}
+
+// Admit counts one connection from country and reports whether it fits in
+// limit, along with the count over the last minute. Refused connections are
+// not counted.
+func (cb *CountryBudgets) Admit(country string, limit int, now time.Time) (bool, int) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	window, exists := cb.windows[country]
+	if !exists {
+		window = &countryWindow{minute: now.Truncate(time.Minute)}
+		cb.windows[country] = window
+	}
+	window.advance(now)
+
+	count := window.count(now)
+	if count >= limit {
+		return false, count
+	}
+	window.current++
+	return true, count + 1
+}
+
+// Count returns country's admitted connections over the last minute without
+// counting anything.
+func (cb *CountryBudgets) Count(country string, now time.Time) int {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	window, exists := cb.windows[country]
+	if !exists {
+		return 0
+	}
+	copied := *window
+	copied.advance(now)
+	return copied.count(now)
+}
+
+// Snapshot returns each country's admitted connections over the last minute,
+// busiest first.
+func (cb *CountryBudgets) Snapshot(now time.Time) []CountEntry {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	counts := make(map[string]uint64, len(cb.windows))
+	for country, window := range cb.windows {
+		window.advance(now)
+		if count := window.count(now); count > 0 {
+			counts[country] = uint64(count)
+		}
+	}
+	return topEntries(counts, 0)
+}
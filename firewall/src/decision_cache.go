@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultDecisionCacheTTLSeconds = 30
+
+// DecisionCacheConfig caches, per IP and for TTLSeconds, the verdict of the
+// checks that depend only on the rules and the loaded databases: blocked
+// ASNs, the country policy, IP lists, DNSBLs and reverse DNS deny rules.
+// Cached verdicts are dropped when the rules, an IP list or a GeoIP database
+// change. Auto-blocks, rate limits and risk scores change with every
+// connection and are always checked.
+type DecisionCacheConfig struct {
+	Enabled    bool `json:"enabled"`
+	TTLSeconds int  `json:"ttl_seconds"`
+}
+
+func normalizeDecisionCacheConfig(config DecisionCacheConfig) DecisionCacheConfig {
+	if config.TTLSeconds <= 0 {
+		config.TTLSeconds = DefaultDecisionCacheTTLSeconds
+	}
+	return config
+}
+
+func (fw *Firewall) decisionCacheConfig() DecisionCacheConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.DecisionCache
+}
+
+// StaticVerdict is the outcome of the cacheable checks for one IP. A
+// refused client has Reason, Details and Message set; an admitted one may
+// still owe a cookie challenge.
+type StaticVerdict struct {
+	Country           string
+	Reason            string
+	Details           string
+	Message           string
+	Group             string
+	Challenge         string
+	ChallengeValidFor time.Duration
+	ListedOnIPList    bool
+	ListedOnDNSBL     bool
+}
+
+func (sv StaticVerdict) Blocked() bool {
+	return sv.Reason != ""
+}
+
+// decisionRevision identifies what a verdict was computed from: the parsed
+// rules in force and the generation of the loaded lists and databases.
+type decisionRevision struct {
+	rules      *ParsedRules
+	generation uint64
+}
+
+type cachedDecision struct {
+	verdict  StaticVerdict
+	revision decisionRevision
+	expires  time.Time
+}
+
+// DecisionCache holds StaticVerdicts per IP.
+type DecisionCache struct {
+	generation atomic.Uint64
+
+	mutex   sync.Mutex
+	entries map[string]cachedDecision
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+}
+
+func NewDecisionCache() *DecisionCache {
+	return &DecisionCache{entries: make(map[string]cachedDecision)}
+}
+
+// Invalidate drops every cached verdict; call it when a list or database
+// the verdicts were computed from is replaced.
+func (dc *DecisionCache) Invalidate() {
+	dc.generation.Add(1)
+	dc.mutex.Lock()
+	clear(dc.entries)
+	dc.mutex.Unlock()
+}
+
+func (dc *DecisionCache) Get(ip string, rules *ParsedRules, now time.Time) (StaticVerdict, bool) {
+	dc.mutex.Lock()
+	entry, exists := dc.entries[ip]
+	dc.mutex.Unlock()
+
+	revision := decisionRevision{rules: rules, generation: dc.generation.Load()}
+	if !exists || entry.revision != revision || !now.Before(entry.expires) {
+		dc.misses.Add(1)
+		return StaticVerdict{}, false
+	}
+	dc.hits.Add(1)
+	return entry.verdict, true
+}
+
+// Put caches verdict, unless the inputs changed while it was computed.
+func (dc *DecisionCache) Put(ip string, verdict StaticVerdict, revision decisionRevision, expires time.Time) {
+	if revision.generation != dc.generation.Load() {
+		return
+	}
+
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	if _, exists := dc.entries[ip]; !exists && len(dc.entries) >= MaxTrackedIPs {
+		return
+	}
+	dc.entries[ip] = cachedDecision{verdict: verdict, revision: revision, expires: expires}
+}
+
+func (dc *DecisionCache) Cleanup(now time.Time) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	for ip, entry := range dc.entries {
+		if !now.Before(entry.expires) {
+			delete(dc.entries, ip)
+		}
+	}
+}
+
+// DecisionCacheStats is reported under /stats.
+type DecisionCacheStats struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+func (dc *DecisionCache) Stats() DecisionCacheStats {
+	dc.mutex.Lock()
+	entries := len(dc.entries)
+	dc.mutex.Unlock()
+
+	return DecisionCacheStats{Entries: entries, Hits: dc.hits.Load(), Misses: dc.misses.Load()}
+}
+
+func (fw *Firewall) currentParsedRules() *ParsedRules {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.parsedRules
+}
+
+// staticVerdict returns ip's verdict from the cache, or runs the checks and
+// caches the result when every answer they depend on is already known.
+func (fw *Firewall) staticVerdict(ip, hostname string) (StaticVerdict, bool) {
+	config := fw.decisionCacheConfig()
+	if !config.Enabled {
+		verdict, _ := fw.evaluateStaticRules(ip, hostname)
+		return verdict, false
+	}
+
+	now := fw.clock.Now()
+	revision := decisionRevision{rules: fw.currentParsedRules(), generation: fw.decisions.generation.Load()}
+	if verdict, cached := fw.decisions.Get(ip, revision.rules, now); cached {
+		return verdict, true
+	}
+	verdict, complete := fw.evaluateStaticRules(ip, hostname)
+	if complete {
+		fw.decisions.Put(ip, verdict, revision, now.Add(time.Duration(config.TTLSeconds)*time.Second))
+	}
+	return verdict, false
+}
+
+// evaluateStaticRules runs the cacheable checks in order, stopping at the
+// first refusal. complete is false while a DNSBL or reverse DNS answer for ip
+// is still pending, so that a verdict missing it isn't cached.
+func (fw *Firewall) evaluateStaticRules(ip, hostname string) (verdict StaticVerdict, complete bool) {
+	complete = true
+
+	if asn, org, blocked := fw.isBlockedASN(ip); blocked {
+		verdict.Reason, verdict.Details = "BLOCKED_ASN", formatASN(asn, org)+" is in blocked_asns"
+		verdict.Message = "Access from your network has been blocked."
+		return verdict, complete
+	}
+
+	countries := fw.countryPolicy()
+	if countries.Enabled || fw.groupsBlockCountries() {
+		verdict.Country = fw.lookupCountry(ip)
+	}
+	if countries.Enabled && !countries.Admits(verdict.Country) {
+		verdict.Reason, verdict.Details = "COUNTRY_DENIED", fmt.Sprintf("country %q not admitted", verdict.Country)
+		verdict.Message = "DockerChat is not available in your region."
+		return verdict, complete
+	}
+	if group, blocked := fw.groupBlockingCountry(verdict.Country); blocked {
+		verdict.Group = group
+		verdict.Reason, verdict.Details = "COUNTRY_DENIED", fmt.Sprintf("country %q blocked by rule group %s", verdict.Country, group)
+		verdict.Message = "DockerChat is not available in your region."
+		return verdict, complete
+	}
+
+	list, entry, listedOnIPList := fw.matchIPList(ip)
+	if listedOnIPList {
+		verdict.ListedOnIPList = true
+		if list.Action == IPListActionBlock {
+			verdict.Reason, verdict.Details = "LISTED_IP", fmt.Sprintf("%s is on the %s list (%s)", ip, list.Name, entry)
+			verdict.Message = "Access from your network has been blocked."
+			return verdict, complete
+		}
+		if list.Action == IPListActionChallenge {
+			verdict.Challenge = "on the " + list.Name + " list"
+			verdict.ChallengeValidFor = time.Duration(list.ChallengeValidHours) * time.Hour
+		}
+	}
+
+	result, dnsblConfig, listedOnDNSBL := fw.checkDNSBL(ip)
+	if dnsblConfig.Enabled && len(dnsblConfig.Zones) > 0 {
+		if _, known := fw.dnsbl.Cached(ip, fw.clock.Now()); !known {
+			complete = false
+		}
+	}
+	if listedOnDNSBL {
+		verdict.ListedOnDNSBL = true
+		if dnsblConfig.Action == DNSBLActionBlock {
+			verdict.Reason, verdict.Details = "DNSBL", fmt.Sprintf("%s is listed in %s (%s)", ip, result.Zone, result.Answer)
+			verdict.Message = "Access from your network has been blocked."
+			return verdict, complete
+		}
+		if dnsblConfig.Action == DNSBLActionChallenge && verdict.Challenge == "" {
+			verdict.Challenge = "listed in " + result.Zone
+			verdict.ChallengeValidFor = time.Duration(dnsblConfig.ChallengeValidHours) * time.Hour
+		}
+	}
+
+	if fw.reverseDNSConfig().Enabled {
+		if _, known := fw.rdns.Cached(ip, fw.clock.Now()); !known {
+			complete = false
+		}
+	}
+	if suffix, denied := fw.ptrDenied(hostname); denied {
+		verdict.Reason, verdict.Details = "PTR_DENY", fmt.Sprintf("%s resolves to %s, under %s", ip, hostname, suffix)
+		verdict.Message = "Access from your network has been blocked."
+	}
+	return verdict, complete
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DNSBLActionBlock     = "block"
+	DNSBLActionChallenge = "challenge"
+	DNSBLActionScore     = "score"
+
+	DNSBLErrorCacheTime = time.Minute
+)
+
+// DNSBLConfig looks first-seen client IPs up in DNS blocklists such as
+// zen.spamhaus.org. Lookups run in the background and answers are cached for
+// CacheMinutes, so known clients never wait on DNS. A first-seen client's
+// connection waits at most WaitMilliseconds for its answer (0: not at all,
+// so the verdict only applies from its next connection). Listed clients get
+// Action: "block", "challenge" (the cookie challenge used by ip_lists) or
+// "score", which only adds to their risk score.
+type DNSBLConfig struct {
+	Enabled             bool     `json:"enabled"`
+	Zones               []string `json:"zones"`
+	Action              string   `json:"action"`
+	WaitMilliseconds    int      `json:"wait_milliseconds"`
+	TimeoutMilliseconds int      `json:"timeout_milliseconds"`
+	CacheMinutes        int      `json:"cache_minutes"`
+	ChallengeValidHours int      `json:"challenge_valid_hours"`
+}
+
+func normalizeDNSBLConfig(config DNSBLConfig) DNSBLConfig {
+	zones := make([]string, 0, len(config.Zones))
+	for _, zone := range config.Zones {
+		if zone = strings.Trim(strings.TrimSpace(zone), "."); zone != "" {
+			zones = append(zones, zone)
+		}
+	}
+	config.Zones = zones
+	if config.Action != DNSBLActionChallenge && config.Action != DNSBLActionScore {
+		config.Action = DNSBLActionBlock
+	}
+	if config.WaitMilliseconds < 0 {
+		config.WaitMilliseconds = 0
+	}
+	if config.TimeoutMilliseconds <= 0 {
+		config.TimeoutMilliseconds = 2000
+	}
+	if config.CacheMinutes <= 0 {
+		config.CacheMinutes = 60
+	}
+	if config.ChallengeValidHours <= 0 {
+		config.ChallengeValidHours = DefaultChallengeValidHours
+	}
+	return config
+}
+
+func (fw *Firewall) dnsblConfig() DNSBLConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.DNSBL
+}
+
+// DNSBLResult is the cached answer for one IP. Zone and Answer name the
+// first list that has it.
+type DNSBLResult struct {
+	Listed bool
+	Zone   string
+	Answer string
+}
+
+// dnsblQueryName builds the name to look ip up under zone: reversed octets
+// for IPv4, reversed nibbles for IPv6.
+func dnsblQueryName(ip net.IP, zone string) string {
+	var name strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := 3; i >= 0; i-- {
+			fmt.Fprintf(&name, "%d.", ip4[i])
+		}
+	} else {
+		ip16 := ip.To16()
+		for i := 15; i >= 0; i-- {
+			fmt.Fprintf(&name, "%x.%x.", ip16[i]&0x0f, ip16[i]>>4)
+		}
+	}
+	name.WriteString(zone)
+	return name.String()
+}
+
+// dnsblListed reports whether a DNSBL answer means "listed". Lists answer
+// within 127.0.0.0/8; Spamhaus' 127.255.255.0/24 codes mean the query itself
+// was refused (e.g. through a public resolver) and say nothing about the IP.
+func dnsblListed(answer string) bool {
+	ip := net.ParseIP(answer).To4()
+	return ip != nil && ip[0] == 127 && !(ip[1] == 255 && ip[2] == 255)
+}
+
+// queryDNSBL asks each zone about ip and returns the first listing, and how
+// long to cache the answer.
+func (fw *Firewall) queryDNSBL(ip string, config DNSBLConfig) (DNSBLResult, time.Duration) {
+	parsed := net.ParseIP(ip)
+	ttl := time.Duration(config.CacheMinutes) * time.Minute
+	if parsed == nil {
+		return DNSBLResult{}, ttl
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.TimeoutMilliseconds)*time.Millisecond)
+	defer cancel()
+
+	for _, zone := range config.Zones {
+		answers, err := fw.lookupHost(ctx, dnsblQueryName(parsed, zone))
+		if err != nil {
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				continue
+			}
+			fw.logErrorRateLimited("dnsbl_"+zone, "DNSBL", "Lookup in %s failed: %v", zone, err)
+			ttl = DNSBLErrorCacheTime
+			continue
+		}
+		for _, answer := range answers {
+			if dnsblListed(answer) {
+				return DNSBLResult{Listed: true, Zone: zone, Answer: answer}, time.Duration(config.CacheMinutes) * time.Minute
+			}
+		}
+	}
+	return DNSBLResult{}, ttl
+}
+
+// checkDNSBL returns ip's DNSBL verdict when DNSBL checks are enabled and it
+// is known in time.
+func (fw *Firewall) checkDNSBL(ip string) (DNSBLResult, DNSBLConfig, bool) {
+	config := fw.dnsblConfig()
+	if !config.Enabled || len(config.Zones) == 0 {
+		return DNSBLResult{}, config, false
+	}
+
+	wait := time.Duration(config.WaitMilliseconds) * time.Millisecond
+	result, known := fw.dnsbl.Lookup(ip, fw.clock.Now(), wait, func() (DNSBLResult, time.Duration) {
+		return fw.queryDNSBL(ip, config)
+	})
+	return result, config, known && result.Listed
+}
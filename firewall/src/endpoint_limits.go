@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// EndpointRateLimit applies a separate per-minute budget to requests whose
+// normalized path falls under PathPrefix, tracked per (client, prefix).
+type EndpointRateLimit struct {
+	PathPrefix           string `json:"path_prefix"`
+	MaxAttemptsPerMinute int    `json:"max_attempts_per_minute"`
+}
+
+// normalizeRequestPath decodes, lowercases, cleans and strips the query so
+// that "/API//%6cogin/?x=1" and "/api/login" land in the same bucket.
+func normalizeRequestPath(p string) string {
+	if idx := strings.IndexAny(p, "?#"); idx >= 0 {
+		p = p[:idx]
+	}
+	if unescaped, err := url.PathUnescape(p); err == nil {
+		p = unescaped
+	}
+	if p == "" || p[0] != '/' {
+		p = "/" + p
+	}
+	return strings.ToLower(path.Clean(p))
+}
+
+func normalizeEndpointRateLimits(limits []EndpointRateLimit) []EndpointRateLimit {
+	normalized := make([]EndpointRateLimit, 0, len(limits))
+	for _, limit := range limits {
+		if limit.PathPrefix == "" || limit.MaxAttemptsPerMinute <= 0 {
+			continue
+		}
+		limit.PathPrefix = normalizeRequestPath(limit.PathPrefix)
+		normalized = append(normalized, limit)
+	}
+	return normalized
+}
+
+func pathHasPrefix(p, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// matchEndpointRateLimit returns the most specific limit covering p.
+func matchEndpointRateLimit(limits []EndpointRateLimit, p string) (EndpointRateLimit, bool) {
+	var best EndpointRateLimit
+	found := false
+	for _, limit := range limits {
+		if pathHasPrefix(p, limit.PathPrefix) && len(limit.PathPrefix) > len(best.PathPrefix) {
+			best = limit
+			found = true
+		}
+	}
+	return best, found
+}
+
+// countAttempt records an attempt in bucket and returns how many it has had
+// in the last minute.
+func (fw *Firewall) countAttempt(bucket string) int {
+	now := fw.clock.Now()
+
+	fw.attemptsMutex.Lock()
+	defer fw.attemptsMutex.Unlock()
+
+	var validAttempts []time.Time
+	for _, attempt := range fw.endpointAttempts[bucket] {
+		if now.Sub(attempt) < time.Minute {
+			validAttempts = append(validAttempts, attempt)
+		}
+	}
+	validAttempts = append(validAttempts, now)
+	fw.endpointAttempts[bucket] = validAttempts
+	return len(validAttempts)
+}
+
+// isEndpointRateLimited records an attempt for (key, matched prefix) and
+// reports whether that budget is exhausted.
+func (fw *Firewall) isEndpointRateLimited(key, requestPath string) (EndpointRateLimit, int, bool) {
+	fw.rulesMutex.RLock()
+	limit, found := matchEndpointRateLimit(fw.rules.EndpointRateLimits, normalizeRequestPath(requestPath))
+	fw.rulesMutex.RUnlock()
+
+	if !found {
+		return limit, 0, false
+	}
+	limit.MaxAttemptsPerMinute = fw.adaptive.Scale(limit.MaxAttemptsPerMinute)
+
+	attempts := fw.countAttempt(key + "|" + limit.PathPrefix)
+	return limit, attempts, attempts > limit.MaxAttemptsPerMinute
+}
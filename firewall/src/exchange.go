@@ -0,0 +1,280 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestInfo is what the firewall remembers about a request until its
+// response comes back.
+type RequestInfo struct {
+	RequestID string
+	Method    string
+	Target    string
+	Proto     string
+	Host      string
+	Referer   string
+	UserAgent string
+	Upgrade   bool
+	StartedAt time.Time
+	// switched receives, for a request that asked to upgrade, whether the
+	// upstream answered it with 101 Switching Protocols.
+	switched chan bool
+}
+
+func (ri *RequestInfo) Path() string {
+	return (&RequestHead{Target: ri.Target}).Path()
+}
+
+// ResponseRecord describes one upstream response seen on a connection,
+// together with the request it answered. Index is its position on the
+// connection.
+type ResponseRecord struct {
+	Index     int
+	Status    int
+	Bytes     int64
+	BodyBytes int64
+	Latency   time.Duration
+	Duration  time.Duration
+	Request   *RequestInfo
+}
+
+// exchange pairs requests seen on the client->proxy stream with responses on
+// the proxy->client stream of the same connection (HTTP/1.x answers in order).
+type exchange struct {
+	mutex   sync.Mutex
+	pending []*RequestInfo
+	// sent and answered count requests and complete final responses.
+	sent     int
+	answered int
+	onIdle   func()
+	// done is closed once no more responses will be read.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newExchange() *exchange {
+	return &exchange{done: make(chan struct{})}
+}
+
+// close releases a request stream waiting on an upgrade that will never be
+// answered.
+func (ex *exchange) close() {
+	ex.closeOnce.Do(func() { close(ex.done) })
+}
+
+// awaitSwitch blocks until the upstream answers info, an upgrade request,
+// and reports whether it switched protocols.
+func (ex *exchange) awaitSwitch(info *RequestInfo) bool {
+	select {
+	case switched := <-info.switched:
+		return switched
+	case <-ex.done:
+		return false
+	}
+}
+
+func (ex *exchange) push(info *RequestInfo) {
+	ex.mutex.Lock()
+	ex.pending = append(ex.pending, info)
+	ex.sent++
+	ex.mutex.Unlock()
+}
+
+// withdraw takes back info, the last request pushed, when it was held and
+// then refused without being sent.
+func (ex *exchange) withdraw(info *RequestInfo) {
+	ex.mutex.Lock()
+	defer ex.mutex.Unlock()
+
+	if n := len(ex.pending); n > 0 && ex.pending[n-1] == info {
+		ex.pending = ex.pending[:n-1]
+		ex.sent--
+	}
+}
+
+func (ex *exchange) answer() {
+	ex.mutex.Lock()
+	ex.answered++
+	var onIdle func()
+	if ex.answered >= ex.sent {
+		onIdle, ex.onIdle = ex.onIdle, nil
+	}
+	ex.mutex.Unlock()
+
+	if onIdle != nil {
+		onIdle()
+	}
+}
+
+// whenIdle runs f once every request sent so far has been answered in full,
+// right away if they have. It runs on the goroutine writing the responses,
+// so whatever f writes to the client comes after them.
+func (ex *exchange) whenIdle(f func()) {
+	ex.mutex.Lock()
+	if ex.answered < ex.sent {
+		ex.onIdle = f
+		ex.mutex.Unlock()
+		return
+	}
+	ex.mutex.Unlock()
+	f()
+}
+
+func (ex *exchange) peek() *RequestInfo {
+	ex.mutex.Lock()
+	defer ex.mutex.Unlock()
+
+	if len(ex.pending) == 0 {
+		return nil
+	}
+	return ex.pending[0]
+}
+
+func (ex *exchange) pop() *RequestInfo {
+	ex.mutex.Lock()
+	defer ex.mutex.Unlock()
+
+	if len(ex.pending) == 0 {
+		return nil
+	}
+	info := ex.pending[0]
+	ex.pending = ex.pending[1:]
+	return info
+}
+
+type requestStreamHandler struct {
+	exchange  *exchange
+	onHead    func(head *messageHead, info *RequestInfo)
+	upgrading *RequestInfo
+}
+
+func (h *requestStreamHandler) OnStart() {}
+
+func (h *requestStreamHandler) OnHead(head *messageHead) (int, int64) {
+	info := &RequestInfo{
+		Host:      head.Header.Get("Host"),
+		Referer:   head.Header.Get("Referer"),
+		UserAgent: head.Header.Get("User-Agent"),
+		Upgrade:   head.Header.Get("Upgrade") != "",
+		StartedAt: time.Now(),
+	}
+	if parts := strings.Fields(head.StartLine); len(parts) == 3 {
+		info.Method, info.Target, info.Proto = parts[0], parts[1], parts[2]
+	}
+
+	if h.onHead != nil {
+		h.onHead(head, info)
+	}
+	if head.refused {
+		return bodyNone, 0
+	}
+	h.exchange.push(info)
+
+	if info.Upgrade {
+		info.switched = make(chan bool, 1)
+		h.upgrading = info
+	}
+	mode, length := contentFraming(head)
+	if mode == bodyUntilClose {
+		// Requests without framing headers have no body.
+		mode = bodyNone
+	}
+	return mode, length
+}
+
+// OnComplete holds the stream after an upgrade request until it is
+// answered: only a 101 to that very request hands the connection over to
+// the new protocol, anything else and the next request is checked as usual.
+func (h *requestStreamHandler) OnComplete(bodyBytes int64) bool {
+	info := h.upgrading
+	if info == nil {
+		return false
+	}
+	h.upgrading = nil
+	return h.exchange.awaitSwitch(info)
+}
+
+type responseStreamHandler struct {
+	exchange   *exchange
+	index      int
+	firstByte  time.Time
+	headBytes  int64
+	current    ResponseRecord
+	onHead     func(head *messageHead, record *ResponseRecord)
+	onResponse func(record ResponseRecord)
+}
+
+func (h *responseStreamHandler) OnStart() {
+	h.firstByte = time.Now()
+}
+
+func (h *responseStreamHandler) OnHead(head *messageHead) (int, int64) {
+	fields := strings.Fields(head.StartLine)
+	status := 0
+	if len(fields) >= 2 && strings.HasPrefix(fields[0], "HTTP/") {
+		status, _ = strconv.Atoi(fields[1])
+	}
+
+	request := h.exchange.peek()
+	if status >= 200 || status == http.StatusSwitchingProtocols {
+		request = h.exchange.pop()
+		if request != nil && request.switched != nil {
+			request.switched <- status == http.StatusSwitchingProtocols
+		}
+	}
+
+	h.current = ResponseRecord{
+		Index:   h.index,
+		Status:  status,
+		Request: request,
+	}
+	if request != nil {
+		h.current.Latency = h.firstByte.Sub(request.StartedAt)
+	}
+
+	// Framing is read before onHead, which may replace the body.
+	mode, length := responseFraming(head, status, request)
+	if h.onHead != nil {
+		h.onHead(head, &h.current)
+	}
+	h.headBytes = int64(len(head.Bytes()))
+	return mode, length
+}
+
+func responseFraming(head *messageHead, status int, request *RequestInfo) (int, int64) {
+	switch {
+	case status == 0:
+		return bodyMalformed, 0
+	case status == http.StatusSwitchingProtocols:
+		return bodyUpgrade, 0
+	case status < 200:
+		return bodyNone, 0
+	case request != nil && request.Method == http.MethodHead,
+		status == http.StatusNoContent, status == http.StatusNotModified:
+		return bodyNone, 0
+	}
+	return contentFraming(head)
+}
+
+func (h *responseStreamHandler) OnComplete(bodyBytes int64) bool {
+	if h.current.Status < 200 && h.current.Status != http.StatusSwitchingProtocols {
+		return false
+	}
+
+	h.exchange.answer()
+	h.current.BodyBytes = bodyBytes
+	h.current.Bytes = h.headBytes + bodyBytes
+	if h.current.Request != nil {
+		h.current.Duration = time.Since(h.current.Request.StartedAt)
+	}
+	h.index++
+
+	if h.onResponse != nil {
+		h.onResponse(h.current)
+	}
+	return false
+}
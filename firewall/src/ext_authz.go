@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultExtAuthzTimeoutMilliseconds = 200
+	ExtAuthzFailureOpen                = "open"
+	ExtAuthzFailureClosed              = "closed"
+
+	// extAuthzMaxReason bounds how much of a denial body is logged.
+	extAuthzMaxReason = 256
+)
+
+// ExtAuthzConfig asks an external authorization service about each
+// connection once its request head is read. The firewall POSTs an
+// ExtAuthzRequest as JSON to URL; a 2xx answer admits the connection, any
+// other status refuses it with that status. UpstreamHeaders names the
+// response headers copied onto the request sent upstream; they are stripped
+// from every request first, checked or not, so clients can't set them
+// themselves. When the service can't be reached in
+// time, FailureMode "open" admits the connection and "closed" refuses it.
+// Only requests under Paths are checked, when set; whitelisted clients never
+// are.
+type ExtAuthzConfig struct {
+	Enabled             bool     `json:"enabled"`
+	URL                 string   `json:"url"`
+	TimeoutMilliseconds int      `json:"timeout_ms"`
+	FailureMode         string   `json:"failure_mode"`
+	Paths               []string `json:"paths"`
+	UpstreamHeaders     []string `json:"upstream_headers"`
+}
+
+// normalizeFailureMode makes anything but "closed" fail open.
+func normalizeFailureMode(mode string) string {
+	if strings.ToLower(strings.TrimSpace(mode)) == ExtAuthzFailureClosed {
+		return ExtAuthzFailureClosed
+	}
+	return ExtAuthzFailureOpen
+}
+
+func normalizeExtAuthzConfig(config ExtAuthzConfig) ExtAuthzConfig {
+	if config.TimeoutMilliseconds <= 0 {
+		config.TimeoutMilliseconds = DefaultExtAuthzTimeoutMilliseconds
+	}
+	config.FailureMode = normalizeFailureMode(config.FailureMode)
+	for i, name := range config.UpstreamHeaders {
+		config.UpstreamHeaders[i] = http.CanonicalHeaderKey(strings.TrimSpace(name))
+	}
+	return config
+}
+
+func (fw *Firewall) extAuthzConfig() ExtAuthzConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.ExtAuthz
+}
+
+func (config ExtAuthzConfig) covers(path string) bool {
+	if len(config.Paths) == 0 {
+		return true
+	}
+	for _, prefix := range config.Paths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtAuthzRequest is what the authorization service is asked about.
+type ExtAuthzRequest struct {
+	RequestID string            `json:"request_id"`
+	IP        string            `json:"ip"`
+	Country   string            `json:"country,omitempty"`
+	Hostname  string            `json:"hostname,omitempty"`
+	Port      int               `json:"port"`
+	Protocol  string            `json:"protocol"`
+	Method    string            `json:"method"`
+	Host      string            `json:"host"`
+	Path      string            `json:"path"`
+	Headers   map[string]string `json:"headers"`
+}
+
+// extAuthzAnswer is the service's decision; err is set when there was none.
+type extAuthzAnswer struct {
+	status  int
+	headers http.Header
+	reason  string
+	err     error
+}
+
+func extAuthzRequest(ms *MiddlewareState) ExtAuthzRequest {
+	request := ExtAuthzRequest{
+		RequestID: ms.ConnID,
+		IP:        ms.IP,
+		Country:   ms.Verdict.Country,
+		Hostname:  ms.Hostname,
+		Port:      ms.Port,
+		Protocol:  ms.Record.Protocol,
+		Method:    ms.Head.Method,
+		Host:      ms.Head.Host(),
+		Path:      ms.Head.Path(),
+		Headers:   make(map[string]string, len(ms.Head.Header)),
+	}
+	for name, values := range ms.Head.Header {
+		request.Headers[name] = strings.Join(values, ", ")
+	}
+	return request
+}
+
+// postDecisionRequest POSTs payload as JSON to url for request requestID and
+// hands the answer to read, all within timeoutMilliseconds. It is how both
+// ext_authz and rego ask their services.
+func postDecisionRequest(url, requestID string, timeoutMilliseconds int, payload interface{}, read func(resp *http.Response) error) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMilliseconds)*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(RequestIDHeader, requestID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return read(resp)
+}
+
+func (fw *Firewall) askExtAuthz(config ExtAuthzConfig, ms *MiddlewareState) extAuthzAnswer {
+	var answer extAuthzAnswer
+	answer.err = postDecisionRequest(config.URL, ms.ConnID, config.TimeoutMilliseconds, extAuthzRequest(ms), func(resp *http.Response) error {
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, extAuthzMaxReason))
+		answer.status, answer.headers, answer.reason = resp.StatusCode, resp.Header, strings.TrimSpace(string(reason))
+		return nil
+	})
+	return answer
+}
+
+func init() {
+	RegisterMiddleware(Middleware{Name: "ext_authz", Stage: StageRequest, SkipWhitelisted: true, Handle: extAuthzMiddleware})
+}
+
+func extAuthzMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	config := fw.extAuthzConfig()
+	if !config.Enabled || config.URL == "" || !config.covers(ms.Head.Path()) {
+		return true
+	}
+
+	started := time.Now()
+	answer := fw.askExtAuthz(config, ms)
+	if answer.err != nil {
+		fw.logErrorRateLimitedTo(ms.Logger, "ext_authz", "EXT_AUTHZ", "Authorization service %s failed: %v", config.URL, answer.err)
+		if config.FailureMode == ExtAuthzFailureOpen {
+			ms.Record.Event("ext_authz unavailable, failed open")
+			return true
+		}
+		ms.Block("EXT_AUTHZ_UNAVAILABLE", answer.err.Error())
+		fw.writeHTTPError(ms.Conn, ms.ConnID, http.StatusServiceUnavailable, "Authorization is unavailable, please retry.", 5*time.Second)
+		return false
+	}
+
+	if answer.status < 200 || answer.status > 299 {
+		status := answer.status
+		if status < 400 || status > 599 {
+			status = http.StatusForbidden
+		}
+		reason := answer.reason
+		if reason == "" {
+			reason = http.StatusText(answer.status)
+		}
+		ms.Block("EXT_AUTHZ_DENIED", fmt.Sprintf("%s answered %d: %s", config.URL, answer.status, reason))
+		fw.writeHTTPError(ms.Conn, ms.ConnID, status, "Access denied.", 0)
+		return false
+	}
+
+	if len(config.UpstreamHeaders) > 0 {
+		if ms.UpstreamHeaders == nil {
+			ms.UpstreamHeaders = make(http.Header)
+		}
+		for _, name := range config.UpstreamHeaders {
+			ms.UpstreamHeaders[name] = answer.headers.Values(name)
+		}
+	}
+	ms.Record.Event("ext_authz allowed in %s", time.Since(started).Round(time.Millisecond))
+	return true
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	FailoverRolePrimary = "primary"
+	FailoverRoleStandby = "standby"
+
+	DefaultFailoverCheckSeconds = 2
+	DefaultFailoverThreshold    = 3
+	FailoverStateSyncChecks     = 5
+	FailoverHookTimeout         = 30 * time.Second
+	MaxFailoverStateSize        = 32 << 20
+
+	// soReusePort is Linux's SO_REUSEPORT, which package syscall lacks.
+	soReusePort = 0xf
+)
+
+// FailoverConfig pairs a standby instance with a primary. It comes from the
+// environment rather than rules.json, because a standby copies the
+// primary's rules file:
+//
+//	FAILOVER_ROLE       primary or standby (unset: no failover)
+//	FAILOVER_PRIMARY    the primary's admin API, e.g. http://10.0.0.2:5002
+//	FAILOVER_TOKEN      bearer token for it (default ADMIN_TOKEN)
+//	FAILOVER_CHECK_SECONDS, FAILOVER_THRESHOLD
+//	FAILOVER_HOOK       shell command run on takeover, e.g. to move a VIP
+//
+// A standby doesn't listen on the firewall port. It checks the primary's
+// /health every FAILOVER_CHECK_SECONDS and copies its rules and auto-blocks
+// from /state every few checks; after FAILOVER_THRESHOLD failed checks in a
+// row it runs the hook and starts listening. Both roles set SO_REUSEPORT, so
+// a standby on the same host can bind the port while a hung primary still
+// holds it.
+type FailoverConfig struct {
+	Role             string
+	PrimaryURL       string
+	Token            string
+	CheckInterval    time.Duration
+	FailureThreshold int
+	TakeoverHook     string
+}
+
+func failoverConfigFromEnv() FailoverConfig {
+	config := FailoverConfig{
+		Role:             os.Getenv("FAILOVER_ROLE"),
+		PrimaryURL:       strings.TrimSuffix(os.Getenv("FAILOVER_PRIMARY"), "/"),
+		Token:            getEnv("FAILOVER_TOKEN", os.Getenv("ADMIN_TOKEN")),
+		CheckInterval:    time.Duration(getEnvInt("FAILOVER_CHECK_SECONDS", DefaultFailoverCheckSeconds)) * time.Second,
+		FailureThreshold: getEnvInt("FAILOVER_THRESHOLD", DefaultFailoverThreshold),
+		TakeoverHook:     os.Getenv("FAILOVER_HOOK"),
+	}
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = DefaultFailoverCheckSeconds * time.Second
+	}
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = DefaultFailoverThreshold
+	}
+	return config
+}
+
+// FailoverState is what a standby copies from the primary: its current
+// rules and how many seconds each auto-block has left.
+type FailoverState struct {
+	Rules      json.RawMessage `json:"rules"`
+	AutoBlocks map[string]int  `json:"auto_blocks"`
+}
+
+func (fw *Firewall) failoverState() (FailoverState, error) {
+	fw.rulesMutex.RLock()
+	rules, err := json.MarshalIndent(fw.rules, "", "  ")
+	fw.rulesMutex.RUnlock()
+	if err != nil {
+		return FailoverState{}, err
+	}
+
+	now := fw.clock.Now()
+	state := FailoverState{Rules: rules, AutoBlocks: make(map[string]int)}
+	fw.attemptsMutex.RLock()
+	for key, until := range fw.autoBlockedIPs {
+		if seconds := int(until.Sub(now) / time.Second); seconds > 0 {
+			state.AutoBlocks[key] = seconds
+		}
+	}
+	fw.attemptsMutex.RUnlock()
+	return state, nil
+}
+
+func (fw *Firewall) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	role, _ := fw.failoverRole.Load().(string)
+	if role == "" {
+		role = FailoverRolePrimary
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "role": role})
+}
+
+func (fw *Firewall) handleState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	state, err := fw.failoverState()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// primaryGet fetches path from the primary's admin API.
+func primaryGet(config FailoverConfig, path string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.CheckInterval)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, config.PrimaryURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+config.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: HTTP %d", path, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, MaxFailoverStateSize))
+}
+
+// syncFromPrimary copies the primary's rules (through the rules file, so they
+// survive a restart) and merges its auto-blocks, keeping the longer block.
+func (fw *Firewall) syncFromPrimary(config FailoverConfig) error {
+	body, err := primaryGet(config, "/state")
+	if err != nil {
+		return err
+	}
+	var state FailoverState
+	if err := json.Unmarshal(body, &state); err != nil {
+		return fmt.Errorf("malformed state: %v", err)
+	}
+
+	if len(state.Rules) > 0 && !bytes.Equal(state.Rules, fw.syncedRules) {
+		if err := fw.writeRulesFile(state.Rules); err != nil {
+			return fmt.Errorf("write rules: %v", err)
+		}
+		fw.syncedRules = state.Rules
+		fw.loadRules()
+	}
+
+	now := fw.clock.Now()
+	fw.attemptsMutex.Lock()
+	for key, seconds := range state.AutoBlocks {
+		until := now.Add(time.Duration(seconds) * time.Second)
+		if current, exists := fw.autoBlockedIPs[key]; !exists || current.Before(until) {
+			fw.autoBlockedIPs[key] = until
+		}
+	}
+	fw.attemptsMutex.Unlock()
+	return nil
+}
+
+// takeOver runs the takeover hook, if any. The firewall starts listening
+// whether or not it succeeds.
+func (fw *Firewall) takeOver(config FailoverConfig) {
+	fw.logger.LogWarning("FAILOVER", "Primary %s failed %d health checks - taking over", config.PrimaryURL, config.FailureThreshold)
+	fw.failoverRole.Store(FailoverRolePrimary)
+	if config.TakeoverHook == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), FailoverHookTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "sh", "-c", config.TakeoverHook).CombinedOutput()
+	if err != nil {
+		fw.logger.LogError("FAILOVER", "Takeover hook failed: %v: %s", err, strings.TrimSpace(string(output)))
+		return
+	}
+	fw.logger.LogInfo("FAILOVER", "Takeover hook done")
+}
+
+// runStandby mirrors the primary until it fails, then takes over. It
+// returns false if the firewall shuts down first.
+func (fw *Firewall) runStandby(config FailoverConfig) bool {
+	fw.logger.LogStartup("Standby for %s: checking every %v, taking over after %d failed checks",
+		config.PrimaryURL, config.CheckInterval, config.FailureThreshold)
+	if err := fw.syncFromPrimary(config); err != nil {
+		fw.logger.LogWarning("FAILOVER", "Initial state sync failed: %v", err)
+	}
+
+	ticker := time.NewTicker(config.CheckInterval)
+	defer ticker.Stop()
+
+	failures, checks := 0, 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-fw.shutdown:
+			return false
+		}
+
+		if _, err := primaryGet(config, "/health"); err != nil {
+			failures++
+			fw.logger.LogWarning("FAILOVER", "Primary health check failed (%d/%d): %v", failures, config.FailureThreshold, err)
+			if failures >= config.FailureThreshold {
+				fw.takeOver(config)
+				return true
+			}
+			continue
+		}
+		failures = 0
+
+		checks++
+		if checks >= FailoverStateSyncChecks {
+			checks = 0
+			if err := fw.syncFromPrimary(config); err != nil {
+				fw.logErrorRateLimited("failover_sync", "FAILOVER", "State sync failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// FingerprintSuppression hides what runs behind the firewall from scanners.
+// StripHeaders are removed from every response; a non-empty ServerHeader
+// replaces the Server header instead of removing it. Upstream responses with
+// one of NormalizeStatuses get their body swapped for the firewall's own
+// error page, so the proxy's and the chat's default error pages can't be
+// told apart.
+type FingerprintSuppression struct {
+	Enabled           bool     `json:"enabled"`
+	StripHeaders      []string `json:"strip_headers"`
+	ServerHeader      string   `json:"server_header"`
+	NormalizeErrors   bool     `json:"normalize_errors"`
+	NormalizeStatuses []int    `json:"normalize_statuses"`
+}
+
+func normalizeFingerprintSuppression(fs FingerprintSuppression) FingerprintSuppression {
+	if len(fs.StripHeaders) == 0 {
+		fs.StripHeaders = []string{"Server", "X-Powered-By", "X-AspNet-Version", "X-AspNetMvc-Version"}
+	}
+	for i, name := range fs.StripHeaders {
+		fs.StripHeaders[i] = http.CanonicalHeaderKey(strings.TrimSpace(name))
+	}
+	fs.ServerHeader = strings.TrimSpace(fs.ServerHeader)
+	if len(fs.NormalizeStatuses) == 0 {
+		fs.NormalizeStatuses = []int{500, 502, 503, 504}
+	}
+	return fs
+}
+
+func (fs FingerprintSuppression) Normalizes(status int) bool {
+	if !fs.NormalizeErrors {
+		return false
+	}
+	for _, normalized := range fs.NormalizeStatuses {
+		if status == normalized {
+			return true
+		}
+	}
+	return false
+}
+
+func (fw *Firewall) fingerprintSuppression() FingerprintSuppression {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.FingerprintSuppression
+}
+
+// suppressFingerprint rewrites an upstream response head on its way to the
+// client.
+func (fw *Firewall) suppressFingerprint(fs FingerprintSuppression, head *messageHead, record *ResponseRecord) {
+	for _, name := range fs.StripHeaders {
+		head.Del(name)
+	}
+	if fs.ServerHeader != "" {
+		head.Set("Server", fs.ServerHeader)
+	}
+
+	if record.Request == nil || record.Request.Method == http.MethodHead || !fs.Normalizes(record.Status) {
+		return
+	}
+	data := ErrorPageData{
+		Status:     record.Status,
+		StatusText: http.StatusText(record.Status),
+		RequestID:  record.Request.RequestID,
+	}
+	head.ReplaceBody(fw.errorPages.Render(fw.errorPagesConfig().Directory, data))
+	head.Set("Content-Type", "text/html; charset=utf-8")
+	head.Del("Content-Encoding")
+	head.Del("Content-Language")
+	head.Del("ETag")
+	head.Del("Last-Modified")
+}
@@ -4,46 +4,152 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 const (
-	BufferSize            = 4096
-	RulesReloadInterval   = 1 * time.Second
-	CleanupInterval       = 5 * time.Minute
-	DefaultFirewallPort   = 5001
-	DefaultProxyPort      = 8080
-	MaxTrackedIPs         = 10000
-	ForceCleanupThreshold = 8000
-	LogSpamInterval       = 1 * time.Minute
-	MaxConcurrentConns    = 100
-	ConnectionTimeout     = 10 * time.Second
-	ProxyConnectTimeout   = 5 * time.Second
+	BufferSize          = 4096
+	RulesReloadInterval = 1 * time.Second
+	CleanupInterval     = 5 * time.Minute
+	DefaultFirewallPort = 5001
+	DefaultProxyPort    = 8080
+	MaxTrackedIPs       = 10000
+	EvictionSampleSize  = 16
+	LogSpamInterval     = 1 * time.Minute
+	MaxConcurrentConns  = 100
+	ConnectionTimeout   = 10 * time.Second
+	ProxyConnectTimeout = 5 * time.Second
+	ShutdownGracePeriod = 10 * time.Second
 
 	MaxConnectionsPerIP = 10
 	SynFloodWindow      = 30 * time.Second
 	MaxSynPerWindow     = 20
+
+	DefaultIPv4AggregationPrefix = 32
+	DefaultIPv6AggregationPrefix = 64
 )
 
+var errShutdown = errors.New("firewall shutting down")
+
 type Rules struct {
-	BlockedIPs             []string `json:"blocked_ips"`
-	Whitelist              []string `json:"whitelist"`
-	AllowedPorts           []int    `json:"allowed_ports"`
-	MaxAttemptsPerMinute   int      `json:"max_attempts_per_minute"`
-	MaxAttemptsPerHour     int      `json:"max_attempts_per_hour"`
-	AutoBlockEnabled       bool     `json:"auto_block_enabled"`
-	AutoBlockDurationHours int      `json:"auto_block_duration_hours"`
+	BlockedIPs  RuleEntryList `json:"blocked_ips"`
+	Whitelist   RuleEntryList `json:"whitelist"`
+	AlwaysBlock RuleEntryList `json:"always_block"`
+	// ExemptFromRateLimit lists clients, such as healthchecks, monitors and
+	// the load balancer, that skip rate limiting but not blocking.
+	ExemptFromRateLimit    RuleEntryList      `json:"exempt_from_rate_limit"`
+	RulePrecedence         []string           `json:"rule_precedence"`
+	RuleGroups             []RuleGroup        `json:"rule_groups"`
+	RuleConflicts          RuleConflictConfig `json:"rule_conflicts"`
+	AllowedPorts           []int              `json:"allowed_ports"`
+	MaxAttemptsPerMinute   int                `json:"max_attempts_per_minute"`
+	MaxAttemptsPerHour     int                `json:"max_attempts_per_hour"`
+	AutoBlockEnabled       bool               `json:"auto_block_enabled"`
+	AutoBlockDurationHours int                `json:"auto_block_duration_hours"`
+	IPv4AggregationPrefix  int                `json:"ipv4_aggregation_prefix"`
+	IPv6AggregationPrefix  int                `json:"ipv6_aggregation_prefix"`
+
+	// AllowlistOnly rejects every client that isn't whitelisted (or let in by
+	// an appeal). The firewall forwards TLS untouched, so client certificates
+	// can't be checked here; that belongs to the TLS-terminating proxy.
+	AllowlistOnly bool `json:"allowlist_only"`
+
+	PortStrategy           PortStrategy         `json:"port_strategy"`
+	ListenerPortStrategies map[int]PortStrategy `json:"listener_port_strategies"`
+	UpstreamTLS            UpstreamTLS          `json:"upstream_tls"`
+	UpstreamDial           UpstreamDialConfig   `json:"upstream_dial"`
+	SocketOptions          SocketOptionsConfig  `json:"socket_options"`
+	ListenerUpstreamTLS    map[int]UpstreamTLS  `json:"listener_upstream_tls"`
+
+	AllowedHosts       []string            `json:"allowed_hosts"`
+	EndpointRateLimits []EndpointRateLimit `json:"endpoint_rate_limits"`
+	ProtocolRateLimits []ProtocolRateLimit `json:"protocol_rate_limits"`
+	ProtocolAllowlist  ProtocolAllowlist   `json:"protocol_allowlist"`
+	LoginProtection    LoginProtection     `json:"login_protection"`
+
+	MaxResponseBytesPerConnection int64 `json:"max_response_bytes_per_connection"`
+	DailyEgressQuotaBytes         int64 `json:"daily_egress_quota_bytes"`
+	DailyIngressQuotaBytes        int64 `json:"daily_ingress_quota_bytes"`
+
+	TrafficSplit TrafficSplit `json:"traffic_split"`
+	Mirror       MirrorConfig `json:"mirror"`
+	Upstreams    []Upstream   `json:"upstreams"`
+	Affinity     Affinity     `json:"affinity"`
+
+	AccessLog  AccessLogConfig  `json:"access_log"`
+	HTMLReport HTMLReportConfig `json:"html_report"`
+	ErrorPages ErrorPagesConfig `json:"error_pages"`
+
+	FingerprintSuppression FingerprintSuppression   `json:"fingerprint_suppression"`
+	SecurityHeaders        SecurityHeaders          `json:"security_headers"`
+	CORS                   CORSPolicy               `json:"cors"`
+	TrustCookies           TrustCookieConfig        `json:"trust_cookies"`
+	AbuseReports           AbuseReportConfig        `json:"abuse_reports"`
+	RiskScoring            RiskScoring              `json:"risk_scoring"`
+	DecisionCache          DecisionCacheConfig      `json:"decision_cache"`
+	BlockNotifications     BlockNotificationsConfig `json:"block_notifications"`
+	ScheduledReports       ScheduledReportsConfig   `json:"scheduled_reports"`
+	Middleware             MiddlewareConfig         `json:"middleware"`
+	Policies               []Policy                 `json:"policies"`
+	WasmFilters            []WasmFilter             `json:"wasm_filters"`
+	ExtAuthz               ExtAuthzConfig           `json:"ext_authz"`
+	Rego                   RegoConfig               `json:"rego"`
+	BodyInspection         BodyInspection           `json:"body_inspection"`
+	Tenants                []Tenant                 `json:"tenants"`
+	Quotas                 QuotaConfig              `json:"quotas"`
+	APIKeys                APIKeyConfig             `json:"api_keys"`
+
+	ConnectionLog ConnectionLogConfig `json:"connection_log"`
+	Logging       LoggingConfig       `json:"logging"`
+	StatsD        StatsDConfig        `json:"statsd"`
+	SLO           SLOConfig           `json:"slo"`
+
+	AdaptiveRateLimit AdaptiveRateLimit `json:"adaptive_rate_limit"`
+	AnomalyDetection  AnomalyDetection  `json:"anomaly_detection"`
+	Appeals           AppealConfig      `json:"appeals"`
+
+	Snapshots SnapshotConfig `json:"snapshots"`
+
+	StagedRules StagedRulesConfig `json:"staged_rules"`
+
+	IdleTimeout       IdleTimeoutConfig `json:"idle_timeout"`
+	HalfOpen          HalfOpenLimits    `json:"half_open"`
+	LoadShedding      LoadShedding      `json:"load_shedding"`
+	Watchdog          WatchdogConfig    `json:"watchdog"`
+	MemoryBudget      MemoryBudget      `json:"memory_budget"`
+	WarmState         WarmStateConfig   `json:"warm_state"`
+	LogReplay         LogReplay         `json:"log_replay"`
+	PortScanDetection PortScanDetection `json:"port_scan_detection"`
+
+	BlockedASNs   []uint32          `json:"blocked_asns"`
+	ASNRateLimits []ASNRateLimit    `json:"asn_rate_limits"`
+	ASNDatabase   GeoDatabaseConfig `json:"asn_database"`
+
+	IPLists []IPList    `json:"ip_lists"`
+	DNSBL   DNSBLConfig `json:"dnsbl"`
+
+	ReverseDNS ReverseDNSConfig `json:"reverse_dns"`
+
+	Countries       CountryPolicy     `json:"countries"`
+	CountryDatabase GeoDatabaseConfig `json:"country_database"`
+
+	Cluster ClusterConfig `json:"cluster"`
+
+	QUIC QUICConfig `json:"quic"`
 }
 
 type Firewall struct {
@@ -51,51 +157,125 @@ type Firewall struct {
 	parsedRules        *ParsedRules
 	rulesMutex         sync.RWMutex
 	rulesFile          string
+	rulesStatusFile    string
+	rulesStatus        *RulesStatusWriter
 	rulesModTime       time.Time
+	rulesKey           []byte
 	connectionAttempts map[string][]time.Time
 	hourlyAttempts     map[string][]time.Time
 	autoBlockedIPs     map[string]time.Time
+	autoBlockReasons   map[string]string
+	endpointAttempts   map[string][]time.Time
+	loginFailures      map[string][]time.Time
+	trackedIPs         *ipLRU
 	attemptsMutex      sync.RWMutex
 	logger             *FirewallLogger
 
 	firewallPort int
 	proxyHost    string
 	proxyPort    int
+	ingressMode  string
 
 	lastErrorLog  map[string]time.Time
 	errorLogMutex sync.RWMutex
 
-	shutdown    chan bool
-	listener    net.Listener
-	activeConns sync.WaitGroup
-	connCounter int64
-	connMutex   sync.RWMutex
+	shutdown     chan bool
+	listener     net.Listener
+	activeConns  sync.WaitGroup
+	connSlots    *Semaphore
+	saturation   SaturationStats
+	watchdog     *Watchdog
+	memory       *MemoryPressure
+	groupHits    *RuleGroupHits
+	panics       atomic.Uint64
+	connections  *ConnectionRegistry
+	portScans    *PortScanDetector
+	asnDB        *GeoDatabase
+	cluster      *Cluster
+	quic         *QUICProxy
+	failoverRole atomic.Value
+	syncedRules  []byte
+	countryDB    *GeoDatabase
+	countries    *CountryBudgets
+	ipListSet    *IPListSet
+	wasmFilters  *WasmFilterSet
+	regoPolicies *RegoPolicySet
+	dnsbl        *LookupCache[DNSBLResult]
+	rdns         *LookupCache[PTRResult]
 
 	activeConnsByIP map[string]int
 	synFloodTracker map[string][]time.Time
+	peerSynFloods   map[string]time.Time
 	synFloodMutex   sync.RWMutex
+
+	startTime      time.Time
+	responseStats  *ResponseStats
+	protocolStats  *ProtocolStats
+	tenantStats    *ProtocolStats
+	quotas         *QuotaTracker
+	apiKeys        *APIKeyStore
+	apiClientStats *ProtocolStats
+	halfOpen       *HalfOpenTracker
+	transfers      *TransferTracker
+	accessLog      *AccessLogger
+	trafficStats   *TrafficStats
+	errorPages     *ErrorPages
+	statsd         *StatsDExporter
+	latencyStats   *LatencyStats
+	slo            *SLOTracker
+	adaptive       *AdaptiveLimiter
+	anomaly        *AnomalyDetector
+	appeals        *Appeals
+	snapshots      *RulesSnapshots
+	staged         *StagedRules
+	upstreamTLS    *UpstreamTLSConfigs
+	trustCookies   *TrustCookies
+	abuseReports   *AbuseReports
+	riskScores     *RiskScores
+	decisions      *DecisionCache
+	reportPeriods  *ReportPeriods
+	// lastGoodUpstream is the address each upstream name last connected on.
+	lastGoodUpstream *LastGoodAddresses
+	upstreamResolver *UpstreamResolver
+
+	clock Clock
+
+	// dialUpstream connects to the reverse proxy; tests replace it with an
+	// in-memory dialer.
+	dialUpstream func(ctx context.Context, address string, timeout time.Duration) (net.Conn, error)
+	lookupHost   func(ctx context.Context, host string) ([]string, error)
+	lookupAddr   func(ctx context.Context, addr string) ([]string, error)
+	// lookupOriginalDst reads SO_ORIGINAL_DST in redirect ingress mode.
+	lookupOriginalDst func(conn net.Conn) (*net.TCPAddr, error)
 }
 
 func NewFirewall() *Firewall {
-	fw := &Firewall{
-		rulesFile:          "/var/log/shared/firewall/rules.json",
-		connectionAttempts: make(map[string][]time.Time),
-		hourlyAttempts:     make(map[string][]time.Time),
-		autoBlockedIPs:     make(map[string]time.Time),
-		firewallPort:       getEnvInt("FIREWALL_PORT", DefaultFirewallPort),
-		proxyHost:          getEnv("REVERSE_PROXY_IP", "reverse-proxy"),
-		proxyPort:          getEnvInt("REVERSE_PROXY_PORT", DefaultProxyPort),
-		lastErrorLog:       make(map[string]time.Time),
-		shutdown:           make(chan bool),
-		activeConnsByIP:    make(map[string]int),
-		synFloodTracker:    make(map[string][]time.Time),
-	}
+	fw := newFirewall(DefaultRulesFile)
+	fw.rulesStatusFile = getEnv("RULES_STATUS_FILE", DefaultRulesStatusFile)
 
 	logger, err := NewFirewallLogger()
 	if err != nil {
 		log.Fatalf("Failed to initialize logger: %v", err)
 	}
 	fw.logger = logger
+	fw.logger.SetBlockObserver(fw.recordBlock)
+
+	if name := getEnv("LOG_LEVEL", ""); name != "" {
+		if level, ok := ParseLogLevel(name); ok {
+			fw.logger.SetMinLevel(level)
+		} else {
+			fw.logger.LogWarning("LOGGING", "Unknown LOG_LEVEL %q, using %s", name, DefaultLogLevel)
+		}
+	}
+
+	rulesKey, err := loadRulesKey()
+	if err != nil {
+		log.Fatalf("Failed to load rules signing key: %v", err)
+	}
+	fw.rulesKey = rulesKey
+	if len(fw.rulesKey) > 0 {
+		fw.logger.LogStartup("Rules signature verification enabled (%s)", rulesSignaturePath(fw.rulesFile))
+	}
 
 	fw.loadRules()
 
@@ -107,6 +287,84 @@ func NewFirewall() *Firewall {
 	return fw
 }
 
+// newFirewall builds a Firewall with empty state and no logger or rules
+// loaded yet.
+func newFirewall(rulesFile string) *Firewall {
+	fw := &Firewall{
+		rulesFile:          rulesFile,
+		rulesStatus:        NewRulesStatusWriter(),
+		connectionAttempts: make(map[string][]time.Time),
+		hourlyAttempts:     make(map[string][]time.Time),
+		autoBlockedIPs:     make(map[string]time.Time),
+		autoBlockReasons:   make(map[string]string),
+		endpointAttempts:   make(map[string][]time.Time),
+		loginFailures:      make(map[string][]time.Time),
+		trackedIPs:         newIPLRU(),
+		firewallPort:       getEnvInt("FIREWALL_PORT", DefaultFirewallPort),
+		ingressMode:        getEnv("INGRESS_MODE", IngressModeProxy),
+		proxyHost:          getEnv("REVERSE_PROXY_IP", "reverse-proxy"),
+		proxyPort:          getEnvInt("REVERSE_PROXY_PORT", DefaultProxyPort),
+		lastErrorLog:       make(map[string]time.Time),
+		shutdown:           make(chan bool),
+		connSlots:          NewSemaphore(MaxConcurrentConns),
+		watchdog:           NewWatchdog(),
+		memory:             NewMemoryPressure(),
+		groupHits:          NewRuleGroupHits(),
+		connections:        NewConnectionRegistry(),
+		portScans:          NewPortScanDetector(),
+		asnDB:              NewGeoDatabase("ASN"),
+		countryDB:          NewGeoDatabase("country"),
+		countries:          NewCountryBudgets(),
+		ipListSet:          NewIPListSet(),
+		wasmFilters:        NewWasmFilterSet(),
+		regoPolicies:       NewRegoPolicySet(),
+		dnsbl:              NewLookupCache[DNSBLResult](),
+		rdns:               NewLookupCache[PTRResult](),
+		activeConnsByIP:    make(map[string]int),
+		synFloodTracker:    make(map[string][]time.Time),
+		peerSynFloods:      make(map[string]time.Time),
+		responseStats:      NewResponseStats(),
+		protocolStats:      NewProtocolStats(),
+		tenantStats:        NewTenantStats(),
+		quotas:             NewQuotaTracker(),
+		apiKeys:            NewAPIKeyStore(),
+		apiClientStats:     NewAPIClientStats(),
+		halfOpen:           NewHalfOpenTracker(),
+		transfers:          NewTransferTracker(),
+		accessLog:          NewAccessLogger(),
+		trafficStats:       NewTrafficStats(),
+		errorPages:         NewErrorPages(),
+		statsd:             NewStatsDExporter(),
+		latencyStats:       NewLatencyStats(),
+		slo:                NewSLOTracker(),
+		adaptive:           NewAdaptiveLimiter(),
+		anomaly:            NewAnomalyDetector(),
+		appeals:            NewAppeals(os.Getenv("APPEAL_SECRET")),
+		trustCookies:       NewTrustCookies(os.Getenv("TRUST_COOKIE_SECRET")),
+		abuseReports:       NewAbuseReports(),
+		riskScores:         NewRiskScores(),
+		decisions:          NewDecisionCache(),
+		reportPeriods:      NewReportPeriods(),
+		snapshots:          NewRulesSnapshots(),
+		staged:             NewStagedRules(),
+		upstreamTLS:        NewUpstreamTLSConfigs(),
+		clock:              systemClock{},
+		lastGoodUpstream:   NewLastGoodAddresses(),
+		upstreamResolver:   NewUpstreamResolver(),
+		lookupHost:         net.DefaultResolver.LookupHost,
+		lookupAddr:         net.DefaultResolver.LookupAddr,
+		lookupOriginalDst:  socketOriginalDst,
+	}
+	fw.dialUpstream = fw.dialHappyEyeballs
+	fw.startTime = fw.clock.Now()
+	return fw
+}
+
+func dialTCP(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
 func (fw *Firewall) validateConfiguration() error {
 	if fw.firewallPort <= 0 || fw.firewallPort > 65535 {
 		return fmt.Errorf("invalid firewall port: %d", fw.firewallPort)
@@ -120,6 +378,10 @@ func (fw *Firewall) validateConfiguration() error {
 		return fmt.Errorf("proxy host cannot be empty")
 	}
 
+	if !validIngressMode(fw.ingressMode) {
+		return fmt.Errorf("invalid INGRESS_MODE %q: must be proxy, tproxy or redirect", fw.ingressMode)
+	}
+
 	proxyAddr := net.JoinHostPort(fw.proxyHost, strconv.Itoa(fw.proxyPort))
 	conn, err := net.DialTimeout("tcp", proxyAddr, 3*time.Second)
 	if err != nil {
@@ -149,6 +411,10 @@ func getEnvInt(key string, defaultValue int) int {
 }
 
 func (fw *Firewall) logErrorRateLimited(key, category, msg string, args ...interface{}) {
+	fw.logErrorRateLimitedTo(fw.logger, key, category, msg, args...)
+}
+
+func (fw *Firewall) logErrorRateLimitedTo(logger *FirewallLogger, key, category, msg string, args ...interface{}) {
 	fw.errorLogMutex.Lock()
 	defer fw.errorLogMutex.Unlock()
 
@@ -160,21 +426,34 @@ func (fw *Firewall) logErrorRateLimited(key, category, msg string, args ...inter
 	}
 
 	fw.lastErrorLog[key] = now
-	if fw.logger != nil {
-		fw.logger.LogError(category, msg, args...)
+	if logger != nil {
+		logger.LogError(category, msg, args...)
 	}
 }
 
 func (fw *Firewall) defaultRules() *Rules {
-	return &Rules{
-		BlockedIPs:             []string{},
-		Whitelist:              []string{},
+	rules := &Rules{
+		BlockedIPs:             RuleEntryList{},
+		Whitelist:              RuleEntryList{},
 		AllowedPorts:           []int{80, 443},
 		MaxAttemptsPerMinute:   5,
 		MaxAttemptsPerHour:     99,
 		AutoBlockEnabled:       true,
 		AutoBlockDurationHours: 24,
-	}
+		IPv4AggregationPrefix:  DefaultIPv4AggregationPrefix,
+		IPv6AggregationPrefix:  DefaultIPv6AggregationPrefix,
+		PortStrategy:           defaultPortStrategy(),
+		LoginProtection:        normalizeLoginProtection(LoginProtection{}),
+		ErrorPages:             normalizeErrorPagesConfig(ErrorPagesConfig{}),
+		StatsD:                 normalizeStatsDConfig(StatsDConfig{}),
+		SLO:                    normalizeSLOConfig(SLOConfig{}),
+		AdaptiveRateLimit:      normalizeAdaptiveRateLimit(AdaptiveRateLimit{}),
+		AnomalyDetection:       normalizeAnomalyDetection(AnomalyDetection{}),
+		Appeals:                normalizeAppealConfig(AppealConfig{}),
+		Snapshots:              normalizeSnapshotConfig(SnapshotConfig{}),
+	}
+	normalizeRules(rules)
+	return rules
 }
 
 func (fw *Firewall) loadRules() {
@@ -205,38 +484,197 @@ func (fw *Firewall) loadRules() {
 	data, err := os.ReadFile(fw.rulesFile)
 	if err != nil {
 		fw.logErrorRateLimited("rules_read", "RULES", "Failed to read rules file: %v", err)
+		fw.writeRulesStatus(RulesStatus{Result: RulesStatusRejected, FileModTime: stat.ModTime(),
+			Errors: []RulesIssue{{Message: fmt.Sprintf("failed to read rules file: %v", err)}}})
 		return
 	}
+	revision := rulesRevision(data, stat.ModTime())
+
+	if len(fw.rulesKey) > 0 {
+		if err := verifyRulesSignature(data, rulesSignaturePath(fw.rulesFile), fw.rulesKey); err != nil {
+			fw.rulesMutex.Lock()
+			if fw.rules == nil {
+				fw.rules = fw.defaultRules()
+				fw.parsedRules = ParseRules(fw.rules)
+			}
+			fw.rulesMutex.Unlock()
+			fw.logErrorRateLimited("rules_signature", "RULES", "Rejected %s: %v - keeping current rules", fw.rulesFile, err)
+			fw.writeRulesStatus(RulesStatus{Result: RulesStatusRejected, Revision: revision, FileModTime: stat.ModTime(),
+				Errors: []RulesIssue{{Message: fmt.Sprintf("signature rejected: %v", err)}}})
+			return
+		}
+	}
 
 	var tempRules Rules
 	if err := json.Unmarshal(data, &tempRules); err != nil {
 		fw.logErrorRateLimited("rules_parse", "RULES", "Failed to parse rules JSON: %v - keeping current rules", err)
+		fw.writeRulesStatus(RulesStatus{Result: RulesStatusRejected, Revision: revision, FileModTime: stat.ModTime(),
+			Errors: []RulesIssue{parseIssue(data, err)}})
 		return
 	}
 
-	if tempRules.MaxAttemptsPerMinute <= 0 {
-		tempRules.MaxAttemptsPerMinute = 5
-	}
-	if tempRules.MaxAttemptsPerHour <= 0 {
-		tempRules.MaxAttemptsPerHour = 99
-	}
-	if tempRules.AutoBlockDurationHours <= 0 {
-		tempRules.AutoBlockDurationHours = 24
+	warnings := validateRules(&tempRules)
+	normalizeRules(&tempRules)
+
+	modTime := stat.ModTime()
+	if changed, expired := expireRuleEntries(&tempRules, fw.clock.Now()); changed {
+		saved, err := json.MarshalIndent(&tempRules, "", "  ")
+		if err == nil {
+			err = fw.writeRulesFile(saved)
+		}
+		if err != nil {
+			fw.logErrorRateLimited("rules_expiry", "RULES", "Failed to save rules with resolved TTLs: %v", err)
+		} else if stat, err := os.Stat(fw.rulesFile); err == nil {
+			modTime = stat.ModTime()
+		}
+		if len(expired) > 0 && fw.logger != nil {
+			fw.logger.LogInfo("RULES", "Expired %d rule entries: %s", len(expired), strings.Join(expired, ", "))
+		}
 	}
-	if len(tempRules.AllowedPorts) == 0 {
-		tempRules.AllowedPorts = []int{80, 443}
+	fw.logNormalizations(dedupeRuleEntries(&tempRules))
+
+	if conflicts := findRuleConflicts(ParseRules(&tempRules), tempRules.RulePrecedence); len(conflicts) > 0 {
+		if tempRules.RuleConflicts.Action == RuleConflictReject {
+			fw.rulesMutex.Lock()
+			if fw.rules == nil {
+				fw.rules = fw.defaultRules()
+				fw.parsedRules = ParseRules(fw.rules)
+			}
+			fw.rulesMutex.Unlock()
+			fw.logErrorRateLimited("rules_conflicts", "RULES", "Rejected %s: %d whitelist conflicts, first: %s - keeping current rules", fw.rulesFile, len(conflicts), conflicts[0])
+			fw.writeRulesStatus(RulesStatus{Result: RulesStatusRejected, Revision: revision, FileModTime: stat.ModTime(),
+				Errors: conflictIssues(conflicts), Warnings: warnings})
+			return
+		}
+		if fw.logger != nil {
+			fw.logger.LogWarning("RULES", "%d whitelist conflicts, first: %s", len(conflicts), conflicts[0])
+		}
+		warnings = append(warnings, conflictIssues(conflicts)...)
 	}
 
+	fw.rulesMutex.RLock()
+	diff := diffRules(fw.rules, &tempRules)
+	fw.rulesMutex.RUnlock()
+
+	fw.applyRules(&tempRules, modTime)
+	fw.writeRulesStatus(RulesStatus{Result: RulesStatusApplied, Revision: revision, FileModTime: stat.ModTime(),
+		Warnings: warnings, Diff: diff})
+}
+
+func normalizeRules(rules *Rules) {
+	if rules.MaxAttemptsPerMinute <= 0 {
+		rules.MaxAttemptsPerMinute = 5
+	}
+	if rules.MaxAttemptsPerHour <= 0 {
+		rules.MaxAttemptsPerHour = 99
+	}
+	if rules.AutoBlockDurationHours <= 0 {
+		rules.AutoBlockDurationHours = 24
+	}
+	if len(rules.AllowedPorts) == 0 {
+		rules.AllowedPorts = []int{80, 443}
+	}
+	if rules.IPv4AggregationPrefix <= 0 || rules.IPv4AggregationPrefix > 32 {
+		rules.IPv4AggregationPrefix = DefaultIPv4AggregationPrefix
+	}
+	if rules.IPv6AggregationPrefix <= 0 || rules.IPv6AggregationPrefix > 128 {
+		rules.IPv6AggregationPrefix = DefaultIPv6AggregationPrefix
+	}
+	rules.RulePrecedence = normalizeRulePrecedence(rules.RulePrecedence)
+	rules.RuleGroups = normalizeRuleGroups(rules.RuleGroups)
+	rules.RuleConflicts = normalizeRuleConflictConfig(rules.RuleConflicts)
+	rules.PortStrategy = normalizePortStrategy(rules.PortStrategy)
+	for port, strategy := range rules.ListenerPortStrategies {
+		rules.ListenerPortStrategies[port] = normalizePortStrategy(strategy)
+	}
+	rules.UpstreamTLS = normalizeUpstreamTLS(rules.UpstreamTLS)
+	rules.UpstreamDial = normalizeUpstreamDialConfig(rules.UpstreamDial)
+	rules.SocketOptions = normalizeSocketOptionsConfig(rules.SocketOptions)
+	for port, config := range rules.ListenerUpstreamTLS {
+		rules.ListenerUpstreamTLS[port] = normalizeUpstreamTLS(config)
+	}
+	rules.EndpointRateLimits = normalizeEndpointRateLimits(rules.EndpointRateLimits)
+	rules.ProtocolRateLimits = normalizeProtocolRateLimits(rules.ProtocolRateLimits)
+	rules.ProtocolAllowlist = normalizeProtocolAllowlist(rules.ProtocolAllowlist)
+	rules.LoginProtection = normalizeLoginProtection(rules.LoginProtection)
+	rules.TrafficSplit = normalizeTrafficSplit(rules.TrafficSplit)
+	rules.Mirror = normalizeMirrorConfig(rules.Mirror)
+	rules.Affinity = normalizeAffinity(rules.Affinity)
+	rules.AccessLog = normalizeAccessLogConfig(rules.AccessLog)
+	rules.HTMLReport = normalizeHTMLReportConfig(rules.HTMLReport)
+	rules.ErrorPages = normalizeErrorPagesConfig(rules.ErrorPages)
+	rules.FingerprintSuppression = normalizeFingerprintSuppression(rules.FingerprintSuppression)
+	rules.SecurityHeaders = normalizeSecurityHeaders(rules.SecurityHeaders)
+	rules.CORS = normalizeCORSPolicy(rules.CORS)
+	rules.TrustCookies = normalizeTrustCookieConfig(rules.TrustCookies)
+	rules.AbuseReports = normalizeAbuseReportConfig(rules.AbuseReports)
+	rules.RiskScoring = normalizeRiskScoring(rules.RiskScoring)
+	rules.DecisionCache = normalizeDecisionCacheConfig(rules.DecisionCache)
+	rules.BlockNotifications = normalizeBlockNotificationsConfig(rules.BlockNotifications)
+	rules.ScheduledReports = normalizeScheduledReportsConfig(rules.ScheduledReports)
+	rules.Middleware = normalizeMiddlewareConfig(rules.Middleware)
+	rules.Policies = normalizePolicies(rules.Policies)
+	rules.WasmFilters = normalizeWasmFilters(rules.WasmFilters)
+	rules.ExtAuthz = normalizeExtAuthzConfig(rules.ExtAuthz)
+	rules.Rego = normalizeRegoConfig(rules.Rego)
+	rules.BodyInspection = normalizeBodyInspection(rules.BodyInspection)
+	rules.Tenants = normalizeTenants(rules.Tenants)
+	rules.Quotas = normalizeQuotaConfig(rules.Quotas)
+	rules.APIKeys = normalizeAPIKeyConfig(rules.APIKeys)
+	rules.StatsD = normalizeStatsDConfig(rules.StatsD)
+	rules.SLO = normalizeSLOConfig(rules.SLO)
+	rules.AdaptiveRateLimit = normalizeAdaptiveRateLimit(rules.AdaptiveRateLimit)
+	rules.AnomalyDetection = normalizeAnomalyDetection(rules.AnomalyDetection)
+	rules.Appeals = normalizeAppealConfig(rules.Appeals)
+	rules.Snapshots = normalizeSnapshotConfig(rules.Snapshots)
+	rules.StagedRules = normalizeStagedRulesConfig(rules.StagedRules)
+	rules.IdleTimeout = normalizeIdleTimeoutConfig(rules.IdleTimeout)
+	rules.HalfOpen = normalizeHalfOpenLimits(rules.HalfOpen)
+	rules.LoadShedding = normalizeLoadShedding(rules.LoadShedding)
+	rules.Watchdog = normalizeWatchdogConfig(rules.Watchdog)
+	rules.MemoryBudget = normalizeMemoryBudget(rules.MemoryBudget)
+	rules.WarmState = normalizeWarmStateConfig(rules.WarmState)
+	rules.LogReplay = normalizeLogReplay(rules.LogReplay)
+	rules.PortScanDetection = normalizePortScanDetection(rules.PortScanDetection)
+	rules.ASNRateLimits = normalizeASNRateLimits(rules.ASNRateLimits)
+	rules.ASNDatabase = normalizeGeoDatabaseConfig(rules.ASNDatabase, DefaultASNDatabase)
+	rules.IPLists = normalizeIPLists(rules.IPLists)
+	rules.DNSBL = normalizeDNSBLConfig(rules.DNSBL)
+	rules.ReverseDNS = normalizeReverseDNSConfig(rules.ReverseDNS)
+	rules.Countries = normalizeCountryPolicy(rules.Countries)
+	rules.CountryDatabase = normalizeGeoDatabaseConfig(rules.CountryDatabase, DefaultCountryDatabase)
+	rules.Cluster = normalizeClusterConfig(rules.Cluster)
+	rules.QUIC = normalizeQUICConfig(rules.QUIC)
+}
+
+// applyRules makes already-normalized rules current. modTime is the rules
+// file's, so the watcher doesn't reload the same file again.
+func (fw *Firewall) applyRules(rules *Rules, modTime time.Time) {
 	fw.rulesMutex.Lock()
-	fw.rules = &tempRules
-	fw.parsedRules = ParseRules(&tempRules)
-	fw.rulesModTime = stat.ModTime()
+	fw.rules = rules
+	fw.parsedRules = ParseRules(rules)
+	fw.rulesModTime = modTime
 	fw.rulesMutex.Unlock()
+	fw.upstreamTLS.Reset()
 
 	if fw.logger != nil {
-		fw.logger.LogRulesReload(len(tempRules.BlockedIPs), len(tempRules.Whitelist), tempRules.AllowedPorts, tempRules.MaxAttemptsPerMinute)
+		routes, problems := buildLogRoutes(rules.Logging)
+		fw.logger.SetRoutes(routes)
+		for _, problem := range problems {
+			fw.logger.LogWarning("RULES", "Ignoring logging category %s", problem)
+		}
+		policy, problems := buildLogFilePolicy(rules.Logging.File)
+		fw.logger.SetFilePolicy(policy)
+		for _, problem := range problems {
+			fw.logger.LogWarning("RULES", "Logging file: %s - using the default", problem)
+		}
+
+		fw.logger.LogRulesReload(len(rules.BlockedIPs), len(rules.Whitelist), rules.AllowedPorts, rules.MaxAttemptsPerMinute)
 		fw.logger.LogStartup("DDoS Protection: MaxPerHour=%d, AutoBlock=%v, BlockDuration=%dh",
-			tempRules.MaxAttemptsPerHour, tempRules.AutoBlockEnabled, tempRules.AutoBlockDurationHours)
+			rules.MaxAttemptsPerHour, rules.AutoBlockEnabled, rules.AutoBlockDurationHours)
+		if rules.AllowlistOnly {
+			fw.logger.LogWarning("RULES", "Allowlist-only mode enabled - %d whitelist entries, all other clients are rejected", len(rules.Whitelist))
+		}
 	}
 }
 
@@ -246,28 +684,50 @@ func (fw *Firewall) rulesWatcher() {
 
 	for range ticker.C {
 		fw.loadRules()
+		fw.pruneExpiredRuleEntries()
 	}
 }
 
-func (fw *Firewall) isWhitelisted(ip string) bool {
+func (fw *Firewall) isRateLimitExempt(ip string) bool {
 	fw.rulesMutex.RLock()
 	defer fw.rulesMutex.RUnlock()
 
-	if fw.parsedRules != nil {
-		return fw.parsedRules.IsWhitelisted(ip)
-	}
-	return false
+	return fw.parsedRules != nil && fw.parsedRules.RateLimitExempt.Contains(ip)
 }
 
-func (fw *Firewall) isBlocked(ip string) bool {
+func (fw *Firewall) allowlistOnly() bool {
 	fw.rulesMutex.RLock()
 	defer fw.rulesMutex.RUnlock()
 
-	if fw.parsedRules != nil && fw.parsedRules.IsBlocked(ip) {
-		return true
+	return fw.rules.AllowlistOnly
+}
+
+// isWhitelisted also covers clients let through by a redeemed appeal. A
+// client matched by a rule ranked above the whitelist isn't whitelisted.
+func (fw *Firewall) isWhitelisted(ip string) bool {
+	return fw.decidePrecedence(ip, fw.aggregationKey(ip), fw.clock.Now()).Rule == RuleWhitelist
+}
+
+// aggregationKey maps a client IP to the prefix its rate limits, SYN-flood
+// tracking and auto-blocks are accounted against, so IPv6 clients can't
+// escape limits by rotating addresses within their /64. Over the memory
+// budget, new clients are aggregated more coarsely still.
+func (fw *Firewall) aggregationKey(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
 	}
 
-	return fw.isAutoBlocked(ip)
+	fw.rulesMutex.RLock()
+	v4Prefix := fw.rules.IPv4AggregationPrefix
+	v6Prefix := fw.rules.IPv6AggregationPrefix
+	fw.rulesMutex.RUnlock()
+
+	if fw.memory.Level() >= MemoryCoarse {
+		v4Prefix = min(v4Prefix, CoarseIPv4AggregationPrefix)
+		v6Prefix = min(v6Prefix, CoarseIPv6AggregationPrefix)
+	}
+	return AggregateIP(parsed, v4Prefix, v6Prefix)
 }
 
 func (fw *Firewall) isAllowedPort(port int) bool {
@@ -280,58 +740,63 @@ func (fw *Firewall) isAllowedPort(port int) bool {
 	return true
 }
 
-func (fw *Firewall) extractRequestedPort(conn net.Conn) (int, []byte, error) {
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	defer conn.SetReadDeadline(time.Time{})
+func (fw *Firewall) allowedHosts() []string {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
 
-	reader := bufio.NewReader(conn)
+	return fw.rules.AllowedHosts
+}
 
-	firstLine, err := reader.ReadString('\n')
-	if err != nil {
-		return 0, nil, err
-	}
+func (fw *Firewall) extractRequestedPort(conn net.Conn) (int, *RequestHead, error) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
 
-	var requestBuffer []byte
-	requestBuffer = append(requestBuffer, []byte(firstLine)...)
+	reader := acquireReader(conn)
+	defer releaseReader(reader)
 
-	var hostHeader string
-	for {
-		line, err := reader.ReadString('\n')
+	parse := parseRequestHead
+	if signatures := fw.protocolSignatures(); signatures != nil {
+		signature, err := sniffProtocol(reader, signatures)
 		if err != nil {
 			return 0, nil, err
 		}
-		requestBuffer = append(requestBuffer, []byte(line)...)
-
-		if strings.HasPrefix(strings.ToLower(line), "host:") {
-			hostHeader = strings.TrimSpace(line[5:])
-		}
-
-		if line == "\r\n" || line == "\n" {
-			break
+		if signature.Name != SignatureHTTP {
+			parse = func(reader *bufio.Reader) (*RequestHead, error) {
+				return readOpaqueHead(reader, signature)
+			}
 		}
 	}
 
-	port := 80
-	if hostHeader != "" {
-		if strings.Contains(hostHeader, ":") {
-			parts := strings.Split(hostHeader, ":")
-			if len(parts) >= 2 {
-				if p, err := strconv.Atoi(parts[len(parts)-1]); err == nil {
-					port = p
-				}
-			}
-		}
+	head, err := parse(reader)
+	if err != nil {
+		return 0, nil, err
 	}
 
-	return port, requestBuffer, nil
+	return fw.requestedPort(conn, head.Host()), head, nil
+}
+
+// requestedPort is the upstream port a request on conn for host asks for.
+func (fw *Firewall) requestedPort(conn net.Conn, host string) int {
+	if dst, ok := fw.originalDestination(conn); ok {
+		return dst.Port
+	}
+	localPort := listenerPort(conn)
+	return fw.portStrategyFor(localPort).Resolve(localPort, host)
 }
 
 func (fw *Firewall) isSynFlooding(ip string) bool {
-	now := time.Now()
+	now := fw.clock.Now()
 
 	fw.synFloodMutex.Lock()
 	defer fw.synFloodMutex.Unlock()
 
+	if until, flagged := fw.peerSynFloods[ip]; flagged {
+		if now.Before(until) {
+			return true
+		}
+		delete(fw.peerSynFloods, ip)
+	}
+
 	attempts := fw.synFloodTracker[ip]
 
 	var validAttempts []time.Time
@@ -346,6 +811,9 @@ func (fw *Firewall) isSynFlooding(ip string) bool {
 
 	// Only block if significantly over threshold (not just by 1)
 	if len(validAttempts) > MaxSynPerWindow*2 {
+		if len(validAttempts) == MaxSynPerWindow*2+1 {
+			fw.publishVerdict(ClusterVerdictSynFlood, ip, "SYN flood", SynFloodWindow)
+		}
 		fw.logger.LogError("SYN_FLOOD", "IP %s: %d tentativi in %v (limite: %d)",
 			ip, len(validAttempts), SynFloodWindow, MaxSynPerWindow*2)
 		return true
@@ -386,24 +854,19 @@ func (fw *Firewall) decrementActiveConnections(ip string) {
 }
 
 func (fw *Firewall) isRateLimited(ip string) bool {
-	now := time.Now()
+	now := fw.clock.Now()
 	window := time.Minute
 
 	fw.attemptsMutex.Lock()
 	defer fw.attemptsMutex.Unlock()
 
-	if len(fw.connectionAttempts) >= MaxTrackedIPs {
-		for oldIP := range fw.connectionAttempts {
-			delete(fw.connectionAttempts, oldIP)
-			if fw.logger != nil {
-				fw.logger.LogWarning("RATELIMIT", "Dropped tracking for IP %s due to memory limits", oldIP)
-			}
-			break
+	attempts, tracked := fw.connectionAttempts[ip]
+	if !tracked && len(fw.connectionAttempts) >= fw.trackedClientLimit() {
+		if oldIP, ok := fw.evictTrackedIP(); ok && fw.logger != nil {
+			fw.logger.LogWarning("RATELIMIT", "Dropped tracking for IP %s due to memory limits", oldIP)
 		}
 	}
 
-	attempts := fw.connectionAttempts[ip]
-
 	var validAttempts []time.Time
 	for _, attempt := range attempts {
 		if now.Sub(attempt) < window {
@@ -413,12 +876,78 @@ func (fw *Firewall) isRateLimited(ip string) bool {
 
 	validAttempts = append(validAttempts, now)
 	fw.connectionAttempts[ip] = validAttempts
+	fw.trackedIPs.Touch(ip)
+
+	return len(validAttempts)+fw.remoteAttempts(ip) > fw.perMinuteLimit(ip)
+}
 
+// perMinuteLimit is the configured per-IP limit (or the stricter of its ASN's
+// and IP lists' overrides), scaled down by the adaptive controller under load and again for clients
+// flagged as anomalous or with a high risk score.
+func (fw *Firewall) perMinuteLimit(key string) int {
 	fw.rulesMutex.RLock()
-	maxAttempts := fw.rules.MaxAttemptsPerMinute
+	limit := fw.rules.MaxAttemptsPerMinute
+	anomaly := fw.rules.AnomalyDetection
 	fw.rulesMutex.RUnlock()
 
-	return len(validAttempts) > maxAttempts
+	if asnLimit, ok := fw.asnRateLimit(key); ok {
+		limit = asnLimit
+	}
+	if listLimit, ok := fw.ipListRateLimit(key); ok && listLimit < limit {
+		limit = listLimit
+	}
+	limit = fw.adaptive.Scale(limit)
+
+	if anomaly.Enabled && anomaly.Action == AnomalyActionLimit && fw.anomaly.IsFlagged(key, fw.clock.Now()) {
+		limit = max(1, int(float64(limit)*anomaly.LimitFactor))
+	}
+	if factor := fw.riskThrottleFactor(key); factor < 1 {
+		limit = max(1, int(float64(limit)*factor))
+	}
+	return limit
+}
+
+// evictTrackedIP drops the least suspicious of the least-recently-seen IPs.
+// Auto-blocked IPs are skipped unless nothing else is available. Callers must
+// hold attemptsMutex.
+func (fw *Firewall) evictTrackedIP() (string, bool) {
+	candidates := fw.trackedIPs.Oldest(EvictionSampleSize)
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	victim := ""
+	lowestScore := -1
+	for _, candidate := range candidates {
+		if _, blocked := fw.autoBlockedIPs[candidate]; blocked {
+			continue
+		}
+		score := len(fw.connectionAttempts[candidate]) + len(fw.hourlyAttempts[candidate])
+		if lowestScore < 0 || score < lowestScore {
+			victim = candidate
+			lowestScore = score
+		}
+	}
+	if victim == "" {
+		victim = candidates[0]
+	}
+
+	delete(fw.connectionAttempts, victim)
+	fw.trackedIPs.Remove(victim)
+	return victim, true
+}
+
+// autoBlockRemaining returns how long key stays auto-blocked, or 0.
+func (fw *Firewall) autoBlockRemaining(key string) time.Duration {
+	fw.attemptsMutex.RLock()
+	defer fw.attemptsMutex.RUnlock()
+
+	if blockExpiry, exists := fw.autoBlockedIPs[key]; exists {
+		if remaining := blockExpiry.Sub(fw.clock.Now()); remaining > 0 {
+			return remaining
+		}
+	}
+	return 0
 }
 
 func (fw *Firewall) isAutoBlocked(ip string) bool {
@@ -426,7 +955,7 @@ func (fw *Firewall) isAutoBlocked(ip string) bool {
 	defer fw.attemptsMutex.RUnlock()
 
 	if blockExpiry, exists := fw.autoBlockedIPs[ip]; exists {
-		if time.Now().Before(blockExpiry) {
+		if fw.clock.Now().Before(blockExpiry) {
 			return true
 		} else {
 			delete(fw.autoBlockedIPs, ip)
@@ -439,7 +968,7 @@ func (fw *Firewall) isAutoBlocked(ip string) bool {
 }
 
 func (fw *Firewall) trackHourlyAttempts(ip string) {
-	now := time.Now()
+	now := fw.clock.Now()
 	window := time.Hour
 
 	fw.attemptsMutex.Lock()
@@ -468,7 +997,7 @@ func (fw *Firewall) trackHourlyAttempts(ip string) {
 
 	if len(validAttempts) > maxHourlyAttempts {
 		blockExpiry := now.Add(time.Duration(blockDurationHours) * time.Hour)
-		fw.autoBlockedIPs[ip] = blockExpiry
+		fw.autoBlockLocked(ip, "DDoS_AUTO_BLOCK", blockExpiry)
 
 		go fw.addToBlockedList(ip)
 
@@ -488,13 +1017,11 @@ func (fw *Firewall) addToBlockedList(ip string) {
 	fw.rulesMutex.Lock()
 	defer fw.rulesMutex.Unlock()
 
-	for _, blockedIP := range fw.rules.BlockedIPs {
-		if blockedIP == ip {
-			return
-		}
+	if _, listed := fw.rules.BlockedIPs.Find(ip); listed {
+		return
 	}
 
-	fw.rules.BlockedIPs = append(fw.rules.BlockedIPs, ip)
+	fw.rules.BlockedIPs = append(fw.rules.BlockedIPs, RuleEntry{Entry: ip, Comment: "auto-block", CreatedBy: "firewall", CreatedAt: fw.clock.Now().UTC()})
 
 	data, err := json.MarshalIndent(fw.rules, "", "  ")
 	if err != nil {
@@ -504,7 +1031,7 @@ func (fw *Firewall) addToBlockedList(ip string) {
 		return
 	}
 
-	if err := os.WriteFile(fw.rulesFile, data, 0644); err != nil {
+	if err := fw.writeRulesFile(data); err != nil {
 		if fw.logger != nil {
 			fw.logger.LogError("RULES", "Failed to save auto-blocked IP %s: %v", ip, err)
 		}
@@ -518,13 +1045,51 @@ func (fw *Firewall) addToBlockedList(ip string) {
 	}
 }
 
+func (fw *Firewall) removeFromBlockedList(ip string) {
+	fw.rulesMutex.Lock()
+	defer fw.rulesMutex.Unlock()
+
+	remaining := make(RuleEntryList, 0, len(fw.rules.BlockedIPs))
+	for _, blockedIP := range fw.rules.BlockedIPs {
+		if blockedIP.Entry != ip {
+			remaining = append(remaining, blockedIP)
+		}
+	}
+	if len(remaining) == len(fw.rules.BlockedIPs) {
+		return
+	}
+
+	fw.rules.BlockedIPs = remaining
+
+	data, err := json.MarshalIndent(fw.rules, "", "  ")
+	if err != nil {
+		if fw.logger != nil {
+			fw.logger.LogError("RULES", "Failed to marshal rules for unblock: %v", err)
+		}
+		return
+	}
+
+	if err := fw.writeRulesFile(data); err != nil {
+		if fw.logger != nil {
+			fw.logger.LogError("RULES", "Failed to save unblock of IP %s: %v", ip, err)
+		}
+		return
+	}
+
+	fw.parsedRules = ParseRules(fw.rules)
+
+	if fw.logger != nil {
+		fw.logger.LogStartup("IP %s removed from permanent block list", ip)
+	}
+}
+
 func (fw *Firewall) logDDoSStats() {
 	fw.attemptsMutex.RLock()
 	defer fw.attemptsMutex.RUnlock()
 
 	activeAutoBlocks := 0
 	expiredBlocks := 0
-	now := time.Now()
+	now := fw.clock.Now()
 
 	for _, blockExpiry := range fw.autoBlockedIPs {
 		if now.Before(blockExpiry) {
@@ -544,24 +1109,27 @@ func (fw *Firewall) logDDoSStats() {
 }
 
 func (fw *Firewall) cleanupOldAttempts() {
-	now := time.Now()
+	now := fw.clock.Now()
 	window := time.Minute
 	hourlyWindow := time.Hour
+	shrink := fw.memory.Level() >= MemoryShrinking
+	limit := fw.trackedClientLimit()
+	scanWindow := time.Duration(fw.portScanDetection().WindowSeconds) * time.Second
+	reportWindow := time.Duration(fw.abuseReportConfig().WindowMinutes) * time.Minute
+	riskHalfLife := fw.riskScoring().halfLife()
 	deletedEntries := 0
 
 	fw.attemptsMutex.Lock()
 	defer fw.attemptsMutex.Unlock()
 
-	forceCleanup := len(fw.connectionAttempts) > ForceCleanupThreshold
+	cleanupWindow, hourlyCleanupWindow := window, hourlyWindow
+	if shrink {
+		cleanupWindow, hourlyCleanupWindow = ShrunkAttemptsWindow, ShrunkHourlyWindow
+	}
 
 	for ip, attempts := range fw.connectionAttempts {
 		var validAttempts []time.Time
 
-		cleanupWindow := window
-		if forceCleanup {
-			cleanupWindow = 30 * time.Second
-		}
-
 		for _, attempt := range attempts {
 			if now.Sub(attempt) < cleanupWindow {
 				validAttempts = append(validAttempts, attempt)
@@ -570,6 +1138,7 @@ func (fw *Firewall) cleanupOldAttempts() {
 
 		if len(validAttempts) == 0 {
 			delete(fw.connectionAttempts, ip)
+			fw.trackedIPs.Remove(ip)
 			deletedEntries++
 		} else {
 			fw.connectionAttempts[ip] = validAttempts
@@ -580,7 +1149,7 @@ func (fw *Firewall) cleanupOldAttempts() {
 		var validAttempts []time.Time
 
 		for _, attempt := range attempts {
-			if now.Sub(attempt) < hourlyWindow {
+			if now.Sub(attempt) < hourlyCleanupWindow {
 				validAttempts = append(validAttempts, attempt)
 			}
 		}
@@ -592,6 +1161,62 @@ func (fw *Firewall) cleanupOldAttempts() {
 		}
 	}
 
+	for key, failures := range fw.loginFailures {
+		var validFailures []time.Time
+
+		for _, failure := range failures {
+			if now.Sub(failure) < hourlyCleanupWindow {
+				validFailures = append(validFailures, failure)
+			}
+		}
+
+		if len(validFailures) == 0 {
+			delete(fw.loginFailures, key)
+		} else {
+			fw.loginFailures[key] = validFailures
+		}
+	}
+
+	for bucket, attempts := range fw.endpointAttempts {
+		var validAttempts []time.Time
+
+		for _, attempt := range attempts {
+			if now.Sub(attempt) < window {
+				validAttempts = append(validAttempts, attempt)
+			}
+		}
+
+		if len(validAttempts) == 0 {
+			delete(fw.endpointAttempts, bucket)
+		} else {
+			fw.endpointAttempts[bucket] = validAttempts
+		}
+	}
+
+	fw.transfers.Cleanup(now)
+	fw.quotas.Cleanup(now)
+	fw.portScans.Cleanup(now, scanWindow)
+	fw.dnsbl.Cleanup(now)
+	fw.rdns.Cleanup(now)
+
+	fw.synFloodMutex.Lock()
+	for ip, attempts := range fw.synFloodTracker {
+		if len(attempts) == 0 || now.Sub(attempts[len(attempts)-1]) > SynFloodWindow {
+			delete(fw.synFloodTracker, ip)
+		}
+	}
+	for key, until := range fw.peerSynFloods {
+		if now.After(until) {
+			delete(fw.peerSynFloods, key)
+		}
+	}
+	fw.synFloodMutex.Unlock()
+	fw.anomaly.Cleanup(now)
+	fw.appeals.Cleanup(now)
+	fw.abuseReports.Cleanup(now, reportWindow)
+	fw.riskScores.Cleanup(now, riskHalfLife)
+	fw.decisions.Cleanup(now)
+
 	for ip, blockExpiry := range fw.autoBlockedIPs {
 		if now.After(blockExpiry) {
 			delete(fw.autoBlockedIPs, ip)
@@ -600,17 +1225,19 @@ func (fw *Firewall) cleanupOldAttempts() {
 			}
 		}
 	}
+	for key := range fw.autoBlockReasons {
+		if _, blocked := fw.autoBlockedIPs[key]; !blocked {
+			delete(fw.autoBlockReasons, key)
+		}
+	}
 
-	if len(fw.connectionAttempts) > MaxTrackedIPs {
-		excess := len(fw.connectionAttempts) - MaxTrackedIPs
-		count := 0
-		for ip := range fw.connectionAttempts {
-			if count >= excess {
+	if len(fw.connectionAttempts) > limit {
+		excess := len(fw.connectionAttempts) - limit
+		for i := 0; i < excess; i++ {
+			if _, ok := fw.evictTrackedIP(); !ok {
 				break
 			}
-			delete(fw.connectionAttempts, ip)
 			deletedEntries++
-			count++
 		}
 
 		if fw.logger != nil {
@@ -622,8 +1249,8 @@ func (fw *Firewall) cleanupOldAttempts() {
 		fw.logger.LogCleanup(deletedEntries)
 	}
 
-	if len(fw.connectionAttempts) > ForceCleanupThreshold && fw.logger != nil {
-		fw.logger.LogWarning("RATELIMIT", "High IP tracking usage: %d/%d IPs", len(fw.connectionAttempts), MaxTrackedIPs)
+	if shrink && fw.logger != nil {
+		fw.logger.LogWarning("RATELIMIT", "High IP tracking usage: %d/%d IPs within memory budget", len(fw.connectionAttempts), limit)
 	}
 }
 
@@ -644,25 +1271,41 @@ func (fw *Firewall) attemptsCleanupWatcher() {
 	}
 }
 
-func (fw *Firewall) forwardData(src, dst net.Conn, direction string, wg *sync.WaitGroup) {
+// forwardData copies src to dst. When out is non-nil the bytes are written
+// through it instead (e.g. a response sniffer wrapping dst).
+func (fw *Firewall) forwardData(ctx context.Context, src, dst net.Conn, out io.Writer, direction string, live *ActiveConnection, copied *atomic.Int64, wg *sync.WaitGroup) {
 	defer wg.Done()
+	defer func() {
+		// Closing both ends unblocks the other direction's copy.
+		if r := recover(); r != nil {
+			fw.logPanic(fw.logger, "forward "+direction, r)
+			src.Close()
+			dst.Close()
+		}
+	}()
 
-	src.SetReadDeadline(time.Now().Add(ConnectionTimeout))
-	dst.SetWriteDeadline(time.Now().Add(ConnectionTimeout))
+	if out == nil {
+		out = dst
+	}
 
-	written, err := io.Copy(dst, src)
-	if err != nil {
+	buf := acquireCopyBuffer()
+	defer releaseCopyBuffer(buf)
+
+	_, err := io.CopyBuffer(out, &activityReader{src: src, dst: dst, n: copied, live: live}, *buf)
+	if err != nil && ctx.Err() == nil {
 		if fw.logger != nil && !isConnectionClosed(err) {
 			fw.logger.LogDebug("PROXY", "Forward error (%s): %v", direction, err)
 		}
 	}
-
-	if tcpConn, ok := dst.(*net.TCPConn); ok {
-		tcpConn.CloseWrite()
+	if errors.Is(err, errMalformedMessage) {
+		// Nothing more on the connection can be checked.
+		src.Close()
+		dst.Close()
+		return
 	}
 
-	if fw.logger != nil && written > 0 {
-		fw.logger.LogDebug("PROXY", "Forwarded %d bytes (%s)", written, direction)
+	if halfCloser, ok := dst.(interface{ CloseWrite() error }); ok {
+		halfCloser.CloseWrite()
 	}
 }
 
@@ -676,111 +1319,377 @@ func isConnectionClosed(err error) bool {
 		strings.Contains(errStr, "broken pipe")
 }
 
-func (fw *Firewall) handleConnection(conn net.Conn) {
+// handleConnection runs one client connection. The request head must arrive
+// within ConnectionTimeout; after that the connection lives as long as data
+// keeps moving. Cancelling ctx closes both sockets, so blocked reads and
+// writes return at once. The caller acquires the connection's slot in
+// connSlots; it is released here.
+func (fw *Firewall) handleConnection(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
 	defer fw.activeConns.Done()
+	defer fw.connSlots.Release(1)
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
 
 	clientAddr := conn.RemoteAddr().(*net.TCPAddr)
 	ip := clientAddr.IP.String()
+	key := fw.aggregationKey(ip)
+	fw.trafficStats.RecordConnection(ip)
+	fw.reportPeriods.RecordConnection(ip, fw.clock.Now())
 
-	// First check: whitelist always wins
-	if fw.isWhitelisted(ip) {
-		fw.logger.LogWhitelist(ip)
-	} else {
-		// Only apply protections to non-whitelisted IPs
-		if fw.isSynFlooding(ip) {
-			fw.logger.LogBlocked(ip, "SYN_FLOOD", "SYN flood protection triggered")
-			return
-		}
+	connID := newConnectionID()
+	logger := fw.logger.WithRequestID(connID)
 
-		if fw.hasTooManyConnections(ip) {
-			fw.logger.LogBlocked(ip, "TOO_MANY_CONNECTIONS", fmt.Sprintf("Too many active connections (%d/%d)", fw.activeConnsByIP[ip], MaxConnectionsPerIP))
-			return
+	connRecord := newConnectionRecord(connID, ip, clientAddr.Port)
+	defer func() {
+		if connRecord.Hostname == "" {
+			connRecord.Hostname = fw.cachedHostname(ip)
 		}
-
-		if fw.isBlocked(ip) {
-			fw.logger.LogBlocked(ip, "BLOCKED_IP", "IP is in blocked list")
-			return
+		fw.shadowStagedRules(connRecord, key)
+		fw.protocolStats.Record(connRecord)
+		fw.tenantStats.Record(connRecord)
+		fw.apiClientStats.Record(connRecord)
+		logger.LogConnectionSummary(connRecord, fw.connectionLogConfig().DebugDetail)
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			fw.logPanic(logger, "connection", r)
+			connRecord.Fail("PANIC")
 		}
+	}()
 
-		if fw.isRateLimited(ip) {
-			fw.logger.LogRateLimit(ip, len(fw.connectionAttempts[ip]), fw.rules.MaxAttemptsPerMinute)
-			fw.trackHourlyAttempts(ip)
-			return
-		}
+	ms := &MiddlewareState{Conn: conn, ConnID: connID, IP: ip, Key: key, Logger: logger, Record: connRecord}
+	defer fw.chargeQuotaBytes(ms)
+	block := ms.Block
+
+	ptr := fw.reverseDNS(ip)
+	connRecord.Hostname = ptr.Hostname
+	ms.Hostname = ptr.Hostname
 
-		fw.trackHourlyAttempts(ip)
+	ms.Exempt = fw.isRateLimitExempt(ip)
+	if ms.Exempt {
+		connRecord.Event("exempt from rate limits")
+	}
+
+	// The accept middleware run before the request head is read, the request
+	// middleware after; a connection through both is routed upstream.
+	chain := fw.middlewareChain()
+	if !fw.runMiddleware(chain.Accept, ms) {
+		return
+	}
+	if !ms.Whitelisted && !ms.Exempt {
+		fw.trackHourlyAttempts(key)
 	}
 
 	fw.incrementActiveConnections(ip)
 	defer fw.decrementActiveConnections(ip)
+	fw.applySocketOptions(conn, fw.socketOptions().Client, "client")
 
-	fw.connMutex.Lock()
-	currentConns := fw.connCounter
-	if currentConns >= MaxConcurrentConns {
-		fw.connMutex.Unlock()
-		fw.logger.LogBlocked(ip, "MAX_CONCURRENT", fmt.Sprintf("Maximum concurrent connections reached (%d)", MaxConcurrentConns))
+	if reason, admitted := fw.halfOpen.Acquire(ip, fw.halfOpenLimits(), fw.isWhitelisted(ip)); !admitted {
+		block("HALF_OPEN_LIMIT", reason)
 		return
 	}
-	fw.connCounter++
-	fw.connMutex.Unlock()
 
-	defer func() {
-		fw.connMutex.Lock()
-		fw.connCounter--
-		fw.connMutex.Unlock()
-	}()
+	live := fw.connections.Add(connRecord, cancel)
+	defer fw.connections.Remove(connID)
 
-	conn.SetDeadline(time.Now().Add(ConnectionTimeout))
+	live.idle = fw.idleTimeoutConfig()
+	conn.SetReadDeadline(time.Now().Add(ConnectionTimeout))
 
-	fw.logger.LogConnection(ip, clientAddr.Port, "INCOMING")
-	fw.logger.LogError("DEBUG", "Starting connection handling for IP: %s", ip)
+	connRecord.Event("accepted")
 
-	requestedPort, requestBuffer, err := fw.extractRequestedPort(conn)
+	requestedPort, requestHead, err := fw.extractRequestedPort(conn)
+	fw.halfOpen.Release(ip)
+	connRecord.ParseTime = time.Since(connRecord.StartedAt)
+	var unknownProtocol *unknownProtocolError
+	if errors.As(err, &unknownProtocol) {
+		connRecord.Protocol = ProtocolUnknown
+		block("PROTOCOL_NOT_ALLOWED", unknownProtocol.Error())
+		return
+	}
 	if err != nil {
-		fw.logErrorRateLimited(ip, "PARSE_ERROR", "Failed to parse request from %s: %v", ip, err)
+		fw.logErrorRateLimitedTo(logger, ip, "PARSE_ERROR", "Failed to parse request from %s: %v", ip, err)
+		connRecord.Fail("PARSE_ERROR")
+		connRecord.Protocol = ProtocolUnknown
+		switch err {
+		case errRequestHeadTooLarge:
+			fw.writeHTTPError(conn, connID, http.StatusRequestHeaderFieldsTooLarge, "Request headers too large.", 0)
+		case errMalformedRequest:
+			fw.writeHTTPError(conn, connID, http.StatusBadRequest, "Malformed request.", 0)
+		}
 		return
 	}
+	defer requestHead.Release()
+	connRecord.Protocol = classifyProtocol(requestHead)
 
-	fw.logger.LogError("DEBUG", "Extracted port %d from request by IP %s", requestedPort, ip)
+	if requestHead.Opaque {
+		connRecord.Event("%s connection to %q, port %d", requestHead.Proto, requestHead.Host(), requestedPort)
+	} else {
+		connRecord.Event("request %s %s, port %d", requestHead.Method, requestHead.Path(), requestedPort)
+	}
 
-	// Check port only for non-whitelisted IPs
-	if !fw.isWhitelisted(ip) && !fw.isAllowedPort(requestedPort) {
-		fw.logger.LogBlocked(ip, "BLOCKED_PORT", fmt.Sprintf("Port %d not allowed", requestedPort))
+	ms.Port, ms.Head = requestedPort, requestHead
+	if !fw.runMiddleware(chain.Request, ms) {
 		return
 	}
 
-	proxyAddr := net.JoinHostPort(fw.proxyHost, strconv.Itoa(fw.proxyPort))
-	fw.logger.LogAllowed(ip, proxyAddr)
+	upstream, canary := fw.selectUpstream(ip, requestHead, ms.Tenant)
+	if dst, ok := fw.originalDestination(conn); ok && fw.ingressMode == IngressModeTProxy {
+		upstream, canary = Upstream{Host: dst.IP.String(), Port: dst.Port}, false
+	}
+	proxyAddr := upstream.Addr()
+	connRecord.Upstream = proxyAddr
+	live.SetUpstream(proxyAddr)
+	connRecord.Canary = canary
 
-	proxyConn, err := net.DialTimeout("tcp", proxyAddr, ProxyConnectTimeout)
+	dialStart := time.Now()
+	proxyConn, err := fw.connectUpstream(ctx, upstream, listenerPort(conn), ProxyConnectTimeout)
+	connRecord.DialTime = time.Since(dialStart)
 	if err != nil {
-		fw.logErrorRateLimited(ip, "PROXY_ERROR", "Failed to connect to proxy %s: %v", proxyAddr, err)
+		fw.logErrorRateLimitedTo(logger, ip, "PROXY_ERROR", "Failed to connect to proxy %s: %v", proxyAddr, err)
+		connRecord.Fail("PROXY_ERROR")
+		fw.adaptive.RecordUpstreamError()
 		return
 	}
 	defer proxyConn.Close()
+	defer context.AfterFunc(ctx, func() { proxyConn.Close() })()
+
+	connRecord.Event("connected to %s", proxyAddr)
+	fw.latencyStats.Connect.Observe(connRecord.DialTime)
+	fw.statsd.RecordTiming(StatsDConnectTime, connRecord.DialTime)
+	defer func() {
+		duration := time.Since(connRecord.StartedAt)
+		fw.latencyStats.Duration.Observe(duration)
+		fw.statsd.RecordTiming(StatsDConnectionDuration, duration)
+	}()
 
-	fw.logger.LogProxy(ip, fw.proxyHost, fw.proxyPort, "CONNECTED")
+	mirror := fw.startMirror(ip)
+	defer mirror.Close()
+
+	var upstreamWriter io.Writer = proxyConn
+	if mirror != nil {
+		upstreamWriter = &mirrorTee{dst: proxyConn, mirror: mirror}
+	}
+
+	var exceededOnce sync.Once
+	newLimiter := func(direction TransferDirection, dst io.Writer) *transferLimiter {
+		perConnLimit, dailyQuota := fw.transferLimits(direction)
+		return &transferLimiter{
+			dst:          dst,
+			tracker:      fw.transfers,
+			now:          fw.clock.Now,
+			key:          key,
+			direction:    direction,
+			perConnLimit: perConnLimit,
+			dailyQuota:   dailyQuota,
+			onExceeded: func(reason string, written int64) {
+				exceededOnce.Do(func() {
+					logger.LogTransferExceeded(ip, direction, reason, written)
+					if direction == TransferIn {
+						connRecord.Block("INGRESS_LIMIT")
+					} else {
+						connRecord.Block("EGRESS_LIMIT")
+					}
+					conn.Close()
+					proxyConn.Close()
+				})
+			},
+		}
+	}
 
-	_, err = proxyConn.Write(requestBuffer)
-	if err != nil {
-		fw.logErrorRateLimited(ip, "PROXY_WRITE_ERROR", "Failed to write to proxy: %v", err)
-		return
+	loginProtection := fw.loginProtection()
+	watchBehavior := fw.anomalyDetection().Enabled && !fw.isWhitelisted(ip)
+	fingerprint := fw.fingerprintSuppression()
+	securityHeaders := fw.securityHeaders()
+	authzHeaders := fw.extAuthzConfig().UpstreamHeaders
+	inspection := fw.bodyInspection()
+	pairs := newExchange()
+	requests := 0
+	requestStream := newHTTPStream(newLimiter(TransferIn, upstreamWriter), &requestStreamHandler{
+		exchange: pairs,
+		onHead: func(head *messageHead, info *RequestInfo) {
+			// Any client-supplied ID is replaced so the ID upstream always
+			// matches the firewall's own log lines.
+			requests++
+			info.RequestID = requestID(connID, requests)
+			request := ms
+			if requests > 1 {
+				// A refused request and all after it stay with the firewall;
+				// the refusal is answered once the earlier requests are, and
+				// ends the connection.
+				var allowed bool
+				if request, allowed = fw.checkFollowUp(chain.Request, ms, head, info.RequestID); !allowed {
+					head.Refuse()
+					pairs.whenIdle(func() {
+						request.Conn.(*followUpConn).Flush()
+						cancel(errRequestRefused)
+					})
+					return
+				}
+			}
+			head.Set(RequestIDHeader, info.RequestID)
+			// Each request carries the headers its own checks left, such as
+			// the identity ext_authz vouched for, never an earlier one's nor
+			// the client's own.
+			for _, name := range authzHeaders {
+				head.Del(name)
+			}
+			for name, values := range request.UpstreamHeaders {
+				head.Del(name)
+				for _, value := range values {
+					head.Add(name, value)
+				}
+			}
+			if fw.inspectsBody(inspection, request, info.Path()) {
+				head.Hold(inspection.MaxBodyBytes, func(body []byte, err error) bool {
+					if fw.inspectBody(inspection, head.Header, body, err, request) {
+						return true
+					}
+					pairs.withdraw(info)
+					pairs.whenIdle(func() {
+						if followUp, ok := request.Conn.(*followUpConn); ok {
+							followUp.Flush()
+						}
+						cancel(errBodyRefused)
+					})
+					return false
+				})
+			}
+			if watchBehavior {
+				fw.anomaly.RecordRequest(key, info.Path(), fw.clock.Now())
+			}
+		},
+	})
+	responseStream := newHTTPStream(newLimiter(TransferOut, conn), &responseStreamHandler{
+		exchange: pairs,
+		onHead: func(head *messageHead, record *ResponseRecord) {
+			if fingerprint.Enabled {
+				fw.suppressFingerprint(fingerprint, head, record)
+			}
+			if securityHeaders.Enabled {
+				injectSecurityHeaders(securityHeaders, head, record.Status)
+			}
+		},
+		onResponse: func(record ResponseRecord) {
+			if record.Index == 0 {
+				connRecord.FirstByte = record.Latency
+			}
+			connRecord.Event("response %d, %d bytes", record.Status, record.Bytes)
+			if record.Status == http.StatusSwitchingProtocols {
+				live.MarkUpgraded()
+			}
+			fw.responseStats.Record(record)
+			fw.latencyStats.FirstByte.Observe(record.Latency)
+			fw.statsd.RecordTiming(StatsDUpstreamLatency, record.Latency)
+			fw.trafficStats.RecordBytes(record.Bytes)
+			fw.logAccess(ip, record)
+			if record.Request != nil && loginProtection.Watches(record.Request.Path()) {
+				fw.recordLoginResult(ip, key, record.Status)
+			}
+			if watchBehavior {
+				fw.recordAnomalyResponse(ip, key, record.Status)
+			}
+		},
+	})
+
+	if requestHead.Opaque {
+		requestStream.passthrough()
+		responseStream.passthrough()
 	}
 
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	go fw.forwardData(conn, proxyConn, "client->proxy", &wg)
-	go fw.forwardData(proxyConn, conn, "proxy->client", &wg)
+	// Responses are read from the start: an upgrade request holds the
+	// request stream until the upstream answers it, and the first request
+	// may be one.
+	go func() {
+		fw.forwardData(ctx, proxyConn, conn, responseStream, "proxy->client", live, &live.BytesOut, &wg)
+		pairs.close()
+	}()
+
+	// The head parsed at accept time goes through the request stream too, so
+	// framing starts at the first byte the client sent.
+	if _, err = requestStream.Write(requestHead.Raw); err != nil {
+		if errors.Is(err, errMalformedMessage) {
+			connRecord.Fail("PARSE_ERROR")
+		} else {
+			fw.logErrorRateLimitedTo(logger, ip, "PROXY_WRITE_ERROR", "Failed to write to proxy: %v", err)
+			connRecord.Fail("PROXY_WRITE_ERROR")
+		}
+		proxyConn.Close()
+		wg.Done()
+		wg.Wait()
+		return
+	}
+	live.BytesIn.Add(int64(len(requestHead.Raw)))
+
+	go fw.forwardData(ctx, conn, proxyConn, requestStream, "client->proxy", live, &live.BytesIn, &wg)
 
 	wg.Wait()
-	fw.logger.LogConnection(ip, clientAddr.Port, "CLOSED")
+	if ctx.Err() != nil {
+		connRecord.Event("cancelled: %v", context.Cause(ctx))
+		if context.Cause(ctx) == errConnectionKilled {
+			connRecord.Fail("KILLED")
+		}
+	}
+	requestStream.Finish()
+	responseStream.Finish()
+	connRecord.Requests = requests
+	connRecord.BytesIn = live.BytesIn.Load()
+	connRecord.BytesOut = live.BytesOut.Load()
 }
 
 func (fw *Firewall) Start() error {
+	restored := false
+	if config := fw.warmStateConfig(); config.Enabled {
+		var err error
+		if restored, err = fw.loadWarmState(config); err != nil {
+			fw.logger.LogError("STATE", "Warm state not restored: %v", err)
+		}
+	}
+	if config := fw.logReplayConfig(); config.Enabled && !restored {
+		fw.replayRecentLog(config)
+	}
+
 	go fw.rulesWatcher()
 	go fw.attemptsCleanupWatcher()
+	go fw.watchdogWatcher()
+	go fw.memoryBudgetWatcher()
+	go fw.warmStateWatcher()
+	go fw.reportWatcher()
+	go fw.statsdWatcher()
+	go fw.sloWatcher()
+	go fw.adaptiveWatcher()
+	go fw.snapshotWatcher()
+	go fw.stagedRulesWatcher()
+	go fw.idleReaper()
+	go fw.geoDatabaseWatcher()
+	go fw.ipListWatcher()
+	go fw.wasmFilterWatcher()
+	go fw.regoPolicyWatcher()
+	go fw.quotaWatcher()
+	go fw.apiKeyWatcher()
+	go fw.blockNotificationsWatcher()
+	go fw.scheduledReportsWatcher()
+	go fw.logLevelSignalWatcher()
+	fw.startAdminServer()
+	fw.startAbuseReportServer()
+	fw.startHoneypots()
+	if err := fw.startCluster(); err != nil {
+		fw.logger.LogError("CLUSTER", "Cluster mode not started: %v", err)
+	}
+	if err := fw.startQUIC(); err != nil {
+		fw.logger.LogError("QUIC", "QUIC passthrough not started: %v", err)
+	}
+
+	failover := failoverConfigFromEnv()
+	fw.failoverRole.Store(failover.Role)
+	if failover.Role == FailoverRoleStandby && !fw.runStandby(failover) {
+		return nil
+	}
 
 	var lc net.ListenConfig
 	lc.Control = func(network, address string, c syscall.RawConn) error {
@@ -791,10 +1700,30 @@ func (fw *Firewall) Start() error {
 				return
 			}
 
+			if fw.ingressMode == IngressModeTProxy {
+				if err := setTransparent(int(fd)); err != nil {
+					controlErr = err
+					return
+				}
+			}
+
+			if failover.Role != "" {
+				if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+					controlErr = fmt.Errorf("failed to set SO_REUSEPORT: %v", err)
+					return
+				}
+			}
+
 			if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, 3); err != nil {
 				fw.logger.LogDebug("SOCKET", "TCP_DEFER_ACCEPT not supported: %v", err)
 			}
 
+			if client := fw.socketOptions().Client; client.FastOpen {
+				if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, client.FastOpenQueue); err != nil {
+					fw.logger.LogWarning("SOCKET", "TCP_FASTOPEN not supported: %v", err)
+				}
+			}
+
 			fw.logger.LogStartup("Socket configured with SYN flood mitigations")
 		}); err != nil {
 			return err
@@ -809,33 +1738,88 @@ func (fw *Firewall) Start() error {
 	fw.listener = listener
 
 	fw.logger.LogStartup("Firewall listening on 0.0.0.0:%d -> proxy %s:%d (SYN flood protection enabled)", fw.firewallPort, fw.proxyHost, fw.proxyPort)
+	if fw.ingressMode == IngressModeTProxy {
+		fw.logger.LogStartup("Transparent ingress: intercepted connections go to their original destination")
+	}
 
 	go fw.handleSignals()
 
+	return fw.serve(context.Background(), listener)
+}
+
+// serve accepts connections until shutdown is closed, then gives the active
+// ones ShutdownGracePeriod to finish before cancelling them.
+func (fw *Firewall) serve(ctx context.Context, listener net.Listener) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// accepting ends with the listener, releasing connections still waiting
+	// for a slot.
+	accepting, stopAccepting := context.WithCancel(ctx)
+	defer stopAccepting()
+	go func() {
+		<-fw.shutdown
+		listener.Close()
+		stopAccepting()
+	}()
+
 	for {
-		select {
-		case <-fw.shutdown:
-			fw.logger.LogStartup("Shutdown signal received, stopping firewall...")
-			listener.Close()
-			fw.logger.LogStartup("Waiting for active connections to finish...")
-			fw.activeConns.Wait()
-			fw.logger.LogStartup("Firewall stopped gracefully")
-			return nil
-		default:
-			conn, err := listener.Accept()
-			if err != nil {
-				select {
-				case <-fw.shutdown:
-					return nil
-				default:
-					fw.logger.LogError("FIREWALL", "Accept failed: %v", err)
-					continue
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-fw.shutdown:
+				fw.logger.LogStartup("Shutdown signal received, stopping firewall...")
+				fw.logger.LogStartup("Waiting for active connections to finish...")
+				if !waitTimeout(&fw.activeConns, ShutdownGracePeriod) {
+					fw.logger.LogWarning("FIREWALL", "Connections still open after %v - closing them", ShutdownGracePeriod)
+					cancel(errShutdown)
+					fw.activeConns.Wait()
+				}
+				if config := fw.warmStateConfig(); config.Enabled {
+					if err := fw.saveWarmState(config); err != nil {
+						fw.logger.LogError("STATE", "Warm state not saved: %v", err)
+					} else {
+						fw.logger.LogStartup("Warm state saved to %s", config.Path)
+					}
+				}
+				if config := fw.quotaConfig(); config.Enabled {
+					if err := fw.quotas.Save(config.Path); err != nil {
+						fw.logger.LogError("QUOTA", "Quota counters not saved: %v", err)
+					}
 				}
+				fw.logger.LogStartup("Firewall stopped gracefully")
+				return nil
+			default:
+				fw.logger.LogError("FIREWALL", "Accept failed: %v", err)
+				continue
 			}
+		}
 
-			fw.activeConns.Add(1)
-			go fw.handleConnection(conn)
+		if !fw.watchdog.AdmitAccept(fw.clock.Now()) {
+			fw.shedConnection(conn)
+			continue
+		}
+		if !fw.connSlots.TryAcquire(1) && !fw.admitSaturated(ctx, accepting, conn) {
+			continue
 		}
+
+		fw.activeConns.Add(1)
+		go fw.handleConnection(ctx, conn)
+	}
+}
+
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
 	}
 }
 
@@ -848,12 +1832,38 @@ func (fw *Firewall) handleSignals() {
 	close(fw.shutdown)
 }
 
+// logLevelSignalWatcher flips between DEBUG and the configured level on
+// SIGUSR2, for turning on debug output in a running container.
+func (fw *Firewall) logLevelSignalWatcher() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR2)
+
+	configured := fw.logger.MinLevel()
+	if configured == DEBUG {
+		configured = DefaultLogLevel
+	}
+	for range sigChan {
+		level := DEBUG
+		if fw.logger.MinLevel() == DEBUG {
+			level = configured
+		}
+		fw.logger.SetMinLevel(level)
+		fw.logger.LogLevelChanged(level)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	firewall := NewFirewall()
 	defer firewall.logger.Close()
+	defer firewall.accessLog.Close()
 
 	if err := firewall.Start(); err != nil {
 		firewall.logger.LogError("FIREWALL", "Failed to start: %v", err)
+		firewall.logger.Flush()
 		log.Fatalf("[FIREWALL] Failed to start: %v", err)
 	}
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// These are native Go fuzz targets: run one with e.g.
+//
+//	go test -run '^$' -fuzz FuzzParseRequestHead
+//
+// Without -fuzz they just replay the seed corpus and testdata/fuzz.
+
+var requestSeeds = []string{
+	"GET / HTTP/1.1\r\nHost: chat.example\r\n\r\n",
+	"POST /api/login HTTP/1.1\r\nHost: chat.example:8443\r\nContent-Length: 5\r\n\r\nhello",
+	"GET http://chat.example/x HTTP/1.1\r\nHost: chat.example\r\n\r\n",
+	"GET / HTTP/1.1\nHost: [::1]:80\n\n",
+	"GET /\x00 HTTP/1.1\r\n\r\n",
+	"GET /\xff\xfe HTTP/1.1\r\nX: \xc3\x28\r\n\r\n",
+	"GET / HTTP/1.1\r\nBad Name: x\r\n\r\n",
+	"GET / HTTP/1.1\r\n folded: x\r\n\r\n",
+}
+
+func FuzzParseRequestHead(f *testing.F) {
+	for _, seed := range requestSeeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		head, err := parseRequestHead(bufio.NewReaderSize(bytes.NewReader(data), BufferSize))
+		if err != nil {
+			return
+		}
+		defer head.Release()
+
+		if !bytes.HasPrefix(data, head.Raw) {
+			t.Fatalf("Raw is not a prefix of the input")
+		}
+		if head.Method == "" && head.Target != "" {
+			t.Fatalf("target %q without a method", head.Target)
+		}
+		if len(head.Header) > MaxRequestHeaders {
+			t.Fatalf("%d headers accepted", len(head.Header))
+		}
+		head.Path()
+		validateHost(head, []string{"chat.example"})
+	})
+}
+
+func FuzzExtractRequestedPort(f *testing.F) {
+	for _, seed := range requestSeeds {
+		f.Add([]byte(seed))
+	}
+
+	fw := newFirewall("")
+	rules := Rules{}
+	normalizeRules(&rules)
+	fw.applyRules(&rules, time.Time{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		client, server := net.Pipe()
+		addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: DefaultFirewallPort}
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+
+		port, head, err := fw.extractRequestedPort(&pipeConn{Conn: server, local: addr, remote: addr})
+		server.Close()
+		if err != nil {
+			return
+		}
+		defer head.Release()
+
+		if head.Host() == "" && port != DefaultRequestedPort {
+			t.Fatalf("no Host header but port %d", port)
+		}
+	})
+}
+
+// identityHandler frames messages without editing them, so the stream's
+// output must equal its input.
+type identityHandler struct{}
+
+func (identityHandler) OnStart() {}
+
+func (identityHandler) OnHead(head *messageHead) (int, int64) {
+	return contentFraming(head)
+}
+
+func (identityHandler) OnComplete(int64) bool { return false }
+
+func FuzzHTTPStream(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\nGET /2 HTTP/1.1\r\nContent-Length: 3\r\n\r\nabc"), uint16(7))
+	f.Add([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"), uint16(40))
+	f.Add([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n7fffffffffffffff\r\nx"), uint16(3))
+	f.Add([]byte("HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\nrest"), uint16(0))
+
+	f.Fuzz(func(t *testing.T, data []byte, split uint16) {
+		var out bytes.Buffer
+		stream := newHTTPStream(&out, identityHandler{})
+
+		cut := 0
+		if len(data) > 0 {
+			cut = int(split) % (len(data) + 1)
+		}
+		_, err := stream.Write(data[:cut])
+		if err == nil {
+			_, err = stream.Write(data[cut:])
+		}
+		if errors.Is(err, errMalformedMessage) {
+			// The stream stops at a message it can't frame.
+			if !bytes.HasPrefix(data, out.Bytes()) {
+				t.Fatalf("stream changed the bytes before a malformed message:\n in: %q\nout: %q", data, out.Bytes())
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Finish()
+
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("stream changed the bytes:\n in: %q\nout: %q", data, out.Bytes())
+		}
+	})
+}
+
+func FuzzParseMMDB(f *testing.F) {
+	f.Add(testASNDatabase(&testing.T{}, 24))
+	f.Add(testASNDatabase(&testing.T{}, 28))
+	f.Add(append([]byte("\x00\x00\x00\x00\x00\x00"), mmdbMetadataMarker...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader, err := parseMMDB(data)
+		if err != nil {
+			return
+		}
+		for _, ip := range []string{"192.0.2.77", "203.0.113.10", "2001:db8::1", "::"} {
+			reader.Lookup(net.ParseIP(ip))
+		}
+	})
+}
+
+func FuzzDecodeWasmModule(f *testing.F) {
+	f.Add([]byte("\x00asm"))
+	f.Add([]byte("\x00asm\x01\x00\x00\x00"))
+	f.Add([]byte("\x00asm\x01\x00\x00\x00\x01\x05\x01\x60\x00\x01\x7f"))
+	f.Add([]byte("\x00asm\x01\x00\x00\x00\x0a\xff\xff\xff\xff\x0f"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		module, err := decodeWasmModule(data)
+		if err != nil {
+			return
+		}
+		checkWasmFilterModule(module)
+	})
+}
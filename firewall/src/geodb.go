@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	GeoDatabaseCheckInterval = 60 // seconds
+	DefaultGeoRefreshHours   = 24
+	MaxGeoDatabaseSize       = 256 << 20
+)
+
+// GeoDatabaseConfig points at an MMDB file. It is reloaded whenever the file
+// changes; with UpdateURL set the firewall also downloads it every
+// RefreshHours. Environment variables in UpdateURL are expanded, so a
+// license key can stay out of rules.json, e.g.
+// "https://download.maxmind.com/app/geoip_download?edition_id=GeoLite2-ASN&license_key=${MAXMIND_LICENSE_KEY}&suffix=tar.gz".
+type GeoDatabaseConfig struct {
+	Path         string `json:"path"`
+	UpdateURL    string `json:"update_url"`
+	RefreshHours int    `json:"refresh_hours"`
+}
+
+func normalizeGeoDatabaseConfig(config GeoDatabaseConfig, defaultPath string) GeoDatabaseConfig {
+	if config.Path == "" {
+		config.Path = defaultPath
+	}
+	if config.RefreshHours <= 0 {
+		config.RefreshHours = DefaultGeoRefreshHours
+	}
+	return config
+}
+
+// GeoDatabase holds the currently loaded MMDB. Lookups see either the old or
+// the new database while it is swapped.
+type GeoDatabase struct {
+	name    string
+	reader  atomic.Pointer[mmdbReader]
+	path    string
+	modTime time.Time
+}
+
+func NewGeoDatabase(name string) *GeoDatabase {
+	return &GeoDatabase{name: name}
+}
+
+func (gd *GeoDatabase) Loaded() bool {
+	return gd.reader.Load() != nil
+}
+
+func (gd *GeoDatabase) Lookup(ip net.IP) (interface{}, bool) {
+	reader := gd.reader.Load()
+	if reader == nil || ip == nil {
+		return nil, false
+	}
+	value, found, err := reader.Lookup(ip)
+	if err != nil {
+		return nil, false
+	}
+	return value, found
+}
+
+// refreshGeoDatabase downloads the database when it is due and reloads it
+// when the file changed. Only the owning watcher calls it.
+func (fw *Firewall) refreshGeoDatabase(gd *GeoDatabase, config GeoDatabaseConfig) {
+	stat, statErr := os.Stat(config.Path)
+
+	if config.UpdateURL != "" {
+		maxAge := time.Duration(config.RefreshHours) * time.Hour
+		if statErr != nil || time.Since(stat.ModTime()) > maxAge {
+			if err := downloadMMDB(os.ExpandEnv(config.UpdateURL), config.Path); err != nil {
+				fw.logErrorRateLimited("geodb_"+gd.name, "GEO", "Failed to download %s database: %v", gd.name, err)
+			} else {
+				fw.logger.LogInfo("GEO", "Downloaded %s database to %s", gd.name, config.Path)
+				stat, statErr = os.Stat(config.Path)
+			}
+		}
+	}
+
+	if statErr != nil {
+		if gd.reader.Load() != nil && gd.path == config.Path {
+			return
+		}
+		gd.reader.Store(nil)
+		gd.path = config.Path
+		fw.decisions.Invalidate()
+		return
+	}
+	if gd.path == config.Path && stat.ModTime().Equal(gd.modTime) {
+		return
+	}
+
+	reader, err := openMMDB(config.Path)
+	if err != nil {
+		fw.logErrorRateLimited("geodb_"+gd.name, "GEO", "Failed to load %s database %s: %v", gd.name, config.Path, err)
+		return
+	}
+	gd.reader.Store(reader)
+	gd.path, gd.modTime = config.Path, stat.ModTime()
+	fw.decisions.Invalidate()
+	fw.logger.LogInfo("GEO", "Loaded %s database %s (%s, built %s)", gd.name, config.Path,
+		reader.databaseType, time.Unix(int64(reader.buildEpoch), 0).UTC().Format("2006-01-02"))
+}
+
+// downloadMMDB fetches a database, unpacking MaxMind's tar.gz downloads, and
+// only replaces path once the new file parses. Errors never include the URL,
+// which may carry a license key.
+func downloadMMDB(url, path string) error {
+	client := http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Get(url)
+	if err != nil {
+		if inner := errors.Unwrap(err); inner != nil {
+			err = inner
+		}
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server answered %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxGeoDatabaseSize))
+	if err != nil {
+		return err
+	}
+	if data, err = extractMMDB(data); err != nil {
+		return err
+	}
+	if _, err := parseMMDB(data); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func extractMMDB(data []byte) ([]byte, error) {
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(io.LimitReader(gz, MaxGeoDatabaseSize)); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(data) > 262 && string(data[257:262]) == "ustar" {
+		archive := tar.NewReader(bytes.NewReader(data))
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				return nil, fmt.Errorf("no .mmdb file in archive")
+			}
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasSuffix(header.Name, ".mmdb") {
+				return io.ReadAll(io.LimitReader(archive, MaxGeoDatabaseSize))
+			}
+		}
+	}
+	return data, nil
+}
+
+// lookupIP parses an IP or an aggregation key ("2001:db8::/64") for a
+// database lookup.
+func lookupIP(ipOrKey string) net.IP {
+	if ip, _, err := net.ParseCIDR(ipOrKey); err == nil {
+		return ip
+	}
+	return net.ParseIP(ipOrKey)
+}
+
+// geoDatabases returns each database with its current configuration.
+func (fw *Firewall) geoDatabases() map[*GeoDatabase]GeoDatabaseConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return map[*GeoDatabase]GeoDatabaseConfig{
+		fw.asnDB:     fw.rules.ASNDatabase,
+		fw.countryDB: fw.rules.CountryDatabase,
+	}
+}
+
+func (fw *Firewall) geoDatabaseWatcher() {
+	for gd, config := range fw.geoDatabases() {
+		fw.refreshGeoDatabase(gd, config)
+	}
+
+	elapsed := 0
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		elapsed++
+		if elapsed < GeoDatabaseCheckInterval {
+			continue
+		}
+		elapsed = 0
+
+		for gd, config := range fw.geoDatabases() {
+			fw.refreshGeoDatabase(gd, config)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	DefaultMaxHalfOpen      = 512
+	DefaultMaxHalfOpenPerIP = 8
+)
+
+// HalfOpenLimits caps connections that were accepted but haven't finished
+// sending their request head yet, so clients dribbling headers (or opening
+// connections and sending nothing) can't tie up the firewall until
+// ConnectionTimeout while staying under the established-connection limits.
+// MaxTotal applies to every client; MaxPerIP spares whitelisted ones.
+type HalfOpenLimits struct {
+	MaxTotal int `json:"max_total"`
+	MaxPerIP int `json:"max_per_ip"`
+}
+
+func normalizeHalfOpenLimits(limits HalfOpenLimits) HalfOpenLimits {
+	if limits.MaxTotal <= 0 {
+		limits.MaxTotal = DefaultMaxHalfOpen
+	}
+	if limits.MaxPerIP <= 0 {
+		limits.MaxPerIP = DefaultMaxHalfOpenPerIP
+	}
+	return limits
+}
+
+func (fw *Firewall) halfOpenLimits() HalfOpenLimits {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.HalfOpen
+}
+
+// HalfOpenTracker counts connections still reading their request head.
+type HalfOpenTracker struct {
+	mutex sync.Mutex
+	total int
+	byIP  map[string]int
+}
+
+func NewHalfOpenTracker() *HalfOpenTracker {
+	return &HalfOpenTracker{
+		byIP: make(map[string]int),
+	}
+}
+
+// Acquire counts a new half-open connection from ip, or returns why it
+// would exceed limits. Every admitted connection must be released.
+func (ht *HalfOpenTracker) Acquire(ip string, limits HalfOpenLimits, whitelisted bool) (string, bool) {
+	ht.mutex.Lock()
+	defer ht.mutex.Unlock()
+
+	if ht.total >= limits.MaxTotal {
+		return fmt.Sprintf("%d connections awaiting their request (limit %d)", ht.total, limits.MaxTotal), false
+	}
+	if !whitelisted && ht.byIP[ip] >= limits.MaxPerIP {
+		return fmt.Sprintf("%d connections from %s awaiting their request (limit %d)", ht.byIP[ip], ip, limits.MaxPerIP), false
+	}
+	ht.total++
+	ht.byIP[ip]++
+	return "", true
+}
+
+func (ht *HalfOpenTracker) Release(ip string) {
+	ht.mutex.Lock()
+	defer ht.mutex.Unlock()
+
+	ht.total--
+	if ht.byIP[ip]--; ht.byIP[ip] <= 0 {
+		delete(ht.byIP, ip)
+	}
+}
+
+// Counts returns the number of half-open connections in all and from ip.
+func (ht *HalfOpenTracker) Counts(ip string) (int, int) {
+	ht.mutex.Lock()
+	defer ht.mutex.Unlock()
+
+	return ht.total, ht.byIP[ip]
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDialFallbackDelayMs  = 250
+	DefaultDialAttemptTimeoutMs = 2000
+	DefaultUpstreamResolveTTL   = 30
+)
+
+// UpstreamDialConfig controls dialing upstreams by name. With Enabled, every
+// address the name resolves to is tried Happy Eyeballs style (RFC 8305):
+// IPv6 and IPv4 interleaved, a new attempt started every FallbackDelayMs
+// until one connects, each given at most AttemptTimeoutMs. The address that
+// last worked is tried first.
+//
+// Names are resolved by the firewall itself rather than on every dial, and
+// the answer kept for ResolveTTLSeconds; a dial where no address connects
+// resolves the name again straight away.
+type UpstreamDialConfig struct {
+	Enabled           bool `json:"enabled"`
+	FallbackDelayMs   int  `json:"fallback_delay_ms"`
+	AttemptTimeoutMs  int  `json:"attempt_timeout_ms"`
+	ResolveTTLSeconds int  `json:"resolve_ttl_seconds"`
+}
+
+func normalizeUpstreamDialConfig(config UpstreamDialConfig) UpstreamDialConfig {
+	if config.FallbackDelayMs <= 0 {
+		config.FallbackDelayMs = DefaultDialFallbackDelayMs
+	}
+	if config.AttemptTimeoutMs <= 0 {
+		config.AttemptTimeoutMs = DefaultDialAttemptTimeoutMs
+	}
+	if config.ResolveTTLSeconds <= 0 {
+		config.ResolveTTLSeconds = DefaultUpstreamResolveTTL
+	}
+	return config
+}
+
+func (fw *Firewall) upstreamDialConfig() UpstreamDialConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.UpstreamDial
+}
+
+// LastGoodAddresses remembers, per upstream name, the address that last
+// accepted a connection.
+type LastGoodAddresses struct {
+	mutex     sync.Mutex
+	addresses map[string]string
+}
+
+func NewLastGoodAddresses() *LastGoodAddresses {
+	return &LastGoodAddresses{addresses: make(map[string]string)}
+}
+
+func (lg *LastGoodAddresses) Get(host string) string {
+	lg.mutex.Lock()
+	defer lg.mutex.Unlock()
+
+	return lg.addresses[host]
+}
+
+func (lg *LastGoodAddresses) Set(host, address string) {
+	lg.mutex.Lock()
+	defer lg.mutex.Unlock()
+
+	lg.addresses[host] = address
+}
+
+// interleaveAddresses orders addresses IPv6 first, alternating families, with
+// preferred (if present) moved to the front.
+func interleaveAddresses(addresses []string, preferred string) []string {
+	var v6, v4 []string
+	for _, address := range addresses {
+		if address == preferred {
+			continue
+		}
+		if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+			v6 = append(v6, address)
+		} else {
+			v4 = append(v4, address)
+		}
+	}
+
+	ordered := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if address == preferred {
+			ordered = append(ordered, preferred)
+			break
+		}
+	}
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			ordered = append(ordered, v6[i])
+		}
+		if i < len(v4) {
+			ordered = append(ordered, v4[i])
+		}
+	}
+	return ordered
+}
+
+// dialHappyEyeballs is the default dialUpstream. Addresses that are already
+// IPs get a single dial; names are resolved through the upstream resolver
+// and, if no address connects, resolved afresh and tried once more.
+func (fw *Firewall) dialHappyEyeballs(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return fw.dialSocket(ctx, address, timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	config := fw.upstreamDialConfig()
+	addresses, err := fw.resolveUpstream(ctx, host, config, false)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := fw.raceAddresses(ctx, host, port, addresses, config)
+	if err == nil || ctx.Err() != nil {
+		return conn, err
+	}
+
+	refreshed, resolveErr := fw.resolveUpstream(ctx, host, config, true)
+	if resolveErr != nil || slices.Equal(refreshed, addresses) {
+		return nil, err
+	}
+	return fw.raceAddresses(ctx, host, port, refreshed, config)
+}
+
+// raceAddresses connects to the first of addresses to answer. Without Happy
+// Eyeballs each address gets its full attempt timeout before the next.
+func (fw *Firewall) raceAddresses(ctx context.Context, host, port string, addresses []string, config UpstreamDialConfig) (net.Conn, error) {
+	addresses = interleaveAddresses(addresses, fw.lastGoodUpstream.Get(host))
+
+	type dialResult struct {
+		address string
+		conn    net.Conn
+		err     error
+	}
+	results := make(chan dialResult, len(addresses))
+	attemptTimeout := time.Duration(config.AttemptTimeoutMs) * time.Millisecond
+	fallbackDelay := time.Duration(config.FallbackDelayMs) * time.Millisecond
+	if !config.Enabled {
+		fallbackDelay = attemptTimeout
+	}
+	fallback := time.NewTimer(fallbackDelay)
+	defer fallback.Stop()
+
+	next, pending := 0, 0
+	startNext := func() {
+		address := addresses[next]
+		next++
+		pending++
+		go func() {
+			conn, err := fw.dialSocket(ctx, net.JoinHostPort(address, port), attemptTimeout)
+			results <- dialResult{address, conn, err}
+		}()
+		if !fallback.Stop() {
+			select {
+			case <-fallback.C:
+			default:
+			}
+		}
+		fallback.Reset(fallbackDelay)
+	}
+	// abandon closes connections from attempts still running once a winner
+	// is picked or the dial is given up.
+	abandon := func() {
+		go func(remaining int) {
+			for ; remaining > 0; remaining-- {
+				if late := <-results; late.conn != nil {
+					late.conn.Close()
+				}
+			}
+		}(pending)
+	}
+
+	startNext()
+	var errs []error
+	for {
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				fw.lastGoodUpstream.Set(host, result.address)
+				abandon()
+				return result.conn, nil
+			}
+			errs = append(errs, fmt.Errorf("%s: %v", result.address, result.err))
+			if next < len(addresses) {
+				startNext()
+			} else if pending == 0 {
+				return nil, errors.Join(errs...)
+			}
+		case <-fallback.C:
+			if next < len(addresses) {
+				startNext()
+			}
+		case <-ctx.Done():
+			abandon()
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipeListener is an in-memory net.Listener. Dial hands the server side of
+// a net.Pipe to Accept and returns the client side, with TCP addresses so the
+// firewall sees the client IP it would get from a real socket.
+type pipeListener struct {
+	addr   *net.TCPAddr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+	ports  atomic.Int32
+}
+
+func newPipeListener(ip string, port int) *pipeListener {
+	return &pipeListener{
+		addr:   &net.TCPAddr{IP: net.ParseIP(ip), Port: port},
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+type pipeConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (pc *pipeConn) LocalAddr() net.Addr  { return pc.local }
+func (pc *pipeConn) RemoteAddr() net.Addr { return pc.remote }
+
+func (pl *pipeListener) Dial(clientIP string) (net.Conn, error) {
+	clientAddr := &net.TCPAddr{IP: net.ParseIP(clientIP), Port: 40000 + int(pl.ports.Add(1))}
+	client, server := net.Pipe()
+
+	select {
+	case pl.conns <- &pipeConn{Conn: server, local: pl.addr, remote: clientAddr}:
+		return &pipeConn{Conn: client, local: clientAddr, remote: pl.addr}, nil
+	case <-pl.closed:
+		client.Close()
+		server.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+func (pl *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case <-pl.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (pl *pipeListener) Close() error {
+	pl.once.Do(func() { close(pl.closed) })
+	return nil
+}
+
+func (pl *pipeListener) Addr() net.Addr {
+	return pl.addr
+}
+
+// testHarness runs a Firewall on in-memory listeners in front of an
+// in-memory upstream, with rules set directly instead of read from disk.
+type testHarness struct {
+	t        testing.TB
+	fw       *Firewall
+	clock    *fakeClock
+	cancel   context.CancelCauseFunc
+	listener *pipeListener
+	upstream *pipeListener
+
+	mutex    sync.Mutex
+	requests []*http.Request
+}
+
+const harnessFirewallIP = "10.0.0.2"
+
+func newTestHarness(t testing.TB, rules Rules) *testHarness {
+	t.Helper()
+
+	dir := t.TempDir()
+	fw := newFirewall(filepath.Join(dir, "rules.json"))
+	logger, err := newFirewallLogger(dir)
+	if err != nil {
+		t.Fatalf("logger: %v", err)
+	}
+	fw.logger = logger
+	fw.logger.SetBlockObserver(fw.recordBlock)
+	fw.proxyHost, fw.proxyPort = "upstream", 8080
+
+	h := &testHarness{
+		t:        t,
+		fw:       fw,
+		clock:    newFakeClock(),
+		listener: newPipeListener(harnessFirewallIP, DefaultFirewallPort),
+		upstream: newPipeListener("10.0.0.3", 8080),
+	}
+	fw.clock = h.clock
+	fw.startTime = h.clock.Now()
+	fw.dialUpstream = func(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+		return h.upstream.Dial(harnessFirewallIP)
+	}
+	h.SetRules(rules)
+
+	server := &http.Server{Handler: http.HandlerFunc(h.serveUpstream)}
+	go server.Serve(h.upstream)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	h.cancel = cancel
+	// serve writes state such as the quota counters on its way out, which
+	// has to be done before the test's directories are removed.
+	served := make(chan struct{})
+	go func() {
+		fw.serve(ctx, h.listener)
+		close(served)
+	}()
+
+	t.Cleanup(func() {
+		close(fw.shutdown)
+		cancel(nil)
+		h.listener.Close()
+		server.Close()
+		fw.activeConns.Wait()
+		<-served
+		logger.Close()
+	})
+	return h
+}
+
+// serveUpstream stands in for the chat: /api/login always fails, /hold never
+// answers, /broken fails with a fingerprintable 502, everything else answers
+// 200.
+func (h *testHarness) serveUpstream(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	h.requests = append(h.requests, r)
+	h.mutex.Unlock()
+
+	if r.URL.Path == "/api/login" {
+		http.Error(w, "bad credentials", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/broken" {
+		w.Header().Set("Server", "nginx/1.25.3")
+		w.Header().Set("X-Powered-By", "Express")
+		http.Error(w, "502 Bad Gateway nginx/1.25.3", http.StatusBadGateway)
+		return
+	}
+	if r.URL.Path == "/hold" {
+		<-r.Context().Done()
+		return
+	}
+	if r.URL.Path == "/echo" && r.Header.Get("Upgrade") == "echo" {
+		// Switches to a protocol that sends every byte straight back.
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buffered.Flush()
+		io.Copy(conn, buffered)
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+func (h *testHarness) upstreamRequests() []*http.Request {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return append([]*http.Request(nil), h.requests...)
+}
+
+// SetRules replaces the rules in memory, normalized as if loaded from disk.
+// Error pages are always enabled for blocked connections so refusals show up
+// as status codes.
+func (h *testHarness) SetRules(rules Rules) {
+	rules.ErrorPages.RespondToBlocked = true
+	rules.ErrorPages.Directory = h.t.TempDir()
+	normalizeRules(&rules)
+	h.fw.applyRules(&rules, time.Time{})
+}
+
+// Get sends one request from clientIP on a new connection and returns the
+// response status, or 0 when the firewall closed the connection without
+// answering. It waits for the firewall to finish with the connection, so
+// state updated after the response (login failures, stats) is visible.
+func (h *testHarness) Get(clientIP, path string) (int, string) {
+	h.t.Helper()
+
+	return h.GetHost(clientIP, "chat.example", path)
+}
+
+// GetHost is Get with the given Host header.
+func (h *testHarness) GetHost(clientIP, host, path string) (int, string) {
+	h.t.Helper()
+
+	status, body, _ := h.Request(clientIP, host, path, nil)
+	return status, body
+}
+
+// Request is GetHost with extra request headers, also returning the
+// response headers.
+func (h *testHarness) Request(clientIP, host, path string, header http.Header) (int, string, http.Header) {
+	h.t.Helper()
+
+	conn, err := h.listener.Dial(clientIP)
+	if err != nil {
+		h.t.Fatalf("dial: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var request bytes.Buffer
+	fmt.Fprintf(&request, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n", path, host)
+	header.Write(&request)
+	request.WriteString("\r\n")
+
+	status, body, responseHeader := 0, "", http.Header(nil)
+	if _, err := conn.Write(request.Bytes()); err == nil {
+		if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+			data, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			status, body, responseHeader = resp.StatusCode, string(data), resp.Header
+		}
+	}
+	conn.Close()
+
+	h.fw.activeConns.Wait()
+	return status, body, responseHeader
+}
+
+// BufferedUpstream moves the upstream onto a loopback TCP socket. An
+// in-memory pipe has no buffer, so the firewall forwarding pipelined
+// requests and the upstream answering the first would wait on each other.
+func (h *testHarness) BufferedUpstream() {
+	h.t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(h.serveUpstream))
+	h.t.Cleanup(server.Close)
+	h.fw.dialUpstream = func(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("tcp", server.Listener.Addr().String(), timeout)
+	}
+}
+
+// KeepAlive opens a connection from clientIP for sending several requests,
+// pipelined or one after another, and reading their responses.
+func (h *testHarness) KeepAlive(clientIP string) (net.Conn, *bufio.Reader) {
+	h.t.Helper()
+
+	conn, err := h.listener.Dial(clientIP)
+	if err != nil {
+		h.t.Fatalf("dial: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	h.t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+// ReadStatus reads the next response off a KeepAlive connection and returns
+// its status, or 0 once the firewall has closed the connection.
+func (h *testHarness) ReadStatus(reader *bufio.Reader) int {
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return 0
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// Send is Get without waiting for the firewall to finish with the
+// connection, for while other connections are deliberately held open.
+func (h *testHarness) Send(clientIP, path string) int {
+	h.t.Helper()
+
+	conn, err := h.listener.Dial(clientIP)
+	if err != nil {
+		h.t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: chat.example\r\nConnection: close\r\n\r\n", path)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// Advance moves the firewall's clock forward by d.
+func (h *testHarness) Advance(d time.Duration) {
+	h.clock.Advance(d)
+}
+
+// fakeClock only moves when told to.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	return fc.now
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	fc.now = fc.now.Add(d)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+const HashRingReplicas = 100
+
+// HashRing maps keys onto upstreams with consistent hashing, so adding or
+// removing a backend only moves the clients that hashed to it.
+type HashRing struct {
+	hashes    []uint32
+	upstreams map[uint32]Upstream
+}
+
+func NewHashRing(upstreams []Upstream) *HashRing {
+	ring := &HashRing{
+		upstreams: make(map[uint32]Upstream, len(upstreams)*HashRingReplicas),
+	}
+
+	for _, upstream := range upstreams {
+		if !upstream.Valid() {
+			continue
+		}
+		for i := 0; i < HashRingReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(upstream.Addr() + "#" + strconv.Itoa(i)))
+			if _, exists := ring.upstreams[hash]; exists {
+				continue
+			}
+			ring.upstreams[hash] = upstream
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+	return ring
+}
+
+func (hr *HashRing) Empty() bool {
+	return hr == nil || len(hr.hashes) == 0
+}
+
+func (hr *HashRing) Get(key string) (Upstream, bool) {
+	if hr.Empty() {
+		return Upstream{}, false
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	idx := sort.Search(len(hr.hashes), func(i int) bool { return hr.hashes[i] >= hash })
+	if idx == len(hr.hashes) {
+		idx = 0
+	}
+	return hr.upstreams[hr.hashes[idx]], true
+}
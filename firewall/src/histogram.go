@@ -0,0 +1,182 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBoundsMillis are the upper bounds of the histogram buckets; one more
+// bucket catches everything above the last bound.
+var latencyBoundsMillis = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+type LatencyHistogram struct {
+	mutex  sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+}
+
+func NewLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{counts: make([]uint64, len(latencyBoundsMillis)+1)}
+}
+
+func (lh *LatencyHistogram) Observe(d time.Duration) {
+	millis := durationMillis(d)
+	bucket := len(latencyBoundsMillis)
+	for i, bound := range latencyBoundsMillis {
+		if millis <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	lh.mutex.Lock()
+	defer lh.mutex.Unlock()
+
+	lh.counts[bucket]++
+	lh.count++
+	lh.sum += d
+}
+
+// HistogramBucket is cumulative, as in Prometheus: Count observations took at
+// most LE milliseconds.
+type HistogramBucket struct {
+	LE    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+type HistogramSnapshot struct {
+	Count     uint64            `json:"count"`
+	SumMillis float64           `json:"sum_ms"`
+	P50       float64           `json:"p50_ms"`
+	P90       float64           `json:"p90_ms"`
+	P99       float64           `json:"p99_ms"`
+	Buckets   []HistogramBucket `json:"buckets"`
+
+	counts []uint64
+	sum    time.Duration
+}
+
+func (lh *LatencyHistogram) Snapshot() HistogramSnapshot {
+	lh.mutex.Lock()
+	counts := make([]uint64, len(lh.counts))
+	copy(counts, lh.counts)
+	count, sum := lh.count, lh.sum
+	lh.mutex.Unlock()
+
+	return newHistogramSnapshot(counts, count, sum)
+}
+
+func newHistogramSnapshot(counts []uint64, count uint64, sum time.Duration) HistogramSnapshot {
+	snapshot := HistogramSnapshot{
+		Count:     count,
+		SumMillis: durationMillis(sum),
+		Buckets:   make([]HistogramBucket, 0, len(counts)),
+		counts:    counts,
+		sum:       sum,
+	}
+
+	var cumulative uint64
+	for i, n := range counts {
+		cumulative += n
+		le := "+Inf"
+		if i < len(latencyBoundsMillis) {
+			le = strconv.FormatFloat(latencyBoundsMillis[i], 'f', -1, 64)
+		}
+		snapshot.Buckets = append(snapshot.Buckets, HistogramBucket{LE: le, Count: cumulative})
+	}
+
+	snapshot.P50 = snapshot.Percentile(50)
+	snapshot.P90 = snapshot.Percentile(90)
+	snapshot.P99 = snapshot.Percentile(99)
+	return snapshot
+}
+
+// Since returns the observations made between prev and hs.
+func (hs HistogramSnapshot) Since(prev HistogramSnapshot) HistogramSnapshot {
+	counts := make([]uint64, len(hs.counts))
+	for i := range counts {
+		counts[i] = hs.counts[i]
+		if i < len(prev.counts) {
+			counts[i] -= prev.counts[i]
+		}
+	}
+	return newHistogramSnapshot(counts, hs.Count-prev.Count, hs.sum-prev.sum)
+}
+
+// Percentile estimates the p-th percentile in milliseconds by interpolating
+// within the bucket it falls in. Values past the last bound report the bound.
+func (hs HistogramSnapshot) Percentile(p float64) float64 {
+	if hs.Count == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(p / 100 * float64(hs.Count)))
+	if rank == 0 {
+		rank = 1
+	}
+
+	var cumulative uint64
+	for i, n := range hs.counts {
+		if n == 0 || cumulative+n < rank {
+			cumulative += n
+			continue
+		}
+		if i >= len(latencyBoundsMillis) {
+			return latencyBoundsMillis[len(latencyBoundsMillis)-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBoundsMillis[i-1]
+		}
+		upper := latencyBoundsMillis[i]
+		return lower + (upper-lower)*float64(rank-cumulative)/float64(n)
+	}
+	return latencyBoundsMillis[len(latencyBoundsMillis)-1]
+}
+
+// LatencyStats holds the proxy timing histograms: upstream connect time,
+// time to the first response byte of each request, and total duration of
+// proxied connections.
+type LatencyStats struct {
+	Connect   *LatencyHistogram
+	FirstByte *LatencyHistogram
+	Duration  *LatencyHistogram
+}
+
+type LatencyStatsSnapshot struct {
+	Connect   HistogramSnapshot `json:"connect"`
+	FirstByte HistogramSnapshot `json:"first_byte"`
+	Duration  HistogramSnapshot `json:"connection_duration"`
+}
+
+func NewLatencyStats() *LatencyStats {
+	return &LatencyStats{
+		Connect:   NewLatencyHistogram(),
+		FirstByte: NewLatencyHistogram(),
+		Duration:  NewLatencyHistogram(),
+	}
+}
+
+func (ls *LatencyStats) Snapshot() LatencyStatsSnapshot {
+	return LatencyStatsSnapshot{
+		Connect:   ls.Connect.Snapshot(),
+		FirstByte: ls.FirstByte.Snapshot(),
+		Duration:  ls.Duration.Snapshot(),
+	}
+}
+
+// Metric returns the snapshot for an SLO metric name.
+func (lss LatencyStatsSnapshot) Metric(name string) (HistogramSnapshot, bool) {
+	switch name {
+	case SLOMetricConnect:
+		return lss.Connect, true
+	case SLOMetricFirstByte:
+		return lss.FirstByte, true
+	case SLOMetricDuration:
+		return lss.Duration, true
+	}
+	return HistogramSnapshot{}, false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// validateHost rejects requests whose Host header is missing where required,
+// duplicated, malformed, or not covered by allowed_hosts. It returns the HTTP
+// status to answer with and a reason, or 0 when the request is acceptable.
+func validateHost(head *RequestHead, allowedHosts []string) (int, string) {
+	hosts := head.Header.Values("Host")
+	if len(hosts) > 1 {
+		return http.StatusForbidden, "multiple Host headers"
+	}
+
+	host := ""
+	if len(hosts) == 1 {
+		host = strings.ToLower(hosts[0])
+		if !isValidHostValue(host) {
+			return http.StatusForbidden, "malformed Host header"
+		}
+	}
+
+	if strings.Contains(head.Target, "://") {
+		target, err := url.Parse(head.Target)
+		if err != nil || target.Host == "" {
+			return http.StatusForbidden, "malformed absolute request target"
+		}
+		if host != "" && !strings.EqualFold(target.Host, host) {
+			return http.StatusForbidden, "request target host does not match Host header"
+		}
+		host = strings.ToLower(target.Host)
+	}
+
+	if len(allowedHosts) == 0 {
+		return 0, ""
+	}
+
+	if host == "" {
+		return http.StatusMisdirectedRequest, "missing Host header"
+	}
+	if !hostAllowed(stripHostPort(host), allowedHosts) {
+		return http.StatusMisdirectedRequest, "host " + host + " not allowed"
+	}
+
+	for _, forwarded := range head.Header.Values("X-Forwarded-Host") {
+		for _, value := range strings.Split(forwarded, ",") {
+			value = strings.ToLower(strings.TrimSpace(value))
+			if !isValidHostValue(value) || !hostAllowed(stripHostPort(value), allowedHosts) {
+				return http.StatusForbidden, "X-Forwarded-Host " + value + " not allowed"
+			}
+		}
+	}
+
+	return 0, ""
+}
+
+func isValidHostValue(host string) bool {
+	if host == "" {
+		return false
+	}
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '.', c == '-', c == ':', c == '[', c == ']', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func stripHostPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.Trim(host, "[]")
+}
+
+// hostAllowed matches host against exact entries and "*.domain" wildcards,
+// where a wildcard covers subdomains but not the bare domain itself.
+func hostAllowed(host string, allowedHosts []string) bool {
+	for _, pattern := range allowedHosts {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "*" || pattern == host {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
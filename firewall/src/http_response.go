@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DefaultErrorPagesDir = "/var/log/shared/firewall/error_pages"
+
+// ErrorPagesConfig points at a directory of operator templates named after
+// the status they render (403.html, 429.html, 503.html, ...). Missing files
+// fall back to the built-in page. RespondToBlocked makes connections rejected
+// before the request is read (blocked IPs, rate limits) get a page as well
+// instead of being dropped.
+type ErrorPagesConfig struct {
+	Directory        string `json:"directory"`
+	RespondToBlocked bool   `json:"respond_to_blocked"`
+}
+
+func normalizeErrorPagesConfig(config ErrorPagesConfig) ErrorPagesConfig {
+	if config.Directory == "" {
+		config.Directory = DefaultErrorPagesDir
+	}
+	return config
+}
+
+// ErrorPageData is the set of variables available to error page templates.
+type ErrorPageData struct {
+	Status            int
+	StatusText        string
+	Reason            string
+	RetryAfterSeconds int
+	RetryAt           string
+	RequestID         string
+	ClientIP          string
+	AppealToken       string
+
+	header http.Header // extra response headers
+}
+
+var defaultErrorPage = template.Must(template.New("default").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} {{.StatusText}} - DockerChat</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", sans-serif; background: #1e1f22; color: #dbdee1; display: flex; align-items: center; justify-content: center; height: 100vh; margin: 0; }
+main { background: #2b2d31; padding: 2em 3em; border-radius: 12px; max-width: 32em; }
+h1 { color: #8775e9; margin-top: 0; }
+small { color: #949ba4; }
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Reason}}</p>
+{{if .RetryAt}}<p>You can try again after {{.RetryAt}}.</p>{{end}}
+{{if .AppealToken}}<p>If you think this is a mistake, send this code to the DockerChat administrators:</p>
+<pre style="white-space: pre-wrap; word-break: break-all;">{{.AppealToken}}</pre>{{end}}
+{{if .RequestID}}<small>Request ID: {{.RequestID}}</small>{{end}}
+</main>
+</body>
+</html>
+`))
+
+type cachedTemplate struct {
+	modTime  time.Time
+	template *template.Template
+}
+
+// ErrorPages renders error responses, reloading operator templates when
+// their files change.
+type ErrorPages struct {
+	mutex sync.Mutex
+	cache map[string]cachedTemplate
+}
+
+func NewErrorPages() *ErrorPages {
+	return &ErrorPages{
+		cache: make(map[string]cachedTemplate),
+	}
+}
+
+func (ep *ErrorPages) templateFor(dir string, status int) *template.Template {
+	path := filepath.Join(dir, strconv.Itoa(status)+".html")
+	stat, err := os.Stat(path)
+	if err != nil {
+		return defaultErrorPage
+	}
+
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+
+	if cached, exists := ep.cache[path]; exists && cached.modTime.Equal(stat.ModTime()) {
+		return cached.template
+	}
+
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		return defaultErrorPage
+	}
+	ep.cache[path] = cachedTemplate{modTime: stat.ModTime(), template: tmpl}
+	return tmpl
+}
+
+func (ep *ErrorPages) Render(dir string, data ErrorPageData) []byte {
+	var body bytes.Buffer
+	if err := ep.templateFor(dir, data.Status).Execute(&body, data); err != nil {
+		body.Reset()
+		defaultErrorPage.Execute(&body, data)
+	}
+	return body.Bytes()
+}
+
+func (fw *Firewall) errorPagesConfig() ErrorPagesConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.ErrorPages
+}
+
+// writeHTTPError sends an HTML error response before the connection is
+// closed, so clients see why instead of a bare reset.
+func (fw *Firewall) writeHTTPError(conn net.Conn, requestID string, status int, reason string, retryAfter time.Duration) {
+	fw.writeErrorPage(conn, newErrorPageData(conn, requestID, status, reason, retryAfter))
+}
+
+func newErrorPageData(conn net.Conn, requestID string, status int, reason string, retryAfter time.Duration) ErrorPageData {
+	data := ErrorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Reason:     reason,
+		RequestID:  requestID,
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		data.ClientIP = addr.IP.String()
+	}
+	if retryAfter > 0 {
+		data.RetryAfterSeconds = int(retryAfter.Round(time.Second) / time.Second)
+		data.RetryAt = time.Now().Add(retryAfter).UTC().Format(time.RFC1123)
+	}
+	return data
+}
+
+func (fw *Firewall) writeErrorPage(conn net.Conn, data ErrorPageData) {
+	body := fw.errorPages.Render(fw.errorPagesConfig().Directory, data)
+
+	var response bytes.Buffer
+	fmt.Fprintf(&response, "HTTP/1.1 %d %s\r\n", data.Status, data.StatusText)
+	response.WriteString("Content-Type: text/html; charset=utf-8\r\n")
+	fmt.Fprintf(&response, "Content-Length: %d\r\n", len(body))
+	if data.RetryAfterSeconds > 0 {
+		fmt.Fprintf(&response, "Retry-After: %d\r\n", data.RetryAfterSeconds)
+	}
+	if data.RequestID != "" {
+		fmt.Fprintf(&response, "%s: %s\r\n", RequestIDHeader, data.RequestID)
+	}
+	data.header.Write(&response)
+	if security := fw.securityHeaders(); security.Enabled {
+		for _, name := range security.Names() {
+			fmt.Fprintf(&response, "%s: %s\r\n", name, security.Headers[name])
+		}
+	}
+	response.WriteString("Cache-Control: no-store\r\nConnection: close\r\n\r\n")
+	response.Write(body)
+
+	conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	conn.Write(response.Bytes())
+}
+
+// rejectBlocked answers a connection that was refused before its request was
+// read. The request is drained briefly first so the client's TCP stack
+// doesn't discard our response with a reset.
+func (fw *Firewall) rejectBlocked(conn net.Conn, requestID string, status int, reason string, retryAfter time.Duration) {
+	if !fw.errorPagesConfig().RespondToBlocked {
+		return
+	}
+
+	drainRequest(conn)
+	fw.writeHTTPError(conn, requestID, status, reason, retryAfter)
+}
+
+func drainRequest(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, BufferSize)
+	conn.Read(buf)
+}
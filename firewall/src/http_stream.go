@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const MaxStreamHeadSize = 64 * 1024
+
+// errMalformedMessage stops a stream at a message it cannot frame; nothing
+// after it could be told apart from the next message, so the connection
+// has to end there.
+var errMalformedMessage = errors.New("malformed HTTP message")
+
+// errBodyTooLarge is what a held message's release function is told when
+// its body is longer than the hold's limit.
+var errBodyTooLarge = errors.New("request body too large")
+
+const (
+	bodyNone = iota
+	bodyLength
+	bodyChunked
+	bodyUntilClose
+	bodyUpgrade
+	bodyMalformed
+)
+
+const (
+	streamHead = iota
+	streamBody
+	streamChunkSize
+	streamChunkData
+	streamTrailer
+	streamUntilClose
+	streamPassthrough
+)
+
+// messageHead is the start line and headers of one HTTP/1.x message. Handlers
+// may edit Header through Set and Del; an edited head is re-serialized with
+// untouched header lines kept in their original order, an unedited one is
+// forwarded byte for byte. ReplaceBody swaps the message body for another,
+// and Hold keeps the message back until its body has been read.
+type messageHead struct {
+	StartLine string
+	Header    http.Header
+	raw       []byte
+	lines     []string
+	names     []string
+	touched   map[string]bool
+	body      []byte
+	refused   bool
+	holdLimit int64
+	release   func(body []byte, err error) bool
+}
+
+func parseMessageHead(raw []byte) (*messageHead, bool) {
+	lines := strings.Split(strings.TrimRight(string(raw), "\r\n"), "\n")
+	if len(lines) == 0 {
+		return nil, false
+	}
+
+	head := &messageHead{
+		StartLine: strings.TrimRight(lines[0], "\r"),
+		Header:    make(http.Header),
+		raw:       raw,
+	}
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, "\r")
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			continue
+		}
+		if !validHeaderName(line[:colon]) {
+			return nil, false
+		}
+		name := http.CanonicalHeaderKey(line[:colon])
+		head.Header.Add(name, strings.TrimSpace(line[colon+1:]))
+		head.lines = append(head.lines, line)
+		head.names = append(head.names, name)
+	}
+	return head, head.StartLine != ""
+}
+
+func (mh *messageHead) touch(name string) {
+	if mh.touched == nil {
+		mh.touched = make(map[string]bool)
+	}
+	mh.touched[http.CanonicalHeaderKey(name)] = true
+}
+
+func (mh *messageHead) Set(name, value string) {
+	mh.Header.Set(name, value)
+	mh.touch(name)
+}
+
+func (mh *messageHead) Add(name, value string) {
+	mh.Header.Add(name, value)
+	mh.touch(name)
+}
+
+func (mh *messageHead) Del(name string) {
+	if _, exists := mh.Header[http.CanonicalHeaderKey(name)]; exists {
+		mh.Header.Del(name)
+		mh.touch(name)
+	}
+}
+
+// ReplaceBody makes the stream send body in place of the message's own,
+// which is read and dropped. The handler must still return the original
+// framing from OnHead.
+func (mh *messageHead) ReplaceBody(body []byte) {
+	mh.body = body
+	mh.Del("Transfer-Encoding")
+	mh.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// Refuse stops the stream at this message: neither it nor anything after
+// it is forwarded, and no more messages are reported.
+func (mh *messageHead) Refuse() {
+	mh.refused = true
+}
+
+// Hold forwards nothing of the message until its body has been read, up to
+// limit bytes as sent, and then passes the body, de-chunked, to release. The
+// message goes on if release returns true; otherwise it is refused as by
+// Refuse. A longer body is not read: release gets errBodyTooLarge and the
+// message is refused whatever it returns, as it is on any other error.
+func (mh *messageHead) Hold(limit int64, release func(body []byte, err error) bool) {
+	mh.holdLimit, mh.release = limit, release
+}
+
+func (mh *messageHead) Bytes() []byte {
+	if len(mh.touched) == 0 {
+		return mh.raw
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(mh.StartLine)
+	buf.WriteString("\r\n")
+
+	writeValues := func(name string) {
+		for _, value := range mh.Header[name] {
+			buf.WriteString(name)
+			buf.WriteString(": ")
+			buf.WriteString(value)
+			buf.WriteString("\r\n")
+		}
+	}
+
+	written := make(map[string]bool)
+	for i, name := range mh.names {
+		if !mh.touched[name] {
+			buf.WriteString(mh.lines[i])
+			buf.WriteString("\r\n")
+			continue
+		}
+		if !written[name] {
+			writeValues(name)
+			written[name] = true
+		}
+	}
+
+	added := make([]string, 0, len(mh.touched))
+	for name := range mh.touched {
+		if !written[name] {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	for _, name := range added {
+		writeValues(name)
+	}
+
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// contentFraming reads Content-Length / Transfer-Encoding off a head.
+func contentFraming(head *messageHead) (int, int64) {
+	if strings.Contains(strings.ToLower(head.Header.Get("Transfer-Encoding")), "chunked") {
+		return bodyChunked, 0
+	}
+	if value := head.Header.Get("Content-Length"); value != "" {
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil && n >= 0 {
+			if n == 0 {
+				return bodyNone, 0
+			}
+			return bodyLength, n
+		}
+	}
+	return bodyUntilClose, 0
+}
+
+// streamHandler receives framing events from an httpStream.
+type streamHandler interface {
+	// OnStart fires on the first byte of each new message.
+	OnStart()
+	// OnHead receives the complete head and returns how the body is framed.
+	OnHead(head *messageHead) (mode int, length int64)
+	// OnComplete fires once the message body has been fully forwarded, and
+	// reports whether the connection switched protocols after it, which
+	// sends the rest through untouched.
+	OnComplete(bodyBytes int64) (switched bool)
+}
+
+// httpStream sits in one direction of a proxied connection and follows
+// HTTP/1.x message framing (heads, Content-Length and chunked bodies) so that
+// each message can be observed, and its head rewritten, on the way through.
+// Upgrades switch it to plain passthrough. A message it cannot frame (an
+// oversized or unparseable head, a bad chunk size) fails the write with
+// errMalformedMessage and nothing more is forwarded.
+type httpStream struct {
+	dst       io.Writer
+	handler   streamHandler
+	state     int
+	pending   []byte
+	remaining int64
+	bodyBytes int64
+	started   bool
+	// discard drops the rest of a message whose body was replaced.
+	discard bool
+	// held stands in for dst while a message is held.
+	held *heldMessage
+}
+
+// heldMessage collects a held message as it would have been forwarded.
+type heldMessage struct {
+	dst     io.Writer
+	head    []byte
+	wire    bytes.Buffer
+	limit   int64
+	chunked bool
+	release func(body []byte, err error) bool
+}
+
+func (hm *heldMessage) Write(p []byte) (int, error) {
+	if int64(hm.wire.Len()+len(p)) > hm.limit {
+		return 0, errBodyTooLarge
+	}
+	return hm.wire.Write(p)
+}
+
+func newHTTPStream(dst io.Writer, handler streamHandler) *httpStream {
+	return &httpStream{dst: dst, handler: handler}
+}
+
+func (hs *httpStream) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		if hs.state == streamPassthrough {
+			if hs.discard {
+				return total, nil
+			}
+			if _, err := hs.dst.Write(p); err != nil {
+				return 0, err
+			}
+			return total, nil
+		}
+
+		if !hs.started {
+			hs.started = true
+			hs.bodyBytes = 0
+			hs.handler.OnStart()
+		}
+
+		var err error
+		switch hs.state {
+		case streamHead:
+			p, err = hs.consumeHead(p)
+		case streamBody, streamChunkData:
+			p, err = hs.consumeBody(p)
+		case streamChunkSize, streamTrailer:
+			p, err = hs.consumeChunkLine(p)
+		case streamUntilClose:
+			if !hs.discard {
+				hs.bodyBytes += int64(len(p))
+				_, err = hs.dst.Write(p)
+			}
+			p = nil
+		}
+		if errors.Is(err, errBodyTooLarge) && hs.held != nil {
+			_, err = hs.releaseHeld(err)
+			p = nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// Finish flushes anything still buffered and reports a message that was
+// delimited by connection close.
+func (hs *httpStream) Finish() {
+	if len(hs.pending) > 0 && !hs.discard {
+		hs.dst.Write(hs.pending)
+		hs.pending = nil
+	}
+	if hs.started && hs.state == streamUntilClose {
+		hs.handler.OnComplete(hs.bodyBytes)
+		hs.started = false
+	}
+}
+
+func (hs *httpStream) consumeHead(p []byte) ([]byte, error) {
+	searchFrom := len(hs.pending) - 3
+	if searchFrom < 0 {
+		searchFrom = 0
+	}
+	hs.pending = append(hs.pending, p...)
+
+	end := headEnd(hs.pending, searchFrom)
+	if end > MaxStreamHeadSize || end < 0 && len(hs.pending) > MaxStreamHeadSize {
+		return nil, hs.malformed()
+	}
+	if end < 0 {
+		return nil, nil
+	}
+
+	rest := hs.pending[end:]
+	raw := make([]byte, end)
+	copy(raw, hs.pending[:end])
+	leftover := make([]byte, len(rest))
+	copy(leftover, rest)
+	hs.pending = hs.pending[:0]
+
+	head, ok := parseMessageHead(raw)
+	if !ok {
+		return nil, hs.malformed()
+	}
+
+	mode, length := hs.handler.OnHead(head)
+	if mode == bodyMalformed {
+		return nil, hs.malformed()
+	}
+	if head.refused {
+		hs.state = streamPassthrough
+		hs.discard = true
+		return nil, nil
+	}
+	if head.release != nil && head.body == nil && mode != bodyUpgrade {
+		hs.held = &heldMessage{dst: hs.dst, head: head.Bytes(), limit: head.holdLimit, chunked: mode == bodyChunked, release: head.release}
+		hs.dst = hs.held
+		if mode == bodyLength && length > head.holdLimit {
+			_, err := hs.releaseHeld(errBodyTooLarge)
+			return nil, err
+		}
+	} else {
+		if _, err := hs.dst.Write(head.Bytes()); err != nil {
+			return nil, err
+		}
+		if head.body != nil {
+			if _, err := hs.dst.Write(head.body); err != nil {
+				return nil, err
+			}
+			hs.bodyBytes = int64(len(head.body))
+			hs.discard = true
+		}
+	}
+
+	switch mode {
+	case bodyLength:
+		hs.state = streamBody
+		hs.remaining = length
+	case bodyChunked:
+		hs.state = streamChunkSize
+	case bodyUntilClose:
+		hs.state = streamUntilClose
+	case bodyUpgrade:
+		hs.handler.OnComplete(0)
+		hs.started = false
+		hs.state = streamPassthrough
+	default:
+		if err := hs.complete(); err != nil {
+			return nil, err
+		}
+	}
+	return leftover, nil
+}
+
+func headEnd(buf []byte, from int) int {
+	for i := from; i < len(buf); i++ {
+		if buf[i] != '\n' {
+			continue
+		}
+		if i+1 < len(buf) && buf[i+1] == '\n' {
+			return i + 2
+		}
+		if i+2 < len(buf) && buf[i+1] == '\r' && buf[i+2] == '\n' {
+			return i + 3
+		}
+	}
+	return -1
+}
+
+func (hs *httpStream) consumeBody(p []byte) ([]byte, error) {
+	n := int64(len(p))
+	if n > hs.remaining {
+		n = hs.remaining
+	}
+	if !hs.discard {
+		if _, err := hs.dst.Write(p[:n]); err != nil {
+			return nil, err
+		}
+		hs.bodyBytes += n
+	}
+	hs.remaining -= n
+
+	if hs.remaining == 0 {
+		if hs.state == streamBody {
+			return p[n:], hs.complete()
+		}
+		hs.state = streamChunkSize
+	}
+	return p[n:], nil
+}
+
+func (hs *httpStream) consumeChunkLine(p []byte) ([]byte, error) {
+	idx := bytes.IndexByte(p, '\n')
+	if idx < 0 {
+		hs.pending = append(hs.pending, p...)
+		if len(hs.pending) > MaxStreamHeadSize {
+			return nil, hs.malformed()
+		}
+		return nil, nil
+	}
+
+	hs.pending = append(hs.pending, p[:idx+1]...)
+	line := strings.TrimRight(string(hs.pending), "\r\n")
+	rest := p[idx+1:]
+
+	size := int64(-1)
+	if hs.state == streamChunkSize {
+		sizeField := line
+		if semi := strings.IndexByte(sizeField, ';'); semi >= 0 {
+			sizeField = sizeField[:semi]
+		}
+		var err error
+		size, err = strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+		// The +2 for the chunk's CRLF must not overflow into a negative length.
+		if err != nil || size < 0 || size > math.MaxInt64-2 {
+			return nil, hs.malformed()
+		}
+	}
+
+	if !hs.discard {
+		if _, err := hs.dst.Write(hs.pending); err != nil {
+			return nil, err
+		}
+		hs.bodyBytes += int64(len(hs.pending))
+	}
+	hs.pending = hs.pending[:0]
+
+	switch {
+	case hs.state == streamTrailer:
+		if line == "" {
+			return rest, hs.complete()
+		}
+	case size == 0:
+		hs.state = streamTrailer
+	default:
+		hs.state = streamChunkData
+		hs.remaining = size + 2
+	}
+	return rest, nil
+}
+
+func (hs *httpStream) complete() error {
+	if hs.held != nil {
+		if forwarded, err := hs.releaseHeld(nil); !forwarded || err != nil {
+			return err
+		}
+	}
+	switched := hs.handler.OnComplete(hs.bodyBytes)
+	hs.started = false
+	hs.discard = false
+	hs.state = streamHead
+	if switched {
+		hs.state = streamPassthrough
+	}
+	return nil
+}
+
+// releaseHeld ends the hold on a message, whose body was read in full
+// unless err says otherwise, and forwards the message if it is let go.
+func (hs *httpStream) releaseHeld(err error) (bool, error) {
+	held := hs.held
+	hs.held, hs.dst = nil, held.dst
+
+	var body []byte
+	if err == nil {
+		body = held.wire.Bytes()
+		if held.chunked {
+			body, err = io.ReadAll(httputil.NewChunkedReader(bytes.NewReader(body)))
+		}
+	}
+	if !held.release(body, err) || err != nil {
+		hs.state = streamPassthrough
+		hs.started = false
+		hs.discard = true
+		hs.pending = nil
+		return false, nil
+	}
+	if _, err := hs.dst.Write(held.head); err != nil {
+		return false, err
+	}
+	if _, err := hs.dst.Write(held.wire.Bytes()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// malformed drops whatever is buffered and everything after it.
+func (hs *httpStream) malformed() error {
+	hs.state = streamPassthrough
+	hs.started = false
+	hs.discard = true
+	hs.pending = nil
+	return errMalformedMessage
+}
+
+func (hs *httpStream) passthrough() error {
+	hs.state = streamPassthrough
+	hs.started = false
+	if len(hs.pending) == 0 || hs.discard {
+		return nil
+	}
+	pending := hs.pending
+	hs.pending = nil
+	_, err := hs.dst.Write(pending)
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	DefaultIdleSeconds          = 60
+	DefaultWebSocketIdleSeconds = 600
+)
+
+var errIdleTimeout = errors.New("idle timeout")
+
+// IdleTimeoutConfig limits how long a proxied connection may move no bytes in
+// either direction: IdleSeconds, or WebSocketIdleSeconds once upgraded (ping/
+// pong frames count as activity, so this only needs to exceed the chat's ping
+// interval). The limits always drive the socket deadlines; Enabled also runs
+// the reaper, which applies changed limits to connections already open and
+// logs what it closes.
+type IdleTimeoutConfig struct {
+	Enabled              bool `json:"enabled"`
+	IdleSeconds          int  `json:"idle_seconds"`
+	WebSocketIdleSeconds int  `json:"websocket_idle_seconds"`
+}
+
+func normalizeIdleTimeoutConfig(config IdleTimeoutConfig) IdleTimeoutConfig {
+	if config.IdleSeconds <= 0 {
+		config.IdleSeconds = DefaultIdleSeconds
+	}
+	if config.WebSocketIdleSeconds <= 0 {
+		config.WebSocketIdleSeconds = DefaultWebSocketIdleSeconds
+	}
+	return config
+}
+
+func (config IdleTimeoutConfig) limit(upgraded bool) time.Duration {
+	if upgraded {
+		return time.Duration(config.WebSocketIdleSeconds) * time.Second
+	}
+	return time.Duration(config.IdleSeconds) * time.Second
+}
+
+func (fw *Firewall) idleTimeoutConfig() IdleTimeoutConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.IdleTimeout
+}
+
+func (fw *Firewall) idleReaper() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		config := fw.idleTimeoutConfig()
+		if config.Enabled {
+			fw.reapIdleConnections(config, time.Now())
+		}
+	}
+}
+
+// reapIdleConnections cancels every connection idle for longer than its limit
+// at now, and returns how many it closed.
+func (fw *Firewall) reapIdleConnections(config IdleTimeoutConfig, now time.Time) int {
+	reaped := 0
+	for _, ac := range fw.connections.List() {
+		idle := ac.IdleFor(now)
+		if idle <= config.limit(ac.Upgraded()) {
+			continue
+		}
+		ac.cancel(errIdleTimeout)
+		reaped++
+		if fw.logger != nil {
+			fw.logger.WithRequestID(ac.ID).LogDebug("PROXY", "Closing %s: idle for %s", ac.IP, idle.Round(time.Second))
+		}
+	}
+	return reaped
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	IngressModeProxy    = "proxy"
+	IngressModeTProxy   = "tproxy"
+	IngressModeRedirect = "redirect"
+
+	// ipv6Transparent is Linux's IPV6_TRANSPARENT, which package syscall
+	// lacks, and soOriginalDst is SO_ORIGINAL_DST (IP6T_SO_ORIGINAL_DST has
+	// the same value).
+	ipv6Transparent = 0x4b
+	soOriginalDst   = 80
+)
+
+// INGRESS_MODE picks how connections reach the firewall. In "proxy" mode
+// (the default) clients connect to FIREWALL_PORT and allowed connections go
+// to REVERSE_PROXY_IP. In "tproxy" mode the firewall is the transparent
+// gateway of the Docker network: iptables hands it connections addressed to
+// other hosts, e.g.
+//
+//	iptables -t mangle -A PREROUTING -p tcp -j TPROXY --on-port 8080 --tproxy-mark 1
+//	ip rule add fwmark 1 lookup 100
+//	ip route add local 0.0.0.0/0 dev lo table 100
+//
+// and it sees each one with its original destination. allowed_ports is then
+// checked against the destination port instead of the Host header, and
+// allowed connections go to the original destination. Connections made to
+// FIREWALL_PORT directly still go to REVERSE_PROXY_IP. The listener needs
+// CAP_NET_ADMIN for IP_TRANSPARENT.
+//
+// "redirect" mode is for deployments behind an iptables REDIRECT (or DNAT)
+// to FIREWALL_PORT: the destination port the client really connected to is
+// read from conntrack with SO_ORIGINAL_DST and allowed_ports is checked
+// against it, since the Host header is the client's to choose. Allowed
+// connections still go to REVERSE_PROXY_IP, and connections that weren't
+// redirected fall back to port_strategy.
+func validIngressMode(mode string) bool {
+	return mode == IngressModeProxy || mode == IngressModeTProxy || mode == IngressModeRedirect
+}
+
+// setTransparent lets the listening socket accept connections addressed to
+// any IP. IPv6 is best effort, for IPv4-only hosts.
+func setTransparent(fd int) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+		return fmt.Errorf("failed to set IP_TRANSPARENT (needs CAP_NET_ADMIN): %v", err)
+	}
+	syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, ipv6Transparent, 1)
+	return nil
+}
+
+// parseSockaddr decodes the sockaddr_in or sockaddr_in6 SO_ORIGINAL_DST
+// returns.
+func parseSockaddr(raw []byte) (*net.TCPAddr, error) {
+	if len(raw) < 8 {
+		return nil, fmt.Errorf("short sockaddr")
+	}
+	port := int(binary.BigEndian.Uint16(raw[2:4]))
+	switch binary.NativeEndian.Uint16(raw[0:2]) {
+	case syscall.AF_INET:
+		return &net.TCPAddr{IP: net.IP(append([]byte(nil), raw[4:8]...)), Port: port}, nil
+	case syscall.AF_INET6:
+		if len(raw) < 24 {
+			return nil, fmt.Errorf("short sockaddr_in6")
+		}
+		return &net.TCPAddr{IP: net.IP(append([]byte(nil), raw[8:24]...)), Port: port}, nil
+	}
+	return nil, fmt.Errorf("unknown address family")
+}
+
+// socketOriginalDst asks conntrack where a redirected connection was headed.
+func socketOriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("not a socket")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	level := syscall.SOL_IP
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		level = syscall.SOL_IPV6
+	}
+
+	var buf [syscall.SizeofSockaddrInet6]byte
+	size := uint32(len(buf))
+	var errno syscall.Errno
+	if err := raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, uintptr(level), soOriginalDst,
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+	}); err != nil {
+		return nil, err
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+	return parseSockaddr(buf[:size])
+}
+
+// originalDestination returns where the client meant to connect, when the
+// ingress mode preserves it and it isn't the firewall port itself.
+func (fw *Firewall) originalDestination(conn net.Conn) (*net.TCPAddr, bool) {
+	var addr *net.TCPAddr
+	switch fw.ingressMode {
+	case IngressModeTProxy:
+		addr, _ = conn.LocalAddr().(*net.TCPAddr)
+	case IngressModeRedirect:
+		var err error
+		if addr, err = fw.lookupOriginalDst(conn); err != nil {
+			return nil, false
+		}
+	}
+	if addr == nil || addr.Port == fw.firewallPort {
+		return nil, false
+	}
+	return addr, true
+}
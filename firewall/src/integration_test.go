@@ -0,0 +1,3522 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testClientIP = "203.0.113.10"
+
+func TestProxyForwardsRequests(t *testing.T) {
+	h := newTestHarness(t, Rules{})
+
+	status, body := h.Get(testClientIP, "/channels")
+	if status != http.StatusOK || body != "ok" {
+		t.Fatalf("got %d %q, want 200 \"ok\"", status, body)
+	}
+
+	requests := h.upstreamRequests()
+	if len(requests) != 1 {
+		t.Fatalf("upstream saw %d requests, want 1", len(requests))
+	}
+	if requests[0].URL.Path != "/channels" {
+		t.Errorf("upstream path = %q, want /channels", requests[0].URL.Path)
+	}
+	if requests[0].Header.Get(RequestIDHeader) == "" {
+		t.Errorf("upstream request has no %s header", RequestIDHeader)
+	}
+}
+
+func TestBlockedIPIsRejected(t *testing.T) {
+	h := newTestHarness(t, Rules{BlockedIPs: ruleEntries("203.0.113.0/24")})
+
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusForbidden {
+		t.Fatalf("blocked client got %d, want 403", status)
+	}
+	if status, _ := h.Get("198.51.100.1", "/"); status != http.StatusOK {
+		t.Fatalf("other client got %d, want 200", status)
+	}
+	if n := len(h.upstreamRequests()); n != 1 {
+		t.Fatalf("upstream saw %d requests, want 1", n)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h := newTestHarness(t, Rules{MaxAttemptsPerMinute: 3})
+
+	for i := 1; i <= 3; i++ {
+		if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+			t.Fatalf("request %d got %d, want 200", i, status)
+		}
+	}
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit got %d, want 429", status)
+	}
+
+	h.Advance(time.Minute + time.Second)
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("request after the window got %d, want 200", status)
+	}
+}
+
+func TestRateLimitAggregatesIPv6Prefix(t *testing.T) {
+	h := newTestHarness(t, Rules{MaxAttemptsPerMinute: 2})
+
+	h.Get("2001:db8::1", "/")
+	h.Get("2001:db8::2", "/")
+	if status, _ := h.Get("2001:db8::3", "/"); status != http.StatusTooManyRequests {
+		t.Fatalf("third address in the same /64 got %d, want 429", status)
+	}
+	if status, _ := h.Get("2001:db8:1::1", "/"); status != http.StatusOK {
+		t.Fatalf("address in another /64 got %d, want 200", status)
+	}
+}
+
+func TestWhitelistSkipsProtections(t *testing.T) {
+	h := newTestHarness(t, Rules{
+		MaxAttemptsPerMinute: 1,
+		Whitelist:            ruleEntries(testClientIP),
+		BlockedIPs:           ruleEntries(testClientIP),
+	})
+
+	for i := 1; i <= 5; i++ {
+		if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+			t.Fatalf("whitelisted request %d got %d, want 200", i, status)
+		}
+	}
+}
+
+func TestAllowlistOnly(t *testing.T) {
+	h := newTestHarness(t, Rules{AllowlistOnly: true, Whitelist: ruleEntries("198.51.100.0/24")})
+
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusForbidden {
+		t.Fatalf("unlisted client got %d, want 403", status)
+	}
+	if status, _ := h.Get("198.51.100.7", "/"); status != http.StatusOK {
+		t.Fatalf("listed client got %d, want 200", status)
+	}
+}
+
+func TestAutoBlockExpires(t *testing.T) {
+	h := newTestHarness(t, Rules{
+		MaxAttemptsPerMinute: 100,
+		LoginProtection: LoginProtection{
+			Enabled:              true,
+			MaxFailures:          2,
+			BlockDurationMinutes: 10,
+		},
+	})
+
+	for i := 1; i <= 2; i++ {
+		if status, _ := h.Get(testClientIP, "/api/login"); status != http.StatusUnauthorized {
+			t.Fatalf("login %d got %d, want 401", i, status)
+		}
+	}
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusForbidden {
+		t.Fatalf("request after failed logins got %d, want 403", status)
+	}
+
+	h.Advance(5 * time.Minute)
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusForbidden {
+		t.Fatalf("request during the block got %d, want 403", status)
+	}
+
+	h.Advance(6 * time.Minute)
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("request after the block expired got %d, want 200", status)
+	}
+}
+
+func TestRulesCanChangeWhileRunning(t *testing.T) {
+	h := newTestHarness(t, Rules{})
+
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("got %d before the block, want 200", status)
+	}
+	h.SetRules(Rules{BlockedIPs: ruleEntries(testClientIP)})
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusForbidden {
+		t.Fatalf("got %d after the block, want 403", status)
+	}
+}
+
+func TestSimulateAtLaterTime(t *testing.T) {
+	h := newTestHarness(t, Rules{
+		LoginProtection: LoginProtection{Enabled: true, MaxFailures: 1, BlockDurationMinutes: 10},
+	})
+	h.Get(testClientIP, "/api/login")
+
+	request := SimulationRequest{IP: testClientIP, Port: DefaultFirewallPort, Method: "GET", Path: "/"}
+	if result := h.fw.simulate(request); result.Reason != "BLOCKED_IP" {
+		t.Fatalf("simulated now: got %s %s, want a BLOCKED_IP block", result.Verdict, result.Reason)
+	}
+
+	later := h.clock.Now().Add(11 * time.Minute)
+	request.At = &later
+	if result := h.fw.simulate(request); result.Verdict != SimulationAllow {
+		t.Fatalf("simulated in 11 minutes: got %s %s, want allow", result.Verdict, result.Reason)
+	}
+}
+
+func TestPanicOnlyDropsThatConnection(t *testing.T) {
+	h := newTestHarness(t, Rules{})
+
+	dial := h.fw.dialUpstream
+	h.fw.dialUpstream = func(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+		panic("upstream dialer exploded")
+	}
+	if status, _ := h.Get(testClientIP, "/"); status != 0 {
+		t.Fatalf("panicking connection got %d, want it closed", status)
+	}
+	if n := h.fw.panics.Load(); n != 1 {
+		t.Fatalf("panic counter = %d, want 1", n)
+	}
+
+	h.fw.synFloodMutex.RLock()
+	active := h.fw.activeConnsByIP[testClientIP]
+	h.fw.synFloodMutex.RUnlock()
+	if slots, _ := h.fw.connSlots.Usage(); active != 0 || slots != 0 {
+		t.Fatalf("counters not released: %d active for the IP, %d slots held", active, slots)
+	}
+
+	h.fw.dialUpstream = dial
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("next connection got %d, want 200", status)
+	}
+}
+
+func TestCancelUnblocksUpstreamDial(t *testing.T) {
+	h := newTestHarness(t, Rules{})
+
+	dialing := make(chan struct{})
+	h.fw.dialUpstream = func(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+		close(dialing)
+		<-ctx.Done()
+		return nil, context.Cause(ctx)
+	}
+
+	result := make(chan int)
+	go func() {
+		status, _ := h.Get(testClientIP, "/")
+		result <- status
+	}()
+
+	<-dialing
+	h.cancel(errors.New("test cancel"))
+	select {
+	case status := <-result:
+		if status != 0 && status != http.StatusBadGateway {
+			t.Fatalf("cancelled connection got %d", status)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection still open 2s after cancel")
+	}
+}
+
+// holdConnection opens a connection whose request upstream never answers and
+// waits until it is registered. The channel yields the status Get returned.
+func holdConnection(t *testing.T, h *testHarness) <-chan int {
+	result := make(chan int, 1)
+	go func() {
+		status, _ := h.Get(testClientIP, "/hold")
+		result <- status
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conns := h.fw.connections.List()
+		if len(conns) == 1 && conns[0].Upstream() != "" {
+			return result
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection never registered: %d listed", len(conns))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func expectClosed(t *testing.T, result <-chan int) {
+	t.Helper()
+
+	select {
+	case status := <-result:
+		if status != 0 {
+			t.Fatalf("closed connection got %d", status)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection still open after 2s")
+	}
+}
+
+func TestKillConnection(t *testing.T) {
+	h := newTestHarness(t, Rules{})
+	result := holdConnection(t, h)
+
+	if killed := h.fw.connections.Kill("", testClientIP); len(killed) != 1 {
+		t.Fatalf("killed %v, want one connection", killed)
+	}
+	expectClosed(t, result)
+	if conns := h.fw.connections.List(); len(conns) != 0 {
+		t.Fatalf("%d connections still registered after kill", len(conns))
+	}
+}
+
+func TestIdleReaper(t *testing.T) {
+	h := newTestHarness(t, Rules{})
+	result := holdConnection(t, h)
+	config := normalizeIdleTimeoutConfig(IdleTimeoutConfig{Enabled: true, IdleSeconds: 30})
+
+	if n := h.fw.reapIdleConnections(config, time.Now().Add(10*time.Second)); n != 0 {
+		t.Fatalf("reaped %d connections idle for 10s", n)
+	}
+	h.fw.connections.List()[0].MarkUpgraded()
+	if n := h.fw.reapIdleConnections(config, time.Now().Add(time.Minute)); n != 0 {
+		t.Fatalf("reaped %d upgraded connections idle for 1m", n)
+	}
+	if n := h.fw.reapIdleConnections(config, time.Now().Add(time.Hour)); n != 1 {
+		t.Fatalf("reaped %d connections idle for 1h, want 1", n)
+	}
+	expectClosed(t, result)
+}
+
+func TestSlowUploadOutlivesIdleLimit(t *testing.T) {
+	h := newTestHarness(t, Rules{IdleTimeout: IdleTimeoutConfig{IdleSeconds: 1}})
+
+	conn, err := h.listener.Dial(testClientIP)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	body := "abcdef"
+	fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: chat.example\r\nContent-Length: %d\r\n\r\n", len(body))
+	for i := range body {
+		time.Sleep(300 * time.Millisecond)
+		if _, err := conn.Write([]byte{body[i]}); err != nil {
+			t.Fatalf("upload cut after %d bytes: %v", i, err)
+		}
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("no response to a %s upload: %v", 300*time.Millisecond*time.Duration(len(body)), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("slow upload got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestStalledUploadHitsIdleLimit(t *testing.T) {
+	h := newTestHarness(t, Rules{IdleTimeout: IdleTimeoutConfig{IdleSeconds: 1}})
+
+	conn, err := h.listener.Dial(testClientIP)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	start := time.Now()
+	fmt.Fprint(conn, "POST /upload HTTP/1.1\r\nHost: chat.example\r\nContent-Length: 10\r\n\r\nab")
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("stalled upload got a response")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("stalled upload closed after %s, want about 1s", elapsed)
+	}
+}
+
+func TestIngressQuota(t *testing.T) {
+	h := newTestHarness(t, Rules{MaxAttemptsPerMinute: 100, DailyIngressQuotaBytes: 300})
+
+	statuses := []int{}
+	for i := 0; i < 5; i++ {
+		status, _ := h.Get(testClientIP, "/")
+		statuses = append(statuses, status)
+		if status == http.StatusTooManyRequests {
+			break
+		}
+	}
+	if statuses[0] != http.StatusOK || statuses[len(statuses)-1] != http.StatusTooManyRequests {
+		t.Fatalf("statuses %v, want 200 first and 429 once the quota is used", statuses)
+	}
+	if in, _ := h.fw.transfers.Used(testClientIP, h.fw.clock.Now()); in != 300 {
+		t.Fatalf("ingress used %d bytes, want exactly the 300 byte quota", in)
+	}
+	if got := h.fw.trafficStats.Snapshot().BlockReasons; len(got) == 0 || got[0].Key != "INGRESS_QUOTA" {
+		t.Fatalf("block reasons %v, want INGRESS_QUOTA", got)
+	}
+	if status, _, header := h.Request(testClientIP, "chat.example", "/", nil); status != http.StatusTooManyRequests || header.Get("Retry-After") != "43200" {
+		t.Fatalf("request over the quota got %d, Retry-After %q, want 429 until midnight UTC", status, header.Get("Retry-After"))
+	}
+
+	h.clock.Advance(12 * time.Hour)
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("request on the next day got %d", status)
+	}
+}
+
+func TestPortScanDetected(t *testing.T) {
+	h := newTestHarness(t, Rules{
+		PortScanDetection: PortScanDetection{Enabled: true, MinPorts: 3, WindowSeconds: 60},
+	})
+
+	for _, port := range []string{"22", "3306"} {
+		if status, _ := h.GetHost(testClientIP, "chat.example:"+port, "/"); status != http.StatusForbidden {
+			t.Fatalf("request to port %s got %d, want 403", port, status)
+		}
+	}
+	if h.fw.isAutoBlocked(testClientIP) {
+		t.Fatal("blocked after two ports")
+	}
+
+	h.GetHost(testClientIP, "chat.example:6379", "/")
+	if !h.fw.isAutoBlocked(testClientIP) {
+		t.Fatal("not blocked after three ports in the window")
+	}
+	reasons := h.fw.trafficStats.Snapshot().BlockReasons
+	for _, reason := range reasons {
+		if reason.Key == "SCAN_DETECTED" {
+			return
+		}
+	}
+	t.Fatalf("block reasons %v, want SCAN_DETECTED", reasons)
+}
+
+func TestPortScanWindow(t *testing.T) {
+	h := newTestHarness(t, Rules{
+		PortScanDetection: PortScanDetection{Enabled: true, MinPorts: 3, WindowSeconds: 60},
+	})
+
+	for _, port := range []string{"80", "22", "3306"} {
+		h.GetHost(testClientIP, "chat.example:"+port, "/")
+		h.Advance(31 * time.Second)
+	}
+	if h.fw.isAutoBlocked(testClientIP) {
+		t.Fatal("blocked for ports spread over more than the window")
+	}
+}
+
+func TestBlockedASN(t *testing.T) {
+	h := newTestHarness(t, Rules{BlockedASNs: []uint32{64501}})
+	loadTestASNDatabase(t, h.fw)
+
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusForbidden {
+		t.Fatalf("client in a blocked ASN got %d, want 403", status)
+	}
+	if status, _ := h.Get("198.51.100.7", "/"); status != http.StatusOK {
+		t.Fatalf("client outside the ASN got %d, want 200", status)
+	}
+}
+
+func TestASNRateLimit(t *testing.T) {
+	h := newTestHarness(t, Rules{
+		MaxAttemptsPerMinute: 10,
+		ASNRateLimits:        []ASNRateLimit{{ASN: 64501, MaxAttemptsPerMinute: 2}},
+	})
+	loadTestASNDatabase(t, h.fw)
+
+	for i := 0; i < 2; i++ {
+		if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+			t.Fatalf("request %d got %d, want 200", i+1, status)
+		}
+	}
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusTooManyRequests {
+		t.Fatalf("third request from the ASN got %d, want 429", status)
+	}
+	for i := 0; i < 3; i++ {
+		if status, _ := h.Get("198.51.100.7", "/"); status != http.StatusOK {
+			t.Fatalf("request %d outside the ASN got %d, want 200", i+1, status)
+		}
+	}
+}
+
+func TestIPListActions(t *testing.T) {
+	dir := t.TempDir()
+	blockedList := filepath.Join(dir, "vpn.txt")
+	challengedList := filepath.Join(dir, "tor.txt")
+	os.WriteFile(blockedList, []byte("# VPN exits\n198.51.100.0/24\n"), 0644)
+	os.WriteFile(challengedList, []byte("203.0.113.0/24\n"), 0644)
+
+	h := newTestHarness(t, Rules{IPLists: []IPList{
+		{Name: "vpn", Path: blockedList},
+		{Name: "tor", Path: challengedList, Action: IPListActionChallenge},
+	}})
+	h.fw.refreshIPLists(true)
+
+	if status, _ := h.Get("198.51.100.7", "/"); status != http.StatusForbidden {
+		t.Fatalf("client on a block list got %d, want 403", status)
+	}
+
+	status, _, header := h.Request(testClientIP, "chat.example", "/", nil)
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("challenged client without cookie got %d, want 503", status)
+	}
+	cookies := (&http.Response{Header: header}).Cookies()
+	if len(cookies) != 1 || cookies[0].Name != ChallengeCookieName {
+		t.Fatalf("challenge set cookies %v", cookies)
+	}
+
+	withCookie := http.Header{"Cookie": {cookies[0].Name + "=" + cookies[0].Value}}
+	if status, _, _ := h.Request(testClientIP, "chat.example", "/", withCookie); status != http.StatusOK {
+		t.Fatalf("challenged client with cookie got %d, want 200", status)
+	}
+	if status, _, _ := h.Request("203.0.113.20", "chat.example", "/", withCookie); status != http.StatusServiceUnavailable {
+		t.Fatalf("another client with the cookie got %d, want 503", status)
+	}
+	if _, _, err := h.fw.appeals.Redeem(cookies[0].Value, time.Minute, h.fw.clock.Now()); err != nil {
+		t.Fatalf("challenge cookie could not be checked as a token: %v", err)
+	}
+	if h.fw.appeals.IsAllowed(testClientIP, h.fw.clock.Now()) {
+		t.Fatal("challenge cookie redeemed as an appeal for the client")
+	}
+}
+
+func TestAppealsFollowTheClock(t *testing.T) {
+	h := newTestHarness(t, Rules{Appeals: AppealConfig{Enabled: true}})
+	appeal := func(token string) (int, appealResponse) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		h.fw.handleAppeal(recorder, httptest.NewRequest(http.MethodPost, "/appeals", strings.NewReader(`{"token":"`+token+`","minutes":5}`)))
+		var response appealResponse
+		json.NewDecoder(recorder.Body).Decode(&response)
+		return recorder.Code, response
+	}
+
+	stale := h.fw.appeals.Issue(testClientIP, time.Hour, h.fw.clock.Now())
+	h.clock.Advance(2 * time.Hour)
+	if status, _ := appeal(stale); status != http.StatusBadRequest {
+		t.Fatalf("expired token got %d", status)
+	}
+
+	status, response := appeal(h.fw.appeals.Issue(testClientIP, time.Hour, h.fw.clock.Now()))
+	if status != http.StatusOK || !response.AllowedUntil.Equal(h.fw.clock.Now().Add(5*time.Minute)) {
+		t.Fatalf("fresh token got %d %+v", status, response)
+	}
+	if !h.fw.appeals.IsAllowed(testClientIP, h.fw.clock.Now()) {
+		t.Fatal("accepted appeal not allowed")
+	}
+	h.clock.Advance(6 * time.Minute)
+	if h.fw.appeals.IsAllowed(testClientIP, h.fw.clock.Now()) {
+		t.Fatal("appeal still allowed after its minutes")
+	}
+}
+
+func TestDNSBL(t *testing.T) {
+	h := newTestHarness(t, Rules{DNSBL: DNSBLConfig{
+		Enabled: true,
+		Zones:   []string{"dnsbl.test"},
+	}})
+
+	var lookups atomic.Int32
+	h.fw.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		lookups.Add(1)
+		if host == "10.113.0.203.dnsbl.test" {
+			return []string{"127.0.0.2"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	// The first connection doesn't wait for the lookup.
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("first-seen client got %d, want 200", status)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, known := h.fw.dnsbl.Cached(testClientIP, h.fw.clock.Now()); known {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("DNSBL answer never cached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusForbidden {
+		t.Fatalf("listed client got %d, want 403", status)
+	}
+
+	rules := h.fw.rules
+	rules.DNSBL.WaitMilliseconds = 1000
+	h.SetRules(*rules)
+	if status, _ := h.Get("198.51.100.7", "/"); status != http.StatusOK {
+		t.Fatalf("unlisted client got %d, want 200", status)
+	}
+	h.Get("198.51.100.7", "/")
+	if n := lookups.Load(); n != 2 {
+		t.Fatalf("%d lookups, want one per IP", n)
+	}
+
+	if name := dnsblQueryName(net.ParseIP("2001:db8::1"), "dnsbl.test"); name != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.dnsbl.test" {
+		t.Fatalf("IPv6 query name %s", name)
+	}
+}
+
+func TestReverseDNSRules(t *testing.T) {
+	h := newTestHarness(t, Rules{
+		MaxAttemptsPerMinute: 1,
+		ReverseDNS: ReverseDNSConfig{
+			Enabled:          true,
+			AllowSuffixes:    []string{"googlebot.com"},
+			DenySuffixes:     []string{".bad.example"},
+			WaitMilliseconds: 1000,
+		},
+	})
+	ptrs := map[string]string{
+		"66.249.66.1":  "crawl-66-249-66-1.googlebot.com.",
+		"203.0.113.10": "fake.googlebot.com.",
+		"198.51.100.7": "host.bad.example.",
+	}
+	forward := map[string]string{
+		"crawl-66-249-66-1.googlebot.com": "66.249.66.1",
+		"fake.googlebot.com":              "192.0.2.1",
+		"host.bad.example":                "198.51.100.7",
+	}
+	h.fw.lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		return []string{ptrs[addr]}, nil
+	}
+	h.fw.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{forward[host]}, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if status, _ := h.Get("66.249.66.1", "/"); status != http.StatusOK {
+			t.Fatalf("request %d from a confirmed crawler got %d, want 200", i+1, status)
+		}
+	}
+
+	h.Get(testClientIP, "/")
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusTooManyRequests {
+		t.Fatalf("unconfirmed crawler PTR got %d, want 429", status)
+	}
+
+	if status, _ := h.Get("198.51.100.7", "/"); status != http.StatusForbidden {
+		t.Fatalf("client under a denied suffix got %d, want 403", status)
+	}
+
+	top := h.fw.trafficSnapshot().TopIPs
+	if len(top) == 0 || top[0].Key != "66.249.66.1" || top[0].Hostname != "crawl-66-249-66-1.googlebot.com" {
+		t.Fatalf("top IPs %+v, want the crawler with its hostname first", top)
+	}
+}
+
+func TestCountryDefaultDeny(t *testing.T) {
+	h := newTestHarness(t, Rules{Countries: CountryPolicy{
+		Enabled:       true,
+		DefaultAction: CountryActionDeny,
+		Allowed:       []string{"de"},
+	}})
+	loadTestGeoDatabase(t, h.fw, h.fw.countryDB, testCountryDatabase(t))
+
+	if status, _ := h.Get("198.51.100.7", "/"); status != http.StatusOK {
+		t.Fatalf("client from an allowed country got %d, want 200", status)
+	}
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusForbidden {
+		t.Fatalf("client from another country got %d, want 403", status)
+	}
+	if status, _ := h.Get("192.0.2.5", "/"); status != http.StatusOK {
+		t.Fatalf("client from an unknown country got %d, want 200", status)
+	}
+}
+
+func TestCountryBudget(t *testing.T) {
+	h := newTestHarness(t, Rules{Countries: CountryPolicy{
+		Enabled: true,
+		Budgets: []CountryBudget{{Country: "CN", MaxConnectionsPerMinute: 2}},
+	}})
+	loadTestGeoDatabase(t, h.fw, h.fw.countryDB, testCountryDatabase(t))
+
+	for i := 1; i <= 2; i++ {
+		if status, _ := h.Get(fmt.Sprintf("203.0.113.%d", i), "/"); status != http.StatusOK {
+			t.Fatalf("connection %d from the country got %d, want 200", i, status)
+		}
+	}
+	if status, _ := h.Get("203.0.113.3", "/"); status != http.StatusServiceUnavailable {
+		t.Fatalf("connection over the country budget got %d, want 503", status)
+	}
+	if status, _ := h.Get("198.51.100.7", "/"); status != http.StatusOK {
+		t.Fatalf("client from another country got %d, want 200", status)
+	}
+
+	h.Advance(2 * time.Minute)
+	if status, _ := h.Get("203.0.113.3", "/"); status != http.StatusOK {
+		t.Fatalf("connection after the window got %d, want 200", status)
+	}
+}
+
+func TestClusterSharesAutoBlocks(t *testing.T) {
+	t.Setenv("CLUSTER_SECRET", "test secret")
+	nodes := []*testHarness{}
+	for _, name := range []string{"a", "b"} {
+		h := newTestHarness(t, Rules{Cluster: ClusterConfig{Enabled: true, NodeName: name, Listen: "127.0.0.1:0"}})
+		if err := h.fw.startCluster(); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, h)
+	}
+	a, b := nodes[0], nodes[1]
+	a.SetRules(Rules{Cluster: ClusterConfig{Enabled: true, NodeName: "a", Peers: []string{b.fw.cluster.conn.LocalAddr().String()}}})
+
+	a.fw.attemptsMutex.Lock()
+	a.fw.autoBlockLocked(testClientIP, "TEST", a.fw.clock.Now().Add(time.Hour))
+	a.fw.attemptsMutex.Unlock()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for b.fw.autoBlockRemaining(testClientIP) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("auto-block never reached the peer")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if status, _ := b.Get(testClientIP, "/"); status != http.StatusForbidden {
+		t.Fatalf("client blocked by a peer got %d, want 403", status)
+	}
+
+	forged, _ := NewCluster("wrong secret").encode(ClusterMessage{
+		ID: "forged", Node: "x", Kind: ClusterVerdictAutoBlock, Key: "198.51.100.7", Seconds: 3600, SentAt: b.fw.clock.Now().Unix(),
+	})
+	b.fw.handleClusterMessage(forged, "127.0.0.1:9")
+	if b.fw.autoBlockRemaining("198.51.100.7") != 0 {
+		t.Fatal("verdict with a bad signature was applied")
+	}
+}
+
+func TestClusterSharesRateLimits(t *testing.T) {
+	t.Setenv("CLUSTER_SECRET", "test secret")
+	nodes := []*testHarness{}
+	for _, name := range []string{"a", "b"} {
+		h := newTestHarness(t, Rules{Cluster: ClusterConfig{Enabled: true, NodeName: name, Listen: "127.0.0.1:0"}})
+		if err := h.fw.startCluster(); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, h)
+	}
+	a, b := nodes[0], nodes[1]
+	for i, h := range nodes {
+		other := nodes[1-i]
+		h.SetRules(Rules{MaxAttemptsPerMinute: 5, Cluster: ClusterConfig{
+			Enabled: true, NodeName: []string{"a", "b"}[i], RateLimitSync: true,
+			Peers: []string{other.fw.cluster.conn.LocalAddr().String()},
+		}})
+	}
+
+	for _, h := range nodes {
+		for i := 0; i < 3; i++ {
+			if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+				t.Fatalf("connection %d got %d before any sync, want 200", i+1, status)
+			}
+		}
+	}
+
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	a.fw.syncRateCounters()
+	waitFor("b to hear from a", func() bool {
+		leader, _ := b.fw.clusterLeader()
+		return leader == "a"
+	})
+	b.fw.syncRateCounters()
+	waitFor("a to get b's counts", func() bool {
+		return a.fw.cluster.counts.Aggregate(1, nil, a.fw.clock.Now(), time.Minute)[testClientIP] == 3
+	})
+	a.fw.syncRateCounters()
+	waitFor("b to get the totals", func() bool { return b.fw.remoteAttempts(testClientIP) == 3 })
+
+	for _, h := range nodes {
+		if status, _ := h.Get(testClientIP, "/"); status != http.StatusTooManyRequests {
+			t.Fatalf("connection over the cluster-wide limit got %d, want 429", status)
+		}
+	}
+	if status, _ := b.Get("198.51.100.7", "/"); status != http.StatusOK {
+		t.Fatalf("other client got %d, want 200", status)
+	}
+}
+
+func TestStandbyMirrorsPrimary(t *testing.T) {
+	primary := newTestHarness(t, Rules{BlockedIPs: ruleEntries("198.51.100.7")})
+	primary.fw.attemptsMutex.Lock()
+	primary.fw.autoBlockLocked(testClientIP, "TEST", primary.fw.clock.Now().Add(time.Hour))
+	primary.fw.attemptsMutex.Unlock()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", primary.fw.handleHealth)
+	mux.HandleFunc("/state", primary.fw.handleState)
+	server := httptest.NewServer(adminAuth{token: "secret"}.Wrap(mux))
+	defer server.Close()
+
+	standby := newTestHarness(t, Rules{})
+	marker := filepath.Join(t.TempDir(), "took-over")
+	config := FailoverConfig{PrimaryURL: server.URL, Token: "secret", CheckInterval: time.Second, FailureThreshold: 1, TakeoverHook: "touch " + marker}
+
+	if err := standby.fw.syncFromPrimary(config); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := standby.Get("198.51.100.7", "/"); status != http.StatusForbidden {
+		t.Fatalf("IP blocked on the primary got %d from the standby, want 403", status)
+	}
+	if remaining := standby.fw.autoBlockRemaining(testClientIP); remaining < 59*time.Minute {
+		t.Fatalf("auto-block copied with %v left, want about an hour", remaining)
+	}
+
+	if _, err := primaryGet(FailoverConfig{PrimaryURL: server.URL, CheckInterval: time.Second}, "/health"); err == nil {
+		t.Fatal("health check without the token succeeded")
+	}
+
+	standby.fw.takeOver(config)
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatalf("takeover hook didn't run: %v", err)
+	}
+	if role, _ := standby.fw.failoverRole.Load().(string); role != FailoverRolePrimary {
+		t.Fatalf("role after takeover is %q, want primary", role)
+	}
+}
+
+func TestStagedRulesPromoteOrRollBack(t *testing.T) {
+	h := newTestHarness(t, Rules{
+		Snapshots:   SnapshotConfig{Directory: t.TempDir()},
+		StagedRules: StagedRulesConfig{ShadowMinutes: 10, MaxNewBlockPercent: 10, MinConnections: 4},
+	})
+
+	shadow := func(staged Rules) StagedRulesStatus {
+		t.Helper()
+		data, _ := json.Marshal(staged)
+		if _, err := h.fw.stageRules(data); err != nil {
+			t.Fatal(err)
+		}
+		for _, ip := range []string{testClientIP, testClientIP, "198.51.100.7", "198.51.100.8"} {
+			if status, _ := h.Get(ip, "/"); status != http.StatusOK {
+				t.Fatalf("staged rules changed a live verdict: got %d", status)
+			}
+		}
+		h.fw.decideStagedRules()
+		if status, _ := h.fw.staged.Status(); status.State != StagedRulesShadowing {
+			t.Fatalf("decided before the shadow period ended: %s", status.State)
+		}
+		h.Advance(11 * time.Minute)
+		h.fw.decideStagedRules()
+		status, _ := h.fw.staged.Status()
+		return status
+	}
+
+	status := shadow(Rules{BlockedIPs: ruleEntries(testClientIP)})
+	if status.State != StagedRulesRolledBack || status.NewBlocks != 2 || status.Connections != 4 {
+		t.Fatalf("staged block of an active client: %+v, want rolled back with 2/4 new blocks", status)
+	}
+	if h.fw.decidePrecedence(testClientIP, testClientIP, h.clock.Now()).Block {
+		t.Fatal("rolled-back rules were applied")
+	}
+
+	status = shadow(Rules{MaxAttemptsPerHour: 50})
+	if status.State != StagedRulesPromoted {
+		t.Fatalf("harmless staged rules: %+v, want promoted", status)
+	}
+	h.fw.rulesMutex.RLock()
+	perHour := h.fw.rules.MaxAttemptsPerHour
+	h.fw.rulesMutex.RUnlock()
+	if perHour != 50 {
+		t.Fatalf("max_attempts_per_hour after promotion is %d, want 50", perHour)
+	}
+}
+
+func TestTransparentIngressUsesOriginalDestination(t *testing.T) {
+	h := newTestHarness(t, Rules{AllowedPorts: []int{443}})
+	h.fw.ingressMode = IngressModeTProxy
+
+	var dialed atomic.Value
+	h.fw.dialUpstream = func(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+		dialed.Store(address)
+		return h.upstream.Dial(harnessFirewallIP)
+	}
+
+	request := func(destination string, port int, host string) int {
+		t.Helper()
+		intercepted := newPipeListener(destination, port)
+		go h.fw.serve(context.Background(), intercepted)
+
+		conn, err := intercepted.Dial(testClientIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", host)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := request("172.18.0.5", 443, "chat.example:9999"); status != http.StatusOK {
+		t.Fatalf("connection to an allowed destination port got %d, want 200", status)
+	}
+	if address, _ := dialed.Load().(string); address != "172.18.0.5:443" {
+		t.Fatalf("dialed %q, want the original destination 172.18.0.5:443", address)
+	}
+	if status := request("172.18.0.5", 22, "chat.example:443"); status != http.StatusForbidden {
+		t.Fatalf("connection to destination port 22 claiming 443 in Host got %d, want 403", status)
+	}
+}
+
+func TestRedirectIngressChecksOriginalPort(t *testing.T) {
+	h := newTestHarness(t, Rules{AllowedPorts: []int{443}})
+	h.fw.ingressMode = IngressModeRedirect
+
+	var original atomic.Int32
+	h.fw.lookupOriginalDst = func(conn net.Conn) (*net.TCPAddr, error) {
+		if port := original.Load(); port != 0 {
+			return &net.TCPAddr{IP: net.ParseIP("172.18.0.5"), Port: int(port)}, nil
+		}
+		return nil, syscall.ENOENT
+	}
+
+	original.Store(22)
+	if status, _ := h.GetHost(testClientIP, "chat.example:443", "/"); status != http.StatusForbidden {
+		t.Fatalf("redirected port 22 claiming 443 in Host got %d, want 403", status)
+	}
+	original.Store(443)
+	if status, _ := h.GetHost(testClientIP, "chat.example:22", "/"); status != http.StatusOK {
+		t.Fatalf("redirected port 443 got %d, want 200", status)
+	}
+	original.Store(0)
+	if status, _ := h.GetHost(testClientIP, "chat.example:443", "/"); status != http.StatusOK {
+		t.Fatalf("connection that wasn't redirected got %d, want the Host header port to apply", status)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if addr, err := socketOriginalDst(server); err == nil && addr.Port != listener.Addr().(*net.TCPAddr).Port {
+		t.Fatalf("SO_ORIGINAL_DST of a direct connection is %v", addr)
+	}
+
+	sockaddr := make([]byte, syscall.SizeofSockaddrInet4)
+	binary.NativeEndian.PutUint16(sockaddr[0:2], syscall.AF_INET)
+	binary.BigEndian.PutUint16(sockaddr[2:4], 8443)
+	copy(sockaddr[4:8], net.ParseIP("10.1.2.3").To4())
+	if addr, err := parseSockaddr(sockaddr); err != nil || addr.String() != "10.1.2.3:8443" {
+		t.Fatalf("parseSockaddr = %v, %v, want 10.1.2.3:8443", addr, err)
+	}
+}
+
+func quicInitial(dcid string) []byte {
+	packet := []byte{0xc3, 0, 0, 0, 1, byte(len(dcid))}
+	packet = append(packet, dcid...)
+	packet = append(packet, 0)
+	return append(packet, make([]byte, QUICMinInitialSize-len(packet))...)
+}
+
+func TestQUICPassthrough(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	h := newTestHarness(t, Rules{QUIC: QUICConfig{
+		Enabled: true, Listen: "127.0.0.1:0", UpstreamPort: echo.LocalAddr().(*net.UDPAddr).Port, MaxNewConnectionsPerMinute: 2,
+	}})
+	h.fw.proxyHost = "127.0.0.1"
+	if err := h.fw.startQUIC(); err != nil {
+		t.Fatal(err)
+	}
+
+	exchange := func(packet []byte) bool {
+		t.Helper()
+		client, err := net.Dial("udp", h.fw.quic.conn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.Write(packet)
+		client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		reply := make([]byte, 2048)
+		n, err := client.Read(reply)
+		return err == nil && n == len(packet)
+	}
+
+	if exchange(quicInitial("conn-1")[:600]) {
+		t.Fatal("undersized Initial was forwarded")
+	}
+	if !exchange(quicInitial("conn-1")) || !exchange(quicInitial("conn-2")) {
+		t.Fatal("Initial within the limit was not relayed")
+	}
+	if exchange(quicInitial("conn-3")) {
+		t.Fatal("third new connection ID in a minute was relayed, limit is 2")
+	}
+	h.Advance(time.Minute)
+	if !exchange(quicInitial("conn-4")) {
+		t.Fatal("new connection ID was refused after the window passed")
+	}
+}
+
+func TestProtocolClassesAndLimits(t *testing.T) {
+	h := newTestHarness(t, Rules{ProtocolRateLimits: []ProtocolRateLimit{{Protocol: "WebSocket", MaxAttemptsPerMinute: 1}}})
+	websocket := http.Header{"Upgrade": {"websocket"}}
+
+	if status, _, _ := h.Request(testClientIP, "chat.example", "/ws", websocket); status == http.StatusTooManyRequests {
+		t.Fatal("first WebSocket connection was rate limited")
+	}
+	if status, _, _ := h.Request(testClientIP, "chat.example", "/ws", websocket); status != http.StatusTooManyRequests {
+		t.Fatalf("second WebSocket connection in a minute got %d, want 429", status)
+	}
+	if status, _, _ := h.Request(testClientIP, "chat.example", "/api", http.Header{"Content-Type": {"application/grpc+proto"}}); status != http.StatusOK {
+		t.Fatalf("gRPC call got %d, want 200", status)
+	}
+	if status, _ := h.Get(testClientIP, "/api/messages"); status != http.StatusOK {
+		t.Fatalf("REST call got %d, want 200", status)
+	}
+
+	protocols := h.fw.protocolStats.Snapshot()
+	if ws := protocols[ProtocolWebSocket]; ws.Connections != 2 || ws.Blocked != 1 {
+		t.Fatalf("websocket stats %+v, want 2 connections, 1 blocked", ws)
+	}
+	if protocols[ProtocolGRPC].Connections != 1 || protocols[ProtocolHTTP].Connections != 1 {
+		t.Fatalf("protocol stats %+v, want one grpc and one http connection", protocols)
+	}
+}
+
+// clientHello captures the first TLS record a client sends for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	defer client.Close()
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestProtocolAllowlist(t *testing.T) {
+	h := newTestHarness(t, Rules{
+		AllowedHosts:      []string{"chat.example"},
+		ProtocolAllowlist: ProtocolAllowlist{Enabled: true},
+	})
+
+	upstreams := make(chan net.Conn, 1)
+	h.fw.dialUpstream = func(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+		client, server := net.Pipe()
+		upstreams <- server
+		return client, nil
+	}
+	send := func(first []byte) net.Conn {
+		t.Helper()
+		conn, err := h.listener.Dial(testClientIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		go conn.Write(first)
+		return conn
+	}
+
+	conn := send([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+	if n, _ := conn.Read(make([]byte, 1)); n != 0 {
+		t.Fatal("SSH probe got a response, want the connection closed")
+	}
+	conn.Close()
+	h.fw.activeConns.Wait()
+	if len(upstreams) != 0 {
+		t.Fatal("SSH probe was forwarded upstream")
+	}
+
+	conn = send(clientHello(t, "evil.example"))
+	io.Copy(io.Discard, conn)
+	conn.Close()
+	h.fw.activeConns.Wait()
+	if len(upstreams) != 0 {
+		t.Fatal("ClientHello for a host outside allowed_hosts was forwarded upstream")
+	}
+
+	hello := clientHello(t, "chat.example")
+	conn = send(hello)
+	upstream := <-upstreams
+	upstream.SetDeadline(time.Now().Add(5 * time.Second))
+	forwarded := make([]byte, len(hello))
+	if _, err := io.ReadFull(upstream, forwarded); err != nil || !bytes.Equal(forwarded, hello) {
+		t.Fatalf("upstream got %x (%v), want the ClientHello untouched", forwarded, err)
+	}
+	upstream.Close()
+	conn.Close()
+	h.fw.activeConns.Wait()
+
+	protocols := h.fw.protocolStats.Snapshot()
+	if protocols[ProtocolUnknown].Blocked != 1 || protocols[ProtocolTLS].Connections != 2 || protocols[ProtocolTLS].Blocked != 1 {
+		t.Fatalf("protocol stats %+v, want one blocked unknown and two tls connections, one blocked", protocols)
+	}
+}
+
+func TestHalfOpenLimits(t *testing.T) {
+	h := newTestHarness(t, Rules{HalfOpen: HalfOpenLimits{MaxPerIP: 2}})
+
+	var stalled []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := h.listener.Dial(testClientIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go conn.Write([]byte("GET / HTTP/1.1\r\nHost: chat.example\r\n"))
+		stalled = append(stalled, conn)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, fromIP := h.fw.halfOpen.Counts(testClientIP); fromIP < 2; _, fromIP = h.fw.halfOpen.Counts(testClientIP) {
+		if time.Now().After(deadline) {
+			t.Fatal("stalled connections never counted as half-open")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// h.Get would wait for the stalled connections to finish too.
+	if status := h.Send(testClientIP, "/"); status != 0 {
+		t.Fatalf("third half-open connection from one IP got %d, want it closed", status)
+	}
+	if status := h.Send("203.0.113.11", "/"); status != http.StatusOK {
+		t.Fatalf("connection from another IP got %d, want 200", status)
+	}
+
+	for _, conn := range stalled {
+		conn.Close()
+	}
+	h.fw.activeConns.Wait()
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("connection after the stalled ones closed got %d, want 200", status)
+	}
+	if total, _ := h.fw.halfOpen.Counts(testClientIP); total != 0 {
+		t.Fatalf("%d connections still counted as half-open, want 0", total)
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	h := newTestHarness(t, Rules{LoadShedding: LoadShedding{Mode: LoadSheddingPause}})
+	h.fw.connSlots = NewSemaphore(1)
+	saturated := func() bool {
+		used, size := h.fw.connSlots.Usage()
+		return used >= size
+	}
+
+	hold := func() net.Conn {
+		t.Helper()
+		conn, err := h.listener.Dial(testClientIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go fmt.Fprint(conn, "GET /hold HTTP/1.1\r\nHost: chat.example\r\n\r\n")
+		deadline := time.Now().Add(5 * time.Second)
+		for !saturated() {
+			if time.Now().After(deadline) {
+				t.Fatal("held connection never counted")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return conn
+	}
+
+	held := hold()
+	statuses := make(chan int, 1)
+	go func() { statuses <- h.Send("203.0.113.11", "/") }()
+	select {
+	case status := <-statuses:
+		t.Fatalf("connection while saturated in pause mode got %d, want it left waiting", status)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !h.fw.saturationSnapshot().AcceptPaused {
+		t.Fatal("accept not reported paused while saturated")
+	}
+	h.fw.connections.Kill("", testClientIP)
+	held.Close()
+	if status := <-statuses; status != http.StatusOK {
+		t.Fatalf("connection accepted after the pause got %d, want 200", status)
+	}
+
+	h.fw.activeConns.Wait()
+	h.SetRules(Rules{LoadShedding: LoadShedding{Mode: LoadSheddingReject}})
+	held = hold()
+	if status := h.Send("203.0.113.11", "/"); status != http.StatusServiceUnavailable {
+		t.Fatalf("connection while saturated in reject mode got %d, want 503", status)
+	}
+	h.fw.connections.Kill("", testClientIP)
+	held.Close()
+
+	saturation := h.fw.saturationSnapshot()
+	if saturation.Shed != 1 || saturation.AcceptPaused || saturation.PausedSeconds <= 0 {
+		t.Fatalf("saturation %+v, want one shed connection and a finished pause", saturation)
+	}
+}
+
+func TestConnectionQueue(t *testing.T) {
+	h := newTestHarness(t, Rules{LoadShedding: LoadShedding{QueueSize: 1, QueueTimeoutMillis: 5000}})
+	h.fw.connSlots = NewSemaphore(1)
+
+	held := holdConnection(t, h)
+	statuses := make(chan int, 1)
+	go func() { statuses <- h.Send("203.0.113.11", "/") }()
+	deadline := time.Now().Add(2 * time.Second)
+	for h.fw.saturationSnapshot().Queued != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection never queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if status := h.Send("203.0.113.12", "/"); status != http.StatusServiceUnavailable {
+		t.Fatalf("connection with the queue full got %d, want 503", status)
+	}
+	h.fw.connections.Kill("", testClientIP)
+	expectClosed(t, held)
+	if status := <-statuses; status != http.StatusOK {
+		t.Fatalf("queued connection got %d once a slot freed up, want 200", status)
+	}
+	h.fw.activeConns.Wait()
+
+	h.SetRules(Rules{LoadShedding: LoadShedding{QueueSize: 1, QueueTimeoutMillis: 20}})
+	held = holdConnection(t, h)
+	if status := h.Send("203.0.113.11", "/"); status != http.StatusServiceUnavailable {
+		t.Fatalf("connection queued past its timeout got %d, want 503", status)
+	}
+	h.fw.connections.Kill("", testClientIP)
+	expectClosed(t, held)
+
+	saturation := h.fw.saturationSnapshot()
+	if saturation.Shed != 2 || saturation.Dequeued != 1 || saturation.Queued != 0 {
+		t.Fatalf("saturation %+v, want 2 shed and 1 dequeued connection", saturation)
+	}
+}
+
+func TestWatchdogThrottlesAndEvicts(t *testing.T) {
+	h := newTestHarness(t, Rules{})
+	for i := 1; i <= 5; i++ {
+		if status, _ := h.Get(fmt.Sprintf("198.51.100.%d", i), "/"); status != http.StatusOK {
+			t.Fatalf("client %d got %d, want 200", i, status)
+		}
+	}
+
+	config := normalizeWatchdogConfig(WatchdogConfig{Enabled: true, MaxTrackedEntries: 8, ThrottleAcceptsPerSecond: 1})
+	reading := h.fw.runWatchdog(config)
+	if len(reading.Exceeded) != 1 || reading.Tracked["connection_attempts"] != 5 {
+		t.Fatalf("reading %+v, want 5 tracked clients over the tracked entries limit", reading)
+	}
+	tracked, total := h.fw.trackedEntries(), 0
+	for _, n := range tracked {
+		total += n
+	}
+	if total > config.MaxTrackedEntries || tracked["connection_attempts"] != 4 || tracked["syn_tracker"] != 4 {
+		t.Fatalf("tracked entries %v after eviction, want the least active client and its SYN history evicted to fit under %d", tracked, config.MaxTrackedEntries)
+	}
+
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("first connection while throttled got %d, want 200", status)
+	}
+	if status := h.Send(testClientIP, "/"); status != http.StatusServiceUnavailable {
+		t.Fatalf("second connection in the same second while throttled got %d, want 503", status)
+	}
+
+	if reading := h.fw.runWatchdog(normalizeWatchdogConfig(WatchdogConfig{Enabled: true})); len(reading.Exceeded) != 0 {
+		t.Fatalf("reading %+v over the default thresholds", reading)
+	}
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("connection after the throttle lifted got %d, want 200", status)
+	}
+	if status := h.fw.watchdog.Status(); status.Throttled || status.ThrottledShed != 1 {
+		t.Fatalf("watchdog status %+v, want unthrottled after shedding one connection", status)
+	}
+}
+
+func TestWatchdogEvictsEveryTrackedMap(t *testing.T) {
+	h := newTestHarness(t, Rules{})
+	now := h.fw.clock.Now()
+	h.fw.attemptsMutex.Lock()
+	for i := 0; i < 10; i++ {
+		h.fw.endpointAttempts[fmt.Sprintf("10.0.0.%d|/login", i)] = []time.Time{now.Add(time.Duration(i) * time.Second)}
+	}
+	h.fw.attemptsMutex.Unlock()
+	h.fw.synFloodMutex.Lock()
+	for i := 0; i < 10; i++ {
+		h.fw.synFloodTracker[fmt.Sprintf("10.0.1.%d", i)] = []time.Time{now.Add(time.Duration(i) * time.Second)}
+	}
+	h.fw.synFloodMutex.Unlock()
+
+	config := normalizeWatchdogConfig(WatchdogConfig{Enabled: true, MaxTrackedEntries: 12})
+	if reading := h.fw.runWatchdog(config); len(reading.Exceeded) != 1 {
+		t.Fatalf("reading %+v, want 20 tracked entries over the limit of 12", reading)
+	}
+	tracked, total := h.fw.trackedEntries(), 0
+	for _, n := range tracked {
+		total += n
+	}
+	if total > config.MaxTrackedEntries {
+		t.Fatalf("tracked entries %v after eviction, want at most %d", tracked, config.MaxTrackedEntries)
+	}
+	h.fw.attemptsMutex.Lock()
+	_, oldest := h.fw.endpointAttempts["10.0.0.0|/login"]
+	_, newest := h.fw.endpointAttempts["10.0.0.9|/login"]
+	h.fw.attemptsMutex.Unlock()
+	if oldest || !newest {
+		t.Fatalf("endpoint buckets after eviction: oldest kept %v, newest kept %v; want the stalest dropped first", oldest, newest)
+	}
+	if reading := h.fw.runWatchdog(config); len(reading.Exceeded) != 0 {
+		t.Fatalf("reading %+v after eviction, want under the limit", reading)
+	}
+
+	h.clock.Advance(SynFloodWindow + 10*time.Second)
+	h.fw.cleanupOldAttempts()
+	if tracked := h.fw.trackedEntries(); tracked["syn_tracker"] != 0 {
+		t.Fatalf("tracked entries %v, want SYN history older than the flood window pruned", tracked)
+	}
+}
+
+func TestMemoryBudgetShrinks(t *testing.T) {
+	h := newTestHarness(t, Rules{})
+	if limit, want := h.fw.trackedClientLimit(), DefaultMemoryBudgetMB<<20/DefaultTrackedBytesPerClient; limit != want {
+		t.Fatalf("tracked client limit %d under the default budget, want %d", limit, want)
+	}
+	rules := h.fw.rules
+	rules.MemoryBudget.MaxMB = 1
+	h.SetRules(*rules)
+	now := h.fw.clock.Now()
+
+	h.fw.attemptsMutex.Lock()
+	for i := 0; i < 6000; i++ {
+		ip := fmt.Sprintf("10.%d.%d.%d", i>>16, (i>>8)&0xff, i&0xff)
+		h.fw.connectionAttempts[ip] = []time.Time{now}
+		h.fw.trackedIPs.Touch(ip)
+	}
+	h.fw.connectionAttempts["10.255.0.1"] = []time.Time{now.Add(-45 * time.Second)}
+	h.fw.trackedIPs.Touch("10.255.0.1")
+	h.fw.attemptsMutex.Unlock()
+
+	budget := h.fw.memoryBudget()
+	status := h.fw.checkMemoryBudget(budget)
+	if status.Level != "coarse" || status.Clients != 6001 {
+		t.Fatalf("status %+v, want 6001 clients over a 1 MB budget", status)
+	}
+	if tracked := h.fw.trackedEntries()["connection_attempts"]; tracked > status.ClientLimit {
+		t.Fatalf("%d clients tracked after shrinking, want at most %d", tracked, status.ClientLimit)
+	}
+	h.fw.attemptsMutex.RLock()
+	_, stale := h.fw.connectionAttempts["10.255.0.1"]
+	h.fw.attemptsMutex.RUnlock()
+	if stale {
+		t.Fatal("45s old attempts kept under memory pressure")
+	}
+
+	if status, _ := h.Get("198.51.100.7", "/"); status != http.StatusOK {
+		t.Fatalf("got %d, want 200", status)
+	}
+	h.fw.attemptsMutex.RLock()
+	_, coarse := h.fw.connectionAttempts["198.51.100.0/24"]
+	h.fw.attemptsMutex.RUnlock()
+	if !coarse {
+		t.Fatal("new client not aggregated by /24 over budget")
+	}
+
+	h.fw.attemptsMutex.Lock()
+	for ip := range h.fw.connectionAttempts {
+		delete(h.fw.connectionAttempts, ip)
+		h.fw.trackedIPs.Remove(ip)
+	}
+	h.fw.attemptsMutex.Unlock()
+	if status := h.fw.checkMemoryBudget(budget); status.Level != "normal" {
+		t.Fatalf("status %+v, want normal once the state is cleared", status)
+	}
+	if key := h.fw.aggregationKey("198.51.100.7"); key != "198.51.100.7" {
+		t.Fatalf("aggregation key %q after pressure eased, want the plain IP", key)
+	}
+}
+
+func TestWarmStateSurvivesRestart(t *testing.T) {
+	rules := Rules{MaxAttemptsPerMinute: 2, WarmState: WarmStateConfig{Enabled: true, Path: filepath.Join(t.TempDir(), "state.json")}}
+	before := newTestHarness(t, rules)
+	for i := 1; i <= 2; i++ {
+		if status, _ := before.Get(testClientIP, "/"); status != http.StatusOK {
+			t.Fatalf("request %d got %d, want 200", i, status)
+		}
+	}
+	before.fw.attemptsMutex.Lock()
+	before.fw.autoBlockedIPs["203.0.113.50"] = before.clock.Now().Add(time.Hour)
+	before.fw.autoBlockedIPs["203.0.113.51"] = before.clock.Now().Add(-time.Second)
+	before.fw.attemptsMutex.Unlock()
+	config := before.fw.warmStateConfig()
+	if err := before.fw.saveWarmState(config); err != nil {
+		t.Fatal(err)
+	}
+
+	after := newTestHarness(t, rules)
+	after.Advance(10 * time.Second)
+	if restored, err := after.fw.loadWarmState(config); err != nil || !restored {
+		t.Fatalf("restored %v, err %v", restored, err)
+	}
+	if status, _ := after.Get(testClientIP, "/"); status != http.StatusTooManyRequests {
+		t.Fatalf("request after restart got %d, want 429 with the budget carried over", status)
+	}
+	if !after.fw.isAutoBlocked("203.0.113.50") || after.fw.isAutoBlocked("203.0.113.51") {
+		t.Fatal("want the live auto-block restored and the expired one dropped")
+	}
+	if top := after.fw.trafficStats.Snapshot().TopIPs; len(top) == 0 || top[0].Key != testClientIP || top[0].Count != 3 {
+		t.Fatalf("top talkers %+v, want %s with 3 connections", top, testClientIP)
+	}
+
+	stale := newTestHarness(t, rules)
+	stale.Advance(2 * time.Hour)
+	if restored, err := stale.fw.loadWarmState(config); err != nil || restored {
+		t.Fatalf("restored %v from stale state, err %v", restored, err)
+	}
+	if status, _ := stale.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("request after restoring stale state got %d, want 200", status)
+	}
+}
+
+func TestLogReplayRebuildsCounters(t *testing.T) {
+	h := newTestHarness(t, Rules{MaxAttemptsPerMinute: 2, AutoBlockEnabled: true, MaxAttemptsPerHour: 100, AutoBlockDurationHours: 1})
+	now := h.clock.Now()
+	line := func(ago time.Duration, level, category, message string) string {
+		return fmt.Sprintf("[%s] [%s] [%s] %s\n", now.Add(-ago).In(time.Local).Format(logTimestampLayout), level, category, message)
+	}
+	log := line(20*time.Minute, "INFO", "CONNECTION", "IP: 198.51.100.8:40001 - Verdict: ALLOWED - Requests: 1") +
+		line(5*time.Minute, "INFO", "CONNECTION", "IP: 198.51.100.9:40002 - Verdict: ALLOWED - Requests: 1") +
+		line(5*time.Minute, "WARNING", "DDOS", "IP: 203.0.113.50 - Hourly attempts: 101/100 - Action: AUTO_BLOCKED") +
+		"not a log line\n" +
+		line(20*time.Second, "INFO", "CONNECTION", "IP: "+testClientIP+":40003 - Verdict: ALLOWED - Requests: 1") +
+		line(10*time.Second, "INFO", "CONNECTION", "[req=abc123] IP: "+testClientIP+":40004 - Verdict: BLOCKED (RATE_LIMIT) - Requests: 0")
+	path := filepath.Join(t.TempDir(), "firewall.log")
+	if err := os.WriteFile(path, []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	connections, err := h.fw.replayLog(path, normalizeLogReplay(LogReplay{Enabled: true}))
+	if err != nil || connections != 3 {
+		t.Fatalf("replayed %d connections, err %v; want the 3 from the last 10 minutes", connections, err)
+	}
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusTooManyRequests {
+		t.Fatalf("request after replay got %d, want 429 with the replayed attempts counted", status)
+	}
+	if !h.fw.isAutoBlocked("203.0.113.50") {
+		t.Fatal("replayed auto-block not reinstated")
+	}
+	h.fw.attemptsMutex.RLock()
+	_, recent := h.fw.connectionAttempts["198.51.100.9"]
+	hourly := len(h.fw.hourlyAttempts["198.51.100.9"])
+	_, old := h.fw.hourlyAttempts["198.51.100.8"]
+	h.fw.attemptsMutex.RUnlock()
+	if recent || hourly != 1 || old {
+		t.Fatalf("5 minute old connection counted per minute %v, hourly %d; 20 minute old one counted %v", recent, hourly, old)
+	}
+}
+
+func TestRulesStatusFile(t *testing.T) {
+	h := newTestHarness(t, Rules{})
+	h.fw.rulesStatusFile = filepath.Join(t.TempDir(), "status.json")
+	readStatus := func() RulesStatus {
+		t.Helper()
+		data, err := os.ReadFile(h.fw.rulesStatusFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status RulesStatus
+		if err := json.Unmarshal(data, &status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+	modTime := time.Now()
+	writeRules := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(h.fw.rulesFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Second)
+		os.Chtimes(h.fw.rulesFile, modTime, modTime)
+		h.fw.loadRules()
+	}
+
+	writeRules(`{"blocked_ips": ["203.0.113.9", "not-an-ip"], "max_attempts_per_minute": 7}`)
+	applied := readStatus()
+	if applied.Result != RulesStatusApplied || applied.AppliedRevision != applied.Revision {
+		t.Fatalf("status %+v, want the new revision applied", applied)
+	}
+	if len(applied.Warnings) != 1 || applied.Warnings[0].Field != "blocked_ips[1]" {
+		t.Fatalf("warnings %+v, want the invalid blocked IP reported", applied.Warnings)
+	}
+	if diff := applied.Diff; diff == nil || len(diff.BlockedAdded) != 2 || !slices.Contains(diff.ChangedSections, "max_attempts_per_minute") {
+		t.Fatalf("diff %+v, want the blocked IPs and rate limit change", diff)
+	}
+
+	writeRules("{\n  \"blocked_ips\": [\n    \"203.0.113.9\",,\n  ]\n}")
+	rejected := readStatus()
+	if rejected.Result != RulesStatusRejected || rejected.AppliedRevision != applied.Revision {
+		t.Fatalf("status %+v, want rejected with %s still applied", rejected, applied.Revision)
+	}
+	if len(rejected.Errors) != 1 || !strings.HasPrefix(rejected.Errors[0].Message, "line 3,") {
+		t.Fatalf("errors %+v, want the syntax error located on line 3", rejected.Errors)
+	}
+	if limit := h.fw.perMinuteLimit(testClientIP); limit != 7 {
+		t.Fatalf("per-minute limit %d after a rejected reload, want 7 from the applied rules", limit)
+	}
+}
+
+func TestRulePrecedence(t *testing.T) {
+	if order := normalizeRulePrecedence([]string{"Blocked_IPs", "whitelist", "always_block", "bogus"}); strings.Join(order, ",") != "always_block,blocked_ips,whitelist,auto_blocks" {
+		t.Fatalf("normalized order %v, want always_block first and auto_blocks appended", order)
+	}
+
+	const alwaysBlocked = "198.51.100.66"
+	rules := Rules{Whitelist: ruleEntries(testClientIP, alwaysBlocked), BlockedIPs: ruleEntries(testClientIP), AlwaysBlock: ruleEntries(alwaysBlocked)}
+	h := newTestHarness(t, rules)
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("whitelisted and blocked client got %d under the default order, want 200", status)
+	}
+	if status, _ := h.Get(alwaysBlocked, "/"); status != http.StatusForbidden {
+		t.Fatalf("whitelisted client on always_block got %d, want 403", status)
+	}
+
+	rules.RulePrecedence = []string{RuleBlockedIPs, RuleWhitelist}
+	h.SetRules(rules)
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusForbidden {
+		t.Fatalf("whitelisted and blocked client got %d with blocked_ips first, want 403", status)
+	}
+	if h.fw.isWhitelisted(testClientIP) {
+		t.Fatal("client outranked by blocked_ips still counted as whitelisted")
+	}
+	decision := h.fw.decidePrecedence(testClientIP, testClientIP, h.clock.Now())
+	if want := "blocked_ips " + testClientIP + " (order always_block > blocked_ips > whitelist > auto_blocks)"; decision.String() != want {
+		t.Fatalf("decision %q, want %q", decision, want)
+	}
+}
+
+func TestRuleGroups(t *testing.T) {
+	rules := Rules{RuleGroups: []RuleGroup{{Name: "Threat-Feed", Enabled: true, BlockedIPs: ruleEntries(testClientIP)}}}
+	h := newTestHarness(t, rules)
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusForbidden {
+		t.Fatalf("client in an enabled group's blocked_ips got %d, want 403", status)
+	}
+	decision := h.fw.decidePrecedence(testClientIP, testClientIP, h.clock.Now())
+	if decision.Group != "threat-feed" || !strings.Contains(decision.String(), "[group threat-feed]") {
+		t.Fatalf("decision %q doesn't name the group", decision)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/rule-groups?name=threat-feed&enabled=false", nil)
+	recorder := httptest.NewRecorder()
+	h.fw.handleRuleGroups(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("disabling the group returned %d: %s", recorder.Code, recorder.Body)
+	}
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("client in a disabled group got %d, want 200", status)
+	}
+
+	statuses := h.fw.ruleGroupStatuses()
+	if len(statuses) != 1 || statuses[0].Enabled || statuses[0].Entries != 1 || statuses[0].Hits == 0 {
+		t.Fatalf("group statuses %+v, want one disabled group with its entry and hits", statuses)
+	}
+
+	recorder = httptest.NewRecorder()
+	h.fw.handleRuleGroups(recorder, httptest.NewRequest(http.MethodPost, "/rule-groups?name=geo&enabled=true", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("toggling an unknown group returned %d, want 404", recorder.Code)
+	}
+}
+
+func TestRuleEntryMetadata(t *testing.T) {
+	data := []byte(`{"blocked_ips": ["198.51.100.1", {"entry": "203.0.113.0/24", "comment": "scraper", "created_by": "ops", "created_at": "2024-01-01T10:00:00Z"}]}`)
+	var rules Rules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(rules.BlockedIPs.Entries(), ","); got != "198.51.100.1,203.0.113.0/24" {
+		t.Fatalf("entries %s", got)
+	}
+	if entry, _ := rules.BlockedIPs.Find("203.0.113.0/24"); entry.Comment != "scraper" || entry.CreatedBy != "ops" || entry.CreatedAt.IsZero() {
+		t.Fatalf("metadata lost: %+v", entry)
+	}
+
+	out, err := json.Marshal(rules.BlockedIPs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `["198.51.100.1",{"entry":"203.0.113.0/24","comment":"scraper","created_by":"ops","created_at":"2024-01-01T10:00:00Z"}]`; string(out) != want {
+		t.Fatalf("marshaled %s, want %s", out, want)
+	}
+
+	var invalid Rules
+	if err := json.Unmarshal([]byte(`{"whitelist": [{"comment": "no address"}]}`), &invalid); err == nil {
+		t.Fatal("entry object without an address was accepted")
+	}
+
+	h := newTestHarness(t, rules)
+	if status, _ := h.Get("203.0.113.9", "/"); status != http.StatusForbidden {
+		t.Fatalf("client in an object entry got %d, want 403", status)
+	}
+}
+
+func TestBlockedEntryTTL(t *testing.T) {
+	h := newTestHarness(t, Rules{})
+	content := `{"blocked_ips": ["198.51.100.5#ttl=1h", {"entry": "198.51.100.6", "ttl": "3h"}, {"entry": "198.51.100.7", "expires_at": "2024-01-01T11:00:00Z"}, "198.51.100.8"], "error_pages": {"respond_to_blocked": true}}`
+	if err := os.WriteFile(h.fw.rulesFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.fw.loadRules()
+
+	if status, _ := h.Get("198.51.100.7", "/"); status != http.StatusOK {
+		t.Fatalf("client whose entry already expired got %d, want 200", status)
+	}
+	if status, _ := h.Get("198.51.100.5", "/"); status != http.StatusForbidden {
+		t.Fatalf("client with a live TTL entry got %d, want 403", status)
+	}
+
+	data, err := os.ReadFile(h.fw.rulesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved Rules
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(saved.BlockedIPs.Entries(), ","); got != "198.51.100.5,198.51.100.6,198.51.100.8" {
+		t.Fatalf("saved blocked_ips %s, want the expired entry pruned", got)
+	}
+	if entry, _ := saved.BlockedIPs.Find("198.51.100.5"); !entry.ExpiresAt.Equal(h.clock.Now().Add(time.Hour)) {
+		t.Fatalf("TTL saved as expiry %v, want an hour from the reload", entry.ExpiresAt)
+	}
+
+	h.Advance(2 * time.Hour)
+	h.fw.pruneExpiredRuleEntries()
+	if status, _ := h.Get("198.51.100.5", "/"); status != http.StatusOK {
+		t.Fatalf("client whose TTL ran out got %d, want 200", status)
+	}
+	if status, _ := h.Get("198.51.100.6", "/"); status != http.StatusForbidden {
+		t.Fatalf("client with a longer TTL got %d, want 403", status)
+	}
+}
+
+func TestRuleEntriesDedupedOnReload(t *testing.T) {
+	h := newTestHarness(t, Rules{})
+	content := `{"blocked_ips": ["10.1.2.3/8", "10.0.0.0/8", "10.9.9.9", "2001:DB8::1", "2001:db8::1", "192.0.2.0/24", {"entry": "192.0.2.0/25", "expires_at": "2024-01-02T00:00:00Z"}, {"entry": "198.51.100.0/24", "expires_at": "2024-01-02T00:00:00Z"}, "198.51.100.7"]}`
+	if err := os.WriteFile(h.fw.rulesFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.fw.loadRules()
+
+	h.fw.rulesMutex.RLock()
+	got := strings.Join(h.fw.rules.BlockedIPs.Entries(), ",")
+	h.fw.rulesMutex.RUnlock()
+	if want := "10.0.0.0/8,2001:db8::1,192.0.2.0/24,198.51.100.0/24,198.51.100.7"; got != want {
+		t.Fatalf("blocked_ips after reload %s, want %s", got, want)
+	}
+}
+
+func TestRuleConflicts(t *testing.T) {
+	h := newTestHarness(t, Rules{})
+	h.fw.rulesStatusFile = filepath.Join(t.TempDir(), "status.json")
+	modTime := time.Now()
+	writeRules := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(h.fw.rulesFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Second)
+		os.Chtimes(h.fw.rulesFile, modTime, modTime)
+		h.fw.loadRules()
+	}
+
+	writeRules(`{"whitelist": ["203.0.113.0/24"], "blocked_ips": ["203.0.113.9", "198.51.100.1"], "max_attempts_per_minute": 7}`)
+	conflicts := h.fw.ruleConflicts()
+	if len(conflicts) != 1 || conflicts[0].Entry != "203.0.113.9" || conflicts[0].Winner != RuleWhitelist {
+		t.Fatalf("conflicts %+v, want the blocked IP inside the whitelisted range, won by the whitelist", conflicts)
+	}
+
+	writeRules(`{"whitelist": ["203.0.113.7"], "always_block": ["203.0.113.0/24"], "max_attempts_per_minute": 9, "rule_conflicts": {"action": "reject"}}`)
+	if limit := h.fw.perMinuteLimit(testClientIP); limit != 7 {
+		t.Fatalf("rules with a conflict under reject were applied (limit %d)", limit)
+	}
+	data, err := os.ReadFile(h.fw.rulesStatusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status RulesStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Result != RulesStatusRejected || len(status.Errors) != 1 || !strings.Contains(status.Errors[0].Message, "always_block 203.0.113.0/24 (always_block wins)") {
+		t.Fatalf("status %+v, want the conflict reported as the rejection reason", status)
+	}
+}
+
+func TestRateLimitExemption(t *testing.T) {
+	const monitor = "198.51.100.20"
+	h := newTestHarness(t, Rules{MaxAttemptsPerMinute: 2, ExemptFromRateLimit: ruleEntries("198.51.100.16/28")})
+
+	for i := 1; i <= 5; i++ {
+		if status, _ := h.Get(monitor, "/"); status != http.StatusOK {
+			t.Fatalf("exempt request %d got %d, want 200", i, status)
+		}
+	}
+	for i := 1; i <= 2; i++ {
+		h.Get(testClientIP, "/")
+	}
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusTooManyRequests {
+		t.Fatalf("non-exempt client over the limit got %d, want 429", status)
+	}
+
+	h.SetRules(Rules{MaxAttemptsPerMinute: 2, ExemptFromRateLimit: ruleEntries("198.51.100.16/28"), BlockedIPs: ruleEntries(monitor)})
+	if status, _ := h.Get(monitor, "/"); status != http.StatusForbidden {
+		t.Fatalf("blocked exempt client got %d, want 403", status)
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	var clientCerts atomic.Int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			clientCerts.Store(int32(len(r.TLS.PeerCertificates)))
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	backend.StartTLS()
+	defer backend.Close()
+
+	dir := t.TempDir()
+	writePEM := func(name, kind string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	serverCert := backend.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(serverCert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := writePEM("ca.pem", "CERTIFICATE", backend.Certificate().Raw)
+	certFile := writePEM("client.pem", "CERTIFICATE", serverCert.Certificate[0])
+	keyFile := writePEM("client.key", "PRIVATE KEY", key)
+
+	config := UpstreamTLS{Enabled: true, ServerName: "example.com", CAFile: caFile, CertFile: certFile, KeyFile: keyFile}
+	h := newTestHarness(t, Rules{UpstreamTLS: config})
+	h.fw.dialUpstream = func(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+		return dialTCP(ctx, backend.Listener.Addr().String(), timeout)
+	}
+	if status, body := h.Get(testClientIP, "/"); status != http.StatusOK || body != "ok" {
+		t.Fatalf("request over upstream TLS got %d %q, want 200", status, body)
+	}
+	if clientCerts.Load() != 1 {
+		t.Fatal("upstream didn't receive the client certificate")
+	}
+
+	config.CAFile = ""
+	h.SetRules(Rules{UpstreamTLS: config})
+	if status, _ := h.Get(testClientIP, "/"); status == http.StatusOK {
+		t.Fatal("upstream with an untrusted certificate was accepted")
+	}
+}
+
+func TestHappyEyeballsDial(t *testing.T) {
+	if got := strings.Join(interleaveAddresses([]string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2"}, "192.0.2.2"), ","); got != "192.0.2.2,2001:db8::1,192.0.2.1,2001:db8::2" {
+		t.Fatalf("dial order %s", got)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	h := newTestHarness(t, Rules{UpstreamDial: UpstreamDialConfig{Enabled: true, FallbackDelayMs: 20, AttemptTimeoutMs: 500}})
+	h.fw.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"192.0.2.1", "127.0.0.1"}, nil
+	}
+	conn, err := h.fw.dialHappyEyeballs(context.Background(), net.JoinHostPort("proxy", port), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := h.fw.lastGoodUpstream.Get("proxy"); got != "127.0.0.1" {
+		t.Fatalf("last good address %q, want 127.0.0.1", got)
+	}
+}
+
+func TestUpstreamReresolvedOnFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	h := newTestHarness(t, Rules{UpstreamDial: UpstreamDialConfig{Enabled: true, AttemptTimeoutMs: 100, ResolveTTLSeconds: 60}})
+	var lookups atomic.Int32
+	answer := []string{"192.0.2.1"}
+	var lookupErr error
+	h.fw.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		lookups.Add(1)
+		return answer, lookupErr
+	}
+	dial := func() error {
+		conn, err := h.fw.dialHappyEyeballs(context.Background(), net.JoinHostPort("reverse-proxy", port), time.Second)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	if err := dial(); err == nil {
+		t.Fatal("dial to an unreachable address succeeded")
+	}
+	answer = []string{"127.0.0.1"}
+	if err := dial(); err != nil {
+		t.Fatalf("dial after the upstream moved: %v", err)
+	}
+	if n := lookups.Load(); n != 3 {
+		t.Fatalf("%d lookups, want the cached answer refreshed once after the failed dial", n)
+	}
+
+	lookupErr = errors.New("no such host")
+	h.Advance(2 * time.Minute)
+	if err := dial(); err != nil {
+		t.Fatalf("dial while the name doesn't resolve: %v", err)
+	}
+}
+
+func TestSocketKeepaliveOptions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	options := normalizeSocketOptions(SocketOptions{Keepalive: KeepaliveConfig{Enabled: true, IdleSeconds: 30, Count: 3}})
+	if err := setSocketOptions(conn, options); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int{}
+	raw.Control(func(fd uintptr) {
+		got["idle"], _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		got["interval"], _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)
+		got["count"], _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT)
+	})
+	if got["idle"] != 30 || got["interval"] != DefaultKeepaliveIntervalSeconds || got["count"] != 3 {
+		t.Fatalf("keepalive options %v, want idle 30, interval %d, count 3", got, DefaultKeepaliveIntervalSeconds)
+	}
+}
+
+func TestSocketNoDelayAndBufferOptions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	noDelay := false
+	options := normalizeSocketOptions(SocketOptions{NoDelay: &noDelay, ReceiveBufferBytes: 65536, SendBufferBytes: 65536})
+	if err := setSocketOptions(conn, options); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int{}
+	raw.Control(func(fd uintptr) {
+		got["nodelay"], _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		got["rcvbuf"], _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		got["sndbuf"], _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+	// Linux doubles requested buffer sizes to leave room for bookkeeping.
+	if got["nodelay"] != 0 || got["rcvbuf"] < 65536 || got["sndbuf"] < 65536 {
+		t.Fatalf("socket options %v, want nodelay 0 and buffers of at least 65536", got)
+	}
+}
+
+func TestFingerprintSuppression(t *testing.T) {
+	h := newTestHarness(t, Rules{})
+
+	if _, body, header := h.Request(testClientIP, "chat.example", "/broken", nil); header.Get("Server") == "" || !strings.Contains(body, "nginx") {
+		t.Fatalf("without suppression got Server %q, body %q", header.Get("Server"), body)
+	}
+
+	h.SetRules(Rules{FingerprintSuppression: FingerprintSuppression{Enabled: true, ServerHeader: "chat", NormalizeErrors: true}})
+	status, body, header := h.Request(testClientIP, "chat.example", "/broken", nil)
+	if status != http.StatusBadGateway {
+		t.Fatalf("got %d, want 502", status)
+	}
+	if header.Get("Server") != "chat" || header.Get("X-Powered-By") != "" {
+		t.Errorf("Server %q, X-Powered-By %q, want \"chat\" and none", header.Get("Server"), header.Get("X-Powered-By"))
+	}
+	if strings.Contains(body, "nginx") || !strings.Contains(body, "DockerChat") {
+		t.Errorf("error body not normalized: %q", body)
+	}
+
+	if status, body := h.Get(testClientIP, "/"); status != http.StatusOK || body != "ok" {
+		t.Fatalf("normal response got %d %q, want 200 \"ok\"", status, body)
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	h := newTestHarness(t, Rules{
+		BlockedIPs: ruleEntries("198.51.100.1"),
+		SecurityHeaders: SecurityHeaders{Enabled: true, Headers: map[string]string{
+			"Content-Security-Policy": "default-src 'self'",
+			"X-Frame-Options":         "",
+		}},
+	})
+
+	for _, clientIP := range []string{testClientIP, "198.51.100.1"} {
+		_, _, header := h.Request(clientIP, "chat.example", "/", nil)
+		if header.Get("X-Content-Type-Options") != "nosniff" || header.Get("Content-Security-Policy") != "default-src 'self'" {
+			t.Errorf("%s: security headers missing: %v", clientIP, header)
+		}
+		if header.Get("X-Frame-Options") != "" {
+			t.Errorf("%s: X-Frame-Options %q, want it dropped", clientIP, header.Get("X-Frame-Options"))
+		}
+	}
+}
+
+func TestCORSPolicy(t *testing.T) {
+	h := newTestHarness(t, Rules{
+		ExemptFromRateLimit: ruleEntries(testClientIP),
+		CORS:                CORSPolicy{Enabled: true, AllowedOrigins: []string{"https://app.example"}},
+	})
+
+	preflight := func(origin, method string) (int, http.Header) {
+		conn, err := h.listener.Dial(testClientIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		go fmt.Fprintf(conn, "OPTIONS /api/messages HTTP/1.1\r\nHost: chat.example\r\nOrigin: %s\r\nAccess-Control-Request-Method: %s\r\n\r\n", origin, method)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("preflight: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header
+	}
+	status, header := preflight("https://app.example", http.MethodPost)
+	if status != http.StatusNoContent || header.Get("Access-Control-Allow-Origin") != "https://app.example" {
+		t.Fatalf("allowed preflight got %d, Allow-Origin %q", status, header.Get("Access-Control-Allow-Origin"))
+	}
+	if status, _ := preflight("https://evil.example", http.MethodPost); status != http.StatusForbidden {
+		t.Fatalf("preflight from another origin got %d, want 403", status)
+	}
+	if status, _ := preflight("https://app.example", "PROPFIND"); status != http.StatusForbidden {
+		t.Fatalf("preflight for an unlisted method got %d, want 403", status)
+	}
+
+	if status, _, _ := h.Request(testClientIP, "chat.example", "/api/messages", http.Header{"Origin": {"https://evil.example"}}); status != http.StatusForbidden {
+		t.Fatalf("cross-origin request got %d, want 403", status)
+	}
+	for _, origin := range []string{"https://app.example", "https://chat.example"} {
+		if status, _, _ := h.Request(testClientIP, "chat.example", "/api/messages", http.Header{"Origin": {origin}}); status != http.StatusOK {
+			t.Fatalf("request from %s got %d, want 200", origin, status)
+		}
+	}
+	if n := len(h.upstreamRequests()); n != 2 {
+		t.Fatalf("upstream saw %d requests, want 2", n)
+	}
+}
+
+func TestTrustCookieRelaxesRateLimit(t *testing.T) {
+	h := newTestHarness(t, Rules{MaxAttemptsPerMinute: 2, TrustCookies: TrustCookieConfig{Enabled: true, RateLimitMultiplier: 2}})
+	h.fw.trustCookies = NewTrustCookies("shared-secret")
+
+	trusted := http.Header{"Cookie": {TrustCookieName + "=" + h.fw.trustCookies.Issue("alice", h.clock.Now().Add(time.Hour))}}
+	forged := http.Header{"Cookie": {TrustCookieName + "=" + NewTrustCookies("guess").Issue("alice", h.clock.Now().Add(time.Hour))}}
+
+	for i := 1; i <= 2; i++ {
+		if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+			t.Fatalf("request %d got %d, want 200", i, status)
+		}
+	}
+	if status, _, _ := h.Request(testClientIP, "chat.example", "/", nil); status != http.StatusTooManyRequests {
+		t.Fatalf("request without cookie over the limit got %d, want 429", status)
+	}
+	if status, _, _ := h.Request(testClientIP, "chat.example", "/", forged); status != http.StatusTooManyRequests {
+		t.Fatalf("request with a forged cookie got %d, want 429", status)
+	}
+	h.Advance(time.Minute + time.Second)
+	for i := 1; i <= 4; i++ {
+		if status, _, _ := h.Request(testClientIP, "chat.example", "/", trusted); status != http.StatusOK {
+			t.Fatalf("trusted request %d got %d, want 200", i, status)
+		}
+	}
+	if status, _, _ := h.Request(testClientIP, "chat.example", "/", trusted); status != http.StatusTooManyRequests {
+		t.Fatalf("trusted request over the relaxed limit got %d, want 429", status)
+	}
+}
+
+func TestAbuseReports(t *testing.T) {
+	h := newTestHarness(t, Rules{
+		MaxAttemptsPerMinute: 1,
+		TrustCookies:         TrustCookieConfig{Enabled: true},
+		AbuseReports:         AbuseReportConfig{Enabled: true, Threshold: 2},
+	})
+	h.fw.trustCookies = NewTrustCookies("shared-secret")
+
+	report := func(body string) (int, abuseReportResponse) {
+		recorder := httptest.NewRecorder()
+		h.fw.handleAbuseReport(recorder, httptest.NewRequest(http.MethodPost, "/reports", strings.NewReader(body)))
+		var response abuseReportResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder.Code, response
+	}
+
+	if code, _ := report(`{"reason": "spam"}`); code != http.StatusBadRequest {
+		t.Fatalf("report without ip or user got %d, want 400", code)
+	}
+	if code, response := report(`{"ip": "` + testClientIP + `", "reason": "spam"}`); code != http.StatusOK || response.BlockedUntil != nil {
+		t.Fatalf("first report got %d %+v, want 200 and no block", code, response)
+	}
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("client under the threshold got %d, want 200", status)
+	}
+	if _, response := report(`{"ip": "` + testClientIP + `", "reason": "spam"}`); response.BlockedUntil == nil {
+		t.Fatalf("second report didn't block: %+v", response)
+	}
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusForbidden {
+		t.Fatalf("reported client got %d, want 403", status)
+	}
+
+	trusted := http.Header{"Cookie": {TrustCookieName + "=" + h.fw.trustCookies.Issue("mallory", h.clock.Now().Add(time.Hour))}}
+	h.Get("198.51.100.1", "/")
+	if status, _, _ := h.Request("198.51.100.1", "chat.example", "/", trusted); status != http.StatusOK {
+		t.Fatalf("trusted user got %d, want 200", status)
+	}
+	report(`{"user": "mallory", "reason": "spam"}`)
+	if status, _, _ := h.Request("198.51.100.1", "chat.example", "/", trusted); status != http.StatusTooManyRequests {
+		t.Fatalf("reported user got %d, want 429", status)
+	}
+}
+
+func TestRiskScoring(t *testing.T) {
+	h := newTestHarness(t, Rules{
+		MaxAttemptsPerMinute: 8,
+		AbuseReports:         AbuseReportConfig{Enabled: true, Threshold: 10},
+		RiskScoring:          RiskScoring{Enabled: true, ChallengeScore: 20, ThrottleScore: 40, ThrottleFactor: 0.25, BlockScore: 80},
+	})
+	report := func() {
+		if _, err := h.fw.applyAbuseReport(abuseReport{IP: testClientIP, Reason: "spam"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report()
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusServiceUnavailable {
+		t.Fatalf("client at score 25 got %d, want the 503 challenge", status)
+	}
+	if status, _ := h.Get("198.51.100.1", "/"); status != http.StatusOK {
+		t.Fatalf("unscored client got %d, want 200", status)
+	}
+
+	report()
+	if limit := h.fw.perMinuteLimit(h.fw.aggregationKey(testClientIP)); limit != 2 {
+		t.Fatalf("per-minute limit at score 50 is %d, want 2", limit)
+	}
+
+	// Scores decay: two half-lives bring 50 down to 12.5.
+	h.Advance(20 * time.Minute)
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("client after decay got %d, want 200", status)
+	}
+
+	for i := 0; i < 3; i++ {
+		report()
+	}
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusForbidden {
+		t.Fatalf("client at block score got %d, want 403", status)
+	}
+}
+
+func TestDecisionCache(t *testing.T) {
+	rules := Rules{
+		ExemptFromRateLimit: ruleEntries(testClientIP),
+		DecisionCache:       DecisionCacheConfig{Enabled: true, TTLSeconds: 30},
+	}
+	h := newTestHarness(t, rules)
+	loadTestASNDatabase(t, h.fw)
+
+	for i := 0; i < 3; i++ {
+		if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+			t.Fatalf("request %d got %d, want 200", i+1, status)
+		}
+	}
+	if stats := h.fw.decisions.Stats(); stats.Entries != 1 || stats.Hits != 2 {
+		t.Fatalf("decision cache stats %+v, want 1 entry and 2 hits", stats)
+	}
+
+	// A reload drops the cached allow verdict straight away.
+	rules.BlockedASNs = []uint32{64501}
+	h.SetRules(rules)
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusForbidden {
+		t.Fatalf("client in a newly blocked ASN got %d, want 403", status)
+	}
+
+	// So does loading a new ASN database.
+	loadTestGeoDatabase(t, h.fw, h.fw.asnDB, testASNDatabase(t, 24))
+	if h.fw.decisions.Stats().Entries != 0 {
+		t.Fatal("verdicts survived a database reload")
+	}
+}
+
+func TestLogFileBuffering(t *testing.T) {
+	h := newTestHarness(t, Rules{})
+	h.SetRules(Rules{Logging: LoggingConfig{File: LogFileConfig{
+		BufferKilobytes:           64,
+		FlushIntervalMilliseconds: 60000,
+		FlushLevel:                "SECURITY",
+		Sync:                      "flush",
+	}}})
+	logged := func(text string) bool {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(h.fw.logger.logDir, "firewall.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Contains(string(data), text)
+	}
+
+	h.fw.logger.LogInfo("TEST", "buffered entry")
+	if logged("buffered entry") {
+		t.Fatal("INFO entry written out before a flush")
+	}
+	h.fw.logger.LogBlocked("198.51.100.1", "TEST")
+	if !logged("buffered entry") || !logged("Reason: TEST") {
+		t.Fatal("SECURITY entry didn't flush the buffer")
+	}
+
+	h.fw.logger.LogInfo("TEST", "entry before close")
+	h.fw.logger.Close()
+	if !logged("entry before close") {
+		t.Fatal("Close lost buffered entries")
+	}
+}
+
+func TestBlockNotificationsFile(t *testing.T) {
+	dir := t.TempDir()
+	config := normalizeBlockNotificationsConfig(BlockNotificationsConfig{
+		Enabled:  true,
+		Path:     filepath.Join(dir, "blocks.json"),
+		LiftPath: filepath.Join(dir, "unblock.json"),
+	})
+	h := newTestHarness(t, Rules{
+		BlockedIPs:         RuleEntryList{{Entry: "192.0.2.1", Comment: "spam wave"}},
+		BlockNotifications: config,
+	})
+	readBlocks := func() []BlockNotice {
+		t.Helper()
+		data, err := os.ReadFile(config.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var file blockNotificationsFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			t.Fatal(err)
+		}
+		return file.Blocks
+	}
+
+	h.fw.attemptsMutex.Lock()
+	h.fw.autoBlockLocked(testClientIP, "SCAN_DETECTED", h.clock.Now().Add(time.Hour))
+	h.fw.attemptsMutex.Unlock()
+	last, err := h.fw.syncBlockNotifications(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := readBlocks()
+	if len(blocks) != 2 || blocks[0].IP != "192.0.2.1" || blocks[0].Reason != "spam wave" || blocks[0].ExpiresAt != nil ||
+		blocks[1].IP != testClientIP || blocks[1].Reason != "SCAN_DETECTED" || blocks[1].Source != BlockSourceAuto || blocks[1].ExpiresAt == nil {
+		t.Fatalf("blocks.json lists %+v", blocks)
+	}
+
+	if err := os.WriteFile(config.LiftPath, []byte(`["`+testClientIP+`"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.fw.syncBlockNotifications(config, last); err != nil {
+		t.Fatal(err)
+	}
+	if h.fw.isAutoBlocked(testClientIP) {
+		t.Fatal("lifted auto-block still in force")
+	}
+	if _, err := os.Stat(config.LiftPath); !os.IsNotExist(err) {
+		t.Fatalf("lift file not removed: %v", err)
+	}
+	if blocks := readBlocks(); len(blocks) != 1 || blocks[0].IP != "192.0.2.1" {
+		t.Fatalf("blocks.json after the lift lists %+v", blocks)
+	}
+}
+
+func TestTopDashboard(t *testing.T) {
+	h := newTestHarness(t, Rules{BlockedIPs: ruleEntries(testClientIP)})
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusForbidden {
+		t.Fatalf("blocked client got %d, want 403", status)
+	}
+	h.fw.logger.Flush()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", h.fw.handleStats)
+	mux.HandleFunc("/connections", h.fw.handleConnections)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	logPath := filepath.Join(h.fw.logger.logDir, "firewall.log")
+	sample, err := fetchTopSample(newAdminClient(server.Listener.Addr().String()), logPath, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frame bytes.Buffer
+	renderTop(&frame, sample, nil, topView{})
+	for _, want := range []string{"TOP BLOCKED IPS", testClientIP, "BLOCKED_IP", "[SECURITY] [BLOCKED]", "Reason: BLOCKED_IP"} {
+		if !strings.Contains(frame.String(), want) {
+			t.Fatalf("frame lacks %q:\n%s", want, frame.String())
+		}
+	}
+}
+
+func TestScheduledReports(t *testing.T) {
+	h := newTestHarness(t, Rules{BlockedIPs: ruleEntries("198.51.100.9")})
+	var delivered atomic.Value
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		delivered.Store(body)
+	}))
+	defer webhook.Close()
+	config := normalizeScheduledReportsConfig(ScheduledReportsConfig{
+		Daily:      true,
+		Weekly:     true,
+		Directory:  t.TempDir(),
+		WebhookURL: webhook.URL,
+	})
+
+	h.Get(testClientIP, "/")
+	h.Get("198.51.100.9", "/")
+	h.fw.publishScheduledReports(config)
+	if entries, _ := os.ReadDir(config.Directory); len(entries) != 0 {
+		t.Fatalf("reports written before the day ended: %v", entries)
+	}
+
+	h.Advance(13 * time.Hour)
+	h.fw.publishScheduledReports(config)
+	data, err := os.ReadFile(filepath.Join(config.Directory, "daily-2024-01-01.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report SecurityReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Connections != 2 || report.Blocked != 1 || report.UniqueClients != 2 ||
+		len(report.BlocksByReason) != 1 || report.BlocksByReason[0].Key != "BLOCKED_IP" ||
+		len(report.BusiestHours) != 1 || report.BusiestHours[0].Connections != 2 {
+		t.Fatalf("daily report %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(config.Directory, "daily-2024-01-01.html")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(config.Directory, "weekly-2024-01-01.json")); !os.IsNotExist(err) {
+		t.Fatalf("weekly report written mid-week: %v", err)
+	}
+	if body, _ := delivered.Load().([]byte); !bytes.Contains(body, []byte(`"period": "daily"`)) {
+		t.Fatalf("webhook received %q", body)
+	}
+}
+
+func TestLogQuery(t *testing.T) {
+	now := time.Now()
+	dir := t.TempDir()
+	line := func(ago time.Duration, level, category, message string) string {
+		return fmt.Sprintf("[%s] [%s] [%s] %s\n", now.Add(-ago).Format(logTimestampLayout), level, category, message)
+	}
+	yesterday := now.AddDate(0, 0, -1)
+	rotated := line(30*time.Hour, "SECURITY", "BLOCKED", "IP: 1.2.3.4 - Reason: RATE_LIMIT")
+	current := line(2*time.Hour, "SECURITY", "BLOCKED", "[req=abc] IP: 1.2.3.4 - Reason: RATE_LIMIT") +
+		line(90*time.Minute, "SECURITY", "BLOCKED", "IP: 1.2.3.9 - Reason: BLOCKED_IP - Details: [1.2.3.9 matched blocked_ips]") +
+		line(time.Hour, "SECURITY", "BLOCKED", "IP: 198.51.100.1 - Reason: RATE_LIMIT") +
+		line(time.Hour, "INFO", "CONNECTION", "IP: 1.2.3.5:40001 - Verdict: BLOCKED (COUNTRY_DENIED) - Requests: 0") +
+		line(time.Minute, "INFO", "CONNECTION", "IP: 1.2.3.5:40002 - Verdict: ALLOWED - Requests: 1")
+	if err := os.WriteFile(filepath.Join(dir, "firewall-"+yesterday.Format("2006-01-02")+".log"), []byte(rotated), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "firewall.log"), []byte(current), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run := func(text string) queryResult {
+		t.Helper()
+		query, err := parseLogQuery(text, now)
+		if err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+		result, err := runLogQuery(query, queryLogFiles(dir, query.Since))
+		if err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+		return result
+	}
+
+	result := run("count blocks by reason where ip in 1.2.3.0/24 since 24h")
+	if len(result.Groups) != 2 || result.Groups[0].Count != 1 || result.Count != 2 {
+		t.Fatalf("blocks by reason in 1.2.3.0/24: %+v", result)
+	}
+	if result := run("count blocks where reason = rate_limit"); result.Count != 3 {
+		t.Fatalf("all-time RATE_LIMIT blocks: %d, want 3", result.Count)
+	}
+	result = run("count connections by verdict, reason where ip in (1.2.3.5, 2001:db8::/32)")
+	if len(result.Groups) != 2 || result.Groups[0].Values["verdict"] != "ALLOWED" || result.Groups[1].Values["reason"] != "COUNTRY_DENIED" {
+		t.Fatalf("connections by verdict and reason: %+v", result.Groups)
+	}
+	if result := run(`list security where message ~ "matched blocked_ips" since 1d limit 5`); len(result.Lines) != 1 || !strings.Contains(result.Lines[0], "1.2.3.9") {
+		t.Fatalf("list: %+v", result.Lines)
+	}
+
+	for _, invalid := range []string{"select *", "count by nothing", "count where ip in 1.2.3", "list by ip", "count since yesterday"} {
+		if _, err := parseLogQuery(invalid, now); err == nil {
+			t.Errorf("%q parsed", invalid)
+		}
+	}
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	RegisterMiddleware(Middleware{
+		Name:  "test_teapot",
+		Stage: StageAccept,
+		Handle: func(fw *Firewall, ms *MiddlewareState) bool {
+			if ms.IP != "198.51.100.9" {
+				return true
+			}
+			ms.Block("TEAPOT", "test middleware")
+			fw.rejectBlocked(ms.Conn, ms.ConnID, http.StatusTeapot, "I'm a teapot.", 0)
+			return false
+		},
+	})
+	RegisterMiddleware(Middleware{
+		Name:            "test_private_path",
+		Stage:           StageRequest,
+		SkipWhitelisted: true,
+		Handle: func(fw *Firewall, ms *MiddlewareState) bool {
+			if ms.Head.Path() != "/private" {
+				return true
+			}
+			ms.Block("PRIVATE_PATH", "test middleware")
+			fw.writeHTTPError(ms.Conn, ms.ConnID, http.StatusNotFound, "Not found.", 0)
+			return false
+		},
+	})
+
+	rules := Rules{BlockedIPs: ruleEntries("198.51.100.9")}
+	h := newTestHarness(t, rules)
+	if status, _ := h.Get(testClientIP, "/private"); status != http.StatusNotFound {
+		t.Fatalf("registered request middleware: got %d, want 404", status)
+	}
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("path the middleware passes: got %d, want 200", status)
+	}
+	// Registered middleware run after the built-in ones of their stage.
+	if status, _ := h.Get("198.51.100.9", "/"); status != http.StatusForbidden {
+		t.Fatalf("blocked IP with the default order: got %d, want 403", status)
+	}
+
+	rules.Middleware = MiddlewareConfig{Order: []string{"test_teapot"}}
+	h.SetRules(rules)
+	if status, _ := h.Get("198.51.100.9", "/"); status != http.StatusTeapot {
+		t.Fatalf("blocked IP with test_teapot first: got %d, want 418", status)
+	}
+
+	rules.Middleware = MiddlewareConfig{Disabled: []string{"test_private_path", "blocklist", "test_teapot"}}
+	h.SetRules(rules)
+	for _, ip := range []string{testClientIP, "198.51.100.9"} {
+		if status, _ := h.Get(ip, "/private"); status != http.StatusOK {
+			t.Fatalf("%s with its middleware disabled: got %d, want 200", ip, status)
+		}
+	}
+
+	issues := validateRules(&Rules{Middleware: MiddlewareConfig{Order: []string{"waf"}}})
+	if len(issues) != 1 || issues[0].Field != "middleware" {
+		t.Fatalf("unknown middleware issues: %+v", issues)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	h := newTestHarness(t, Rules{
+		Whitelist: ruleEntries("192.0.2.1"),
+		Policies: []Policy{
+			{Name: "sanctioned", When: `ip in ["198.51.100.0/24", "unused"]`, Status: http.StatusUnavailableForLegalReasons, Message: "Not available."},
+			{Name: "audit", When: `path == "/audit"`, Action: "log"},
+			{Name: "admin-tools", When: `path startswith "/admin" and (header("User-Agent") matches "(?i)curl|wget" or method != "GET")`},
+		},
+	})
+
+	if status, body := h.Get("198.51.100.9", "/"); status != http.StatusUnavailableForLegalReasons || !strings.Contains(body, "Not available.") {
+		t.Fatalf("accept policy: got %d %q, want 451", status, body)
+	}
+	curl := http.Header{"User-Agent": {"curl/8.4.0"}}
+	if status, _, _ := h.Request(testClientIP, "chat.example", "/admin/users", curl); status != http.StatusForbidden {
+		t.Fatalf("request policy: got %d, want 403", status)
+	}
+	for _, path := range []string{"/admin/users", "/audit", "/"} {
+		if status, _ := h.Get(testClientIP, path); status != http.StatusOK {
+			t.Fatalf("%s without a matching policy: got %d, want 200", path, status)
+		}
+	}
+	if status, _, _ := h.Request("192.0.2.1", "chat.example", "/admin/users", curl); status != http.StatusOK {
+		t.Fatalf("whitelisted client: got %d, want 200", status)
+	}
+
+	if compiled, _ := compilePolicies(normalizePolicies([]Policy{{When: `asn == 64500 or exempt`}, {When: "port > 1024"}})); compiled[0].Stage != StageAccept || compiled[1].Stage != StageRequest {
+		t.Fatalf("policy stages: %v, %v", compiled[0].Stage, compiled[1].Stage)
+	}
+	issues := validateRules(&Rules{Policies: []Policy{{When: "referer == 'x'"}, {When: `path matches "("`}, {When: `ip in [`}, {When: ""}}})
+	if len(issues) != 4 {
+		t.Fatalf("policy issues: %+v", issues)
+	}
+}
+
+// testWasmSection encodes a module section; vectors and sizes are LEB128,
+// which is what binary.AppendUvarint writes.
+func testWasmSection(id byte, items ...[]byte) []byte {
+	content := binary.AppendUvarint(nil, uint64(len(items)))
+	for _, item := range items {
+		content = append(content, item...)
+	}
+	return append(binary.AppendUvarint([]byte{id}, uint64(len(content))), content...)
+}
+
+func testWasmName(name string) []byte {
+	return append(binary.AppendUvarint(nil, uint64(len(name))), name...)
+}
+
+func testWasmBody(locals, code []byte) []byte {
+	body := append(locals, code...)
+	return append(binary.AppendUvarint(nil, uint64(len(body))), body...)
+}
+
+func TestWasmFilters(t *testing.T) {
+	// on_request blocks paths containing "!", looping over the path it reads
+	// with get_property.
+	bangFilter := []byte("\x00asm\x01\x00\x00\x00")
+	bangFilter = append(bangFilter, testWasmSection(1,
+		[]byte{0x60, 4, 0x7f, 0x7f, 0x7f, 0x7f, 1, 0x7f},
+		[]byte{0x60, 2, 0x7f, 0x7f, 0},
+		[]byte{0x60, 0, 1, 0x7f})...)
+	bangFilter = append(bangFilter, testWasmSection(2,
+		append(append(testWasmName("env"), testWasmName("get_property")...), 0, 0),
+		append(append(testWasmName("env"), testWasmName("set_reason")...), 0, 1))...)
+	bangFilter = append(bangFilter, testWasmSection(3, []byte{2})...)
+	bangFilter = append(bangFilter, testWasmSection(5, []byte{0, 1})...)
+	bangFilter = append(bangFilter, testWasmSection(7, append(testWasmName("on_request"), 0, 2))...)
+	bangFilter = append(bangFilter, testWasmSection(10, testWasmBody([]byte{1, 2, 0x7f}, []byte{
+		0x41, 0, 0x41, 4, 0x41, 0xc0, 0, 0x41, 0x80, 2, 0x10, 0, 0x21, 0, // len = get_property("path", 64, 256)
+		0x02, 0x40, 0x03, 0x40,
+		0x20, 1, 0x20, 0, 0x4e, 0x0d, 1, // i >= len: done
+		0x20, 1, 0x2d, 0, 0x40, 0x41, '!', 0x46, // memory[64+i] == '!'
+		0x04, 0x40, 0x41, 16, 0x41, 12, 0x10, 1, 0x41, 1, 0x0f, 0x0b,
+		0x20, 1, 0x41, 1, 0x6a, 0x21, 1, 0x0c, 0,
+		0x0b, 0x0b,
+		0x41, 0, 0x0b,
+	}))...)
+	bangFilter = append(bangFilter, testWasmSection(11,
+		append([]byte{0, 0x41, 0, 0x0b}, testWasmName("path")...),
+		append([]byte{0, 0x41, 16, 0x0b}, testWasmName("bang in path")...))...)
+
+	// on_request never returns.
+	spinFilter := []byte("\x00asm\x01\x00\x00\x00")
+	spinFilter = append(spinFilter, testWasmSection(1, []byte{0x60, 0, 1, 0x7f})...)
+	spinFilter = append(spinFilter, testWasmSection(3, []byte{0})...)
+	spinFilter = append(spinFilter, testWasmSection(7, append(testWasmName("on_request"), 0, 0))...)
+	spinFilter = append(spinFilter, testWasmSection(10, testWasmBody([]byte{0}, []byte{0x03, 0x40, 0x0c, 0, 0x0b, 0x41, 0, 0x0b}))...)
+
+	dir := t.TempDir()
+	bangPath, spinPath := filepath.Join(dir, "bang.wasm"), filepath.Join(dir, "spin.wasm")
+	os.WriteFile(bangPath, bangFilter, 0644)
+	os.WriteFile(spinPath, spinFilter, 0644)
+
+	h := newTestHarness(t, Rules{WasmFilters: []WasmFilter{{Path: bangPath}}})
+	h.fw.refreshWasmFilters()
+	if status, _ := h.Get(testClientIP, "/hello!"); status != http.StatusForbidden {
+		t.Fatalf("path the filter blocks: got %d, want 403", status)
+	}
+	if status, _ := h.Get(testClientIP, "/hello"); status != http.StatusOK {
+		t.Fatalf("path the filter passes: got %d, want 200", status)
+	}
+
+	// A filter that runs out of fuel fails open unless told otherwise.
+	h.SetRules(Rules{WasmFilters: []WasmFilter{{Path: spinPath, Fuel: 10000}}})
+	h.fw.refreshWasmFilters()
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("failing filter: got %d, want 200", status)
+	}
+	h.SetRules(Rules{WasmFilters: []WasmFilter{{Path: spinPath, Fuel: 10000, FailClosed: true}}})
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusForbidden {
+		t.Fatalf("failing filter with fail_closed: got %d, want 403", status)
+	}
+	if h.fw.wasmFilters.get(bangPath) != nil {
+		t.Fatal("a filter no longer configured stayed loaded")
+	}
+
+	for _, truncated := range [][]byte{nil, []byte("\x00as"), []byte("\x00asm"), []byte("\x00asm\x01\x00"), bangFilter[:len(bangFilter)-5]} {
+		if _, err := decodeWasmModule(truncated); err == nil {
+			t.Fatalf("truncated module %q decoded", truncated)
+		}
+	}
+	module, _ := decodeWasmModule(bangFilter)
+	module.imports[1].name = "exec"
+	if err := checkWasmFilterModule(module); err == nil {
+		t.Fatal("module importing env.exec accepted")
+	}
+}
+
+func TestExtAuthz(t *testing.T) {
+	var asked []ExtAuthzRequest
+	var mutex sync.Mutex
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ExtAuthzRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("decoding authorization request: %v", err)
+		}
+		mutex.Lock()
+		asked = append(asked, request)
+		mutex.Unlock()
+		switch request.Path {
+		case "/denied":
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, "no session")
+		case "/slow":
+			time.Sleep(300 * time.Millisecond)
+		default:
+			w.Header().Set("X-User-Id", "alice")
+			w.Header().Add("X-Roles", "admin")
+			w.Header().Add("X-Roles", "staff")
+		}
+	}))
+	defer service.Close()
+
+	h := newTestHarness(t, Rules{
+		MaxAttemptsPerMinute: 100,
+		Whitelist:            ruleEntries("198.51.100.7"),
+		ExtAuthz: ExtAuthzConfig{
+			Enabled:             true,
+			URL:                 service.URL,
+			TimeoutMilliseconds: 100,
+			UpstreamHeaders:     []string{"x-user-id", "x-roles"},
+		},
+	})
+	spoofed := http.Header{"X-User-Id": {"mallory"}, "X-Roles": {"root"}, "X-Trace": {"abc"}}
+	lastUpstream := func() *http.Request {
+		requests := h.upstreamRequests()
+		return requests[len(requests)-1]
+	}
+
+	status, _, _ := h.Request(testClientIP, "chat.example", "/allowed", spoofed)
+	if status != http.StatusOK {
+		t.Fatalf("allowed request got %d", status)
+	}
+	if got := lastUpstream().Header; got.Get("X-User-Id") != "alice" || strings.Join(got.Values("X-Roles"), ",") != "admin,staff" {
+		t.Errorf("upstream identity %q with roles %q, want all of the service's", got.Get("X-User-Id"), got.Values("X-Roles"))
+	}
+
+	// Requests the service is never asked about still lose the headers only
+	// it may set.
+	for _, client := range []string{testClientIP, "198.51.100.7"} {
+		if status, _, _ := h.Request(client, "chat.example", "/slow", spoofed); status != http.StatusOK {
+			t.Fatalf("request from %s got %d", client, status)
+		}
+		if got := lastUpstream().Header; got.Get("X-User-Id") != "" || got.Get("X-Roles") != "" {
+			t.Errorf("request from %s, not authorized by the service, reached upstream as %q with roles %q", client, got.Get("X-User-Id"), got.Values("X-Roles"))
+		}
+	}
+	rules := h.fw.rules
+	rules.ExtAuthz.Paths = []string{"/api"}
+	h.SetRules(*rules)
+	if status, _, _ := h.Request(testClientIP, "chat.example", "/outside", spoofed); status != http.StatusOK {
+		t.Fatalf("request outside the checked paths got %d", status)
+	}
+	if got := lastUpstream().Header.Get("X-User-Id"); got != "" {
+		t.Errorf("request outside the checked paths reached upstream as %q", got)
+	}
+	rules.ExtAuthz.Paths = nil
+	h.SetRules(*rules)
+	mutex.Lock()
+	request := asked[len(asked)-1]
+	mutex.Unlock()
+	if request.IP != testClientIP || request.Method != http.MethodGet || request.Headers["X-Trace"] != "abc" {
+		t.Errorf("service was asked %+v", request)
+	}
+
+	if status, _ := h.Get(testClientIP, "/denied"); status != http.StatusUnauthorized {
+		t.Errorf("denied request got %d, want the service's 401", status)
+	}
+
+	rules.ExtAuthz.FailureMode = ExtAuthzFailureClosed
+	h.SetRules(*rules)
+	if status, _ := h.Get(testClientIP, "/slow"); status != http.StatusServiceUnavailable {
+		t.Errorf("request failing closed got %d", status)
+	}
+
+	issues := validateRules(&Rules{ExtAuthz: ExtAuthzConfig{Enabled: true, URL: "ftp://auth"}})
+	if len(issues) != 1 || issues[0].Field != "ext_authz.url" {
+		t.Errorf("bad URL issues: %+v", issues)
+	}
+}
+
+func TestRegoPolicies(t *testing.T) {
+	opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/data/firewall/decision" {
+			http.NotFound(w, r)
+			return
+		}
+		var query struct {
+			Input RegoInput `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+			t.Errorf("decoding OPA query: %v", err)
+		}
+		input := query.Input
+		switch {
+		case input.Path == "/admin":
+			fmt.Fprint(w, `{"result": false}`)
+		case input.Path == "/teapot":
+			fmt.Fprint(w, `{"result": {"action": "block", "reason": "short and stout", "status": 418}}`)
+		case input.Path == "/undefined":
+			fmt.Fprint(w, `{}`)
+		case input.IP != testClientIP || input.Headers["X-Trace"] != "abc" || input.Counters.AttemptsLastMinute == 0:
+			fmt.Fprintf(w, `{"result": {"allow": false, "reason": "unexpected input %+v"}}`, input)
+		default:
+			fmt.Fprint(w, `{"result": {"allow": true}}`)
+		}
+	}))
+	defer opa.Close()
+
+	h := newTestHarness(t, Rules{Rego: RegoConfig{Enabled: true, URL: opa.URL, Decision: "firewall.decision"}})
+
+	if status, body, _ := h.Request(testClientIP, "chat.example", "/", http.Header{"X-Trace": {"abc"}}); status != http.StatusOK {
+		t.Fatalf("allowed request got %d: %s", status, body)
+	}
+	if status, _ := h.Get(testClientIP, "/admin"); status != http.StatusForbidden {
+		t.Errorf("request denied by a boolean decision got %d", status)
+	}
+	if status, _ := h.Get(testClientIP, "/teapot"); status != http.StatusTeapot {
+		t.Errorf("request denied with a status got %d", status)
+	}
+	if status, _ := h.Get(testClientIP, "/undefined"); status != http.StatusOK {
+		t.Errorf("undefined decision failing open got %d", status)
+	}
+
+	rules := h.fw.rules
+	rules.Rego.FailureMode = ExtAuthzFailureClosed
+	h.SetRules(*rules)
+	if status, _ := h.Get(testClientIP, "/undefined"); status != http.StatusForbidden {
+		t.Errorf("undefined decision failing closed got %d", status)
+	}
+
+	issues := validateRules(&Rules{Rego: RegoConfig{Enabled: true}})
+	if len(issues) != 1 || issues[0].Field != "rego" {
+		t.Errorf("missing OPA URL issues: %+v", issues)
+	}
+
+	// With policy files, the firewall evaluates them itself.
+	path := filepath.Join(t.TempDir(), "firewall.rego")
+	policy := `package firewall
+
+import rego.v1
+
+default decision := {"allow": true}
+
+decision := {"action": "block", "reason": reason, "status": 418} if {
+	some reason in deny
+}
+
+deny contains "admin" if startswith(input.path, "/admin")
+
+deny contains sprintf("busy %s", [input.ip]) if {
+	input.headers["X-Trace"] == "busy"
+	input.counters.attempts_last_minute > 0
+}
+`
+	if err := os.WriteFile(path, []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opa.Close()
+	rules.Rego = RegoConfig{Enabled: true, Policies: []string{path}, FailureMode: ExtAuthzFailureClosed}
+	h.SetRules(*rules)
+	h.fw.refreshRegoPolicies()
+	h.clock.Advance(time.Minute)
+
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Errorf("request allowed by the default decision got %d", status)
+	}
+	if status, _ := h.Get(testClientIP, "/admin"); status != http.StatusTeapot {
+		t.Errorf("request denied by an embedded policy got %d", status)
+	}
+	if status, _, _ := h.Request(testClientIP, "chat.example", "/", http.Header{"X-Trace": {"busy"}}); status != http.StatusTeapot {
+		t.Errorf("request denied on its headers and counters got %d", status)
+	}
+
+	// A policy that stops compiling keeps the previous one.
+	if err := os.WriteFile(path, []byte("package firewall\ndecision := {"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	h.fw.refreshRegoPolicies()
+	if status, _ := h.Get(testClientIP, "/admin"); status != http.StatusTeapot {
+		t.Errorf("request after a broken reload got %d", status)
+	}
+}
+
+func TestBodyInspection(t *testing.T) {
+	h := newTestHarness(t, Rules{
+		MaxAttemptsPerMinute: 100,
+		Whitelist:            ruleEntries("198.51.100.7"),
+		Policies:             []Policy{{Name: "no-script", When: `body contains "<script"`}},
+		BodyInspection: BodyInspection{
+			Enabled:              true,
+			Paths:                []string{"/api/"},
+			MaxBodyBytes:         1024,
+			MaxDecompressedBytes: 4096,
+			MaxExpansionRatio:    20,
+		},
+	})
+	h.BufferedUpstream()
+
+	compress := func(coding string, data []byte) []byte {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch coding {
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "zlib":
+			w = zlib.NewWriter(&buf)
+		default:
+			w, _ = flate.NewWriter(&buf, flate.BestCompression)
+		}
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	}
+	post := func(ip, path, header string, body []byte) int {
+		t.Helper()
+		conn, reader := h.KeepAlive(ip)
+		go func() {
+			fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: chat.example\r\nConnection: close\r\nContent-Length: %d\r\n%s\r\n", path, len(body), header)
+			conn.Write(body)
+		}()
+		status := h.ReadStatus(reader)
+		conn.Close()
+		h.fw.activeConns.Wait()
+		return status
+	}
+
+	// Repetitive enough that compressing it leaves no plain "<script".
+	script := []byte(`{"text": "` + strings.Repeat("hello ", 50) + `<script>alert(1)</script>"}`)
+	bomb := compress("gzip", make([]byte, 64<<10))
+	for _, tc := range []struct {
+		name   string
+		ip     string
+		path   string
+		header string
+		body   []byte
+		want   int
+	}{
+		{name: "clean body", path: "/api/messages", body: []byte(`{"text": "hello"}`), want: http.StatusOK},
+		{name: "plain match", path: "/api/messages", body: script, want: http.StatusForbidden},
+		{name: "gzip", path: "/api/messages", header: "Content-Encoding: gzip\r\n", body: compress("gzip", script), want: http.StatusForbidden},
+		{name: "gzip without Content-Encoding", path: "/api/messages", body: compress("gzip", script), want: http.StatusForbidden},
+		{name: "deflate", path: "/api/messages", header: "Content-Encoding: deflate\r\n", body: compress("zlib", script), want: http.StatusForbidden},
+		{name: "raw deflate", path: "/api/messages", header: "Content-Encoding: deflate\r\n", body: compress("flate", script), want: http.StatusForbidden},
+		{name: "clean gzip", path: "/api/messages", header: "Content-Encoding: gzip\r\n", body: compress("gzip", []byte("hello")), want: http.StatusOK},
+		{name: "path not inspected", path: "/upload", body: script, want: http.StatusOK},
+		{name: "whitelisted client", ip: "198.51.100.7", path: "/api/messages", body: script, want: http.StatusOK},
+		{name: "expansion past the ratio", path: "/api/messages", header: "Content-Encoding: gzip\r\n", body: bomb, want: http.StatusRequestEntityTooLarge},
+		{name: "body over the limit as sent", path: "/api/messages", body: bytes.Repeat([]byte("a"), 2048), want: http.StatusRequestEntityTooLarge},
+		{name: "unreadable encoding", path: "/api/messages", header: "Content-Encoding: br\r\n", body: []byte("abc"), want: http.StatusUnsupportedMediaType},
+		{name: "corrupt gzip", path: "/api/messages", header: "Content-Encoding: gzip\r\n", body: append(append([]byte(nil), gzipMagic...), "garbage"...), want: http.StatusBadRequest},
+	} {
+		ip := tc.ip
+		if ip == "" {
+			ip = testClientIP
+		}
+		if got := post(ip, tc.path, tc.header, tc.body); got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+	if got := len(h.upstreamRequests()); got != 4 {
+		t.Errorf("upstream saw %d requests, want the 4 let through", got)
+	}
+
+	// Within the ratio, the decompressed size limit still holds.
+	rules := h.fw.rules
+	rules.BodyInspection.MaxExpansionRatio = 1e6
+	h.SetRules(*rules)
+	if got := post(testClientIP, "/api/messages", "Content-Encoding: gzip\r\n", bomb); got != http.StatusRequestEntityTooLarge {
+		t.Errorf("body inflating past max_decompressed_bytes got %d", got)
+	}
+
+	// Chunked bodies are inspected whole, across chunks, and a refused
+	// follow-up request ends the connection after the earlier answer.
+	conn, reader := h.KeepAlive(testClientIP)
+	go fmt.Fprint(conn, "POST /api/messages HTTP/1.1\r\nHost: chat.example\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"5\r\nhello\r\n0\r\n\r\n"+
+		"POST /api/messages HTTP/1.1\r\nHost: chat.example\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"4\r\n<scr\r\n3\r\nipt\r\n0\r\n\r\n"+
+		"GET / HTTP/1.1\r\nHost: chat.example\r\n\r\n")
+	if status := h.ReadStatus(reader); status != http.StatusOK {
+		t.Errorf("clean chunked request got %d", status)
+	}
+	if status := h.ReadStatus(reader); status != http.StatusForbidden {
+		t.Errorf("chunked request with a match split across chunks got %d", status)
+	}
+	if status := h.ReadStatus(reader); status != 0 {
+		t.Errorf("request after a refused body got %d, want the connection closed", status)
+	}
+
+	issues := validateRules(&Rules{Policies: []Policy{{When: `body contains "x"`}}})
+	if len(issues) != 1 || issues[0].Field != "body_inspection" {
+		t.Errorf("body policy without inspection issues: %+v", issues)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	tenants := []Tenant{
+		{
+			Name:                 "Acme",
+			Hosts:                []string{"chat.acme.example", "*.acme.example"},
+			Upstreams:            []Upstream{{Host: "10.0.1.5", Port: 8080}},
+			BlockedIPs:           ruleEntries("198.51.100.0/24"),
+			MaxAttemptsPerMinute: 2,
+		},
+		{
+			Name:     "globex",
+			Hosts:    []string{"chat.globex.example"},
+			Policies: []Policy{{Name: "no-admin", When: `path startswith "/admin"`}},
+		},
+	}
+	h := newTestHarness(t, Rules{Tenants: tenants})
+
+	var dialed atomic.Value
+	dial := h.fw.dialUpstream
+	h.fw.dialUpstream = func(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+		dialed.Store(address)
+		return dial(ctx, address, timeout)
+	}
+
+	if status, _, _ := h.Request(testClientIP, "eu.acme.example", "/", nil); status != http.StatusOK {
+		t.Fatalf("acme request got %d", status)
+	}
+	if got := dialed.Load(); got != "10.0.1.5:8080" {
+		t.Errorf("acme routed to %v, want its own upstream", got)
+	}
+	if status, _, _ := h.Request("198.51.100.7", "chat.acme.example", "/", nil); status != http.StatusForbidden {
+		t.Errorf("client blocked by acme got %d", status)
+	}
+	if status, _, _ := h.Request("198.51.100.7", "chat.globex.example", "/", nil); status != http.StatusOK {
+		t.Errorf("client blocked by acme got %d from globex", status)
+	}
+	if status, _, _ := h.Request(testClientIP, "chat.acme.example", "/", nil); status != http.StatusOK {
+		t.Fatalf("second acme request got %d", status)
+	}
+	if status, _, _ := h.Request(testClientIP, "chat.acme.example", "/", nil); status != http.StatusTooManyRequests {
+		t.Errorf("third acme request in a minute got %d, want 429", status)
+	}
+	if status, _, _ := h.Request(testClientIP, "chat.globex.example", "/admin", nil); status != http.StatusForbidden {
+		t.Errorf("globex admin request got %d", status)
+	}
+	if status, _, _ := h.Request(testClientIP, "chat.acme.example", "/admin", nil); status == http.StatusForbidden {
+		t.Error("globex policy applied to acme")
+	}
+
+	stats := h.fw.tenantStats.Snapshot()
+	if stats["acme"].Connections != 5 || stats["acme"].Blocked != 3 || stats["globex"].Connections != 2 || stats["globex"].Blocked != 1 {
+		t.Errorf("tenant stats: %+v", stats)
+	}
+
+	issues := validateRules(&Rules{Tenants: []Tenant{{Name: "a", Hosts: []string{"x.example"}}, {Name: "b", Hosts: []string{"X.example"}}, {Hosts: []string{"y.example"}}}})
+	if len(issues) != 2 {
+		t.Errorf("tenant issues: %+v", issues)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	config := QuotaConfig{
+		Enabled: true,
+		Path:    path,
+		Limits: []QuotaLimit{
+			{Name: "ip_daily", Per: QuotaPerIP, Period: QuotaPeriodDay, MaxConnections: 2},
+			{Name: "key_weekly", Per: QuotaPerAPIKey, Period: QuotaPeriodWeek, MaxBytes: 1},
+		},
+	}
+	h := newTestHarness(t, Rules{MaxAttemptsPerMinute: 100, Quotas: config})
+
+	for i := 0; i < 2; i++ {
+		if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+			t.Fatalf("request %d within quota got %d", i+1, status)
+		}
+	}
+	status, _, header := h.Request(testClientIP, "chat.example", "/", nil)
+	if status != http.StatusTooManyRequests || header.Get("Retry-After") == "" {
+		t.Fatalf("request over the daily quota got %d, Retry-After %q", status, header.Get("Retry-After"))
+	}
+	if status, _ := h.Get("198.51.100.7", "/"); status != http.StatusOK {
+		t.Fatalf("another client got %d", status)
+	}
+
+	withKey := http.Header{"X-Api-Key": {"secret-key"}}
+	if status, _, _ := h.Request("198.51.100.8", "chat.example", "/", withKey); status != http.StatusOK {
+		t.Fatalf("first request with an API key got %d", status)
+	}
+	if status, _, _ := h.Request("198.51.100.12", "chat.example", "/", withKey); status != http.StatusTooManyRequests {
+		t.Fatalf("API key over its byte quota got %d from another IP", status)
+	}
+	for _, usage := range h.fw.quotas.Snapshot("", h.clock.Now()) {
+		if strings.Contains(usage.Subject, "secret") {
+			t.Fatalf("API key stored in the clear: %+v", usage)
+		}
+	}
+
+	if err := h.fw.quotas.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewQuotaTracker()
+	if n, err := restored.Load(path, h.clock.Now()); err != nil || n != 4 {
+		t.Fatalf("restored %d quota counters (%v), want 4", n, err)
+	}
+	if _, exceeded := restored.Exceeded(config.Limits[0], testClientIP, h.clock.Now()); !exceeded {
+		t.Error("restored counters forgot the exhausted quota")
+	}
+
+	h.Advance(24 * time.Hour)
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("request the next day got %d", status)
+	}
+
+	monday := time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)
+	for _, now := range []time.Time{monday, monday.Add(6*24*time.Hour + 23*time.Hour)} {
+		if end := quotaPeriodEnd(QuotaPeriodWeek, now); !end.Equal(monday.AddDate(0, 0, 7)) {
+			t.Errorf("week of %s ends %s", now, end)
+		}
+	}
+
+	issues := validateRules(&Rules{Quotas: QuotaConfig{Limits: []QuotaLimit{{Per: "tenant", MaxBytes: 1}, {}}}})
+	if len(issues) != 2 {
+		t.Errorf("quota issues: %+v", issues)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "api_keys.json")
+	h := newTestHarness(t, Rules{MaxAttemptsPerMinute: 1, APIKeys: APIKeyConfig{Enabled: true, File: file}})
+
+	recorder := httptest.NewRecorder()
+	h.fw.handleAPIKeys(recorder, httptest.NewRequest(http.MethodPost, "/api-keys?name=Helpdesk-Bot&max_attempts_per_minute=3", nil))
+	var created struct{ Name, Key string }
+	if err := json.NewDecoder(recorder.Body).Decode(&created); err != nil || recorder.Code != http.StatusCreated || created.Name != "helpdesk-bot" {
+		t.Fatalf("registering a client: %d %+v %v", recorder.Code, created, err)
+	}
+	if data, _ := os.ReadFile(file); bytes.Contains(data, []byte(created.Key)) || !bytes.Contains(data, []byte(hashAPIKey(created.Key))) {
+		t.Fatalf("keys file should hold the key's hash only: %s", data)
+	}
+	recorder = httptest.NewRecorder()
+	h.fw.handleAPIKeys(recorder, httptest.NewRequest(http.MethodPost, "/api-keys?name=helpdesk-bot", nil))
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("registering a client twice got %d", recorder.Code)
+	}
+
+	withKey := http.Header{"X-Api-Key": {created.Key}}
+	for i := 0; i < 3; i++ {
+		if status, _, _ := h.Request(testClientIP, "chat.example", "/", withKey); status != http.StatusOK {
+			t.Fatalf("API client request %d got %d", i+1, status)
+		}
+	}
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusTooManyRequests {
+		t.Errorf("anonymous request over the per-IP limit got %d", status)
+	}
+	if status, _, _ := h.Request("198.51.100.7", "chat.example", "/", withKey); status != http.StatusTooManyRequests {
+		t.Errorf("API client over its own limit from another IP got %d", status)
+	}
+	if stats := h.fw.apiClientStats.Snapshot()["helpdesk-bot"]; stats.Connections != 4 || stats.Blocked != 1 {
+		t.Errorf("API client stats: %+v", stats)
+	}
+
+	if status, _, _ := h.Request("198.51.100.8", "chat.example", "/", http.Header{"X-Api-Key": {"dck_guess"}}); status != http.StatusOK {
+		t.Errorf("unrecognized key got %d, want it treated as anonymous", status)
+	}
+	rules := h.fw.rules
+	rules.APIKeys.RejectInvalid = true
+	h.SetRules(*rules)
+	if status, _, _ := h.Request("198.51.100.8", "chat.example", "/", http.Header{"X-Api-Key": {"dck_guess"}}); status != http.StatusUnauthorized {
+		t.Errorf("unrecognized key with reject_invalid got %d", status)
+	}
+
+	recorder = httptest.NewRecorder()
+	h.fw.handleAPIKeys(recorder, httptest.NewRequest(http.MethodDelete, "/api-keys?name=helpdesk-bot", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("revoking the client got %d", recorder.Code)
+	}
+	if _, found := h.fw.apiKeys.Lookup(created.Key); found {
+		t.Error("revoked key still recognized")
+	}
+}
+
+func TestAdminReplayProtection(t *testing.T) {
+	h := newTestHarness(t, Rules{APIKeys: APIKeyConfig{Enabled: true, File: filepath.Join(t.TempDir(), "api_keys.json")}})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api-keys", h.fw.handleAPIKeys)
+	server := httptest.NewServer(adminAuth{token: "secret"}.Wrap(newAdminSigner("signing-key", time.Minute, h.fw.clock.Now).Wrap(mux)))
+	defer server.Close()
+
+	send := func(req *http.Request) int {
+		t.Helper()
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	signed := func(method, path, key string, at time.Time) *http.Request {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		if err := signAdminRequest(req, key, nil, at); err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	read, _ := http.NewRequest(http.MethodGet, server.URL+"/api-keys", nil)
+	if status := send(read); status != http.StatusOK {
+		t.Fatalf("unsigned read got %d", status)
+	}
+	unsigned, _ := http.NewRequest(http.MethodPost, server.URL+"/api-keys?name=bot-a", nil)
+	if status := send(unsigned); status != http.StatusUnauthorized {
+		t.Errorf("unsigned mutation got %d", status)
+	}
+
+	req := signed(http.MethodPost, "/api-keys?name=bot-a", "signing-key", h.fw.clock.Now())
+	if status := send(req); status != http.StatusCreated {
+		t.Fatalf("signed mutation got %d", status)
+	}
+	replay, _ := http.NewRequest(http.MethodPost, server.URL+"/api-keys?name=bot-a", nil)
+	replay.Header = req.Header.Clone()
+	if status := send(replay); status != http.StatusUnauthorized {
+		t.Errorf("replayed mutation got %d", status)
+	}
+	tampered, _ := http.NewRequest(http.MethodDelete, server.URL+"/api-keys?name=bot-a", nil)
+	tampered.Header = req.Header.Clone()
+	tampered.Header.Set(AdminNonceHeader, "fresh")
+	if status := send(tampered); status != http.StatusUnauthorized {
+		t.Errorf("mutation signed for another request got %d", status)
+	}
+	if status := send(signed(http.MethodDelete, "/api-keys?name=bot-a", "other-key", h.fw.clock.Now())); status != http.StatusUnauthorized {
+		t.Errorf("mutation signed with the wrong key got %d", status)
+	}
+
+	stale := signed(http.MethodDelete, "/api-keys?name=bot-a", "signing-key", h.fw.clock.Now())
+	h.Advance(2 * time.Minute)
+	if status := send(stale); status != http.StatusUnauthorized {
+		t.Errorf("mutation held past the replay window got %d", status)
+	}
+	if status := send(signed(http.MethodDelete, "/api-keys?name=bot-a", "signing-key", h.fw.clock.Now())); status != http.StatusOK {
+		t.Errorf("fresh signed mutation got %d", status)
+	}
+}
+
+func TestAdminRoles(t *testing.T) {
+	signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// While stalling is set, a JWKS fetch reports itself on fetching and
+	// waits for stall to close.
+	var stalling atomic.Bool
+	fetching, stall := make(chan struct{}, 1), make(chan struct{})
+	provider := httptest.NewServer(nil)
+	defer provider.Close()
+	provider.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			writeJSON(w, http.StatusOK, map[string]string{"jwks_uri": provider.URL + "/keys"})
+		case "/keys":
+			if stalling.Load() {
+				fetching <- struct{}{}
+				select {
+				case <-stall:
+				case <-r.Context().Done():
+					return
+				}
+			}
+			e := big.NewInt(int64(signingKey.E)).Bytes()
+			writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+				"kid": "k1", "kty": "RSA",
+				"n": base64.RawURLEncoding.EncodeToString(signingKey.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(e),
+			}}})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	sign := func(kid string, claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signed))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, signingKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+	issue := func(claims map[string]interface{}) string {
+		return sign("k1", claims)
+	}
+	clock := newFakeClock()
+	expires := clock.Now().Add(time.Hour).Unix()
+
+	auth := adminAuth{
+		token:          "admin-secret",
+		operatorTokens: []string{"ops-1", "ops-2"},
+		viewerTokens:   []string{"dashboard"},
+		oidc:           newOIDCVerifier(provider.URL, "firewall-admin", "", "realm_access.roles"),
+		now:            clock.Now,
+	}
+	server := httptest.NewServer(auth.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+	defer server.Close()
+
+	// Well short of the verifier's own timeout for fetching keys.
+	client := &http.Client{Timeout: 2 * time.Second}
+	call := func(token, method, path string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	oidcViewer := issue(map[string]interface{}{"iss": provider.URL, "aud": []string{"firewall-admin"}, "exp": expires, "realm_access": map[string]interface{}{"roles": []string{"offline_access", "viewer"}}})
+	oidcOperator := issue(map[string]interface{}{"iss": provider.URL, "aud": "firewall-admin", "exp": expires, "realm_access": map[string]interface{}{"roles": []string{"operator"}}})
+	for _, tc := range []struct {
+		name, token, method, path string
+		want                      int
+	}{
+		{"viewer reads", "dashboard", http.MethodGet, "/stats", http.StatusNoContent},
+		{"viewer simulates", "dashboard", http.MethodPost, "/simulate", http.StatusNoContent},
+		{"viewer kills a connection", "dashboard", http.MethodPost, "/connections/kill", http.StatusForbidden},
+		{"operator kills a connection", "ops-2", http.MethodPost, "/connections/kill", http.StatusNoContent},
+		{"operator imports a blocklist", "ops-1", http.MethodPost, "/blocklist", http.StatusForbidden},
+		{"operator rolls back the rules", "ops-1", http.MethodPost, "/rules/rollback", http.StatusForbidden},
+		{"operator grants an appeal", "ops-1", http.MethodPost, "/appeals", http.StatusForbidden},
+		{"admin grants an appeal", "admin-secret", http.MethodPost, "/appeals", http.StatusNoContent},
+		{"admin imports a blocklist", "admin-secret", http.MethodPost, "/blocklist", http.StatusNoContent},
+		{"OIDC viewer reads", oidcViewer, http.MethodGet, "/connections", http.StatusNoContent},
+		{"OIDC viewer refreshes lists", oidcViewer, http.MethodPost, "/ip-lists", http.StatusForbidden},
+		{"OIDC operator refreshes lists", oidcOperator, http.MethodPost, "/ip-lists", http.StatusNoContent},
+		{"OIDC operator revokes an API key", oidcOperator, http.MethodDelete, "/api-keys", http.StatusForbidden},
+		{"OIDC token without a role", issue(map[string]interface{}{"iss": provider.URL, "aud": "firewall-admin", "exp": expires}), http.MethodGet, "/stats", http.StatusUnauthorized},
+		{"OIDC token for another audience", issue(map[string]interface{}{"iss": provider.URL, "aud": "chat", "exp": expires, "realm_access": map[string]interface{}{"roles": "admin"}}), http.MethodGet, "/stats", http.StatusUnauthorized},
+		{"expired OIDC token", issue(map[string]interface{}{"iss": provider.URL, "aud": "firewall-admin", "exp": clock.Now().Add(-time.Hour).Unix(), "realm_access": map[string]interface{}{"roles": "admin"}}), http.MethodGet, "/stats", http.StatusUnauthorized},
+		{"tampered OIDC token", oidcViewer[:strings.LastIndex(oidcViewer, ".")] + ".AAAA", http.MethodGet, "/stats", http.StatusUnauthorized},
+		{"unknown token", "guess", http.MethodGet, "/stats", http.StatusUnauthorized},
+	} {
+		if status := call(tc.token, tc.method, tc.path); status != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, status, tc.want)
+		}
+	}
+
+	clock.Advance(2 * time.Hour)
+	if status := call(oidcViewer, http.MethodGet, "/stats"); status != http.StatusUnauthorized {
+		t.Errorf("OIDC token past its expiry got %d", status)
+	}
+
+	// A token signed by an unknown key sends for the provider's keys; tokens
+	// signed by known ones are verified while the fetch is under way.
+	claims := map[string]interface{}{"iss": provider.URL, "aud": "firewall-admin", "exp": clock.Now().Add(time.Hour).Unix(), "realm_access": map[string]interface{}{"roles": "viewer"}}
+	stalling.Store(true)
+	rotated := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/stats", nil)
+		req.Header.Set("Authorization", "Bearer "+sign("k2", claims))
+		resp, err := client.Do(req)
+		if err != nil {
+			rotated <- 0
+			return
+		}
+		resp.Body.Close()
+		rotated <- resp.StatusCode
+	}()
+	<-fetching
+	if status := call(issue(claims), http.MethodGet, "/stats"); status != http.StatusNoContent {
+		t.Errorf("token signed by a known key got %d during a key fetch", status)
+	}
+	close(stall)
+	if status := <-rotated; status != http.StatusUnauthorized {
+		t.Errorf("token signed by a key the provider doesn't have got %d", status)
+	}
+}
+
+func TestKeepAliveRequestsMeetEndpointLimits(t *testing.T) {
+	h := newTestHarness(t, Rules{EndpointRateLimits: []EndpointRateLimit{{PathPrefix: "/api/login", MaxAttemptsPerMinute: 1}}})
+	h.BufferedUpstream()
+	login := "POST /api/login HTTP/1.1\r\nHost: chat.example\r\nContent-Length: 0\r\n\r\n"
+	countLogins := func() int {
+		logins := 0
+		for _, r := range h.upstreamRequests() {
+			if r.URL.Path == "/api/login" {
+				logins++
+			}
+		}
+		return logins
+	}
+
+	conn, reader := h.KeepAlive(testClientIP)
+	go io.WriteString(conn, "GET / HTTP/1.1\r\nHost: chat.example\r\n\r\n"+login+login+login)
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized, http.StatusTooManyRequests, 0} {
+		if status := h.ReadStatus(reader); status != want {
+			t.Fatalf("pipelined response %d: got %d, want %d", i+1, status, want)
+		}
+	}
+	h.fw.activeConns.Wait()
+	if logins := countLogins(); logins != 1 {
+		t.Fatalf("upstream saw %d pipelined logins over the limit of 1", logins)
+	}
+
+	h.Advance(2 * time.Minute)
+	conn, reader = h.KeepAlive(testClientIP)
+	io.WriteString(conn, login)
+	if status := h.ReadStatus(reader); status != http.StatusUnauthorized {
+		t.Fatalf("first login got %d", status)
+	}
+	io.WriteString(conn, login)
+	if status := h.ReadStatus(reader); status != http.StatusTooManyRequests {
+		t.Fatalf("second login on the same connection got %d, want 429", status)
+	}
+	if status := h.ReadStatus(reader); status != 0 {
+		t.Fatalf("connection still open after a refused request")
+	}
+	h.fw.activeConns.Wait()
+	if logins := countLogins(); logins != 2 {
+		t.Fatalf("upstream saw %d logins, want 2", logins)
+	}
+}
+
+func TestKeepAliveRequestsMeetHostValidation(t *testing.T) {
+	h := newTestHarness(t, Rules{AllowedHosts: []string{"chat.example"}})
+	h.BufferedUpstream()
+
+	conn, reader := h.KeepAlive(testClientIP)
+	go io.WriteString(conn, "GET / HTTP/1.1\r\nHost: chat.example\r\n\r\n"+
+		"GET /a HTTP/1.1\r\nHost: chat.example\r\nX-Forwarded-Host: evil.example\r\n\r\n"+
+		"GET /b HTTP/1.1\r\nHost: chat.example\r\n\r\n")
+	for i, want := range []int{http.StatusOK, http.StatusForbidden, 0} {
+		if status := h.ReadStatus(reader); status != want {
+			t.Fatalf("pipelined response %d: got %d, want %d", i+1, status, want)
+		}
+	}
+
+	conn, reader = h.KeepAlive(testClientIP)
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: chat.example\r\n\r\n")
+	if status := h.ReadStatus(reader); status != http.StatusOK {
+		t.Fatalf("first request got %d", status)
+	}
+	io.WriteString(conn, "GET /c HTTP/1.1\r\nHost: evil.example\r\n\r\n")
+	if status := h.ReadStatus(reader); status != http.StatusMisdirectedRequest {
+		t.Fatalf("spoofed Host on the same connection got %d, want 421", status)
+	}
+	h.fw.activeConns.Wait()
+	for _, r := range h.upstreamRequests() {
+		if r.URL.Path != "/" {
+			t.Errorf("upstream saw %s after a refused Host", r.URL.Path)
+		}
+	}
+}
+
+func TestKeepAliveRequestsAfterUpgradeRequest(t *testing.T) {
+	h := newTestHarness(t, Rules{AllowedHosts: []string{"chat.example"}})
+	h.BufferedUpstream()
+
+	// An upgrade the upstream doesn't take leaves the connection HTTP, and
+	// what follows is checked like any other request.
+	conn, reader := h.KeepAlive(testClientIP)
+	go io.WriteString(conn, "GET / HTTP/1.1\r\nHost: chat.example\r\nUpgrade: nope\r\n\r\n"+
+		"GET /c HTTP/1.1\r\nHost: evil.example\r\n\r\n")
+	for i, want := range []int{http.StatusOK, http.StatusMisdirectedRequest, 0} {
+		if status := h.ReadStatus(reader); status != want {
+			t.Fatalf("pipelined response %d: got %d, want %d", i+1, status, want)
+		}
+	}
+	h.fw.activeConns.Wait()
+	for _, r := range h.upstreamRequests() {
+		if r.URL.Path != "/" {
+			t.Errorf("upstream saw %s after an upgrade it refused", r.URL.Path)
+		}
+	}
+
+	// Once the upstream switches protocols, the bytes are no longer HTTP.
+	conn, reader = h.KeepAlive(testClientIP)
+	io.WriteString(conn, "GET /echo HTTP/1.1\r\nHost: chat.example\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	if status := h.ReadStatus(reader); status != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade got %d, want 101", status)
+	}
+	frame := "GET /c HTTP/1.1\r\nHost: evil.example\r\n\r\n"
+	io.WriteString(conn, frame)
+	echoed := make([]byte, len(frame))
+	if _, err := io.ReadFull(reader, echoed); err != nil || string(echoed) != frame {
+		t.Fatalf("upgraded connection echoed %q, %v; want %q", echoed, err, frame)
+	}
+}
+
+func TestMalformedKeepAliveRequestsCloseTheConnection(t *testing.T) {
+	h := newTestHarness(t, Rules{MaxAttemptsPerMinute: 100})
+	h.BufferedUpstream()
+
+	for _, next := range []string{
+		"GET /bad-name HTTP/1.1\r\nHost: chat.example\r\nBad Name: x\r\n\r\n",
+		"GET /folded HTTP/1.1\r\nHost: chat.example\r\n Host: evil.example\r\n\r\n",
+		"POST /bad-chunk HTTP/1.1\r\nHost: chat.example\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n",
+		"GET /oversized HTTP/1.1\r\nHost: chat.example\r\nX-Filler: " + strings.Repeat("x", MaxStreamHeadSize) + "\r\n\r\n",
+	} {
+		conn, reader := h.KeepAlive(testClientIP)
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: chat.example\r\n\r\n")
+		if status := h.ReadStatus(reader); status != http.StatusOK {
+			t.Fatalf("first request got %d", status)
+		}
+		go io.WriteString(conn, next+"GET /after HTTP/1.1\r\nHost: chat.example\r\n\r\n")
+		if status := h.ReadStatus(reader); status != 0 {
+			t.Fatalf("malformed request %q answered %d, want the connection closed", next[:20], status)
+		}
+		h.fw.activeConns.Wait()
+	}
+	for _, r := range h.upstreamRequests() {
+		if r.URL.Path != "/" && r.URL.Path != "/bad-chunk" {
+			t.Errorf("upstream saw %s on a connection with a malformed request", r.URL.Path)
+		}
+	}
+}
+
+func TestKeepAliveRequestsAuthorizedEach(t *testing.T) {
+	var asked atomic.Int32
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked.Add(1)
+		var request ExtAuthzRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		user, ok := strings.CutPrefix(request.Headers["Authorization"], "Bearer ")
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("X-User-Id", user)
+	}))
+	defer service.Close()
+
+	h := newTestHarness(t, Rules{ExtAuthz: ExtAuthzConfig{Enabled: true, URL: service.URL, UpstreamHeaders: []string{"X-User-Id"}}})
+	h.BufferedUpstream()
+
+	conn, reader := h.KeepAlive(testClientIP)
+	go io.WriteString(conn, "GET /a HTTP/1.1\r\nHost: chat.example\r\nAuthorization: Bearer alice\r\n\r\n"+
+		"GET /b HTTP/1.1\r\nHost: chat.example\r\nAuthorization: Bearer bob\r\n\r\n"+
+		"GET /c HTTP/1.1\r\nHost: chat.example\r\n\r\n")
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusUnauthorized, 0} {
+		if status := h.ReadStatus(reader); status != want {
+			t.Fatalf("pipelined response %d: got %d, want %d", i+1, status, want)
+		}
+	}
+	h.fw.activeConns.Wait()
+
+	if got := asked.Load(); got != 3 {
+		t.Errorf("authorization service asked %d times for 3 requests", got)
+	}
+	users := map[string]string{}
+	for _, r := range h.upstreamRequests() {
+		users[r.URL.Path] = r.Header.Get("X-User-Id")
+	}
+	if users["/a"] != "alice" || users["/b"] != "bob" {
+		t.Errorf("upstream identities %v, want each request's own", users)
+	}
+	if _, forwarded := users["/c"]; forwarded {
+		t.Error("unauthorized request forwarded with an earlier request's identity")
+	}
+}
+
+func TestKeepAliveRequestsStayWithTheirTenant(t *testing.T) {
+	h := newTestHarness(t, Rules{Tenants: []Tenant{
+		{Name: "acme", Hosts: []string{"chat.acme.example"}, MaxAttemptsPerMinute: 2},
+		{Name: "globex", Hosts: []string{"chat.globex.example"}},
+	}})
+	h.BufferedUpstream()
+	get := func(host string) string {
+		return "GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+	}
+
+	conn, reader := h.KeepAlive(testClientIP)
+	go io.WriteString(conn, get("chat.acme.example")+get("chat.acme.example")+get("chat.acme.example"))
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, 0} {
+		if status := h.ReadStatus(reader); status != want {
+			t.Fatalf("pipelined acme response %d: got %d, want %d", i+1, status, want)
+		}
+	}
+
+	for _, second := range []string{"chat.acme.example", "chat.example"} {
+		conn, reader = h.KeepAlive("198.51.100.7")
+		go io.WriteString(conn, get("chat.globex.example")+get(second))
+		for i, want := range []int{http.StatusOK, http.StatusMisdirectedRequest} {
+			if status := h.ReadStatus(reader); status != want {
+				t.Fatalf("%s after globex, response %d: got %d, want %d", second, i+1, status, want)
+			}
+		}
+	}
+	h.fw.activeConns.Wait()
+	if stats := h.fw.tenantStats.Snapshot()["globex"]; stats.Connections != 2 {
+		t.Errorf("globex stats: %+v", stats)
+	}
+}
+
+func TestKeepAliveRequestsIdentifyTheirOwnAPIClient(t *testing.T) {
+	h := newTestHarness(t, Rules{MaxAttemptsPerMinute: 1, APIKeys: APIKeyConfig{Enabled: true, File: filepath.Join(t.TempDir(), "api_keys.json")}})
+	h.BufferedUpstream()
+	key, err := h.fw.apiKeys.Create(h.fw.apiKeyConfig().File, "helpdesk-bot", 0, h.fw.clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := h.Get(testClientIP, "/"); status != http.StatusOK {
+		t.Fatalf("first request got %d", status)
+	}
+
+	// The client is now over its per-IP limit, which only the API client
+	// may pass.
+	conn, reader := h.KeepAlive(testClientIP)
+	go io.WriteString(conn, "GET /bot HTTP/1.1\r\nHost: chat.example\r\nX-Api-Key: "+key+"\r\n\r\n"+
+		"GET /anonymous HTTP/1.1\r\nHost: chat.example\r\n\r\n")
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, 0} {
+		if status := h.ReadStatus(reader); status != want {
+			t.Fatalf("pipelined response %d: got %d, want %d", i+1, status, want)
+		}
+	}
+	h.fw.activeConns.Wait()
+
+	for _, r := range h.upstreamRequests() {
+		if r.URL.Path == "/anonymous" {
+			t.Error("anonymous request forwarded as the API client's")
+		}
+	}
+}
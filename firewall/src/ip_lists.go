@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	TorExitListURL = "https://check.torproject.org/torbulkexitlist"
+
+	IPListActionBlock     = "block"
+	IPListActionChallenge = "challenge"
+	IPListActionLimit     = "limit"
+	IPListActionScore     = "score"
+
+	IPListCheckInterval         = 60 // seconds
+	DefaultIPListRefreshMinutes = 60
+	DefaultIPListMaxAttempts    = 10
+	DefaultChallengeValidHours  = 24
+	MaxIPListSize               = 16 << 20
+
+	ChallengeCookieName  = "fw_challenge"
+	challengeTokenPrefix = "challenge:"
+)
+
+// IPList is a set of addresses (Tor exits, VPN providers, datacenter ranges)
+// fetched from URL or read from Path every RefreshMinutes, in any blocklist
+// import format. A list named "tor" with neither set uses the Tor Project's
+// exit list. Clients on a list get its Action:
+//   - "block" refuses them like blocked_ips;
+//   - "challenge" lets them through only once they come back with a signed
+//     cookie, which stops clients that don't keep cookies (most scripts) but
+//     is not a CAPTCHA;
+//   - "limit" replaces max_attempts_per_minute with MaxAttemptsPerMinute;
+//   - "score" only adds to their risk score (see RiskScoring).
+//
+// The first matching list in rules.json order wins.
+type IPList struct {
+	Name                 string `json:"name"`
+	URL                  string `json:"url"`
+	Path                 string `json:"path"`
+	Format               string `json:"format"`
+	Action               string `json:"action"`
+	MaxAttemptsPerMinute int    `json:"max_attempts_per_minute"`
+	ChallengeValidHours  int    `json:"challenge_valid_hours"`
+	RefreshMinutes       int    `json:"refresh_minutes"`
+}
+
+func (list IPList) source() string {
+	if list.URL != "" {
+		return list.URL
+	}
+	return list.Path
+}
+
+func normalizeIPLists(lists []IPList) []IPList {
+	valid := make([]IPList, 0, len(lists))
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		if list.Name == "" || seen[list.Name] {
+			continue
+		}
+		if list.Name == "tor" && list.URL == "" && list.Path == "" {
+			list.URL = TorExitListURL
+		}
+		if list.URL == "" && list.Path == "" {
+			continue
+		}
+		if !validBlocklistFormat(list.Format) {
+			list.Format = BlocklistFormatPlain
+		}
+		switch list.Action {
+		case IPListActionChallenge, IPListActionLimit, IPListActionScore:
+		default:
+			list.Action = IPListActionBlock
+		}
+		if list.MaxAttemptsPerMinute <= 0 {
+			list.MaxAttemptsPerMinute = DefaultIPListMaxAttempts
+		}
+		if list.ChallengeValidHours <= 0 {
+			list.ChallengeValidHours = DefaultChallengeValidHours
+		}
+		if list.RefreshMinutes <= 0 {
+			list.RefreshMinutes = DefaultIPListRefreshMinutes
+		}
+		seen[list.Name] = true
+		valid = append(valid, list)
+	}
+	return valid
+}
+
+func (fw *Firewall) ipLists() []IPList {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.IPLists
+}
+
+type loadedIPList struct {
+	source    string
+	entries   *IPMatcher
+	loadedAt  time.Time
+	checkedAt time.Time
+	err       string
+}
+
+// IPListSet holds the last successful load of each configured list. A list
+// that fails to refresh keeps its previous entries.
+type IPListSet struct {
+	mutex sync.RWMutex
+	lists map[string]*loadedIPList
+}
+
+func NewIPListSet() *IPListSet {
+	return &IPListSet{
+		lists: make(map[string]*loadedIPList),
+	}
+}
+
+func (ls *IPListSet) get(name string) *loadedIPList {
+	ls.mutex.RLock()
+	defer ls.mutex.RUnlock()
+
+	return ls.lists[name]
+}
+
+func (ls *IPListSet) set(name string, loaded *loadedIPList) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	ls.lists[name] = loaded
+}
+
+// retain drops lists that are no longer configured.
+func (ls *IPListSet) retain(lists []IPList) {
+	keep := make(map[string]bool, len(lists))
+	for _, list := range lists {
+		keep[list.Name] = true
+	}
+
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	for name := range ls.lists {
+		if !keep[name] {
+			delete(ls.lists, name)
+		}
+	}
+}
+
+// Contains reports whether ip is on the loaded list name, and the matching
+// entry.
+func (ls *IPListSet) Contains(name, ip string) (string, bool) {
+	loaded := ls.get(name)
+	if loaded == nil || loaded.entries == nil {
+		return "", false
+	}
+	return loaded.entries.MatchRule(ip)
+}
+
+// matchIPList returns the first configured list ip is on.
+func (fw *Firewall) matchIPList(ip string) (IPList, string, bool) {
+	for _, list := range fw.ipLists() {
+		if entry, found := fw.ipListSet.Contains(list.Name, ip); found {
+			return list, entry, true
+		}
+	}
+	return IPList{}, "", false
+}
+
+// ipListRateLimit returns the per-minute limit override for key when it is on
+// a list with the "limit" action.
+func (fw *Firewall) ipListRateLimit(key string) (int, bool) {
+	list, _, found := fw.matchIPList(lookupIP(key).String())
+	if !found || list.Action != IPListActionLimit {
+		return 0, false
+	}
+	return list.MaxAttemptsPerMinute, true
+}
+
+func (fw *Firewall) ipListWatcher() {
+	fw.refreshIPLists(false)
+
+	elapsed := 0
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		elapsed++
+		if elapsed < IPListCheckInterval {
+			continue
+		}
+		elapsed = 0
+
+		fw.refreshIPLists(false)
+	}
+}
+
+// refreshIPLists reloads every list that is due, whose source changed, or all
+// of them when force is set.
+func (fw *Firewall) refreshIPLists(force bool) {
+	lists := fw.ipLists()
+	fw.ipListSet.retain(lists)
+
+	now := time.Now()
+	for _, list := range lists {
+		current := fw.ipListSet.get(list.Name)
+		maxAge := time.Duration(list.RefreshMinutes) * time.Minute
+		if !force && current != nil && current.source == list.source() && now.Sub(current.checkedAt) < maxAge {
+			continue
+		}
+
+		entries, err := fetchIPList(list)
+		if err != nil {
+			fw.logErrorRateLimited("iplist_"+list.Name, "IPLIST", "Failed to load %s list: %v", list.Name, err)
+			failed := &loadedIPList{source: list.source()}
+			if current != nil && current.source == list.source() {
+				*failed = *current
+			}
+			failed.checkedAt, failed.err = now, err.Error()
+			fw.ipListSet.set(list.Name, failed)
+			continue
+		}
+
+		fw.ipListSet.set(list.Name, &loadedIPList{
+			source:    list.source(),
+			entries:   NewIPMatcher(entries),
+			loadedAt:  now,
+			checkedAt: now,
+		})
+		fw.decisions.Invalidate()
+		if fw.logger != nil {
+			fw.logger.LogInfo("IPLIST", "Loaded %s list: %d entries", list.Name, len(entries))
+		}
+	}
+}
+
+// fetchIPList reads a list's entries. Errors never include the URL, which may
+// carry an API key.
+func fetchIPList(list IPList) ([]string, error) {
+	var data []byte
+	if list.URL != "" {
+		client := http.Client{Timeout: time.Minute}
+		resp, err := client.Get(os.ExpandEnv(list.URL))
+		if err != nil {
+			if inner := errors.Unwrap(err); inner != nil {
+				err = inner
+			}
+			return nil, fmt.Errorf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("server answered %s", resp.Status)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, MaxIPListSize)); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(list.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	entries, _, err := parseBlocklist(bytes.NewReader(data), list.Format)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no addresses in list")
+	}
+	return entries, nil
+}
+
+// challengePassed reports whether the request carries a valid challenge
+// cookie for key.
+func (fw *Firewall) challengePassed(head *RequestHead, key string) bool {
+	if head == nil {
+		return false
+	}
+	cookie, err := (&http.Request{Header: head.Header}).Cookie(ChallengeCookieName)
+	if err != nil {
+		return false
+	}
+	tokenKey, _, err := fw.appeals.Verify(cookie.Value, fw.clock.Now())
+	return err == nil && tokenKey == challengeTokenPrefix+key
+}
+
+// writeChallenge answers with a page that sets the challenge cookie and
+// reloads itself. Challenge cookies are signed with the appeal key, and
+// their payload can't be redeemed as an appeal for key.
+func (fw *Firewall) writeChallenge(conn net.Conn, requestID, key string, validFor time.Duration) {
+	cookie := &http.Cookie{
+		Name:     ChallengeCookieName,
+		Value:    fw.appeals.Issue(challengeTokenPrefix+key, validFor, fw.clock.Now()),
+		Path:     "/",
+		MaxAge:   int(validFor / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	data := newErrorPageData(conn, requestID, http.StatusServiceUnavailable,
+		"Checking your connection before continuing to DockerChat. This page reloads by itself; make sure cookies are enabled.", time.Second)
+	data.header = http.Header{}
+	data.header.Set("Set-Cookie", cookie.String())
+	data.header.Set("Refresh", "1")
+	fw.writeErrorPage(conn, data)
+}
+
+type ipListInfo struct {
+	Name     string `json:"name"`
+	Action   string `json:"action"`
+	Entries  int    `json:"entries"`
+	LoadedAt string `json:"loaded_at,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (fw *Firewall) handleIPLists(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		fw.refreshIPLists(true)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	infos := []ipListInfo{}
+	for _, list := range fw.ipLists() {
+		info := ipListInfo{Name: list.Name, Action: list.Action}
+		if loaded := fw.ipListSet.get(list.Name); loaded != nil {
+			if loaded.entries != nil {
+				info.Entries = loaded.entries.Size()
+			}
+			if !loaded.loadedAt.IsZero() {
+				info.LoadedAt = loaded.loadedAt.UTC().Format(time.RFC3339)
+			}
+			info.Error = loaded.err
+		}
+		infos = append(infos, info)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ip_lists": infos})
+}
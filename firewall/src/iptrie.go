@@ -0,0 +1,163 @@
+package main
+
+import "net"
+
+// IPTrie is a path-compressed binary radix tree over address bits, giving
+// longest-prefix matching in O(address length) regardless of how many CIDRs
+// are loaded. IPv4 and IPv6 live in separate trees.
+type IPTrie struct {
+	v4   *trieNode
+	v6   *trieNode
+	size int
+}
+
+type trieNode struct {
+	key      [16]byte
+	bits     int
+	network  *net.IPNet
+	children [2]*trieNode
+}
+
+func NewIPTrie() *IPTrie {
+	return &IPTrie{
+		v4: &trieNode{},
+		v6: &trieNode{},
+	}
+}
+
+func trieKey(ip net.IP) ([16]byte, int, bool) {
+	var key [16]byte
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(key[:], ip4)
+		return key, 32, true
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		copy(key[:], ip16)
+		return key, 128, true
+	}
+	return key, 0, false
+}
+
+func keyBit(key *[16]byte, i int) int {
+	return int(key[i/8]>>(7-uint(i%8))) & 1
+}
+
+func commonPrefixLen(a, b *[16]byte, limit int) int {
+	n := 0
+	for n < limit {
+		byteIdx := n / 8
+		if n%8 == 0 && n+8 <= limit && a[byteIdx] == b[byteIdx] {
+			n += 8
+			continue
+		}
+		if keyBit(a, n) != keyBit(b, n) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+func maskKey(key [16]byte, bits int) [16]byte {
+	var masked [16]byte
+	full := bits / 8
+	copy(masked[:full], key[:full])
+	if rem := bits % 8; rem != 0 {
+		masked[full] = key[full] & (0xFF << (8 - uint(rem)))
+	}
+	return masked
+}
+
+func (t *IPTrie) Insert(network *net.IPNet) {
+	key, maxBits, ok := trieKey(network.IP)
+	if !ok {
+		return
+	}
+	ones, total := network.Mask.Size()
+	if total == 0 {
+		return
+	}
+	if total == 128 && maxBits == 32 {
+		ones -= 96
+		if ones < 0 {
+			ones = 0
+		}
+	}
+	key = maskKey(key, ones)
+
+	root := t.v6
+	if maxBits == 32 {
+		root = t.v4
+	}
+
+	slot := &root
+	for {
+		node := *slot
+		limit := node.bits
+		if ones < limit {
+			limit = ones
+		}
+		common := commonPrefixLen(&node.key, &key, limit)
+
+		if common < node.bits {
+			split := &trieNode{key: maskKey(key, common), bits: common}
+			split.children[keyBit(&node.key, common)] = node
+			if common == ones {
+				split.network = network
+			} else {
+				split.children[keyBit(&key, common)] = &trieNode{key: key, bits: ones, network: network}
+			}
+			*slot = split
+			t.size++
+			return
+		}
+
+		if node.bits == ones {
+			if node.network == nil {
+				t.size++
+			}
+			node.network = network
+			return
+		}
+
+		next := &node.children[keyBit(&key, node.bits)]
+		if *next == nil {
+			*next = &trieNode{key: key, bits: ones, network: network}
+			t.size++
+			return
+		}
+		slot = next
+	}
+}
+
+// Lookup returns the most specific network containing ip.
+func (t *IPTrie) Lookup(ip net.IP) (*net.IPNet, bool) {
+	key, maxBits, ok := trieKey(ip)
+	if !ok {
+		return nil, false
+	}
+
+	node := t.v6
+	if maxBits == 32 {
+		node = t.v4
+	}
+
+	var best *net.IPNet
+	for node != nil {
+		if commonPrefixLen(&node.key, &key, node.bits) < node.bits {
+			break
+		}
+		if node.network != nil {
+			best = node.network
+		}
+		if node.bits >= maxBits {
+			break
+		}
+		node = node.children[keyBit(&key, node.bits)]
+	}
+	return best, best != nil
+}
+
+func (t *IPTrie) Len() int {
+	return t.size
+}
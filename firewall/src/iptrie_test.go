@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// prefixBits is network's prefix length within its own address family, so
+// that ::ffff:10.0.0.0/104 counts as the /8 it stands for.
+func prefixBits(network *net.IPNet) int {
+	ones, bits := network.Mask.Size()
+	if bits == 128 && network.IP.To4() != nil {
+		ones -= 96
+	}
+	return ones
+}
+
+// linearLookup is the reference for IPTrie.Lookup: the longest prefix among
+// networks that contain ip.
+func linearLookup(networks []*net.IPNet, ip net.IP) (int, bool) {
+	best, found := -1, false
+	for _, network := range networks {
+		if network.Contains(ip) && prefixBits(network) > best {
+			best, found = prefixBits(network), true
+		}
+	}
+	return best, found
+}
+
+func checkTrieLookups(t *testing.T, trie *IPTrie, networks []*net.IPNet, lookups []string) {
+	t.Helper()
+	for _, address := range lookups {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			t.Fatalf("bad lookup address %q", address)
+		}
+		wantBits, wantFound := linearLookup(networks, ip)
+		got, found := trie.Lookup(ip)
+		switch {
+		case found != wantFound:
+			t.Errorf("Lookup(%s) found %v (%v), linear scan found %v", address, found, got, wantFound)
+		case found && (!got.Contains(ip) || prefixBits(got) != wantBits):
+			t.Errorf("Lookup(%s) = %s, linear scan found a /%d", address, got, wantBits)
+		}
+	}
+}
+
+func TestIPTrie(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cidrs   []string
+		lookups []string
+		wantLen int
+	}{
+		{
+			name:    "nested IPv4 prefixes",
+			cidrs:   []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.2.3/32"},
+			lookups: []string{"10.1.2.3", "10.1.2.4", "10.1.3.1", "10.2.0.0", "10.255.255.255", "11.0.0.1", "9.255.255.255"},
+			wantLen: 4,
+		},
+		{
+			name:    "shorter prefix inserted at a split",
+			cidrs:   []string{"192.168.0.0/24", "192.168.1.0/24", "192.168.0.128/25", "192.168.0.0/16", "192.168.0.0/23"},
+			lookups: []string{"192.168.0.1", "192.168.0.200", "192.168.1.1", "192.168.2.1", "192.169.0.1"},
+			wantLen: 5,
+		},
+		{
+			name:    "nested IPv6 prefixes",
+			cidrs:   []string{"2001:db8::/32", "2001:db8:1::/48", "2001:db8:1:2::/64", "2001:db8:1:2::1/128"},
+			lookups: []string{"2001:db8:1:2::1", "2001:db8:1:2::2", "2001:db8:1:3::1", "2001:db8:2::1", "2001:db9::1"},
+			wantLen: 4,
+		},
+		{
+			name:    "IPv4 /0",
+			cidrs:   []string{"0.0.0.0/0", "203.0.113.0/24"},
+			lookups: []string{"203.0.113.9", "1.2.3.4", "255.255.255.255", "0.0.0.0", "2001:db8::1"},
+			wantLen: 2,
+		},
+		{
+			name:    "IPv6 /0",
+			cidrs:   []string{"::/0", "2001:db8::/32"},
+			lookups: []string{"2001:db8::1", "fe80::1", "::", "1.2.3.4"},
+			wantLen: 2,
+		},
+		{
+			name:    "IPv4-mapped IPv6 prefixes",
+			cidrs:   []string{"::ffff:10.0.0.0/104", "10.1.0.0/16", "::ffff:10.1.2.0/120", "::ffff:198.51.100.7/128"},
+			lookups: []string{"10.1.2.3", "::ffff:10.1.2.3", "10.1.3.1", "10.9.9.9", "11.0.0.1", "198.51.100.7", "198.51.100.8", "::a01:203"},
+			wantLen: 4,
+		},
+		{
+			name:    "duplicate inserts",
+			cidrs:   []string{"10.0.0.0/8", "10.0.0.0/8", "10.9.9.9/8", "::ffff:10.0.0.0/104", "2001:db8::/32", "2001:db8:0::/32", "2001:db8::1/32"},
+			lookups: []string{"10.1.1.1", "2001:db8::5", "11.0.0.1"},
+			wantLen: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			trie := NewIPTrie()
+			var networks []*net.IPNet
+			for _, cidr := range tc.cidrs {
+				_, network, err := net.ParseCIDR(cidr)
+				if err != nil {
+					t.Fatalf("bad CIDR %q: %v", cidr, err)
+				}
+				trie.Insert(network)
+				networks = append(networks, network)
+			}
+			if got := trie.Len(); got != tc.wantLen {
+				t.Errorf("Len() = %d, want %d", got, tc.wantLen)
+			}
+			checkTrieLookups(t, trie, networks, tc.lookups)
+		})
+	}
+}
+
+// TestIPTrieMatchesLinearScan checks random overlapping prefixes within a
+// few /16s, where splits and shared paths are common.
+func TestIPTrieMatchesLinearScan(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	address := func() string {
+		return fmt.Sprintf("10.%d.%d.%d", random.Intn(4), random.Intn(256), random.Intn(256))
+	}
+
+	trie := NewIPTrie()
+	var networks []*net.IPNet
+	distinct := map[string]bool{}
+	for i := 0; i < 500; i++ {
+		_, network, _ := net.ParseCIDR(fmt.Sprintf("%s/%d", address(), 8+random.Intn(25)))
+		trie.Insert(network)
+		networks = append(networks, network)
+		distinct[network.String()] = true
+	}
+	if got := trie.Len(); got != len(distinct) {
+		t.Errorf("Len() = %d, want %d distinct networks", got, len(distinct))
+	}
+
+	lookups := make([]string, 2000)
+	for i := range lookups {
+		lookups[i] = address()
+	}
+	checkTrieLookups(t, trie, networks, lookups)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LoadSheddingReject = "reject"
+	LoadSheddingPause  = "pause"
+
+	DefaultQueueTimeoutMillis = 250
+
+	shedWriteTimeout      = 100 * time.Millisecond
+	shedRetryAfterSeconds = 5
+)
+
+// LoadShedding decides what the accept loop does once MaxConcurrentConns
+// connections hold a slot. "reject" (the default) answers new connections
+// with a bare 503 from the accept loop itself and closes them, without
+// starting a handler; "pause" holds the connection just accepted and stops
+// accepting until a slot frees up, leaving new ones in the kernel's listen
+// backlog (and SYNs to be dropped once it fills).
+//
+// In reject mode up to QueueSize connections can instead wait
+// QueueTimeoutMillis for a slot, in arrival order, so a brief burst of chat
+// users reconnecting isn't turned away.
+type LoadShedding struct {
+	Mode               string `json:"mode"`
+	QueueSize          int    `json:"queue_size"`
+	QueueTimeoutMillis int    `json:"queue_timeout_ms"`
+}
+
+func normalizeLoadShedding(config LoadShedding) LoadShedding {
+	if config.Mode != LoadSheddingPause {
+		config.Mode = LoadSheddingReject
+	}
+	if config.QueueSize < 0 {
+		config.QueueSize = 0
+	}
+	if config.QueueTimeoutMillis <= 0 {
+		config.QueueTimeoutMillis = DefaultQueueTimeoutMillis
+	}
+	return config
+}
+
+func (fw *Firewall) loadSheddingConfig() LoadShedding {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.LoadShedding
+}
+
+const shedBody = "DockerChat is busy right now."
+
+var shedResponse = []byte(fmt.Sprintf("HTTP/1.1 503 Service Unavailable\r\n"+
+	"Content-Type: text/plain; charset=utf-8\r\nRetry-After: %d\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+	shedRetryAfterSeconds, len(shedBody), shedBody))
+
+// SaturationStats tracks how often the firewall had to shed load.
+type SaturationStats struct {
+	shed     atomic.Uint64
+	queued   atomic.Int64
+	dequeued atomic.Uint64
+	paused   atomic.Bool
+	// pausedNanos is the time spent with Accept paused, not counting a pause
+	// still in progress.
+	pausedNanos atomic.Int64
+}
+
+type SaturationSnapshot struct {
+	Active        int64   `json:"active_connections"`
+	Limit         int64   `json:"max_concurrent_connections"`
+	Utilization   float64 `json:"utilization"`
+	Shed          uint64  `json:"shed_connections"`
+	Queued        int64   `json:"queued_connections"`
+	Dequeued      uint64  `json:"dequeued_connections"`
+	AcceptPaused  bool    `json:"accept_paused"`
+	PausedSeconds float64 `json:"accept_paused_seconds"`
+}
+
+func (fw *Firewall) saturationSnapshot() SaturationSnapshot {
+	active, limit := fw.connSlots.Usage()
+	return SaturationSnapshot{
+		Active:        active,
+		Limit:         limit,
+		Utilization:   float64(active) / float64(limit),
+		Shed:          fw.saturation.shed.Load(),
+		Queued:        fw.saturation.queued.Load(),
+		Dequeued:      fw.saturation.dequeued.Load(),
+		AcceptPaused:  fw.saturation.paused.Load(),
+		PausedSeconds: time.Duration(fw.saturation.pausedNanos.Load()).Seconds(),
+	}
+}
+
+// admitSaturated deals with a connection accepted while every slot is held.
+// It returns true once conn holds a slot and can be handled; otherwise conn
+// was shed, or queued for queueConnection to handle or shed.
+func (fw *Firewall) admitSaturated(ctx, accepting context.Context, conn net.Conn) bool {
+	config := fw.loadSheddingConfig()
+	if config.Mode == LoadSheddingPause {
+		if fw.awaitCapacity(accepting) {
+			return true
+		}
+		conn.Close()
+		return false
+	}
+
+	if fw.saturation.queued.Load() < int64(config.QueueSize) {
+		fw.saturation.queued.Add(1)
+		fw.activeConns.Add(1)
+		go fw.queueConnection(ctx, accepting, conn, time.Duration(config.QueueTimeoutMillis)*time.Millisecond)
+		return false
+	}
+
+	fw.shedConnection(conn)
+	return false
+}
+
+// queueConnection waits up to timeout for a slot for conn.
+func (fw *Firewall) queueConnection(ctx, accepting context.Context, conn net.Conn, timeout time.Duration) {
+	wait, cancel := context.WithTimeout(accepting, timeout)
+	err := fw.connSlots.Acquire(wait, 1)
+	cancel()
+	fw.saturation.queued.Add(-1)
+
+	if err != nil {
+		fw.activeConns.Done()
+		fw.shedConnection(conn)
+		return
+	}
+	fw.saturation.dequeued.Add(1)
+	fw.handleConnection(ctx, conn)
+}
+
+// shedConnection turns conn away without spending a goroutine on it. The
+// write can't hold up the accept loop for long: the response fits in any
+// socket buffer, and the deadline covers the rest.
+func (fw *Firewall) shedConnection(conn net.Conn) {
+	ip := ""
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP.String()
+	}
+	_, limit := fw.connSlots.Usage()
+	fw.saturation.shed.Add(1)
+	fw.recordBlock(ip, "LOAD_SHED")
+	fw.logErrorRateLimited("load_shed", "LOAD_SHED", "Saturated at %d connections - shedding new connections", limit)
+
+	conn.SetWriteDeadline(time.Now().Add(shedWriteTimeout))
+	conn.Write(shedResponse)
+	conn.Close()
+}
+
+// awaitCapacity holds the accept loop, and the connection it just accepted,
+// until a slot frees up. It returns false if the firewall stops accepting
+// first.
+func (fw *Firewall) awaitCapacity(accepting context.Context) bool {
+	started := time.Now()
+	fw.saturation.paused.Store(true)
+	defer fw.saturation.paused.Store(false)
+
+	_, limit := fw.connSlots.Usage()
+	fw.logErrorRateLimited("accept_paused", "LOAD_SHED", "Saturated at %d connections - pausing accept", limit)
+
+	if err := fw.connSlots.Acquire(accepting, 1); err != nil {
+		return false
+	}
+	fw.saturation.pausedNanos.Add(int64(time.Since(started)))
+	return true
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	LogSyncNone   = "none"
+	LogSyncFlush  = "flush"
+	LogSyncAlways = "always"
+
+	DefaultLogFlushIntervalMilliseconds = 1000
+)
+
+// LogFileConfig controls how firewall.log is written. With BufferKilobytes
+// set, entries are collected in memory and written out every
+// FlushIntervalMilliseconds, whenever the buffer fills, and straight away
+// after any entry at FlushLevel or above, so a burst of connection logs costs
+// a few writes rather than one per line. Sync is when the file is fsynced:
+// "none" leaves it to the kernel, "flush" after every write-out and "always"
+// opens the file O_SYNC. Only the file is buffered; stdout still gets each
+// entry as it is logged.
+type LogFileConfig struct {
+	BufferKilobytes           int    `json:"buffer_kilobytes"`
+	FlushIntervalMilliseconds int    `json:"flush_interval_milliseconds"`
+	FlushLevel                string `json:"flush_level"`
+	Sync                      string `json:"sync"`
+}
+
+type logFilePolicy struct {
+	bufferSize    int
+	flushInterval time.Duration
+	flushLevel    LogLevel
+	sync          string
+}
+
+// buildLogFilePolicy validates the file config, using the default for, and
+// reporting, anything it doesn't understand.
+func buildLogFilePolicy(config LogFileConfig) (logFilePolicy, []string) {
+	policy := logFilePolicy{
+		bufferSize:    config.BufferKilobytes * 1024,
+		flushInterval: time.Duration(config.FlushIntervalMilliseconds) * time.Millisecond,
+		flushLevel:    SECURITY,
+		sync:          strings.ToLower(strings.TrimSpace(config.Sync)),
+	}
+	var problems []string
+
+	if policy.bufferSize < 0 {
+		problems = append(problems, fmt.Sprintf("buffer_kilobytes %d is negative", config.BufferKilobytes))
+		policy.bufferSize = 0
+	}
+	if policy.flushInterval <= 0 {
+		policy.flushInterval = DefaultLogFlushIntervalMilliseconds * time.Millisecond
+	}
+	if config.FlushLevel != "" {
+		level, ok := ParseLogLevel(config.FlushLevel)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown flush_level %q", config.FlushLevel))
+		} else {
+			policy.flushLevel = level
+		}
+	}
+	switch policy.sync {
+	case "":
+		policy.sync = LogSyncNone
+	case LogSyncNone, LogSyncFlush, LogSyncAlways:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown sync %q", config.Sync))
+		policy.sync = LogSyncNone
+	}
+	return policy, problems
+}
+
+func openLogFile(path string, syncWrites bool) (*os.File, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if syncWrites {
+		flags |= os.O_SYNC
+	}
+	return os.OpenFile(path, flags, 0644)
+}
+
+// logFileSink is the log file as seen by the stdout-and-file logger.
+type logFileSink struct {
+	*logOutput
+}
+
+func (sink logFileSink) Write(p []byte) (int, error) {
+	return sink.writeFile(p)
+}
+
+// writeFile writes to the log file, through the buffer when there is one.
+// Callers hold mutex.
+func (lo *logOutput) writeFile(p []byte) (int, error) {
+	if lo.logFile == nil {
+		return 0, os.ErrClosed
+	}
+	lo.dirty = true
+	if lo.buffer != nil {
+		return lo.buffer.Write(p)
+	}
+	return lo.logFile.Write(p)
+}
+
+// flushLocked writes out the buffer and, with sync "flush", fsyncs the file.
+// Callers hold mutex.
+func (lo *logOutput) flushLocked() {
+	if !lo.dirty || lo.logFile == nil {
+		return
+	}
+	lo.dirty = false
+	if lo.buffer != nil {
+		lo.buffer.Flush()
+	}
+	if lo.filePolicy.sync == LogSyncFlush {
+		lo.logFile.Sync()
+	}
+}
+
+// Flush writes out whatever is buffered, for callers about to exit without
+// closing the logger.
+func (fl *FirewallLogger) Flush() {
+	fl.mutex.Lock()
+	defer fl.mutex.Unlock()
+
+	fl.flushLocked()
+}
+
+// SetFilePolicy changes how the log file is buffered and synced, writing out
+// anything buffered under the old policy first.
+func (fl *FirewallLogger) SetFilePolicy(policy logFilePolicy) {
+	fl.mutex.Lock()
+	defer fl.mutex.Unlock()
+
+	if policy == fl.filePolicy {
+		return
+	}
+	fl.flushLocked()
+	reopen := (policy.sync == LogSyncAlways) != (fl.filePolicy.sync == LogSyncAlways)
+	fl.filePolicy = policy
+
+	if reopen && fl.logFile != nil {
+		file, err := openLogFile(fl.logFile.Name(), policy.sync == LogSyncAlways)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[LOGGING] Failed to reopen %s: %v\n", fl.logFile.Name(), err)
+		} else {
+			fl.logFile.Close()
+			fl.logFile = file
+		}
+	}
+	fl.resetBufferLocked()
+	fl.startFlusherLocked()
+}
+
+// resetBufferLocked puts a buffer of the policy's size in front of the
+// current log file, or none. Callers hold mutex and have flushed.
+func (lo *logOutput) resetBufferLocked() {
+	lo.buffer = nil
+	if lo.filePolicy.bufferSize > 0 && lo.logFile != nil {
+		lo.buffer = bufio.NewWriterSize(lo.logFile, lo.filePolicy.bufferSize)
+	}
+}
+
+// startFlusherLocked replaces the goroutine that flushes every flush
+// interval; none is needed when nothing is buffered or synced on flush.
+// Callers hold mutex.
+func (lo *logOutput) startFlusherLocked() {
+	if lo.stopFlusher != nil {
+		close(lo.stopFlusher)
+		lo.stopFlusher = nil
+	}
+	if lo.filePolicy.bufferSize == 0 && lo.filePolicy.sync != LogSyncFlush {
+		return
+	}
+
+	stop := make(chan struct{})
+	lo.stopFlusher = stop
+	go func(interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				lo.mutex.Lock()
+				lo.flushLocked()
+				lo.mutex.Unlock()
+			}
+		}
+	}(lo.filePolicy.flushInterval)
+}
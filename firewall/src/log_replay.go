@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultLogReplayMinutes = 10
+	MaxLogReplayMinutes     = 60
+
+	logTimestampLayout = "2006-01-02 15:04:05.000"
+)
+
+// LogReplay rebuilds approximate per-client counters at startup from the
+// last Minutes of firewall.log: every logged connection counts as an attempt
+// by its client, and logged DDoS auto-blocks are reinstated. It only runs
+// when no warm state was restored.
+type LogReplay struct {
+	Enabled bool `json:"enabled"`
+	Minutes int  `json:"minutes"`
+}
+
+func normalizeLogReplay(replay LogReplay) LogReplay {
+	if replay.Minutes <= 0 {
+		replay.Minutes = DefaultLogReplayMinutes
+	}
+	if replay.Minutes > MaxLogReplayMinutes {
+		replay.Minutes = MaxLogReplayMinutes
+	}
+	return replay
+}
+
+func (fw *Firewall) logReplayConfig() LogReplay {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.LogReplay
+}
+
+// logLine is a firewall.log entry: its time, level, category, request ID and
+// message.
+type logLine struct {
+	At        time.Time
+	Level     string
+	Category  string
+	RequestID string
+	Message   string
+}
+
+func parseLogLine(line string) (logLine, bool) {
+	// [timestamp] [LEVEL] [CATEGORY] [req=id] message
+	if len(line) < len(logTimestampLayout)+3 || line[0] != '[' {
+		return logLine{}, false
+	}
+	at, err := time.ParseInLocation(logTimestampLayout, line[1:1+len(logTimestampLayout)], time.Local)
+	if err != nil {
+		return logLine{}, false
+	}
+	fields := strings.SplitN(line[len(logTimestampLayout)+3:], "] ", 3)
+	if len(fields) < 3 {
+		return logLine{}, false
+	}
+	message, requestID := fields[2], ""
+	if strings.HasPrefix(message, "[req=") {
+		if end := strings.Index(message, "] "); end >= 0 {
+			requestID, message = message[len("[req="):end], message[end+2:]
+		}
+	}
+	return logLine{At: at, Level: strings.TrimPrefix(fields[0], "["), Category: strings.TrimPrefix(fields[1], "["), RequestID: requestID, Message: message}, true
+}
+
+// replayedClient returns the client IP of a CONNECTION summary line.
+func replayedClient(message string) (string, bool) {
+	rest, ok := strings.CutPrefix(message, "IP: ")
+	if !ok {
+		return "", false
+	}
+	address, _, _ := strings.Cut(rest, " ")
+	colon := strings.LastIndexByte(address, ':')
+	if colon < 0 || net.ParseIP(address[:colon]) == nil {
+		return "", false
+	}
+	return address[:colon], true
+}
+
+// replayedAutoBlock returns the key of a DDOS line recording an auto-block.
+func replayedAutoBlock(message string) (string, bool) {
+	if !strings.HasSuffix(message, "Action: AUTO_BLOCKED") {
+		return "", false
+	}
+	rest, ok := strings.CutPrefix(message, "IP: ")
+	if !ok {
+		return "", false
+	}
+	key, _, _ := strings.Cut(rest, " ")
+	return key, true
+}
+
+// replayLog reads the last config.Minutes of the log at path into the rate
+// limit counters and auto-blocks, returning how many connections it counted.
+func (fw *Firewall) replayLog(path string, config LogReplay) (int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	fw.rulesMutex.RLock()
+	autoBlockEnabled := fw.rules.AutoBlockEnabled
+	blockDuration := time.Duration(fw.rules.AutoBlockDurationHours) * time.Hour
+	fw.rulesMutex.RUnlock()
+
+	now := fw.clock.Now()
+	since := now.Add(-time.Duration(config.Minutes) * time.Minute)
+	limit := fw.trackedClientLimit()
+	connections := 0
+
+	fw.attemptsMutex.Lock()
+	defer fw.attemptsMutex.Unlock()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line, ok := parseLogLine(scanner.Text())
+		if !ok || line.At.Before(since) || line.At.After(now) {
+			continue
+		}
+
+		switch line.Category {
+		case "CONNECTION":
+			ip, ok := replayedClient(line.Message)
+			if !ok {
+				continue
+			}
+			key := fw.aggregationKey(ip)
+			if now.Sub(line.At) < time.Minute {
+				if _, tracked := fw.connectionAttempts[key]; tracked || len(fw.connectionAttempts) < limit {
+					fw.connectionAttempts[key] = append(fw.connectionAttempts[key], line.At)
+					fw.trackedIPs.Touch(key)
+				}
+			}
+			if autoBlockEnabled {
+				if _, tracked := fw.hourlyAttempts[key]; tracked || len(fw.hourlyAttempts) < limit {
+					fw.hourlyAttempts[key] = append(fw.hourlyAttempts[key], line.At)
+				}
+			}
+			connections++
+		case "DDOS":
+			key, ok := replayedAutoBlock(line.Message)
+			if !ok {
+				continue
+			}
+			if until := line.At.Add(blockDuration); until.After(now) && until.After(fw.autoBlockedIPs[key]) {
+				fw.autoBlockedIPs[key] = until
+				fw.autoBlockReasons[key] = "DDoS_AUTO_BLOCK"
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return connections, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return connections, nil
+}
+
+// replayRecentLog runs the startup replay of the firewall's own log.
+func (fw *Firewall) replayRecentLog(config LogReplay) {
+	if fw.logger == nil {
+		return
+	}
+	path := filepath.Join(fw.logger.logDir, "firewall.log")
+	connections, err := fw.replayLog(path, config)
+	if err != nil {
+		fw.logger.LogError("STATE", "Log replay incomplete: %v", err)
+	}
+	fw.logger.LogStartup("Replayed %d connections from the last %d minutes of %s", connections, config.Minutes, path)
+}
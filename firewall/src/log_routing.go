@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+)
+
+const (
+	LogDestinationDefault = ""
+	LogDestinationFile    = "file"
+	LogDestinationStdout  = "stdout"
+	LogDestinationSyslog  = "syslog"
+	LogDestinationNull    = "null"
+)
+
+// CategoryLogConfig overrides the minimum level and destination for one log
+// category (BLOCKED, PROXY, RULES, ...) or, failing that, for one level
+// (SECURITY, DEBUG, ...). An empty destination keeps the default of stdout
+// plus the log file.
+type CategoryLogConfig struct {
+	Level       string `json:"level"`
+	Destination string `json:"destination"`
+}
+
+type LoggingConfig struct {
+	Categories map[string]CategoryLogConfig `json:"categories"`
+	File       LogFileConfig                `json:"file"`
+}
+
+type logRoute struct {
+	level       LogLevel
+	hasLevel    bool
+	destination string
+}
+
+// buildLogRoutes validates the logging config, skipping (and reporting)
+// entries it doesn't understand.
+func buildLogRoutes(config LoggingConfig) (map[string]logRoute, []string) {
+	routes := make(map[string]logRoute, len(config.Categories))
+	var problems []string
+
+	for name, entry := range config.Categories {
+		route := logRoute{destination: strings.ToLower(strings.TrimSpace(entry.Destination))}
+
+		if entry.Level != "" {
+			level, ok := ParseLogLevel(entry.Level)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: unknown level %q", name, entry.Level))
+				continue
+			}
+			route.level, route.hasLevel = level, true
+		}
+
+		switch route.destination {
+		case LogDestinationDefault, LogDestinationFile, LogDestinationStdout, LogDestinationSyslog, LogDestinationNull:
+		default:
+			problems = append(problems, fmt.Sprintf("%s: unknown destination %q", name, entry.Destination))
+			continue
+		}
+
+		routes[strings.ToUpper(strings.TrimSpace(name))] = route
+	}
+	return routes, problems
+}
+
+// SetRoutes replaces the per-category routing table; safe to call while
+// other goroutines are logging.
+func (fl *FirewallLogger) SetRoutes(routes map[string]logRoute) {
+	fl.routes.Store(&routes)
+}
+
+// routeFor prefers a route for the category over one for the level.
+func (fl *FirewallLogger) routeFor(level LogLevel, category string) logRoute {
+	routes := fl.routes.Load()
+	if routes == nil {
+		return logRoute{}
+	}
+	if route, exists := (*routes)[category]; exists {
+		return route
+	}
+	return (*routes)[level.String()]
+}
+
+func syslogPriority(level LogLevel) syslog.Priority {
+	switch level {
+	case DEBUG:
+		return syslog.LOG_DEBUG
+	case INFO:
+		return syslog.LOG_INFO
+	case WARNING:
+		return syslog.LOG_WARNING
+	case SECURITY:
+		return syslog.LOG_NOTICE
+	default:
+		return syslog.LOG_ERR
+	}
+}
+
+// writeSyslog sends one entry to the local syslog daemon, connecting on first
+// use. Callers hold fl.mutex. Without a reachable daemon the entry goes to
+// stdout instead so it isn't lost.
+func (fl *FirewallLogger) writeSyslog(level LogLevel, entry string) error {
+	if fl.syslog == nil {
+		writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "firewall")
+		if err != nil {
+			return err
+		}
+		fl.syslog = writer
+	}
+
+	var err error
+	switch syslogPriority(level) {
+	case syslog.LOG_DEBUG:
+		err = fl.syslog.Debug(entry)
+	case syslog.LOG_INFO:
+		err = fl.syslog.Info(entry)
+	case syslog.LOG_WARNING:
+		err = fl.syslog.Warning(entry)
+	case syslog.LOG_NOTICE:
+		err = fl.syslog.Notice(entry)
+	default:
+		err = fl.syslog.Err(entry)
+	}
+	if err != nil {
+		fl.syslog.Close()
+		fl.syslog = nil
+	}
+	return err
+}
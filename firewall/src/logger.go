@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"log"
+	"log/syslog"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,6 +24,24 @@ const (
 	SECURITY
 )
 
+const DefaultLogLevel = INFO
+
+func ParseLogLevel(name string) (LogLevel, bool) {
+	switch strings.ToUpper(strings.TrimSpace(name)) {
+	case "DEBUG":
+		return DEBUG, true
+	case "INFO":
+		return INFO, true
+	case "WARNING", "WARN":
+		return WARNING, true
+	case "ERROR":
+		return ERROR, true
+	case "SECURITY":
+		return SECURITY, true
+	}
+	return INFO, false
+}
+
 func (l LogLevel) String() string {
 	switch l {
 	case DEBUG:
@@ -37,24 +59,46 @@ func (l LogLevel) String() string {
 	}
 }
 
+// FirewallLogger writes the firewall log. Loggers returned by WithRequestID
+// share the same output and tag every line with the request ID.
 type FirewallLogger struct {
+	*logOutput
+	requestID string
+}
+
+type logOutput struct {
 	mutex       sync.Mutex
 	logFile     *os.File
 	logger      *log.Logger
 	logDir      string
 	currentDate string
+	minLevel    atomic.Int32
+	routes      atomic.Pointer[map[string]logRoute]
+	syslog      *syslog.Writer
+
+	buffer      *bufio.Writer
+	dirty       bool
+	filePolicy  logFilePolicy
+	stopFlusher chan struct{}
+
+	blockObserver func(ip, reason string)
 }
 
+const DefaultLogDir = "/var/log/shared/firewall"
+
 func NewFirewallLogger() (*FirewallLogger, error) {
-	logDir := "/var/log/shared/firewall"
+	return newFirewallLogger(DefaultLogDir)
+}
 
+func newFirewallLogger(logDir string) (*FirewallLogger, error) {
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create logs directory: %v", err)
 	}
 
 	fl := &FirewallLogger{
-		logDir: logDir,
+		logOutput: &logOutput{logDir: logDir},
 	}
+	fl.SetMinLevel(DefaultLogLevel)
 
 	if err := fl.initLogFile(); err != nil {
 		return nil, err
@@ -63,6 +107,19 @@ func NewFirewallLogger() (*FirewallLogger, error) {
 	return fl, nil
 }
 
+// SetMinLevel drops everything below level. It can be called at any time.
+func (fl *FirewallLogger) SetMinLevel(level LogLevel) {
+	fl.minLevel.Store(int32(level))
+}
+
+func (fl *FirewallLogger) MinLevel() LogLevel {
+	return LogLevel(fl.minLevel.Load())
+}
+
+func (fl *FirewallLogger) WithRequestID(id string) *FirewallLogger {
+	return &FirewallLogger{logOutput: fl.logOutput, requestID: id}
+}
+
 func (fl *FirewallLogger) initLogFile() error {
 	fl.mutex.Lock()
 	defer fl.mutex.Unlock()
@@ -72,6 +129,7 @@ func (fl *FirewallLogger) initLogFile() error {
 
 	if fl.currentDate != dateStr {
 		if fl.logFile != nil {
+			fl.flushLocked()
 			fl.logFile.Close()
 		}
 
@@ -83,12 +141,13 @@ func (fl *FirewallLogger) initLogFile() error {
 		}
 
 		var err error
-		fl.logFile, err = os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		fl.logFile, err = openLogFile(logFilePath, fl.filePolicy.sync == LogSyncAlways)
 		if err != nil {
 			return fmt.Errorf("failed to open log file %s: %v", logFilePath, err)
 		}
+		fl.resetBufferLocked()
 
-		multiWriter := io.MultiWriter(os.Stdout, fl.logFile)
+		multiWriter := io.MultiWriter(os.Stdout, logFileSink{fl.logOutput})
 		fl.logger = log.New(multiWriter, "", 0)
 		fl.currentDate = dateStr
 
@@ -100,7 +159,18 @@ func (fl *FirewallLogger) initLogFile() error {
 	return nil
 }
 
+// writeLog applies the category's route if one is configured; its level
+// replaces the global minimum for that category.
 func (fl *FirewallLogger) writeLog(level LogLevel, category, format string, args ...interface{}) {
+	route := fl.routeFor(level, category)
+	minLevel := fl.MinLevel()
+	if route.hasLevel {
+		minLevel = route.level
+	}
+	if level < minLevel || route.destination == LogDestinationNull {
+		return
+	}
+
 	fl.initLogFile()
 
 	fl.mutex.Lock()
@@ -109,28 +179,74 @@ func (fl *FirewallLogger) writeLog(level LogLevel, category, format string, args
 	timestamp := time.Now().Format("2006-01-02 15:04:05.000")
 	message := fmt.Sprintf(format, args...)
 
-	logEntry := fmt.Sprintf("[%s] [%s] [%s] %s", timestamp, level.String(), category, message)
-	fl.logger.Println(logEntry)
+	body := fmt.Sprintf("[%s] [%s] %s", level.String(), category, message)
+	if fl.requestID != "" {
+		body = fmt.Sprintf("[%s] [%s] [req=%s] %s", level.String(), category, fl.requestID, message)
+	}
+	logEntry := fmt.Sprintf("[%s] %s", timestamp, body)
+
+	switch route.destination {
+	case LogDestinationFile:
+		fl.writeFile([]byte(logEntry + "\n"))
+	case LogDestinationStdout:
+		os.Stdout.WriteString(logEntry + "\n")
+	case LogDestinationSyslog:
+		if err := fl.writeSyslog(level, body); err != nil {
+			os.Stdout.WriteString(logEntry + "\n")
+		}
+	default:
+		fl.logger.Println(logEntry)
+	}
+	if level >= fl.filePolicy.flushLevel {
+		fl.flushLocked()
+	}
 }
 
 func (fl *FirewallLogger) Close() {
 	fl.mutex.Lock()
 	defer fl.mutex.Unlock()
 
+	if fl.stopFlusher != nil {
+		close(fl.stopFlusher)
+		fl.stopFlusher = nil
+	}
 	if fl.logFile != nil {
+		fl.flushLocked()
 		fl.logFile.Close()
 	}
+	if fl.syslog != nil {
+		fl.syslog.Close()
+	}
 }
 
 func (fl *FirewallLogger) LogStartup(message string, args ...interface{}) {
 	fl.writeLog(INFO, "STARTUP", message, args...)
 }
 
-func (fl *FirewallLogger) LogConnection(ip string, port int, action string) {
-	fl.writeLog(INFO, "CONNECTION", "IP: %s:%d - Action: %s", ip, port, action)
+func (fl *FirewallLogger) LogConnectionSummary(record *ConnectionRecord, detail bool) {
+	fl.writeLog(INFO, "CONNECTION", "%s", record.Summary())
+	if detail && len(record.detail) > 0 {
+		fl.writeLog(DEBUG, "CONNECTION", "Detail: %s", record.Detail())
+	}
+}
+
+// SetBlockObserver registers fn to be called for every LogBlocked event, so
+// stats can count blocks without touching each call site.
+func (fl *FirewallLogger) SetBlockObserver(fn func(ip, reason string)) {
+	fl.mutex.Lock()
+	defer fl.mutex.Unlock()
+
+	fl.blockObserver = fn
 }
 
 func (fl *FirewallLogger) LogBlocked(ip string, reason string, details ...interface{}) {
+	fl.mutex.Lock()
+	observer := fl.blockObserver
+	fl.mutex.Unlock()
+	if observer != nil {
+		observer(ip, reason)
+	}
+
 	message := fmt.Sprintf("IP: %s - Reason: %s", ip, reason)
 	if len(details) > 0 {
 		message += fmt.Sprintf(" - Details: %v", details)
@@ -138,16 +254,24 @@ func (fl *FirewallLogger) LogBlocked(ip string, reason string, details ...interf
 	fl.writeLog(SECURITY, "BLOCKED", message)
 }
 
-func (fl *FirewallLogger) LogAllowed(ip string, destination string) {
-	fl.writeLog(INFO, "ALLOWED", "IP: %s -> Destination: %s", ip, destination)
+func (fl *FirewallLogger) LogRateLimit(ip string, attempts int, maxAttempts int) {
+	fl.writeLog(SECURITY, "RATE_LIMIT", "IP: %s exceeded rate limit - Attempts: %d/%d", ip, attempts, maxAttempts)
+}
+
+func (fl *FirewallLogger) LogEndpointRateLimit(ip, pathPrefix string, attempts int, maxAttempts int) {
+	fl.writeLog(SECURITY, "RATE_LIMIT", "IP: %s exceeded endpoint rate limit for %s - Attempts: %d/%d", ip, pathPrefix, attempts, maxAttempts)
 }
 
-func (fl *FirewallLogger) LogWhitelist(ip string) {
-	fl.writeLog(INFO, "WHITELIST", "IP: %s allowed by whitelist", ip)
+func (fl *FirewallLogger) LogTransferExceeded(ip string, direction TransferDirection, limit string, written int64) {
+	category := "EGRESS"
+	if direction == TransferIn {
+		category = "INGRESS"
+	}
+	fl.writeLog(SECURITY, category, "IP: %s exceeded %s after %d bytes - connection closed", ip, limit, written)
 }
 
-func (fl *FirewallLogger) LogRateLimit(ip string, attempts int, maxAttempts int) {
-	fl.writeLog(SECURITY, "RATE_LIMIT", "IP: %s exceeded rate limit - Attempts: %d/%d", ip, attempts, maxAttempts)
+func (fl *FirewallLogger) LogAnomaly(ip string, score float64, details, action string) {
+	fl.writeLog(SECURITY, "ANOMALY", "IP: %s flagged with behavior score %.2f (%s) - Action: %s", ip, score, details, action)
 }
 
 func (fl *FirewallLogger) LogRulesReload(blockedIPs, whitelist int, allowedPorts []int, maxAttempts int) {
@@ -159,16 +283,20 @@ func (fl *FirewallLogger) LogError(category, message string, args ...interface{}
 	fl.writeLog(ERROR, category, message, args...)
 }
 
+func (fl *FirewallLogger) LogInfo(category, message string, args ...interface{}) {
+	fl.writeLog(INFO, category, message, args...)
+}
+
 func (fl *FirewallLogger) LogWarning(category, message string, args ...interface{}) {
 	fl.writeLog(WARNING, category, message, args...)
 }
 
-func (fl *FirewallLogger) LogDebug(category, message string, args ...interface{}) {
-	fl.writeLog(DEBUG, category, message, args...)
+func (fl *FirewallLogger) LogLevelChanged(level LogLevel) {
+	fl.writeLog(WARNING, "LOGGING", "Minimum log level set to %s", level)
 }
 
-func (fl *FirewallLogger) LogProxy(ip, proxyHost string, proxyPort int, status string) {
-	fl.writeLog(INFO, "PROXY", "IP: %s -> %s:%d - Status: %s", ip, proxyHost, proxyPort, status)
+func (fl *FirewallLogger) LogDebug(category, message string, args ...interface{}) {
+	fl.writeLog(DEBUG, category, message, args...)
 }
 
 func (fl *FirewallLogger) LogCleanup(deletedEntries int) {
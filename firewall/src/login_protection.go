@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// LoginProtection auto-blocks clients that collect too many failed responses
+// from the chat's login endpoints. Failures are detected from the upstream's
+// status code, which the plain connection rate limiter never sees.
+type LoginProtection struct {
+	Enabled              bool     `json:"enabled"`
+	Paths                []string `json:"paths"`
+	FailureStatuses      []int    `json:"failure_statuses"`
+	MaxFailures          int      `json:"max_failures"`
+	WindowSeconds        int      `json:"window_seconds"`
+	BlockDurationMinutes int      `json:"block_duration_minutes"`
+}
+
+func normalizeLoginProtection(lp LoginProtection) LoginProtection {
+	if len(lp.Paths) == 0 {
+		lp.Paths = []string{"/api/login"}
+	}
+	for i, p := range lp.Paths {
+		lp.Paths[i] = normalizeRequestPath(p)
+	}
+	if len(lp.FailureStatuses) == 0 {
+		lp.FailureStatuses = []int{401, 403}
+	}
+	if lp.MaxFailures <= 0 {
+		lp.MaxFailures = 5
+	}
+	if lp.WindowSeconds <= 0 {
+		lp.WindowSeconds = 300
+	}
+	if lp.BlockDurationMinutes <= 0 {
+		lp.BlockDurationMinutes = 60
+	}
+	return lp
+}
+
+func (lp LoginProtection) Watches(requestPath string) bool {
+	if !lp.Enabled {
+		return false
+	}
+	normalized := normalizeRequestPath(requestPath)
+	for _, p := range lp.Paths {
+		if pathHasPrefix(normalized, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (lp LoginProtection) IsFailure(status int) bool {
+	for _, failure := range lp.FailureStatuses {
+		if status == failure {
+			return true
+		}
+	}
+	return false
+}
+
+func (fw *Firewall) loginProtection() LoginProtection {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.LoginProtection
+}
+
+// recordLoginResult is fed the upstream status for a watched login request
+// and auto-blocks key once it crosses max_failures within the window.
+func (fw *Firewall) recordLoginResult(ip, key string, status int) {
+	lp := fw.loginProtection()
+	if !lp.IsFailure(status) {
+		return
+	}
+	fw.recordRisk(ip, key, RiskSignalLoginFailure, 1)
+
+	now := fw.clock.Now()
+	window := time.Duration(lp.WindowSeconds) * time.Second
+
+	fw.attemptsMutex.Lock()
+	defer fw.attemptsMutex.Unlock()
+
+	var validFailures []time.Time
+	for _, failure := range fw.loginFailures[key] {
+		if now.Sub(failure) < window {
+			validFailures = append(validFailures, failure)
+		}
+	}
+	validFailures = append(validFailures, now)
+
+	if len(validFailures) < lp.MaxFailures {
+		fw.loginFailures[key] = validFailures
+		return
+	}
+
+	delete(fw.loginFailures, key)
+	fw.autoBlockLocked(key, "LOGIN_BRUTE_FORCE", now.Add(time.Duration(lp.BlockDurationMinutes)*time.Minute))
+
+	if fw.logger != nil {
+		fw.logger.LogBlocked(ip, "LOGIN_BRUTE_FORCE",
+			fmt.Sprintf("%s blocked for %dm after %d failed logins in %v (last status %d)",
+				key, lp.BlockDurationMinutes, len(validFailures), window, status))
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type lookupEntry[T any] struct {
+	value   T
+	expires time.Time
+	done    chan struct{}
+}
+
+// LookupCache caches the answers of slow per-IP lookups (DNSBL, reverse DNS)
+// and makes sure each IP is looked up once at a time.
+type LookupCache[T any] struct {
+	mutex   sync.Mutex
+	entries map[string]*lookupEntry[T]
+}
+
+func NewLookupCache[T any]() *LookupCache[T] {
+	return &LookupCache[T]{
+		entries: make(map[string]*lookupEntry[T]),
+	}
+}
+
+// Cached returns ip's answer if one is known and fresh.
+func (lc *LookupCache[T]) Cached(ip string, now time.Time) (T, bool) {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	var zero T
+	entry, exists := lc.entries[ip]
+	if !exists || entry.done != nil || now.After(entry.expires) {
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// Lookup returns ip's cached answer, or starts a lookup with resolve and
+// waits up to wait for it. Concurrent callers for the same IP share one
+// lookup. resolve returns the answer and how long to cache it.
+func (lc *LookupCache[T]) Lookup(ip string, now time.Time, wait time.Duration, resolve func() (T, time.Duration)) (T, bool) {
+	var zero T
+
+	lc.mutex.Lock()
+	entry, exists := lc.entries[ip]
+	if exists && entry.done == nil && now.After(entry.expires) {
+		exists = false
+	}
+	if !exists {
+		if len(lc.entries) >= MaxTrackedIPs {
+			lc.cleanupLocked(now)
+		}
+		if len(lc.entries) >= MaxTrackedIPs {
+			lc.mutex.Unlock()
+			return zero, false
+		}
+		entry = &lookupEntry[T]{done: make(chan struct{})}
+		lc.entries[ip] = entry
+		go lc.resolve(entry, now, resolve)
+	}
+	done := entry.done
+	value := entry.value
+	lc.mutex.Unlock()
+
+	if done == nil {
+		return value, true
+	}
+	if wait <= 0 {
+		return zero, false
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-done:
+		lc.mutex.Lock()
+		defer lc.mutex.Unlock()
+		return entry.value, true
+	case <-timer.C:
+		return zero, false
+	}
+}
+
+func (lc *LookupCache[T]) resolve(entry *lookupEntry[T], now time.Time, resolve func() (T, time.Duration)) {
+	value, ttl := resolve()
+
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	entry.value = value
+	entry.expires = now.Add(ttl)
+	close(entry.done)
+	entry.done = nil
+}
+
+// Cleanup drops expired answers.
+func (lc *LookupCache[T]) Cleanup(now time.Time) {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	lc.cleanupLocked(now)
+}
+
+func (lc *LookupCache[T]) cleanupLocked(now time.Time) {
+	for ip, entry := range lc.entries {
+		if entry.done == nil && now.After(entry.expires) {
+			delete(lc.entries, ip)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import "container/list"
+
+// ipLRU keeps tracked IPs ordered by last activity so eviction under memory
+// pressure can prefer idle entries over clients that are actively hitting us.
+type ipLRU struct {
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newIPLRU() *ipLRU {
+	return &ipLRU{
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (l *ipLRU) Touch(ip string) {
+	if el, exists := l.items[ip]; exists {
+		l.order.MoveToFront(el)
+		return
+	}
+	l.items[ip] = l.order.PushFront(ip)
+}
+
+func (l *ipLRU) Remove(ip string) {
+	if el, exists := l.items[ip]; exists {
+		l.order.Remove(el)
+		delete(l.items, ip)
+	}
+}
+
+func (l *ipLRU) Len() int {
+	return len(l.items)
+}
+
+// Oldest returns up to n least-recently-seen IPs, oldest first.
+func (l *ipLRU) Oldest(n int) []string {
+	result := make([]string, 0, n)
+	for el := l.order.Back(); el != nil && len(result) < n; el = el.Prev() {
+		result = append(result, el.Value.(string))
+	}
+	return result
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultMemoryBudgetMB        = 16
+	DefaultMemoryShrinkPercent   = 80
+	DefaultMemoryBudgetCheckSecs = 10
+	DefaultTrackedBytesPerClient = 1024
+	ShrunkAttemptsWindow         = 30 * time.Second
+	ShrunkHourlyWindow           = 30 * time.Minute
+	CoarseIPv4AggregationPrefix  = 24
+	CoarseIPv6AggregationPrefix  = 48
+
+	// Rough per-entry costs: a map entry with its key string and slice
+	// header, and one time.Time.
+	trackedKeyBytes  = 160
+	trackedTimeBytes = 24
+)
+
+const (
+	MemoryNormal = iota
+	// MemoryShrinking prunes attempt history to shorter windows.
+	MemoryShrinking
+	// MemoryCoarse also accounts new clients against wider prefixes.
+	MemoryCoarse
+)
+
+var memoryLevelNames = []string{"normal", "shrinking", "coarse"}
+
+// MemoryBudget bounds the memory spent tracking clients (attempt histories,
+// login failures, SYN counters and auto-blocks), estimated from entry counts
+// every CheckSeconds. Past ShrinkAtPercent the firewall keeps shorter
+// histories; over budget it also aggregates new clients by /24 (IPv4) and /48
+// (IPv6) until usage falls back under ShrinkAtPercent, and evicts the least
+// active clients past what the budget holds.
+type MemoryBudget struct {
+	MaxMB           int `json:"max_mb"`
+	ShrinkAtPercent int `json:"shrink_at_percent"`
+	CheckSeconds    int `json:"check_seconds"`
+}
+
+func normalizeMemoryBudget(budget MemoryBudget) MemoryBudget {
+	if budget.MaxMB <= 0 {
+		budget.MaxMB = DefaultMemoryBudgetMB
+	}
+	if budget.ShrinkAtPercent <= 0 || budget.ShrinkAtPercent > 100 {
+		budget.ShrinkAtPercent = DefaultMemoryShrinkPercent
+	}
+	if budget.CheckSeconds <= 0 {
+		budget.CheckSeconds = DefaultMemoryBudgetCheckSecs
+	}
+	return budget
+}
+
+func (fw *Firewall) memoryBudget() MemoryBudget {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.MemoryBudget
+}
+
+func (budget MemoryBudget) bytes() int64 {
+	return int64(budget.MaxMB) << 20
+}
+
+type MemoryBudgetStatus struct {
+	At          time.Time `json:"at"`
+	Bytes       int64     `json:"estimated_bytes"`
+	BudgetBytes int64     `json:"budget_bytes"`
+	Percent     float64   `json:"percent"`
+	Clients     int       `json:"tracked_clients"`
+	ClientLimit int       `json:"client_limit"`
+	Level       string    `json:"level"`
+}
+
+// MemoryPressure holds the outcome of the last budget check.
+type MemoryPressure struct {
+	level          atomic.Int32
+	bytesPerClient atomic.Int64
+	mutex          sync.Mutex
+	last           MemoryBudgetStatus
+}
+
+func NewMemoryPressure() *MemoryPressure {
+	mp := &MemoryPressure{}
+	mp.bytesPerClient.Store(DefaultTrackedBytesPerClient)
+	return mp
+}
+
+func (mp *MemoryPressure) Level() int {
+	return int(mp.level.Load())
+}
+
+func (mp *MemoryPressure) Status() MemoryBudgetStatus {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	return mp.last
+}
+
+// trackedClientLimit is how many clients fit in the budget at the per-client
+// cost last measured.
+func (fw *Firewall) trackedClientLimit() int {
+	return int(fw.memoryBudget().bytes() / fw.memory.bytesPerClient.Load())
+}
+
+// estimateTrackingBytes returns the estimated size of the tracking state and
+// the number of clients it covers.
+func (fw *Firewall) estimateTrackingBytes() (int64, int) {
+	var bytes int64
+	add := func(history map[string][]time.Time) {
+		for _, times := range history {
+			bytes += trackedKeyBytes + int64(len(times))*trackedTimeBytes
+		}
+	}
+
+	fw.attemptsMutex.RLock()
+	clients := len(fw.connectionAttempts)
+	for _, history := range []map[string][]time.Time{fw.connectionAttempts, fw.hourlyAttempts, fw.endpointAttempts, fw.loginFailures} {
+		add(history)
+	}
+	bytes += int64(len(fw.autoBlockedIPs)) * (trackedKeyBytes + trackedTimeBytes)
+	fw.attemptsMutex.RUnlock()
+
+	fw.synFloodMutex.RLock()
+	add(fw.synFloodTracker)
+	bytes += int64(len(fw.activeConnsByIP)) * trackedKeyBytes
+	fw.synFloodMutex.RUnlock()
+	return bytes, clients
+}
+
+// checkMemoryBudget estimates the tracking state against budget and moves to
+// the matching level, pruning straight away when pressure rises.
+func (fw *Firewall) checkMemoryBudget(budget MemoryBudget) MemoryBudgetStatus {
+	bytes, clients := fw.estimateTrackingBytes()
+	if clients > 0 {
+		fw.memory.bytesPerClient.Store(max(bytes/int64(clients), trackedKeyBytes+trackedTimeBytes))
+	}
+
+	percent := float64(bytes) * 100 / float64(budget.bytes())
+	previous := fw.memory.Level()
+	level := MemoryNormal
+	switch {
+	case percent >= 100:
+		level = MemoryCoarse
+	case percent >= float64(budget.ShrinkAtPercent):
+		level = max(previous, MemoryShrinking)
+	}
+	fw.memory.level.Store(int32(level))
+
+	status := MemoryBudgetStatus{
+		At:          fw.clock.Now(),
+		Bytes:       bytes,
+		BudgetBytes: budget.bytes(),
+		Percent:     percent,
+		Clients:     clients,
+		ClientLimit: fw.trackedClientLimit(),
+		Level:       memoryLevelNames[level],
+	}
+	fw.memory.mutex.Lock()
+	fw.memory.last = status
+	fw.memory.mutex.Unlock()
+
+	if level == previous {
+		return status
+	}
+	if fw.logger != nil {
+		if level > previous {
+			fw.logger.LogWarning("MEMORY", "Tracking state at %.0f%% of %d MB budget - level %s",
+				percent, budget.MaxMB, memoryLevelNames[level])
+		} else {
+			fw.logger.LogInfo("MEMORY", "Tracking state at %.0f%% of %d MB budget - back to %s",
+				percent, budget.MaxMB, memoryLevelNames[level])
+		}
+	}
+	if level > previous {
+		fw.cleanupOldAttempts()
+	}
+	return status
+}
+
+func (fw *Firewall) memoryBudgetWatcher() {
+	elapsed := 0
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		budget := fw.memoryBudget()
+		elapsed++
+		if elapsed < budget.CheckSeconds {
+			continue
+		}
+		elapsed = 0
+		fw.checkMemoryBudget(budget)
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MiddlewareStage is when a middleware runs: on accept, knowing only the
+// client's address, or once its request head has been read.
+type MiddlewareStage int
+
+const (
+	StageAccept MiddlewareStage = iota
+	StageRequest
+	// StageBody is once the request body has been read as well. Only
+	// policies that read the body run there.
+	StageBody
+)
+
+// Middleware is one check of the connection handling chain. Handle returns
+// false once it has refused or answered the connection, which ends the
+// chain.
+type Middleware struct {
+	Name  string
+	Stage MiddlewareStage
+	// SkipWhitelisted and SkipExempt leave whitelisted and rate limit exempt
+	// clients alone.
+	SkipWhitelisted bool
+	SkipExempt      bool
+	// PerConnection request middleware only see a connection's first
+	// request; the others run again for every request of a keep-alive
+	// connection.
+	PerConnection bool
+	Handle        func(fw *Firewall, ms *MiddlewareState) bool
+}
+
+// MiddlewareState is what the middleware of one connection see and leave
+// for those after them.
+type MiddlewareState struct {
+	Conn     net.Conn
+	ConnID   string
+	IP       string
+	Key      string
+	Hostname string
+	Logger   *FirewallLogger
+	Record   *ConnectionRecord
+
+	Decision    PrecedenceDecision
+	Whitelisted bool
+	Exempt      bool
+	Verdict     StaticVerdict
+
+	// Set when the client must pass the cookie challenge once its request
+	// head is read: why, and for how long a passed challenge holds.
+	Challenge         string
+	ChallengeValidFor time.Duration
+
+	// Set when the client is over its rate limit but may hold a trust
+	// cookie, which is only known once its request head is read.
+	RateLimitedUnlessTrusted bool
+
+	// Set for StageRequest.
+	Port int
+	Head *RequestHead
+	// Body is the request body, decoded, for StageBody.
+	Body []byte
+	// FollowUp is set for the requests after the first on a connection.
+	FollowUp bool
+
+	// UpstreamHeaders are set on the request sent upstream; a name
+	// without values is removed.
+	UpstreamHeaders http.Header
+
+	// Tenant is the tenant the request's Host belongs to, if any.
+	Tenant *tenantRules
+
+	// APIClient is the registered client whose key the request carries.
+	APIClient *APIClient
+
+	// QuotaCharges are the quotas the connection's bytes count against.
+	QuotaCharges []quotaCharge
+}
+
+func (ms *MiddlewareState) Block(reason, details string) {
+	ms.Logger.LogBlocked(ms.IP, reason, details)
+	ms.Record.Block(reason)
+}
+
+var (
+	middlewareMutex    sync.Mutex
+	middlewareRegistry []Middleware
+)
+
+// RegisterMiddleware adds m to the end of its stage in the default chain, or
+// replaces the middleware of the same name. Register from an init function,
+// before the rules are loaded.
+func RegisterMiddleware(m Middleware) {
+	middlewareMutex.Lock()
+	defer middlewareMutex.Unlock()
+
+	for i, registered := range middlewareRegistry {
+		if registered.Name == m.Name {
+			middlewareRegistry[i] = m
+			return
+		}
+	}
+	middlewareRegistry = append(middlewareRegistry, m)
+}
+
+func registeredMiddleware() []Middleware {
+	middlewareMutex.Lock()
+	defer middlewareMutex.Unlock()
+
+	return append([]Middleware(nil), middlewareRegistry...)
+}
+
+// MiddlewareConfig reorders and disables middleware by name. Middleware
+// left out of Order keep their default position after those listed; the
+// order only applies within a stage, as request middleware can't run before
+// the request is read.
+type MiddlewareConfig struct {
+	Order    []string `json:"order"`
+	Disabled []string `json:"disabled"`
+}
+
+// normalizeMiddlewareConfig keeps the known names of order, adds those it
+// leaves out in their default position, and drops unknown disabled names.
+func normalizeMiddlewareConfig(config MiddlewareConfig) MiddlewareConfig {
+	known := make(map[string]bool)
+	for _, m := range registeredMiddleware() {
+		known[m.Name] = true
+	}
+
+	seen := make(map[string]bool)
+	var order []string
+	for _, name := range config.Order {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if known[name] && !seen[name] {
+			order = append(order, name)
+			seen[name] = true
+		}
+	}
+	for _, m := range registeredMiddleware() {
+		if !seen[m.Name] {
+			order = append(order, m.Name)
+			seen[m.Name] = true
+		}
+	}
+
+	var disabled []string
+	for _, name := range config.Disabled {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if known[name] {
+			disabled = append(disabled, name)
+		}
+	}
+	return MiddlewareConfig{Order: order, Disabled: disabled}
+}
+
+// middlewareProblems lists the names in config that aren't registered.
+func middlewareProblems(config MiddlewareConfig) []string {
+	known := make(map[string]bool)
+	for _, m := range registeredMiddleware() {
+		known[m.Name] = true
+	}
+	var problems []string
+	for field, names := range map[string][]string{"order": config.Order, "disabled": config.Disabled} {
+		for _, name := range names {
+			if !known[strings.ToLower(strings.TrimSpace(name))] {
+				problems = append(problems, fmt.Sprintf("%s: unknown middleware %q", field, name))
+			}
+		}
+	}
+	return problems
+}
+
+// middlewareChain is the enabled middleware of each stage, in order.
+type middlewareChain struct {
+	Accept  []Middleware
+	Request []Middleware
+}
+
+func buildMiddlewareChain(config MiddlewareConfig) middlewareChain {
+	config = normalizeMiddlewareConfig(config)
+	disabled := make(map[string]bool, len(config.Disabled))
+	for _, name := range config.Disabled {
+		disabled[name] = true
+	}
+	byName := make(map[string]Middleware)
+	for _, m := range registeredMiddleware() {
+		byName[m.Name] = m
+	}
+
+	var chain middlewareChain
+	for _, name := range config.Order {
+		m := byName[name]
+		if disabled[name] || m.Handle == nil {
+			continue
+		}
+		if m.Stage == StageAccept {
+			chain.Accept = append(chain.Accept, m)
+		} else {
+			chain.Request = append(chain.Request, m)
+		}
+	}
+	return chain
+}
+
+func (fw *Firewall) middlewareChain() middlewareChain {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	if fw.parsedRules == nil {
+		return buildMiddlewareChain(MiddlewareConfig{})
+	}
+	return fw.parsedRules.Middleware
+}
+
+// runMiddleware runs chain in order, skipping middleware that leave ms's
+// client alone, and reports whether the connection got through.
+func (fw *Firewall) runMiddleware(chain []Middleware, ms *MiddlewareState) bool {
+	for _, m := range chain {
+		if (m.SkipWhitelisted && ms.Whitelisted) || (m.SkipExempt && ms.Exempt) || (m.PerConnection && ms.FollowUp) {
+			continue
+		}
+		if !m.Handle(fw, ms) {
+			return false
+		}
+	}
+	return true
+}
+
+// followUpConn is the client connection as the middleware of a later
+// request see it. What they answer is held until Flush, as responses to
+// earlier requests may still be on their way to the client.
+type followUpConn struct {
+	net.Conn
+	held bytes.Buffer
+}
+
+func (fc *followUpConn) Write(p []byte) (int, error) {
+	return fc.held.Write(p)
+}
+
+func (fc *followUpConn) Flush() error {
+	_, err := fc.Conn.Write(fc.held.Bytes())
+	return err
+}
+
+// checkFollowUp runs the request middleware for a later request on ms's
+// keep-alive connection, so each request meets the same checks as the
+// first, and reports whether it got through. The state returned is the
+// request's own; its Conn is a followUpConn.
+func (fw *Firewall) checkFollowUp(chain []Middleware, ms *MiddlewareState, head *messageHead, requestID string) (*MiddlewareState, bool) {
+	request := *ms
+	request.Conn = &followUpConn{Conn: ms.Conn}
+	request.ConnID = requestID
+	request.FollowUp = true
+	request.Head = requestHeadFromMessage(head)
+	request.Port = fw.requestedPort(ms.Conn, request.Head.Host())
+	// Tenant stays the first request's, whose upstream the connection is
+	// routed to, for the tenant middleware to compare.
+	request.UpstreamHeaders, request.APIClient, request.QuotaCharges, request.Body = nil, nil, nil, nil
+	return &request, fw.runMiddleware(chain, &request)
+}
+
+func init() {
+	for _, m := range []Middleware{
+		{Name: "blocklist", Stage: StageAccept, Handle: blocklistMiddleware},
+		{Name: "allowlist_only", Stage: StageAccept, SkipWhitelisted: true, Handle: allowlistOnlyMiddleware},
+		{Name: "syn_flood", Stage: StageAccept, SkipWhitelisted: true, SkipExempt: true, Handle: synFloodMiddleware},
+		{Name: "connection_limit", Stage: StageAccept, SkipWhitelisted: true, Handle: connectionLimitMiddleware},
+		{Name: "static_rules", Stage: StageAccept, SkipWhitelisted: true, Handle: staticRulesMiddleware},
+		{Name: "risk_score", Stage: StageAccept, SkipWhitelisted: true, Handle: riskScoreMiddleware},
+		{Name: "rate_limit", Stage: StageAccept, SkipWhitelisted: true, SkipExempt: true, Handle: rateLimitMiddleware},
+		{Name: "country_budget", Stage: StageAccept, SkipWhitelisted: true, SkipExempt: true, Handle: countryBudgetMiddleware},
+
+		{Name: "port_scan", Stage: StageRequest, SkipWhitelisted: true, PerConnection: true, Handle: portScanMiddleware},
+		{Name: "allowed_ports", Stage: StageRequest, SkipWhitelisted: true, Handle: allowedPortsMiddleware},
+		{Name: "host", Stage: StageRequest, SkipWhitelisted: true, Handle: hostMiddleware},
+		{Name: "trust_cookie", Stage: StageRequest, SkipWhitelisted: true, Handle: trustCookieMiddleware},
+		{Name: "challenge", Stage: StageRequest, SkipWhitelisted: true, Handle: challengeMiddleware},
+		{Name: "endpoint_rate_limit", Stage: StageRequest, SkipWhitelisted: true, SkipExempt: true, Handle: endpointRateLimitMiddleware},
+		{Name: "protocol_rate_limit", Stage: StageRequest, SkipWhitelisted: true, SkipExempt: true, PerConnection: true, Handle: protocolRateLimitMiddleware},
+		{Name: "cors", Stage: StageRequest, Handle: corsMiddleware},
+		{Name: "transfer_quota", Stage: StageRequest, Handle: transferQuotaMiddleware},
+	} {
+		RegisterMiddleware(m)
+	}
+}
+
+// blocklistMiddleware applies always_block, whitelist, blocked_ips and
+// auto-blocks, in the configured order.
+func blocklistMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	ms.Decision = fw.decidePrecedence(ms.IP, ms.Key, fw.clock.Now())
+	if ms.Decision.Rule != "" {
+		ms.Record.Rule = ms.Decision.String()
+		fw.groupHits.Record(ms.Decision.Group)
+	}
+	if ms.Decision.Block {
+		ms.Block(ms.Decision.BlockReason(), fmt.Sprintf("%s matched %s", ms.IP, ms.Decision))
+		if ms.Decision.Rule == RuleAlwaysBlock {
+			fw.rejectBlocked(ms.Conn, ms.ConnID, http.StatusForbidden, "Access from your network has been blocked.", 0)
+		} else {
+			fw.rejectAutoBlocked(ms.Conn, ms.ConnID, ms.Key)
+		}
+		return false
+	}
+	if ms.Decision.Rule == RuleWhitelist {
+		ms.Whitelisted = true
+		ms.Record.Reason = "WHITELIST"
+	}
+	return true
+}
+
+func allowlistOnlyMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	if !fw.allowlistOnly() {
+		return true
+	}
+	ms.Block("NOT_ALLOWLISTED", "Allowlist-only mode")
+	fw.rejectBlocked(ms.Conn, ms.ConnID, http.StatusForbidden, "This DockerChat instance is private.", 0)
+	return false
+}
+
+func synFloodMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	if !fw.isSynFlooding(ms.Key) {
+		return true
+	}
+	ms.Block("SYN_FLOOD", "SYN flood protection triggered")
+	return false
+}
+
+func connectionLimitMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	if !fw.hasTooManyConnections(ms.IP) {
+		return true
+	}
+	fw.synFloodMutex.RLock()
+	active := fw.activeConnsByIP[ms.IP]
+	fw.synFloodMutex.RUnlock()
+	ms.Block("TOO_MANY_CONNECTIONS", fmt.Sprintf("Too many active connections (%d/%d)", active, MaxConnectionsPerIP))
+	return false
+}
+
+// staticRulesMiddleware applies blocked ASNs, the country policy, IP lists,
+// DNSBLs and reverse DNS deny rules, through the decision cache.
+func staticRulesMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	verdict, cached := fw.staticVerdict(ms.IP, ms.Hostname)
+	if cached {
+		ms.Record.Event("cached verdict")
+	}
+	ms.Verdict = verdict
+	if verdict.Blocked() {
+		fw.groupHits.Record(verdict.Group)
+		ms.Block(verdict.Reason, verdict.Details)
+		fw.rejectBlocked(ms.Conn, ms.ConnID, http.StatusForbidden, verdict.Message, 0)
+		return false
+	}
+	if verdict.Challenge != "" {
+		ms.Challenge, ms.ChallengeValidFor = verdict.Challenge, verdict.ChallengeValidFor
+	}
+	return true
+}
+
+func riskScoreMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	risk := fw.assessRisk(ms.IP, ms.Key, ms.Verdict.ListedOnIPList, ms.Verdict.ListedOnDNSBL)
+	if risk.Block {
+		ms.Record.Block("RISK_SCORE")
+		fw.rejectAutoBlocked(ms.Conn, ms.ConnID, ms.Key)
+		return false
+	}
+	if risk.Challenge {
+		ms.Record.Event("risk score %.1f", risk.Score)
+		if ms.Challenge == "" {
+			ms.Challenge = fmt.Sprintf("at risk score %.0f", risk.Score)
+			ms.ChallengeValidFor = time.Duration(fw.riskScoring().ChallengeValidHours) * time.Hour
+		}
+	}
+	return true
+}
+
+// rateLimitMiddleware defers the decision to trust_cookie when trust cookies
+// are enabled.
+func rateLimitMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	if !fw.isRateLimited(ms.Key) {
+		return true
+	}
+	if fw.trustCookieConfig().Enabled || fw.apiKeyConfig().Enabled {
+		ms.RateLimitedUnlessTrusted = true
+		return true
+	}
+	ms.Logger.LogRateLimit(ms.Key, len(fw.connectionAttempts[ms.Key]), fw.perMinuteLimit(ms.Key))
+	ms.Record.Block("RATE_LIMIT")
+	fw.trackHourlyAttempts(ms.Key)
+	fw.recordRisk(ms.IP, ms.Key, RiskSignalRateLimit, 1)
+	fw.rejectBlocked(ms.Conn, ms.ConnID, http.StatusTooManyRequests, "Too many requests, please slow down.", time.Minute)
+	return false
+}
+
+func countryBudgetMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	countries, country := fw.countryPolicy(), ms.Verdict.Country
+	budget := countries.Budget(country)
+	if !countries.Enabled || country == "" || budget <= 0 {
+		return true
+	}
+	if admitted, count := fw.countries.Admit(country, budget, fw.clock.Now()); !admitted {
+		ms.Block("COUNTRY_BUDGET", fmt.Sprintf("%d/%d connections per minute from %s", count, budget, country))
+		fw.trackHourlyAttempts(ms.Key)
+		fw.rejectBlocked(ms.Conn, ms.ConnID, http.StatusServiceUnavailable, "DockerChat is busy right now.", time.Minute)
+		return false
+	}
+	return true
+}
+
+func portScanMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	if !fw.recordPortTouch(ms.IP, ms.Key, ms.Port) {
+		return true
+	}
+	ms.Record.Block("SCAN_DETECTED")
+	fw.writeHTTPError(ms.Conn, ms.ConnID, http.StatusForbidden, "Access from your network has been blocked.", fw.autoBlockRemaining(ms.Key))
+	return false
+}
+
+func allowedPortsMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	if fw.isAllowedPort(ms.Port) {
+		return true
+	}
+	ms.Block("BLOCKED_PORT", fmt.Sprintf("Port %d not allowed", ms.Port))
+	fw.writeHTTPError(ms.Conn, ms.ConnID, http.StatusForbidden, "This port is not served.", 0)
+	return false
+}
+
+// hostMiddleware checks the Host of every request, not only a connection's
+// first, so a later request can't slip a spoofed Host past allowed_hosts.
+func hostMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	status, reason := validateHost(ms.Head, fw.allowedHosts())
+	if status == 0 {
+		return true
+	}
+	ms.Block("INVALID_HOST", reason)
+	fw.writeHTTPError(ms.Conn, ms.ConnID, status, reason, 0)
+	return false
+}
+
+// trustCookieMiddleware admits a rate limited client holding a valid trust
+// cookie, within its trusted limit.
+func trustCookieMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	if !ms.RateLimitedUnlessTrusted {
+		return true
+	}
+	if ms.APIClient != nil {
+		ms.Record.Event("API client %s, not limited per IP", ms.APIClient.Name)
+		return true
+	}
+	config := fw.trustCookieConfig()
+	user, err := fw.trustedUser(ms.Head)
+	attempts, limit, within := fw.withinTrustedLimit(ms.Key, config)
+	if !config.Enabled || err != nil || !within {
+		ms.Logger.LogRateLimit(ms.Key, attempts, fw.perMinuteLimit(ms.Key))
+		ms.Record.Block("RATE_LIMIT")
+		fw.recordRisk(ms.IP, ms.Key, RiskSignalRateLimit, 1)
+		fw.writeHTTPError(ms.Conn, ms.ConnID, http.StatusTooManyRequests, "Too many requests, please slow down.", time.Minute)
+		return false
+	}
+	ms.Record.Event("trusted session for %s, %d/%d attempts", user, attempts, limit)
+	return true
+}
+
+func challengeMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	if ms.Challenge == "" || fw.challengePassed(ms.Head, ms.Key) {
+		return true
+	}
+	ms.Block("CHALLENGED", fmt.Sprintf("%s is %s, no valid challenge cookie", ms.IP, ms.Challenge))
+	fw.writeChallenge(ms.Conn, ms.ConnID, ms.Key, ms.ChallengeValidFor)
+	return false
+}
+
+func endpointRateLimitMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	limit, attempts, limited := fw.isEndpointRateLimited(ms.Key, ms.Head.Path())
+	if !limited {
+		return true
+	}
+	ms.Logger.LogEndpointRateLimit(ms.Key, limit.PathPrefix, attempts, limit.MaxAttemptsPerMinute)
+	ms.Record.Block("ENDPOINT_RATE_LIMIT")
+	fw.recordRisk(ms.IP, ms.Key, RiskSignalRateLimit, 1)
+	fw.writeHTTPError(ms.Conn, ms.ConnID, http.StatusTooManyRequests, "Too many requests to "+limit.PathPrefix, time.Minute)
+	return false
+}
+
+func protocolRateLimitMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	limit, attempts, limited := fw.isProtocolRateLimited(ms.Key, ms.Record.Protocol)
+	if !limited {
+		return true
+	}
+	ms.Block("PROTOCOL_RATE_LIMIT", fmt.Sprintf("%d/%d %s connections per minute", attempts, limit.MaxAttemptsPerMinute, limit.Protocol))
+	fw.recordRisk(ms.IP, ms.Key, RiskSignalRateLimit, 1)
+	fw.writeHTTPError(ms.Conn, ms.ConnID, http.StatusTooManyRequests, "Too many "+limit.Protocol+" connections", time.Minute)
+	return false
+}
+
+// corsMiddleware refuses disallowed cross-origin requests and answers
+// preflights itself.
+func corsMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	cors := fw.corsPolicy()
+	if !cors.Enabled {
+		return true
+	}
+	reason, preflight := cors.checkCORS(ms.Head)
+	if reason != "" {
+		ms.Block("CORS_DENIED", reason)
+		fw.writeHTTPError(ms.Conn, ms.ConnID, http.StatusForbidden, "Cross-origin request not allowed.", 0)
+		return false
+	}
+	if preflight {
+		ms.Record.Event("answered CORS preflight from %s", ms.Head.Header.Get("Origin"))
+		fw.writeCORSPreflight(ms.Conn, ms.ConnID, cors, ms.Head)
+		return false
+	}
+	return true
+}
+
+func transferQuotaMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	direction, exceeded := fw.transferQuotaExceeded(ms.Key)
+	if !exceeded {
+		return true
+	}
+	if direction == TransferIn {
+		ms.Block("INGRESS_QUOTA", "Daily ingress quota already exhausted")
+	} else {
+		ms.Block("EGRESS_QUOTA", "Daily egress quota already exhausted")
+	}
+	now := fw.clock.Now()
+	fw.writeHTTPError(ms.Conn, ms.ConnID, http.StatusTooManyRequests, "Daily transfer quota exceeded", nextTransferReset(now).Sub(now))
+	return false
+}
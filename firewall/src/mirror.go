@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"time"
+)
+
+const MirrorQueueSize = 64
+
+// MirrorConfig duplicates client->proxy traffic to a shadow upstream whose
+// responses are discarded, for load-testing a new backend with real traffic.
+type MirrorConfig struct {
+	Enabled    bool     `json:"enabled"`
+	Upstream   Upstream `json:"upstream"`
+	Percentage int      `json:"percentage"`
+}
+
+func normalizeMirrorConfig(mirror MirrorConfig) MirrorConfig {
+	if mirror.Percentage <= 0 || mirror.Percentage > 100 {
+		mirror.Percentage = 100
+	}
+	if !mirror.Upstream.Valid() {
+		mirror.Enabled = false
+	}
+	return mirror
+}
+
+// shadowMirror feeds a copy of the request stream to the shadow upstream
+// from its own goroutine. Offer never blocks: if the shadow falls behind, the
+// mirror is abandoned for this connection rather than slowing the client.
+type shadowMirror struct {
+	queue   chan []byte
+	dropped bool
+}
+
+func (fw *Firewall) startMirror(ip string) *shadowMirror {
+	fw.rulesMutex.RLock()
+	config := fw.rules.Mirror
+	fw.rulesMutex.RUnlock()
+
+	if !config.Enabled || rand.Intn(100) >= config.Percentage {
+		return nil
+	}
+
+	sm := &shadowMirror{queue: make(chan []byte, MirrorQueueSize)}
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				fw.logPanic(fw.logger, "mirror", r)
+			}
+		}()
+
+		shadowConn, err := fw.connectUpstream(context.Background(), config.Upstream, 0, ProxyConnectTimeout)
+		if err != nil {
+			fw.logErrorRateLimited("mirror_dial", "MIRROR", "Failed to connect to shadow upstream %s: %v", config.Upstream.Addr(), err)
+			for range sm.queue {
+			}
+			return
+		}
+		defer shadowConn.Close()
+
+		go io.Copy(io.Discard, shadowConn)
+
+		for chunk := range sm.queue {
+			shadowConn.SetWriteDeadline(time.Now().Add(ConnectionTimeout))
+			if _, err := shadowConn.Write(chunk); err != nil {
+				fw.logger.LogDebug("MIRROR", "Shadow write failed for %s: %v", ip, err)
+				for range sm.queue {
+				}
+				return
+			}
+		}
+	}()
+
+	return sm
+}
+
+func (sm *shadowMirror) Offer(p []byte) {
+	if sm == nil || sm.dropped || len(p) == 0 {
+		return
+	}
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+	select {
+	case sm.queue <- chunk:
+	default:
+		sm.dropped = true
+	}
+}
+
+func (sm *shadowMirror) Close() {
+	if sm != nil {
+		close(sm.queue)
+	}
+}
+
+// mirrorTee writes to the real upstream first and then offers the same bytes
+// to the shadow mirror.
+type mirrorTee struct {
+	dst    io.Writer
+	mirror *shadowMirror
+}
+
+func (mt *mirrorTee) Write(p []byte) (int, error) {
+	n, err := mt.dst.Write(p)
+	mt.mirror.Offer(p[:n])
+	return n, err
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdbMetadataMarker precedes the metadata map at the end of a MaxMind DB
+// file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const mmdbDataSeparator = 16
+
+var errMMDBCorrupt = errors.New("mmdb: corrupt database")
+
+// mmdbReader looks addresses up in a MaxMind DB file (GeoLite2/GeoIP2 ASN,
+// Country, City, ...) held in memory. It only reads; it is safe for
+// concurrent use.
+type mmdbReader struct {
+	data         []byte
+	tree         []byte
+	dataSection  []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	databaseType string
+	buildEpoch   uint64
+	ipv4Start    uint
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseMMDB(data)
+}
+
+func parseMMDB(data []byte) (*mmdbReader, error) {
+	markerAt := bytes.LastIndex(data, mmdbMetadataMarker)
+	if markerAt < 0 {
+		return nil, errors.New("mmdb: metadata marker not found")
+	}
+	metadataStart := markerAt + len(mmdbMetadataMarker)
+
+	decoder := mmdbDecoder{data: data[metadataStart:]}
+	value, _, err := decoder.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: metadata: %v", err)
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("mmdb: metadata is not a map")
+	}
+
+	reader := &mmdbReader{data: data}
+	reader.nodeCount = uint(mmdbUint(metadata["node_count"]))
+	reader.recordSize = uint(mmdbUint(metadata["record_size"]))
+	reader.ipVersion = uint(mmdbUint(metadata["ip_version"]))
+	reader.buildEpoch = mmdbUint(metadata["build_epoch"])
+	reader.databaseType, _ = metadata["database_type"].(string)
+
+	switch reader.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", reader.recordSize)
+	}
+	if reader.ipVersion != 4 && reader.ipVersion != 6 {
+		return nil, fmt.Errorf("mmdb: unsupported ip_version %d", reader.ipVersion)
+	}
+
+	if reader.nodeCount > uint(markerAt) {
+		return nil, errMMDBCorrupt
+	}
+	treeSize := reader.nodeCount * reader.recordSize / 4
+	if treeSize+mmdbDataSeparator > uint(markerAt) {
+		return nil, errMMDBCorrupt
+	}
+	reader.tree = data[:treeSize]
+	reader.dataSection = data[treeSize+mmdbDataSeparator : markerAt]
+
+	// IPv4 addresses live under ::/96 in an IPv6 tree.
+	if reader.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < reader.nodeCount; i++ {
+			node = reader.record(node, 0)
+		}
+		reader.ipv4Start = node
+	}
+	return reader, nil
+}
+
+func (mr *mmdbReader) record(node, bit uint) uint {
+	b := mr.tree[node*mr.recordSize/4:]
+	switch mr.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b[0:4]))
+		}
+		return uint(binary.BigEndian.Uint32(b[4:8]))
+	}
+}
+
+// Lookup returns the record for ip, or false when the database has none.
+func (mr *mmdbReader) Lookup(ip net.IP) (interface{}, bool, error) {
+	address := ip.To4()
+	node := uint(0)
+	if address == nil {
+		if mr.ipVersion == 4 {
+			return nil, false, nil
+		}
+		address = ip.To16()
+		if address == nil {
+			return nil, false, nil
+		}
+	} else if mr.ipVersion == 6 {
+		node = mr.ipv4Start
+	}
+
+	bits := uint(len(address) * 8)
+	for i := uint(0); i < bits && node < mr.nodeCount; i++ {
+		bit := uint(address[i/8]>>(7-i%8)) & 1
+		node = mr.record(node, bit)
+	}
+
+	switch {
+	case node == mr.nodeCount:
+		return nil, false, nil
+	case node < mr.nodeCount:
+		return nil, false, errMMDBCorrupt
+	}
+
+	offset := node - mr.nodeCount - mmdbDataSeparator
+	if offset >= uint(len(mr.dataSection)) {
+		return nil, false, errMMDBCorrupt
+	}
+	decoder := mmdbDecoder{data: mr.dataSection}
+	value, _, err := decoder.decode(offset, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+const (
+	mmdbExtended  = 0
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEndMarker = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+
+	mmdbMaxDepth  = 32
+	mmdbMaxValues = 1 << 16
+)
+
+// mmdbDecoder decodes the MaxMind DB data section format into maps, slices,
+// strings, uint64, int64, float64, bool and []byte. Pointers can make a
+// corrupt record fan out exponentially, so one decode visits at most
+// mmdbMaxValues values.
+type mmdbDecoder struct {
+	data    []byte
+	visited int
+}
+
+func (md *mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	md.visited++
+	if depth > mmdbMaxDepth || md.visited > mmdbMaxValues {
+		return nil, 0, errMMDBCorrupt
+	}
+	if offset >= uint(len(md.data)) {
+		return nil, 0, errMMDBCorrupt
+	}
+
+	control := md.data[offset]
+	offset++
+	kind := uint(control >> 5)
+
+	if kind == mmdbPointer {
+		target, next, err := md.pointer(control, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := md.decode(target, depth+1)
+		return value, next, err
+	}
+
+	if kind == mmdbExtended {
+		if offset >= uint(len(md.data)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		kind = 7 + uint(md.data[offset])
+		offset++
+	}
+
+	size := uint(control & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		if offset+extra > uint(len(md.data)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		n := md.uintAt(offset, extra)
+		offset += extra
+		switch extra {
+		case 1:
+			size = 29 + n
+		case 2:
+			size = 285 + n
+		default:
+			size = 65821 + n
+		}
+	}
+
+	switch kind {
+	case mmdbMap:
+		value := make(map[string]interface{}, min(size, 64))
+		for i := uint(0); i < size; i++ {
+			key, next, err := md.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			value[name], offset, err = md.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return value, offset, nil
+	case mmdbArray:
+		value := make([]interface{}, 0, min(size, 64))
+		for i := uint(0); i < size; i++ {
+			var element interface{}
+			var err error
+			element, offset, err = md.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			value = append(value, element)
+		}
+		return value, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	if offset+size > uint(len(md.data)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	raw := md.data[offset : offset+size]
+	next := offset + size
+
+	switch kind {
+	case mmdbString:
+		return string(raw), next, nil
+	case mmdbBytes:
+		return append([]byte(nil), raw...), next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), next, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return uint64(md.uintAt(offset, size)), next, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return int64(int32(md.uintAt(offset, size))), next, nil
+	case mmdbUint128:
+		return append([]byte(nil), raw...), next, nil
+	}
+	return nil, 0, fmt.Errorf("mmdb: unknown data type %d", kind)
+}
+
+// pointer resolves a pointer's target offset and returns the offset after
+// the pointer itself.
+func (md *mmdbDecoder) pointer(control byte, offset uint) (uint, uint, error) {
+	size := uint(control>>3)&0x3 + 1
+	if offset+size > uint(len(md.data)) {
+		return 0, 0, errMMDBCorrupt
+	}
+	n := md.uintAt(offset, size)
+	high := uint(control & 0x7)
+
+	var target uint
+	switch size {
+	case 1:
+		target = high<<8 | n
+	case 2:
+		target = (high<<16 | n) + 2048
+	case 3:
+		target = (high<<24 | n) + 526336
+	default:
+		target = n
+	}
+	return target, offset + size, nil
+}
+
+func (md *mmdbDecoder) uintAt(offset, size uint) uint {
+	n := uint(0)
+	for _, b := range md.data[offset : offset+size] {
+		n = n<<8 | uint(b)
+	}
+	return n
+}
+
+func mmdbUint(value interface{}) uint64 {
+	n, _ := value.(uint64)
+	return n
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mmdbWriter builds small MaxMind DB files for tests: an IPv6 tree with IPv4
+// under ::/96, map/string/uint records, and pointers for repeated map keys.
+type mmdbWriter struct {
+	recordSize int
+	nodes      [][2]mmdbTestRecord
+	data       bytes.Buffer
+	keys       map[string]int
+}
+
+type mmdbTestRecord struct {
+	kind  int // 0 empty, 1 node, 2 data
+	value int
+}
+
+func newMMDBWriter(recordSize int) *mmdbWriter {
+	return &mmdbWriter{
+		recordSize: recordSize,
+		nodes:      make([][2]mmdbTestRecord, 1),
+		keys:       make(map[string]int),
+	}
+}
+
+func (mw *mmdbWriter) Insert(t *testing.T, cidr string, record map[string]interface{}) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("bad CIDR %s: %v", cidr, err)
+	}
+	ones, _ := network.Mask.Size()
+	address := network.IP.To16()
+	if network.IP.To4() != nil {
+		address = append(make([]byte, 12), network.IP.To4()...)
+		ones += 96
+	}
+
+	offset := mw.data.Len()
+	mw.encode(record)
+
+	node := 0
+	for i := 0; i < ones; i++ {
+		bit := int(address[i/8]>>(7-i%8)) & 1
+		if i == ones-1 {
+			mw.nodes[node][bit] = mmdbTestRecord{kind: 2, value: offset}
+			return
+		}
+		next := mw.nodes[node][bit]
+		if next.kind != 1 {
+			mw.nodes = append(mw.nodes, [2]mmdbTestRecord{})
+			next = mmdbTestRecord{kind: 1, value: len(mw.nodes) - 1}
+			mw.nodes[node][bit] = next
+		}
+		node = next.value
+	}
+}
+
+func (mw *mmdbWriter) control(kind, size int) {
+	var extended []byte
+	if kind > 7 {
+		extended = []byte{byte(kind - 7)}
+		kind = 0
+	}
+	switch {
+	case size < 29:
+		mw.data.WriteByte(byte(kind<<5 | size))
+		mw.data.Write(extended)
+	case size < 285:
+		mw.data.WriteByte(byte(kind<<5 | 29))
+		mw.data.Write(extended)
+		mw.data.WriteByte(byte(size - 29))
+	default:
+		mw.data.WriteByte(byte(kind<<5 | 30))
+		mw.data.Write(extended)
+		mw.data.Write([]byte{byte((size - 285) >> 8), byte(size - 285)})
+	}
+}
+
+func (mw *mmdbWriter) encode(value interface{}) {
+	switch v := value.(type) {
+	case string:
+		mw.control(mmdbString, len(v))
+		mw.data.WriteString(v)
+	case uint16:
+		mw.control(mmdbUint16, 2)
+		binary.Write(&mw.data, binary.BigEndian, v)
+	case uint32:
+		mw.control(mmdbUint32, 4)
+		binary.Write(&mw.data, binary.BigEndian, v)
+	case uint64:
+		mw.control(mmdbUint64, 8)
+		binary.Write(&mw.data, binary.BigEndian, v)
+	case map[string]interface{}:
+		mw.control(mmdbMap, len(v))
+		for key, element := range v {
+			if offset, seen := mw.keys[key]; seen && offset < 2048 {
+				mw.data.Write([]byte{byte(mmdbPointer<<5 | offset>>8), byte(offset)})
+			} else {
+				mw.keys[key] = mw.data.Len()
+				mw.encode(key)
+			}
+			mw.encode(element)
+		}
+	default:
+		panic("mmdbWriter: unsupported type")
+	}
+}
+
+func (mw *mmdbWriter) Bytes() []byte {
+	nodeCount := len(mw.nodes)
+	resolve := func(r mmdbTestRecord) uint32 {
+		switch r.kind {
+		case 1:
+			return uint32(r.value)
+		case 2:
+			return uint32(nodeCount + mmdbDataSeparator + r.value)
+		}
+		return uint32(nodeCount)
+	}
+
+	var out bytes.Buffer
+	for _, node := range mw.nodes {
+		left, right := resolve(node[0]), resolve(node[1])
+		switch mw.recordSize {
+		case 24:
+			out.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+		case 28:
+			out.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(left>>24)<<4 | byte(right>>24)&0x0f, byte(right >> 16), byte(right >> 8), byte(right)})
+		default:
+			binary.Write(&out, binary.BigEndian, left)
+			binary.Write(&out, binary.BigEndian, right)
+		}
+	}
+	out.Write(make([]byte, mmdbDataSeparator))
+	out.Write(mw.data.Bytes())
+	out.Write(mmdbMetadataMarker)
+
+	metadata := &mmdbWriter{keys: make(map[string]int)}
+	metadata.encode(map[string]interface{}{
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(mw.recordSize),
+		"ip_version":                  uint16(6),
+		"database_type":               "Test-ASN",
+		"build_epoch":                 uint64(1700000000),
+		"binary_format_major_version": uint16(2),
+	})
+	out.Write(metadata.data.Bytes())
+	return out.Bytes()
+}
+
+func asnRecord(asn uint32, org string) map[string]interface{} {
+	return map[string]interface{}{
+		"autonomous_system_number":       asn,
+		"autonomous_system_organization": org,
+	}
+}
+
+func testASNDatabase(t *testing.T, recordSize int) []byte {
+	mw := newMMDBWriter(recordSize)
+	mw.Insert(t, "192.0.2.0/24", asnRecord(64500, "Example Bulletproof Hosting With A Rather Long Organization Name"))
+	mw.Insert(t, "203.0.113.0/25", asnRecord(64501, "Example Residential"))
+	mw.Insert(t, "2001:db8::/32", asnRecord(64502, "Example IPv6"))
+	return mw.Bytes()
+}
+
+func TestMMDBLookup(t *testing.T) {
+	for _, recordSize := range []int{24, 28, 32} {
+		reader, err := parseMMDB(testASNDatabase(t, recordSize))
+		if err != nil {
+			t.Fatalf("record size %d: %v", recordSize, err)
+		}
+
+		cases := []struct {
+			ip  string
+			asn uint64
+		}{
+			{"192.0.2.77", 64500},
+			{"203.0.113.10", 64501},
+			{"203.0.113.200", 0},
+			{"198.51.100.1", 0},
+			{"2001:db8:1::1", 64502},
+			{"2001:db9::1", 0},
+		}
+		for _, c := range cases {
+			record, found, err := reader.Lookup(net.ParseIP(c.ip))
+			if err != nil {
+				t.Fatalf("record size %d, %s: %v", recordSize, c.ip, err)
+			}
+			var asn uint64
+			if found {
+				asn = mmdbUint(record.(map[string]interface{})["autonomous_system_number"])
+			}
+			if asn != c.asn {
+				t.Errorf("record size %d, %s: AS%d, want AS%d", recordSize, c.ip, asn, c.asn)
+			}
+		}
+	}
+}
+
+func testCountryDatabase(t *testing.T) []byte {
+	country := func(code string) map[string]interface{} {
+		return map[string]interface{}{"country": map[string]interface{}{"iso_code": code}}
+	}
+	mw := newMMDBWriter(24)
+	mw.Insert(t, "203.0.113.0/24", country("CN"))
+	mw.Insert(t, "198.51.100.0/24", country("DE"))
+	return mw.Bytes()
+}
+
+func loadTestGeoDatabase(t *testing.T, fw *Firewall, gd *GeoDatabase, data []byte) {
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fw.refreshGeoDatabase(gd, GeoDatabaseConfig{Path: path})
+	if !gd.Loaded() {
+		t.Fatalf("%s database not loaded", gd.name)
+	}
+}
+
+func loadTestASNDatabase(t *testing.T, fw *Firewall) {
+	loadTestGeoDatabase(t, fw, fw.asnDB, testASNDatabase(t, 28))
+}
@@ -0,0 +1,13 @@
+package main
+
+import "runtime/debug"
+
+// logPanic records a panic recovered in a connection goroutine. The
+// goroutine's own defers still run, releasing its per-IP counters and
+// closing its sockets, so only that connection is lost.
+func (fw *Firewall) logPanic(logger *FirewallLogger, where string, value interface{}) {
+	fw.panics.Add(1)
+	if logger != nil {
+		logger.LogError("PANIC", "Recovered panic in %s: %v\n%s", where, value, debug.Stack())
+	}
+}
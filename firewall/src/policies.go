@@ -0,0 +1,535 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	PolicyActionBlock     = "block"
+	PolicyActionChallenge = "challenge"
+	PolicyActionLog       = "log"
+
+	DefaultPolicyMessage             = "Access from your network has been blocked."
+	DefaultPolicyChallengeValidHours = 24
+)
+
+// Policy is a site-specific check written as an expression over the
+// connection, e.g.
+//
+//	country in ["RU", "CN"] and path startswith "/admin"
+//	header("User-Agent") matches "(?i)curl|wget" and not (ip in ["10.0.0.0/8"])
+//
+// Policies that only use client fields (ip, country, asn, org, hostname,
+// exempt) run on accept; those using request fields (port, method, path,
+// host, protocol, user_agent, header("name")) once the request head is
+// read; and those using body once the request body is read, which takes
+// body_inspection. Whitelisted clients are not checked.
+type Policy struct {
+	Name                string `json:"name"`
+	When                string `json:"when"`
+	Action              string `json:"action"`
+	Status              int    `json:"status"`
+	Message             string `json:"message"`
+	ChallengeValidHours int    `json:"challenge_valid_hours"`
+}
+
+func normalizePolicies(policies []Policy) []Policy {
+	for i := range policies {
+		policy := &policies[i]
+		policy.Action = strings.ToLower(strings.TrimSpace(policy.Action))
+		if policy.Action != PolicyActionChallenge && policy.Action != PolicyActionLog {
+			policy.Action = PolicyActionBlock
+		}
+		if policy.Status < 400 || policy.Status > 599 {
+			policy.Status = http.StatusForbidden
+		}
+		if policy.Message == "" {
+			policy.Message = DefaultPolicyMessage
+		}
+		if policy.ChallengeValidHours <= 0 {
+			policy.ChallengeValidHours = DefaultPolicyChallengeValidHours
+		}
+		if policy.Name == "" {
+			policy.Name = fmt.Sprintf("policy %d", i+1)
+		}
+	}
+	return policies
+}
+
+// compiledPolicy is a Policy whose expression parsed.
+type compiledPolicy struct {
+	Policy
+	Stage MiddlewareStage
+	eval  policyExpr
+}
+
+// compilePolicies returns the policies that compile, in order, and why the
+// others didn't.
+func compilePolicies(policies []Policy) ([]compiledPolicy, []string) {
+	var compiled []compiledPolicy
+	var problems []string
+	for i, policy := range policies {
+		eval, stage, err := compilePolicyExpr(policy.When)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("policies[%d] (%s): %v", i, policy.Name, err))
+			continue
+		}
+		compiled = append(compiled, compiledPolicy{Policy: policy, Stage: stage, eval: eval})
+	}
+	return compiled, problems
+}
+
+func (fw *Firewall) policies() []compiledPolicy {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	if fw.parsedRules == nil {
+		return nil
+	}
+	return fw.parsedRules.Policies
+}
+
+// policyEnv is what a policy expression is evaluated against.
+type policyEnv struct {
+	fw *Firewall
+	ms *MiddlewareState
+}
+
+type policyExpr func(env *policyEnv) interface{}
+
+// policyField is a value a policy can read, and whether it needs the
+// request head.
+type policyField struct {
+	request bool
+	value   func(env *policyEnv) interface{}
+}
+
+var policyFields = map[string]policyField{
+	"ip":       {value: func(env *policyEnv) interface{} { return env.ms.IP }},
+	"hostname": {value: func(env *policyEnv) interface{} { return env.ms.Hostname }},
+	"exempt":   {value: func(env *policyEnv) interface{} { return env.ms.Exempt }},
+	"country": {value: func(env *policyEnv) interface{} {
+		if env.ms.Verdict.Country != "" {
+			return env.ms.Verdict.Country
+		}
+		return env.fw.lookupCountry(env.ms.IP)
+	}},
+	"asn": {value: func(env *policyEnv) interface{} {
+		asn, _, _ := env.fw.lookupASN(env.ms.IP)
+		return float64(asn)
+	}},
+	"org": {value: func(env *policyEnv) interface{} {
+		_, org, _ := env.fw.lookupASN(env.ms.IP)
+		return org
+	}},
+	"port":       {request: true, value: func(env *policyEnv) interface{} { return float64(env.ms.Port) }},
+	"method":     {request: true, value: func(env *policyEnv) interface{} { return env.ms.Head.Method }},
+	"path":       {request: true, value: func(env *policyEnv) interface{} { return env.ms.Head.Path() }},
+	"host":       {request: true, value: func(env *policyEnv) interface{} { return env.ms.Head.Host() }},
+	"protocol":   {request: true, value: func(env *policyEnv) interface{} { return env.ms.Record.Protocol }},
+	"user_agent": {request: true, value: func(env *policyEnv) interface{} { return env.ms.Head.Header.Get("User-Agent") }},
+}
+
+func policyString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+func policyTruth(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case float64:
+		return v != 0
+	}
+	return false
+}
+
+// policyToken is a lexeme; kind is 's' for a string literal, 'n' for a
+// number, 'i' for an identifier or keyword and 'p' for punctuation.
+type policyToken struct {
+	kind rune
+	text string
+}
+
+func tokenizePolicy(text string) ([]policyToken, error) {
+	var tokens []policyToken
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			var literal strings.Builder
+			j := i + 1
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				}
+				literal.WriteRune(runes[j])
+			}
+			if j == len(runes) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, policyToken{'s', literal.String()})
+			i = j + 1
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, policyToken{'n', string(runes[i:j])})
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, policyToken{'i', strings.ToLower(string(runes[i:j]))})
+			i = j
+		default:
+			two := ""
+			if i+1 < len(runes) {
+				two = string(runes[i : i+2])
+			}
+			switch {
+			case two == "==" || two == "!=" || two == "<=" || two == ">=" || two == "&&" || two == "||":
+				tokens = append(tokens, policyToken{'p', two})
+				i += 2
+			case strings.ContainsRune("()[],<>!", r):
+				tokens = append(tokens, policyToken{'p', string(r)})
+				i++
+			default:
+				return nil, fmt.Errorf("unexpected %q", r)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+type policyParser struct {
+	tokens  []policyToken
+	pos     int
+	request bool
+	body    bool
+}
+
+func (pp *policyParser) peek() policyToken {
+	if pp.pos < len(pp.tokens) {
+		return pp.tokens[pp.pos]
+	}
+	return policyToken{}
+}
+
+func (pp *policyParser) accept(kind rune, text string) bool {
+	if token := pp.peek(); token.kind == kind && token.text == text {
+		pp.pos++
+		return true
+	}
+	return false
+}
+
+func (pp *policyParser) expect(text string) error {
+	if !pp.accept('p', text) {
+		return fmt.Errorf("expected %q", text)
+	}
+	return nil
+}
+
+// compilePolicyExpr parses text and reports the stage it needs.
+func compilePolicyExpr(text string) (policyExpr, MiddlewareStage, error) {
+	tokens, err := tokenizePolicy(text)
+	if err != nil {
+		return nil, StageAccept, err
+	}
+	if len(tokens) == 0 {
+		return nil, StageAccept, fmt.Errorf("empty expression")
+	}
+	pp := &policyParser{tokens: tokens}
+	eval, err := pp.or()
+	if err == nil && pp.pos < len(tokens) {
+		err = fmt.Errorf("unexpected %q", tokens[pp.pos].text)
+	}
+	if err != nil {
+		return nil, StageAccept, err
+	}
+	if pp.body {
+		return eval, StageBody, nil
+	}
+	if pp.request {
+		return eval, StageRequest, nil
+	}
+	return eval, StageAccept, nil
+}
+
+func (pp *policyParser) or() (policyExpr, error) {
+	left, err := pp.and()
+	for err == nil && (pp.accept('i', "or") || pp.accept('p', "||")) {
+		var right policyExpr
+		if right, err = pp.and(); err == nil {
+			l := left
+			left = func(env *policyEnv) interface{} { return policyTruth(l(env)) || policyTruth(right(env)) }
+		}
+	}
+	return left, err
+}
+
+func (pp *policyParser) and() (policyExpr, error) {
+	left, err := pp.not()
+	for err == nil && (pp.accept('i', "and") || pp.accept('p', "&&")) {
+		var right policyExpr
+		if right, err = pp.not(); err == nil {
+			l := left
+			left = func(env *policyEnv) interface{} { return policyTruth(l(env)) && policyTruth(right(env)) }
+		}
+	}
+	return left, err
+}
+
+func (pp *policyParser) not() (policyExpr, error) {
+	if pp.accept('i', "not") || pp.accept('p', "!") {
+		operand, err := pp.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *policyEnv) interface{} { return !policyTruth(operand(env)) }, nil
+	}
+	return pp.comparison()
+}
+
+func (pp *policyParser) comparison() (policyExpr, error) {
+	left, err := pp.operand()
+	if err != nil {
+		return nil, err
+	}
+	token := pp.peek()
+	switch {
+	case token.kind == 'p' && policyComparisons[token.text]:
+		pp.pos++
+		right, err := pp.operand()
+		if err != nil {
+			return nil, err
+		}
+		return compareExpr(token.text, left, right), nil
+	case token.kind == 'i' && token.text == "in":
+		pp.pos++
+		return pp.in(left)
+	case token.kind == 'i' && (token.text == "contains" || token.text == "startswith" || token.text == "endswith"):
+		pp.pos++
+		right, err := pp.operand()
+		if err != nil {
+			return nil, err
+		}
+		test := map[string]func(string, string) bool{"contains": strings.Contains, "startswith": strings.HasPrefix, "endswith": strings.HasSuffix}[token.text]
+		return func(env *policyEnv) interface{} {
+			return test(policyString(left(env)), policyString(right(env)))
+		}, nil
+	case token.kind == 'i' && token.text == "matches":
+		pp.pos++
+		pattern := pp.peek()
+		if pattern.kind != 's' {
+			return nil, fmt.Errorf("matches needs a quoted pattern")
+		}
+		pp.pos++
+		re, err := regexp.Compile(pattern.text)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %v", pattern.text, err)
+		}
+		return func(env *policyEnv) interface{} { return re.MatchString(policyString(left(env))) }, nil
+	}
+	return left, nil
+}
+
+var policyComparisons = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+func compareExpr(op string, left, right policyExpr) policyExpr {
+	return func(env *policyEnv) interface{} {
+		l, r := left(env), right(env)
+		ln, lNumber := l.(float64)
+		rn, rNumber := r.(float64)
+		if lNumber && rNumber {
+			switch op {
+			case "==":
+				return ln == rn
+			case "!=":
+				return ln != rn
+			case "<":
+				return ln < rn
+			case "<=":
+				return ln <= rn
+			case ">":
+				return ln > rn
+			case ">=":
+				return ln >= rn
+			}
+		}
+		switch op {
+		case "==":
+			return policyString(l) == policyString(r)
+		case "!=":
+			return policyString(l) != policyString(r)
+		}
+		return false
+	}
+}
+
+// in tests membership of a literal list, or of a single quoted entry; IP,
+// CIDR and address class entries match the addresses they cover.
+func (pp *policyParser) in(left policyExpr) (policyExpr, error) {
+	var entries []string
+	if token := pp.peek(); token.kind == 's' {
+		pp.pos++
+		entries = []string{token.text}
+	} else {
+		if err := pp.expect("["); err != nil {
+			return nil, err
+		}
+		for !pp.accept('p', "]") {
+			token := pp.peek()
+			if token.kind != 's' && token.kind != 'n' {
+				return nil, fmt.Errorf("list entries must be strings or numbers")
+			}
+			pp.pos++
+			entries = append(entries, token.text)
+			if !pp.accept('p', ",") {
+				if err := pp.expect("]"); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	}
+
+	set := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		set[entry] = true
+	}
+	networks := NewIPMatcher(entries)
+	return func(env *policyEnv) interface{} {
+		value := policyString(left(env))
+		return set[value] || (networks.Size() > 0 && networks.Contains(value))
+	}, nil
+}
+
+func (pp *policyParser) operand() (policyExpr, error) {
+	token := pp.peek()
+	pp.pos++
+	switch token.kind {
+	case 's':
+		return func(*policyEnv) interface{} { return token.text }, nil
+	case 'n':
+		n, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", token.text)
+		}
+		return func(*policyEnv) interface{} { return n }, nil
+	case 'p':
+		if token.text == "(" {
+			inner, err := pp.or()
+			if err != nil {
+				return nil, err
+			}
+			return inner, pp.expect(")")
+		}
+	case 'i':
+		switch token.text {
+		case "true", "false":
+			value := token.text == "true"
+			return func(*policyEnv) interface{} { return value }, nil
+		case "header":
+			if err := pp.expect("("); err != nil {
+				return nil, err
+			}
+			name := pp.peek()
+			if name.kind != 's' {
+				return nil, fmt.Errorf("header needs a quoted name")
+			}
+			pp.pos++
+			pp.request = true
+			return func(env *policyEnv) interface{} { return env.ms.Head.Header.Get(name.text) }, pp.expect(")")
+		case "body":
+			pp.body = true
+			return func(env *policyEnv) interface{} { return string(env.ms.Body) }, nil
+		}
+		field, known := policyFields[token.text]
+		if !known {
+			return nil, fmt.Errorf("unknown field %q", token.text)
+		}
+		pp.request = pp.request || field.request
+		return field.value, nil
+	}
+	if token.kind == 0 {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q", token.text)
+}
+
+func init() {
+	RegisterMiddleware(Middleware{Name: "policies", Stage: StageAccept, SkipWhitelisted: true, Handle: acceptPoliciesMiddleware})
+	RegisterMiddleware(Middleware{Name: "request_policies", Stage: StageRequest, SkipWhitelisted: true, Handle: requestPoliciesMiddleware})
+}
+
+func acceptPoliciesMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	return fw.applyPolicies(fw.policies(), StageAccept, ms)
+}
+
+func requestPoliciesMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	return fw.applyPolicies(fw.policies(), StageRequest, ms)
+}
+
+// applyPolicies runs those of policies for stage in order; the first
+// matching block or challenge decides.
+func (fw *Firewall) applyPolicies(policies []compiledPolicy, stage MiddlewareStage, ms *MiddlewareState) bool {
+	env := &policyEnv{fw: fw, ms: ms}
+	for _, policy := range policies {
+		if policy.Stage != stage || !policyTruth(policy.eval(env)) {
+			continue
+		}
+		details := fmt.Sprintf("policy %s: %s", policy.Name, policy.When)
+		switch policy.Action {
+		case PolicyActionLog:
+			ms.Record.Event("matched %s", details)
+		case PolicyActionChallenge:
+			validFor := time.Duration(policy.ChallengeValidHours) * time.Hour
+			if stage == StageAccept {
+				// The challenge middleware asks for the cookie once the
+				// request head is read.
+				if ms.Challenge == "" {
+					ms.Challenge, ms.ChallengeValidFor = "matched policy "+policy.Name, validFor
+				}
+				continue
+			}
+			if fw.challengePassed(ms.Head, ms.Key) {
+				continue
+			}
+			ms.Block("CHALLENGED", fmt.Sprintf("%s matched %s, no valid challenge cookie", ms.IP, details))
+			fw.writeChallenge(ms.Conn, ms.ConnID, ms.Key, validFor)
+			return false
+		default:
+			ms.Block("POLICY", details)
+			if stage == StageAccept {
+				fw.rejectBlocked(ms.Conn, ms.ConnID, policy.Status, policy.Message, 0)
+			} else {
+				fw.writeHTTPError(ms.Conn, ms.ConnID, policy.Status, policy.Message, 0)
+			}
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PortScanDetection auto-blocks clients that touch MinPorts distinct ports
+// within WindowSeconds (a vertical scan). Touches are the port each proxied
+// request targets and connections to HoneypotPorts, which the firewall opens
+// only to watch: they accept and immediately close, so any hit is a probe.
+// Honeypot ports are opened at startup; changing them needs a restart. ICMP
+// never reaches a TCP proxy, so ping sweeps are not seen here.
+type PortScanDetection struct {
+	Enabled              bool  `json:"enabled"`
+	HoneypotPorts        []int `json:"honeypot_ports"`
+	MinPorts             int   `json:"min_ports"`
+	WindowSeconds        int   `json:"window_seconds"`
+	BlockDurationMinutes int   `json:"block_duration_minutes"`
+}
+
+func normalizePortScanDetection(config PortScanDetection) PortScanDetection {
+	ports := make([]int, 0, len(config.HoneypotPorts))
+	for _, port := range config.HoneypotPorts {
+		if port > 0 && port <= 65535 {
+			ports = append(ports, port)
+		}
+	}
+	config.HoneypotPorts = ports
+	if config.MinPorts <= 1 {
+		config.MinPorts = 3
+	}
+	if config.WindowSeconds <= 0 {
+		config.WindowSeconds = 60
+	}
+	if config.BlockDurationMinutes <= 0 {
+		config.BlockDurationMinutes = 60
+	}
+	return config
+}
+
+func (fw *Firewall) portScanDetection() PortScanDetection {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.PortScanDetection
+}
+
+// PortScanDetector remembers when each client key last touched each port.
+type PortScanDetector struct {
+	mutex   sync.Mutex
+	touches map[string]map[int]time.Time
+}
+
+func NewPortScanDetector() *PortScanDetector {
+	return &PortScanDetector{
+		touches: make(map[string]map[int]time.Time),
+	}
+}
+
+// Touch records key hitting port at now and returns the distinct ports it
+// touched within window, in ascending order.
+func (pd *PortScanDetector) Touch(key string, port int, now time.Time, window time.Duration) []int {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+
+	ports, exists := pd.touches[key]
+	if !exists {
+		if len(pd.touches) >= MaxTrackedIPs {
+			pd.cleanupLocked(now, window)
+			if len(pd.touches) >= MaxTrackedIPs {
+				return nil
+			}
+		}
+		ports = make(map[int]time.Time)
+		pd.touches[key] = ports
+	}
+	ports[port] = now
+
+	recent := make([]int, 0, len(ports))
+	for p, touched := range ports {
+		if now.Sub(touched) < window {
+			recent = append(recent, p)
+		} else {
+			delete(ports, p)
+		}
+	}
+	sort.Ints(recent)
+	return recent
+}
+
+func (pd *PortScanDetector) Forget(key string) {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+
+	delete(pd.touches, key)
+}
+
+// Cleanup drops touches older than window.
+func (pd *PortScanDetector) Cleanup(now time.Time, window time.Duration) {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+
+	pd.cleanupLocked(now, window)
+}
+
+func (pd *PortScanDetector) cleanupLocked(now time.Time, window time.Duration) {
+	for key, ports := range pd.touches {
+		for port, touched := range ports {
+			if now.Sub(touched) >= window {
+				delete(ports, port)
+			}
+		}
+		if len(ports) == 0 {
+			delete(pd.touches, key)
+		}
+	}
+}
+
+// recordPortTouch feeds one touch to the detector and auto-blocks key when
+// it completes a scan. It reports whether key was blocked.
+func (fw *Firewall) recordPortTouch(ip, key string, port int) bool {
+	config := fw.portScanDetection()
+	if !config.Enabled {
+		return false
+	}
+
+	now := fw.clock.Now()
+	window := time.Duration(config.WindowSeconds) * time.Second
+	ports := fw.portScans.Touch(key, port, now, window)
+	if len(ports) < config.MinPorts {
+		return false
+	}
+
+	fw.portScans.Forget(key)
+	fw.recordRisk(ip, key, RiskSignalScan, 1)
+	fw.attemptsMutex.Lock()
+	fw.autoBlockLocked(key, "SCAN_DETECTED", now.Add(time.Duration(config.BlockDurationMinutes)*time.Minute))
+	fw.attemptsMutex.Unlock()
+
+	if fw.logger != nil {
+		fw.logger.LogBlocked(ip, "SCAN_DETECTED",
+			fmt.Sprintf("%s blocked for %dm after touching ports %v within %v",
+				key, config.BlockDurationMinutes, ports, window))
+	}
+	return true
+}
+
+// startHoneypots opens the configured honeypot ports. A port that can't be
+// opened is logged and skipped.
+func (fw *Firewall) startHoneypots() {
+	config := fw.portScanDetection()
+	if !config.Enabled {
+		return
+	}
+
+	for _, port := range config.HoneypotPorts {
+		if port == fw.firewallPort {
+			continue
+		}
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			fw.logger.LogError("SCAN", "Honeypot port %d not opened: %v", port, err)
+			continue
+		}
+		fw.logger.LogStartup("Honeypot listening on port %d", port)
+
+		go func() {
+			<-fw.shutdown
+			listener.Close()
+		}()
+		go fw.serveHoneypot(listener, port)
+	}
+}
+
+func (fw *Firewall) serveHoneypot(listener net.Listener, port int) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-fw.shutdown:
+				return
+			default:
+				fw.logErrorRateLimited("honeypot", "SCAN", "Honeypot accept failed on port %d: %v", port, err)
+				continue
+			}
+		}
+
+		clientAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		conn.Close()
+		if !ok {
+			continue
+		}
+
+		ip := clientAddr.IP.String()
+		if fw.isWhitelisted(ip) {
+			continue
+		}
+		if fw.logger != nil {
+			fw.logger.LogDebug("SCAN", "Honeypot port %d touched by %s", port, ip)
+		}
+		key := fw.aggregationKey(ip)
+		if !fw.recordPortTouch(ip, key, port) {
+			fw.recordRisk(ip, key, RiskSignalHoneypot, 1)
+		}
+	}
+}
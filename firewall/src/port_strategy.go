@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	PortSourceHostHeader = "host_header"
+	PortSourceListener   = "listener"
+	PortSourceMapping    = "mapping"
+
+	DefaultRequestedPort = 80
+)
+
+// PortStrategy decides which port a request is considered to be targeting
+// when checking allowed_ports. The Host header is only a hint supplied by the
+// client, so deployments behind TLS termination or non-standard frontends can
+// pin it to the listener port or an explicit mapping instead.
+type PortStrategy struct {
+	Source      string `json:"source"`
+	DefaultPort int    `json:"default_port"`
+	MappedPort  int    `json:"mapped_port"`
+}
+
+func defaultPortStrategy() PortStrategy {
+	return PortStrategy{
+		Source:      PortSourceHostHeader,
+		DefaultPort: DefaultRequestedPort,
+	}
+}
+
+func normalizePortStrategy(strategy PortStrategy) PortStrategy {
+	switch strategy.Source {
+	case PortSourceHostHeader, PortSourceListener, PortSourceMapping:
+	default:
+		strategy.Source = PortSourceHostHeader
+	}
+	if strategy.DefaultPort <= 0 || strategy.DefaultPort > 65535 {
+		strategy.DefaultPort = DefaultRequestedPort
+	}
+	if strategy.Source == PortSourceMapping && (strategy.MappedPort <= 0 || strategy.MappedPort > 65535) {
+		strategy.Source = PortSourceHostHeader
+	}
+	return strategy
+}
+
+func (ps PortStrategy) Resolve(listenerPort int, hostHeader string) int {
+	switch ps.Source {
+	case PortSourceListener:
+		if listenerPort > 0 {
+			return listenerPort
+		}
+	case PortSourceMapping:
+		return ps.MappedPort
+	default:
+		if port, ok := hostHeaderPort(hostHeader); ok {
+			return port
+		}
+	}
+	return ps.DefaultPort
+}
+
+func hostHeaderPort(hostHeader string) (int, bool) {
+	if !strings.Contains(hostHeader, ":") {
+		return 0, false
+	}
+	parts := strings.Split(hostHeader, ":")
+	if len(parts) < 2 {
+		return 0, false
+	}
+	port, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return 0, false
+	}
+	return port, true
+}
+
+func listenerPort(conn net.Conn) int {
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// portStrategyFor returns the strategy configured for the listener port,
+// falling back to the global port_strategy.
+func (fw *Firewall) portStrategyFor(port int) PortStrategy {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	if strategy, exists := fw.rules.ListenerPortStrategies[port]; exists {
+		return strategy
+	}
+	return fw.rules.PortStrategy
+}
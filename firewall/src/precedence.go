@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	RuleAlwaysBlock = "always_block"
+	RuleWhitelist   = "whitelist"
+	RuleBlockedIPs  = "blocked_ips"
+	RuleAutoBlocks  = "auto_blocks"
+)
+
+var defaultRulePrecedence = []string{RuleAlwaysBlock, RuleWhitelist, RuleBlockedIPs, RuleAutoBlocks}
+
+// normalizeRulePrecedence keeps the known rules of order, adds any it leaves
+// out in their default position, and puts always_block first: nothing,
+// whitelist included, overrides it.
+func normalizeRulePrecedence(order []string) []string {
+	seen := map[string]bool{RuleAlwaysBlock: true}
+	normalized := []string{RuleAlwaysBlock}
+	for _, rule := range order {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if seen[rule] {
+			continue
+		}
+		for _, known := range defaultRulePrecedence {
+			if rule == known {
+				normalized = append(normalized, rule)
+				seen[rule] = true
+			}
+		}
+	}
+	for _, rule := range defaultRulePrecedence {
+		if !seen[rule] {
+			normalized = append(normalized, rule)
+		}
+	}
+	return normalized
+}
+
+// PrecedenceDecision is the first rule, in rule_precedence order, that
+// matched a client. Rule is "" when none did.
+type PrecedenceDecision struct {
+	Rule  string
+	Entry string
+	Group string
+	Block bool
+	Order []string
+}
+
+func (pd PrecedenceDecision) String() string {
+	group := ""
+	if pd.Group != "" {
+		group = " [group " + pd.Group + "]"
+	}
+	return fmt.Sprintf("%s %s%s (order %s)", pd.Rule, pd.Entry, group, strings.Join(pd.Order, " > "))
+}
+
+// BlockReason is the block reason logged for a blocking decision.
+func (pd PrecedenceDecision) BlockReason() string {
+	if pd.Rule == RuleAlwaysBlock {
+		return "ALWAYS_BLOCK"
+	}
+	return "BLOCKED_IP"
+}
+
+// whitelistMatch returns the whitelist entry, redeemed appeal or allowed
+// reverse DNS name that lets ip through.
+func (fw *Firewall) whitelistMatch(parsed *ParsedRules, ip, key string, now time.Time) (string, bool) {
+	if entry, whitelisted := parsed.Whitelist.MatchRule(ip); whitelisted {
+		return entry, true
+	}
+	if fw.appeals.IsAllowed(key, now) {
+		return "appeal for " + key, true
+	}
+	if hostname, allowed := fw.ptrAllowed(ip); allowed {
+		return "reverse_dns " + hostname, true
+	}
+	return "", false
+}
+
+// decidePrecedence evaluates always_block, the whitelist, blocked_ips and
+// auto-blocks for ip in the configured order, as of now.
+func (fw *Firewall) decidePrecedence(ip, key string, now time.Time) PrecedenceDecision {
+	fw.rulesMutex.RLock()
+	order := fw.rules.RulePrecedence
+	parsed := fw.parsedRules
+	fw.rulesMutex.RUnlock()
+
+	if parsed == nil {
+		return PrecedenceDecision{Order: order}
+	}
+	return fw.evaluatePrecedence(order, parsed, ip, key, now)
+}
+
+// evaluatePrecedence is decidePrecedence for a given set of rules, such as
+// staged ones.
+func (fw *Firewall) evaluatePrecedence(order []string, parsed *ParsedRules, ip, key string, now time.Time) PrecedenceDecision {
+	decision := PrecedenceDecision{Order: order}
+	for _, rule := range order {
+		decision.Rule = rule
+		switch rule {
+		case RuleAlwaysBlock:
+			if entry, ok := parsed.AlwaysBlock.MatchRule(ip); ok {
+				decision.Entry, decision.Group, decision.Block = entry, parsed.groupOf(rule, entry), true
+				return decision
+			}
+		case RuleWhitelist:
+			if entry, ok := fw.whitelistMatch(parsed, ip, key, now); ok {
+				decision.Entry, decision.Group = entry, parsed.groupOf(rule, entry)
+				return decision
+			}
+		case RuleBlockedIPs:
+			if entry, ok := parsed.BlockedIPs.MatchRule(ip); ok {
+				decision.Entry, decision.Group, decision.Block = entry, parsed.groupOf(rule, entry), true
+				return decision
+			}
+		case RuleAutoBlocks:
+			fw.attemptsMutex.RLock()
+			expiry := fw.autoBlockedIPs[key]
+			fw.attemptsMutex.RUnlock()
+			if remaining := expiry.Sub(now); remaining > 0 {
+				decision.Entry, decision.Block = fmt.Sprintf("on %s for another %v", key, remaining.Round(time.Second)), true
+				return decision
+			}
+		}
+	}
+	return PrecedenceDecision{Order: order}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProtocolHTTP      = "http"
+	ProtocolWebSocket = "websocket"
+	ProtocolGRPC      = "grpc"
+	ProtocolTLS       = "tls"
+	ProtocolUnknown   = "unknown"
+)
+
+// classifyProtocol tells chat WebSockets, gRPC (including gRPC-Web) and
+// plain HTTP calls apart from their request head. TLS passed through by the
+// protocol allowlist is ProtocolTLS; connections whose first bytes don't
+// parse as HTTP are otherwise ProtocolUnknown.
+func classifyProtocol(head *RequestHead) string {
+	if head == nil {
+		return ProtocolUnknown
+	}
+	if head.Opaque {
+		if head.Proto == SignatureTLS {
+			return ProtocolTLS
+		}
+		return ProtocolUnknown
+	}
+	if strings.EqualFold(head.Header.Get("Upgrade"), "websocket") {
+		return ProtocolWebSocket
+	}
+	if strings.HasPrefix(strings.ToLower(head.Header.Get("Content-Type")), "application/grpc") {
+		return ProtocolGRPC
+	}
+	return ProtocolHTTP
+}
+
+// ProtocolRateLimit applies a separate per-minute budget per client to
+// connections of one protocol class.
+type ProtocolRateLimit struct {
+	Protocol             string `json:"protocol"`
+	MaxAttemptsPerMinute int    `json:"max_attempts_per_minute"`
+}
+
+func normalizeProtocolRateLimits(limits []ProtocolRateLimit) []ProtocolRateLimit {
+	normalized := make([]ProtocolRateLimit, 0, len(limits))
+	for _, limit := range limits {
+		limit.Protocol = strings.ToLower(strings.TrimSpace(limit.Protocol))
+		switch limit.Protocol {
+		case ProtocolHTTP, ProtocolWebSocket, ProtocolGRPC, ProtocolTLS:
+		default:
+			continue
+		}
+		if limit.MaxAttemptsPerMinute > 0 {
+			normalized = append(normalized, limit)
+		}
+	}
+	return normalized
+}
+
+func (fw *Firewall) protocolRateLimit(protocol string) (ProtocolRateLimit, bool) {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	for _, limit := range fw.rules.ProtocolRateLimits {
+		if limit.Protocol == protocol {
+			return limit, true
+		}
+	}
+	return ProtocolRateLimit{}, false
+}
+
+// protocolBucket keys a client's protocol budget alongside its endpoint
+// budgets, which are keyed by path and so can't collide with it.
+func protocolBucket(key, protocol string) string {
+	return key + "|protocol:" + protocol
+}
+
+// isProtocolRateLimited records a connection of protocol for key and
+// reports whether that budget is exhausted.
+func (fw *Firewall) isProtocolRateLimited(key, protocol string) (ProtocolRateLimit, int, bool) {
+	limit, found := fw.protocolRateLimit(protocol)
+	if !found {
+		return limit, 0, false
+	}
+	limit.MaxAttemptsPerMinute = fw.adaptive.Scale(limit.MaxAttemptsPerMinute)
+
+	now := fw.clock.Now()
+	bucket := protocolBucket(key, protocol)
+
+	fw.attemptsMutex.Lock()
+	defer fw.attemptsMutex.Unlock()
+
+	var validAttempts []time.Time
+	for _, attempt := range fw.endpointAttempts[bucket] {
+		if now.Sub(attempt) < time.Minute {
+			validAttempts = append(validAttempts, attempt)
+		}
+	}
+	validAttempts = append(validAttempts, now)
+	fw.endpointAttempts[bucket] = validAttempts
+
+	return limit, len(validAttempts), len(validAttempts) > limit.MaxAttemptsPerMinute
+}
+
+type protocolCounters struct {
+	connections uint64
+	blocked     uint64
+	bytesIn     uint64
+	bytesOut    uint64
+	duration    time.Duration
+}
+
+type ProtocolStatsEntry struct {
+	Connections       uint64  `json:"connections"`
+	Blocked           uint64  `json:"blocked"`
+	BytesIn           uint64  `json:"bytes_in"`
+	BytesOut          uint64  `json:"bytes_out"`
+	AvgBytesIn        float64 `json:"avg_bytes_in"`
+	AvgBytesOut       float64 `json:"avg_bytes_out"`
+	AvgDurationMillis float64 `json:"avg_duration_ms"`
+}
+
+// ProtocolStats breaks finished connections down by protocol class, or by
+// tenant or API client when made by NewTenantStats or NewAPIClientStats.
+type ProtocolStats struct {
+	mutex    sync.Mutex
+	counters map[string]*protocolCounters
+	by       func(record *ConnectionRecord) string
+}
+
+func NewProtocolStats() *ProtocolStats {
+	return &ProtocolStats{
+		counters: make(map[string]*protocolCounters),
+		by:       func(record *ConnectionRecord) string { return record.Protocol },
+	}
+}
+
+func NewTenantStats() *ProtocolStats {
+	return &ProtocolStats{
+		counters: make(map[string]*protocolCounters),
+		by:       func(record *ConnectionRecord) string { return record.Tenant },
+	}
+}
+
+func NewAPIClientStats() *ProtocolStats {
+	return &ProtocolStats{
+		counters: make(map[string]*protocolCounters),
+		by:       func(record *ConnectionRecord) string { return record.APIClient },
+	}
+}
+
+// Record counts a finished connection. Connections refused before their
+// request was read have no class and aren't counted.
+func (ps *ProtocolStats) Record(record *ConnectionRecord) {
+	key := ps.by(record)
+	if key == "" {
+		return
+	}
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	counters, exists := ps.counters[key]
+	if !exists {
+		counters = &protocolCounters{}
+		ps.counters[key] = counters
+	}
+	counters.connections++
+	if record.Verdict == VerdictBlocked {
+		counters.blocked++
+	}
+	counters.bytesIn += uint64(record.BytesIn)
+	counters.bytesOut += uint64(record.BytesOut)
+	counters.duration += time.Since(record.StartedAt)
+}
+
+func (ps *ProtocolStats) Snapshot() map[string]ProtocolStatsEntry {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	snapshot := make(map[string]ProtocolStatsEntry, len(ps.counters))
+	for protocol, counters := range ps.counters {
+		entry := ProtocolStatsEntry{
+			Connections: counters.connections,
+			Blocked:     counters.blocked,
+			BytesIn:     counters.bytesIn,
+			BytesOut:    counters.bytesOut,
+		}
+		if counters.connections > 0 {
+			entry.AvgBytesIn = float64(counters.bytesIn) / float64(counters.connections)
+			entry.AvgBytesOut = float64(counters.bytesOut) / float64(counters.connections)
+			entry.AvgDurationMillis = durationMillis(counters.duration) / float64(counters.connections)
+		}
+		snapshot[protocol] = entry
+	}
+	return snapshot
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	SignatureHTTP = "http"
+	SignatureTLS  = "tls"
+
+	customSignaturePrefix = "hex:"
+	maxSignatureLength    = 64
+
+	tlsRecordHeaderSize = 5
+	maxTLSRecordSize    = 16384 + 2048
+)
+
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+
+// ProtocolAllowlist rejects connections whose first bytes match none of
+// Signatures, so SMTP, SSH and botnet probes never reach the reverse proxy.
+// "http" matches an HTTP/1.x request line and "tls" a TLS ClientHello;
+// "hex:<bytes>" matches any other protocol by its opening bytes. Connections
+// matched by anything but "http" are forwarded untouched: allowed_hosts is
+// checked against the ClientHello's SNI, but nothing else in them is read.
+type ProtocolAllowlist struct {
+	Enabled    bool     `json:"enabled"`
+	Signatures []string `json:"signatures"`
+}
+
+func normalizeProtocolAllowlist(allowlist ProtocolAllowlist) ProtocolAllowlist {
+	signatures := make([]string, 0, len(allowlist.Signatures))
+	for _, signature := range allowlist.Signatures {
+		signature = strings.ToLower(strings.TrimSpace(signature))
+		if _, ok := compileProtocolSignature(signature); ok {
+			signatures = append(signatures, signature)
+		}
+	}
+	if len(signatures) == 0 {
+		signatures = []string{SignatureHTTP, SignatureTLS}
+	}
+	allowlist.Signatures = signatures
+	return allowlist
+}
+
+// ProtocolSignature recognises a protocol from a connection's first bytes.
+type ProtocolSignature struct {
+	Name   string
+	prefix []byte
+}
+
+func compileProtocolSignature(name string) (ProtocolSignature, bool) {
+	switch name {
+	case SignatureHTTP, SignatureTLS:
+		return ProtocolSignature{Name: name}, true
+	}
+	if !strings.HasPrefix(name, customSignaturePrefix) {
+		return ProtocolSignature{}, false
+	}
+	prefix, err := hex.DecodeString(strings.TrimPrefix(name, customSignaturePrefix))
+	if err != nil || len(prefix) == 0 || len(prefix) > maxSignatureLength {
+		return ProtocolSignature{}, false
+	}
+	return ProtocolSignature{Name: name, prefix: prefix}, true
+}
+
+// compileProtocolAllowlist returns nil when the allowlist is off.
+func compileProtocolAllowlist(allowlist ProtocolAllowlist) []ProtocolSignature {
+	if !allowlist.Enabled {
+		return nil
+	}
+	signatures := make([]ProtocolSignature, 0, len(allowlist.Signatures))
+	for _, name := range allowlist.Signatures {
+		if signature, ok := compileProtocolSignature(name); ok {
+			signatures = append(signatures, signature)
+		}
+	}
+	return signatures
+}
+
+// length is how many bytes Matches needs to decide.
+func (ps ProtocolSignature) length() int {
+	switch ps.Name {
+	case SignatureHTTP:
+		return len("OPTIONS ")
+	case SignatureTLS:
+		return 3
+	}
+	return len(ps.prefix)
+}
+
+func (ps ProtocolSignature) Matches(first []byte) bool {
+	switch ps.Name {
+	case SignatureHTTP:
+		for _, method := range httpMethods {
+			if len(first) > len(method) && string(first[:len(method)]) == method && first[len(method)] == ' ' {
+				return true
+			}
+		}
+		return false
+	case SignatureTLS:
+		// A handshake record of SSL 3.0 through TLS 1.3.
+		return len(first) >= 3 && first[0] == 0x16 && first[1] == 0x03 && first[2] <= 0x04
+	}
+	return bytes.HasPrefix(first, ps.prefix)
+}
+
+func (fw *Firewall) protocolSignatures() []ProtocolSignature {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.parsedRules.ProtocolSignatures
+}
+
+type unknownProtocolError struct {
+	first []byte
+}
+
+func (e *unknownProtocolError) Error() string {
+	return fmt.Sprintf("first bytes %q match no allowed protocol", e.first)
+}
+
+// sniffProtocol peeks at the client's first bytes and returns the signature
+// they match. A client that sends less than a signature needs before going
+// quiet is judged on what it sent.
+func sniffProtocol(reader *bufio.Reader, signatures []ProtocolSignature) (ProtocolSignature, error) {
+	need := 1
+	for _, signature := range signatures {
+		if n := signature.length(); n > need {
+			need = n
+		}
+	}
+	first, err := reader.Peek(need)
+	if len(first) == 0 {
+		return ProtocolSignature{}, err
+	}
+	if signature, ok := matchProtocolSignature(first, signatures); ok {
+		return signature, nil
+	}
+	return ProtocolSignature{}, &unknownProtocolError{first: append([]byte(nil), first...)}
+}
+
+// matchProtocolSignature returns the first of signatures that first matches.
+func matchProtocolSignature(first []byte, signatures []ProtocolSignature) (ProtocolSignature, bool) {
+	for _, signature := range signatures {
+		if signature.Matches(first) {
+			return signature, true
+		}
+	}
+	return ProtocolSignature{}, false
+}
+
+// readOpaqueHead takes what the client sent first on a connection that isn't
+// HTTP: a TLS ClientHello record, with its SNI as the Host, or for custom
+// signatures whatever is buffered.
+func readOpaqueHead(reader *bufio.Reader, signature ProtocolSignature) (*RequestHead, error) {
+	head := &RequestHead{
+		Proto:  signature.Name,
+		Header: make(http.Header),
+		Raw:    acquireRequestBuffer(),
+		Opaque: true,
+	}
+
+	if signature.Name == SignatureTLS {
+		header, err := reader.Peek(tlsRecordHeaderSize)
+		if err != nil {
+			head.Release()
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint16(header[3:5]))
+		if length > maxTLSRecordSize {
+			head.Release()
+			return nil, errMalformedRequest
+		}
+		record := make([]byte, tlsRecordHeaderSize+length)
+		if _, err := io.ReadFull(reader, record); err != nil {
+			head.Release()
+			return nil, err
+		}
+		head.Raw = append(head.Raw, record...)
+		if serverName := clientHelloServerName(record[tlsRecordHeaderSize:]); serverName != "" {
+			head.Header.Set("Host", serverName)
+		}
+	}
+
+	if buffered := reader.Buffered(); buffered > 0 {
+		rest, _ := reader.Peek(buffered)
+		head.Raw = append(head.Raw, rest...)
+	}
+	return head, nil
+}
+
+// clientHelloServerName returns the server_name extension of the
+// ClientHello in a handshake record, or "" if it has none or spans further
+// records.
+func clientHelloServerName(handshake []byte) string {
+	// Handshake type and length, client version and random.
+	if len(handshake) < 4+2+32 || handshake[0] != 0x01 {
+		return ""
+	}
+	data := handshake[4+2+32:]
+
+	skip := func(lengthBytes int) bool {
+		if len(data) < lengthBytes {
+			return false
+		}
+		n := 0
+		for _, b := range data[:lengthBytes] {
+			n = n<<8 | int(b)
+		}
+		if len(data) < lengthBytes+n {
+			return false
+		}
+		data = data[lengthBytes+n:]
+		return true
+	}
+	// Session ID, cipher suites, compression methods.
+	if !skip(1) || !skip(2) || !skip(1) || len(data) < 2 {
+		return ""
+	}
+
+	extensions := data[2:]
+	if n := int(binary.BigEndian.Uint16(data)); n < len(extensions) {
+		extensions = extensions[:n]
+	}
+	for len(extensions) >= 4 {
+		kind := binary.BigEndian.Uint16(extensions)
+		n := int(binary.BigEndian.Uint16(extensions[2:]))
+		if len(extensions) < 4+n {
+			return ""
+		}
+		body := extensions[4 : 4+n]
+		extensions = extensions[4+n:]
+		if kind != 0 {
+			continue
+		}
+
+		// server_name_list: one host_name entry in practice.
+		if len(body) < 5 || body[2] != 0 {
+			return ""
+		}
+		nameLength := int(binary.BigEndian.Uint16(body[3:]))
+		if len(body) < 5+nameLength {
+			return ""
+		}
+		return strings.ToLower(string(body[5 : 5+nameLength]))
+	}
+	return ""
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	QueryCount = "count"
+	QueryList  = "list"
+
+	DefaultQueryListLimit = 100
+)
+
+// querySources narrow a query to one kind of event; "events" is all of them.
+var querySources = map[string]func(logLine) bool{
+	"events":      func(logLine) bool { return true },
+	"blocks":      func(line logLine) bool { return line.Category == "BLOCKED" },
+	"connections": func(line logLine) bool { return line.Category == "CONNECTION" },
+	"security":    func(line logLine) bool { return line.Level == SECURITY.String() },
+}
+
+var queryFields = map[string]bool{
+	"level": true, "category": true, "ip": true, "hostname": true, "reason": true, "verdict": true,
+	"rule": true, "protocol": true, "upstream": true, "request_id": true, "message": true, "hour": true, "day": true,
+}
+
+type queryCondition struct {
+	Field    string
+	Op       string
+	Values   []string
+	Networks []*net.IPNet
+}
+
+// logQuery is a parsed query over the firewall log:
+//
+//	count|list [events|blocks|connections|security] [by field, ...]
+//	    [where field =|!=|~|in value [and ...]] [since t] [until t] [limit n]
+//
+// "~" matches a substring, case-insensitively; "ip in" takes CIDRs, and "in"
+// a single value or a parenthesized list. Times are durations back from now
+// (30m, 24h, 7d) or local dates and times (2024-01-02, "2024-01-02 15:04").
+type logQuery struct {
+	Verb    string
+	Source  string
+	GroupBy []string
+	Where   []queryCondition
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+func tokenizeQuery(text string) ([]string, error) {
+	var tokens []string
+	var current strings.Builder
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '"' || r == '\'':
+			flush()
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			tokens = append(tokens, string(runes[i+1:end]))
+			i = end
+		case r == ' ' || r == '\t' || r == '\n':
+			flush()
+		case r == ',' || r == '(' || r == ')' || r == '=' || r == '~':
+			flush()
+			tokens = append(tokens, string(r))
+		case r == '!' && i+1 < len(runes) && runes[i+1] == '=':
+			flush()
+			tokens = append(tokens, "!=")
+			i++
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens, nil
+}
+
+// parseQueryTime reads a since/until value relative to now.
+func parseQueryTime(value string, now time.Time) (time.Time, error) {
+	if days, found := strings.CutSuffix(value, "d"); found {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02 15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a duration or a date", value)
+}
+
+func parseQueryNetwork(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an IP or CIDR", value)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not an IP or CIDR", value)
+	}
+	return network, nil
+}
+
+type queryParser struct {
+	tokens []string
+	pos    int
+}
+
+func (qp *queryParser) peek() string {
+	if qp.pos < len(qp.tokens) {
+		return strings.ToLower(qp.tokens[qp.pos])
+	}
+	return ""
+}
+
+func (qp *queryParser) next(what string) (string, error) {
+	if qp.pos >= len(qp.tokens) {
+		return "", fmt.Errorf("expected %s at the end of the query", what)
+	}
+	qp.pos++
+	return qp.tokens[qp.pos-1], nil
+}
+
+func (qp *queryParser) field() (string, error) {
+	name, err := qp.next("a field")
+	if err != nil {
+		return "", err
+	}
+	name = strings.ToLower(name)
+	if !queryFields[name] {
+		return "", fmt.Errorf("unknown field %q", name)
+	}
+	return name, nil
+}
+
+func (qp *queryParser) condition() (queryCondition, error) {
+	name, err := qp.field()
+	if err != nil {
+		return queryCondition{}, err
+	}
+	op, err := qp.next("an operator")
+	if err != nil {
+		return queryCondition{}, err
+	}
+	condition := queryCondition{Field: name, Op: strings.ToLower(op)}
+
+	switch condition.Op {
+	case "=", "!=", "~":
+		value, err := qp.next("a value")
+		if err != nil {
+			return queryCondition{}, err
+		}
+		condition.Values = []string{value}
+	case "in":
+		if qp.peek() == "(" {
+			qp.pos++
+			for qp.peek() != ")" {
+				value, err := qp.next("a value or )")
+				if err != nil {
+					return queryCondition{}, err
+				}
+				if value != "," {
+					condition.Values = append(condition.Values, value)
+				}
+			}
+			qp.pos++
+		} else {
+			value, err := qp.next("a value")
+			if err != nil {
+				return queryCondition{}, err
+			}
+			condition.Values = []string{value}
+		}
+		if len(condition.Values) == 0 {
+			return queryCondition{}, fmt.Errorf("%s in () matches nothing", name)
+		}
+	default:
+		return queryCondition{}, fmt.Errorf("unknown operator %q after %s", op, name)
+	}
+
+	if name == "ip" && condition.Op == "in" {
+		for _, value := range condition.Values {
+			network, err := parseQueryNetwork(value)
+			if err != nil {
+				return queryCondition{}, err
+			}
+			condition.Networks = append(condition.Networks, network)
+		}
+	}
+	return condition, nil
+}
+
+func parseLogQuery(text string, now time.Time) (logQuery, error) {
+	tokens, err := tokenizeQuery(text)
+	if err != nil {
+		return logQuery{}, err
+	}
+	qp := &queryParser{tokens: tokens}
+
+	query := logQuery{Verb: qp.peek(), Source: "events"}
+	if query.Verb != QueryCount && query.Verb != QueryList {
+		return logQuery{}, fmt.Errorf("a query starts with count or list")
+	}
+	qp.pos++
+	if _, known := querySources[qp.peek()]; known {
+		query.Source = qp.peek()
+		qp.pos++
+	}
+
+	for qp.pos < len(qp.tokens) {
+		switch keyword := qp.peek(); keyword {
+		case "by":
+			qp.pos++
+			for {
+				name, err := qp.field()
+				if err != nil {
+					return logQuery{}, err
+				}
+				query.GroupBy = append(query.GroupBy, name)
+				if qp.peek() != "," {
+					break
+				}
+				qp.pos++
+			}
+		case "where":
+			qp.pos++
+			for {
+				condition, err := qp.condition()
+				if err != nil {
+					return logQuery{}, err
+				}
+				query.Where = append(query.Where, condition)
+				if qp.peek() != "and" {
+					break
+				}
+				qp.pos++
+			}
+		case "since", "until":
+			qp.pos++
+			value, err := qp.next("a time")
+			if err != nil {
+				return logQuery{}, err
+			}
+			t, err := parseQueryTime(value, now)
+			if err != nil {
+				return logQuery{}, err
+			}
+			if keyword == "since" {
+				query.Since = t
+			} else {
+				query.Until = t
+			}
+		case "limit":
+			qp.pos++
+			value, err := qp.next("a number")
+			if err != nil {
+				return logQuery{}, err
+			}
+			if query.Limit, err = strconv.Atoi(value); err != nil || query.Limit <= 0 {
+				return logQuery{}, fmt.Errorf("limit must be a positive number")
+			}
+		default:
+			return logQuery{}, fmt.Errorf("unexpected %q", qp.tokens[qp.pos])
+		}
+	}
+
+	if query.Verb == QueryList && len(query.GroupBy) > 0 {
+		return logQuery{}, fmt.Errorf("by only applies to count")
+	}
+	if query.Verb == QueryList && query.Limit == 0 {
+		query.Limit = DefaultQueryListLimit
+	}
+	return query, nil
+}
+
+// logEventFields breaks an entry into the fields queries can use. Messages
+// are " - "-separated "Key: value" pairs, led by the client's IP.
+func logEventFields(line logLine) map[string]string {
+	fields := map[string]string{
+		"level":      line.Level,
+		"category":   line.Category,
+		"request_id": line.RequestID,
+		"message":    line.Message,
+		"hour":       line.At.Format("2006-01-02 15:00"),
+		"day":        line.At.Format("2006-01-02"),
+	}
+	if line.Category == "RATE_LIMIT" {
+		fields["reason"] = "RATE_LIMIT"
+	}
+
+	for _, part := range strings.Split(line.Message, " - ") {
+		key, value, found := strings.Cut(part, ": ")
+		if !found {
+			continue
+		}
+		switch key {
+		case "IP":
+			address, rest, _ := strings.Cut(value, " ")
+			if ip, ok := replayedClient("IP: " + address); ok {
+				address = ip
+			}
+			fields["ip"] = address
+			if strings.HasPrefix(rest, "(") && strings.HasSuffix(rest, ")") {
+				fields["hostname"] = strings.Trim(rest, "()")
+			}
+		case "Reason":
+			fields["reason"] = value
+		case "Verdict":
+			verdict, reason, _ := strings.Cut(value, " (")
+			fields["verdict"] = verdict
+			if reason != "" {
+				fields["reason"] = strings.TrimSuffix(reason, ")")
+			}
+		case "Rule":
+			fields["rule"] = value
+		case "Protocol":
+			fields["protocol"] = value
+		case "Upstream":
+			fields["upstream"] = value
+		}
+	}
+	return fields
+}
+
+func (condition queryCondition) matches(fields map[string]string) bool {
+	value := fields[condition.Field]
+	switch condition.Op {
+	case "=":
+		return strings.EqualFold(value, condition.Values[0])
+	case "!=":
+		return !strings.EqualFold(value, condition.Values[0])
+	case "~":
+		return strings.Contains(strings.ToLower(value), strings.ToLower(condition.Values[0]))
+	}
+	if condition.Networks != nil {
+		ip := net.ParseIP(value)
+		for _, network := range condition.Networks {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, candidate := range condition.Values {
+		if strings.EqualFold(value, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryGroup is one row of a count query.
+type queryGroup struct {
+	Values map[string]string `json:"values,omitempty"`
+	Count  int               `json:"count"`
+}
+
+type queryResult struct {
+	Count  int          `json:"count"`
+	Groups []queryGroup `json:"groups,omitempty"`
+	Lines  []string     `json:"lines,omitempty"`
+}
+
+// queryLogFiles returns firewall.log and the daily files rotated out of it
+// that may hold entries from since on, oldest first.
+func queryLogFiles(dir string, since time.Time) []string {
+	rotated, _ := filepath.Glob(filepath.Join(dir, "firewall-*.log"))
+	sort.Strings(rotated)
+
+	var files []string
+	for _, path := range rotated {
+		date := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "firewall-"), ".log")
+		day, err := time.ParseInLocation("2006-01-02", date, time.Local)
+		if err == nil && !since.IsZero() && day.AddDate(0, 0, 1).Before(since) {
+			continue
+		}
+		files = append(files, path)
+	}
+	return append(files, filepath.Join(dir, "firewall.log"))
+}
+
+func runLogQuery(query logQuery, files []string) (queryResult, error) {
+	var result queryResult
+	matchesSource := querySources[query.Source]
+	groups := make(map[string]*queryGroup)
+
+	for _, path := range files {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line, ok := parseLogLine(scanner.Text())
+			if !ok || !matchesSource(line) || line.At.Before(query.Since) || (!query.Until.IsZero() && !line.At.Before(query.Until)) {
+				continue
+			}
+			fields := logEventFields(line)
+			matched := true
+			for _, condition := range query.Where {
+				if !condition.matches(fields) {
+					matched = false
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+
+			result.Count++
+			if query.Verb == QueryList {
+				if len(result.Lines) < query.Limit {
+					result.Lines = append(result.Lines, scanner.Text())
+				}
+				continue
+			}
+			if len(query.GroupBy) > 0 {
+				values := make([]string, len(query.GroupBy))
+				for i, name := range query.GroupBy {
+					values[i] = fields[name]
+				}
+				key := strings.Join(values, "\x00")
+				group, exists := groups[key]
+				if !exists {
+					group = &queryGroup{Values: make(map[string]string, len(values))}
+					for i, name := range query.GroupBy {
+						group.Values[name] = values[i]
+					}
+					groups[key] = group
+				}
+				group.Count++
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return result, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+	}
+
+	for _, group := range groups {
+		result.Groups = append(result.Groups, *group)
+	}
+	sort.Slice(result.Groups, func(i, j int) bool {
+		if result.Groups[i].Count != result.Groups[j].Count {
+			return result.Groups[i].Count > result.Groups[j].Count
+		}
+		for _, name := range query.GroupBy {
+			if a, b := result.Groups[i].Values[name], result.Groups[j].Values[name]; a != b {
+				return a < b
+			}
+		}
+		return false
+	})
+	if query.Limit > 0 && len(result.Groups) > query.Limit {
+		result.Groups = result.Groups[:query.Limit]
+	}
+	return result, nil
+}
+
+func printQueryResult(w io.Writer, query logQuery, result queryResult) {
+	if query.Verb == QueryList {
+		for _, line := range result.Lines {
+			fmt.Fprintln(w, line)
+		}
+		if result.Count > len(result.Lines) {
+			fmt.Fprintf(w, "(%d of %d matching events shown)\n", len(result.Lines), result.Count)
+		}
+		return
+	}
+	if len(query.GroupBy) == 0 {
+		fmt.Fprintln(w, result.Count)
+		return
+	}
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, strings.Join(query.GroupBy, "\t")+"\tcount")
+	for _, group := range result.Groups {
+		for _, name := range query.GroupBy {
+			value := group.Values[name]
+			if value == "" {
+				value = "-"
+			}
+			fmt.Fprint(table, value+"\t")
+		}
+		fmt.Fprintln(table, group.Count)
+	}
+	table.Flush()
+}
+
+// runQueryCommand answers a query over the firewall log and the daily files
+// rotated out of it, e.g.
+//
+//	firewall query count blocks by reason where ip in 1.2.3.0/24 since 24h
+func runQueryCommand(args []string) int {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	logDir := flags.String("log-dir", DefaultLogDir, "directory holding firewall.log")
+	asJSON := flags.Bool("json", false, "print the result as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: firewall query [-log-dir dir] [-json] count|list [events|blocks|connections|security] [by field, ...] [where field =|!=|~|in value [and ...]] [since t] [until t] [limit n]")
+		return 2
+	}
+
+	query, err := parseLogQuery(strings.Join(flags.Args(), " "), time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid query: %v\n", err)
+		return 2
+	}
+	result, err := runLogQuery(query, queryLogFiles(*logDir, query.Since))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "query failed: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(result)
+		return 0
+	}
+	printQueryResult(os.Stdout, query, result)
+	return 0
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultQUICNewConnectionsPerMinute = 30
+	DefaultQUICIdleTimeoutSeconds      = 30
+
+	// QUICMinInitialSize is the size clients must pad Initial datagrams to
+	// (RFC 9000 section 14.1), which keeps the upstream's first flight from
+	// being used for amplification.
+	QUICMinInitialSize = 1200
+	QUICRefusalTime    = 10 * time.Second
+	maxQUICDatagram    = 65535
+
+	quicVersion2 = 0x6b3343cf
+)
+
+// QUICConfig forwards QUIC (HTTP/3) datagrams to the reverse proxy so
+// DockerChat can advertise HTTP/3 without bypassing the firewall. A new
+// client flow has to start with a full-size Initial packet; its IP goes
+// through the whitelist, blocked_ips, blocked_asns and countries checks, and
+// may open at most MaxNewConnectionsPerMinute new connection IDs a minute.
+// Connection IDs the upstream hands out are tracked, so a client that
+// migrates to a new address keeps its flow. Listen (default FIREWALL_PORT,
+// over UDP) is only read at startup; UpstreamPort defaults to
+// REVERSE_PROXY_PORT.
+type QUICConfig struct {
+	Enabled                    bool   `json:"enabled"`
+	Listen                     string `json:"listen"`
+	UpstreamPort               int    `json:"upstream_port"`
+	MaxNewConnectionsPerMinute int    `json:"max_new_connections_per_minute"`
+	IdleTimeoutSeconds         int    `json:"idle_timeout_seconds"`
+}
+
+func normalizeQUICConfig(config QUICConfig) QUICConfig {
+	if config.UpstreamPort < 0 || config.UpstreamPort > 65535 {
+		config.UpstreamPort = 0
+	}
+	if config.MaxNewConnectionsPerMinute <= 0 {
+		config.MaxNewConnectionsPerMinute = DefaultQUICNewConnectionsPerMinute
+	}
+	if config.IdleTimeoutSeconds <= 0 {
+		config.IdleTimeoutSeconds = DefaultQUICIdleTimeoutSeconds
+	}
+	return config
+}
+
+func (fw *Firewall) quicConfig() QUICConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.QUIC
+}
+
+// quicHeader is what the firewall reads of a QUIC packet: the invariant
+// long-header fields (RFC 8999), or just the first byte of a short header.
+type quicHeader struct {
+	long    bool
+	initial bool
+	dcid    []byte
+	scid    []byte
+}
+
+func parseQUICHeader(packet []byte) (quicHeader, bool) {
+	var header quicHeader
+	if len(packet) == 0 {
+		return header, false
+	}
+	if packet[0]&0x80 == 0 {
+		return header, true
+	}
+	header.long = true
+
+	if len(packet) < 6 {
+		return header, false
+	}
+	version := binary.BigEndian.Uint32(packet[1:5])
+	packetType := packet[0] & 0x30 >> 4
+	header.initial = version != 0 && (packetType == 0 && version != quicVersion2 || packetType == 1 && version == quicVersion2)
+
+	rest := packet[5:]
+	for _, cid := range []*[]byte{&header.dcid, &header.scid} {
+		if len(rest) < 1 || int(rest[0]) > 20 || len(rest) < 1+int(rest[0]) {
+			return header, false
+		}
+		*cid = rest[1 : 1+rest[0]]
+		rest = rest[1+rest[0]:]
+	}
+	return header, true
+}
+
+type quicFlow struct {
+	key      string
+	client   net.Addr
+	upstream *net.UDPConn
+	lastSeen time.Time
+	dcids    map[string]bool
+}
+
+// QUICProxy relays datagrams between clients and the upstream, one upstream
+// socket per client flow.
+type QUICProxy struct {
+	conn net.PacketConn
+
+	mutex      sync.Mutex
+	flows      map[string]*quicFlow
+	byCID      map[string]*quicFlow
+	cidLengths map[int]bool
+	attempts   map[string][]time.Time
+	refused    map[string]time.Time
+}
+
+func NewQUICProxy(conn net.PacketConn) *QUICProxy {
+	return &QUICProxy{
+		conn:       conn,
+		flows:      make(map[string]*quicFlow),
+		byCID:      make(map[string]*quicFlow),
+		cidLengths: make(map[int]bool),
+		attempts:   make(map[string][]time.Time),
+		refused:    make(map[string]time.Time),
+	}
+}
+
+// startQUIC opens the UDP listener when QUIC passthrough is enabled.
+func (fw *Firewall) startQUIC() error {
+	config := fw.quicConfig()
+	if !config.Enabled {
+		return nil
+	}
+	listen := config.Listen
+	if listen == "" {
+		listen = fmt.Sprintf(":%d", fw.firewallPort)
+	}
+
+	conn, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		return fmt.Errorf("QUIC listen on %s: %v", listen, err)
+	}
+	fw.quic = NewQUICProxy(conn)
+	fw.logger.LogStartup("QUIC passthrough listening on udp %s -> %s", conn.LocalAddr(), fw.quicUpstream(config))
+
+	go func() {
+		<-fw.shutdown
+		conn.Close()
+		fw.quic.mutex.Lock()
+		for _, flow := range fw.quic.flows {
+			flow.upstream.Close()
+		}
+		fw.quic.mutex.Unlock()
+	}()
+	go fw.quicReceiver()
+	go fw.quicFlowReaper()
+	return nil
+}
+
+func (fw *Firewall) quicUpstream(config QUICConfig) string {
+	port := config.UpstreamPort
+	if port == 0 {
+		port = fw.proxyPort
+	}
+	return net.JoinHostPort(fw.proxyHost, strconv.Itoa(port))
+}
+
+func (fw *Firewall) quicReceiver() {
+	buf := make([]byte, maxQUICDatagram)
+	for {
+		n, addr, err := fw.quic.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-fw.shutdown:
+				return
+			default:
+				fw.logErrorRateLimited("quic_receive", "QUIC", "Receive failed: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+		}
+		fw.handleQUICDatagram(buf[:n], addr)
+	}
+}
+
+// quicRefusal returns why ip may not open a QUIC flow ("" if it may) and
+// whether it is whitelisted, which also exempts it from the rate limit.
+func (fw *Firewall) quicRefusal(ip, key string) (string, string, bool) {
+	decision := fw.decidePrecedence(ip, key, fw.clock.Now())
+	if decision.Block {
+		return decision.BlockReason(), fmt.Sprintf("%s matched %s", ip, decision), false
+	}
+	if decision.Rule == RuleWhitelist {
+		return "", "", true
+	}
+	if asn, org, blocked := fw.isBlockedASN(ip); blocked {
+		return "BLOCKED_ASN", formatASN(asn, org) + " is in blocked_asns", false
+	}
+	if countries := fw.countryPolicy(); countries.Enabled {
+		if country := fw.lookupCountry(ip); !countries.Admits(country) {
+			return "COUNTRY_DENIED", fmt.Sprintf("country %q not admitted", country), false
+		}
+	}
+	return "", "", false
+}
+
+// admitConnectionID counts a new connection ID for key and reports whether
+// it fits in limit. Callers must hold the proxy's mutex.
+func (qp *QUICProxy) admitConnectionID(key string, limit int, now time.Time) (bool, int) {
+	attempts := qp.attempts[key][:0]
+	for _, attempt := range qp.attempts[key] {
+		if now.Sub(attempt) < time.Minute {
+			attempts = append(attempts, attempt)
+		}
+	}
+	if len(attempts) >= limit {
+		qp.attempts[key] = attempts
+		return false, len(attempts)
+	}
+	qp.attempts[key] = append(attempts, now)
+	return true, len(attempts) + 1
+}
+
+// migratedFlow finds the flow a short-header packet from an unknown address
+// belongs to by its destination connection ID.
+func (qp *QUICProxy) migratedFlow(packet []byte) *quicFlow {
+	for length := range qp.cidLengths {
+		if len(packet) > length {
+			if flow, exists := qp.byCID[string(packet[1:1+length])]; exists {
+				return flow
+			}
+		}
+	}
+	return nil
+}
+
+func (fw *Firewall) handleQUICDatagram(packet []byte, addr net.Addr) {
+	header, ok := parseQUICHeader(packet)
+	if !ok {
+		return
+	}
+	udpAddr, isUDP := addr.(*net.UDPAddr)
+	if !isUDP {
+		return
+	}
+	ip := udpAddr.IP.String()
+	key := fw.aggregationKey(ip)
+	now := fw.clock.Now()
+	config := fw.quicConfig()
+	qp := fw.quic
+
+	qp.mutex.Lock()
+	if until, refused := qp.refused[addr.String()]; refused && now.Before(until) {
+		qp.mutex.Unlock()
+		return
+	}
+	flow, exists := qp.flows[addr.String()]
+	var migrated *quicFlow
+	if !exists && !header.long {
+		migrated = qp.migratedFlow(packet)
+	}
+	newCID := header.initial && (!exists || !flow.dcids[string(header.dcid)])
+	qp.mutex.Unlock()
+
+	if !exists && migrated == nil && !(header.initial && len(packet) >= QUICMinInitialSize) {
+		return
+	}
+
+	// Checks run without the proxy's mutex: they may wait on rules or DNS.
+	reason, detail, whitelisted := "", "", false
+	if !exists {
+		reason, detail, whitelisted = fw.quicRefusal(ip, key)
+	} else if newCID {
+		_, _, whitelisted = fw.quicRefusal(ip, key)
+	}
+
+	qp.mutex.Lock()
+	if migrated != nil && reason == "" && qp.flows[migrated.client.String()] == migrated {
+		// A client that moved to a new address keeps its flow.
+		delete(qp.flows, migrated.client.String())
+		migrated.client, migrated.key = addr, key
+		qp.flows[addr.String()] = migrated
+		flow, exists = migrated, true
+	} else if migrated != nil {
+		qp.mutex.Unlock()
+		return
+	}
+	if exists && qp.flows[addr.String()] != flow {
+		flow, exists = nil, false
+	}
+
+	if newCID && reason == "" && !whitelisted {
+		if admitted, count := qp.admitConnectionID(key, config.MaxNewConnectionsPerMinute, now); !admitted {
+			reason, detail = "QUIC_RATE_LIMIT", fmt.Sprintf("%d/%d new QUIC connections per minute", count, config.MaxNewConnectionsPerMinute)
+		}
+	}
+	if reason == "" && !exists && len(qp.flows) >= MaxTrackedIPs {
+		reason, detail = "QUIC_FLOWS", fmt.Sprintf("%d QUIC flows already open", len(qp.flows))
+	}
+	if reason != "" {
+		qp.refused[addr.String()] = now.Add(QUICRefusalTime)
+		qp.mutex.Unlock()
+		if fw.logger != nil {
+			fw.logger.LogBlocked(ip, reason, detail)
+		}
+		return
+	}
+
+	if !exists {
+		// Only this goroutine creates flows, so none can appear for addr
+		// while the upstream is dialed.
+		qp.mutex.Unlock()
+		upstream, err := fw.dialQUICUpstream(config)
+		if err != nil {
+			fw.logErrorRateLimited("quic_upstream", "QUIC", "Failed to reach upstream %s: %v", fw.quicUpstream(config), err)
+			return
+		}
+		qp.mutex.Lock()
+		flow = &quicFlow{key: key, client: addr, upstream: upstream, dcids: make(map[string]bool)}
+		qp.flows[addr.String()] = flow
+		go fw.quicUpstreamReader(flow)
+	}
+	if header.initial {
+		flow.dcids[string(header.dcid)] = true
+	}
+	flow.lastSeen = now
+	upstream := flow.upstream
+	qp.mutex.Unlock()
+
+	upstream.Write(packet)
+}
+
+func (fw *Firewall) dialQUICUpstream(config QUICConfig) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", fw.quicUpstream(config))
+	if err != nil {
+		return nil, err
+	}
+	return net.DialUDP("udp", nil, addr)
+}
+
+// quicUpstreamReader relays the upstream's datagrams back to the flow's
+// client and learns the connection IDs it hands out, until the flow is
+// reaped.
+func (fw *Firewall) quicUpstreamReader(flow *quicFlow) {
+	buf := make([]byte, maxQUICDatagram)
+	for {
+		n, err := flow.upstream.Read(buf)
+		if err != nil {
+			return
+		}
+
+		qp := fw.quic
+		qp.mutex.Lock()
+		if header, ok := parseQUICHeader(buf[:n]); ok && header.long && len(header.scid) > 0 {
+			qp.byCID[string(header.scid)] = flow
+			qp.cidLengths[len(header.scid)] = true
+		}
+		client := flow.client
+		qp.mutex.Unlock()
+
+		qp.conn.WriteTo(buf[:n], client)
+	}
+}
+
+// reapQUICFlows closes flows idle for longer than the idle timeout and
+// forgets expired refusals and counters.
+func (fw *Firewall) reapQUICFlows() {
+	now := fw.clock.Now()
+	idle := time.Duration(fw.quicConfig().IdleTimeoutSeconds) * time.Second
+
+	qp := fw.quic
+	qp.mutex.Lock()
+	defer qp.mutex.Unlock()
+
+	for addr, flow := range qp.flows {
+		if now.Sub(flow.lastSeen) > idle {
+			flow.upstream.Close()
+			delete(qp.flows, addr)
+		}
+	}
+	for cid, flow := range qp.byCID {
+		if qp.flows[flow.client.String()] != flow {
+			delete(qp.byCID, cid)
+		}
+	}
+	for addr, until := range qp.refused {
+		if now.After(until) {
+			delete(qp.refused, addr)
+		}
+	}
+	for key, attempts := range qp.attempts {
+		if countSince(attempts, time.Minute, now) == 0 {
+			delete(qp.attempts, key)
+		}
+	}
+}
+
+func (fw *Firewall) quicFlowReaper() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fw.reapQUICFlows()
+		case <-fw.shutdown:
+			return
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultQuotaPath                = "/var/log/shared/firewall/quotas.json"
+	DefaultQuotaSaveIntervalSeconds = 60
+	DefaultQuotaAPIKeyHeader        = "X-API-Key"
+
+	QuotaPeriodDay  = "day"
+	QuotaPeriodWeek = "week"
+	QuotaPerIP      = "ip"
+	QuotaPerAPIKey  = "api_key"
+)
+
+// QuotaConfig sets long-horizon budgets, unlike the rate limits' sliding
+// minutes and hours: each limit caps the connections and bytes (in plus out)
+// a client may use per UTC day or ISO week, counted per IP (its aggregation
+// key) or per API key, taken from APIKeyHeader. A client over any of its
+// quotas is refused with QUOTA_EXCEEDED until the period ends. Bytes are
+// counted when a connection ends, so a connection is never cut short; the
+// next one is refused. Counters are saved to Path every SaveIntervalSeconds
+// and on shutdown, and survive restarts. Whitelisted and rate limit exempt
+// clients have no quotas.
+type QuotaConfig struct {
+	Enabled             bool         `json:"enabled"`
+	Path                string       `json:"path"`
+	SaveIntervalSeconds int          `json:"save_interval_seconds"`
+	APIKeyHeader        string       `json:"api_key_header"`
+	Limits              []QuotaLimit `json:"limits"`
+}
+
+type QuotaLimit struct {
+	Name           string `json:"name"`
+	Per            string `json:"per"`
+	Period         string `json:"period"`
+	MaxConnections int64  `json:"max_connections"`
+	MaxBytes       int64  `json:"max_bytes"`
+}
+
+func normalizeQuotaConfig(config QuotaConfig) QuotaConfig {
+	if config.Path == "" {
+		config.Path = DefaultQuotaPath
+	}
+	if config.SaveIntervalSeconds <= 0 {
+		config.SaveIntervalSeconds = DefaultQuotaSaveIntervalSeconds
+	}
+	if config.APIKeyHeader == "" {
+		config.APIKeyHeader = DefaultQuotaAPIKeyHeader
+	}
+
+	seen := make(map[string]bool, len(config.Limits))
+	limits := make([]QuotaLimit, 0, len(config.Limits))
+	for _, limit := range config.Limits {
+		limit.Per = strings.ToLower(strings.TrimSpace(limit.Per))
+		if limit.Per == "" {
+			limit.Per = QuotaPerIP
+		}
+		limit.Period = strings.ToLower(strings.TrimSpace(limit.Period))
+		if limit.Period == "" {
+			limit.Period = QuotaPeriodDay
+		}
+		if limit.Name == "" {
+			limit.Name = limit.Per + "_" + limit.Period
+		}
+		if (limit.Per != QuotaPerIP && limit.Per != QuotaPerAPIKey) ||
+			(limit.Period != QuotaPeriodDay && limit.Period != QuotaPeriodWeek) ||
+			(limit.MaxConnections <= 0 && limit.MaxBytes <= 0) || seen[limit.Name] {
+			continue
+		}
+		seen[limit.Name] = true
+		limits = append(limits, limit)
+	}
+	config.Limits = limits
+	return config
+}
+
+// quotaProblems lists the limits normalizeQuotaConfig drops.
+func quotaProblems(config QuotaConfig) []string {
+	var problems []string
+	seen := make(map[string]bool, len(config.Limits))
+	for i, limit := range config.Limits {
+		normalized := normalizeQuotaConfig(QuotaConfig{Limits: []QuotaLimit{limit}}).Limits
+		switch {
+		case len(normalized) == 0 && limit.MaxConnections <= 0 && limit.MaxBytes <= 0:
+			problems = append(problems, fmt.Sprintf("limits[%d] sets neither max_connections nor max_bytes - ignored", i))
+		case len(normalized) == 0:
+			problems = append(problems, fmt.Sprintf("limits[%d]: per must be ip or api_key and period day or week - ignored", i))
+		case seen[normalized[0].Name]:
+			problems = append(problems, fmt.Sprintf("limits[%d]: %s is defined twice - ignored", i, normalized[0].Name))
+		default:
+			seen[normalized[0].Name] = true
+		}
+	}
+	return problems
+}
+
+func (fw *Firewall) quotaConfig() QuotaConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.Quotas
+}
+
+var quotaPeriodAdjectives = map[string]string{QuotaPeriodDay: "daily", QuotaPeriodWeek: "weekly"}
+
+// quotaPeriodEnd is when the period holding now ends.
+func quotaPeriodEnd(period string, now time.Time) time.Time {
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if period == QuotaPeriodWeek {
+		daysToMonday := (8 - int(now.Weekday())) % 7
+		if daysToMonday == 0 {
+			daysToMonday = 7
+		}
+		return midnight.AddDate(0, 0, daysToMonday)
+	}
+	return midnight.AddDate(0, 0, 1)
+}
+
+// QuotaUsage is what a subject used of one limit in the current period.
+type QuotaUsage struct {
+	Limit       string    `json:"limit"`
+	Subject     string    `json:"subject"`
+	Connections int64     `json:"connections"`
+	Bytes       int64     `json:"bytes"`
+	Resets      time.Time `json:"resets"`
+}
+
+// QuotaTracker holds the usage of every (limit, subject) in its current
+// period.
+type QuotaTracker struct {
+	mutex sync.Mutex
+	usage map[string]*QuotaUsage
+	dirty bool
+}
+
+func NewQuotaTracker() *QuotaTracker {
+	return &QuotaTracker{usage: make(map[string]*QuotaUsage)}
+}
+
+// entry returns the usage of subject under limit, starting a new period if
+// the last one is over. Callers hold the mutex.
+func (qt *QuotaTracker) entry(limit QuotaLimit, subject string, now time.Time) *QuotaUsage {
+	key := limit.Name + "|" + subject
+	usage, exists := qt.usage[key]
+	if exists && now.Before(usage.Resets) {
+		return usage
+	}
+	if !exists && len(qt.usage) >= MaxTrackedIPs {
+		for k, u := range qt.usage {
+			if u.Connections <= 1 || !now.Before(u.Resets) {
+				delete(qt.usage, k)
+			}
+		}
+	}
+	usage = &QuotaUsage{Limit: limit.Name, Subject: subject, Resets: quotaPeriodEnd(limit.Period, now)}
+	qt.usage[key] = usage
+	return usage
+}
+
+// Exceeded reports whether subject has used up limit this period.
+func (qt *QuotaTracker) Exceeded(limit QuotaLimit, subject string, now time.Time) (QuotaUsage, bool) {
+	qt.mutex.Lock()
+	defer qt.mutex.Unlock()
+
+	usage := QuotaUsage{Limit: limit.Name, Subject: subject, Resets: quotaPeriodEnd(limit.Period, now)}
+	if current, exists := qt.usage[limit.Name+"|"+subject]; exists && now.Before(current.Resets) {
+		usage = *current
+	}
+	exceeded := (limit.MaxConnections > 0 && usage.Connections >= limit.MaxConnections) ||
+		(limit.MaxBytes > 0 && usage.Bytes >= limit.MaxBytes)
+	return usage, exceeded
+}
+
+func (qt *QuotaTracker) Add(limit QuotaLimit, subject string, connections, bytes int64, now time.Time) {
+	qt.mutex.Lock()
+	defer qt.mutex.Unlock()
+
+	usage := qt.entry(limit, subject, now)
+	usage.Connections += connections
+	usage.Bytes += bytes
+	qt.dirty = true
+}
+
+// Cleanup drops usage from periods that are over.
+func (qt *QuotaTracker) Cleanup(now time.Time) {
+	qt.mutex.Lock()
+	defer qt.mutex.Unlock()
+
+	for key, usage := range qt.usage {
+		if !now.Before(usage.Resets) {
+			delete(qt.usage, key)
+			qt.dirty = true
+		}
+	}
+}
+
+// Snapshot returns the current usage, heaviest first, of subject or of
+// every subject when it is empty.
+func (qt *QuotaTracker) Snapshot(subject string, now time.Time) []QuotaUsage {
+	qt.mutex.Lock()
+	defer qt.mutex.Unlock()
+
+	usage := []QuotaUsage{}
+	for _, u := range qt.usage {
+		if now.Before(u.Resets) && (subject == "" || u.Subject == subject) {
+			usage = append(usage, *u)
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Bytes != usage[j].Bytes {
+			return usage[i].Bytes > usage[j].Bytes
+		}
+		if usage[i].Connections != usage[j].Connections {
+			return usage[i].Connections > usage[j].Connections
+		}
+		return usage[i].Limit+usage[i].Subject < usage[j].Limit+usage[j].Subject
+	})
+	return usage
+}
+
+// Save writes the usage to path if it changed since the last save.
+func (qt *QuotaTracker) Save(path string) error {
+	qt.mutex.Lock()
+	if !qt.dirty {
+		qt.mutex.Unlock()
+		return nil
+	}
+	usage := make([]QuotaUsage, 0, len(qt.usage))
+	for _, u := range qt.usage {
+		usage = append(usage, *u)
+	}
+	qt.dirty = false
+	qt.mutex.Unlock()
+
+	data, err := json.Marshal(usage)
+	if err == nil {
+		err = writeFileAtomic(path, data, 0600)
+	}
+	if err != nil {
+		qt.mutex.Lock()
+		qt.dirty = true
+		qt.mutex.Unlock()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// Load adds the usage saved at path whose period isn't over and returns how
+// many entries it restored. A missing file is not an error.
+func (qt *QuotaTracker) Load(path string, now time.Time) (int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	var saved []QuotaUsage
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	qt.mutex.Lock()
+	defer qt.mutex.Unlock()
+
+	restored := 0
+	for _, u := range saved {
+		if !now.Before(u.Resets) {
+			continue
+		}
+		key := u.Limit + "|" + u.Subject
+		if current, exists := qt.usage[key]; exists && current.Resets.Equal(u.Resets) {
+			current.Connections += u.Connections
+			current.Bytes += u.Bytes
+		} else {
+			usage := u
+			qt.usage[key] = &usage
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+func (fw *Firewall) quotaWatcher() {
+	if config := fw.quotaConfig(); config.Enabled {
+		restored, err := fw.quotas.Load(config.Path, fw.clock.Now())
+		if err != nil {
+			fw.logErrorRateLimited("quotas", "QUOTA", "Quota counters not restored: %v", err)
+		} else if restored > 0 && fw.logger != nil {
+			fw.logger.LogStartup("Restored %d quota counters from %s", restored, config.Path)
+		}
+	}
+
+	elapsed := 0
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fw.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		config := fw.quotaConfig()
+		if !config.Enabled {
+			continue
+		}
+		elapsed++
+		if elapsed < config.SaveIntervalSeconds {
+			continue
+		}
+		elapsed = 0
+		if err := fw.quotas.Save(config.Path); err != nil {
+			fw.logErrorRateLimited("quotas", "QUOTA", "Failed to save quota counters: %v", err)
+		}
+	}
+}
+
+// quotaSubject is what a connection counts against for one kind of limit:
+// its aggregation key, or its registered API client, or else a fingerprint
+// of its API key so that the keys themselves never reach the counters file
+// or the admin API.
+func quotaSubject(config QuotaConfig, per string, ms *MiddlewareState) (string, bool) {
+	if per == QuotaPerIP {
+		return ms.Key, true
+	}
+	if ms.APIClient != nil {
+		return "client:" + ms.APIClient.Name, true
+	}
+	apiKey := ms.Head.Header.Get(config.APIKeyHeader)
+	if apiKey == "" {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	return "key:" + hex.EncodeToString(sum[:8]), true
+}
+
+func init() {
+	RegisterMiddleware(Middleware{Name: "quota", Stage: StageRequest, SkipWhitelisted: true, SkipExempt: true, Handle: quotaMiddleware})
+}
+
+func quotaMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	config := fw.quotaConfig()
+	if !config.Enabled {
+		return true
+	}
+	now := fw.clock.Now()
+
+	var charges []quotaCharge
+	for _, limit := range config.Limits {
+		subject, applies := quotaSubject(config, limit.Per, ms)
+		if !applies {
+			continue
+		}
+		if usage, exceeded := fw.quotas.Exceeded(limit, subject, now); exceeded {
+			ms.Block("QUOTA_EXCEEDED", fmt.Sprintf("quota %s for %s: %d connections, %d bytes until %s",
+				limit.Name, subject, usage.Connections, usage.Bytes, usage.Resets.Format(time.RFC3339)))
+			fw.writeHTTPError(ms.Conn, ms.ConnID, http.StatusTooManyRequests,
+				fmt.Sprintf("Your %s quota is used up.", quotaPeriodAdjectives[limit.Period]), usage.Resets.Sub(now))
+			return false
+		}
+		charges = append(charges, quotaCharge{limit: limit, subject: subject})
+	}
+	if ms.FollowUp {
+		// The connection is already counted, against its first request's
+		// subjects.
+		return true
+	}
+	for _, charge := range charges {
+		fw.quotas.Add(charge.limit, charge.subject, 1, 0, now)
+	}
+	ms.QuotaCharges = charges
+	return true
+}
+
+// quotaCharge is a quota a connection counts against.
+type quotaCharge struct {
+	limit   QuotaLimit
+	subject string
+}
+
+// chargeQuotaBytes counts a finished connection's bytes against its quotas.
+func (fw *Firewall) chargeQuotaBytes(ms *MiddlewareState) {
+	bytes := ms.Record.BytesIn + ms.Record.BytesOut
+	if bytes == 0 {
+		return
+	}
+	now := fw.clock.Now()
+	for _, charge := range ms.QuotaCharges {
+		fw.quotas.Add(charge.limit, charge.subject, 0, bytes, now)
+	}
+}
+
+// handleQuotas lists current quota usage, of one subject with ?subject=.
+func (fw *Firewall) handleQuotas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"limits": fw.quotaConfig().Limits,
+		"usage":  fw.quotas.Snapshot(r.URL.Query().Get("subject"), fw.clock.Now()),
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// ReverseDNSConfig resolves client IPs to hostnames (cached for
+// CacheMinutes) for logs, stats and PTR rules. Like DNSBL lookups, a
+// first-seen client waits at most WaitMilliseconds for its hostname.
+//
+// AllowSuffixes whitelist clients whose PTR name ends in a suffix (e.g.
+// ".googlebot.com") and resolves back to the client's IP, so a PTR record
+// alone can't claim to be a crawler. DenySuffixes block on the PTR name
+// without forward confirmation: whoever controls the reverse zone chose it.
+type ReverseDNSConfig struct {
+	Enabled             bool     `json:"enabled"`
+	AllowSuffixes       []string `json:"allow_suffixes"`
+	DenySuffixes        []string `json:"deny_suffixes"`
+	WaitMilliseconds    int      `json:"wait_milliseconds"`
+	TimeoutMilliseconds int      `json:"timeout_milliseconds"`
+	CacheMinutes        int      `json:"cache_minutes"`
+}
+
+func normalizePTRSuffixes(suffixes []string) []string {
+	valid := make([]string, 0, len(suffixes))
+	for _, suffix := range suffixes {
+		suffix = strings.Trim(strings.ToLower(strings.TrimSpace(suffix)), ".")
+		if suffix != "" {
+			valid = append(valid, "."+suffix)
+		}
+	}
+	return valid
+}
+
+func normalizeReverseDNSConfig(config ReverseDNSConfig) ReverseDNSConfig {
+	config.AllowSuffixes = normalizePTRSuffixes(config.AllowSuffixes)
+	config.DenySuffixes = normalizePTRSuffixes(config.DenySuffixes)
+	if config.WaitMilliseconds < 0 {
+		config.WaitMilliseconds = 0
+	}
+	if config.TimeoutMilliseconds <= 0 {
+		config.TimeoutMilliseconds = 1000
+	}
+	if config.CacheMinutes <= 0 {
+		config.CacheMinutes = 60
+	}
+	return config
+}
+
+func (fw *Firewall) reverseDNSConfig() ReverseDNSConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.ReverseDNS
+}
+
+// PTRResult is an IP's hostname and whether it resolves back to the IP.
+type PTRResult struct {
+	Hostname  string
+	Confirmed bool
+}
+
+// matchPTRSuffix returns the suffix in suffixes hostname falls under.
+// ".googlebot.com" matches "crawl-1.googlebot.com" and "googlebot.com".
+func matchPTRSuffix(hostname string, suffixes []string) (string, bool) {
+	if hostname == "" {
+		return "", false
+	}
+	dotted := "." + hostname
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(dotted, suffix) {
+			return suffix, true
+		}
+	}
+	return "", false
+}
+
+// queryPTR resolves ip's PTR names and prefers one that forward-confirms.
+func (fw *Firewall) queryPTR(ip string, config ReverseDNSConfig) (PTRResult, time.Duration) {
+	ttl := time.Duration(config.CacheMinutes) * time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.TimeoutMilliseconds)*time.Millisecond)
+	defer cancel()
+
+	names, err := fw.lookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return PTRResult{}, ttl
+	}
+
+	var result PTRResult
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if result.Hostname == "" {
+			result.Hostname = name
+		}
+		addresses, err := fw.lookupHost(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, address := range addresses {
+			if net.ParseIP(address).Equal(net.ParseIP(ip)) {
+				return PTRResult{Hostname: name, Confirmed: true}, ttl
+			}
+		}
+	}
+	return result, ttl
+}
+
+// reverseDNS returns ip's hostname when reverse DNS is enabled and the
+// answer is known in time.
+func (fw *Firewall) reverseDNS(ip string) PTRResult {
+	config := fw.reverseDNSConfig()
+	if !config.Enabled {
+		return PTRResult{}
+	}
+
+	wait := time.Duration(config.WaitMilliseconds) * time.Millisecond
+	result, _ := fw.rdns.Lookup(ip, fw.clock.Now(), wait, func() (PTRResult, time.Duration) {
+		return fw.queryPTR(ip, config)
+	})
+	return result
+}
+
+// cachedHostname returns ip's hostname if it has already been resolved.
+func (fw *Firewall) cachedHostname(ip string) string {
+	result, _ := fw.rdns.Cached(ip, fw.clock.Now())
+	return result.Hostname
+}
+
+// ptrAllowed reports whether ip's already-resolved, forward-confirmed
+// hostname is under one of allow_suffixes. It never starts a lookup.
+func (fw *Firewall) ptrAllowed(ip string) (string, bool) {
+	config := fw.reverseDNSConfig()
+	if !config.Enabled || len(config.AllowSuffixes) == 0 {
+		return "", false
+	}
+	result, known := fw.rdns.Cached(ip, fw.clock.Now())
+	if !known || !result.Confirmed {
+		return "", false
+	}
+	if _, matched := matchPTRSuffix(result.Hostname, config.AllowSuffixes); !matched {
+		return "", false
+	}
+	return result.Hostname, true
+}
+
+// ptrDenied reports whether hostname is under one of deny_suffixes.
+func (fw *Firewall) ptrDenied(hostname string) (string, bool) {
+	config := fw.reverseDNSConfig()
+	if !config.Enabled {
+		return "", false
+	}
+	return matchPTRSuffix(hostname, config.DenySuffixes)
+}
+
+// withHostnames fills in the hostnames already known for IP-keyed entries.
+func (fw *Firewall) withHostnames(entries []CountEntry) []CountEntry {
+	if !fw.reverseDNSConfig().Enabled {
+		return entries
+	}
+	for i := range entries {
+		entries[i].Hostname = fw.cachedHostname(entries[i].Key)
+	}
+	return entries
+}
+
+// trafficSnapshot is the traffic stats with hostnames for the top IPs.
+func (fw *Firewall) trafficSnapshot() TrafficStatsSnapshot {
+	traffic := fw.trafficStats.Snapshot()
+	traffic.TopIPs = fw.withHostnames(traffic.TopIPs)
+	traffic.TopBlocked = fw.withHostnames(traffic.TopBlocked)
+	return traffic
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRegoDecision            = "firewall/decision"
+	DefaultRegoTimeoutMilliseconds = 100
+	RegoPolicyCheckInterval        = 5 * time.Second
+	MaxRegoAnswerSize              = 1 << 20
+)
+
+// RegoConfig evaluates each request against Rego policies with a RegoInput
+// as the input document, asking for Decision. Policies are .rego files the
+// firewall evaluates itself, reloaded when they change on disk; rego_eval.go
+// lists the subset of the language it supports. Without Policies, requests
+// are instead posted through the ext_authz client to the Data API of an
+// Open Policy Agent server at URL, usually a sidecar on localhost, which
+// must answer within TimeoutMilliseconds. The decision is either a boolean,
+// false blocking the request, or an object like
+//
+//	{"allow": false, "action": "block", "reason": "...", "status": 403, "message": "..."}
+//
+// where action is one of allow, block, challenge or log and overrides
+// allow. A decision that is undefined, late or unreadable is handled as
+// FailureMode says, as for ext_authz. Whitelisted clients are not
+// evaluated.
+type RegoConfig struct {
+	Enabled             bool     `json:"enabled"`
+	Policies            []string `json:"policies"`
+	URL                 string   `json:"url"`
+	Decision            string   `json:"decision"`
+	TimeoutMilliseconds int      `json:"timeout_ms"`
+	FailureMode         string   `json:"failure_mode"`
+	Status              int      `json:"status"`
+	Message             string   `json:"message"`
+	ChallengeValidHours int      `json:"challenge_valid_hours"`
+}
+
+func normalizeRegoConfig(config RegoConfig) RegoConfig {
+	config.Decision = strings.Trim(strings.ReplaceAll(strings.TrimSpace(config.Decision), ".", "/"), "/")
+	if config.Decision == "" {
+		config.Decision = DefaultRegoDecision
+	}
+	if config.TimeoutMilliseconds <= 0 {
+		config.TimeoutMilliseconds = DefaultRegoTimeoutMilliseconds
+	}
+	config.FailureMode = normalizeFailureMode(config.FailureMode)
+	if config.Status < 400 || config.Status > 599 {
+		config.Status = http.StatusForbidden
+	}
+	if config.Message == "" {
+		config.Message = DefaultPolicyMessage
+	}
+	if config.ChallengeValidHours <= 0 {
+		config.ChallengeValidHours = DefaultPolicyChallengeValidHours
+	}
+	return config
+}
+
+func (fw *Firewall) regoConfig() RegoConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.Rego
+}
+
+func regoProblems(config RegoConfig) []string {
+	if !config.Enabled || len(config.Policies) > 0 {
+		return nil
+	}
+	if config.URL == "" {
+		return []string{"neither policies nor url is set - requests are not evaluated"}
+	}
+	if parsed, err := url.Parse(config.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return []string{fmt.Sprintf("url %q is not an http(s) URL - requests are not evaluated", config.URL)}
+	}
+	return nil
+}
+
+// RegoInput is the input document policies are evaluated against: what an
+// ext_authz service is told, plus the firewall's own view of the client.
+type RegoInput struct {
+	ExtAuthzRequest
+	Key      string       `json:"key"`
+	Exempt   bool         `json:"exempt"`
+	Geo      RegoGeo      `json:"geo"`
+	Counters RegoCounters `json:"counters"`
+}
+
+type RegoGeo struct {
+	Country string `json:"country,omitempty"`
+	ASN     uint32 `json:"asn,omitempty"`
+	Org     string `json:"org,omitempty"`
+}
+
+// RegoCounters are the client's recent activity as the firewall tracks it.
+type RegoCounters struct {
+	ActiveConnections  int     `json:"active_connections"`
+	AttemptsLastMinute int     `json:"attempts_last_minute"`
+	AttemptsLastHour   int     `json:"attempts_last_hour"`
+	RiskScore          float64 `json:"risk_score"`
+}
+
+// RegoDecision is the object form of a decision.
+type RegoDecision struct {
+	Allow   *bool  `json:"allow"`
+	Action  string `json:"action"`
+	Reason  string `json:"reason"`
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+func (decision *RegoDecision) UnmarshalJSON(data []byte) error {
+	var allow bool
+	if err := json.Unmarshal(data, &allow); err == nil {
+		decision.Allow = &allow
+		return nil
+	}
+	type plain RegoDecision
+	return json.Unmarshal(data, (*plain)(decision))
+}
+
+func (decision RegoDecision) action() string {
+	if decision.Action != "" {
+		return strings.ToLower(decision.Action)
+	}
+	if decision.Allow != nil && !*decision.Allow {
+		return PolicyActionBlock
+	}
+	return "allow"
+}
+
+// recentAttempts counts key's connections over the last minute and hour.
+func (fw *Firewall) recentAttempts(key string) (int, int) {
+	now := fw.clock.Now()
+
+	fw.attemptsMutex.RLock()
+	defer fw.attemptsMutex.RUnlock()
+
+	minute, hour := 0, 0
+	for _, attempt := range fw.connectionAttempts[key] {
+		if now.Sub(attempt) < time.Minute {
+			minute++
+		}
+	}
+	for _, attempt := range fw.hourlyAttempts[key] {
+		if now.Sub(attempt) < time.Hour {
+			hour++
+		}
+	}
+	return minute, hour
+}
+
+func (fw *Firewall) regoInput(ms *MiddlewareState) RegoInput {
+	input := RegoInput{
+		ExtAuthzRequest: extAuthzRequest(ms),
+		Key:             ms.Key,
+		Exempt:          ms.Exempt,
+		Geo:             RegoGeo{Country: ms.Verdict.Country},
+	}
+	if input.Geo.Country == "" {
+		input.Geo.Country = fw.lookupCountry(ms.IP)
+	}
+	input.Geo.ASN, input.Geo.Org, _ = fw.lookupASN(ms.IP)
+
+	fw.synFloodMutex.RLock()
+	input.Counters.ActiveConnections = fw.activeConnsByIP[ms.IP]
+	fw.synFloodMutex.RUnlock()
+	input.Counters.AttemptsLastMinute, input.Counters.AttemptsLastHour = fw.recentAttempts(ms.Key)
+	if scoring := fw.riskScoring(); scoring.Enabled {
+		input.Counters.RiskScore = fw.riskScores.Score(ms.Key, fw.clock.Now(), scoring.halfLife())
+	}
+	return input
+}
+
+// queryRego asks the OPA server for the configured decision about input.
+func queryRego(config RegoConfig, input RegoInput) (RegoDecision, error) {
+	endpoint := strings.TrimSuffix(config.URL, "/") + "/v1/data/" + config.Decision
+	var answer struct {
+		Result *RegoDecision `json:"result"`
+	}
+	err := postDecisionRequest(endpoint, input.RequestID, config.TimeoutMilliseconds, struct {
+		Input RegoInput `json:"input"`
+	}{input}, func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("OPA answered %s", resp.Status)
+		}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, MaxRegoAnswerSize)).Decode(&answer); err != nil {
+			return fmt.Errorf("reading OPA answer: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return RegoDecision{}, err
+	}
+	if answer.Result == nil {
+		return RegoDecision{}, fmt.Errorf("%s is undefined", config.Decision)
+	}
+	return *answer.Result, nil
+}
+
+// RegoPolicySet holds the compiled policy files. Files that fail to reload
+// leave the previous policy in place.
+type RegoPolicySet struct {
+	mutex    sync.RWMutex
+	policy   *regoPolicy
+	decision string
+	modTimes map[string]time.Time
+}
+
+func NewRegoPolicySet() *RegoPolicySet {
+	return &RegoPolicySet{}
+}
+
+func (rs *RegoPolicySet) get() *regoPolicy {
+	rs.mutex.RLock()
+	defer rs.mutex.RUnlock()
+
+	return rs.policy
+}
+
+// current reports whether the loaded policy is the one for decision
+// compiled from files with modTimes.
+func (rs *RegoPolicySet) current(decision string, modTimes map[string]time.Time) bool {
+	rs.mutex.RLock()
+	defer rs.mutex.RUnlock()
+
+	if rs.policy == nil || rs.decision != decision || len(rs.modTimes) != len(modTimes) {
+		return false
+	}
+	for path, modTime := range modTimes {
+		if loaded, exists := rs.modTimes[path]; !exists || !loaded.Equal(modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rs *RegoPolicySet) set(policy *regoPolicy, decision string, modTimes map[string]time.Time) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	rs.policy, rs.decision, rs.modTimes = policy, decision, modTimes
+}
+
+// refreshRegoPolicies compiles the configured policy files again when any
+// of them changed on disk.
+func (fw *Firewall) refreshRegoPolicies() {
+	config := fw.regoConfig()
+	if !config.Enabled || len(config.Policies) == 0 {
+		fw.regoPolicies.set(nil, "", nil)
+		return
+	}
+
+	modTimes := make(map[string]time.Time, len(config.Policies))
+	for _, path := range config.Policies {
+		stat, err := os.Stat(path)
+		if err != nil {
+			fw.logErrorRateLimited("rego_policies", "REGO", "Failed to load policies: %v", err)
+			return
+		}
+		modTimes[path] = stat.ModTime()
+	}
+	if fw.regoPolicies.current(config.Decision, modTimes) {
+		return
+	}
+
+	policy, err := loadRegoPolicies(config)
+	if err != nil {
+		fw.logErrorRateLimited("rego_policies", "REGO", "Failed to load policies: %v", err)
+		return
+	}
+	fw.regoPolicies.set(policy, config.Decision, modTimes)
+	if fw.logger != nil {
+		fw.logger.LogInfo("REGO", "Loaded %d policy files deciding %s", len(config.Policies), config.Decision)
+	}
+}
+
+func loadRegoPolicies(config RegoConfig) (*regoPolicy, error) {
+	sources := make(map[string]string, len(config.Policies))
+	for _, path := range config.Policies {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sources[path] = string(data)
+	}
+	policy, err := compileRego(sources)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := policy.rules[config.Decision]; !exists {
+		return nil, fmt.Errorf("no policy defines %s", config.Decision)
+	}
+	return policy, nil
+}
+
+func (fw *Firewall) regoPolicyWatcher() {
+	fw.refreshRegoPolicies()
+
+	ticker := time.NewTicker(RegoPolicyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fw.refreshRegoPolicies()
+		case <-fw.shutdown:
+			return
+		}
+	}
+}
+
+// evaluateRego evaluates the configured decision about input with the
+// loaded policies.
+func (fw *Firewall) evaluateRego(config RegoConfig, input RegoInput) (RegoDecision, error) {
+	policy := fw.regoPolicies.get()
+	if policy == nil {
+		return RegoDecision{}, errors.New("no policies are loaded")
+	}
+	// The policies see the same document an OPA server would be sent.
+	data, err := json.Marshal(input)
+	if err != nil {
+		return RegoDecision{}, err
+	}
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return RegoDecision{}, err
+	}
+
+	value, defined, err := policy.Evaluate(config.Decision, document)
+	if err != nil {
+		return RegoDecision{}, err
+	}
+	if !defined {
+		return RegoDecision{}, fmt.Errorf("%s is undefined", config.Decision)
+	}
+	var decision RegoDecision
+	if data, err = json.Marshal(regoJSON(value)); err == nil {
+		err = json.Unmarshal(data, &decision)
+	}
+	if err != nil {
+		return RegoDecision{}, fmt.Errorf("%s is not a decision: %v", config.Decision, err)
+	}
+	return decision, nil
+}
+
+func init() {
+	RegisterMiddleware(Middleware{Name: "rego", Stage: StageRequest, SkipWhitelisted: true, Handle: regoMiddleware})
+}
+
+func regoMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	config := fw.regoConfig()
+	if !config.Enabled || len(regoProblems(config)) > 0 {
+		return true
+	}
+
+	var decision RegoDecision
+	var err error
+	if len(config.Policies) > 0 {
+		decision, err = fw.evaluateRego(config, fw.regoInput(ms))
+	} else {
+		decision, err = queryRego(config, fw.regoInput(ms))
+	}
+	if err != nil {
+		fw.logErrorRateLimitedTo(ms.Logger, "rego", "REGO", "Evaluating %s failed: %v", config.Decision, err)
+		if config.FailureMode == ExtAuthzFailureOpen {
+			ms.Record.Event("rego decision failed open")
+			return true
+		}
+		decision = RegoDecision{Action: PolicyActionBlock, Reason: "decision failed: " + err.Error()}
+	}
+	reason := decision.Reason
+	if reason == "" {
+		reason = "no reason given"
+	}
+	details := fmt.Sprintf("rego %s: %s", config.Decision, reason)
+
+	switch decision.action() {
+	case "allow":
+		return true
+	case PolicyActionLog:
+		ms.Record.Event(details)
+		return true
+	case PolicyActionChallenge:
+		if fw.challengePassed(ms.Head, ms.Key) {
+			return true
+		}
+		ms.Block("CHALLENGED", fmt.Sprintf("%s, no valid challenge cookie", details))
+		fw.writeChallenge(ms.Conn, ms.ConnID, ms.Key, time.Duration(config.ChallengeValidHours)*time.Hour)
+		return false
+	default:
+		status, message := config.Status, config.Message
+		if decision.Status >= 400 && decision.Status <= 599 {
+			status = decision.Status
+		}
+		if decision.Message != "" {
+			message = decision.Message
+		}
+		ms.Block("REGO", details)
+		fw.writeHTTPError(ms.Conn, ms.ConnID, status, message, 0)
+		return false
+	}
+}
@@ -0,0 +1,1484 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// This file evaluates the subset of Rego that request policies need,
+// without an OPA server:
+//
+//	package firewall
+//
+//	import rego.v1
+//
+//	default decision := {"allow": true}
+//
+//	decision := {"action": "block", "reason": reason} if {
+//		some reason in deny
+//	}
+//
+//	deny contains "admin from abroad" if {
+//		startswith(input.path, "/admin")
+//		not input.geo.country in {"DE", "AT"}
+//	}
+//
+// Supported are complete rules (with default and several definitions, which
+// must not disagree), partial set rules (name contains x, name[x]), bodies
+// of assignments (:=), unification of a variable (=), expressions, not,
+// some x in / some k, v in and iteration through _ or unbound variables in
+// references; scalars, arrays, objects and sets; == != < <= > >= + - * / %
+// and in; references to input, to rules of the same package by name and to
+// any rule through data; and the builtins in regoBuiltins. Functions, else,
+// with, every and comprehensions are not, and fail to load. Errors in
+// builtins leave the expression undefined, as OPA does.
+
+const (
+	// regoMaxSteps bounds the work of one evaluation.
+	regoMaxSteps = 100000
+)
+
+var errRegoBudget = errors.New("evaluation exceeded its step budget")
+
+// regoPolicy is a set of parsed modules, with rules keyed by package path
+// and name, e.g. "firewall/decision".
+type regoPolicy struct {
+	rules map[string][]*regoRule
+}
+
+const (
+	regoComplete = iota
+	regoPartialSet
+)
+
+type regoRule struct {
+	pkg       string
+	name      string
+	kind      int
+	isDefault bool
+	key       regoExpr
+	value     regoExpr
+	body      []regoStmt
+}
+
+const (
+	regoStmtExpr = iota
+	regoStmtNot
+	regoStmtAssign
+	regoStmtUnify
+	regoStmtSome
+	regoStmtSomeIn
+)
+
+type regoStmt struct {
+	kind  int
+	vars  []string
+	expr  regoExpr
+	right regoExpr
+}
+
+type regoExpr interface{}
+
+type regoLiteral struct{ value interface{} }
+
+// regoRef is a variable, input, data or a rule, followed by a path of
+// .field and [expr] lookups; a field is a regoLiteral string.
+type regoRef struct {
+	root string
+	path []regoExpr
+}
+
+type regoCall struct {
+	name    string
+	builtin regoBuiltin
+	args    []regoExpr
+}
+
+type regoBinary struct {
+	op          string
+	left, right regoExpr
+}
+
+type regoIn struct{ value, collection regoExpr }
+
+type regoArrayLit struct{ items []regoExpr }
+
+type regoObjectLit struct{ keys, values []regoExpr }
+
+type regoSetLit struct{ items []regoExpr }
+
+// regoSet is a set value, its members keyed by regoKey.
+type regoSet struct {
+	members map[string]interface{}
+}
+
+func newRegoSet() *regoSet {
+	return &regoSet{members: make(map[string]interface{})}
+}
+
+func (rs *regoSet) add(v interface{}) {
+	rs.members[regoKey(v)] = v
+}
+
+func (rs *regoSet) sortedKeys() []string {
+	keys := make([]string, 0, len(rs.members))
+	for key := range rs.members {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// regoKey is a canonical form of v, equal for equal values.
+func regoKey(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return strconv.Quote(v)
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = regoKey(item)
+		}
+		return "[" + strings.Join(parts, ",") + "]"
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			parts[i] = strconv.Quote(key) + ":" + regoKey(v[key])
+		}
+		return "{" + strings.Join(parts, ",") + "}"
+	case *regoSet:
+		return "<" + strings.Join(v.sortedKeys(), ",") + ">"
+	}
+	return fmt.Sprintf("?%v", v)
+}
+
+// regoJSON turns sets into sorted arrays so that v can be marshalled.
+func regoJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = regoJSON(item)
+		}
+		return items
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			object[key] = regoJSON(value)
+		}
+		return object
+	case *regoSet:
+		items := make([]interface{}, 0, len(v.members))
+		for _, key := range v.sortedKeys() {
+			items = append(items, regoJSON(v.members[key]))
+		}
+		return items
+	}
+	return v
+}
+
+// regoToken is a lexeme; kind is 'i' for an identifier or keyword, 's' for
+// a string, 'n' for a number, 'p' for punctuation and '\n' for a line break
+// outside parentheses and brackets.
+type regoToken struct {
+	kind rune
+	text string
+	line int
+}
+
+func tokenizeRego(source string) ([]regoToken, error) {
+	var tokens []regoToken
+	line, depth := 1, 0
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == '\n':
+			if depth == 0 {
+				tokens = append(tokens, regoToken{'\n', "\n", line})
+			}
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			j := i + 1
+			for ; j < len(source) && source[j] != '"' && source[j] != '\n'; j++ {
+				if source[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(source) || source[j] != '"' {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			text, err := strconv.Unquote(source[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad string %s", line, source[i:j+1])
+			}
+			tokens = append(tokens, regoToken{'s', text, line})
+			i = j + 1
+		case c == '`':
+			j := strings.IndexByte(source[i+1:], '`')
+			if j < 0 {
+				return nil, fmt.Errorf("line %d: unterminated raw string", line)
+			}
+			text := source[i+1 : i+1+j]
+			tokens = append(tokens, regoToken{'s', text, line})
+			line += strings.Count(text, "\n")
+			i += j + 2
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(source) && (source[j] >= '0' && source[j] <= '9' || source[j] == '.' ||
+				source[j] == 'e' || source[j] == 'E' || (source[j] == '-' || source[j] == '+') && (source[j-1] == 'e' || source[j-1] == 'E')) {
+				j++
+			}
+			tokens = append(tokens, regoToken{'n', source[i:j], line})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(source) && (source[j] == '_' || unicode.IsLetter(rune(source[j])) || source[j] >= '0' && source[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, regoToken{'i', source[i:j], line})
+			i = j
+		default:
+			two := ""
+			if i+1 < len(source) {
+				two = source[i : i+2]
+			}
+			switch {
+			case two == ":=" || two == "==" || two == "!=" || two == "<=" || two == ">=":
+				tokens = append(tokens, regoToken{'p', two, line})
+				i += 2
+				continue
+			case strings.IndexByte("()[]{},.;:=<>+-*/%|&", c) < 0:
+				return nil, fmt.Errorf("line %d: unexpected %q", line, c)
+			}
+			switch c {
+			case '(', '[':
+				depth++
+			case ')', ']':
+				if depth > 0 {
+					depth--
+				}
+			}
+			tokens = append(tokens, regoToken{'p', string(c), line})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+type regoParser struct {
+	tokens []regoToken
+	pos    int
+	pkg    string
+}
+
+func (rp *regoParser) peek() regoToken {
+	if rp.pos < len(rp.tokens) {
+		return rp.tokens[rp.pos]
+	}
+	return regoToken{}
+}
+
+func (rp *regoParser) peekAt(offset int) regoToken {
+	if rp.pos+offset < len(rp.tokens) {
+		return rp.tokens[rp.pos+offset]
+	}
+	return regoToken{}
+}
+
+func (rp *regoParser) accept(kind rune, text string) bool {
+	if token := rp.peek(); token.kind == kind && token.text == text {
+		rp.pos++
+		return true
+	}
+	return false
+}
+
+func (rp *regoParser) errorf(format string, args ...interface{}) error {
+	token := rp.peek()
+	if token.kind == 0 {
+		return fmt.Errorf("end of file: "+format, args...)
+	}
+	return fmt.Errorf("line %d: "+format, append([]interface{}{token.line}, args...)...)
+}
+
+func (rp *regoParser) expect(text string) error {
+	if !rp.accept('p', text) {
+		return rp.errorf("expected %q", text)
+	}
+	return nil
+}
+
+func (rp *regoParser) skipLines() {
+	for rp.accept('\n', "\n") || rp.accept('p', ";") {
+	}
+}
+
+func (rp *regoParser) ident() (string, error) {
+	token := rp.peek()
+	if token.kind != 'i' {
+		return "", rp.errorf("expected a name")
+	}
+	rp.pos++
+	return token.text, nil
+}
+
+// endOfLine consumes the line break that ends a statement or rule.
+func (rp *regoParser) endOfLine() error {
+	token := rp.peek()
+	if token.kind == 0 || token.kind == '\n' || token.kind == 'p' && (token.text == ";" || token.text == "}") {
+		return nil
+	}
+	return rp.errorf("unexpected %q", token.text)
+}
+
+// parseRegoModule parses one file's rules into rules, keyed by package path
+// and name.
+func parseRegoModule(source string, rules map[string][]*regoRule) error {
+	tokens, err := tokenizeRego(source)
+	if err != nil {
+		return err
+	}
+	rp := &regoParser{tokens: tokens}
+	rp.skipLines()
+	if !rp.accept('i', "package") {
+		return rp.errorf("expected package")
+	}
+	var path []string
+	for {
+		name, err := rp.ident()
+		if err != nil {
+			return err
+		}
+		path = append(path, name)
+		if !rp.accept('p', ".") {
+			break
+		}
+	}
+	rp.pkg = strings.Join(path, "/")
+
+	for {
+		rp.skipLines()
+		if rp.peek().kind == 0 {
+			return nil
+		}
+		if rp.accept('i', "import") {
+			for token := rp.peek(); token.kind != 0 && token.kind != '\n'; token = rp.peek() {
+				rp.pos++
+			}
+			continue
+		}
+		rule, err := rp.rule()
+		if err != nil {
+			return err
+		}
+		key := rule.pkg + "/" + rule.name
+		if existing := rules[key]; len(existing) > 0 && existing[0].kind != rule.kind {
+			return fmt.Errorf("rule %s is defined both as a set and as a value", key)
+		}
+		for _, existing := range rules[key] {
+			if rule.isDefault && existing.isDefault {
+				return fmt.Errorf("rule %s has more than one default", key)
+			}
+		}
+		rules[key] = append(rules[key], rule)
+	}
+}
+
+func (rp *regoParser) rule() (*regoRule, error) {
+	rule := &regoRule{pkg: rp.pkg, kind: regoComplete, isDefault: rp.accept('i', "default")}
+	name, err := rp.ident()
+	if err != nil {
+		return nil, err
+	}
+	rule.name = name
+	if token := rp.peek(); token.kind == 'p' && token.text == "(" {
+		return nil, rp.errorf("functions are not supported")
+	}
+
+	if rp.accept('p', "[") {
+		if rule.key, err = rp.expr(); err != nil {
+			return nil, err
+		}
+		if err := rp.expect("]"); err != nil {
+			return nil, err
+		}
+		rule.kind = regoPartialSet
+	} else if rp.accept('i', "contains") {
+		if rule.key, err = rp.expr(); err != nil {
+			return nil, err
+		}
+		rule.kind = regoPartialSet
+	}
+	if rp.accept('p', ":=") || rp.accept('p', "=") {
+		if rule.kind == regoPartialSet {
+			return nil, rp.errorf("partial object rules are not supported")
+		}
+		if rule.value, err = rp.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if rule.isDefault {
+		if rule.value == nil || rule.kind != regoComplete {
+			return nil, fmt.Errorf("default %s needs a value", name)
+		}
+		return rule, rp.endOfLine()
+	}
+
+	switch {
+	case rp.accept('i', "if"):
+		if token := rp.peek(); token.kind == 'p' && token.text == "{" {
+			rule.body, err = rp.body()
+		} else {
+			var stmt regoStmt
+			stmt, err = rp.stmt()
+			rule.body = []regoStmt{stmt}
+		}
+	case rp.peek().kind == 'p' && rp.peek().text == "{":
+		rule.body, err = rp.body()
+	case rule.value == nil && rule.kind == regoComplete:
+		return nil, fmt.Errorf("rule %s has neither a value nor a body", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rp.accept('i', "else") {
+		return nil, rp.errorf("else is not supported")
+	}
+	return rule, rp.endOfLine()
+}
+
+func (rp *regoParser) body() ([]regoStmt, error) {
+	if err := rp.expect("{"); err != nil {
+		return nil, err
+	}
+	var stmts []regoStmt
+	for {
+		rp.skipLines()
+		if rp.accept('p', "}") {
+			if len(stmts) == 0 {
+				return nil, rp.errorf("empty body")
+			}
+			return stmts, nil
+		}
+		stmt, err := rp.stmt()
+		if err != nil {
+			return nil, err
+		}
+		if err := rp.endOfLine(); err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+	}
+}
+
+func (rp *regoParser) stmt() (regoStmt, error) {
+	for _, keyword := range []string{"every", "with"} {
+		if token := rp.peek(); token.kind == 'i' && token.text == keyword {
+			return regoStmt{}, rp.errorf("%s is not supported", keyword)
+		}
+	}
+	if rp.accept('i', "some") {
+		var vars []string
+		for {
+			name, err := rp.ident()
+			if err != nil {
+				return regoStmt{}, err
+			}
+			vars = append(vars, name)
+			if !rp.accept('p', ",") {
+				break
+			}
+		}
+		if !rp.accept('i', "in") {
+			return regoStmt{kind: regoStmtSome, vars: vars}, nil
+		}
+		if len(vars) > 2 {
+			return regoStmt{}, rp.errorf("some takes a value or a key and a value")
+		}
+		collection, err := rp.comparison()
+		return regoStmt{kind: regoStmtSomeIn, vars: vars, expr: collection}, err
+	}
+	if rp.accept('i', "not") {
+		expr, err := rp.expr()
+		return regoStmt{kind: regoStmtNot, expr: expr}, err
+	}
+	if token, next := rp.peek(), rp.peekAt(1); token.kind == 'i' && next.kind == 'p' && next.text == ":=" {
+		rp.pos += 2
+		expr, err := rp.expr()
+		return regoStmt{kind: regoStmtAssign, vars: []string{token.text}, expr: expr}, err
+	}
+	expr, err := rp.expr()
+	if err != nil {
+		return regoStmt{}, err
+	}
+	if rp.accept('p', "=") {
+		right, err := rp.expr()
+		return regoStmt{kind: regoStmtUnify, expr: expr, right: right}, err
+	}
+	return regoStmt{kind: regoStmtExpr, expr: expr}, nil
+}
+
+func (rp *regoParser) expr() (regoExpr, error) {
+	left, err := rp.comparison()
+	if err != nil {
+		return nil, err
+	}
+	if rp.accept('i', "in") {
+		collection, err := rp.comparison()
+		return &regoIn{value: left, collection: collection}, err
+	}
+	return left, nil
+}
+
+var regoComparisons = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+func (rp *regoParser) comparison() (regoExpr, error) {
+	left, err := rp.arithmetic()
+	if err != nil {
+		return nil, err
+	}
+	if token := rp.peek(); token.kind == 'p' && regoComparisons[token.text] {
+		rp.pos++
+		right, err := rp.arithmetic()
+		return &regoBinary{op: token.text, left: left, right: right}, err
+	}
+	return left, nil
+}
+
+func (rp *regoParser) arithmetic() (regoExpr, error) {
+	left, err := rp.term()
+	for err == nil {
+		token := rp.peek()
+		if token.kind != 'p' || token.text != "+" && token.text != "-" {
+			break
+		}
+		rp.pos++
+		var right regoExpr
+		right, err = rp.term()
+		left = &regoBinary{op: token.text, left: left, right: right}
+	}
+	return left, err
+}
+
+func (rp *regoParser) term() (regoExpr, error) {
+	left, err := rp.factor()
+	for err == nil {
+		token := rp.peek()
+		if token.kind != 'p' || token.text != "*" && token.text != "/" && token.text != "%" {
+			break
+		}
+		rp.pos++
+		var right regoExpr
+		right, err = rp.factor()
+		left = &regoBinary{op: token.text, left: left, right: right}
+	}
+	return left, err
+}
+
+func (rp *regoParser) factor() (regoExpr, error) {
+	if rp.accept('p', "-") {
+		operand, err := rp.factor()
+		if literal, ok := operand.(regoLiteral); ok {
+			if n, ok := literal.value.(float64); ok {
+				return regoLiteral{-n}, err
+			}
+		}
+		return &regoBinary{op: "-", left: regoLiteral{0.0}, right: operand}, err
+	}
+	return rp.primary()
+}
+
+func (rp *regoParser) primary() (regoExpr, error) {
+	token := rp.peek()
+	switch {
+	case token.kind == 's':
+		rp.pos++
+		return regoLiteral{token.text}, nil
+	case token.kind == 'n':
+		rp.pos++
+		n, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, rp.errorf("bad number %q", token.text)
+		}
+		return regoLiteral{n}, nil
+	case token.kind == 'i' && (token.text == "true" || token.text == "false"):
+		rp.pos++
+		return regoLiteral{token.text == "true"}, nil
+	case token.kind == 'i' && token.text == "null":
+		rp.pos++
+		return regoLiteral{nil}, nil
+	case token.kind == 'p' && token.text == "(":
+		rp.pos++
+		inner, err := rp.expr()
+		if err != nil {
+			return nil, err
+		}
+		return inner, rp.expect(")")
+	case token.kind == 'p' && token.text == "[":
+		rp.pos++
+		items, err := rp.items("]")
+		return &regoArrayLit{items: items}, err
+	case token.kind == 'p' && token.text == "{":
+		rp.pos++
+		return rp.braces()
+	case token.kind == 'i':
+		return rp.ref()
+	case token.kind == 0:
+		return nil, rp.errorf("unexpected end of file")
+	}
+	return nil, rp.errorf("unexpected %q", token.text)
+}
+
+// items parses comma-separated expressions up to end.
+func (rp *regoParser) items(end string) ([]regoExpr, error) {
+	var items []regoExpr
+	for {
+		rp.skipLines()
+		if rp.accept('p', end) {
+			return items, nil
+		}
+		item, err := rp.expr()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		rp.skipLines()
+		if token := rp.peek(); token.kind == 'p' && token.text == "|" {
+			return nil, rp.errorf("comprehensions are not supported")
+		}
+		if !rp.accept('p', ",") {
+			rp.skipLines()
+			return items, rp.expect(end)
+		}
+	}
+}
+
+// braces parses an object or a set literal after its opening brace.
+func (rp *regoParser) braces() (regoExpr, error) {
+	rp.skipLines()
+	if rp.accept('p', "}") {
+		return &regoObjectLit{}, nil
+	}
+	first, err := rp.expr()
+	if err != nil {
+		return nil, err
+	}
+	rp.skipLines()
+	if !rp.accept('p', ":") {
+		if token := rp.peek(); token.kind == 'p' && token.text == "|" {
+			return nil, rp.errorf("comprehensions are not supported")
+		}
+		set := &regoSetLit{items: []regoExpr{first}}
+		if rp.accept('p', ",") {
+			rest, err := rp.items("}")
+			set.items = append(set.items, rest...)
+			return set, err
+		}
+		rp.skipLines()
+		return set, rp.expect("}")
+	}
+
+	object := &regoObjectLit{}
+	key := first
+	for {
+		rp.skipLines()
+		value, err := rp.expr()
+		if err != nil {
+			return nil, err
+		}
+		object.keys = append(object.keys, key)
+		object.values = append(object.values, value)
+		rp.skipLines()
+		if !rp.accept('p', ",") {
+			return object, rp.expect("}")
+		}
+		rp.skipLines()
+		if rp.accept('p', "}") {
+			return object, nil
+		}
+		if key, err = rp.expr(); err != nil {
+			return nil, err
+		}
+		rp.skipLines()
+		if err := rp.expect(":"); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ref parses a reference, or a builtin call when one is followed by
+// arguments.
+func (rp *regoParser) ref() (regoExpr, error) {
+	root, err := rp.ident()
+	if err != nil {
+		return nil, err
+	}
+	ref := &regoRef{root: root}
+	for {
+		if rp.accept('p', ".") {
+			field, err := rp.ident()
+			if err != nil {
+				return nil, err
+			}
+			ref.path = append(ref.path, regoLiteral{field})
+			continue
+		}
+		if rp.accept('p', "[") {
+			index, err := rp.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := rp.expect("]"); err != nil {
+				return nil, err
+			}
+			ref.path = append(ref.path, index)
+			continue
+		}
+		break
+	}
+	if !rp.accept('p', "(") {
+		return ref, nil
+	}
+
+	name := root
+	for _, element := range ref.path {
+		field, ok := element.(regoLiteral)
+		if _, isString := field.value.(string); !ok || !isString {
+			return nil, rp.errorf("bad function name")
+		}
+		name += "." + field.value.(string)
+	}
+	builtin, known := regoBuiltins[name]
+	if !known {
+		return nil, rp.errorf("unknown function %s", name)
+	}
+	args, err := rp.items(")")
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != builtin.arity {
+		return nil, rp.errorf("%s takes %d arguments, not %d", name, builtin.arity, len(args))
+	}
+	return &regoCall{name: name, builtin: builtin, args: args}, nil
+}
+
+// compileRego parses the modules in sources, keyed by file name.
+func compileRego(sources map[string]string) (*regoPolicy, error) {
+	policy := &regoPolicy{rules: make(map[string][]*regoRule)}
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := parseRegoModule(sources[name], policy.rules); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return policy, nil
+}
+
+// Evaluate returns the value of the rule at path ("firewall/decision") for
+// input, which must be plain JSON values, and whether it is defined.
+func (policy *regoPolicy) Evaluate(path string, input interface{}) (interface{}, bool, error) {
+	if _, exists := policy.rules[path]; !exists {
+		return nil, false, fmt.Errorf("no rule %s", path)
+	}
+	ev := &regoEval{policy: policy, input: input, cache: make(map[string]regoResult), active: make(map[string]bool)}
+	value, defined := ev.rule(path)
+	if ev.err != nil {
+		return nil, false, ev.err
+	}
+	return value, defined, nil
+}
+
+type regoResult struct {
+	value   interface{}
+	defined bool
+}
+
+// regoEval is one evaluation. Expressions are evaluated in continuation
+// passing style: each result, with the variable bindings that produced it,
+// goes to a yield function, which returns false to stop. An undefined
+// expression yields nothing.
+type regoEval struct {
+	policy *regoPolicy
+	input  interface{}
+	cache  map[string]regoResult
+	active map[string]bool
+	steps  int
+	err    error
+}
+
+type regoYield func(value interface{}, b *regoBindings) bool
+
+// regoBindings are local variables, innermost first. An unbound entry is a
+// variable declared with some, which shadows rules of the same name.
+type regoBindings struct {
+	name   string
+	value  interface{}
+	bound  bool
+	parent *regoBindings
+}
+
+func (b *regoBindings) lookup(name string) (value interface{}, bound, declared bool) {
+	for ; b != nil; b = b.parent {
+		if b.name == name {
+			return b.value, b.bound, true
+		}
+	}
+	return nil, false, false
+}
+
+func (b *regoBindings) bind(name string, value interface{}) *regoBindings {
+	if name == "_" {
+		return b
+	}
+	return &regoBindings{name: name, value: value, bound: true, parent: b}
+}
+
+func (ev *regoEval) fail(err error) {
+	if ev.err == nil {
+		ev.err = err
+	}
+}
+
+func (ev *regoEval) step() bool {
+	ev.steps++
+	if ev.steps > regoMaxSteps {
+		ev.fail(errRegoBudget)
+	}
+	return ev.err == nil
+}
+
+// unbound reports whether name, in pkg, is a variable without a value.
+func (ev *regoEval) unbound(name, pkg string, b *regoBindings) bool {
+	if name == "_" {
+		return true
+	}
+	if _, bound, declared := b.lookup(name); declared {
+		return !bound
+	}
+	if name == "input" || name == "data" {
+		return false
+	}
+	_, isRule := ev.policy.rules[pkg+"/"+name]
+	return !isRule
+}
+
+func (ev *regoEval) rule(key string) (interface{}, bool) {
+	if result, done := ev.cache[key]; done {
+		return result.value, result.defined
+	}
+	if ev.active[key] {
+		ev.fail(fmt.Errorf("rule %s depends on itself", key))
+		return nil, false
+	}
+	ev.active[key] = true
+	defer delete(ev.active, key)
+
+	rules := ev.policy.rules[key]
+	var result regoResult
+	if rules[0].kind == regoPartialSet {
+		set := newRegoSet()
+		for _, rule := range rules {
+			rule := rule
+			ev.body(rule.body, rule.pkg, nil, func(b *regoBindings) bool {
+				return ev.eval(rule.key, rule.pkg, b, func(v interface{}, _ *regoBindings) bool {
+					set.add(v)
+					return true
+				})
+			})
+		}
+		result = regoResult{set, true}
+	} else {
+		var fallback *regoRule
+		for _, rule := range rules {
+			if rule.isDefault {
+				fallback = rule
+				continue
+			}
+			rule, value := rule, rule.value
+			if value == nil {
+				value = regoLiteral{true}
+			}
+			ev.body(rule.body, rule.pkg, nil, func(b *regoBindings) bool {
+				return ev.eval(value, rule.pkg, b, func(v interface{}, _ *regoBindings) bool {
+					if result.defined && regoKey(v) != regoKey(result.value) {
+						ev.fail(fmt.Errorf("rule %s has conflicting values %s and %s", key, regoKey(result.value), regoKey(v)))
+						return false
+					}
+					result = regoResult{v, true}
+					return true
+				})
+			})
+		}
+		if !result.defined && fallback != nil {
+			ev.eval(fallback.value, fallback.pkg, nil, func(v interface{}, _ *regoBindings) bool {
+				result = regoResult{v, true}
+				return false
+			})
+		}
+	}
+	if ev.err != nil {
+		return nil, false
+	}
+	ev.cache[key] = result
+	return result.value, result.defined
+}
+
+func (ev *regoEval) body(stmts []regoStmt, pkg string, b *regoBindings, k func(b *regoBindings) bool) bool {
+	if !ev.step() {
+		return false
+	}
+	if len(stmts) == 0 {
+		return k(b)
+	}
+	stmt, rest := stmts[0], stmts[1:]
+	next := func(b *regoBindings) bool { return ev.body(rest, pkg, b, k) }
+
+	switch stmt.kind {
+	case regoStmtNot:
+		matched := false
+		ev.eval(stmt.expr, pkg, b, func(v interface{}, _ *regoBindings) bool {
+			matched = v != false
+			return !matched
+		})
+		if ev.err != nil || matched {
+			return ev.err == nil
+		}
+		return next(b)
+	case regoStmtAssign:
+		return ev.eval(stmt.expr, pkg, b, func(v interface{}, b *regoBindings) bool {
+			return next(b.bind(stmt.vars[0], v))
+		})
+	case regoStmtUnify:
+		for _, side := range [][2]regoExpr{{stmt.expr, stmt.right}, {stmt.right, stmt.expr}} {
+			if ref, ok := side[0].(*regoRef); ok && len(ref.path) == 0 && ev.unbound(ref.root, pkg, b) {
+				return ev.eval(side[1], pkg, b, func(v interface{}, b *regoBindings) bool {
+					return next(b.bind(ref.root, v))
+				})
+			}
+		}
+		return ev.eval(&regoBinary{op: "==", left: stmt.expr, right: stmt.right}, pkg, b, func(v interface{}, b *regoBindings) bool {
+			return v != true || next(b)
+		})
+	case regoStmtSome:
+		for _, name := range stmt.vars {
+			b = &regoBindings{name: name, parent: b}
+		}
+		return next(b)
+	case regoStmtSomeIn:
+		return ev.eval(stmt.expr, pkg, b, func(collection interface{}, b *regoBindings) bool {
+			return regoEach(collection, func(key, value interface{}) bool {
+				inner := b
+				if len(stmt.vars) == 2 {
+					inner = inner.bind(stmt.vars[0], key)
+				}
+				return next(inner.bind(stmt.vars[len(stmt.vars)-1], value))
+			})
+		})
+	}
+	return ev.eval(stmt.expr, pkg, b, func(v interface{}, b *regoBindings) bool {
+		return v == false || next(b)
+	})
+}
+
+func (ev *regoEval) eval(e regoExpr, pkg string, b *regoBindings, k regoYield) bool {
+	if !ev.step() {
+		return false
+	}
+	switch e := e.(type) {
+	case regoLiteral:
+		return k(e.value, b)
+	case *regoRef:
+		return ev.ref(e, pkg, b, k)
+	case *regoArrayLit:
+		return ev.list(e.items, pkg, b, nil, func(values []interface{}, b *regoBindings) bool {
+			return k(values, b)
+		})
+	case *regoSetLit:
+		return ev.list(e.items, pkg, b, nil, func(values []interface{}, b *regoBindings) bool {
+			set := newRegoSet()
+			for _, value := range values {
+				set.add(value)
+			}
+			return k(set, b)
+		})
+	case *regoObjectLit:
+		return ev.list(append(append([]regoExpr(nil), e.keys...), e.values...), pkg, b, nil, func(values []interface{}, b *regoBindings) bool {
+			object := make(map[string]interface{}, len(e.keys))
+			for i := range e.keys {
+				key, ok := values[i].(string)
+				if !ok {
+					return true
+				}
+				object[key] = values[len(e.keys)+i]
+			}
+			return k(object, b)
+		})
+	case *regoCall:
+		return ev.list(e.args, pkg, b, nil, func(args []interface{}, b *regoBindings) bool {
+			if result, ok := e.builtin.call(args); ok {
+				return k(result, b)
+			}
+			return true
+		})
+	case *regoBinary:
+		return ev.list([]regoExpr{e.left, e.right}, pkg, b, nil, func(operands []interface{}, b *regoBindings) bool {
+			if result, ok := regoOperate(e.op, operands[0], operands[1]); ok {
+				return k(result, b)
+			}
+			return true
+		})
+	case *regoIn:
+		return ev.list([]regoExpr{e.value, e.collection}, pkg, b, nil, func(operands []interface{}, b *regoBindings) bool {
+			member, want := false, regoKey(operands[0])
+			regoEach(operands[1], func(_, value interface{}) bool {
+				member = regoKey(value) == want
+				return !member
+			})
+			return k(member, b)
+		})
+	}
+	ev.fail(fmt.Errorf("unknown expression %T", e))
+	return false
+}
+
+// list evaluates exprs left to right and yields every combination.
+func (ev *regoEval) list(exprs []regoExpr, pkg string, b *regoBindings, values []interface{}, k func([]interface{}, *regoBindings) bool) bool {
+	if len(values) == len(exprs) {
+		return k(values, b)
+	}
+	return ev.eval(exprs[len(values)], pkg, b, func(v interface{}, b *regoBindings) bool {
+		return ev.list(exprs, pkg, b, append(values[:len(values):len(values)], v), k)
+	})
+}
+
+func (ev *regoEval) ref(ref *regoRef, pkg string, b *regoBindings, k regoYield) bool {
+	path := ref.path
+	var base interface{}
+	if value, bound, declared := b.lookup(ref.root); declared {
+		if !bound {
+			return true
+		}
+		base = value
+	} else {
+		switch ref.root {
+		case "input":
+			base = ev.input
+		case "data":
+			// The longest run of fields naming a rule picks it.
+			found := false
+			for i := len(path); i > 0 && !found; i-- {
+				var names []string
+				for _, element := range path[:i] {
+					if field, ok := element.(regoLiteral); ok {
+						if name, ok := field.value.(string); ok {
+							names = append(names, name)
+							continue
+						}
+					}
+					break
+				}
+				if len(names) < i {
+					continue
+				}
+				if _, exists := ev.policy.rules[strings.Join(names, "/")]; exists {
+					value, defined := ev.rule(strings.Join(names, "/"))
+					if !defined {
+						return ev.err == nil
+					}
+					base, path, found = value, path[i:], true
+				}
+			}
+			if !found {
+				return true
+			}
+		default:
+			key := pkg + "/" + ref.root
+			if _, exists := ev.policy.rules[key]; !exists {
+				return true
+			}
+			value, defined := ev.rule(key)
+			if !defined {
+				return ev.err == nil
+			}
+			base = value
+		}
+	}
+	return ev.walk(base, path, pkg, b, k)
+}
+
+// walk follows path from value; an unbound variable in the path iterates
+// over the collection there, binding the key.
+func (ev *regoEval) walk(value interface{}, path []regoExpr, pkg string, b *regoBindings, k regoYield) bool {
+	if !ev.step() {
+		return false
+	}
+	if len(path) == 0 {
+		return k(value, b)
+	}
+	if variable, ok := path[0].(*regoRef); ok && len(variable.path) == 0 && ev.unbound(variable.root, pkg, b) {
+		return regoEach(value, func(key, child interface{}) bool {
+			return ev.walk(child, path[1:], pkg, b.bind(variable.root, key), k)
+		})
+	}
+	return ev.eval(path[0], pkg, b, func(key interface{}, b *regoBindings) bool {
+		if child, ok := regoIndex(value, key); ok {
+			return ev.walk(child, path[1:], pkg, b, k)
+		}
+		return true
+	})
+}
+
+func regoIndex(collection, key interface{}) (interface{}, bool) {
+	switch collection := collection.(type) {
+	case map[string]interface{}:
+		if name, ok := key.(string); ok {
+			value, exists := collection[name]
+			return value, exists
+		}
+	case []interface{}:
+		if n, ok := key.(float64); ok && n == math.Trunc(n) && n >= 0 && int(n) < len(collection) {
+			return collection[int(n)], true
+		}
+	case *regoSet:
+		if _, member := collection.members[regoKey(key)]; member {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// regoEach calls f with each key and value of an object, array or set, in
+// a stable order, until it returns false.
+func regoEach(collection interface{}, f func(key, value interface{}) bool) bool {
+	switch collection := collection.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(collection))
+		for key := range collection {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !f(key, collection[key]) {
+				return false
+			}
+		}
+	case []interface{}:
+		for i, value := range collection {
+			if !f(float64(i), value) {
+				return false
+			}
+		}
+	case *regoSet:
+		for _, key := range collection.sortedKeys() {
+			member := collection.members[key]
+			if !f(member, member) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func regoOperate(op string, left, right interface{}) (interface{}, bool) {
+	switch op {
+	case "==":
+		return regoKey(left) == regoKey(right), true
+	case "!=":
+		return regoKey(left) != regoKey(right), true
+	}
+	if l, ok := left.(string); ok {
+		r, ok := right.(string)
+		if !ok {
+			return nil, false
+		}
+		switch op {
+		case "<":
+			return l < r, true
+		case "<=":
+			return l <= r, true
+		case ">":
+			return l > r, true
+		case ">=":
+			return l >= r, true
+		}
+		return nil, false
+	}
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil, false
+	}
+	switch op {
+	case "<":
+		return l < r, true
+	case "<=":
+		return l <= r, true
+	case ">":
+		return l > r, true
+	case ">=":
+		return l >= r, true
+	case "+":
+		return l + r, true
+	case "-":
+		return l - r, true
+	case "*":
+		return l * r, true
+	case "/":
+		if r == 0 {
+			return nil, false
+		}
+		return l / r, true
+	case "%":
+		if r == 0 || l != math.Trunc(l) || r != math.Trunc(r) {
+			return nil, false
+		}
+		return float64(int64(l) % int64(r)), true
+	}
+	return nil, false
+}
+
+type regoBuiltin struct {
+	arity int
+	call  func(args []interface{}) (interface{}, bool)
+}
+
+// regoStrings is a builtin over string arguments.
+func regoStrings(arity int, f func(args []string) (interface{}, bool)) regoBuiltin {
+	return regoBuiltin{arity: arity, call: func(args []interface{}) (interface{}, bool) {
+		strs := make([]string, len(args))
+		for i, arg := range args {
+			s, ok := arg.(string)
+			if !ok {
+				return nil, false
+			}
+			strs[i] = s
+		}
+		return f(strs)
+	}}
+}
+
+// regoNumbers collects the numbers of an array or set.
+func regoNumbers(collection interface{}) ([]float64, bool) {
+	var numbers []float64
+	ok := true
+	regoEach(collection, func(_, value interface{}) bool {
+		n, isNumber := value.(float64)
+		numbers, ok = append(numbers, n), isNumber
+		return ok
+	})
+	if _, isObject := collection.(map[string]interface{}); isObject {
+		return nil, false
+	}
+	return numbers, ok
+}
+
+func regoSprintfArg(v interface{}) interface{} {
+	switch v := v.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+		return v
+	case string, bool:
+		return v
+	}
+	data, _ := json.Marshal(regoJSON(v))
+	return string(data)
+}
+
+// regoPatterns caches compiled regex.match patterns, which are mostly
+// constants of the policy; patterns built from the input are compiled each
+// time once the cache is full.
+var regoPatterns = struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp
+}{compiled: make(map[string]*regexp.Regexp)}
+
+const regoMaxPatterns = 256
+
+func regoPattern(pattern string) (*regexp.Regexp, error) {
+	regoPatterns.Lock()
+	defer regoPatterns.Unlock()
+
+	if re, cached := regoPatterns.compiled[pattern]; cached {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err == nil && len(regoPatterns.compiled) < regoMaxPatterns {
+		regoPatterns.compiled[pattern] = re
+	}
+	return re, err
+}
+
+var regoBuiltins map[string]regoBuiltin
+
+func init() {
+	regoBuiltins = map[string]regoBuiltin{
+		"count": {1, func(args []interface{}) (interface{}, bool) {
+			switch v := args[0].(type) {
+			case string:
+				return float64(len([]rune(v))), true
+			case []interface{}:
+				return float64(len(v)), true
+			case map[string]interface{}:
+				return float64(len(v)), true
+			case *regoSet:
+				return float64(len(v.members)), true
+			}
+			return nil, false
+		}},
+		"sum": {1, func(args []interface{}) (interface{}, bool) {
+			numbers, ok := regoNumbers(args[0])
+			total := 0.0
+			for _, n := range numbers {
+				total += n
+			}
+			return total, ok
+		}},
+		"max": {1, func(args []interface{}) (interface{}, bool) {
+			numbers, ok := regoNumbers(args[0])
+			if !ok || len(numbers) == 0 {
+				return nil, false
+			}
+			sort.Float64s(numbers)
+			return numbers[len(numbers)-1], true
+		}},
+		"min": {1, func(args []interface{}) (interface{}, bool) {
+			numbers, ok := regoNumbers(args[0])
+			if !ok || len(numbers) == 0 {
+				return nil, false
+			}
+			sort.Float64s(numbers)
+			return numbers[0], true
+		}},
+		"startswith": regoStrings(2, func(s []string) (interface{}, bool) { return strings.HasPrefix(s[0], s[1]), true }),
+		"endswith":   regoStrings(2, func(s []string) (interface{}, bool) { return strings.HasSuffix(s[0], s[1]), true }),
+		"contains":   regoStrings(2, func(s []string) (interface{}, bool) { return strings.Contains(s[0], s[1]), true }),
+		"lower":      regoStrings(1, func(s []string) (interface{}, bool) { return strings.ToLower(s[0]), true }),
+		"upper":      regoStrings(1, func(s []string) (interface{}, bool) { return strings.ToUpper(s[0]), true }),
+		"trim_space": regoStrings(1, func(s []string) (interface{}, bool) { return strings.TrimSpace(s[0]), true }),
+		"trim_prefix": regoStrings(2, func(s []string) (interface{}, bool) {
+			return strings.TrimPrefix(s[0], s[1]), true
+		}),
+		"trim_suffix": regoStrings(2, func(s []string) (interface{}, bool) {
+			return strings.TrimSuffix(s[0], s[1]), true
+		}),
+		"replace": regoStrings(3, func(s []string) (interface{}, bool) {
+			return strings.ReplaceAll(s[0], s[1], s[2]), true
+		}),
+		"split": regoStrings(2, func(s []string) (interface{}, bool) {
+			parts := strings.Split(s[0], s[1])
+			items := make([]interface{}, len(parts))
+			for i, part := range parts {
+				items[i] = part
+			}
+			return items, true
+		}),
+		"concat": {2, func(args []interface{}) (interface{}, bool) {
+			separator, ok := args[0].(string)
+			if !ok {
+				return nil, false
+			}
+			var parts []string
+			regoEach(args[1], func(_, value interface{}) bool {
+				var isString bool
+				part, isString := value.(string)
+				parts, ok = append(parts, part), isString
+				return ok
+			})
+			return strings.Join(parts, separator), ok
+		}},
+		"sprintf": {2, func(args []interface{}) (interface{}, bool) {
+			format, ok := args[0].(string)
+			values, isArray := args[1].([]interface{})
+			if !ok || !isArray {
+				return nil, false
+			}
+			converted := make([]interface{}, len(values))
+			for i, value := range values {
+				converted[i] = regoSprintfArg(value)
+			}
+			return fmt.Sprintf(format, converted...), true
+		}},
+		"to_number": {1, func(args []interface{}) (interface{}, bool) {
+			switch v := args[0].(type) {
+			case float64:
+				return v, true
+			case string:
+				n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+				return n, err == nil
+			case bool:
+				if v {
+					return 1.0, true
+				}
+				return 0.0, true
+			}
+			return nil, false
+		}},
+		"regex.match": regoStrings(2, func(s []string) (interface{}, bool) {
+			re, err := regoPattern(s[0])
+			if err != nil {
+				return nil, false
+			}
+			return re.MatchString(s[1]), true
+		}),
+		"net.cidr_contains": regoStrings(2, func(s []string) (interface{}, bool) {
+			_, network, err := net.ParseCIDR(s[0])
+			if err != nil {
+				return nil, false
+			}
+			if ip := net.ParseIP(s[1]); ip != nil {
+				return network.Contains(ip), true
+			}
+			ip, inner, err := net.ParseCIDR(s[1])
+			if err != nil {
+				return nil, false
+			}
+			innerBits, _ := inner.Mask.Size()
+			outerBits, _ := network.Mask.Size()
+			return network.Contains(ip) && innerBits >= outerBits, true
+		}),
+		"object.get": {3, func(args []interface{}) (interface{}, bool) {
+			object, ok := args[0].(map[string]interface{})
+			key, isString := args[1].(string)
+			if !ok || !isString {
+				return nil, false
+			}
+			if value, exists := object[key]; exists {
+				return value, true
+			}
+			return args[2], true
+		}},
+	}
+}
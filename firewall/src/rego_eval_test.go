@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const regoTestInput = `{
+	"ip": "203.0.113.9",
+	"method": "POST",
+	"path": "/admin/users",
+	"headers": {"User-Agent": "curl/8.0", "X-Roles": "staff,admin"},
+	"geo": {"country": "FR", "asn": 64500},
+	"counters": {"attempts_last_minute": 3, "attempts_last_hour": 40, "risk_score": 2.5}
+}`
+
+func evaluateRegoTest(t *testing.T, source, rule string) (interface{}, bool, error) {
+	t.Helper()
+	policy, err := compileRego(map[string]string{"test.rego": source})
+	if err != nil {
+		return nil, false, err
+	}
+	var input interface{}
+	if err := json.Unmarshal([]byte(regoTestInput), &input); err != nil {
+		t.Fatal(err)
+	}
+	value, defined, err := policy.Evaluate(rule, input)
+	if err == nil {
+		data, _ := json.Marshal(regoJSON(value))
+		value = string(data)
+	}
+	return value, defined, err
+}
+
+func TestRegoEvaluation(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		source  string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "default when no definition holds",
+			source: `package test
+default result := "open"
+result := "closed" if input.geo.country == "DE"`,
+			want: `"open"`,
+		},
+		{
+			name: "complete rule with body",
+			source: `package test
+import rego.v1
+result := {"action": "block", "reason": reason} if {
+	startswith(input.path, "/admin")
+	not input.geo.country in {"DE", "AT"}
+	reason := sprintf("admin from %s", [input.geo.country])
+}`,
+			want: `{"action":"block","reason":"admin from FR"}`,
+		},
+		{
+			name: "partial set over iteration",
+			source: `package test
+result contains role if {
+	some role in split(input.headers["X-Roles"], ",")
+	role != "staff"
+}
+result contains "busy" if input.counters.attempts_last_hour > 30
+result[x] { x := upper(input.method) }`,
+			want: `["POST","admin","busy"]`,
+		},
+		{
+			name: "comprehensions are rejected",
+			source: `package test
+result := names if {
+	names := {name | input.headers[name]}
+}`,
+			wantErr: "comprehensions are not supported",
+		},
+		{
+			name: "iteration through references",
+			source: `package test
+agents[name] { startswith(input.headers[name], "curl/") }
+result := count(agents)`,
+			want: `1`,
+		},
+		{
+			name: "rules reach each other through data",
+			source: `package test
+limit := 2
+over if input.counters.attempts_last_minute > data.test.limit
+result := {"allow": false} if over`,
+			want: `{"allow":false}`,
+		},
+		{
+			name: "unification binds, then compares",
+			source: `package test
+result := x if {
+	x = input.geo.asn
+	x = 64500
+	some y
+	y = x + 1
+	y % 2 == 1
+}`,
+			want: `64500`,
+		},
+		{
+			name: "builtins",
+			source: `package test
+result := [
+	net.cidr_contains("203.0.113.0/24", input.ip),
+	regex.match("^/admin/", input.path),
+	object.get(input.geo, "org", "none"),
+	concat(",", split("a-b", "-")),
+	to_number("1.5") * 2,
+	max([1, 7, 3]),
+	trim_space("  x "),
+]`,
+			want: `[true,true,"none","a,b",3,7,"x"]`,
+		},
+		{
+			name: "builtin errors leave the expression undefined",
+			source: `package test
+default result := "undefined"
+result := "defined" if count(42) > 0`,
+			want: `"undefined"`,
+		},
+		{
+			name: "conflicting values",
+			source: `package test
+result := 1 if input.ip
+result := 2 if input.path`,
+			wantErr: "conflicting values",
+		},
+		{
+			name:    "self dependency",
+			source:  "package test\nresult if not result",
+			wantErr: "depends on itself",
+		},
+		{
+			name:    "functions are rejected",
+			source:  "package test\nf(x) := x\nresult := 1",
+			wantErr: "functions are not supported",
+		},
+		{
+			name:    "unknown builtins are rejected",
+			source:  "package test\nresult := http.send({})",
+			wantErr: "unknown function http.send",
+		},
+		{
+			name:    "arity is checked",
+			source:  `package test` + "\n" + `result := startswith("a")`,
+			wantErr: "takes 2 arguments",
+		},
+		{
+			name: "the step budget stops runaway evaluation",
+			source: `package test
+n := [0, 1, 2, 3, 4, 5, 6, 7, 8, 9]
+result if {
+	n[a]; n[b]; n[c]; n[d]; n[e]
+	a + b + c + d + e < 0
+}`,
+			wantErr: errRegoBudget.Error(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, defined, err := evaluateRegoTest(t, tc.source, "test/result")
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got %v, %v, want an error containing %q", got, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil || !defined || got != tc.want {
+				t.Errorf("got %v (defined %v, error %v), want %s", got, defined, err, tc.want)
+			}
+		})
+	}
+}
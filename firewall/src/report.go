@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	DefaultReportPath     = "/var/log/shared/firewall/report.html"
+	DefaultReportInterval = 60
+)
+
+type HTMLReportConfig struct {
+	Enabled         bool   `json:"enabled"`
+	Path            string `json:"path"`
+	IntervalSeconds int    `json:"interval_seconds"`
+}
+
+func normalizeHTMLReportConfig(config HTMLReportConfig) HTMLReportConfig {
+	if config.Path == "" {
+		config.Path = DefaultReportPath
+	}
+	if config.IntervalSeconds <= 0 {
+		config.IntervalSeconds = DefaultReportInterval
+	}
+	return config
+}
+
+type reportBar struct {
+	X, Y, Height  float64
+	BlockedY      float64
+	BlockedHeight float64
+	Label         string
+}
+
+type reportData struct {
+	GeneratedAt string
+	Uptime      string
+	Traffic     TrafficStatsSnapshot
+	Responses   ResponseStatsSnapshot
+	Bars        []reportBar
+	ChartWidth  float64
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="60">
+<title>DockerChat Firewall Report</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", sans-serif; background: #1e1f22; color: #dbdee1; margin: 2em; }
+h1 { color: #8775e9; }
+h2 { border-bottom: 1px solid #3f4147; padding-bottom: .3em; }
+.cards { display: flex; gap: 1em; flex-wrap: wrap; }
+.card { background: #2b2d31; padding: 1em 1.5em; border-radius: 8px; min-width: 10em; }
+.card b { display: block; font-size: 1.6em; color: #fff; }
+table { border-collapse: collapse; min-width: 24em; }
+td, th { padding: .3em 1em; text-align: left; border-bottom: 1px solid #3f4147; }
+td.n { text-align: right; font-variant-numeric: tabular-nums; }
+.grid { display: flex; gap: 3em; flex-wrap: wrap; }
+svg rect.c { fill: #8775e9; }
+svg rect.b { fill: #ed4245; }
+svg text { fill: #949ba4; font-size: 10px; }
+</style>
+</head>
+<body>
+<h1>DockerChat Firewall</h1>
+<p>Generated {{.GeneratedAt}} &middot; uptime {{.Uptime}}</p>
+<div class="cards">
+<div class="card">Connections<b>{{.Traffic.Connections}}</b></div>
+<div class="card">Blocked<b>{{.Traffic.Blocked}}</b></div>
+<div class="card">Responses<b>{{.Responses.Responses}}</b></div>
+<div class="card">Avg upstream latency<b>{{printf "%.1f" .Responses.AvgLatencyMillis}} ms</b></div>
+</div>
+
+<h2>Traffic over the last hour</h2>
+<svg width="{{.ChartWidth}}" height="140" role="img" aria-label="connections per minute">
+{{range .Bars}}<rect class="c" x="{{.X}}" y="{{printf "%.1f" .Y}}" width="8" height="{{printf "%.1f" .Height}}"><title>{{.Label}}</title></rect>
+<rect class="b" x="{{.X}}" y="{{printf "%.1f" .BlockedY}}" width="8" height="{{printf "%.1f" .BlockedHeight}}"></rect>
+{{end}}<text x="0" y="135">connections (purple) / blocked (red) per minute</text>
+</svg>
+
+<div class="grid">
+<div>
+<h2>Top clients</h2>
+<table><tr><th>IP</th><th>Connections</th></tr>
+{{range .Traffic.TopIPs}}<tr><td>{{.Key}}{{if .Hostname}} <small>{{.Hostname}}</small>{{end}}</td><td class="n">{{.Count}}</td></tr>
+{{else}}<tr><td colspan="2">No traffic yet</td></tr>
+{{end}}</table>
+</div>
+<div>
+<h2>Top blocked clients</h2>
+<table><tr><th>IP</th><th>Blocks</th></tr>
+{{range .Traffic.TopBlocked}}<tr><td>{{.Key}}{{if .Hostname}} <small>{{.Hostname}}</small>{{end}}</td><td class="n">{{.Count}}</td></tr>
+{{else}}<tr><td colspan="2">Nothing blocked</td></tr>
+{{end}}</table>
+</div>
+<div>
+<h2>Block reasons</h2>
+<table><tr><th>Reason</th><th>Count</th></tr>
+{{range .Traffic.BlockReasons}}<tr><td>{{.Key}}</td><td class="n">{{.Count}}</td></tr>
+{{else}}<tr><td colspan="2">Nothing blocked</td></tr>
+{{end}}</table>
+</div>
+<div>
+<h2>Response status</h2>
+<table><tr><th>Class</th><th>Count</th></tr>
+{{range $class, $count := .Responses.StatusClasses}}<tr><td>{{$class}}</td><td class="n">{{$count}}</td></tr>
+{{else}}<tr><td colspan="2">No responses yet</td></tr>
+{{end}}</table>
+</div>
+</div>
+</body>
+</html>
+`))
+
+func buildReportData(fw *Firewall) reportData {
+	traffic := fw.trafficSnapshot()
+
+	var peak uint64
+	for _, bucket := range traffic.Timeline {
+		if bucket.Connections > peak {
+			peak = bucket.Connections
+		}
+	}
+
+	bars := make([]reportBar, 0, len(traffic.Timeline))
+	for i, bucket := range traffic.Timeline {
+		bar := reportBar{
+			X:     float64(i * 10),
+			Label: fmt.Sprintf("%s - %d connections, %d blocked", bucket.Minute.Format("15:04"), bucket.Connections, bucket.Blocked),
+		}
+		if peak > 0 {
+			bar.Height = float64(bucket.Connections) / float64(peak) * 120
+			bar.BlockedHeight = float64(bucket.Blocked) / float64(peak) * 120
+		}
+		bar.Y = 120 - bar.Height
+		bar.BlockedY = 120 - bar.BlockedHeight
+		bars = append(bars, bar)
+	}
+
+	return reportData{
+		GeneratedAt: time.Now().Format("2006-01-02 15:04:05"),
+		Uptime:      fw.clock.Now().Sub(fw.startTime).Round(time.Second).String(),
+		Traffic:     traffic,
+		Responses:   fw.responseStats.Snapshot(),
+		Bars:        bars,
+		ChartWidth:  float64(TimelineBuckets * 10),
+	}
+}
+
+func (fw *Firewall) writeHTMLReport(path string) error {
+	var buf bytes.Buffer
+	if err := reportTemplate.Execute(&buf, buildReportData(fw)); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf.Bytes(), 0644)
+}
+
+// writeFileAtomic writes via a temp file and rename so readers of the shared
+// volume never see a half-written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (fw *Firewall) reportWatcher() {
+	lastWritten := time.Time{}
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fw.rulesMutex.RLock()
+		config := fw.rules.HTMLReport
+		fw.rulesMutex.RUnlock()
+
+		if !config.Enabled || time.Since(lastWritten) < time.Duration(config.IntervalSeconds)*time.Second {
+			continue
+		}
+
+		if err := fw.writeHTMLReport(config.Path); err != nil {
+			fw.logErrorRateLimited("html_report", "REPORT", "Failed to write HTML report %s: %v", config.Path, err)
+			continue
+		}
+		lastWritten = time.Now()
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// RequestHead is the parsed request line and headers of the first request on
+// a connection. Raw holds the exact bytes read from the client (including any
+// body bytes already buffered) and is what gets forwarded upstream. Opaque
+// heads are the opening bytes of a non-HTTP connection the protocol allowlist
+// let through; see readOpaqueHead.
+type RequestHead struct {
+	Method string
+	Target string
+	Proto  string
+	Header http.Header
+	Raw    []byte
+	Opaque bool
+}
+
+func (rh *RequestHead) Host() string {
+	return rh.Header.Get("Host")
+}
+
+// Path returns the request path, handling both origin-form ("/x?y") and
+// absolute-form ("http://host/x") request targets.
+func (rh *RequestHead) Path() string {
+	target := rh.Target
+	if strings.Contains(target, "://") {
+		if parsed, err := url.Parse(target); err == nil {
+			return parsed.EscapedPath()
+		}
+	}
+	return target
+}
+
+// requestHeadFromMessage is a later request of a keep-alive connection,
+// as the request middleware read it. Its Raw isn't pooled and must not be
+// released.
+func requestHeadFromMessage(head *messageHead) *RequestHead {
+	rh := &RequestHead{Header: head.Header, Raw: head.raw}
+	if parts := strings.Fields(head.StartLine); len(parts) == 3 {
+		rh.Method, rh.Target, rh.Proto = parts[0], parts[1], parts[2]
+	}
+	return rh
+}
+
+func (rh *RequestHead) Release() {
+	releaseRequestBuffer(rh.Raw)
+	rh.Raw = nil
+}
+
+const (
+	MaxRequestHeadSize = MaxStreamHeadSize
+	MaxRequestHeaders  = 100
+)
+
+var (
+	errRequestHeadTooLarge = errors.New("request head too large")
+	errMalformedRequest    = errors.New("malformed request")
+)
+
+// readHeadLine reads one line, failing once the head as a whole would pass
+// MaxRequestHeadSize instead of buffering whatever the client sends.
+func readHeadLine(reader *bufio.Reader, head *RequestHead) (string, error) {
+	start := len(head.Raw)
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(head.Raw)+len(chunk) > MaxRequestHeadSize {
+			return "", errRequestHeadTooLarge
+		}
+		head.Raw = append(head.Raw, chunk...)
+		if err == nil {
+			return string(head.Raw[start:]), nil
+		}
+		if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+}
+
+// validHeadLine rejects NUL and other control bytes, which no legitimate
+// client sends and which parsers downstream may read differently.
+func validHeadLine(line string) bool {
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	for i := 0; i < len(line); i++ {
+		if c := line[i]; (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRequestHead reads the request line and headers. Heads over
+// MaxRequestHeadSize or MaxRequestHeaders fail with errRequestHeadTooLarge;
+// control bytes, a request target that isn't printable ASCII and invalid
+// header names fail with errMalformedRequest.
+func parseRequestHead(reader *bufio.Reader) (*RequestHead, error) {
+	head := &RequestHead{
+		Header: make(http.Header),
+		Raw:    acquireRequestBuffer(),
+	}
+
+	firstLine, err := readHeadLine(reader, head)
+	if err != nil {
+		head.Release()
+		return nil, err
+	}
+	if !validHeadLine(firstLine) {
+		head.Release()
+		return nil, errMalformedRequest
+	}
+
+	if parts := strings.Fields(firstLine); len(parts) == 3 {
+		head.Method, head.Target, head.Proto = parts[0], parts[1], parts[2]
+	}
+	for i := 0; i < len(head.Target); i++ {
+		if head.Target[i] >= 0x7f {
+			head.Release()
+			return nil, errMalformedRequest
+		}
+	}
+
+	for count := 0; ; count++ {
+		line, err := readHeadLine(reader, head)
+		if err != nil {
+			head.Release()
+			return nil, err
+		}
+
+		if line == "\r\n" || line == "\n" {
+			break
+		}
+		if count >= MaxRequestHeaders {
+			head.Release()
+			return nil, errRequestHeadTooLarge
+		}
+		if !validHeadLine(line) {
+			head.Release()
+			return nil, errMalformedRequest
+		}
+
+		if colon := strings.IndexByte(line, ':'); colon > 0 {
+			if !validHeaderName(line[:colon]) {
+				head.Release()
+				return nil, errMalformedRequest
+			}
+			name := textproto.CanonicalMIMEHeaderKey(line[:colon])
+			head.Header.Add(name, strings.TrimSpace(line[colon+1:]))
+		}
+	}
+
+	// Anything the reader pulled in past the headers belongs to the body and
+	// must be forwarded along with them.
+	if buffered := reader.Buffered(); buffered > 0 {
+		body, _ := reader.Peek(buffered)
+		head.Raw = append(head.Raw, body...)
+	}
+
+	return head, nil
+}
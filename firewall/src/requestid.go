@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+var fallbackRequestIDs atomic.Uint64
+
+// newConnectionID returns a random 16 hex digit ID for a client connection.
+func newConnectionID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16) + "-" + strconv.FormatUint(fallbackRequestIDs.Add(1), 16)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// requestID names the n-th request (1-based) on a connection. The first
+// request carries the bare connection ID so that errors sent before the
+// request stream starts match the ID seen upstream.
+func requestID(connID string, n int) string {
+	if n <= 1 {
+		return connID
+	}
+	return connID + "-" + strconv.Itoa(n)
+}
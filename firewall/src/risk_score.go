@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RiskSignalRateLimit    = "rate_limit"
+	RiskSignalScan         = "scan"
+	RiskSignalHoneypot     = "honeypot"
+	RiskSignalAbuseReport  = "abuse_report"
+	RiskSignalLoginFailure = "login_failure"
+	RiskSignalAnomaly      = "anomaly"
+	RiskSignalIPList       = "ip_list"
+	RiskSignalDNSBL        = "dnsbl"
+
+	// RiskScoreFloor is where a decayed score is forgotten.
+	RiskScoreFloor  = 1
+	RiskScoresShown = 50
+)
+
+var defaultRiskWeights = map[string]float64{
+	RiskSignalRateLimit:    10,
+	RiskSignalScan:         50,
+	RiskSignalHoneypot:     30,
+	RiskSignalAbuseReport:  25,
+	RiskSignalLoginFailure: 5,
+	RiskSignalAnomaly:      30,
+	RiskSignalIPList:       30,
+	RiskSignalDNSBL:        30,
+}
+
+// RiskScoring keeps a score per client key that the other protections feed:
+// each rate-limit refusal, honeypot hit, completed port scan, abuse report
+// from the chat, failed login and anomaly flag adds its weight, and the total
+// halves every HalfLifeMinutes. Being on an IP list or a DNSBL adds its
+// weight for as long as the listing holds; lists and DNSBLs with action
+// "score" do nothing else. The combined score then decides:
+//   - at ChallengeScore the client must pass the cookie challenge;
+//   - at ThrottleScore its per-minute limit is multiplied by ThrottleFactor;
+//   - at BlockScore it is auto-blocked for BlockDurationMinutes.
+type RiskScoring struct {
+	Enabled              bool               `json:"enabled"`
+	Weights              map[string]float64 `json:"weights"`
+	HalfLifeMinutes      int                `json:"half_life_minutes"`
+	ChallengeScore       float64            `json:"challenge_score"`
+	ChallengeValidHours  int                `json:"challenge_valid_hours"`
+	ThrottleScore        float64            `json:"throttle_score"`
+	ThrottleFactor       float64            `json:"throttle_factor"`
+	BlockScore           float64            `json:"block_score"`
+	BlockDurationMinutes int                `json:"block_duration_minutes"`
+}
+
+func normalizeRiskScoring(config RiskScoring) RiskScoring {
+	weights := make(map[string]float64, len(defaultRiskWeights))
+	for signal, weight := range defaultRiskWeights {
+		weights[signal] = weight
+	}
+	for signal, weight := range config.Weights {
+		signal = strings.ToLower(strings.TrimSpace(signal))
+		if _, known := defaultRiskWeights[signal]; known && weight >= 0 {
+			weights[signal] = weight
+		}
+	}
+	config.Weights = weights
+	if config.HalfLifeMinutes <= 0 {
+		config.HalfLifeMinutes = 10
+	}
+	if config.BlockScore <= 0 {
+		config.BlockScore = 80
+	}
+	if config.ThrottleScore <= 0 || config.ThrottleScore > config.BlockScore {
+		config.ThrottleScore = config.BlockScore / 2
+	}
+	if config.ChallengeScore <= 0 || config.ChallengeScore > config.ThrottleScore {
+		config.ChallengeScore = config.ThrottleScore / 2
+	}
+	if config.ChallengeValidHours <= 0 {
+		config.ChallengeValidHours = DefaultChallengeValidHours
+	}
+	if config.ThrottleFactor <= 0 || config.ThrottleFactor > 1 {
+		config.ThrottleFactor = 0.25
+	}
+	if config.BlockDurationMinutes <= 0 {
+		config.BlockDurationMinutes = 60
+	}
+	return config
+}
+
+func (config RiskScoring) halfLife() time.Duration {
+	return time.Duration(config.HalfLifeMinutes) * time.Minute
+}
+
+type riskEntry struct {
+	score      float64
+	updated    time.Time
+	reputation float64
+	signals    map[string]int
+}
+
+func (entry *riskEntry) decay(now time.Time, halfLife time.Duration) {
+	if elapsed := now.Sub(entry.updated); elapsed > 0 {
+		entry.score *= math.Pow(0.5, float64(elapsed)/float64(halfLife))
+		entry.updated = now
+	}
+}
+
+// RiskScores holds the decaying per-key scores.
+type RiskScores struct {
+	mutex   sync.Mutex
+	entries map[string]*riskEntry
+}
+
+func NewRiskScores() *RiskScores {
+	return &RiskScores{entries: make(map[string]*riskEntry)}
+}
+
+func (rs *RiskScores) entry(key string, now time.Time) *riskEntry {
+	entry, exists := rs.entries[key]
+	if !exists {
+		if len(rs.entries) >= MaxTrackedIPs {
+			return nil
+		}
+		entry = &riskEntry{updated: now, signals: make(map[string]int)}
+		rs.entries[key] = entry
+	}
+	return entry
+}
+
+// Add records points for signal against key and returns the new total.
+func (rs *RiskScores) Add(key, signal string, points float64, now time.Time, halfLife time.Duration) float64 {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	entry := rs.entry(key, now)
+	if entry == nil {
+		return 0
+	}
+	entry.decay(now, halfLife)
+	entry.score += points
+	entry.signals[signal]++
+	return entry.score + entry.reputation
+}
+
+// SetReputation replaces the part of key's score that comes from listings.
+func (rs *RiskScores) SetReputation(key string, points float64, now time.Time) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	entry, exists := rs.entries[key]
+	if !exists && points == 0 {
+		return
+	}
+	if !exists {
+		if entry = rs.entry(key, now); entry == nil {
+			return
+		}
+	}
+	entry.reputation = points
+}
+
+func (rs *RiskScores) Score(key string, now time.Time, halfLife time.Duration) float64 {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	entry, exists := rs.entries[key]
+	if !exists {
+		return 0
+	}
+	entry.decay(now, halfLife)
+	return entry.score + entry.reputation
+}
+
+func (rs *RiskScores) Forget(key string) {
+	rs.mutex.Lock()
+	delete(rs.entries, key)
+	rs.mutex.Unlock()
+}
+
+// Cleanup drops keys whose score has decayed away and that aren't listed.
+func (rs *RiskScores) Cleanup(now time.Time, halfLife time.Duration) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	for key, entry := range rs.entries {
+		entry.decay(now, halfLife)
+		if entry.score < RiskScoreFloor && entry.reputation == 0 {
+			delete(rs.entries, key)
+		}
+	}
+}
+
+// RiskScoreEntry is one client's score as shown by the admin API.
+type RiskScoreEntry struct {
+	Key        string         `json:"key"`
+	Score      float64        `json:"score"`
+	Reputation float64        `json:"reputation"`
+	Signals    map[string]int `json:"signals"`
+}
+
+// Top returns the n highest-scoring keys.
+func (rs *RiskScores) Top(n int, now time.Time, halfLife time.Duration) []RiskScoreEntry {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	entries := make([]RiskScoreEntry, 0, len(rs.entries))
+	for key, entry := range rs.entries {
+		entry.decay(now, halfLife)
+		signals := make(map[string]int, len(entry.signals))
+		for signal, count := range entry.signals {
+			signals[signal] = count
+		}
+		entries = append(entries, RiskScoreEntry{
+			Key:        key,
+			Score:      math.Round((entry.score+entry.reputation)*10) / 10,
+			Reputation: entry.reputation,
+			Signals:    signals,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score > entries[j].Score
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+func (fw *Firewall) riskScoring() RiskScoring {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.RiskScoring
+}
+
+// recordRisk adds one occurrence of signal to key's score, times count, and
+// auto-blocks key once the score reaches block_score. It reports whether key
+// was blocked. Callers must not hold attemptsMutex.
+func (fw *Firewall) recordRisk(ip, key, signal string, count int) bool {
+	config := fw.riskScoring()
+	if !config.Enabled || config.Weights[signal] == 0 {
+		return false
+	}
+	score := fw.riskScores.Add(key, signal, config.Weights[signal]*float64(count), fw.clock.Now(), config.halfLife())
+	return fw.blockOnRisk(ip, key, score, signal, config)
+}
+
+func (fw *Firewall) blockOnRisk(ip, key string, score float64, last string, config RiskScoring) bool {
+	if score < config.BlockScore {
+		return false
+	}
+
+	fw.riskScores.Forget(key)
+	fw.attemptsMutex.Lock()
+	fw.autoBlockLocked(key, "RISK_SCORE", fw.clock.Now().Add(time.Duration(config.BlockDurationMinutes)*time.Minute))
+	fw.attemptsMutex.Unlock()
+
+	if fw.logger != nil {
+		fw.logger.LogBlocked(ip, "RISK_SCORE",
+			fmt.Sprintf("%s blocked for %dm - risk score %.1f/%.0f (last signal: %s)", key, config.BlockDurationMinutes, score, config.BlockScore, last))
+	}
+	return true
+}
+
+// RiskVerdict is what a client's score calls for when it connects.
+type RiskVerdict struct {
+	Score     float64
+	Block     bool
+	Throttle  bool
+	Challenge bool
+}
+
+// assessRisk refreshes key's reputation from its current listings and
+// returns the verdict for its score.
+func (fw *Firewall) assessRisk(ip, key string, listedOnIPList, listedOnDNSBL bool) RiskVerdict {
+	config := fw.riskScoring()
+	if !config.Enabled {
+		return RiskVerdict{}
+	}
+
+	reputation := 0.0
+	if listedOnIPList {
+		reputation += config.Weights[RiskSignalIPList]
+	}
+	if listedOnDNSBL {
+		reputation += config.Weights[RiskSignalDNSBL]
+	}
+	now := fw.clock.Now()
+	fw.riskScores.SetReputation(key, reputation, now)
+
+	score := fw.riskScores.Score(key, now, config.halfLife())
+	verdict := RiskVerdict{
+		Score:     score,
+		Throttle:  score >= config.ThrottleScore,
+		Challenge: score >= config.ChallengeScore,
+	}
+	verdict.Block = fw.blockOnRisk(ip, key, score, "reputation", config)
+	return verdict
+}
+
+// riskThrottleFactor is what key's per-minute limit is multiplied by.
+func (fw *Firewall) riskThrottleFactor(key string) float64 {
+	config := fw.riskScoring()
+	if !config.Enabled {
+		return 1
+	}
+	if fw.riskScores.Score(key, fw.clock.Now(), config.halfLife()) < config.ThrottleScore {
+		return 1
+	}
+	return config.ThrottleFactor
+}
+
+func (fw *Firewall) handleRiskScores(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, fw.riskScores.Top(RiskScoresShown, fw.clock.Now(), fw.riskScoring().halfLife()))
+}
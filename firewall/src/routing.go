@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+type Upstream struct {
+	Host string       `json:"host"`
+	Port int          `json:"port"`
+	TLS  *UpstreamTLS `json:"tls,omitempty"`
+}
+
+func (u Upstream) Addr() string {
+	return net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+}
+
+func (u Upstream) Valid() bool {
+	return u.Host != "" && u.Port > 0 && u.Port <= 65535
+}
+
+// TrafficSplit sends a share of connections to an alternate upstream for
+// canary releases. Clients in IPs or presenting the configured cookie always
+// go to the canary; everyone else is routed there with Percentage chance.
+type TrafficSplit struct {
+	Enabled     bool     `json:"enabled"`
+	Upstream    Upstream `json:"upstream"`
+	Percentage  int      `json:"percentage"`
+	IPs         []string `json:"ips"`
+	CookieName  string   `json:"cookie_name"`
+	CookieValue string   `json:"cookie_value"`
+}
+
+func normalizeTrafficSplit(split TrafficSplit) TrafficSplit {
+	if split.Percentage < 0 {
+		split.Percentage = 0
+	}
+	if split.Percentage > 100 {
+		split.Percentage = 100
+	}
+	if !split.Upstream.Valid() {
+		split.Enabled = false
+	}
+	return split
+}
+
+func (split TrafficSplit) matchesCookie(head *RequestHead) bool {
+	if split.CookieName == "" || head == nil {
+		return false
+	}
+	cookie, err := (&http.Request{Header: head.Header}).Cookie(split.CookieName)
+	if err != nil {
+		return false
+	}
+	return split.CookieValue == "" || cookie.Value == split.CookieValue
+}
+
+const (
+	AffinityClientIP = "ip"
+	AffinityCookie   = "cookie"
+)
+
+// Affinity controls which key multi-backend routing hashes on. With cookie
+// affinity, clients without the cookie fall back to their IP.
+type Affinity struct {
+	Mode       string `json:"mode"`
+	CookieName string `json:"cookie_name"`
+}
+
+func normalizeAffinity(affinity Affinity) Affinity {
+	if affinity.Mode != AffinityCookie || affinity.CookieName == "" {
+		affinity.Mode = AffinityClientIP
+	}
+	return affinity
+}
+
+func (affinity Affinity) Key(ip string, head *RequestHead) string {
+	if affinity.Mode == AffinityCookie && head != nil {
+		if cookie, err := (&http.Request{Header: head.Header}).Cookie(affinity.CookieName); err == nil && cookie.Value != "" {
+			return "cookie:" + cookie.Value
+		}
+	}
+	return "ip:" + ip
+}
+
+func (fw *Firewall) primaryUpstream() Upstream {
+	return Upstream{Host: fw.proxyHost, Port: fw.proxyPort}
+}
+
+// selectUpstream picks the upstream for a connection and reports whether it
+// was routed to the canary. A tenant with its own upstreams is routed among
+// them only.
+func (fw *Firewall) selectUpstream(ip string, head *RequestHead, tenant *tenantRules) (Upstream, bool) {
+	fw.rulesMutex.RLock()
+	split := fw.rules.TrafficSplit
+	canaryIPs := fw.parsedRules.CanaryIPs
+	ring := fw.parsedRules.UpstreamRing
+	affinity := fw.rules.Affinity
+	fw.rulesMutex.RUnlock()
+
+	if tenant != nil && !tenant.ring.Empty() {
+		upstream, _ := tenant.ring.Get(affinity.Key(ip, head))
+		return upstream, false
+	}
+
+	if split.Enabled {
+		if canaryIPs.Contains(ip) || split.matchesCookie(head) {
+			return split.Upstream, true
+		}
+		if split.Percentage > 0 && rand.Intn(100) < split.Percentage {
+			return split.Upstream, true
+		}
+	}
+
+	if upstream, ok := ring.Get(affinity.Key(ip, head)); ok {
+		return upstream, false
+	}
+
+	return fw.primaryUpstream(), false
+}
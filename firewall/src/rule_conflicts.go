@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	RuleConflictWarn   = "warn"
+	RuleConflictReject = "reject"
+)
+
+// RuleConflictConfig decides what a reload does when a whitelist entry
+// overlaps a blocked_ips or always_block entry: "warn" applies the rules and
+// reports the overlap, "reject" keeps the previous rules.
+type RuleConflictConfig struct {
+	Action string `json:"action"`
+}
+
+func normalizeRuleConflictConfig(config RuleConflictConfig) RuleConflictConfig {
+	config.Action = strings.ToLower(strings.TrimSpace(config.Action))
+	if config.Action != RuleConflictReject {
+		config.Action = RuleConflictWarn
+	}
+	return config
+}
+
+func (fw *Firewall) ruleConflictConfig() RuleConflictConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.RuleConflicts
+}
+
+// RuleConflict is a whitelist entry overlapping a blocking one. Winner is the
+// rule that applies to the addresses they share, per rule_precedence.
+type RuleConflict struct {
+	Whitelist string `json:"whitelist"`
+	Rule      string `json:"rule"`
+	Entry     string `json:"entry"`
+	Winner    string `json:"winner"`
+}
+
+func (rc RuleConflict) String() string {
+	return fmt.Sprintf("whitelist %s overlaps %s %s (%s wins)", rc.Whitelist, rc.Rule, rc.Entry, rc.Winner)
+}
+
+// precedenceWinner returns whichever of a and b comes first in order.
+func precedenceWinner(order []string, a, b string) string {
+	for _, rule := range order {
+		if rule == a || rule == b {
+			return rule
+		}
+	}
+	return a
+}
+
+// overlappingEntries pairs each network of one matcher with the most specific
+// network of the other that contains it, in both directions, as configured
+// entries.
+func overlappingEntries(whitelist, blocking *IPMatcher) [][2]string {
+	var pairs [][2]string
+	seen := make(map[[2]string]bool)
+	add := func(white, blocked *net.IPNet) {
+		pair := [2]string{whitelist.sources[white], blocking.sources[blocked]}
+		if !seen[pair] {
+			seen[pair] = true
+			pairs = append(pairs, pair)
+		}
+	}
+	for _, network := range blocking.networks {
+		if white, found := whitelist.trie.Lookup(network.IP); found {
+			add(white, network)
+		}
+	}
+	for _, network := range whitelist.networks {
+		if blocked, found := blocking.trie.Lookup(network.IP); found {
+			add(network, blocked)
+		}
+	}
+	return pairs
+}
+
+// findRuleConflicts lists the whitelist entries of parsed that overlap
+// blocked_ips or always_block entries.
+func findRuleConflicts(parsed *ParsedRules, order []string) []RuleConflict {
+	conflicts := []RuleConflict{}
+	for _, blocking := range []struct {
+		rule    string
+		matcher *IPMatcher
+	}{{RuleAlwaysBlock, parsed.AlwaysBlock}, {RuleBlockedIPs, parsed.BlockedIPs}} {
+		for _, pair := range overlappingEntries(parsed.Whitelist, blocking.matcher) {
+			conflicts = append(conflicts, RuleConflict{
+				Whitelist: pair[0],
+				Rule:      blocking.rule,
+				Entry:     pair[1],
+				Winner:    precedenceWinner(order, RuleWhitelist, blocking.rule),
+			})
+		}
+	}
+	sort.SliceStable(conflicts, func(i, j int) bool {
+		if conflicts[i].Whitelist != conflicts[j].Whitelist {
+			return conflicts[i].Whitelist < conflicts[j].Whitelist
+		}
+		return conflicts[i].Entry < conflicts[j].Entry
+	})
+	return conflicts
+}
+
+func (fw *Firewall) ruleConflicts() []RuleConflict {
+	fw.rulesMutex.RLock()
+	parsed := fw.parsedRules
+	order := fw.rules.RulePrecedence
+	fw.rulesMutex.RUnlock()
+
+	return findRuleConflicts(parsed, order)
+}
+
+// conflictIssues turns conflicts into rules status issues.
+func conflictIssues(conflicts []RuleConflict) []RulesIssue {
+	issues := make([]RulesIssue, 0, len(conflicts))
+	for _, conflict := range conflicts {
+		issues = append(issues, RulesIssue{Field: "whitelist", Message: conflict.String()})
+	}
+	return issues
+}
+
+// handleRuleConflicts lists the overlaps between the whitelist and the
+// blocking rules currently in force.
+func (fw *Firewall) handleRuleConflicts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"action":    fw.ruleConflictConfig().Action,
+		"conflicts": fw.ruleConflicts(),
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// RuleEntry is one whitelist, blocked_ips or always_block entry. In
+// rules.json it is either a plain string or an object carrying audit
+// metadata:
+//
+//	{"entry": "203.0.113.0/24", "comment": "scraper", "created_by": "ops",
+//	 "created_at": "2024-01-01T12:00:00Z", "expires_at": "2024-02-01T00:00:00Z"}
+//
+// Entries without metadata are written back as plain strings.
+//
+// An entry can also be given a lifetime, as "1.2.3.4#ttl=72h" or an object
+// with "ttl": "72h". The TTL is turned into expires_at, counted from
+// created_at or the reload that first saw it, and expired entries are pruned
+// from rules.json.
+type RuleEntry struct {
+	Entry     string
+	Comment   string
+	CreatedBy string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	TTL       time.Duration
+}
+
+type ruleEntryObject struct {
+	Entry     string     `json:"entry"`
+	Comment   string     `json:"comment,omitempty"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	TTL       string     `json:"ttl,omitempty"`
+}
+
+const ruleEntryTTLSuffix = "#ttl="
+
+func parseEntryTTL(value string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl %q: %v", value, err)
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("invalid ttl %q: must be positive", value)
+	}
+	return ttl, nil
+}
+
+func (re RuleEntry) hasMetadata() bool {
+	return re.Comment != "" || re.CreatedBy != "" || !re.CreatedAt.IsZero() || !re.ExpiresAt.IsZero()
+}
+
+func (re RuleEntry) MarshalJSON() ([]byte, error) {
+	if !re.hasMetadata() {
+		if re.TTL > 0 {
+			return json.Marshal(re.Entry + ruleEntryTTLSuffix + re.TTL.String())
+		}
+		return json.Marshal(re.Entry)
+	}
+	object := ruleEntryObject{Entry: re.Entry, Comment: re.Comment, CreatedBy: re.CreatedBy}
+	if re.TTL > 0 {
+		object.TTL = re.TTL.String()
+	}
+	if !re.CreatedAt.IsZero() {
+		object.CreatedAt = &re.CreatedAt
+	}
+	if !re.ExpiresAt.IsZero() {
+		object.ExpiresAt = &re.ExpiresAt
+	}
+	return json.Marshal(object)
+}
+
+func (re *RuleEntry) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		*re = RuleEntry{}
+		if err := json.Unmarshal(data, &re.Entry); err != nil {
+			return err
+		}
+		if entry, ttl, found := strings.Cut(re.Entry, ruleEntryTTLSuffix); found {
+			parsed, err := parseEntryTTL(ttl)
+			if err != nil {
+				return fmt.Errorf("rule entry %q: %v", re.Entry, err)
+			}
+			re.Entry, re.TTL = strings.TrimSpace(entry), parsed
+		}
+		return nil
+	}
+
+	var object ruleEntryObject
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	if strings.TrimSpace(object.Entry) == "" {
+		return fmt.Errorf("rule entry %s has no \"entry\"", data)
+	}
+	*re = RuleEntry{Entry: object.Entry, Comment: object.Comment, CreatedBy: object.CreatedBy}
+	if object.CreatedAt != nil {
+		re.CreatedAt = *object.CreatedAt
+	}
+	if object.ExpiresAt != nil {
+		re.ExpiresAt = *object.ExpiresAt
+	}
+	if object.TTL != "" {
+		ttl, err := parseEntryTTL(object.TTL)
+		if err != nil {
+			return fmt.Errorf("rule entry %q: %v", object.Entry, err)
+		}
+		re.TTL = ttl
+	}
+	return nil
+}
+
+// RuleEntryList is a list of rule entries as read from rules.json.
+type RuleEntryList []RuleEntry
+
+// ruleEntries builds a list of entries without metadata.
+func ruleEntries(entries ...string) RuleEntryList {
+	list := make(RuleEntryList, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, RuleEntry{Entry: entry})
+	}
+	return list
+}
+
+// Entries returns the IPs, CIDRs and address classes of the list.
+func (rl RuleEntryList) Entries() []string {
+	entries := make([]string, 0, len(rl))
+	for _, entry := range rl {
+		entries = append(entries, entry.Entry)
+	}
+	return entries
+}
+
+// Find returns the list's entry for value.
+func (rl RuleEntryList) Find(value string) (RuleEntry, bool) {
+	value = strings.TrimSpace(value)
+	for _, entry := range rl {
+		if strings.TrimSpace(entry.Entry) == value {
+			return entry, true
+		}
+	}
+	return RuleEntry{}, false
+}
+
+// expire turns TTLs into expiry times as of now and drops entries that have
+// expired. It reports whether the list changed and which entries expired.
+func (rl RuleEntryList) expire(now time.Time) (RuleEntryList, bool, []string) {
+	changed := false
+	var expired []string
+	kept := make(RuleEntryList, 0, len(rl))
+	for _, entry := range rl {
+		if entry.TTL > 0 {
+			if entry.ExpiresAt.IsZero() {
+				if entry.CreatedAt.IsZero() {
+					entry.CreatedAt = now.UTC()
+				}
+				entry.ExpiresAt = entry.CreatedAt.Add(entry.TTL)
+			}
+			entry.TTL = 0
+			changed = true
+		}
+		if !entry.ExpiresAt.IsZero() && !now.Before(entry.ExpiresAt) {
+			expired = append(expired, entry.Entry)
+			changed = true
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	return kept, changed, expired
+}
+
+// nextExpiry is the earliest expires_at in the list, or zero.
+func (rl RuleEntryList) nextExpiry() time.Time {
+	var next time.Time
+	for _, entry := range rl {
+		if !entry.ExpiresAt.IsZero() && (next.IsZero() || entry.ExpiresAt.Before(next)) {
+			next = entry.ExpiresAt
+		}
+	}
+	return next
+}
+
+// ruleEntryListRef points at one entry list of a Rules, named by its field.
+type ruleEntryListRef struct {
+	Field string
+	List  *RuleEntryList
+}
+
+// entryLists returns the rule entry lists of rules, the top-level ones and
+// those of every rule group.
+func (rules *Rules) entryLists() []ruleEntryListRef {
+	lists := []ruleEntryListRef{
+		{RuleBlockedIPs, &rules.BlockedIPs},
+		{RuleWhitelist, &rules.Whitelist},
+		{RuleAlwaysBlock, &rules.AlwaysBlock},
+		{"exempt_from_rate_limit", &rules.ExemptFromRateLimit},
+	}
+	for i := range rules.RuleGroups {
+		group := &rules.RuleGroups[i]
+		prefix := fmt.Sprintf("rule_groups[%s].", group.Name)
+		lists = append(lists,
+			ruleEntryListRef{prefix + RuleBlockedIPs, &group.BlockedIPs},
+			ruleEntryListRef{prefix + RuleWhitelist, &group.Whitelist},
+			ruleEntryListRef{prefix + RuleAlwaysBlock, &group.AlwaysBlock})
+	}
+	return lists
+}
+
+// expireRuleEntries applies expire to every entry list of rules.
+func expireRuleEntries(rules *Rules, now time.Time) (bool, []string) {
+	changed := false
+	var expired []string
+	for _, ref := range rules.entryLists() {
+		kept, listChanged, listExpired := ref.List.expire(now)
+		if listChanged {
+			*ref.List = kept
+			changed = true
+		}
+		expired = append(expired, listExpired...)
+	}
+	return changed, expired
+}
+
+// rulesNextExpiry is when the next entry of rules expires, or zero.
+func rulesNextExpiry(rules *Rules) time.Time {
+	var next time.Time
+	for _, ref := range rules.entryLists() {
+		if expiry := ref.List.nextExpiry(); !expiry.IsZero() && (next.IsZero() || expiry.Before(next)) {
+			next = expiry
+		}
+	}
+	return next
+}
+
+// pruneExpiredRuleEntries drops entries whose expiry has passed since the
+// rules were loaded and saves the rules without them.
+func (fw *Firewall) pruneExpiredRuleEntries() {
+	now := fw.clock.Now()
+	fw.rulesMutex.RLock()
+	next := fw.parsedRules.NextExpiry
+	fw.rulesMutex.RUnlock()
+	if next.IsZero() || now.Before(next) {
+		return
+	}
+
+	fw.rulesMutex.Lock()
+	defer fw.rulesMutex.Unlock()
+
+	updated := *fw.rules
+	updated.RuleGroups = append([]RuleGroup(nil), fw.rules.RuleGroups...)
+	changed, expired := expireRuleEntries(&updated, now)
+	if !changed {
+		return
+	}
+
+	data, err := json.MarshalIndent(&updated, "", "  ")
+	if err == nil {
+		err = fw.writeRulesFile(data)
+	}
+	if err != nil {
+		fw.logErrorRateLimited("rules_expiry", "RULES", "Failed to save rules without expired entries: %v", err)
+		return
+	}
+	if stat, err := os.Stat(fw.rulesFile); err == nil {
+		fw.rulesModTime = stat.ModTime()
+	}
+	fw.rules = &updated
+	fw.parsedRules = ParseRules(fw.rules)
+	if fw.logger != nil {
+		fw.logger.LogInfo("RULES", "Expired %d rule entries: %s", len(expired), strings.Join(expired, ", "))
+	}
+}
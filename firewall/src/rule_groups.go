@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RuleGroup is a named set of entries ("geo", "office-whitelist",
+// "threat-feed") that can be switched off through the admin API without
+// deleting them. The entries of an enabled group apply as if listed in the
+// top-level whitelist, blocked_ips and always_block; BlockedCountries refuses
+// clients located in those countries whether or not the countries policy is
+// enabled.
+type RuleGroup struct {
+	Name             string        `json:"name"`
+	Enabled          bool          `json:"enabled"`
+	Whitelist        RuleEntryList `json:"whitelist"`
+	BlockedIPs       RuleEntryList `json:"blocked_ips"`
+	AlwaysBlock      RuleEntryList `json:"always_block"`
+	BlockedCountries []string      `json:"blocked_countries"`
+}
+
+func normalizeRuleGroups(groups []RuleGroup) []RuleGroup {
+	seen := make(map[string]bool, len(groups))
+	normalized := make([]RuleGroup, 0, len(groups))
+	for _, group := range groups {
+		group.Name = strings.ToLower(strings.TrimSpace(group.Name))
+		if group.Name == "" || seen[group.Name] {
+			continue
+		}
+		seen[group.Name] = true
+		group.BlockedCountries = normalizeCountryCodes(group.BlockedCountries)
+		normalized = append(normalized, group)
+	}
+	return normalized
+}
+
+// withGroupEntries returns base plus the entries pick selects from every
+// enabled group, and records which group each added entry came from under
+// rule in owners.
+func withGroupEntries(base []string, groups []RuleGroup, rule string, owners map[string]string, pick func(RuleGroup) []string) []string {
+	inBase := make(map[string]bool, len(base))
+	for _, entry := range base {
+		inBase[strings.TrimSpace(entry)] = true
+	}
+	entries := append([]string(nil), base...)
+	for _, group := range groups {
+		if !group.Enabled {
+			continue
+		}
+		for _, entry := range pick(group) {
+			entry = strings.TrimSpace(entry)
+			if inBase[entry] {
+				continue
+			}
+			if _, owned := owners[rule+" "+entry]; !owned {
+				owners[rule+" "+entry] = group.Name
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// groupOf returns the rule group an entry matched under rule came from, or
+// "" if it is listed at the top level.
+func (pr *ParsedRules) groupOf(rule, entry string) string {
+	return pr.EntryGroups[rule+" "+entry]
+}
+
+func (fw *Firewall) ruleGroups() []RuleGroup {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.RuleGroups
+}
+
+// groupBlockingCountry returns the first enabled group that blocks country.
+func (fw *Firewall) groupBlockingCountry(country string) (string, bool) {
+	if country == "" {
+		return "", false
+	}
+	for _, group := range fw.ruleGroups() {
+		if group.Enabled && containsCountry(group.BlockedCountries, country) {
+			return group.Name, true
+		}
+	}
+	return "", false
+}
+
+// groupsBlockCountries reports whether any enabled group blocks countries,
+// which means every client's country has to be looked up.
+func (fw *Firewall) groupsBlockCountries() bool {
+	for _, group := range fw.ruleGroups() {
+		if group.Enabled && len(group.BlockedCountries) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+var errUnknownRuleGroup = errors.New("no such rule group")
+
+// RuleGroupHits counts the decisions each rule group made.
+type RuleGroupHits struct {
+	mutex sync.Mutex
+	hits  map[string]uint64
+}
+
+func NewRuleGroupHits() *RuleGroupHits {
+	return &RuleGroupHits{hits: make(map[string]uint64)}
+}
+
+func (rh *RuleGroupHits) Record(group string) {
+	if group == "" {
+		return
+	}
+	rh.mutex.Lock()
+	defer rh.mutex.Unlock()
+
+	rh.hits[group]++
+}
+
+func (rh *RuleGroupHits) Count(group string) uint64 {
+	rh.mutex.Lock()
+	defer rh.mutex.Unlock()
+
+	return rh.hits[group]
+}
+
+type RuleGroupStatus struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+}
+
+func (fw *Firewall) ruleGroupStatuses() []RuleGroupStatus {
+	statuses := []RuleGroupStatus{}
+	for _, group := range fw.ruleGroups() {
+		statuses = append(statuses, RuleGroupStatus{
+			Name:    group.Name,
+			Enabled: group.Enabled,
+			Entries: len(group.Whitelist) + len(group.BlockedIPs) + len(group.AlwaysBlock) + len(group.BlockedCountries),
+			Hits:    fw.groupHits.Count(group.Name),
+		})
+	}
+	return statuses
+}
+
+// setRuleGroupEnabled switches a group on or off and saves the rules.
+func (fw *Firewall) setRuleGroupEnabled(name string, enabled bool) error {
+	fw.rulesMutex.Lock()
+	defer fw.rulesMutex.Unlock()
+
+	updated := *fw.rules
+	updated.RuleGroups = append([]RuleGroup(nil), fw.rules.RuleGroups...)
+	found := false
+	for i := range updated.RuleGroups {
+		if updated.RuleGroups[i].Name == name {
+			updated.RuleGroups[i].Enabled = enabled
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: %q", errUnknownRuleGroup, name)
+	}
+
+	data, err := json.MarshalIndent(&updated, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fw.writeRulesFile(data); err != nil {
+		return err
+	}
+	fw.rules = &updated
+	fw.parsedRules = ParseRules(fw.rules)
+	return nil
+}
+
+// handleRuleGroups lists the rule groups with their hit counts on GET and
+// switches one on or off on POST ?name=...&enabled=true|false.
+func (fw *Firewall) handleRuleGroups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		name := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("name")))
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if name == "" || err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name and enabled=true|false are required"})
+			return
+		}
+		if err := fw.setRuleGroupEnabled(name, enabled); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errUnknownRuleGroup) {
+				status = http.StatusNotFound
+			}
+			writeJSON(w, status, map[string]string{"error": err.Error()})
+			return
+		}
+		if fw.logger != nil {
+			fw.logger.LogInfo("RULES", "Rule group %s set to enabled=%v", name, enabled)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"rule_groups": fw.ruleGroupStatuses()})
+}
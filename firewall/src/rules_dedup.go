@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// MaxLoggedNormalizations caps how many normalization notes a reload logs.
+const MaxLoggedNormalizations = 20
+
+// canonicalEntry returns the canonical form of an IP or CIDR entry and the
+// network it covers. Address classes and unparseable entries come back
+// unchanged with a nil network.
+func canonicalEntry(entry string) (string, *net.IPNet) {
+	entry = strings.TrimSpace(entry)
+	if _, isClass := addressClassNetworks(entry); isClass {
+		return strings.ToLower(entry), nil
+	}
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return entry, nil
+		}
+		return ipNet.String(), ipNet
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return entry, nil
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return ip.String(), &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// dedupeEntryList canonicalizes the entries of list, drops duplicates and
+// drops entries covered by a broader one that lasts at least as long. The
+// first of duplicates is kept, with its metadata and the longest expiry. It
+// returns the list and what it changed.
+func dedupeEntryList(list RuleEntryList) (RuleEntryList, []string) {
+	var notes []string
+	networks := make([]*net.IPNet, len(list))
+	seen := make(map[string]int, len(list))
+	dropped := make([]bool, len(list))
+	canonical := make(RuleEntryList, len(list))
+	for i, entry := range list {
+		text, network := canonicalEntry(entry.Entry)
+		if text != entry.Entry {
+			notes = append(notes, fmt.Sprintf("%s -> %s", entry.Entry, text))
+		}
+		entry.Entry = text
+		canonical[i], networks[i] = entry, network
+		if first, duplicate := seen[text]; duplicate {
+			dropped[i] = true
+			notes = append(notes, fmt.Sprintf("dropped duplicate %s", list[i].Entry))
+			if kept := &canonical[first]; entry.ExpiresAt.IsZero() || (!kept.ExpiresAt.IsZero() && entry.ExpiresAt.After(kept.ExpiresAt)) {
+				kept.ExpiresAt = entry.ExpiresAt
+			}
+			continue
+		}
+		seen[text] = i
+	}
+
+	order := make([]int, 0, len(list))
+	for i := range canonical {
+		if !dropped[i] && networks[i] != nil {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		onesA, _ := networks[order[a]].Mask.Size()
+		onesB, _ := networks[order[b]].Mask.Size()
+		return onesA < onesB
+	})
+
+	trie := NewIPTrie()
+	owners := make(map[*net.IPNet]int, len(order))
+	for _, i := range order {
+		if covering, found := trie.Lookup(networks[i].IP); found {
+			owner := canonical[owners[covering]]
+			expires := canonical[i].ExpiresAt
+			if owner.ExpiresAt.IsZero() || (!expires.IsZero() && !owner.ExpiresAt.Before(expires)) {
+				dropped[i] = true
+				notes = append(notes, fmt.Sprintf("dropped %s (covered by %s)", canonical[i].Entry, owner.Entry))
+				continue
+			}
+		}
+		trie.Insert(networks[i])
+		owners[networks[i]] = i
+	}
+
+	kept := make(RuleEntryList, 0, len(canonical))
+	for i, entry := range canonical {
+		if !dropped[i] {
+			kept = append(kept, entry)
+		}
+	}
+	return kept, notes
+}
+
+// dedupeRuleEntries applies dedupeEntryList to every entry list of rules and
+// returns what it changed, prefixed with the list's field.
+func dedupeRuleEntries(rules *Rules) []string {
+	var notes []string
+	for _, ref := range rules.entryLists() {
+		kept, listNotes := dedupeEntryList(*ref.List)
+		if len(listNotes) == 0 {
+			continue
+		}
+		*ref.List = kept
+		for _, note := range listNotes {
+			notes = append(notes, ref.Field+": "+note)
+		}
+	}
+	return notes
+}
+
+// logNormalizations logs what dedupeRuleEntries changed on a reload.
+func (fw *Firewall) logNormalizations(notes []string) {
+	if len(notes) == 0 || fw.logger == nil {
+		return
+	}
+	shown := notes
+	more := ""
+	if len(shown) > MaxLoggedNormalizations {
+		shown = shown[:MaxLoggedNormalizations]
+		more = fmt.Sprintf("; and %d more", len(notes)-MaxLoggedNormalizations)
+	}
+	fw.logger.LogInfo("RULES", "Normalized %d rule entries: %s%s", len(notes), strings.Join(shown, "; "), more)
+}
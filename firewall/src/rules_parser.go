@@ -3,22 +3,38 @@ package main
 import (
 	"net"
 	"strings"
+	"time"
 )
 
 type ParsedRules struct {
-	BlockedIPs           []*net.IPNet
-	Whitelist            []*net.IPNet
+	AlwaysBlock          *IPMatcher
+	BlockedIPs           *IPMatcher
+	Whitelist            *IPMatcher
+	RateLimitExempt      *IPMatcher
+	CanaryIPs            *IPMatcher
+	UpstreamRing         *HashRing
 	AllowedPorts         []int
 	MaxAttemptsPerMinute int
+	ProtocolSignatures   []ProtocolSignature
+	Middleware           middlewareChain
+	Policies             []compiledPolicy
+	Tenants              []*tenantRules
+	// EntryGroups maps "<rule> <entry>" to the rule group an entry came from.
+	EntryGroups map[string]string
+	NextExpiry  time.Time
 }
 
 type IPMatcher struct {
 	networks []*net.IPNet
+	trie     *IPTrie
+	sources  map[*net.IPNet]string
 }
 
 func NewIPMatcher(ipStrings []string) *IPMatcher {
 	matcher := &IPMatcher{
 		networks: make([]*net.IPNet, 0, len(ipStrings)),
+		trie:     NewIPTrie(),
+		sources:  make(map[*net.IPNet]string, len(ipStrings)),
 	}
 
 	for _, ipStr := range ipStrings {
@@ -27,6 +43,15 @@ func NewIPMatcher(ipStrings []string) *IPMatcher {
 			continue
 		}
 
+		if classNetworks, isClass := addressClassNetworks(ipStr); isClass {
+			for _, ipNet := range classNetworks {
+				matcher.networks = append(matcher.networks, ipNet)
+				matcher.trie.Insert(ipNet)
+				matcher.sources[ipNet] = ipStr
+			}
+			continue
+		}
+
 		var ipNet *net.IPNet
 		var err error
 
@@ -45,6 +70,8 @@ func NewIPMatcher(ipStrings []string) *IPMatcher {
 
 		if err == nil && ipNet != nil {
 			matcher.networks = append(matcher.networks, ipNet)
+			matcher.trie.Insert(ipNet)
+			matcher.sources[ipNet] = ipStr
 		}
 	}
 
@@ -52,58 +79,82 @@ func NewIPMatcher(ipStrings []string) *IPMatcher {
 }
 
 func (m *IPMatcher) Contains(ipStr string) bool {
+	_, found := m.Match(ipStr)
+	return found
+}
+
+// Match returns the most specific configured network containing ipStr.
+func (m *IPMatcher) Match(ipStr string) (*net.IPNet, bool) {
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
-		return false
+		return nil, false
 	}
+	return m.trie.Lookup(ip)
+}
 
-	for _, network := range m.networks {
-		if network.Contains(ip) {
-			return true
-		}
+// MatchRule is Match but returns the configured entry that produced the
+// network, e.g. an address class name rather than one of its CIDRs.
+func (m *IPMatcher) MatchRule(ipStr string) (string, bool) {
+	ipNet, found := m.Match(ipStr)
+	if !found {
+		return "", false
 	}
-	return false
+	if source, exists := m.sources[ipNet]; exists {
+		return source, true
+	}
+	return ipNet.String(), true
 }
 
 func (m *IPMatcher) Size() int {
 	return len(m.networks)
 }
 
+// AggregateIP returns the CIDR covering ip at the configured prefix length,
+// or the bare address when the prefix is the full address length.
+func AggregateIP(ip net.IP, v4Prefix, v6Prefix int) string {
+	bits, prefix := 128, v6Prefix
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, prefix = ip4, 32, v4Prefix
+	}
+	if prefix <= 0 || prefix >= bits {
+		return ip.String()
+	}
+
+	mask := net.CIDRMask(prefix, bits)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
 func ParseRules(rules *Rules) *ParsedRules {
+	owners := make(map[string]string)
+	policies, _ := compilePolicies(rules.Policies)
+	alwaysBlock := withGroupEntries(rules.AlwaysBlock.Entries(), rules.RuleGroups, RuleAlwaysBlock, owners, func(g RuleGroup) []string { return g.AlwaysBlock.Entries() })
+	blockedIPs := withGroupEntries(rules.BlockedIPs.Entries(), rules.RuleGroups, RuleBlockedIPs, owners, func(g RuleGroup) []string { return g.BlockedIPs.Entries() })
+	whitelist := withGroupEntries(rules.Whitelist.Entries(), rules.RuleGroups, RuleWhitelist, owners, func(g RuleGroup) []string { return g.Whitelist.Entries() })
+
 	return &ParsedRules{
-		BlockedIPs:           NewIPMatcher(rules.BlockedIPs).networks,
-		Whitelist:            NewIPMatcher(rules.Whitelist).networks,
+		AlwaysBlock:          NewIPMatcher(alwaysBlock),
+		BlockedIPs:           NewIPMatcher(blockedIPs),
+		Whitelist:            NewIPMatcher(whitelist),
+		RateLimitExempt:      NewIPMatcher(rules.ExemptFromRateLimit.Entries()),
+		EntryGroups:          owners,
+		NextExpiry:           rulesNextExpiry(rules),
+		CanaryIPs:            NewIPMatcher(rules.TrafficSplit.IPs),
+		UpstreamRing:         NewHashRing(rules.Upstreams),
 		AllowedPorts:         rules.AllowedPorts,
 		MaxAttemptsPerMinute: rules.MaxAttemptsPerMinute,
+		ProtocolSignatures:   compileProtocolAllowlist(rules.ProtocolAllowlist),
+		Middleware:           buildMiddlewareChain(rules.Middleware),
+		Policies:             policies,
+		Tenants:              compileTenants(rules.Tenants),
 	}
 }
 
 func (pr *ParsedRules) IsWhitelisted(ip string) bool {
-	parsed := net.ParseIP(ip)
-	if parsed == nil {
-		return false
-	}
-
-	for _, network := range pr.Whitelist {
-		if network.Contains(parsed) {
-			return true
-		}
-	}
-	return false
+	return pr.Whitelist.Contains(ip)
 }
 
 func (pr *ParsedRules) IsBlocked(ip string) bool {
-	parsed := net.ParseIP(ip)
-	if parsed == nil {
-		return false
-	}
-
-	for _, network := range pr.BlockedIPs {
-		if network.Contains(parsed) {
-			return true
-		}
-	}
-	return false
+	return pr.BlockedIPs.Contains(ip)
 }
 
 func (pr *ParsedRules) IsAllowedPort(port int) bool {
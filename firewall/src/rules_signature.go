@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Rules signing: when RULES_HMAC_KEY (or RULES_HMAC_KEY_FILE) is set, a reload
+// only takes rules.json if rules.json.sig holds the hex HMAC-SHA256 of its
+// exact bytes under that key. The output of
+//
+//	openssl dgst -sha256 -hmac "$RULES_HMAC_KEY" rules.json > rules.json.sig
+//
+// is accepted as is. Anyone who can write the shared volume but doesn't hold
+// the key can then no longer slip in a whitelist entry.
+
+func loadRulesKey() ([]byte, error) {
+	if key := os.Getenv("RULES_HMAC_KEY"); key != "" {
+		return []byte(key), nil
+	}
+	path := os.Getenv("RULES_HMAC_KEY_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read RULES_HMAC_KEY_FILE: %v", err)
+	}
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return nil, fmt.Errorf("RULES_HMAC_KEY_FILE %s is empty", path)
+	}
+	return []byte(key), nil
+}
+
+func rulesSignaturePath(rulesFile string) string {
+	return rulesFile + ".sig"
+}
+
+func signRules(data, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verifyRulesSignature(data []byte, sigPath string, key []byte) error {
+	sigData, err := os.ReadFile(sigPath)
+	if err != nil {
+		return fmt.Errorf("missing signature: %v", err)
+	}
+
+	// Take the last field so openssl's "HMAC-SHA256(rules.json)= <hex>"
+	// works as well as a bare hex digest.
+	fields := strings.Fields(string(sigData))
+	if len(fields) == 0 {
+		return fmt.Errorf("empty signature file %s", sigPath)
+	}
+	signature, err := hex.DecodeString(strings.ToLower(fields[len(fields)-1]))
+	if err != nil {
+		return fmt.Errorf("signature is not hex: %v", err)
+	}
+
+	expected, _ := hex.DecodeString(signRules(data, key))
+	if !hmac.Equal(signature, expected) {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
+
+// writeRulesFile saves rules changed by the firewall itself (auto-blocks,
+// appeals, imports), re-signing them when signing is enabled.
+func (fw *Firewall) writeRulesFile(data []byte) error {
+	return writeSignedRules(fw.rulesFile, data, fw.rulesKey)
+}
+
+func writeSignedRules(path string, data, key []byte) error {
+	if len(key) > 0 {
+		if err := writeFileAtomic(rulesSignaturePath(path), []byte(signRules(data, key)+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, data, 0644)
+}
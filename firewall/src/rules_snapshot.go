@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSnapshotDir      = "/var/log/shared/firewall/snapshots"
+	DefaultSnapshotInterval = 300
+	DefaultSnapshotKeep     = 48
+)
+
+// SnapshotConfig periodically saves the effective rules so a bad push can be
+// rolled back. A snapshot is only written when the rules changed since the
+// last one.
+type SnapshotConfig struct {
+	Enabled         bool   `json:"enabled"`
+	Directory       string `json:"directory"`
+	IntervalSeconds int    `json:"interval_seconds"`
+	Keep            int    `json:"keep"`
+}
+
+func normalizeSnapshotConfig(config SnapshotConfig) SnapshotConfig {
+	if config.Directory == "" {
+		config.Directory = DefaultSnapshotDir
+	}
+	if config.IntervalSeconds <= 0 {
+		config.IntervalSeconds = DefaultSnapshotInterval
+	}
+	if config.Keep <= 0 {
+		config.Keep = DefaultSnapshotKeep
+	}
+	return config
+}
+
+type RulesSnapshot struct {
+	Revision  string    `json:"revision"`
+	CreatedAt time.Time `json:"created_at"`
+	Current   bool      `json:"current"`
+}
+
+// RulesSnapshots writes and lists snapshot files. Revisions are the snapshot
+// time plus a hash of the rules, which also names the file.
+type RulesSnapshots struct {
+	mutex sync.Mutex
+}
+
+func NewRulesSnapshots() *RulesSnapshots {
+	return &RulesSnapshots{}
+}
+
+func rulesRevision(data []byte, at time.Time) string {
+	sum := sha256.Sum256(data)
+	return at.UTC().Format("20060102-150405") + "-" + hex.EncodeToString(sum[:4])
+}
+
+func revisionHash(revision string) string {
+	return revision[strings.LastIndexByte(revision, '-')+1:]
+}
+
+func validRevision(revision string) bool {
+	if len(revision) != len("20060102-150405-00000000") {
+		return false
+	}
+	for _, c := range revision {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// list returns the revisions in dir, oldest first.
+func (rs *RulesSnapshots) list(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var revisions []string
+	for _, entry := range entries {
+		revision := strings.TrimSuffix(entry.Name(), ".json")
+		if !entry.IsDir() && validRevision(revision) {
+			revisions = append(revisions, revision)
+		}
+	}
+	sort.Strings(revisions)
+	return revisions, nil
+}
+
+// Take saves data unless the newest snapshot already holds the same rules,
+// then prunes down to keep snapshots. It returns the revision and whether a
+// new file was written.
+func (rs *RulesSnapshots) Take(config SnapshotConfig, data []byte) (string, bool, error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	revisions, err := rs.list(config.Directory)
+	if err != nil {
+		return "", false, err
+	}
+
+	revision := rulesRevision(data, time.Now())
+	if n := len(revisions); n > 0 && revisionHash(revisions[n-1]) == revisionHash(revision) {
+		return revisions[n-1], false, nil
+	}
+
+	if err := writeFileAtomic(filepath.Join(config.Directory, revision+".json"), data, 0644); err != nil {
+		return "", false, err
+	}
+	revisions = append(revisions, revision)
+
+	for len(revisions) > config.Keep {
+		os.Remove(filepath.Join(config.Directory, revisions[0]+".json"))
+		revisions = revisions[1:]
+	}
+	return revision, true, nil
+}
+
+func (rs *RulesSnapshots) Read(config SnapshotConfig, revision string) ([]byte, error) {
+	if !validRevision(revision) {
+		return nil, fmt.Errorf("invalid revision %q", revision)
+	}
+	data, err := os.ReadFile(filepath.Join(config.Directory, revision+".json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("unknown revision %s", revision)
+	}
+	return data, err
+}
+
+func (fw *Firewall) snapshotConfig() SnapshotConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.Snapshots
+}
+
+func (fw *Firewall) currentRulesJSON() ([]byte, error) {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return json.MarshalIndent(fw.rules, "", "  ")
+}
+
+func (fw *Firewall) takeRulesSnapshot(config SnapshotConfig) (string, error) {
+	data, err := fw.currentRulesJSON()
+	if err != nil {
+		return "", err
+	}
+
+	revision, created, err := fw.snapshots.Take(config, data)
+	if err != nil {
+		return "", err
+	}
+	if created && fw.logger != nil {
+		fw.logger.LogDebug("SNAPSHOT", "Saved rules snapshot %s", revision)
+	}
+	return revision, nil
+}
+
+// rollbackRules writes a snapshot back to the rules file and reloads it. The
+// current rules are snapshotted first so the rollback itself can be undone.
+// With no revision, the newest snapshot that differs from the current rules
+// is used.
+func (fw *Firewall) rollbackRules(revision string) (string, error) {
+	config := fw.snapshotConfig()
+
+	current, err := fw.takeRulesSnapshot(config)
+	if err != nil {
+		return "", fmt.Errorf("failed to snapshot current rules: %v", err)
+	}
+
+	if revision == "" {
+		revisions, err := fw.snapshots.list(config.Directory)
+		if err != nil {
+			return "", err
+		}
+		for i := len(revisions) - 1; i >= 0; i-- {
+			if revisionHash(revisions[i]) != revisionHash(current) {
+				revision = revisions[i]
+				break
+			}
+		}
+		if revision == "" {
+			return "", fmt.Errorf("no earlier snapshot to roll back to")
+		}
+	}
+
+	data, err := fw.snapshots.Read(config, revision)
+	if err != nil {
+		return "", err
+	}
+	var rules Rules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return "", fmt.Errorf("snapshot %s is not valid rules JSON: %v", revision, err)
+	}
+
+	if err := fw.writeRulesFile(data); err != nil {
+		return "", err
+	}
+	fw.loadRules()
+
+	if fw.logger != nil {
+		fw.logger.LogWarning("SNAPSHOT", "Rules rolled back to snapshot %s (previous rules saved as %s)", revision, current)
+	}
+	return revision, nil
+}
+
+func (fw *Firewall) snapshotWatcher() {
+	elapsed := 0
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		config := fw.snapshotConfig()
+
+		elapsed++
+		if !config.Enabled || elapsed < config.IntervalSeconds {
+			continue
+		}
+		elapsed = 0
+
+		if _, err := fw.takeRulesSnapshot(config); err != nil {
+			fw.logErrorRateLimited("rules_snapshot", "SNAPSHOT", "Failed to snapshot rules to %s: %v", config.Directory, err)
+		}
+	}
+}
+
+type rollbackRequest struct {
+	Revision string `json:"revision"`
+}
+
+// handleSnapshots lists snapshots on GET and takes one immediately on POST.
+func (fw *Firewall) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	config := fw.snapshotConfig()
+
+	switch r.Method {
+	case http.MethodGet:
+		revisions, err := fw.snapshots.list(config.Directory)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		var currentHash string
+		if data, err := fw.currentRulesJSON(); err == nil {
+			currentHash = revisionHash(rulesRevision(data, time.Now()))
+		}
+
+		snapshots := make([]RulesSnapshot, 0, len(revisions))
+		for i := len(revisions) - 1; i >= 0; i-- {
+			createdAt, _ := time.Parse("20060102-150405", revisions[i][:15])
+			snapshots = append(snapshots, RulesSnapshot{
+				Revision:  revisions[i],
+				CreatedAt: createdAt,
+				Current:   revisionHash(revisions[i]) == currentHash,
+			})
+		}
+		writeJSON(w, http.StatusOK, snapshots)
+
+	case http.MethodPost:
+		revision, err := fw.takeRulesSnapshot(config)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"revision": revision})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRollback restores {"revision": "..."}, or the previous snapshot when
+// the body is empty.
+func (fw *Firewall) handleRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req rollbackRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+			return
+		}
+	}
+
+	revision, err := fw.rollbackRules(req.Revision)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"revision": revision})
+}
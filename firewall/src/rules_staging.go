@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	StagedRulesShadowing  = "shadowing"
+	StagedRulesPromoted   = "promoted"
+	StagedRulesRolledBack = "rolled_back"
+	StagedRulesCancelled  = "cancelled"
+
+	MaxStagedRulesSize   = 8 << 20
+	maxStagedNewBlocks   = 20
+	DefaultShadowMinutes = 30
+)
+
+// StagedRulesConfig governs rules pushed to /rules/staged: they run in
+// shadow for ShadowMinutes, judging every connection next to the active
+// rules without enforcing anything. If at most MaxNewBlockPercent of the
+// connections seen would have been blocked by the staged rules but not by
+// the active ones, they are promoted; otherwise they are dropped. The
+// decision waits until at least MinConnections were compared.
+//
+// The shadow covers the per-client checks rules.json drives: whitelist,
+// allowlist_only, blocked_ips, blocked_asns, countries and
+// max_attempts_per_minute.
+type StagedRulesConfig struct {
+	ShadowMinutes      int     `json:"shadow_minutes"`
+	MaxNewBlockPercent float64 `json:"max_new_block_percent"`
+	MinConnections     int     `json:"min_connections"`
+}
+
+func normalizeStagedRulesConfig(config StagedRulesConfig) StagedRulesConfig {
+	if config.ShadowMinutes <= 0 {
+		config.ShadowMinutes = DefaultShadowMinutes
+	}
+	if config.MaxNewBlockPercent < 0 {
+		config.MaxNewBlockPercent = 0
+	}
+	if config.MinConnections < 0 {
+		config.MinConnections = 0
+	}
+	return config
+}
+
+func (fw *Firewall) stagedRulesConfig() StagedRulesConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.StagedRules
+}
+
+// shadowReasons are the block reasons the shadow evaluates; other verdicts
+// depend on checks it doesn't repeat and are compared as allowed.
+var shadowReasons = map[string]bool{
+	"NOT_ALLOWLISTED": true,
+	"BLOCKED_IP":      true,
+	"BLOCKED_ASN":     true,
+	"COUNTRY_DENIED":  true,
+	"RATE_LIMIT":      true,
+}
+
+type stagedNewBlock struct {
+	IP     string `json:"ip"`
+	Reason string `json:"reason"`
+}
+
+// StagedRulesStatus is the state of the current (or last) staged revision.
+type StagedRulesStatus struct {
+	State          string           `json:"state"`
+	StagedAt       time.Time        `json:"staged_at"`
+	DecideAt       time.Time        `json:"decide_at"`
+	Connections    uint64           `json:"connections"`
+	ActiveBlocks   uint64           `json:"active_blocks"`
+	StagedBlocks   uint64           `json:"staged_blocks"`
+	NewBlocks      uint64           `json:"new_blocks"`
+	NewAllows      uint64           `json:"new_allows"`
+	NewBlockPct    float64          `json:"new_block_percent"`
+	Threshold      float64          `json:"max_new_block_percent"`
+	MinConnections int              `json:"min_connections"`
+	Examples       []stagedNewBlock `json:"new_block_examples"`
+	Decision       string           `json:"decision,omitempty"`
+}
+
+// StagedRules holds a rules revision under shadow evaluation.
+type StagedRules struct {
+	mutex  sync.Mutex
+	data   []byte
+	rules  *Rules
+	parsed *ParsedRules
+	status StagedRulesStatus
+}
+
+func NewStagedRules() *StagedRules {
+	return &StagedRules{}
+}
+
+func (sr *StagedRules) Status() (StagedRulesStatus, bool) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	status := sr.status
+	status.Examples = append([]stagedNewBlock{}, sr.status.Examples...)
+	return status, sr.rules != nil || status.State != ""
+}
+
+// stageRules starts shadowing data, replacing any revision still in shadow.
+func (fw *Firewall) stageRules(data []byte) (StagedRulesStatus, error) {
+	var rules Rules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return StagedRulesStatus{}, fmt.Errorf("invalid rules JSON: %v", err)
+	}
+	normalizeRules(&rules)
+
+	config := fw.stagedRulesConfig()
+	now := fw.clock.Now()
+
+	fw.staged.mutex.Lock()
+	fw.staged.data = data
+	fw.staged.rules = &rules
+	fw.staged.parsed = ParseRules(&rules)
+	fw.staged.status = StagedRulesStatus{
+		State:          StagedRulesShadowing,
+		StagedAt:       now,
+		DecideAt:       now.Add(time.Duration(config.ShadowMinutes) * time.Minute),
+		Threshold:      config.MaxNewBlockPercent,
+		MinConnections: config.MinConnections,
+		Examples:       []stagedNewBlock{},
+	}
+	status := fw.staged.status
+	fw.staged.mutex.Unlock()
+
+	if fw.logger != nil {
+		fw.logger.LogInfo("RULES", "Staged rules in shadow until %s", status.DecideAt.Format(time.RFC3339))
+	}
+	return status, nil
+}
+
+// stagedVerdict returns the reason the staged rules would block ip for, or
+// "" when they would let it through.
+func (fw *Firewall) stagedVerdict(rules *Rules, parsed *ParsedRules, ip, key string) string {
+	decision := fw.evaluatePrecedence(rules.RulePrecedence, parsed, ip, key, fw.clock.Now())
+	if decision.Block {
+		return decision.BlockReason()
+	}
+	if decision.Rule == RuleWhitelist {
+		return ""
+	}
+	if rules.AllowlistOnly {
+		return "NOT_ALLOWLISTED"
+	}
+	if len(rules.BlockedASNs) > 0 {
+		if asn, _, found := fw.lookupASN(ip); found {
+			for _, blocked := range rules.BlockedASNs {
+				if asn == blocked {
+					return "BLOCKED_ASN"
+				}
+			}
+		}
+	}
+	if rules.Countries.Enabled && !rules.Countries.Admits(fw.lookupCountry(ip)) {
+		return "COUNTRY_DENIED"
+	}
+
+	fw.attemptsMutex.RLock()
+	attempts := countSince(fw.connectionAttempts[key], time.Minute, fw.clock.Now())
+	fw.attemptsMutex.RUnlock()
+	if attempts > rules.MaxAttemptsPerMinute {
+		return "RATE_LIMIT"
+	}
+	return ""
+}
+
+// shadowStagedRules compares a finished connection's verdict with the one
+// the staged rules would have given it.
+func (fw *Firewall) shadowStagedRules(record *ConnectionRecord, key string) {
+	fw.staged.mutex.Lock()
+	rules, parsed := fw.staged.rules, fw.staged.parsed
+	fw.staged.mutex.Unlock()
+	if rules == nil {
+		return
+	}
+
+	activeBlocked := record.Verdict == VerdictBlocked && shadowReasons[record.Reason]
+	stagedReason := fw.stagedVerdict(rules, parsed, record.IP, key)
+
+	fw.staged.mutex.Lock()
+	defer fw.staged.mutex.Unlock()
+
+	if fw.staged.rules != rules {
+		return
+	}
+	status := &fw.staged.status
+	status.Connections++
+	if activeBlocked {
+		status.ActiveBlocks++
+	}
+	if stagedReason != "" {
+		status.StagedBlocks++
+	}
+	switch {
+	case stagedReason != "" && !activeBlocked:
+		status.NewBlocks++
+		if len(status.Examples) < maxStagedNewBlocks {
+			status.Examples = append(status.Examples, stagedNewBlock{IP: record.IP, Reason: stagedReason})
+		}
+	case stagedReason == "" && activeBlocked:
+		status.NewAllows++
+	}
+	status.NewBlockPct = 100 * float64(status.NewBlocks) / float64(status.Connections)
+}
+
+// finishStagedRules ends the shadow with decision. Only a promotion touches
+// the active rules, which are snapshotted first so /rules/rollback can undo
+// it.
+func (fw *Firewall) finishStagedRules(decision string) error {
+	fw.staged.mutex.Lock()
+	data := fw.staged.data
+	if fw.staged.rules == nil {
+		fw.staged.mutex.Unlock()
+		return fmt.Errorf("no rules are staged")
+	}
+	fw.staged.rules, fw.staged.parsed, fw.staged.data = nil, nil, nil
+	fw.staged.status.State = decision
+	status := fw.staged.status
+	fw.staged.mutex.Unlock()
+
+	if decision != StagedRulesPromoted {
+		if fw.logger != nil {
+			fw.logger.LogWarning("RULES", "Staged rules %s: %d of %d connections (%.2f%%) would have been newly blocked",
+				decision, status.NewBlocks, status.Connections, status.NewBlockPct)
+		}
+		return nil
+	}
+
+	if _, err := fw.takeRulesSnapshot(fw.snapshotConfig()); err != nil {
+		fw.logErrorRateLimited("rules_snapshot", "SNAPSHOT", "Failed to snapshot rules before promotion: %v", err)
+	}
+	if err := fw.writeRulesFile(data); err != nil {
+		return fmt.Errorf("failed to write promoted rules: %v", err)
+	}
+	fw.loadRules()
+
+	if fw.logger != nil {
+		fw.logger.LogInfo("RULES", "Staged rules promoted: %d of %d connections (%.2f%%) newly blocked, %d newly allowed",
+			status.NewBlocks, status.Connections, status.NewBlockPct, status.NewAllows)
+	}
+	return nil
+}
+
+// decideStagedRules promotes or drops the staged rules once their shadow
+// period is over and enough connections were compared.
+func (fw *Firewall) decideStagedRules() {
+	status, _ := fw.staged.Status()
+	if status.State != StagedRulesShadowing || fw.clock.Now().Before(status.DecideAt) {
+		return
+	}
+	if status.Connections < uint64(status.MinConnections) {
+		return
+	}
+
+	decision := StagedRulesPromoted
+	if status.NewBlockPct > status.Threshold {
+		decision = StagedRulesRolledBack
+	}
+	fw.staged.mutex.Lock()
+	fw.staged.status.Decision = fmt.Sprintf("%.2f%% newly blocked, limit %.2f%%", status.NewBlockPct, status.Threshold)
+	fw.staged.mutex.Unlock()
+
+	if err := fw.finishStagedRules(decision); err != nil {
+		fw.logErrorRateLimited("rules_staged", "RULES", "%v", err)
+	}
+}
+
+func (fw *Firewall) stagedRulesWatcher() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fw.decideStagedRules()
+	}
+}
+
+// handleStagedRules shows the staged revision's shadow results on GET,
+// stages the rules in the body on POST, and drops them on DELETE.
+func (fw *Firewall) handleStagedRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		status, exists := fw.staged.Status()
+		if !exists {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no rules have been staged"})
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+
+	case http.MethodPost:
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxStagedRulesSize))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "rules too large"})
+			return
+		}
+		status, err := fw.stageRules(data)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+
+	case http.MethodDelete:
+		if err := fw.finishStagedRules(StagedRulesCancelled); err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+		status, _ := fw.staged.Status()
+		writeJSON(w, http.StatusOK, status)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
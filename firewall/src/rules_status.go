@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRulesStatusFile = "/var/log/shared/firewall/status.json"
+
+	RulesStatusApplied  = "applied"
+	RulesStatusRejected = "rejected"
+)
+
+// RulesIssue is one problem found in rules.json. Field is the JSON path it
+// concerns, when known.
+type RulesIssue struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// RulesDiffSummary is what a reload changed compared to the rules before it.
+type RulesDiffSummary struct {
+	ChangedSections  []string `json:"changed_sections"`
+	BlockedAdded     []string `json:"blocked_ips_added,omitempty"`
+	BlockedRemoved   []string `json:"blocked_ips_removed,omitempty"`
+	WhitelistAdded   []string `json:"whitelist_added,omitempty"`
+	WhitelistRemoved []string `json:"whitelist_removed,omitempty"`
+}
+
+// RulesStatus is written to the shared volume after every reload of
+// rules.json, so the admin panel can tell whether an edit took effect.
+// Rejected reloads leave the previous rules, and AppliedRevision, in force.
+type RulesStatus struct {
+	UpdatedAt       time.Time         `json:"updated_at"`
+	Result          string            `json:"result"`
+	Revision        string            `json:"revision"`
+	AppliedRevision string            `json:"applied_revision"`
+	FileModTime     time.Time         `json:"file_mod_time"`
+	Errors          []RulesIssue      `json:"errors"`
+	Warnings        []RulesIssue      `json:"warnings"`
+	Diff            *RulesDiffSummary `json:"diff,omitempty"`
+}
+
+// RulesStatusWriter remembers the last status written, so a broken file the
+// watcher keeps rereading is only reported once.
+type RulesStatusWriter struct {
+	mutex   sync.Mutex
+	applied string
+	last    RulesStatus
+}
+
+func NewRulesStatusWriter() *RulesStatusWriter {
+	return &RulesStatusWriter{}
+}
+
+// parseIssue locates a rules.json decoding error.
+func parseIssue(data []byte, err error) RulesIssue {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	offset := int64(-1)
+	field := ""
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset, field = typeErr.Offset, typeErr.Field
+	}
+	if offset < 0 || offset > int64(len(data)) {
+		return RulesIssue{Field: field, Message: err.Error()}
+	}
+	line := bytes.Count(data[:offset], []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(data[:offset], '\n')
+	return RulesIssue{Field: field, Message: fmt.Sprintf("line %d, column %d: %v", line, column, err)}
+}
+
+func validIPEntry(entry string) bool {
+	entry = strings.TrimSpace(entry)
+	if _, isClass := addressClassNetworks(entry); isClass {
+		return true
+	}
+	if strings.Contains(entry, "/") {
+		_, _, err := net.ParseCIDR(entry)
+		return err == nil
+	}
+	return net.ParseIP(entry) != nil
+}
+
+// validateRules lists what normalizing rules (not yet normalized) will
+// ignore or replace with a default.
+func validateRules(rules *Rules) []RulesIssue {
+	var issues []RulesIssue
+	for field, entries := range map[string]RuleEntryList{"blocked_ips": rules.BlockedIPs, "whitelist": rules.Whitelist, "always_block": rules.AlwaysBlock, "exempt_from_rate_limit": rules.ExemptFromRateLimit} {
+		for i, entry := range entries.Entries() {
+			if strings.TrimSpace(entry) != "" && !validIPEntry(entry) {
+				issues = append(issues, RulesIssue{Field: fmt.Sprintf("%s[%d]", field, i), Message: fmt.Sprintf("%q is not an IP, CIDR or address class - ignored", entry)})
+			}
+		}
+	}
+	for g, group := range rules.RuleGroups {
+		for field, entries := range map[string]RuleEntryList{"whitelist": group.Whitelist, "blocked_ips": group.BlockedIPs, "always_block": group.AlwaysBlock} {
+			for i, entry := range entries.Entries() {
+				if strings.TrimSpace(entry) != "" && !validIPEntry(entry) {
+					issues = append(issues, RulesIssue{Field: fmt.Sprintf("rule_groups[%d].%s[%d]", g, field, i), Message: fmt.Sprintf("%q is not an IP, CIDR or address class - ignored", entry)})
+				}
+			}
+		}
+	}
+	for i, port := range rules.AllowedPorts {
+		if port <= 0 || port > 65535 {
+			issues = append(issues, RulesIssue{Field: fmt.Sprintf("allowed_ports[%d]", i), Message: fmt.Sprintf("%d is not a valid port", port)})
+		}
+	}
+	for field, value := range map[string]int{
+		"max_attempts_per_minute":   rules.MaxAttemptsPerMinute,
+		"max_attempts_per_hour":     rules.MaxAttemptsPerHour,
+		"auto_block_duration_hours": rules.AutoBlockDurationHours,
+	} {
+		if value < 0 {
+			issues = append(issues, RulesIssue{Field: field, Message: fmt.Sprintf("%d is negative - using the default", value)})
+		}
+	}
+	if prefix := rules.IPv4AggregationPrefix; prefix < 0 || prefix > 32 {
+		issues = append(issues, RulesIssue{Field: "ipv4_aggregation_prefix", Message: fmt.Sprintf("/%d is not an IPv4 prefix - using /%d", prefix, DefaultIPv4AggregationPrefix)})
+	}
+	if prefix := rules.IPv6AggregationPrefix; prefix < 0 || prefix > 128 {
+		issues = append(issues, RulesIssue{Field: "ipv6_aggregation_prefix", Message: fmt.Sprintf("/%d is not an IPv6 prefix - using /%d", prefix, DefaultIPv6AggregationPrefix)})
+	}
+	_, problems := buildLogRoutes(rules.Logging)
+	for _, problem := range problems {
+		issues = append(issues, RulesIssue{Field: "logging.categories", Message: "ignoring category " + problem})
+	}
+	_, problems = buildLogFilePolicy(rules.Logging.File)
+	for _, problem := range problems {
+		issues = append(issues, RulesIssue{Field: "logging.file", Message: problem + " - using the default"})
+	}
+	policies, problems := compilePolicies(rules.Policies)
+	for _, problem := range problems {
+		issues = append(issues, RulesIssue{Field: "policies", Message: problem + " - ignored"})
+	}
+	if hasBodyPolicies(policies) && !rules.BodyInspection.Enabled {
+		issues = append(issues, RulesIssue{Field: "body_inspection", Message: "policies read body, but body inspection is disabled - they never match"})
+	}
+	for _, problem := range middlewareProblems(rules.Middleware) {
+		issues = append(issues, RulesIssue{Field: "middleware", Message: problem + " - ignored"})
+	}
+	if rules.ExtAuthz.Enabled {
+		if parsed, err := url.Parse(rules.ExtAuthz.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			issues = append(issues, RulesIssue{Field: "ext_authz.url", Message: fmt.Sprintf("%q is not an http(s) URL - requests follow failure_mode", rules.ExtAuthz.URL)})
+		}
+	}
+	for _, problem := range regoProblems(rules.Rego) {
+		issues = append(issues, RulesIssue{Field: "rego", Message: problem})
+	}
+	for _, problem := range tenantProblems(rules.Tenants) {
+		issues = append(issues, RulesIssue{Field: "tenants", Message: problem})
+	}
+	for _, problem := range quotaProblems(rules.Quotas) {
+		issues = append(issues, RulesIssue{Field: "quotas", Message: problem})
+	}
+
+	sort.Slice(issues, func(i, j int) bool { return issues[i].Field < issues[j].Field })
+	return issues
+}
+
+func stringSetDiff(before, after []string) ([]string, []string) {
+	seen := make(map[string]bool, len(before))
+	for _, entry := range before {
+		seen[entry] = true
+	}
+	var added []string
+	for _, entry := range after {
+		if !seen[entry] {
+			added = append(added, entry)
+		}
+		delete(seen, entry)
+	}
+	removed := make([]string, 0, len(seen))
+	for entry := range seen {
+		removed = append(removed, entry)
+	}
+	sort.Strings(removed)
+	return added, removed
+}
+
+// diffRules summarizes the change from before to after, both normalized.
+func diffRules(before, after *Rules) *RulesDiffSummary {
+	diff := &RulesDiffSummary{ChangedSections: []string{}}
+	if before == nil {
+		return diff
+	}
+
+	sections := func(rules *Rules) map[string]json.RawMessage {
+		var fields map[string]json.RawMessage
+		data, _ := json.Marshal(rules)
+		json.Unmarshal(data, &fields)
+		return fields
+	}
+	old, updated := sections(before), sections(after)
+	for name, value := range updated {
+		if !bytes.Equal(old[name], value) {
+			diff.ChangedSections = append(diff.ChangedSections, name)
+		}
+	}
+	sort.Strings(diff.ChangedSections)
+
+	diff.BlockedAdded, diff.BlockedRemoved = stringSetDiff(before.BlockedIPs.Entries(), after.BlockedIPs.Entries())
+	diff.WhitelistAdded, diff.WhitelistRemoved = stringSetDiff(before.Whitelist.Entries(), after.Whitelist.Entries())
+	return diff
+}
+
+// writeRulesStatus records the outcome of a reload to rulesStatusFile.
+func (fw *Firewall) writeRulesStatus(status RulesStatus) {
+	if fw.rulesStatusFile == "" {
+		return
+	}
+
+	fw.rulesStatus.mutex.Lock()
+	defer fw.rulesStatus.mutex.Unlock()
+
+	if status.Result == RulesStatusApplied {
+		fw.rulesStatus.applied = status.Revision
+	}
+	last := fw.rulesStatus.last
+	if status.Result == RulesStatusRejected && last.Result == RulesStatusRejected &&
+		last.FileModTime.Equal(status.FileModTime) && last.Revision == status.Revision {
+		return
+	}
+	status.UpdatedAt = time.Now()
+	status.AppliedRevision = fw.rulesStatus.applied
+	if status.Errors == nil {
+		status.Errors = []RulesIssue{}
+	}
+	if status.Warnings == nil {
+		status.Warnings = []RulesIssue{}
+	}
+	fw.rulesStatus.last = status
+
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(fw.rulesStatusFile, data, 0644)
+	}
+	if err != nil {
+		fw.logErrorRateLimited("rules_status", "RULES", "Failed to write %s: %v", fw.rulesStatusFile, err)
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultReportsDirectory = "/var/log/shared/firewall/reports"
+
+	ReportPeriodDaily  = "daily"
+	ReportPeriodWeekly = "weekly"
+
+	ReportTopSize      = 10
+	ReportBusiestHours = 5
+)
+
+// ScheduledReportsConfig writes a security summary for every finished day
+// and/or week (Monday to Monday, local time) to Directory as
+// <period>-<start date>.json and .html. Each report is also POSTed as JSON to
+// WebhookURL and mailed as HTML to EmailTo through the SMTP server in
+// SMTP_ADDR (host:port, with SMTP_USER and SMTP_PASSWORD when it needs
+// them), when those are set. Counts are kept in memory, so the first report
+// after a restart only covers the part of its period since then.
+type ScheduledReportsConfig struct {
+	Daily      bool     `json:"daily"`
+	Weekly     bool     `json:"weekly"`
+	Directory  string   `json:"directory"`
+	WebhookURL string   `json:"webhook_url"`
+	EmailTo    []string `json:"email_to"`
+	EmailFrom  string   `json:"email_from"`
+}
+
+func normalizeScheduledReportsConfig(config ScheduledReportsConfig) ScheduledReportsConfig {
+	if config.Directory == "" {
+		config.Directory = DefaultReportsDirectory
+	}
+	if config.EmailFrom == "" {
+		config.EmailFrom = "firewall@localhost"
+	}
+	return config
+}
+
+func (fw *Firewall) scheduledReportsConfig() ScheduledReportsConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.ScheduledReports
+}
+
+// periodStart returns the start of the day or week now falls in.
+func periodStart(period string, now time.Time) time.Time {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if period == ReportPeriodWeekly {
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return day
+}
+
+func periodEnd(period string, start time.Time) time.Time {
+	if period == ReportPeriodWeekly {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+type hourCounts struct {
+	connections uint64
+	blocked     uint64
+}
+
+// periodStats counts one day's or week's traffic.
+type periodStats struct {
+	period         string
+	start          time.Time
+	end            time.Time
+	since          time.Time
+	connections    uint64
+	blocked        uint64
+	clients        map[string]uint64
+	blockedClients map[string]uint64
+	reasons        map[string]uint64
+	hours          map[time.Time]*hourCounts
+}
+
+func newPeriodStats(period string, now time.Time) *periodStats {
+	start := periodStart(period, now)
+	return &periodStats{
+		period:         period,
+		start:          start,
+		end:            periodEnd(period, start),
+		since:          now,
+		clients:        make(map[string]uint64),
+		blockedClients: make(map[string]uint64),
+		reasons:        make(map[string]uint64),
+		hours:          make(map[time.Time]*hourCounts),
+	}
+}
+
+func (ps *periodStats) hour(now time.Time) *hourCounts {
+	hour := now.Truncate(time.Hour)
+	counts, exists := ps.hours[hour]
+	if !exists {
+		counts = &hourCounts{}
+		ps.hours[hour] = counts
+	}
+	return counts
+}
+
+// ReportPeriods feeds the daily and weekly counts and keeps finished periods
+// until their reports are written.
+type ReportPeriods struct {
+	mutex    sync.Mutex
+	current  map[string]*periodStats
+	finished []*periodStats
+}
+
+func NewReportPeriods() *ReportPeriods {
+	return &ReportPeriods{current: make(map[string]*periodStats)}
+}
+
+// periodsLocked returns the current periods at now, setting finished ones
+// aside. Callers hold mutex.
+func (rp *ReportPeriods) periodsLocked(now time.Time) []*periodStats {
+	periods := make([]*periodStats, 0, 2)
+	for _, period := range []string{ReportPeriodDaily, ReportPeriodWeekly} {
+		stats, exists := rp.current[period]
+		if exists && !now.Before(stats.end) {
+			rp.finished = append(rp.finished, stats)
+			exists = false
+		}
+		if !exists {
+			stats = newPeriodStats(period, now)
+			rp.current[period] = stats
+		}
+		periods = append(periods, stats)
+	}
+	return periods
+}
+
+func (rp *ReportPeriods) RecordConnection(ip string, now time.Time) {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+
+	for _, stats := range rp.periodsLocked(now) {
+		stats.connections++
+		stats.hour(now).connections++
+		incrementBounded(stats.clients, ip)
+	}
+}
+
+func (rp *ReportPeriods) RecordBlock(ip, reason string, now time.Time) {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+
+	for _, stats := range rp.periodsLocked(now) {
+		stats.blocked++
+		stats.hour(now).blocked++
+		incrementBounded(stats.blockedClients, ip)
+		stats.reasons[reason]++
+	}
+}
+
+// Finished returns the periods that ended by now and forgets them.
+func (rp *ReportPeriods) Finished(now time.Time) []*periodStats {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+
+	rp.periodsLocked(now)
+	finished := rp.finished
+	rp.finished = nil
+	return finished
+}
+
+// HourCount is one hour of a report's period.
+type HourCount struct {
+	Hour        time.Time `json:"hour"`
+	Connections uint64    `json:"connections"`
+	Blocked     uint64    `json:"blocked"`
+}
+
+// SecurityReport is a finished period's summary. UniqueClients stops
+// growing at MaxTrackedIPs.
+type SecurityReport struct {
+	Period               string       `json:"period"`
+	Start                time.Time    `json:"start"`
+	End                  time.Time    `json:"end"`
+	CountedSince         time.Time    `json:"counted_since"`
+	Connections          uint64       `json:"connections"`
+	Blocked              uint64       `json:"blocked"`
+	UniqueClients        int          `json:"unique_clients"`
+	UniqueBlockedClients int          `json:"unique_blocked_clients"`
+	BlocksByReason       []CountEntry `json:"blocks_by_reason"`
+	TopBlockedClients    []CountEntry `json:"top_blocked_clients"`
+	TopCountries         []CountEntry `json:"top_countries"`
+	TopASNs              []CountEntry `json:"top_asns"`
+	BusiestHours         []HourCount  `json:"busiest_hours"`
+}
+
+// buildSecurityReport summarizes stats, locating clients with whichever
+// GeoIP databases are loaded.
+func (fw *Firewall) buildSecurityReport(stats *periodStats) SecurityReport {
+	report := SecurityReport{
+		Period:               stats.period,
+		Start:                stats.start,
+		End:                  stats.end,
+		CountedSince:         stats.since,
+		Connections:          stats.connections,
+		Blocked:              stats.blocked,
+		UniqueClients:        len(stats.clients),
+		UniqueBlockedClients: len(stats.blockedClients),
+		BlocksByReason:       topEntries(stats.reasons, 0),
+		TopBlockedClients:    topEntries(stats.blockedClients, ReportTopSize),
+	}
+	if report.CountedSince.Before(report.Start) {
+		report.CountedSince = report.Start
+	}
+
+	countries := make(map[string]uint64)
+	asns := make(map[string]uint64)
+	for ip, count := range stats.clients {
+		if country := fw.lookupCountry(ip); country != "" {
+			countries[country] += count
+		}
+		if asn, org, found := fw.lookupASN(ip); found {
+			asns[formatASN(asn, org)] += count
+		}
+	}
+	report.TopCountries = topEntries(countries, ReportTopSize)
+	report.TopASNs = topEntries(asns, ReportTopSize)
+
+	hours := make([]HourCount, 0, len(stats.hours))
+	for hour, counts := range stats.hours {
+		hours = append(hours, HourCount{Hour: hour, Connections: counts.connections, Blocked: counts.blocked})
+	}
+	sort.Slice(hours, func(i, j int) bool {
+		if hours[i].Connections != hours[j].Connections {
+			return hours[i].Connections > hours[j].Connections
+		}
+		return hours[i].Hour.Before(hours[j].Hour)
+	})
+	if len(hours) > ReportBusiestHours {
+		hours = hours[:ReportBusiestHours]
+	}
+	report.BusiestHours = hours
+	return report
+}
+
+func (report SecurityReport) Title() string {
+	title := "DockerChat firewall " + report.Period + " report for " + report.Start.Format("2006-01-02")
+	if report.Period == ReportPeriodWeekly {
+		title = "DockerChat firewall weekly report for " + report.Start.Format("2006-01-02") + " to " + report.End.AddDate(0, 0, -1).Format("2006-01-02")
+	}
+	return title
+}
+
+var securityReportTemplate = template.Must(template.New("security-report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", sans-serif; background: #1e1f22; color: #dbdee1; margin: 2em; }
+h1 { color: #8775e9; }
+h2 { border-bottom: 1px solid #3f4147; padding-bottom: .3em; }
+.cards { display: flex; gap: 1em; flex-wrap: wrap; }
+.card { background: #2b2d31; padding: 1em 1.5em; border-radius: 8px; min-width: 10em; }
+.card b { display: block; font-size: 1.6em; color: #fff; }
+table { border-collapse: collapse; min-width: 24em; }
+td, th { padding: .3em 1em; text-align: left; border-bottom: 1px solid #3f4147; }
+td.n { text-align: right; font-variant-numeric: tabular-nums; }
+.grid { display: flex; gap: 3em; flex-wrap: wrap; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Start.Format "2006-01-02 15:04"}} to {{.End.Format "2006-01-02 15:04"}}{{if .CountedSince.After .Start}} &middot; counted since {{.CountedSince.Format "2006-01-02 15:04"}}{{end}}</p>
+<div class="cards">
+<div class="card">Connections<b>{{.Connections}}</b></div>
+<div class="card">Blocked<b>{{.Blocked}}</b></div>
+<div class="card">Unique clients<b>{{.UniqueClients}}</b></div>
+<div class="card">Unique blocked clients<b>{{.UniqueBlockedClients}}</b></div>
+</div>
+
+<div class="grid">
+<div>
+<h2>Blocks by reason</h2>
+<table><tr><th>Reason</th><th>Count</th></tr>
+{{range .BlocksByReason}}<tr><td>{{.Key}}</td><td class="n">{{.Count}}</td></tr>
+{{else}}<tr><td colspan="2">Nothing blocked</td></tr>
+{{end}}</table>
+</div>
+<div>
+<h2>Top blocked clients</h2>
+<table><tr><th>IP</th><th>Blocks</th></tr>
+{{range .TopBlockedClients}}<tr><td>{{.Key}}</td><td class="n">{{.Count}}</td></tr>
+{{else}}<tr><td colspan="2">Nothing blocked</td></tr>
+{{end}}</table>
+</div>
+<div>
+<h2>Top countries</h2>
+<table><tr><th>Country</th><th>Connections</th></tr>
+{{range .TopCountries}}<tr><td>{{.Key}}</td><td class="n">{{.Count}}</td></tr>
+{{else}}<tr><td colspan="2">No country database loaded</td></tr>
+{{end}}</table>
+</div>
+<div>
+<h2>Top networks</h2>
+<table><tr><th>ASN</th><th>Connections</th></tr>
+{{range .TopASNs}}<tr><td>{{.Key}}</td><td class="n">{{.Count}}</td></tr>
+{{else}}<tr><td colspan="2">No ASN database loaded</td></tr>
+{{end}}</table>
+</div>
+<div>
+<h2>Busiest hours</h2>
+<table><tr><th>Hour</th><th>Connections</th><th>Blocked</th></tr>
+{{range .BusiestHours}}<tr><td>{{.Hour.Format "2006-01-02 15:00"}}</td><td class="n">{{.Connections}}</td><td class="n">{{.Blocked}}</td></tr>
+{{else}}<tr><td colspan="3">No traffic</td></tr>
+{{end}}</table>
+</div>
+</div>
+</body>
+</html>
+`))
+
+// writeSecurityReport saves report as JSON and HTML and returns both.
+func writeSecurityReport(directory string, report SecurityReport) ([]byte, []byte, error) {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	var page bytes.Buffer
+	if err := securityReportTemplate.Execute(&page, report); err != nil {
+		return nil, nil, err
+	}
+
+	base := filepath.Join(directory, report.Period+"-"+report.Start.Format("2006-01-02"))
+	if err := writeFileAtomic(base+".json", data, 0644); err != nil {
+		return nil, nil, err
+	}
+	if err := writeFileAtomic(base+".html", page.Bytes(), 0644); err != nil {
+		return nil, nil, err
+	}
+	return data, page.Bytes(), nil
+}
+
+// postReportWebhook sends the JSON report. Errors never include the URL,
+// which may carry a token.
+func postReportWebhook(url string, data []byte) error {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(os.ExpandEnv(url), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("webhook request failed")
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+func mailReport(config ScheduledReportsConfig, subject string, page []byte) error {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return fmt.Errorf("SMTP_ADDR is not set")
+	}
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		host, _, _ := strings.Cut(addr, ":")
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\nTo: %s\r\nSubject: %s\r\n", config.EmailFrom, strings.Join(config.EmailTo, ", "), subject)
+	message.WriteString("MIME-Version: 1.0\r\nContent-Type: text/html; charset=utf-8\r\n\r\n")
+	message.Write(page)
+	return smtp.SendMail(addr, auth, config.EmailFrom, config.EmailTo, message.Bytes())
+}
+
+// publishScheduledReports writes, posts and mails the reports of every period
+// that has ended.
+func (fw *Firewall) publishScheduledReports(config ScheduledReportsConfig) {
+	for _, stats := range fw.reportPeriods.Finished(fw.clock.Now()) {
+		if (stats.period == ReportPeriodDaily && !config.Daily) || (stats.period == ReportPeriodWeekly && !config.Weekly) {
+			continue
+		}
+		report := fw.buildSecurityReport(stats)
+		data, page, err := writeSecurityReport(config.Directory, report)
+		if err != nil {
+			fw.logErrorRateLimited("scheduled_report", "REPORT", "Failed to write %s report: %v", report.Period, err)
+			continue
+		}
+		fw.logger.LogInfo("REPORT", "%s written to %s - %d connections, %d blocked, %d unique clients",
+			report.Title(), config.Directory, report.Connections, report.Blocked, report.UniqueClients)
+
+		if config.WebhookURL != "" {
+			if err := postReportWebhook(config.WebhookURL, data); err != nil {
+				fw.logger.LogError("REPORT", "Failed to deliver %s report: %v", report.Period, err)
+			}
+		}
+		if len(config.EmailTo) > 0 {
+			if err := mailReport(config, report.Title(), page); err != nil {
+				fw.logger.LogError("REPORT", "Failed to mail %s report: %v", report.Period, err)
+			}
+		}
+	}
+}
+
+func (fw *Firewall) scheduledReportsWatcher() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fw.shutdown:
+			return
+		case <-ticker.C:
+		}
+		fw.publishScheduledReports(fw.scheduledReportsConfig())
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// SecurityHeaders are added to every HTTP response sent to clients, the
+// upstream's and the firewall's own error pages alike. Headers the upstream
+// already set are kept unless Override is on. An empty value drops one of the
+// defaults.
+type SecurityHeaders struct {
+	Enabled  bool              `json:"enabled"`
+	Headers  map[string]string `json:"headers"`
+	Override bool              `json:"override"`
+}
+
+var defaultSecurityHeaders = map[string]string{
+	"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+	"X-Content-Type-Options":    "nosniff",
+	"X-Frame-Options":           "SAMEORIGIN",
+}
+
+func normalizeSecurityHeaders(sh SecurityHeaders) SecurityHeaders {
+	headers := make(map[string]string, len(defaultSecurityHeaders)+len(sh.Headers))
+	for name, value := range defaultSecurityHeaders {
+		headers[name] = value
+	}
+	for name, value := range sh.Headers {
+		headers[http.CanonicalHeaderKey(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	for name, value := range headers {
+		if value == "" {
+			delete(headers, name)
+		}
+	}
+	sh.Headers = headers
+	return sh
+}
+
+// Names returns the configured header names in a stable order.
+func (sh SecurityHeaders) Names() []string {
+	names := make([]string, 0, len(sh.Headers))
+	for name := range sh.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (fw *Firewall) securityHeaders() SecurityHeaders {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.SecurityHeaders
+}
+
+// injectSecurityHeaders adds the configured headers to a final upstream
+// response head. Interim responses and non-HTTP traffic are left alone.
+func injectSecurityHeaders(sh SecurityHeaders, head *messageHead, status int) {
+	if status < 200 {
+		return
+	}
+	for _, name := range sh.Names() {
+		if _, exists := head.Header[name]; exists && !sh.Override {
+			continue
+		}
+		head.Set(name, sh.Headers[name])
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// Semaphore is a weighted semaphore. Waiters are served in arrival order, and
+// TryAcquire doesn't jump ahead of them, so a queued connection isn't
+// overtaken by ones that arrive after it.
+type Semaphore struct {
+	mutex   sync.Mutex
+	size    int64
+	used    int64
+	waiters list.List
+}
+
+type semaphoreWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+func NewSemaphore(size int64) *Semaphore {
+	return &Semaphore{size: size}
+}
+
+func (s *Semaphore) TryAcquire(n int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.size-s.used >= n && s.waiters.Len() == 0 {
+		s.used += n
+		return true
+	}
+	return false
+}
+
+// Acquire waits for n to be free or ctx to end, in which case it returns
+// ctx's error and acquires nothing.
+func (s *Semaphore) Acquire(ctx context.Context, n int64) error {
+	s.mutex.Lock()
+	if s.size-s.used >= n && s.waiters.Len() == 0 {
+		s.used += n
+		s.mutex.Unlock()
+		return nil
+	}
+	if n > s.size {
+		s.mutex.Unlock()
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	waiter := &semaphoreWaiter{n: n, ready: make(chan struct{})}
+	element := s.waiters.PushBack(waiter)
+	s.mutex.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-waiter.ready:
+		// Granted just as ctx ended; give it back.
+		s.used -= n
+	default:
+		s.waiters.Remove(element)
+	}
+	// Either way the front of the queue may now fit.
+	s.notifyWaiters()
+	return ctx.Err()
+}
+
+func (s *Semaphore) Release(n int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.used -= n
+	if s.used < 0 {
+		panic("semaphore released more than held")
+	}
+	s.notifyWaiters()
+}
+
+func (s *Semaphore) notifyWaiters() {
+	for {
+		front := s.waiters.Front()
+		if front == nil {
+			return
+		}
+		waiter := front.Value.(*semaphoreWaiter)
+		if s.size-s.used < waiter.n {
+			return
+		}
+		s.used += waiter.n
+		s.waiters.Remove(front)
+		close(waiter.ready)
+	}
+}
+
+// Usage returns how much of the semaphore is held, and its size.
+func (s *Semaphore) Usage() (int64, int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.used, s.size
+}
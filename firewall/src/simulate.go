@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	SimulationAllow = "allow"
+	SimulationBlock = "block"
+)
+
+// SimulationRequest describes a hypothetical client request. Port is the
+// firewall port the client connects to (defaulting to FIREWALL_PORT); the
+// port checked against allowed_ports is resolved from it and the Host header
+// exactly as for live traffic; in tproxy and redirect ingress modes it is
+// the destination port itself. At evaluates the time windows as of another moment, e.g. to
+// check whether an auto-block will have expired by then.
+type SimulationRequest struct {
+	IP      string            `json:"ip"`
+	Port    int               `json:"port"`
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	At      *time.Time        `json:"at"`
+}
+
+type SimulationCheck struct {
+	Check  string `json:"check"`
+	Result string `json:"result"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// SimulationResult is the verdict the request would get. Reason matches the
+// connection log's block reasons and Status is the HTTP status the client
+// would see (0 when the connection would just be closed).
+type SimulationResult struct {
+	Verdict       string            `json:"verdict"`
+	Reason        string            `json:"reason,omitempty"`
+	Rule          string            `json:"rule,omitempty"`
+	Status        int               `json:"status,omitempty"`
+	RequestedPort int               `json:"requested_port,omitempty"`
+	Upstream      string            `json:"upstream,omitempty"`
+	Canary        bool              `json:"canary,omitempty"`
+	Tenant        string            `json:"tenant,omitempty"`
+	Checks        []SimulationCheck `json:"checks"`
+}
+
+func (sr *SimulationResult) pass(check, detail string, args ...interface{}) {
+	sr.Checks = append(sr.Checks, SimulationCheck{Check: check, Result: "pass", Detail: fmt.Sprintf(detail, args...)})
+}
+
+func (sr *SimulationResult) skip(check, detail string) {
+	sr.Checks = append(sr.Checks, SimulationCheck{Check: check, Result: "skipped", Detail: detail})
+}
+
+func (sr *SimulationResult) block(check, reason, rule string, status int) *SimulationResult {
+	sr.Checks = append(sr.Checks, SimulationCheck{Check: check, Result: "block", Detail: rule})
+	sr.Verdict = SimulationBlock
+	sr.Reason = reason
+	sr.Rule = rule
+	sr.Status = status
+	return sr
+}
+
+func countSince(attempts []time.Time, window time.Duration, now time.Time) int {
+	count := 0
+	for _, attempt := range attempts {
+		if now.Sub(attempt) < window {
+			count++
+		}
+	}
+	return count
+}
+
+// simulate runs req through the same checks, in the same order, as
+// handleConnection, reading the rate-limit counters without recording
+// anything, so results reflect current traffic but don't change it.
+func (fw *Firewall) simulate(req SimulationRequest) *SimulationResult {
+	now := fw.clock.Now()
+	if req.At != nil {
+		now = *req.At
+	}
+	ip := net.ParseIP(req.IP).String()
+	key := fw.aggregationKey(ip)
+	result := &SimulationResult{Verdict: SimulationAllow}
+
+	blockedStatus := func(status int) int {
+		if fw.errorPagesConfig().RespondToBlocked {
+			return status
+		}
+		return 0
+	}
+
+	var challenge string
+
+	decision := fw.decidePrecedence(ip, key, now)
+	whitelisted := decision.Rule == RuleWhitelist
+	if decision.Block {
+		return result.block("precedence", decision.BlockReason(), decision.Rule+": "+decision.Entry, blockedStatus(http.StatusForbidden))
+	}
+	if whitelisted {
+		result.Reason = "WHITELIST"
+		result.Rule = "whitelist: " + decision.Entry
+		result.pass("precedence", "matched %s", decision)
+	} else {
+		result.pass("precedence", "no match in %s", strings.Join(decision.Order, " > "))
+
+		if fw.allowlistOnly() {
+			return result.block("allowlist_only", "NOT_ALLOWLISTED", "allowlist_only", blockedStatus(http.StatusForbidden))
+		}
+
+		fw.synFloodMutex.RLock()
+		synAttempts := countSince(fw.synFloodTracker[key], SynFloodWindow, now) + 1
+		activeConns := fw.activeConnsByIP[ip]
+		fw.synFloodMutex.RUnlock()
+
+		if synAttempts > MaxSynPerWindow*2 {
+			return result.block("syn_flood", "SYN_FLOOD", fmt.Sprintf("%d connections in %v (limit %d)", synAttempts, SynFloodWindow, MaxSynPerWindow*2), 0)
+		}
+		result.pass("syn_flood", "%d/%d connections in %v", synAttempts, MaxSynPerWindow*2, SynFloodWindow)
+
+		if activeConns >= MaxConnectionsPerIP {
+			return result.block("active_connections", "TOO_MANY_CONNECTIONS", fmt.Sprintf("%d active connections (limit %d)", activeConns, MaxConnectionsPerIP), 0)
+		}
+		result.pass("active_connections", "%d/%d", activeConns, MaxConnectionsPerIP)
+
+		if asn, org, blocked := fw.isBlockedASN(ip); blocked {
+			return result.block("blocked_asns", "BLOCKED_ASN", "blocked_asns: "+formatASN(asn, org), blockedStatus(http.StatusForbidden))
+		}
+		if asn, org, found := fw.lookupASN(ip); found {
+			result.pass("blocked_asns", "%s not blocked", formatASN(asn, org))
+		} else {
+			result.pass("blocked_asns", "no ASN known")
+		}
+
+		countries := fw.countryPolicy()
+		country := ""
+		if !countries.Enabled {
+			result.skip("countries", "disabled")
+		} else {
+			country = fw.lookupCountry(ip)
+			if !countries.Admits(country) {
+				return result.block("countries", "COUNTRY_DENIED", fmt.Sprintf("countries: %q not admitted", country), blockedStatus(http.StatusForbidden))
+			}
+			result.pass("countries", "%q admitted", country)
+		}
+
+		if list, entry, found := fw.matchIPList(ip); found {
+			if list.Action == IPListActionBlock {
+				return result.block("ip_lists", "LISTED_IP", fmt.Sprintf("ip_lists %s: %s", list.Name, entry), blockedStatus(http.StatusForbidden))
+			}
+			if list.Action == IPListActionChallenge {
+				challenge = "ip_lists " + list.Name
+			}
+			result.pass("ip_lists", "on the %s list (%s), action %s", list.Name, entry, list.Action)
+		} else {
+			result.pass("ip_lists", "not listed")
+		}
+
+		if config := fw.dnsblConfig(); !config.Enabled {
+			result.skip("dnsbl", "disabled")
+		} else if answer, known := fw.dnsbl.Cached(ip, now); !known {
+			result.pass("dnsbl", "not looked up yet")
+		} else if !answer.Listed {
+			result.pass("dnsbl", "not listed")
+		} else if config.Action == DNSBLActionBlock {
+			return result.block("dnsbl", "DNSBL", fmt.Sprintf("dnsbl: listed in %s (%s)", answer.Zone, answer.Answer), blockedStatus(http.StatusForbidden))
+		} else {
+			if config.Action == DNSBLActionChallenge && challenge == "" {
+				challenge = "dnsbl " + answer.Zone
+			}
+			result.pass("dnsbl", "listed in %s (%s), action %s", answer.Zone, answer.Answer, config.Action)
+		}
+
+		if hostname := fw.cachedHostname(ip); hostname == "" {
+			result.pass("reverse_dns", "no hostname known")
+		} else if suffix, denied := fw.ptrDenied(hostname); denied {
+			return result.block("reverse_dns", "PTR_DENY", fmt.Sprintf("reverse_dns deny_suffixes %s: %s", suffix, hostname), blockedStatus(http.StatusForbidden))
+		} else {
+			result.pass("reverse_dns", "%s", hostname)
+		}
+
+		if config := fw.riskScoring(); !config.Enabled {
+			result.skip("risk_score", "disabled")
+		} else {
+			score := fw.riskScores.Score(key, now, config.halfLife())
+			if score >= config.BlockScore {
+				return result.block("risk_score", "RISK_SCORE", fmt.Sprintf("risk score %.1f/%.0f", score, config.BlockScore), blockedStatus(http.StatusForbidden))
+			}
+			if score >= config.ChallengeScore && challenge == "" {
+				challenge = fmt.Sprintf("risk score %.0f", score)
+			}
+			result.pass("risk_score", "%.1f (challenge at %.0f, throttle at %.0f, block at %.0f)", score, config.ChallengeScore, config.ThrottleScore, config.BlockScore)
+		}
+
+		fw.attemptsMutex.RLock()
+		attempts := countSince(fw.connectionAttempts[key], time.Minute, now) + 1
+		fw.attemptsMutex.RUnlock()
+		attempts += fw.remoteAttempts(key)
+
+		limit := fw.perMinuteLimit(key)
+		if attempts > limit {
+			return result.block("rate_limit", "RATE_LIMIT", fmt.Sprintf("%d/%d connections per minute from %s", attempts, limit, key), blockedStatus(http.StatusTooManyRequests))
+		}
+		result.pass("rate_limit", "%d/%d connections per minute from %s", attempts, limit, key)
+
+		if budget := countries.Budget(country); countries.Enabled && country != "" && budget > 0 {
+			count := fw.countries.Count(country, now) + 1
+			if count > budget {
+				return result.block("country_budget", "COUNTRY_BUDGET", fmt.Sprintf("countries budget for %s: %d/%d connections per minute", country, count, budget), blockedStatus(http.StatusServiceUnavailable))
+			}
+			result.pass("country_budget", "%s: %d/%d connections per minute", country, count, budget)
+		}
+	}
+
+	halfOpen := fw.halfOpenLimits()
+	total, fromIP := fw.halfOpen.Counts(ip)
+	if total >= halfOpen.MaxTotal {
+		return result.block("half_open", "HALF_OPEN_LIMIT", fmt.Sprintf("%d connections awaiting their request (limit %d)", total, halfOpen.MaxTotal), 0)
+	}
+	if !whitelisted && fromIP >= halfOpen.MaxPerIP {
+		return result.block("half_open", "HALF_OPEN_LIMIT", fmt.Sprintf("%d connections from %s awaiting their request (limit %d)", fromIP, ip, halfOpen.MaxPerIP), 0)
+	}
+	result.pass("half_open", "%d/%d from %s, %d/%d in all", fromIP, halfOpen.MaxPerIP, ip, total, halfOpen.MaxTotal)
+
+	head := &RequestHead{
+		Method: req.Method,
+		Target: req.Path,
+		Proto:  "HTTP/1.1",
+		Header: make(http.Header),
+	}
+	for name, value := range req.Headers {
+		head.Header.Add(name, value)
+	}
+
+	if signatures := fw.protocolSignatures(); signatures != nil {
+		signature, ok := matchProtocolSignature([]byte(head.Method+" "), signatures)
+		if !ok {
+			return result.block("protocol_allowlist", "PROTOCOL_NOT_ALLOWED", fmt.Sprintf("method %q matches no protocol_allowlist signature", head.Method), 0)
+		}
+		result.pass("protocol_allowlist", "matches %s", signature.Name)
+	}
+
+	intercepted := fw.ingressMode != IngressModeProxy && req.Port != fw.firewallPort
+	if intercepted {
+		result.RequestedPort = req.Port
+	} else {
+		result.RequestedPort = fw.portStrategyFor(req.Port).Resolve(req.Port, head.Host())
+	}
+
+	tenant := fw.tenantFor(head.Host())
+	if tenant != nil {
+		result.Tenant = tenant.Name
+	}
+
+	if whitelisted {
+		result.skip("allowed_ports", "whitelisted")
+		result.skip("host", "whitelisted")
+		result.skip("tenant", "whitelisted")
+		result.skip("challenge", "whitelisted")
+		result.skip("endpoint_rate_limit", "whitelisted")
+	} else {
+		if !fw.isAllowedPort(result.RequestedPort) {
+			return result.block("allowed_ports", "BLOCKED_PORT", fmt.Sprintf("port %d not in allowed_ports", result.RequestedPort), http.StatusForbidden)
+		}
+		result.pass("allowed_ports", "port %d", result.RequestedPort)
+
+		if status, reason := validateHost(head, fw.allowedHosts()); status != 0 {
+			return result.block("host", "INVALID_HOST", reason, status)
+		}
+		result.pass("host", "%s", head.Host())
+
+		if tenant == nil {
+			result.pass("tenant", "no tenant serves %s", head.Host())
+		} else if tenant.whitelist.Contains(ip) {
+			result.skip("tenant", "whitelisted by tenant "+tenant.Name)
+		} else {
+			if rule, blocked := tenant.blockedIPs.MatchRule(ip); blocked {
+				return result.block("tenant", "TENANT_BLOCKED", fmt.Sprintf("tenant %s blocks %s", tenant.Name, rule), http.StatusForbidden)
+			}
+			country := fw.lookupCountry(ip)
+			for _, blocked := range tenant.BlockedCountries {
+				if country != "" && country == blocked {
+					return result.block("tenant", "TENANT_BLOCKED", fmt.Sprintf("tenant %s blocks country %s", tenant.Name, country), http.StatusForbidden)
+				}
+			}
+			if tenant.MaxAttemptsPerMinute > 0 {
+				maxAttempts := fw.adaptive.Scale(tenant.MaxAttemptsPerMinute)
+				fw.attemptsMutex.RLock()
+				attempts := countSince(fw.endpointAttempts[key+"|tenant:"+tenant.Name], time.Minute, now) + 1
+				fw.attemptsMutex.RUnlock()
+				if attempts > maxAttempts {
+					return result.block("tenant", "TENANT_RATE_LIMIT", fmt.Sprintf("tenant %s: %d/%d per minute", tenant.Name, attempts, maxAttempts), http.StatusTooManyRequests)
+				}
+			}
+			result.pass("tenant", "%s", tenant.Name)
+		}
+
+		if challenge != "" {
+			if !fw.challengePassed(head, key) {
+				return result.block("challenge", "CHALLENGED", fmt.Sprintf("%s: no valid %s cookie", challenge, ChallengeCookieName), http.StatusServiceUnavailable)
+			}
+			result.pass("challenge", "valid %s cookie", ChallengeCookieName)
+		}
+
+		fw.rulesMutex.RLock()
+		limit, found := matchEndpointRateLimit(fw.rules.EndpointRateLimits, normalizeRequestPath(head.Path()))
+		fw.rulesMutex.RUnlock()
+
+		if found {
+			maxAttempts := fw.adaptive.Scale(limit.MaxAttemptsPerMinute)
+			fw.attemptsMutex.RLock()
+			attempts := countSince(fw.endpointAttempts[key+"|"+limit.PathPrefix], time.Minute, now) + 1
+			fw.attemptsMutex.RUnlock()
+
+			if attempts > maxAttempts {
+				return result.block("endpoint_rate_limit", "ENDPOINT_RATE_LIMIT", fmt.Sprintf("endpoint_rate_limits %s: %d/%d per minute", limit.PathPrefix, attempts, maxAttempts), http.StatusTooManyRequests)
+			}
+			result.pass("endpoint_rate_limit", "%s: %d/%d per minute", limit.PathPrefix, attempts, maxAttempts)
+		} else {
+			result.pass("endpoint_rate_limit", "no matching endpoint")
+		}
+
+		protocol := classifyProtocol(head)
+		if limit, found := fw.protocolRateLimit(protocol); found {
+			maxAttempts := fw.adaptive.Scale(limit.MaxAttemptsPerMinute)
+			fw.attemptsMutex.RLock()
+			attempts := countSince(fw.endpointAttempts[protocolBucket(key, protocol)], time.Minute, now) + 1
+			fw.attemptsMutex.RUnlock()
+
+			if attempts > maxAttempts {
+				return result.block("protocol_rate_limit", "PROTOCOL_RATE_LIMIT", fmt.Sprintf("protocol_rate_limits %s: %d/%d per minute", protocol, attempts, maxAttempts), http.StatusTooManyRequests)
+			}
+			result.pass("protocol_rate_limit", "%s: %d/%d per minute", protocol, attempts, maxAttempts)
+		} else {
+			result.pass("protocol_rate_limit", "no limit for %s", protocol)
+		}
+	}
+
+	if direction, exceeded := fw.transferQuotaExceeded(key); exceeded {
+		if direction == TransferIn {
+			return result.block("transfer_quota", "INGRESS_QUOTA", "daily_ingress_quota_bytes exhausted", http.StatusTooManyRequests)
+		}
+		return result.block("transfer_quota", "EGRESS_QUOTA", "daily_egress_quota_bytes exhausted", http.StatusTooManyRequests)
+	}
+	in, out := fw.transfers.Used(key, fw.clock.Now())
+	result.pass("transfer_quota", "%d bytes in, %d bytes out today", in, out)
+
+	if intercepted && fw.ingressMode == IngressModeTProxy {
+		result.Upstream = "original destination"
+		return result
+	}
+	upstream, canary := fw.selectUpstream(ip, head, tenant)
+	result.Upstream = upstream.Addr()
+	result.Canary = canary
+	return result
+}
+
+// handleSimulate answers "would this request be allowed?" for a JSON
+// SimulationRequest without generating any traffic.
+func (fw *Firewall) handleSimulate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req SimulationRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	if net.ParseIP(req.IP) == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "ip must be an IP address"})
+		return
+	}
+	if req.Port == 0 {
+		req.Port = fw.firewallPort
+	}
+	if req.Method == "" {
+		req.Method = http.MethodGet
+	}
+	if req.Path == "" {
+		req.Path = "/"
+	}
+	req.Method = strings.ToUpper(req.Method)
+
+	writeJSON(w, http.StatusOK, fw.simulate(req))
+}
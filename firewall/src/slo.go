@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SLOMetricConnect   = "connect"
+	SLOMetricFirstByte = "first_byte"
+	SLOMetricDuration  = "connection_duration"
+
+	DefaultSLOWindow     = 60
+	DefaultSLOMinSamples = 10
+)
+
+// SLOObjective is violated when the Percentile of Metric over one window is
+// above ThresholdMs.
+type SLOObjective struct {
+	Metric      string  `json:"metric"`
+	Percentile  float64 `json:"percentile"`
+	ThresholdMs float64 `json:"threshold_ms"`
+}
+
+func (o SLOObjective) String() string {
+	return fmt.Sprintf("%s p%g <= %gms", o.Metric, o.Percentile, o.ThresholdMs)
+}
+
+// SLOConfig evaluates the objectives every WindowSeconds over the requests
+// seen in that window; windows with fewer than MinSamples are skipped.
+type SLOConfig struct {
+	Enabled       bool           `json:"enabled"`
+	WindowSeconds int            `json:"window_seconds"`
+	MinSamples    int            `json:"min_samples"`
+	Objectives    []SLOObjective `json:"objectives"`
+}
+
+func normalizeSLOConfig(config SLOConfig) SLOConfig {
+	if config.WindowSeconds <= 0 {
+		config.WindowSeconds = DefaultSLOWindow
+	}
+	if config.MinSamples <= 0 {
+		config.MinSamples = DefaultSLOMinSamples
+	}
+
+	objectives := make([]SLOObjective, 0, len(config.Objectives))
+	for _, objective := range config.Objectives {
+		objective.Metric = strings.ToLower(strings.TrimSpace(objective.Metric))
+		if _, known := (LatencyStatsSnapshot{}).Metric(objective.Metric); !known {
+			continue
+		}
+		if objective.Percentile <= 0 || objective.Percentile > 100 || objective.ThresholdMs <= 0 {
+			continue
+		}
+		objectives = append(objectives, objective)
+	}
+	config.Objectives = objectives
+	return config
+}
+
+type SLOStatus struct {
+	Objective  string    `json:"objective"`
+	Violated   bool      `json:"violated"`
+	LastValue  float64   `json:"last_value_ms"`
+	Samples    uint64    `json:"last_samples"`
+	Violations uint64    `json:"violations"`
+	CheckedAt  time.Time `json:"checked_at"`
+}
+
+// SLOTracker remembers, per objective, whether the last window was in
+// violation so that a recovery can be logged once.
+type SLOTracker struct {
+	mutex  sync.Mutex
+	status map[string]*SLOStatus
+}
+
+func NewSLOTracker() *SLOTracker {
+	return &SLOTracker{status: make(map[string]*SLOStatus)}
+}
+
+func (st *SLOTracker) Snapshot() []SLOStatus {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	statuses := make([]SLOStatus, 0, len(st.status))
+	for _, status := range st.status {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Objective < statuses[j].Objective
+	})
+	return statuses
+}
+
+func (fw *Firewall) checkSLOs(config SLOConfig, window LatencyStatsSnapshot) {
+	fw.slo.mutex.Lock()
+	defer fw.slo.mutex.Unlock()
+
+	for _, objective := range config.Objectives {
+		histogram, _ := window.Metric(objective.Metric)
+		if histogram.Count < uint64(config.MinSamples) {
+			continue
+		}
+
+		name := objective.String()
+		status, exists := fw.slo.status[name]
+		if !exists {
+			status = &SLOStatus{Objective: name}
+			fw.slo.status[name] = status
+		}
+
+		value := histogram.Percentile(objective.Percentile)
+		violated := value > objective.ThresholdMs
+		status.LastValue = value
+		status.Samples = histogram.Count
+		status.CheckedAt = time.Now()
+
+		switch {
+		case violated:
+			status.Violations++
+			fw.logger.LogWarning("SLO", "Violated %s: p%g was %.1fms over the last %ds (%d samples)",
+				name, objective.Percentile, value, config.WindowSeconds, histogram.Count)
+		case status.Violated:
+			fw.logger.LogInfo("SLO", "Recovered %s: p%g is %.1fms", name, objective.Percentile, value)
+		}
+		status.Violated = violated
+	}
+}
+
+func (fw *Firewall) sloWatcher() {
+	previous := fw.latencyStats.Snapshot()
+	elapsed := 0
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fw.rulesMutex.RLock()
+		config := fw.rules.SLO
+		fw.rulesMutex.RUnlock()
+
+		elapsed++
+		if elapsed < config.WindowSeconds {
+			continue
+		}
+		elapsed = 0
+
+		current := fw.latencyStats.Snapshot()
+		window := LatencyStatsSnapshot{
+			Connect:   current.Connect.Since(previous.Connect),
+			FirstByte: current.FirstByte.Since(previous.FirstByte),
+			Duration:  current.Duration.Since(previous.Duration),
+		}
+		previous = current
+
+		if config.Enabled {
+			fw.checkSLOs(config, window)
+		}
+	}
+}
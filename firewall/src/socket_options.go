@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultKeepaliveIdleSeconds     = 60
+	DefaultKeepaliveIntervalSeconds = 15
+	DefaultKeepaliveCount           = 4
+	DefaultFastOpenQueue            = 256
+
+	// tcpFastOpen and tcpFastOpenConnect are Linux's TCP_FASTOPEN and
+	// TCP_FASTOPEN_CONNECT, which package syscall lacks.
+	tcpFastOpen        = 23
+	tcpFastOpenConnect = 30
+)
+
+// KeepaliveConfig sets TCP keepalive on a socket: after IdleSeconds without
+// traffic a probe is sent every IntervalSeconds, and the peer is declared
+// dead after Count unanswered probes.
+type KeepaliveConfig struct {
+	Enabled         bool `json:"enabled"`
+	IdleSeconds     int  `json:"idle_seconds"`
+	IntervalSeconds int  `json:"interval_seconds"`
+	Count           int  `json:"count"`
+}
+
+func normalizeKeepaliveConfig(config KeepaliveConfig) KeepaliveConfig {
+	if config.IdleSeconds <= 0 {
+		config.IdleSeconds = DefaultKeepaliveIdleSeconds
+	}
+	if config.IntervalSeconds <= 0 {
+		config.IntervalSeconds = DefaultKeepaliveIntervalSeconds
+	}
+	if config.Count <= 0 {
+		config.Count = DefaultKeepaliveCount
+	}
+	return config
+}
+
+// SocketOptions are applied to one side's TCP sockets. NoDelay unset keeps
+// Go's default of TCP_NODELAY on; buffer sizes of 0 keep the kernel's.
+// FastOpen on the client side is set on the listener, with FastOpenQueue
+// pending handshakes, and only takes effect at startup.
+type SocketOptions struct {
+	Keepalive          KeepaliveConfig `json:"keepalive"`
+	NoDelay            *bool           `json:"no_delay,omitempty"`
+	ReceiveBufferBytes int             `json:"receive_buffer_bytes"`
+	SendBufferBytes    int             `json:"send_buffer_bytes"`
+	FastOpen           bool            `json:"fast_open"`
+	FastOpenQueue      int             `json:"fast_open_queue,omitempty"`
+}
+
+func normalizeSocketOptions(options SocketOptions) SocketOptions {
+	options.Keepalive = normalizeKeepaliveConfig(options.Keepalive)
+	if options.ReceiveBufferBytes < 0 {
+		options.ReceiveBufferBytes = 0
+	}
+	if options.SendBufferBytes < 0 {
+		options.SendBufferBytes = 0
+	}
+	if options.FastOpenQueue <= 0 {
+		options.FastOpenQueue = DefaultFastOpenQueue
+	}
+	return options
+}
+
+// SocketOptionsConfig holds the options for accepted client sockets and for
+// sockets dialed to upstreams.
+type SocketOptionsConfig struct {
+	Client   SocketOptions `json:"client"`
+	Upstream SocketOptions `json:"upstream"`
+}
+
+func normalizeSocketOptionsConfig(config SocketOptionsConfig) SocketOptionsConfig {
+	config.Client = normalizeSocketOptions(config.Client)
+	config.Upstream = normalizeSocketOptions(config.Upstream)
+	return config
+}
+
+func (fw *Firewall) socketOptions() SocketOptionsConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.SocketOptions
+}
+
+// setSocketOptions applies options to conn's socket. Connections that aren't
+// sockets are left alone.
+func setSocketOptions(conn net.Conn, options SocketOptions) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	set := func(fd int, level, name, value int, label string) {
+		if err := syscall.SetsockoptInt(fd, level, name, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", label, err))
+		}
+	}
+	keepalive := options.Keepalive
+	if err := raw.Control(func(fd uintptr) {
+		if options.NoDelay != nil {
+			noDelay := 0
+			if *options.NoDelay {
+				noDelay = 1
+			}
+			set(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY, noDelay, "TCP_NODELAY")
+		}
+		if options.ReceiveBufferBytes > 0 {
+			set(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, options.ReceiveBufferBytes, "SO_RCVBUF")
+		}
+		if options.SendBufferBytes > 0 {
+			set(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, options.SendBufferBytes, "SO_SNDBUF")
+		}
+
+		if !keepalive.Enabled {
+			set(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 0, "SO_KEEPALIVE")
+			return
+		}
+		set(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1, "SO_KEEPALIVE")
+		set(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, keepalive.IdleSeconds, "TCP_KEEPIDLE")
+		set(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, keepalive.IntervalSeconds, "TCP_KEEPINTVL")
+		set(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, keepalive.Count, "TCP_KEEPCNT")
+	}); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// applySocketOptions is setSocketOptions with failures logged, not fatal.
+func (fw *Firewall) applySocketOptions(conn net.Conn, options SocketOptions, side string) {
+	if err := setSocketOptions(conn, options); err != nil {
+		fw.logErrorRateLimited("socket_options_"+side, "SOCKET", "Failed to set %s socket options: %v", side, err)
+	}
+}
+
+// dialSocket dials a TCP address, asking for TCP Fast Open when the upstream
+// socket options enable it.
+func (fw *Firewall) dialSocket(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	if fw.socketOptions().Upstream.FastOpen {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1); err != nil {
+					fw.logErrorRateLimited("socket_fastopen_connect", "SOCKET", "TCP_FASTOPEN_CONNECT not supported: %v", err)
+				}
+			})
+		}
+	}
+	return dialer.DialContext(ctx, "tcp", address)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ResponseStats aggregates the upstream responses seen across all
+// proxied connections.
+type ResponseStats struct {
+	mutex        sync.Mutex
+	statusCounts map[int]uint64
+	responses    uint64
+	bytes        uint64
+	latencyTotal time.Duration
+	latencyMax   time.Duration
+}
+
+type ResponseStatsSnapshot struct {
+	Responses        uint64            `json:"responses"`
+	StatusCounts     map[string]uint64 `json:"status_counts"`
+	StatusClasses    map[string]uint64 `json:"status_classes"`
+	TotalBytes       uint64            `json:"total_bytes"`
+	AvgBytes         float64           `json:"avg_bytes_per_response"`
+	AvgLatencyMillis float64           `json:"avg_upstream_latency_ms"`
+	MaxLatencyMillis float64           `json:"max_upstream_latency_ms"`
+}
+
+func NewResponseStats() *ResponseStats {
+	return &ResponseStats{
+		statusCounts: make(map[int]uint64),
+	}
+}
+
+func (rs *ResponseStats) Record(record ResponseRecord) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	rs.statusCounts[record.Status]++
+	rs.responses++
+	rs.bytes += uint64(record.Bytes)
+	rs.latencyTotal += record.Latency
+	if record.Latency > rs.latencyMax {
+		rs.latencyMax = record.Latency
+	}
+}
+
+func (rs *ResponseStats) Snapshot() ResponseStatsSnapshot {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	snapshot := ResponseStatsSnapshot{
+		Responses:        rs.responses,
+		StatusCounts:     make(map[string]uint64, len(rs.statusCounts)),
+		StatusClasses:    make(map[string]uint64),
+		TotalBytes:       rs.bytes,
+		MaxLatencyMillis: durationMillis(rs.latencyMax),
+	}
+
+	for status, count := range rs.statusCounts {
+		snapshot.StatusCounts[strconv.Itoa(status)] = count
+		snapshot.StatusClasses[strconv.Itoa(status/100)+"xx"] += count
+	}
+
+	if rs.responses > 0 {
+		snapshot.AvgBytes = float64(rs.bytes) / float64(rs.responses)
+		snapshot.AvgLatencyMillis = durationMillis(rs.latencyTotal) / float64(rs.responses)
+	}
+
+	return snapshot
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultStatsDAddress  = "127.0.0.1:8125"
+	DefaultStatsDPrefix   = "dockerchat.firewall"
+	DefaultStatsDInterval = 10
+	MaxStatsDSamples      = 1000
+	MaxStatsDPacketSize   = 1432
+
+	StatsDUpstreamLatency    = "upstream_latency"
+	StatsDConnectTime        = "connect_time"
+	StatsDConnectionDuration = "connection_duration"
+)
+
+// StatsDConfig pushes metrics to a StatsD agent over UDP. DogStatsD switches
+// per-reason and per-status metrics from name suffixes to tags, and adds
+// Tags to every metric.
+type StatsDConfig struct {
+	Enabled         bool     `json:"enabled"`
+	Address         string   `json:"address"`
+	Prefix          string   `json:"prefix"`
+	IntervalSeconds int      `json:"interval_seconds"`
+	DogStatsD       bool     `json:"dogstatsd"`
+	Tags            []string `json:"tags"`
+}
+
+func normalizeStatsDConfig(config StatsDConfig) StatsDConfig {
+	if config.Address == "" {
+		config.Address = DefaultStatsDAddress
+	}
+	if config.Prefix == "" {
+		config.Prefix = DefaultStatsDPrefix
+	}
+	config.Prefix = strings.TrimSuffix(config.Prefix, ".")
+	if config.IntervalSeconds <= 0 {
+		config.IntervalSeconds = DefaultStatsDInterval
+	}
+	return config
+}
+
+type statsdCounters struct {
+	connections  uint64
+	blocked      uint64
+	responses    uint64
+	bytes        uint64
+	bytesIn      uint64
+	bytesOut     uint64
+	panics       uint64
+	shed         uint64
+	blockReasons map[string]uint64
+	classes      map[string]uint64
+}
+
+// StatsDExporter turns the cumulative stats into per-interval counter deltas
+// and collects timing samples between pushes.
+type StatsDExporter struct {
+	enabled atomic.Bool
+
+	mutex   sync.Mutex
+	timings map[string]*statsdTimings
+	last    statsdCounters
+	conn    net.Conn
+	addr    string
+}
+
+func NewStatsDExporter() *StatsDExporter {
+	return &StatsDExporter{}
+}
+
+// statsdTimings keeps up to MaxStatsDSamples samples per interval; seen
+// counts all of them so the rest can be accounted for with a sample rate.
+type statsdTimings struct {
+	samples []time.Duration
+	seen    int
+}
+
+func (se *StatsDExporter) RecordTiming(name string, d time.Duration) {
+	if !se.enabled.Load() {
+		return
+	}
+
+	se.mutex.Lock()
+	defer se.mutex.Unlock()
+
+	if se.timings == nil {
+		se.timings = make(map[string]*statsdTimings)
+	}
+	timings, exists := se.timings[name]
+	if !exists {
+		timings = &statsdTimings{}
+		se.timings[name] = timings
+	}
+	timings.seen++
+	if len(timings.samples) < MaxStatsDSamples {
+		timings.samples = append(timings.samples, d)
+	}
+}
+
+type statsdBatch struct {
+	config  StatsDConfig
+	packets []string
+	current strings.Builder
+}
+
+func (sb *statsdBatch) add(name, value, kind string, tags []string) {
+	line := sb.config.Prefix + "." + name + ":" + value + "|" + kind
+	if sb.config.DogStatsD {
+		tags = append(tags, sb.config.Tags...)
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+	}
+
+	if sb.current.Len() > 0 && sb.current.Len()+1+len(line) > MaxStatsDPacketSize {
+		sb.packets = append(sb.packets, sb.current.String())
+		sb.current.Reset()
+	}
+	if sb.current.Len() > 0 {
+		sb.current.WriteByte('\n')
+	}
+	sb.current.WriteString(line)
+}
+
+// addLabelled emits name tagged with key:label for DogStatsD, or with the
+// label appended to the name for plain StatsD.
+func (sb *statsdBatch) addLabelled(name, key, label, value, kind string) {
+	label = statsdSafe(label)
+	if sb.config.DogStatsD {
+		sb.add(name, value, kind, []string{key + ":" + label})
+		return
+	}
+	sb.add(name+"."+label, value, kind, nil)
+}
+
+func (sb *statsdBatch) finish() []string {
+	if sb.current.Len() > 0 {
+		sb.packets = append(sb.packets, sb.current.String())
+		sb.current.Reset()
+	}
+	return sb.packets
+}
+
+func statsdSafe(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + ('a' - 'A')
+		}
+		return '_'
+	}, value)
+}
+
+func (fw *Firewall) buildStatsDPackets(config StatsDConfig) []string {
+	se := fw.statsd
+	traffic := fw.trafficStats.Snapshot()
+	responses := fw.responseStats.Snapshot()
+	transfer := fw.transfers.Snapshot(fw.clock.Now())
+	active, tracked, autoBlocked := fw.connectionGauges()
+
+	current := statsdCounters{
+		connections:  traffic.Connections,
+		blocked:      traffic.Blocked,
+		responses:    responses.Responses,
+		bytes:        responses.TotalBytes,
+		bytesIn:      transfer.BytesIn,
+		bytesOut:     transfer.BytesOut,
+		panics:       fw.panics.Load(),
+		shed:         fw.saturation.shed.Load(),
+		blockReasons: make(map[string]uint64, len(traffic.BlockReasons)),
+		classes:      responses.StatusClasses,
+	}
+	for _, entry := range traffic.BlockReasons {
+		current.blockReasons[entry.Key] = entry.Count
+	}
+
+	se.mutex.Lock()
+	last := se.last
+	se.last = current
+	timings := se.timings
+	se.timings = nil
+	se.mutex.Unlock()
+
+	batch := &statsdBatch{config: config}
+	count := func(n uint64) string { return fmt.Sprintf("%d", n) }
+
+	batch.add("connections", count(current.connections-last.connections), "c", nil)
+	batch.add("blocked", count(current.blocked-last.blocked), "c", nil)
+	batch.add("responses", count(current.responses-last.responses), "c", nil)
+	batch.add("bytes", count(current.bytes-last.bytes), "c", nil)
+	batch.add("bytes_in", count(current.bytesIn-last.bytesIn), "c", nil)
+	batch.add("bytes_out", count(current.bytesOut-last.bytesOut), "c", nil)
+	batch.add("panics", count(current.panics-last.panics), "c", nil)
+	batch.add("shed_connections", count(current.shed-last.shed), "c", nil)
+	for reason, n := range current.blockReasons {
+		if delta := n - last.blockReasons[reason]; delta > 0 {
+			batch.addLabelled("block_reasons", "reason", reason, count(delta), "c")
+		}
+	}
+	for class, n := range current.classes {
+		if delta := n - last.classes[class]; delta > 0 {
+			batch.addLabelled("responses_by_class", "status_class", class, count(delta), "c")
+		}
+	}
+
+	batch.add("active_connections", fmt.Sprintf("%d", active), "g", nil)
+	batch.add("tracked_ips", fmt.Sprintf("%d", tracked), "g", nil)
+	batch.add("auto_blocked_ips", fmt.Sprintf("%d", autoBlocked), "g", nil)
+	batch.add("saturation", fmt.Sprintf("%.3f", fw.saturationSnapshot().Utilization), "g", nil)
+
+	for name, timing := range timings {
+		kind := "ms"
+		if timing.seen > len(timing.samples) {
+			kind = fmt.Sprintf("ms|@%.4f", float64(len(timing.samples))/float64(timing.seen))
+		}
+		for _, sample := range timing.samples {
+			batch.add(name, fmt.Sprintf("%.3f", durationMillis(sample)), kind, nil)
+		}
+	}
+
+	return batch.finish()
+}
+
+func (fw *Firewall) pushStatsD(config StatsDConfig) error {
+	se := fw.statsd
+
+	if se.conn == nil || se.addr != config.Address {
+		if se.conn != nil {
+			se.conn.Close()
+			se.conn = nil
+		}
+		conn, err := net.Dial("udp", config.Address)
+		if err != nil {
+			return err
+		}
+		se.conn, se.addr = conn, config.Address
+	}
+
+	// A connected UDP socket reports an earlier packet's ICMP rejection on
+	// the next write, which then isn't sent, so each packet gets one retry.
+	var firstErr error
+	for _, packet := range fw.buildStatsDPackets(config) {
+		if _, err := se.conn.Write([]byte(packet)); err != nil {
+			if _, err = se.conn.Write([]byte(packet)); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (fw *Firewall) statsdWatcher() {
+	elapsed := 0
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fw.rulesMutex.RLock()
+		config := fw.rules.StatsD
+		fw.rulesMutex.RUnlock()
+
+		fw.statsd.enabled.Store(config.Enabled)
+		elapsed++
+		if !config.Enabled || elapsed < config.IntervalSeconds {
+			continue
+		}
+		elapsed = 0
+
+		if err := fw.pushStatsD(config); err != nil {
+			fw.logErrorRateLimited("statsd", "STATSD", "Failed to push metrics to %s: %v", config.Address, err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Tenant is one DockerChat instance sharing the firewall with others,
+// picked by the request's Host header or, for TLS, its SNI. Hosts are exact
+// names or "*.domain" wildcards; exact names win. A tenant's lists, rate
+// limit and policies only apply to its own traffic and come on top of the
+// global rules, which tenants can't loosen: the global whitelist still skips
+// them, a tenant's whitelist only skips the tenant's own rules. Upstreams,
+// when set, replace the global upstreams and canary split for the tenant.
+type Tenant struct {
+	Name                 string        `json:"name"`
+	Hosts                []string      `json:"hosts"`
+	Upstreams            []Upstream    `json:"upstreams"`
+	Whitelist            RuleEntryList `json:"whitelist"`
+	BlockedIPs           RuleEntryList `json:"blocked_ips"`
+	BlockedCountries     []string      `json:"blocked_countries"`
+	MaxAttemptsPerMinute int           `json:"max_attempts_per_minute"`
+	Policies             []Policy      `json:"policies"`
+}
+
+func normalizeTenants(tenants []Tenant) []Tenant {
+	seen := make(map[string]bool, len(tenants))
+	normalized := make([]Tenant, 0, len(tenants))
+	for _, tenant := range tenants {
+		tenant.Name = strings.ToLower(strings.TrimSpace(tenant.Name))
+		if tenant.Name == "" || seen[tenant.Name] {
+			continue
+		}
+		seen[tenant.Name] = true
+
+		hosts := make([]string, 0, len(tenant.Hosts))
+		for _, host := range tenant.Hosts {
+			if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+		tenant.Hosts = hosts
+		for i, country := range tenant.BlockedCountries {
+			tenant.BlockedCountries[i] = strings.ToUpper(strings.TrimSpace(country))
+		}
+		if tenant.MaxAttemptsPerMinute < 0 {
+			tenant.MaxAttemptsPerMinute = 0
+		}
+		tenant.Policies = normalizePolicies(tenant.Policies)
+		normalized = append(normalized, tenant)
+	}
+	return normalized
+}
+
+// tenantProblems reports tenants that are dropped or that can't get all the
+// traffic their hosts name.
+func tenantProblems(tenants []Tenant) []string {
+	var problems []string
+	seen := make(map[string]bool, len(tenants))
+	owners := make(map[string]string)
+	for i, tenant := range tenants {
+		name := strings.ToLower(strings.TrimSpace(tenant.Name))
+		switch {
+		case name == "":
+			problems = append(problems, fmt.Sprintf("tenants[%d] has no name - ignored", i))
+			continue
+		case seen[name]:
+			problems = append(problems, fmt.Sprintf("tenant %s is defined twice - the second is ignored", name))
+			continue
+		}
+		seen[name] = true
+
+		if len(tenant.Hosts) == 0 {
+			problems = append(problems, fmt.Sprintf("tenant %s has no hosts - it never matches", name))
+		}
+		for _, host := range tenant.Hosts {
+			host = strings.ToLower(strings.TrimSpace(host))
+			if owner, claimed := owners[host]; claimed {
+				problems = append(problems, fmt.Sprintf("host %s belongs to tenant %s - tenant %s never gets it", host, owner, name))
+				continue
+			}
+			owners[host] = name
+		}
+		for _, upstream := range tenant.Upstreams {
+			if !upstream.Valid() {
+				problems = append(problems, fmt.Sprintf("tenant %s upstream %s is invalid - ignored", name, upstream.Addr()))
+			}
+		}
+		_, policyProblems := compilePolicies(tenant.Policies)
+		for _, problem := range policyProblems {
+			problems = append(problems, fmt.Sprintf("tenant %s %s - ignored", name, problem))
+		}
+	}
+	return problems
+}
+
+// tenantRules is a tenant with its lists and policies compiled.
+type tenantRules struct {
+	Tenant
+	whitelist  *IPMatcher
+	blockedIPs *IPMatcher
+	ring       *HashRing
+	policies   []compiledPolicy
+}
+
+func compileTenants(tenants []Tenant) []*tenantRules {
+	compiled := make([]*tenantRules, 0, len(tenants))
+	for _, tenant := range tenants {
+		policies, _ := compilePolicies(tenant.Policies)
+		// Tenant policies run once the Host is known, whatever else they
+		// read, or once the body is if they read that.
+		for i := range policies {
+			if policies[i].Stage != StageBody {
+				policies[i].Stage = StageRequest
+			}
+		}
+		compiled = append(compiled, &tenantRules{
+			Tenant:     tenant,
+			whitelist:  NewIPMatcher(tenant.Whitelist.Entries()),
+			blockedIPs: NewIPMatcher(tenant.BlockedIPs.Entries()),
+			ring:       NewHashRing(tenant.Upstreams),
+			policies:   policies,
+		})
+	}
+	return compiled
+}
+
+// tenantFor returns the tenant serving host, or nil.
+func (fw *Firewall) tenantFor(host string) *tenantRules {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	if fw.parsedRules == nil {
+		return nil
+	}
+	host = stripHostPort(strings.ToLower(host))
+	for _, tenant := range fw.parsedRules.Tenants {
+		for _, pattern := range tenant.Hosts {
+			if pattern == host {
+				return tenant
+			}
+		}
+	}
+	for _, tenant := range fw.parsedRules.Tenants {
+		if hostAllowed(host, tenant.Hosts) {
+			return tenant
+		}
+	}
+	return nil
+}
+
+// isTenantRateLimited records a request to tenant from key and reports
+// whether the tenant's per-minute budget is exhausted.
+func (fw *Firewall) isTenantRateLimited(key string, tenant *tenantRules) (int, int, bool) {
+	if tenant.MaxAttemptsPerMinute == 0 {
+		return 0, 0, false
+	}
+	limit := fw.adaptive.Scale(tenant.MaxAttemptsPerMinute)
+	attempts := fw.countAttempt(key + "|tenant:" + tenant.Name)
+	return attempts, limit, attempts > limit
+}
+
+func init() {
+	RegisterMiddleware(Middleware{Name: "tenant", Stage: StageRequest, Handle: tenantMiddleware})
+}
+
+func tenantName(tenant *tenantRules) string {
+	if tenant == nil {
+		return ""
+	}
+	return tenant.Name
+}
+
+// tenantMiddleware picks the request's tenant, for routing and stats, and
+// applies the tenant's own rules. A keep-alive connection stays with its
+// first request's tenant, as it is routed to that tenant's upstreams; a
+// later request for another is misdirected.
+func tenantMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	tenant := fw.tenantFor(ms.Head.Host())
+	if ms.FollowUp && tenantName(tenant) != tenantName(ms.Tenant) {
+		ms.Block("MISDIRECTED", fmt.Sprintf("host %s on a connection to tenant %q", ms.Head.Host(), tenantName(ms.Tenant)))
+		fw.writeHTTPError(ms.Conn, ms.ConnID, http.StatusMisdirectedRequest, "This connection serves another site.", 0)
+		return false
+	}
+	if tenant == nil {
+		return true
+	}
+	ms.Tenant = tenant
+	ms.Record.Tenant = tenant.Name
+	if ms.Whitelisted || tenant.whitelist.Contains(ms.IP) {
+		ms.Record.Event("whitelisted by tenant %s", tenant.Name)
+		return true
+	}
+
+	if rule, blocked := tenant.blockedIPs.MatchRule(ms.IP); blocked {
+		ms.Block("TENANT_BLOCKED", fmt.Sprintf("tenant %s blocks %s", tenant.Name, rule))
+		fw.writeHTTPError(ms.Conn, ms.ConnID, http.StatusForbidden, "Access from your network has been blocked.", 0)
+		return false
+	}
+	if len(tenant.BlockedCountries) > 0 {
+		country := ms.Verdict.Country
+		if country == "" {
+			country = fw.lookupCountry(ms.IP)
+		}
+		for _, blocked := range tenant.BlockedCountries {
+			if country != "" && country == blocked {
+				ms.Block("TENANT_BLOCKED", fmt.Sprintf("tenant %s blocks country %s", tenant.Name, country))
+				fw.writeHTTPError(ms.Conn, ms.ConnID, http.StatusForbidden, "DockerChat is not available in your region.", 0)
+				return false
+			}
+		}
+	}
+	if !ms.Exempt {
+		if attempts, limit, limited := fw.isTenantRateLimited(ms.Key, tenant); limited {
+			ms.Block("TENANT_RATE_LIMIT", fmt.Sprintf("%d/%d requests per minute to tenant %s", attempts, limit, tenant.Name))
+			fw.recordRisk(ms.IP, ms.Key, RiskSignalRateLimit, 1)
+			fw.writeHTTPError(ms.Conn, ms.ConnID, http.StatusTooManyRequests, "Too many requests", time.Minute)
+			return false
+		}
+	}
+	return fw.applyPolicies(tenant.policies, StageRequest, ms)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// topLogTail is how much of the end of firewall.log is searched for
+	// recent security events.
+	topLogTail        = 256 * 1024
+	topConnectionRows = 15
+)
+
+// adminClient calls the admin API of a running firewall, with the same
+// ADMIN_* credentials and signing key the server reads. ADMIN_CLIENT_TOKEN,
+// an operator's or viewer's token or an OIDC token, takes precedence.
+type adminClient struct {
+	base       string
+	auth       adminAuth
+	token      string
+	signingKey string
+	client     *http.Client
+}
+
+func newAdminClient(addr string) *adminClient {
+	auth := adminAuthFromEnv(time.Now)
+	ac := &adminClient{
+		auth:       auth,
+		token:      getEnv("ADMIN_CLIENT_TOKEN", auth.token),
+		signingKey: os.Getenv("ADMIN_SIGNING_KEY"),
+		client:     &http.Client{Timeout: 5 * time.Second},
+	}
+	if path, isUnix := strings.CutPrefix(addr, "unix:"); isUnix {
+		ac.base = "http://firewall"
+		ac.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		}
+	} else {
+		ac.base = "http://" + addr
+	}
+	return ac
+}
+
+// do sends a request, signing it when it mutates and a signing key is set.
+func (ac *adminClient) do(method, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, ac.base+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if ac.token != "" {
+		req.Header.Set("Authorization", "Bearer "+ac.token)
+	} else if ac.auth.basicEnabled() {
+		req.SetBasicAuth(ac.auth.user, ac.auth.password)
+	}
+	if ac.signingKey != "" && adminRequestMutates(req) {
+		if err := signAdminRequest(req, ac.signingKey, body, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	return ac.client.Do(req)
+}
+
+func (ac *adminClient) get(path string, v interface{}) error {
+	resp, err := ac.do(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// topSample is one refresh of the dashboard.
+type topSample struct {
+	At          time.Time
+	Stats       StatsResponse
+	Connections []connectionInfo
+	Events      []string
+}
+
+func fetchTopSample(ac *adminClient, logPath string, events int) (topSample, error) {
+	sample := topSample{At: time.Now()}
+	if err := ac.get("/stats", &sample.Stats); err != nil {
+		return sample, err
+	}
+	var connections struct {
+		Connections []connectionInfo `json:"connections"`
+	}
+	if err := ac.get("/connections", &connections); err != nil {
+		return sample, err
+	}
+	sample.Connections = connections.Connections
+	sample.Events = recentSecurityEvents(logPath, events)
+	return sample, nil
+}
+
+// recentSecurityEvents returns the last n SECURITY entries of the log.
+func recentSecurityEvents(path string, n int) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	if info, err := file.Stat(); err == nil && info.Size() > topLogTail {
+		file.Seek(info.Size()-topLogTail, io.SeekStart)
+	}
+	data, _ := io.ReadAll(file)
+
+	var events []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.Contains(line, "] ["+SECURITY.String()+"] [") {
+			events = append(events, line)
+		}
+	}
+	if len(events) > n {
+		events = events[len(events)-n:]
+	}
+	return events
+}
+
+// topView is what the dashboard shows; the sort order is picked with "s".
+type topView struct {
+	SortByBytes bool
+	Paused      bool
+	Width       int
+	// Error is why the last refresh failed; the previous sample is shown.
+	Error string
+}
+
+func perSecond(current, previous uint64, elapsed time.Duration) float64 {
+	if elapsed <= 0 || current < previous {
+		return 0
+	}
+	return float64(current-previous) / elapsed.Seconds()
+}
+
+func truncateLine(line string, width int) string {
+	if width > 0 && len(line) > width {
+		return line[:width]
+	}
+	return line
+}
+
+// renderTop draws one frame. previous may be nil on the first refresh, when
+// rates aren't known yet.
+func renderTop(w io.Writer, sample topSample, previous *topSample, view topView) {
+	var out bytes.Buffer
+	line := func(format string, args ...interface{}) {
+		out.WriteString(truncateLine(fmt.Sprintf(format, args...), view.Width))
+		out.WriteString("\n")
+	}
+	stats := sample.Stats
+	traffic := stats.Traffic
+
+	status := "live"
+	if view.Paused {
+		status = "paused"
+	}
+	line("firewall top - %s - up %s - %s   (q quit, p pause, s sort)", sample.At.Format("15:04:05"), stats.Uptime, status)
+	rates := "conn/s -   blocked/s -"
+	if previous != nil {
+		elapsed := sample.At.Sub(previous.At)
+		rates = fmt.Sprintf("conn/s %.1f   blocked/s %.1f",
+			perSecond(traffic.Connections, previous.Stats.Traffic.Connections, elapsed),
+			perSecond(traffic.Blocked, previous.Stats.Traffic.Blocked, elapsed))
+	}
+	line("active %d/%d   half-open %d   %s   total %d   blocked %d   auto-blocked %d   rate factor %.2f",
+		stats.ActiveConnections, stats.Saturation.Limit, stats.HalfOpen, rates,
+		traffic.Connections, traffic.Blocked, stats.AutoBlockedIPs, stats.RateLimitFactor)
+	if view.Error != "" {
+		line("refresh failed: %s", view.Error)
+	}
+	line("")
+
+	connections := append([]connectionInfo(nil), sample.Connections...)
+	sort.Slice(connections, func(i, j int) bool {
+		if view.SortByBytes {
+			return connections[i].BytesIn+connections[i].BytesOut > connections[j].BytesIn+connections[j].BytesOut
+		}
+		return connections[i].Started < connections[j].Started
+	})
+	order := "oldest first"
+	if view.SortByBytes {
+		order = "most bytes first"
+	}
+	line("CONNECTIONS (%d, %s)", len(connections), order)
+	line("%-40s %6s %-10s %-10s %10s %10s  %s", "IP", "PORT", "DURATION", "IDLE", "IN", "OUT", "UPSTREAM")
+	for i, c := range connections {
+		if i == topConnectionRows {
+			line("... %d more", len(connections)-topConnectionRows)
+			break
+		}
+		upstream := c.Upstream
+		if c.Upgraded {
+			upstream += " (websocket)"
+		}
+		line("%-40s %6d %-10s %-10s %10d %10d  %s", c.IP, c.Port, c.Duration, c.Idle, c.BytesIn, c.BytesOut, upstream)
+	}
+	line("")
+
+	line("%-40s %8s    %-24s %8s", "TOP BLOCKED IPS", "BLOCKS", "BLOCK REASONS", "COUNT")
+	for i := 0; i < 10 && (i < len(traffic.TopBlocked) || i < len(traffic.BlockReasons)); i++ {
+		var ip, reason string
+		var ipCount, reasonCount string
+		if i < len(traffic.TopBlocked) {
+			ip, ipCount = traffic.TopBlocked[i].Key, fmt.Sprint(traffic.TopBlocked[i].Count)
+			if hostname := traffic.TopBlocked[i].Hostname; hostname != "" {
+				ip += " (" + hostname + ")"
+			}
+		}
+		if i < len(traffic.BlockReasons) {
+			reason, reasonCount = traffic.BlockReasons[i].Key, fmt.Sprint(traffic.BlockReasons[i].Count)
+		}
+		line("%-40s %8s    %-24s %8s", ip, ipCount, reason, reasonCount)
+	}
+	line("")
+
+	line("RECENT SECURITY EVENTS")
+	if len(sample.Events) == 0 {
+		line("(none)")
+	}
+	for _, event := range sample.Events {
+		line("%s", event)
+	}
+
+	w.Write(out.Bytes())
+}
+
+// terminalState switches a terminal to unbuffered, unechoed input so single
+// key presses reach the dashboard, and back.
+type terminalState struct {
+	fd       uintptr
+	original syscall.Termios
+}
+
+func makeRaw(fd uintptr) (*terminalState, error) {
+	state := &terminalState{fd: fd}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&state.original))); errno != 0 {
+		return nil, errno
+	}
+	raw := state.original
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO
+	raw.Cc[syscall.VMIN], raw.Cc[syscall.VTIME] = 1, 0
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&raw))); errno != 0 {
+		return nil, errno
+	}
+	return state, nil
+}
+
+func (ts *terminalState) restore() {
+	syscall.Syscall(syscall.SYS_IOCTL, ts.fd, syscall.TCSETS, uintptr(unsafe.Pointer(&ts.original)))
+}
+
+func terminalWidth(fd uintptr) int {
+	var size struct{ rows, cols, x, y uint16 }
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0
+	}
+	return int(size.cols)
+}
+
+// runTopCommand shows a live dashboard of the running firewall, read from its
+// admin API and log, e.g. via "docker exec -it firewall firewall top".
+func runTopCommand(args []string) int {
+	flags := flag.NewFlagSet("top", flag.ContinueOnError)
+	addr := flags.String("admin", getEnv("ADMIN_ADDR", DefaultAdminAddr), "admin API address, host:port or unix:/path")
+	interval := flags.Duration("interval", 2*time.Second, "refresh interval")
+	logPath := flags.String("log", filepath.Join(DefaultLogDir, "firewall.log"), "firewall log to read security events from")
+	events := flags.Int("events", 10, "number of recent security events to show")
+	once := flags.Bool("once", false, "print one frame and exit")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *interval <= 0 || *events < 0 {
+		fmt.Fprintln(os.Stderr, "interval must be positive and events not negative")
+		return 2
+	}
+	if *addr == "off" {
+		fmt.Fprintln(os.Stderr, "the admin API is disabled (ADMIN_ADDR=off); set -admin")
+		return 2
+	}
+
+	client := newAdminClient(*addr)
+	sample, err := fetchTopSample(client, *logPath, *events)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to reach the admin API at %s: %v\n", *addr, err)
+		return 1
+	}
+	view := topView{Width: terminalWidth(os.Stdout.Fd())}
+	if *once {
+		renderTop(os.Stdout, sample, nil, view)
+		return 0
+	}
+
+	terminal, err := makeRaw(os.Stdin.Fd())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "stdin is not a terminal (%v); use -once or docker exec -it\n", err)
+		return 2
+	}
+	defer terminal.restore()
+	// Hide the cursor while drawing, and show it again on the way out.
+	os.Stdout.WriteString("\x1b[?25l")
+	defer os.Stdout.WriteString("\x1b[?25h\n")
+
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if n, err := os.Stdin.Read(buf); err != nil || n == 0 {
+				close(keys)
+				return
+			}
+			keys <- buf[0]
+		}
+	}()
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	var previous *topSample
+	for {
+		// Home the cursor and clear the screen before each frame.
+		os.Stdout.WriteString("\x1b[H\x1b[2J")
+		renderTop(os.Stdout, sample, previous, view)
+
+		select {
+		case key, ok := <-keys:
+			switch {
+			case !ok, key == 'q', key == 3:
+				return 0
+			case key == 'p':
+				view.Paused = !view.Paused
+			case key == 's':
+				view.SortByBytes = !view.SortByBytes
+			}
+			continue
+		case <-ticker.C:
+		}
+
+		view.Width = terminalWidth(os.Stdout.Fd())
+		if view.Paused {
+			continue
+		}
+		next, err := fetchTopSample(client, *logPath, *events)
+		if err != nil {
+			view.Error = err.Error()
+			continue
+		}
+		last := sample
+		previous, sample, view.Error = &last, next, ""
+	}
+}
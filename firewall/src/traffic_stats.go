@@ -0,0 +1,210 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	TimelineBuckets = 60
+	TopListSize     = 10
+)
+
+type TimelineBucket struct {
+	Minute      time.Time `json:"minute"`
+	Connections uint64    `json:"connections"`
+	Blocked     uint64    `json:"blocked"`
+	Bytes       uint64    `json:"bytes"`
+}
+
+type CountEntry struct {
+	Key      string `json:"key"`
+	Count    uint64 `json:"count"`
+	Hostname string `json:"hostname,omitempty"`
+}
+
+// TrafficStats keeps per-IP connection and block counts plus a per-minute
+// timeline for the last hour, feeding the stats API and the HTML report.
+type TrafficStats struct {
+	mutex        sync.Mutex
+	connections  uint64
+	blocked      uint64
+	ipCounts     map[string]uint64
+	blockedIPs   map[string]uint64
+	blockReasons map[string]uint64
+	timeline     []TimelineBucket
+}
+
+type TrafficStatsSnapshot struct {
+	Connections  uint64           `json:"connections"`
+	Blocked      uint64           `json:"blocked"`
+	TopIPs       []CountEntry     `json:"top_ips"`
+	TopBlocked   []CountEntry     `json:"top_blocked_ips"`
+	BlockReasons []CountEntry     `json:"block_reasons"`
+	Timeline     []TimelineBucket `json:"timeline"`
+}
+
+func NewTrafficStats() *TrafficStats {
+	return &TrafficStats{
+		ipCounts:     make(map[string]uint64),
+		blockedIPs:   make(map[string]uint64),
+		blockReasons: make(map[string]uint64),
+	}
+}
+
+func (ts *TrafficStats) bucket(now time.Time) *TimelineBucket {
+	minute := now.Truncate(time.Minute)
+	if n := len(ts.timeline); n > 0 && ts.timeline[n-1].Minute.Equal(minute) {
+		return &ts.timeline[n-1]
+	}
+	ts.timeline = append(ts.timeline, TimelineBucket{Minute: minute})
+	if len(ts.timeline) > TimelineBuckets {
+		ts.timeline = ts.timeline[len(ts.timeline)-TimelineBuckets:]
+	}
+	return &ts.timeline[len(ts.timeline)-1]
+}
+
+func (ts *TrafficStats) RecordConnection(ip string) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	ts.connections++
+	ts.bucket(time.Now()).Connections++
+	incrementBounded(ts.ipCounts, ip)
+}
+
+func (ts *TrafficStats) RecordBlock(ip, reason string) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	ts.blocked++
+	ts.bucket(time.Now()).Blocked++
+	incrementBounded(ts.blockedIPs, ip)
+	ts.blockReasons[reason]++
+}
+
+func (ts *TrafficStats) RecordBytes(n int64) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	ts.bucket(time.Now()).Bytes += uint64(n)
+}
+
+// incrementBounded bumps counts[key], shedding single-hit entries first when
+// the map reaches MaxTrackedIPs so a spoofed-source flood can't grow it
+// without bound.
+func incrementBounded(counts map[string]uint64, key string) {
+	if _, exists := counts[key]; !exists && len(counts) >= MaxTrackedIPs {
+		for k, v := range counts {
+			if v <= 1 {
+				delete(counts, k)
+			}
+		}
+		if len(counts) >= MaxTrackedIPs {
+			return
+		}
+	}
+	counts[key]++
+}
+
+func topEntries(counts map[string]uint64, n int) []CountEntry {
+	entries := make([]CountEntry, 0, len(counts))
+	for key, count := range counts {
+		entries = append(entries, CountEntry{Key: key, Count: count})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+func (ts *TrafficStats) Snapshot() TrafficStatsSnapshot {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	timeline := make([]TimelineBucket, len(ts.timeline))
+	copy(timeline, ts.timeline)
+
+	return TrafficStatsSnapshot{
+		Connections:  ts.connections,
+		Blocked:      ts.blocked,
+		TopIPs:       topEntries(ts.ipCounts, TopListSize),
+		TopBlocked:   topEntries(ts.blockedIPs, TopListSize),
+		BlockReasons: topEntries(ts.blockReasons, 0),
+		Timeline:     timeline,
+	}
+}
+
+// TrafficStatsState is the part of TrafficStats kept across restarts.
+type TrafficStatsState struct {
+	Connections  uint64            `json:"connections"`
+	Blocked      uint64            `json:"blocked"`
+	IPCounts     map[string]uint64 `json:"ip_counts"`
+	BlockedIPs   map[string]uint64 `json:"blocked_ips"`
+	BlockReasons map[string]uint64 `json:"block_reasons"`
+	Timeline     []TimelineBucket  `json:"timeline"`
+}
+
+func copyCounts(counts map[string]uint64) map[string]uint64 {
+	copied := make(map[string]uint64, len(counts))
+	for key, count := range counts {
+		copied[key] = count
+	}
+	return copied
+}
+
+func (ts *TrafficStats) State() TrafficStatsState {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	return TrafficStatsState{
+		Connections:  ts.connections,
+		Blocked:      ts.blocked,
+		IPCounts:     copyCounts(ts.ipCounts),
+		BlockedIPs:   copyCounts(ts.blockedIPs),
+		BlockReasons: copyCounts(ts.blockReasons),
+		Timeline:     append([]TimelineBucket(nil), ts.timeline...),
+	}
+}
+
+// Restore adds state to the counts recorded since startup.
+func (ts *TrafficStats) Restore(state TrafficStatsState) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	ts.connections += state.Connections
+	ts.blocked += state.Blocked
+	for key, count := range state.IPCounts {
+		if _, exists := ts.ipCounts[key]; exists || len(ts.ipCounts) < MaxTrackedIPs {
+			ts.ipCounts[key] += count
+		}
+	}
+	for key, count := range state.BlockedIPs {
+		if _, exists := ts.blockedIPs[key]; exists || len(ts.blockedIPs) < MaxTrackedIPs {
+			ts.blockedIPs[key] += count
+		}
+	}
+	for reason, count := range state.BlockReasons {
+		ts.blockReasons[reason] += count
+	}
+	if len(ts.timeline) == 0 {
+		ts.timeline = state.Timeline
+		if len(ts.timeline) > TimelineBuckets {
+			ts.timeline = ts.timeline[len(ts.timeline)-TimelineBuckets:]
+		}
+	}
+}
+
+// recordBlock counts a block in the traffic stats and in the periods of the
+// scheduled reports.
+func (fw *Firewall) recordBlock(ip, reason string) {
+	fw.trafficStats.RecordBlock(ip, reason)
+	fw.reportPeriods.RecordBlock(ip, reason, fw.clock.Now())
+}
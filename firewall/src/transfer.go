@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var errTransferCapExceeded = errors.New("transfer cap exceeded")
+
+type TransferDirection int
+
+const (
+	TransferIn  TransferDirection = iota // client->proxy
+	TransferOut                          // proxy->client
+)
+
+// quotaName is the rules field holding the daily quota for the direction.
+func (d TransferDirection) quotaName() string {
+	if d == TransferIn {
+		return "daily_ingress_quota_bytes"
+	}
+	return "daily_egress_quota_bytes"
+}
+
+type transferUsage struct {
+	day string
+	in  int64
+	out int64
+}
+
+// TransferTracker accounts bytes per client key per UTC day in each
+// direction, plus lifetime totals for the stats exporters.
+type TransferTracker struct {
+	mutex    sync.Mutex
+	usage    map[string]*transferUsage
+	totalIn  uint64
+	totalOut uint64
+}
+
+type TransferStatsSnapshot struct {
+	BytesIn        uint64       `json:"bytes_in"`
+	BytesOut       uint64       `json:"bytes_out"`
+	TodayIn        uint64       `json:"today_bytes_in"`
+	TodayOut       uint64       `json:"today_bytes_out"`
+	TopUploaders   []CountEntry `json:"top_uploaders"`
+	TopDownloaders []CountEntry `json:"top_downloaders"`
+}
+
+func NewTransferTracker() *TransferTracker {
+	return &TransferTracker{
+		usage: make(map[string]*transferUsage),
+	}
+}
+
+func transferDay(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+func nextTransferReset(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+// Used returns the bytes key moved today in each direction.
+func (tt *TransferTracker) Used(key string, now time.Time) (int64, int64) {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	if usage, exists := tt.usage[key]; exists && usage.day == transferDay(now) {
+		return usage.in, usage.out
+	}
+	return 0, 0
+}
+
+// Add records n bytes for key and returns the day's running total in that
+// direction.
+func (tt *TransferTracker) Add(key string, direction TransferDirection, n int64, now time.Time) int64 {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	today := transferDay(now)
+	usage, exists := tt.usage[key]
+	if !exists || usage.day != today {
+		usage = &transferUsage{day: today}
+		tt.usage[key] = usage
+	}
+	if direction == TransferIn {
+		usage.in += n
+		tt.totalIn += uint64(n)
+		return usage.in
+	}
+	usage.out += n
+	tt.totalOut += uint64(n)
+	return usage.out
+}
+
+// Cleanup drops counters from previous days.
+func (tt *TransferTracker) Cleanup(now time.Time) {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	today := transferDay(now)
+	for key, usage := range tt.usage {
+		if usage.day != today {
+			delete(tt.usage, key)
+		}
+	}
+}
+
+func (tt *TransferTracker) Snapshot(now time.Time) TransferStatsSnapshot {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	snapshot := TransferStatsSnapshot{BytesIn: tt.totalIn, BytesOut: tt.totalOut}
+	today := transferDay(now)
+	in := make(map[string]uint64)
+	out := make(map[string]uint64)
+	for key, usage := range tt.usage {
+		if usage.day != today {
+			continue
+		}
+		snapshot.TodayIn += uint64(usage.in)
+		snapshot.TodayOut += uint64(usage.out)
+		if usage.in > 0 {
+			in[key] = uint64(usage.in)
+		}
+		if usage.out > 0 {
+			out[key] = uint64(usage.out)
+		}
+	}
+	snapshot.TopUploaders = topEntries(in, TopListSize)
+	snapshot.TopDownloaders = topEntries(out, TopListSize)
+	return snapshot
+}
+
+// transferLimiter accounts one direction of a connection and enforces its
+// limits: the daily per-client quota, and on the proxy->client stream
+// max_response_bytes_per_connection. When either is hit the write fails,
+// which ends the copy, and onExceeded tears the connection down.
+type transferLimiter struct {
+	dst          io.Writer
+	tracker      *TransferTracker
+	now          func() time.Time
+	key          string
+	direction    TransferDirection
+	perConnLimit int64
+	dailyQuota   int64
+	written      int64
+	exceeded     bool
+	onExceeded   func(reason string, written int64)
+}
+
+func (tl *transferLimiter) Write(p []byte) (int, error) {
+	if tl.exceeded {
+		return 0, errTransferCapExceeded
+	}
+
+	allowed := int64(len(p))
+	reason := ""
+	if tl.perConnLimit > 0 && tl.written+allowed > tl.perConnLimit {
+		allowed = tl.perConnLimit - tl.written
+		reason = "max_response_bytes_per_connection"
+	}
+	if tl.dailyQuota > 0 {
+		in, out := tl.tracker.Used(tl.key, tl.now())
+		used := out
+		if tl.direction == TransferIn {
+			used = in
+		}
+		if remaining := tl.dailyQuota - used; remaining < allowed {
+			allowed = remaining
+			reason = tl.direction.quotaName()
+		}
+	}
+	if allowed < 0 {
+		allowed = 0
+	}
+
+	n, err := tl.dst.Write(p[:allowed])
+	tl.written += int64(n)
+	tl.tracker.Add(tl.key, tl.direction, int64(n), tl.now())
+	if err != nil {
+		return n, err
+	}
+
+	if reason != "" {
+		tl.exceeded = true
+		if tl.onExceeded != nil {
+			tl.onExceeded(reason, tl.written)
+		}
+		return n, errTransferCapExceeded
+	}
+	return n, nil
+}
+
+// transferLimits returns the per-connection limit and daily quota for a
+// direction; only responses have a per-connection limit.
+func (fw *Firewall) transferLimits(direction TransferDirection) (int64, int64) {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	if direction == TransferIn {
+		return 0, fw.rules.DailyIngressQuotaBytes
+	}
+	return fw.rules.MaxResponseBytesPerConnection, fw.rules.DailyEgressQuotaBytes
+}
+
+// transferQuotaExceeded reports which daily quota, if any, key has used up.
+func (fw *Firewall) transferQuotaExceeded(key string) (TransferDirection, bool) {
+	in, out := fw.transfers.Used(key, fw.clock.Now())
+	if _, quota := fw.transferLimits(TransferOut); quota > 0 && out >= quota {
+		return TransferOut, true
+	}
+	if _, quota := fw.transferLimits(TransferIn); quota > 0 && in >= quota {
+		return TransferIn, true
+	}
+	return 0, false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TrustCookieName                 = "fw_trust"
+	DefaultTrustRateLimitMultiplier = 5
+)
+
+// TrustCookieConfig gives clients holding a valid fw_trust cookie, which the
+// chat sets once a user has logged in, RateLimitMultiplier times the usual
+// per-minute budget. Users behind a shared IP then aren't locked out by their
+// neighbours' traffic. The cookie is only read from the request head, so a
+// client over the plain limit has it checked before being refused.
+type TrustCookieConfig struct {
+	Enabled             bool `json:"enabled"`
+	RateLimitMultiplier int  `json:"rate_limit_multiplier"`
+}
+
+func normalizeTrustCookieConfig(config TrustCookieConfig) TrustCookieConfig {
+	if config.RateLimitMultiplier <= 1 {
+		config.RateLimitMultiplier = DefaultTrustRateLimitMultiplier
+	}
+	return config
+}
+
+// TrustCookies verifies fw_trust cookies. The chat signs them with the secret
+// it shares with the firewall through TRUST_COOKIE_SECRET:
+//
+//	payload = "<user>|<expiry, unix seconds>"
+//	value   = base64url(payload) + "." + base64url(HMAC-SHA256(secret, payload))
+//
+// both base64url without padding. Without a secret no cookie is trusted.
+type TrustCookies struct {
+	secret []byte
+}
+
+func NewTrustCookies(secret string) *TrustCookies {
+	return &TrustCookies{secret: []byte(secret)}
+}
+
+func (tc *TrustCookies) sign(payload string) string {
+	mac := hmac.New(sha256.New, tc.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a cookie value for user, valid until expiry. The firewall
+// never sets the cookie itself; this is the reference for the chat's side.
+func (tc *TrustCookies) Issue(user string, expiry time.Time) string {
+	payload := user + "|" + strconv.FormatInt(expiry.Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + tc.sign(payload)
+}
+
+// Verify checks that value is genuine and unexpired at now, and returns the
+// user it names.
+func (tc *TrustCookies) Verify(value string, now time.Time) (string, error) {
+	if len(tc.secret) == 0 {
+		return "", fmt.Errorf("no TRUST_COOKIE_SECRET configured")
+	}
+	encoded, signature, found := strings.Cut(strings.TrimSpace(value), ".")
+	if !found {
+		return "", fmt.Errorf("malformed cookie")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed cookie")
+	}
+	payload := string(raw)
+	if !hmac.Equal([]byte(signature), []byte(tc.sign(payload))) {
+		return "", fmt.Errorf("invalid signature")
+	}
+
+	user, expiryField, found := strings.Cut(payload, "|")
+	expiryUnix, err := strconv.ParseInt(expiryField, 10, 64)
+	if !found || err != nil || user == "" {
+		return "", fmt.Errorf("malformed cookie")
+	}
+	if expiry := time.Unix(expiryUnix, 0); now.After(expiry) {
+		return "", fmt.Errorf("cookie expired at %s", expiry.UTC().Format(time.RFC3339))
+	}
+	return user, nil
+}
+
+func (fw *Firewall) trustCookieConfig() TrustCookieConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.TrustCookies
+}
+
+// trustedUser returns the user named by the request's fw_trust cookie.
+func (fw *Firewall) trustedUser(head *RequestHead) (string, error) {
+	if head == nil || head.Opaque {
+		return "", fmt.Errorf("no request head")
+	}
+	cookie, err := (&http.Request{Header: head.Header}).Cookie(TrustCookieName)
+	if err != nil {
+		return "", fmt.Errorf("no %s cookie", TrustCookieName)
+	}
+	user, err := fw.trustCookies.Verify(cookie.Value, fw.clock.Now())
+	if err == nil && fw.abuseReports.IsDistrusted(user, fw.clock.Now()) {
+		return "", fmt.Errorf("user %s was reported for abuse", user)
+	}
+	return user, err
+}
+
+// withinTrustedLimit reports whether key's attempts in the last minute, this
+// one included, fit the relaxed budget of a trusted session.
+func (fw *Firewall) withinTrustedLimit(key string, config TrustCookieConfig) (int, int, bool) {
+	fw.attemptsMutex.RLock()
+	attempts := len(fw.connectionAttempts[key])
+	fw.attemptsMutex.RUnlock()
+
+	attempts += fw.remoteAttempts(key)
+	limit := fw.perMinuteLimit(key) * config.RateLimitMultiplier
+	return attempts, limit, attempts <= limit
+}
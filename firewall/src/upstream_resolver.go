@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+type resolvedUpstream struct {
+	addresses []string
+	expires   time.Time
+}
+
+// UpstreamResolver caches what upstream names resolve to. Failed lookups are
+// never cached: while a name doesn't resolve, its last known addresses keep
+// being used, so a negative answer during a container restart can't outlast
+// the restart.
+type UpstreamResolver struct {
+	mutex   sync.Mutex
+	entries map[string]resolvedUpstream
+}
+
+func NewUpstreamResolver() *UpstreamResolver {
+	return &UpstreamResolver{entries: make(map[string]resolvedUpstream)}
+}
+
+// resolveUpstream returns the addresses of host, from the cache unless it has
+// expired or refresh is set.
+func (fw *Firewall) resolveUpstream(ctx context.Context, host string, config UpstreamDialConfig, refresh bool) ([]string, error) {
+	now := fw.clock.Now()
+	resolver := fw.upstreamResolver
+
+	resolver.mutex.Lock()
+	cached, found := resolver.entries[host]
+	resolver.mutex.Unlock()
+	if found && !refresh && now.Before(cached.expires) {
+		return cached.addresses, nil
+	}
+
+	addresses, err := fw.lookupHost(ctx, host)
+	if err == nil && len(addresses) == 0 {
+		err = fmt.Errorf("no addresses for %s", host)
+	}
+	if err != nil {
+		if found {
+			fw.logErrorRateLimited("upstream_resolve_"+host, "PROXY", "Failed to resolve %s: %v - using last known %v", host, err, cached.addresses)
+			return cached.addresses, nil
+		}
+		return nil, err
+	}
+
+	sorted := append([]string(nil), addresses...)
+	sort.Strings(sorted)
+	resolver.mutex.Lock()
+	resolver.entries[host] = resolvedUpstream{addresses: addresses, expires: now.Add(time.Duration(config.ResolveTTLSeconds) * time.Second)}
+	resolver.mutex.Unlock()
+
+	if found && fw.logger != nil {
+		previous := append([]string(nil), cached.addresses...)
+		sort.Strings(previous)
+		if !slices.Equal(previous, sorted) {
+			fw.logger.LogInfo("PROXY", "Upstream %s now resolves to %v (was %v)", host, addresses, cached.addresses)
+		}
+	}
+	return addresses, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UpstreamTLS encrypts the firewall-to-reverse-proxy leg. CAFile replaces the
+// system roots for verifying the upstream; CertFile and KeyFile present a
+// client certificate for mTLS. ServerName defaults to the upstream host.
+type UpstreamTLS struct {
+	Enabled            bool   `json:"enabled"`
+	ServerName         string `json:"server_name,omitempty"`
+	CAFile             string `json:"ca_file,omitempty"`
+	CertFile           string `json:"cert_file,omitempty"`
+	KeyFile            string `json:"key_file,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+func normalizeUpstreamTLS(config UpstreamTLS) UpstreamTLS {
+	config.ServerName = strings.TrimSpace(config.ServerName)
+	config.CAFile = strings.TrimSpace(config.CAFile)
+	config.CertFile = strings.TrimSpace(config.CertFile)
+	config.KeyFile = strings.TrimSpace(config.KeyFile)
+	return config
+}
+
+// clientConfig builds the tls.Config for dialing host.
+func (config UpstreamTLS) clientConfig(host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file must be set together")
+	}
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// UpstreamTLSConfigs caches built tls.Configs, so certificates are read once
+// per rules reload rather than per connection.
+type UpstreamTLSConfigs struct {
+	mutex   sync.Mutex
+	configs map[string]*tls.Config
+}
+
+func NewUpstreamTLSConfigs() *UpstreamTLSConfigs {
+	return &UpstreamTLSConfigs{configs: make(map[string]*tls.Config)}
+}
+
+func (uc *UpstreamTLSConfigs) Get(config UpstreamTLS, host string) (*tls.Config, error) {
+	key := fmt.Sprintf("%+v|%s", config, host)
+
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+
+	if tlsConfig, cached := uc.configs[key]; cached {
+		return tlsConfig, nil
+	}
+	tlsConfig, err := config.clientConfig(host)
+	if err != nil {
+		return nil, err
+	}
+	uc.configs[key] = tlsConfig
+	return tlsConfig, nil
+}
+
+// Reset drops the cached configs, picking up replaced certificates.
+func (uc *UpstreamTLSConfigs) Reset() {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+
+	uc.configs = make(map[string]*tls.Config)
+}
+
+// upstreamTLSFor returns the TLS settings for upstream reached through the
+// listener on port: the upstream's own, else the listener's, else the global
+// upstream_tls.
+func (fw *Firewall) upstreamTLSFor(upstream Upstream, port int) UpstreamTLS {
+	if upstream.TLS != nil {
+		return *upstream.TLS
+	}
+
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	if config, exists := fw.rules.ListenerUpstreamTLS[port]; exists {
+		return config
+	}
+	return fw.rules.UpstreamTLS
+}
+
+// connectUpstream dials upstream, applies the upstream socket options and, if
+// configured, completes a TLS handshake with it.
+func (fw *Firewall) connectUpstream(ctx context.Context, upstream Upstream, port int, timeout time.Duration) (net.Conn, error) {
+	config := fw.upstreamTLSFor(upstream, port)
+	var tlsConfig *tls.Config
+	if config.Enabled {
+		var err error
+		if tlsConfig, err = fw.upstreamTLS.Get(config, upstream.Host); err != nil {
+			return nil, fmt.Errorf("upstream TLS: %v", err)
+		}
+	}
+
+	conn, err := fw.dialUpstream(ctx, upstream.Addr(), timeout)
+	if err != nil {
+		return nil, err
+	}
+	fw.applySocketOptions(conn, fw.socketOptions().Upstream, "upstream")
+	if tlsConfig == nil {
+		return conn, nil
+	}
+
+	handshakeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake: %v", err)
+	}
+	return tlsConn, nil
+}
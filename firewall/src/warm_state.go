@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	DefaultWarmStatePath         = "/var/log/shared/firewall/state.json"
+	DefaultWarmStateSaveInterval = 60
+	DefaultWarmStateMaxAge       = 60
+)
+
+// WarmStateConfig saves rate-limit counters, auto-blocks and top talkers to
+// Path on shutdown, and every SaveIntervalSeconds in case the container is
+// killed, then restores them at startup so restarting the firewall during an
+// attack doesn't reset every attacker's budget. A file older than
+// MaxAgeMinutes is ignored.
+type WarmStateConfig struct {
+	Enabled             bool   `json:"enabled"`
+	Path                string `json:"path"`
+	SaveIntervalSeconds int    `json:"save_interval_seconds"`
+	MaxAgeMinutes       int    `json:"max_age_minutes"`
+}
+
+func normalizeWarmStateConfig(config WarmStateConfig) WarmStateConfig {
+	if config.Path == "" {
+		config.Path = DefaultWarmStatePath
+	}
+	if config.SaveIntervalSeconds <= 0 {
+		config.SaveIntervalSeconds = DefaultWarmStateSaveInterval
+	}
+	if config.MaxAgeMinutes <= 0 {
+		config.MaxAgeMinutes = DefaultWarmStateMaxAge
+	}
+	return config
+}
+
+func (fw *Firewall) warmStateConfig() WarmStateConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.WarmState
+}
+
+type warmState struct {
+	SavedAt            time.Time              `json:"saved_at"`
+	ConnectionAttempts map[string][]time.Time `json:"connection_attempts"`
+	HourlyAttempts     map[string][]time.Time `json:"hourly_attempts"`
+	EndpointAttempts   map[string][]time.Time `json:"endpoint_attempts"`
+	LoginFailures      map[string][]time.Time `json:"login_failures"`
+	SynFlood           map[string][]time.Time `json:"syn_flood"`
+	AutoBlocks         map[string]time.Time   `json:"auto_blocks"`
+	Traffic            TrafficStatsState      `json:"traffic"`
+}
+
+func copyHistory(history map[string][]time.Time) map[string][]time.Time {
+	copied := make(map[string][]time.Time, len(history))
+	for key, times := range history {
+		copied[key] = append([]time.Time(nil), times...)
+	}
+	return copied
+}
+
+// restoreHistory merges the parts of saved younger than window into history
+// and returns the keys it added.
+func restoreHistory(history, saved map[string][]time.Time, now time.Time, window time.Duration) []string {
+	var added []string
+	for key, times := range saved {
+		var valid []time.Time
+		for _, t := range times {
+			if now.Sub(t) < window {
+				valid = append(valid, t)
+			}
+		}
+		if len(valid) == 0 {
+			continue
+		}
+		if _, exists := history[key]; !exists {
+			added = append(added, key)
+		}
+		history[key] = append(valid, history[key]...)
+	}
+	return added
+}
+
+func (fw *Firewall) captureWarmState() warmState {
+	state := warmState{SavedAt: fw.clock.Now()}
+
+	fw.attemptsMutex.RLock()
+	state.ConnectionAttempts = copyHistory(fw.connectionAttempts)
+	state.HourlyAttempts = copyHistory(fw.hourlyAttempts)
+	state.EndpointAttempts = copyHistory(fw.endpointAttempts)
+	state.LoginFailures = copyHistory(fw.loginFailures)
+	state.AutoBlocks = make(map[string]time.Time, len(fw.autoBlockedIPs))
+	for key, until := range fw.autoBlockedIPs {
+		state.AutoBlocks[key] = until
+	}
+	fw.attemptsMutex.RUnlock()
+
+	fw.synFloodMutex.RLock()
+	state.SynFlood = copyHistory(fw.synFloodTracker)
+	fw.synFloodMutex.RUnlock()
+
+	state.Traffic = fw.trafficStats.State()
+	return state
+}
+
+func (fw *Firewall) saveWarmState(config WarmStateConfig) error {
+	data, err := json.Marshal(fw.captureWarmState())
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %v", err)
+	}
+	if err := writeFileAtomic(config.Path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", config.Path, err)
+	}
+	return nil
+}
+
+// loadWarmState restores the state saved at config.Path, dropping whatever
+// has expired since, and reports whether there was any to restore. A missing
+// file is not an error.
+func (fw *Firewall) loadWarmState(config WarmStateConfig) (bool, error) {
+	data, err := os.ReadFile(config.Path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %v", config.Path, err)
+	}
+
+	var state warmState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return false, fmt.Errorf("failed to parse %s: %v", config.Path, err)
+	}
+	now := fw.clock.Now()
+	age := now.Sub(state.SavedAt)
+	if age > time.Duration(config.MaxAgeMinutes)*time.Minute {
+		if fw.logger != nil {
+			fw.logger.LogStartup("Ignoring warm state saved %v ago", age.Round(time.Second))
+		}
+		return false, nil
+	}
+
+	fw.attemptsMutex.Lock()
+	clients := restoreHistory(fw.connectionAttempts, state.ConnectionAttempts, now, time.Minute)
+	for _, key := range clients {
+		fw.trackedIPs.Touch(key)
+	}
+	restoreHistory(fw.hourlyAttempts, state.HourlyAttempts, now, time.Hour)
+	restoreHistory(fw.endpointAttempts, state.EndpointAttempts, now, time.Minute)
+	restoreHistory(fw.loginFailures, state.LoginFailures, now, time.Hour)
+	blocks := 0
+	for key, until := range state.AutoBlocks {
+		if until.After(now) && until.After(fw.autoBlockedIPs[key]) {
+			fw.autoBlockedIPs[key] = until
+			blocks++
+		}
+	}
+	fw.attemptsMutex.Unlock()
+
+	fw.synFloodMutex.Lock()
+	restoreHistory(fw.synFloodTracker, state.SynFlood, now, SynFloodWindow)
+	fw.synFloodMutex.Unlock()
+
+	fw.trafficStats.Restore(state.Traffic)
+
+	if fw.logger != nil {
+		fw.logger.LogStartup("Restored warm state saved %v ago: %d rate-limited clients, %d auto-blocks",
+			age.Round(time.Second), len(clients), blocks)
+	}
+	return true, nil
+}
+
+func (fw *Firewall) warmStateWatcher() {
+	elapsed := 0
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fw.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		config := fw.warmStateConfig()
+		if !config.Enabled {
+			continue
+		}
+		elapsed++
+		if elapsed < config.SaveIntervalSeconds {
+			continue
+		}
+		elapsed = 0
+		if err := fw.saveWarmState(config); err != nil {
+			fw.logErrorRateLimited("warm_state", "STATE", "Failed to save warm state: %v", err)
+		}
+	}
+}
@@ -0,0 +1,1242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// A small WebAssembly interpreter for filters: the 1.0 instruction set plus
+// sign extension, saturating truncation and memory.copy/fill, with one
+// memory, one funcref table and host functions as the only imports. Every
+// instruction costs one unit of fuel, so a filter can't hold a connection
+// up forever.
+
+const (
+	wasmI32 = 0x7f
+	wasmI64 = 0x7e
+	wasmF32 = 0x7d
+	wasmF64 = 0x7c
+
+	wasmPageSize     = 64 * 1024
+	wasmMaxCallDepth = 256
+)
+
+var (
+	errWasmMalformed  = errors.New("wasm: malformed module")
+	errWasmOutOfFuel  = errors.New("wasm: fuel exhausted")
+	errWasmOutOfRange = errors.New("wasm: memory access out of bounds")
+)
+
+type wasmFuncType struct {
+	params, results []byte
+}
+
+func (ft wasmFuncType) equal(other wasmFuncType) bool {
+	return bytes.Equal(ft.params, other.params) && bytes.Equal(ft.results, other.results)
+}
+
+type wasmImport struct {
+	module, name string
+	typeIdx      uint32
+}
+
+type wasmGlobal struct {
+	init uint64
+}
+
+// wasmBlock locates the else and end of a block, loop or if.
+type wasmBlock struct {
+	elsePC, endPC int
+}
+
+type wasmFunction struct {
+	typeIdx uint32
+	locals  int
+	body    []byte
+	blocks  map[int]wasmBlock
+}
+
+type wasmSegment struct {
+	offset uint32
+	funcs  []uint32
+	data   []byte
+}
+
+type wasmExport struct {
+	kind  byte
+	index uint32
+}
+
+// wasmModule is a decoded module; instances are created from it per call.
+type wasmModule struct {
+	types     []wasmFuncType
+	imports   []wasmImport
+	functions []wasmFunction
+	tableMin  uint32
+	elements  []wasmSegment
+	hasMemory bool
+	memMin    uint32
+	memMax    uint32
+	globals   []wasmGlobal
+	exports   map[string]wasmExport
+	data      []wasmSegment
+	start     int
+}
+
+// wasmReader reads the binary format; the first error sticks, and reads
+// after it return zero values.
+type wasmReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *wasmReader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: "+format, append([]interface{}{errWasmMalformed}, args...)...)
+	}
+}
+
+func (r *wasmReader) byte() byte {
+	if r.err != nil || r.pos >= len(r.data) {
+		r.fail("unexpected end")
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *wasmReader) bytes(n uint32) []byte {
+	if r.err != nil || uint64(r.pos)+uint64(n) > uint64(len(r.data)) {
+		r.fail("unexpected end")
+		return nil
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
+
+func (r *wasmReader) leb(signed bool, size uint) uint64 {
+	var result uint64
+	var shift uint
+	for {
+		b := r.byte()
+		if r.err != nil {
+			return 0
+		}
+		result |= uint64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			if signed && shift < 64 && b&0x40 != 0 {
+				result |= ^uint64(0) << shift
+			}
+			return result
+		}
+		if shift >= size+7 {
+			r.fail("integer too long")
+			return 0
+		}
+	}
+}
+
+func (r *wasmReader) u32() uint32 { return uint32(r.leb(false, 32)) }
+func (r *wasmReader) s32() int32  { return int32(r.leb(true, 32)) }
+func (r *wasmReader) s64() int64  { return int64(r.leb(true, 64)) }
+
+func (r *wasmReader) name() string {
+	return string(r.bytes(r.u32()))
+}
+
+func (r *wasmReader) valueType() byte {
+	t := r.byte()
+	if t != wasmI32 && t != wasmI64 && t != wasmF32 && t != wasmF64 {
+		r.fail("unsupported value type 0x%x", t)
+	}
+	return t
+}
+
+func (r *wasmReader) limits() (min, max uint32, hasMax bool) {
+	switch flag := r.byte(); flag {
+	case 0:
+		return r.u32(), 0, false
+	case 1:
+		return r.u32(), r.u32(), true
+	default:
+		r.fail("unsupported limits 0x%x", flag)
+		return 0, 0, false
+	}
+}
+
+// constExpr reads an initializer: a single constant followed by end.
+func (r *wasmReader) constExpr() uint64 {
+	var value uint64
+	switch op := r.byte(); op {
+	case 0x41:
+		value = uint64(uint32(r.s32()))
+	case 0x42:
+		value = uint64(r.s64())
+	case 0x43:
+		value = uint64(binary.LittleEndian.Uint32(r.bytes(4)))
+	case 0x44:
+		value = binary.LittleEndian.Uint64(r.bytes(8))
+	default:
+		r.fail("unsupported initializer 0x%x", op)
+	}
+	if r.byte() != 0x0b {
+		r.fail("initializer not ended")
+	}
+	return value
+}
+
+func decodeWasmModule(data []byte) (*wasmModule, error) {
+	if len(data) < 8 || !bytes.Equal(data[:4], []byte("\x00asm")) || binary.LittleEndian.Uint32(data[4:8]) != 1 {
+		return nil, fmt.Errorf("%w: not a version 1 wasm binary", errWasmMalformed)
+	}
+	r := &wasmReader{data: data, pos: 8}
+
+	m := &wasmModule{exports: make(map[string]wasmExport), start: -1}
+	var funcTypes []uint32
+	for r.err == nil && r.pos < len(r.data) {
+		id := r.byte()
+		section := &wasmReader{data: r.bytes(r.u32())}
+		if r.err != nil {
+			break
+		}
+		switch id {
+		case 0, 12:
+			// Custom sections and the data count aren't needed.
+		case 1:
+			for n := section.u32(); n > 0 && section.err == nil; n-- {
+				if section.byte() != 0x60 {
+					section.fail("bad function type")
+				}
+				var ft wasmFuncType
+				for i := section.u32(); i > 0 && section.err == nil; i-- {
+					ft.params = append(ft.params, section.valueType())
+				}
+				for i := section.u32(); i > 0 && section.err == nil; i-- {
+					ft.results = append(ft.results, section.valueType())
+				}
+				m.types = append(m.types, ft)
+			}
+		case 2:
+			for n := section.u32(); n > 0 && section.err == nil; n-- {
+				imp := wasmImport{module: section.name(), name: section.name()}
+				if kind := section.byte(); kind != 0 {
+					section.fail("import %s.%s: only functions can be imported", imp.module, imp.name)
+				}
+				imp.typeIdx = section.u32()
+				m.imports = append(m.imports, imp)
+			}
+		case 3:
+			for n := section.u32(); n > 0 && section.err == nil; n-- {
+				funcTypes = append(funcTypes, section.u32())
+			}
+		case 4:
+			if n := section.u32(); n > 1 {
+				section.fail("more than one table")
+			} else if n == 1 {
+				if section.byte() != 0x70 {
+					section.fail("table is not funcref")
+				}
+				m.tableMin, _, _ = section.limits()
+			}
+		case 5:
+			if n := section.u32(); n > 1 {
+				section.fail("more than one memory")
+			} else if n == 1 {
+				var hasMax bool
+				m.hasMemory = true
+				m.memMin, m.memMax, hasMax = section.limits()
+				if !hasMax {
+					m.memMax = 65536
+				}
+			}
+		case 6:
+			for n := section.u32(); n > 0 && section.err == nil; n-- {
+				section.valueType()
+				section.byte()
+				m.globals = append(m.globals, wasmGlobal{init: section.constExpr()})
+			}
+		case 7:
+			for n := section.u32(); n > 0 && section.err == nil; n-- {
+				name := section.name()
+				m.exports[name] = wasmExport{kind: section.byte(), index: section.u32()}
+			}
+		case 8:
+			m.start = int(section.u32())
+		case 9:
+			for n := section.u32(); n > 0 && section.err == nil; n-- {
+				if flag := section.u32(); flag != 0 {
+					section.fail("unsupported element segment 0x%x", flag)
+				}
+				segment := wasmSegment{offset: uint32(section.constExpr())}
+				for i := section.u32(); i > 0 && section.err == nil; i-- {
+					segment.funcs = append(segment.funcs, section.u32())
+				}
+				m.elements = append(m.elements, segment)
+			}
+		case 10:
+			n := section.u32()
+			if int(n) != len(funcTypes) {
+				section.fail("%d function bodies for %d functions", n, len(funcTypes))
+			}
+			for i := uint32(0); i < n && section.err == nil; i++ {
+				body := &wasmReader{data: section.bytes(section.u32())}
+				fn := wasmFunction{typeIdx: funcTypes[i]}
+				for groups := body.u32(); groups > 0 && body.err == nil; groups-- {
+					count := body.u32()
+					body.valueType()
+					fn.locals += int(count)
+					if fn.locals > 50000 {
+						body.fail("too many locals")
+					}
+				}
+				if body.err != nil {
+					section.fail("function %d: %v", i, body.err)
+					break
+				}
+				fn.body = body.data[body.pos:]
+				blocks, err := scanWasmBody(fn.body)
+				if err != nil {
+					section.fail("function %d: %v", i, err)
+					break
+				}
+				fn.blocks = blocks
+				m.functions = append(m.functions, fn)
+			}
+		case 11:
+			for n := section.u32(); n > 0 && section.err == nil; n-- {
+				flag := section.u32()
+				if flag == 2 && section.u32() != 0 {
+					section.fail("data segment for a second memory")
+				} else if flag == 1 || flag > 2 {
+					section.fail("unsupported data segment 0x%x", flag)
+				}
+				offset := uint32(section.constExpr())
+				m.data = append(m.data, wasmSegment{offset: offset, data: section.bytes(section.u32())})
+			}
+		default:
+			section.fail("unknown section %d", id)
+		}
+		if section.err != nil {
+			return nil, section.err
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return m, m.validate()
+}
+
+// validate checks the indices the interpreter would otherwise trip over.
+func (m *wasmModule) validate() error {
+	funcs := uint32(len(m.imports) + len(m.functions))
+	for _, imp := range m.imports {
+		if imp.typeIdx >= uint32(len(m.types)) {
+			return fmt.Errorf("%w: import %s.%s has no type", errWasmMalformed, imp.module, imp.name)
+		}
+	}
+	for i, fn := range m.functions {
+		if fn.typeIdx >= uint32(len(m.types)) {
+			return fmt.Errorf("%w: function %d has no type", errWasmMalformed, i)
+		}
+	}
+	for _, segment := range m.elements {
+		for _, f := range segment.funcs {
+			if f >= funcs {
+				return fmt.Errorf("%w: element refers to function %d", errWasmMalformed, f)
+			}
+		}
+	}
+	for name, export := range m.exports {
+		if export.kind == 0 && export.index >= funcs {
+			return fmt.Errorf("%w: export %q refers to function %d", errWasmMalformed, name, export.index)
+		}
+	}
+	if m.start >= int(funcs) {
+		return fmt.Errorf("%w: start function %d", errWasmMalformed, m.start)
+	}
+	if len(m.data) > 0 && !m.hasMemory {
+		return fmt.Errorf("%w: data without a memory", errWasmMalformed)
+	}
+	return nil
+}
+
+// blockType reads a block signature: how many values the block takes and
+// leaves.
+func (m *wasmModule) blockType(body []byte, pc *int) (params, results int) {
+	r := &wasmReader{data: body, pos: *pc}
+	switch b := body[*pc]; {
+	case b == 0x40:
+		r.pos++
+	case b == wasmI32 || b == wasmI64 || b == wasmF32 || b == wasmF64:
+		r.pos++
+		results = 1
+	default:
+		idx := r.leb(true, 33)
+		if idx >= uint64(len(m.types)) {
+			panic(wasmTrap("bad block type"))
+		}
+		params, results = len(m.types[idx].params), len(m.types[idx].results)
+	}
+	*pc = r.pos
+	return params, results
+}
+
+// scanWasmBody walks a function body once, checking every instruction is
+// supported and recording where each block's else and end are.
+func scanWasmBody(body []byte) (map[int]wasmBlock, error) {
+	blocks := make(map[int]wasmBlock)
+	var open []int
+	r := &wasmReader{data: body}
+	for r.err == nil && r.pos < len(body) {
+		at := r.pos
+		op := r.byte()
+		switch {
+		case op == 0x02 || op == 0x03 || op == 0x04:
+			if b := r.byte(); b != 0x40 && b != wasmI32 && b != wasmI64 && b != wasmF32 && b != wasmF64 {
+				r.pos--
+				r.leb(true, 33)
+			}
+			open = append(open, at)
+		case op == 0x05:
+			if len(open) == 0 || body[open[len(open)-1]] != 0x04 {
+				return nil, fmt.Errorf("else outside if")
+			}
+			block := blocks[open[len(open)-1]]
+			block.elsePC = at
+			blocks[open[len(open)-1]] = block
+		case op == 0x0b:
+			if len(open) == 0 {
+				if r.pos != len(body) {
+					return nil, fmt.Errorf("code after the final end")
+				}
+				return blocks, nil
+			}
+			block := blocks[open[len(open)-1]]
+			block.endPC = at
+			blocks[open[len(open)-1]] = block
+			open = open[:len(open)-1]
+		case op == 0x00 || op == 0x01 || op == 0x0f || op == 0x1a || op == 0x1b || (op >= 0x45 && op <= 0xc4):
+		case op == 0x0c || op == 0x0d || op == 0x10 || (op >= 0x20 && op <= 0x24):
+			r.u32()
+		case op == 0x0e:
+			for n := r.u32(); n > 0 && r.err == nil; n-- {
+				r.u32()
+			}
+			r.u32()
+		case op == 0x11:
+			r.u32()
+			if r.byte() != 0 {
+				return nil, fmt.Errorf("call_indirect on a second table")
+			}
+		case op == 0x1c:
+			for n := r.u32(); n > 0 && r.err == nil; n-- {
+				r.valueType()
+			}
+		case op >= 0x28 && op <= 0x3e:
+			r.u32()
+			r.u32()
+		case op == 0x3f || op == 0x40:
+			r.byte()
+		case op == 0x41:
+			r.s32()
+		case op == 0x42:
+			r.s64()
+		case op == 0x43:
+			r.bytes(4)
+		case op == 0x44:
+			r.bytes(8)
+		case op == 0xfc:
+			switch sub := r.u32(); {
+			case sub <= 7:
+			case sub == 10:
+				r.byte()
+				r.byte()
+			case sub == 11:
+				r.byte()
+			default:
+				return nil, fmt.Errorf("unsupported instruction 0xfc %d", sub)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported instruction 0x%02x", op)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return nil, fmt.Errorf("function body not ended")
+}
+
+// wasmTrap aborts execution; Call turns it into an error.
+type wasmTrap string
+
+// wasmHostFunc implements an imported function.
+type wasmHostFunc func(inst *wasmInstance, args []uint64) []uint64
+
+type wasmInstance struct {
+	module  *wasmModule
+	memory  []byte
+	memMax  uint32
+	globals []uint64
+	table   []int64
+	host    []wasmHostFunc
+	stack   []uint64
+	fuel    int64
+	depth   int
+}
+
+// instantiateWasm links m to host, keyed "module.name", and lays out its
+// memory, at most maxPages, table and globals.
+func instantiateWasm(m *wasmModule, host map[string]wasmHostFunc, maxPages uint32, fuel int64) (*wasmInstance, error) {
+	inst := &wasmInstance{module: m, fuel: fuel, stack: make([]uint64, 0, 256)}
+	for _, imp := range m.imports {
+		fn, found := host[imp.module+"."+imp.name]
+		if !found {
+			return nil, fmt.Errorf("wasm: unknown import %s.%s", imp.module, imp.name)
+		}
+		inst.host = append(inst.host, fn)
+	}
+
+	if m.hasMemory {
+		inst.memMax = m.memMax
+		if inst.memMax > maxPages {
+			inst.memMax = maxPages
+		}
+		if m.memMin > inst.memMax {
+			return nil, fmt.Errorf("wasm: module needs %d memory pages, the limit is %d", m.memMin, inst.memMax)
+		}
+		inst.memory = make([]byte, int(m.memMin)*wasmPageSize)
+	}
+	for _, segment := range m.data {
+		if uint64(segment.offset)+uint64(len(segment.data)) > uint64(len(inst.memory)) {
+			return nil, fmt.Errorf("wasm: data segment out of bounds")
+		}
+		copy(inst.memory[segment.offset:], segment.data)
+	}
+
+	inst.table = make([]int64, m.tableMin)
+	for i := range inst.table {
+		inst.table[i] = -1
+	}
+	for _, segment := range m.elements {
+		if uint64(segment.offset)+uint64(len(segment.funcs)) > uint64(len(inst.table)) {
+			return nil, fmt.Errorf("wasm: element segment out of bounds")
+		}
+		for i, f := range segment.funcs {
+			inst.table[int(segment.offset)+i] = int64(f)
+		}
+	}
+
+	for _, global := range m.globals {
+		inst.globals = append(inst.globals, global.init)
+	}
+	if m.start >= 0 {
+		if _, err := inst.invoke(uint32(m.start)); err != nil {
+			return nil, err
+		}
+	}
+	return inst, nil
+}
+
+// Call runs the exported function name.
+func (inst *wasmInstance) Call(name string, args ...uint64) ([]uint64, error) {
+	export, found := inst.module.exports[name]
+	if !found || export.kind != 0 {
+		return nil, fmt.Errorf("wasm: no exported function %q", name)
+	}
+	if n := len(inst.funcType(export.index).params); n != len(args) {
+		return nil, fmt.Errorf("wasm: %s takes %d arguments, not %d", name, n, len(args))
+	}
+	inst.stack = append(inst.stack[:0], args...)
+	return inst.invoke(export.index)
+}
+
+func (inst *wasmInstance) invoke(idx uint32) (results []uint64, err error) {
+	// A module that slipped past decoding can still index out of range; that
+	// fails the call like any trap rather than the firewall.
+	defer func() {
+		if r := recover(); r != nil {
+			switch r := r.(type) {
+			case wasmTrap:
+				err = fmt.Errorf("wasm: %s", string(r))
+			case error:
+				if errors.Is(r, errWasmOutOfFuel) || errors.Is(r, errWasmOutOfRange) {
+					err = r
+				} else {
+					err = fmt.Errorf("wasm: %v", r)
+				}
+			default:
+				err = fmt.Errorf("wasm: %v", r)
+			}
+			inst.stack = inst.stack[:0]
+		}
+	}()
+	inst.call(idx)
+	n := len(inst.funcType(idx).results)
+	results = append([]uint64(nil), inst.stack[len(inst.stack)-n:]...)
+	inst.stack = inst.stack[:0]
+	return results, nil
+}
+
+// Memory returns n bytes of memory at ptr, or nil when out of bounds.
+func (inst *wasmInstance) Memory(ptr, n uint32) []byte {
+	if uint64(ptr)+uint64(n) > uint64(len(inst.memory)) {
+		return nil
+	}
+	return inst.memory[ptr : ptr+n]
+}
+
+func (inst *wasmInstance) funcType(idx uint32) wasmFuncType {
+	m := inst.module
+	if idx < uint32(len(m.imports)) {
+		return m.types[m.imports[idx].typeIdx]
+	}
+	return m.types[m.functions[idx-uint32(len(m.imports))].typeIdx]
+}
+
+func (inst *wasmInstance) push(v uint64) { inst.stack = append(inst.stack, v) }
+
+func (inst *wasmInstance) pop() uint64 {
+	if len(inst.stack) == 0 {
+		panic(wasmTrap("operand stack underflow"))
+	}
+	v := inst.stack[len(inst.stack)-1]
+	inst.stack = inst.stack[:len(inst.stack)-1]
+	return v
+}
+
+func (inst *wasmInstance) popI32() uint32 { return uint32(inst.pop()) }
+func (inst *wasmInstance) popF32() float32 {
+	return math.Float32frombits(uint32(inst.pop()))
+}
+func (inst *wasmInstance) popF64() float64 { return math.Float64frombits(inst.pop()) }
+func (inst *wasmInstance) pushBool(b bool) {
+	if b {
+		inst.push(1)
+	} else {
+		inst.push(0)
+	}
+}
+func (inst *wasmInstance) pushF32(f float32) { inst.push(uint64(math.Float32bits(f))) }
+func (inst *wasmInstance) pushF64(f float64) { inst.push(math.Float64bits(f)) }
+
+// address returns the memory offset an n-byte access at the popped base
+// plus offset refers to.
+func (inst *wasmInstance) address(base uint32, offset uint32, n uint64) uint64 {
+	ea := uint64(base) + uint64(offset)
+	if ea+n > uint64(len(inst.memory)) {
+		panic(errWasmOutOfRange)
+	}
+	return ea
+}
+
+func (inst *wasmInstance) call(idx uint32) {
+	m := inst.module
+	if idx >= uint32(len(m.imports)+len(m.functions)) {
+		panic(wasmTrap("call to an unknown function"))
+	}
+	ft := inst.funcType(idx)
+	if len(inst.stack) < len(ft.params) {
+		panic(wasmTrap("operand stack underflow"))
+	}
+	if idx < uint32(len(m.imports)) {
+		args := append([]uint64(nil), inst.stack[len(inst.stack)-len(ft.params):]...)
+		inst.stack = inst.stack[:len(inst.stack)-len(ft.params)]
+		results := inst.host[idx](inst, args)
+		if len(results) != len(ft.results) {
+			panic(wasmTrap("host function returned the wrong number of results"))
+		}
+		inst.stack = append(inst.stack, results...)
+		return
+	}
+
+	inst.depth++
+	defer func() { inst.depth-- }()
+	if inst.depth > wasmMaxCallDepth {
+		panic(wasmTrap("call stack exhausted"))
+	}
+	fn := &m.functions[idx-uint32(len(m.imports))]
+	locals := make([]uint64, len(ft.params)+fn.locals)
+	copy(locals, inst.stack[len(inst.stack)-len(ft.params):])
+	inst.stack = inst.stack[:len(inst.stack)-len(ft.params)]
+	inst.run(fn, locals, len(ft.results))
+}
+
+type wasmLabel struct {
+	arity, height, cont int
+	loop                bool
+}
+
+// run executes a function body; labels[0] is the function itself, which a
+// branch to returns from.
+func (inst *wasmInstance) run(fn *wasmFunction, locals []uint64, results int) {
+	body := fn.body
+	labels := []wasmLabel{{arity: results, height: len(inst.stack), cont: len(body)}}
+	pc := 0
+	u32 := func() uint32 {
+		r := &wasmReader{data: body, pos: pc}
+		v := r.u32()
+		pc = r.pos
+		return v
+	}
+	memarg := func() uint32 {
+		u32()
+		return u32()
+	}
+	branch := func(depth uint32) {
+		if int(depth) >= len(labels) {
+			panic(wasmTrap("branch out of range"))
+		}
+		target := labels[len(labels)-1-int(depth)]
+		copy(inst.stack[target.height:], inst.stack[len(inst.stack)-target.arity:])
+		inst.stack = inst.stack[:target.height+target.arity]
+		if target.loop {
+			labels = labels[:len(labels)-int(depth)]
+		} else {
+			labels = labels[:len(labels)-1-int(depth)]
+		}
+		pc = target.cont
+	}
+
+	for len(labels) > 0 {
+		if inst.fuel--; inst.fuel < 0 {
+			panic(errWasmOutOfFuel)
+		}
+		at := pc
+		op := body[pc]
+		pc++
+
+		switch op {
+		case 0x00:
+			panic(wasmTrap("unreachable"))
+		case 0x01:
+		case 0x02, 0x03:
+			params, blockResults := inst.module.blockType(body, &pc)
+			label := wasmLabel{arity: blockResults, height: len(inst.stack) - params, cont: fn.blocks[at].endPC + 1}
+			if op == 0x03 {
+				label = wasmLabel{arity: params, height: len(inst.stack) - params, cont: pc, loop: true}
+			}
+			labels = append(labels, label)
+		case 0x04:
+			params, blockResults := inst.module.blockType(body, &pc)
+			condition := inst.popI32()
+			block := fn.blocks[at]
+			labels = append(labels, wasmLabel{arity: blockResults, height: len(inst.stack) - params, cont: block.endPC + 1})
+			if condition == 0 {
+				if block.elsePC > 0 {
+					pc = block.elsePC + 1
+				} else {
+					pc = block.endPC
+				}
+			}
+		case 0x05:
+			pc = labels[len(labels)-1].cont - 1
+		case 0x0b:
+			labels = labels[:len(labels)-1]
+		case 0x0c:
+			branch(u32())
+		case 0x0d:
+			depth := u32()
+			if inst.popI32() != 0 {
+				branch(depth)
+			}
+		case 0x0e:
+			n := u32()
+			targets := make([]uint32, n)
+			for i := range targets {
+				targets[i] = u32()
+			}
+			fallback := u32()
+			if i := inst.popI32(); i < n {
+				branch(targets[i])
+			} else {
+				branch(fallback)
+			}
+		case 0x0f:
+			branch(uint32(len(labels) - 1))
+		case 0x10:
+			inst.call(u32())
+		case 0x11:
+			ft := inst.module.types[u32()]
+			pc++
+			i := inst.popI32()
+			if i >= uint32(len(inst.table)) || inst.table[i] < 0 {
+				panic(wasmTrap("undefined table element"))
+			}
+			if !inst.funcType(uint32(inst.table[i])).equal(ft) {
+				panic(wasmTrap("indirect call type mismatch"))
+			}
+			inst.call(uint32(inst.table[i]))
+		case 0x1a:
+			inst.pop()
+		case 0x1b, 0x1c:
+			if op == 0x1c {
+				for n := u32(); n > 0; n-- {
+					pc++
+				}
+			}
+			condition := inst.popI32()
+			b, a := inst.pop(), inst.pop()
+			if condition != 0 {
+				inst.push(a)
+			} else {
+				inst.push(b)
+			}
+		case 0x20:
+			inst.push(locals[u32()])
+		case 0x21:
+			locals[u32()] = inst.pop()
+		case 0x22:
+			locals[u32()] = inst.stack[len(inst.stack)-1]
+		case 0x23:
+			inst.push(inst.globals[u32()])
+		case 0x24:
+			inst.globals[u32()] = inst.pop()
+
+		case 0x28, 0x2a:
+			offset := memarg()
+			ea := inst.address(inst.popI32(), offset, 4)
+			inst.push(uint64(binary.LittleEndian.Uint32(inst.memory[ea:])))
+		case 0x29, 0x2b:
+			offset := memarg()
+			ea := inst.address(inst.popI32(), offset, 8)
+			inst.push(binary.LittleEndian.Uint64(inst.memory[ea:]))
+		case 0x2c, 0x2d, 0x30, 0x31:
+			offset := memarg()
+			b := inst.memory[inst.address(inst.popI32(), offset, 1)]
+			switch op {
+			case 0x2c:
+				inst.push(uint64(uint32(int32(int8(b)))))
+			case 0x30:
+				inst.push(uint64(int64(int8(b))))
+			default:
+				inst.push(uint64(b))
+			}
+		case 0x2e, 0x2f, 0x32, 0x33:
+			offset := memarg()
+			h := binary.LittleEndian.Uint16(inst.memory[inst.address(inst.popI32(), offset, 2):])
+			switch op {
+			case 0x2e:
+				inst.push(uint64(uint32(int32(int16(h)))))
+			case 0x32:
+				inst.push(uint64(int64(int16(h))))
+			default:
+				inst.push(uint64(h))
+			}
+		case 0x34, 0x35:
+			offset := memarg()
+			w := binary.LittleEndian.Uint32(inst.memory[inst.address(inst.popI32(), offset, 4):])
+			if op == 0x34 {
+				inst.push(uint64(int64(int32(w))))
+			} else {
+				inst.push(uint64(w))
+			}
+		case 0x36, 0x38, 0x3e:
+			offset := memarg()
+			v := inst.pop()
+			binary.LittleEndian.PutUint32(inst.memory[inst.address(inst.popI32(), offset, 4):], uint32(v))
+		case 0x37, 0x39:
+			offset := memarg()
+			v := inst.pop()
+			binary.LittleEndian.PutUint64(inst.memory[inst.address(inst.popI32(), offset, 8):], v)
+		case 0x3a, 0x3c:
+			offset := memarg()
+			v := inst.pop()
+			inst.memory[inst.address(inst.popI32(), offset, 1)] = byte(v)
+		case 0x3b, 0x3d:
+			offset := memarg()
+			v := inst.pop()
+			binary.LittleEndian.PutUint16(inst.memory[inst.address(inst.popI32(), offset, 2):], uint16(v))
+		case 0x3f:
+			pc++
+			inst.push(uint64(len(inst.memory) / wasmPageSize))
+		case 0x40:
+			pc++
+			delta := inst.popI32()
+			pages := uint32(len(inst.memory) / wasmPageSize)
+			if !inst.module.hasMemory || uint64(pages)+uint64(delta) > uint64(inst.memMax) {
+				inst.push(uint64(uint32(0xffffffff)))
+				break
+			}
+			inst.memory = append(inst.memory, make([]byte, int(delta)*wasmPageSize)...)
+			inst.push(uint64(pages))
+
+		case 0x41:
+			r := &wasmReader{data: body, pos: pc}
+			inst.push(uint64(uint32(r.s32())))
+			pc = r.pos
+		case 0x42:
+			r := &wasmReader{data: body, pos: pc}
+			inst.push(uint64(r.s64()))
+			pc = r.pos
+		case 0x43:
+			inst.push(uint64(binary.LittleEndian.Uint32(body[pc:])))
+			pc += 4
+		case 0x44:
+			inst.push(binary.LittleEndian.Uint64(body[pc:]))
+			pc += 8
+
+		case 0xfc:
+			inst.execMisc(u32(), &pc)
+		default:
+			inst.execNumeric(op)
+		}
+	}
+}
+
+func (inst *wasmInstance) execNumeric(op byte) {
+	switch {
+	case op == 0x45:
+		inst.pushBool(inst.popI32() == 0)
+	case op >= 0x46 && op <= 0x4f:
+		b, a := inst.popI32(), inst.popI32()
+		inst.pushBool(compareInts(op-0x46, int64(int32(a)), int64(int32(b)), uint64(a), uint64(b)))
+	case op == 0x50:
+		inst.pushBool(inst.pop() == 0)
+	case op >= 0x51 && op <= 0x5a:
+		b, a := inst.pop(), inst.pop()
+		inst.pushBool(compareInts(op-0x51, int64(a), int64(b), a, b))
+	case op >= 0x5b && op <= 0x60:
+		b, a := inst.popF32(), inst.popF32()
+		inst.pushBool(compareFloats(op-0x5b, float64(a), float64(b)))
+	case op >= 0x61 && op <= 0x66:
+		b, a := inst.popF64(), inst.popF64()
+		inst.pushBool(compareFloats(op-0x61, a, b))
+
+	case op >= 0x67 && op <= 0x69:
+		a := inst.popI32()
+		switch op {
+		case 0x67:
+			inst.push(uint64(bits.LeadingZeros32(a)))
+		case 0x68:
+			inst.push(uint64(bits.TrailingZeros32(a)))
+		default:
+			inst.push(uint64(bits.OnesCount32(a)))
+		}
+	case op >= 0x6a && op <= 0x78:
+		b, a := inst.popI32(), inst.popI32()
+		inst.push(uint64(uint32(intBinary(op-0x6a, uint64(a), uint64(b), 32))))
+	case op >= 0x79 && op <= 0x7b:
+		a := inst.pop()
+		switch op {
+		case 0x79:
+			inst.push(uint64(bits.LeadingZeros64(a)))
+		case 0x7a:
+			inst.push(uint64(bits.TrailingZeros64(a)))
+		default:
+			inst.push(uint64(bits.OnesCount64(a)))
+		}
+	case op >= 0x7c && op <= 0x8a:
+		b, a := inst.pop(), inst.pop()
+		inst.push(intBinary(op-0x7c, a, b, 64))
+
+	case op >= 0x8b && op <= 0x91:
+		inst.pushF32(float32(floatUnary(op-0x8b, float64(inst.popF32()))))
+	case op >= 0x92 && op <= 0x98:
+		b, a := inst.popF32(), inst.popF32()
+		inst.pushF32(float32(floatBinary(op-0x92, float64(a), float64(b))))
+	case op >= 0x99 && op <= 0x9f:
+		inst.pushF64(floatUnary(op-0x99, inst.popF64()))
+	case op >= 0xa0 && op <= 0xa6:
+		b, a := inst.popF64(), inst.popF64()
+		inst.pushF64(floatBinary(op-0xa0, a, b))
+
+	default:
+		inst.execConversion(op)
+	}
+}
+
+// compareInts implements eq, ne, lt_s, lt_u, gt_s, gt_u, le_s, le_u, ge_s
+// and ge_u, in opcode order.
+func compareInts(k byte, sa, sb int64, ua, ub uint64) bool {
+	switch k {
+	case 0:
+		return ua == ub
+	case 1:
+		return ua != ub
+	case 2:
+		return sa < sb
+	case 3:
+		return ua < ub
+	case 4:
+		return sa > sb
+	case 5:
+		return ua > ub
+	case 6:
+		return sa <= sb
+	case 7:
+		return ua <= ub
+	case 8:
+		return sa >= sb
+	default:
+		return ua >= ub
+	}
+}
+
+func compareFloats(k byte, a, b float64) bool {
+	switch k {
+	case 0:
+		return a == b
+	case 1:
+		return a != b
+	case 2:
+		return a < b
+	case 3:
+		return a > b
+	case 4:
+		return a <= b
+	default:
+		return a >= b
+	}
+}
+
+// intBinary implements add through rotr, in opcode order, on size-bit
+// integers held in a uint64.
+func intBinary(k byte, a, b uint64, size uint) uint64 {
+	signed := func(v uint64) int64 {
+		if size == 32 {
+			return int64(int32(v))
+		}
+		return int64(v)
+	}
+	shift := b % uint64(size)
+	switch k {
+	case 0:
+		return a + b
+	case 1:
+		return a - b
+	case 2:
+		return a * b
+	case 3, 5:
+		if b == 0 {
+			panic(wasmTrap("integer divide by zero"))
+		}
+		sa, sb := signed(a), signed(b)
+		if k == 5 {
+			if sb == -1 {
+				return 0
+			}
+			return uint64(sa % sb)
+		}
+		if sb == -1 && ((size == 32 && sa == math.MinInt32) || (size == 64 && sa == math.MinInt64)) {
+			panic(wasmTrap("integer overflow"))
+		}
+		return uint64(sa / sb)
+	case 4, 6:
+		if b == 0 {
+			panic(wasmTrap("integer divide by zero"))
+		}
+		if size == 32 {
+			a, b = uint64(uint32(a)), uint64(uint32(b))
+		}
+		if k == 4 {
+			return a / b
+		}
+		return a % b
+	case 7:
+		return a & b
+	case 8:
+		return a | b
+	case 9:
+		return a ^ b
+	case 10:
+		return a << shift
+	case 11:
+		return uint64(signed(a) >> shift)
+	case 12:
+		if size == 32 {
+			return uint64(uint32(a) >> shift)
+		}
+		return a >> shift
+	case 13, 14:
+		if k == 14 {
+			shift = -shift
+		}
+		if size == 32 {
+			return uint64(bits.RotateLeft32(uint32(a), int(shift)))
+		}
+		return bits.RotateLeft64(a, int(shift))
+	}
+	return 0
+}
+
+// floatUnary implements abs, neg, ceil, floor, trunc, nearest and sqrt.
+func floatUnary(k byte, a float64) float64 {
+	switch k {
+	case 0:
+		return math.Abs(a)
+	case 1:
+		return -a
+	case 2:
+		return math.Ceil(a)
+	case 3:
+		return math.Floor(a)
+	case 4:
+		return math.Trunc(a)
+	case 5:
+		return math.RoundToEven(a)
+	default:
+		return math.Sqrt(a)
+	}
+}
+
+// floatBinary implements add, sub, mul, div, min, max and copysign.
+func floatBinary(k byte, a, b float64) float64 {
+	switch k {
+	case 0:
+		return a + b
+	case 1:
+		return a - b
+	case 2:
+		return a * b
+	case 3:
+		return a / b
+	case 4, 5:
+		if math.IsNaN(a) || math.IsNaN(b) {
+			return math.NaN()
+		}
+		if k == 4 {
+			return math.Min(a, b)
+		}
+		return math.Max(a, b)
+	default:
+		return math.Copysign(a, b)
+	}
+}
+
+// truncate converts f to an integer in [min, max), trapping outside it
+// unless saturating.
+func truncate(f, min, max float64, saturate bool) float64 {
+	if math.IsNaN(f) {
+		if saturate {
+			return 0
+		}
+		panic(wasmTrap("invalid conversion to integer"))
+	}
+	t := math.Trunc(f)
+	if t < min || t >= max {
+		if !saturate {
+			panic(wasmTrap("integer overflow"))
+		}
+		if t < min {
+			return min
+		}
+		return math.Nextafter(max, min)
+	}
+	return t
+}
+
+func truncToInt(f float64, size uint, signed, saturate bool) uint64 {
+	switch {
+	case size == 32 && signed:
+		return uint64(uint32(int32(truncate(f, math.MinInt32, 1<<31, saturate))))
+	case size == 32:
+		return uint64(uint32(truncate(f, 0, 1<<32, saturate)))
+	case signed:
+		if saturate && !math.IsNaN(f) && f >= 1<<63 {
+			return math.MaxInt64
+		}
+		return uint64(int64(truncate(f, math.MinInt64, 1<<63, saturate)))
+	default:
+		if saturate && !math.IsNaN(f) && f >= 1<<64 {
+			return math.MaxUint64
+		}
+		return uint64(truncate(f, 0, 1<<64, saturate))
+	}
+}
+
+func (inst *wasmInstance) execConversion(op byte) {
+	switch op {
+	case 0xa7:
+		inst.push(uint64(inst.popI32()))
+	case 0xa8, 0xa9:
+		inst.push(truncToInt(float64(inst.popF32()), 32, op == 0xa8, false))
+	case 0xaa, 0xab:
+		inst.push(truncToInt(inst.popF64(), 32, op == 0xaa, false))
+	case 0xac:
+		inst.push(uint64(int64(int32(inst.popI32()))))
+	case 0xad:
+		inst.push(uint64(inst.popI32()))
+	case 0xae, 0xaf:
+		inst.push(truncToInt(float64(inst.popF32()), 64, op == 0xae, false))
+	case 0xb0, 0xb1:
+		inst.push(truncToInt(inst.popF64(), 64, op == 0xb0, false))
+	case 0xb2:
+		inst.pushF32(float32(int32(inst.popI32())))
+	case 0xb3:
+		inst.pushF32(float32(inst.popI32()))
+	case 0xb4:
+		inst.pushF32(float32(int64(inst.pop())))
+	case 0xb5:
+		inst.pushF32(float32(inst.pop()))
+	case 0xb6:
+		inst.pushF32(float32(inst.popF64()))
+	case 0xb7:
+		inst.pushF64(float64(int32(inst.popI32())))
+	case 0xb8:
+		inst.pushF64(float64(inst.popI32()))
+	case 0xb9:
+		inst.pushF64(float64(int64(inst.pop())))
+	case 0xba:
+		inst.pushF64(float64(inst.pop()))
+	case 0xbb:
+		inst.pushF64(float64(inst.popF32()))
+	case 0xbc, 0xbd, 0xbe, 0xbf:
+		// Reinterpretations keep the bits; f32 and i32 are both held in the
+		// low 32 bits.
+	case 0xc0:
+		inst.push(uint64(uint32(int32(int8(inst.popI32())))))
+	case 0xc1:
+		inst.push(uint64(uint32(int32(int16(inst.popI32())))))
+	case 0xc2:
+		inst.push(uint64(int64(int8(inst.pop()))))
+	case 0xc3:
+		inst.push(uint64(int64(int16(inst.pop()))))
+	case 0xc4:
+		inst.push(uint64(int64(int32(inst.pop()))))
+	default:
+		panic(wasmTrap(fmt.Sprintf("unsupported instruction 0x%02x", op)))
+	}
+}
+
+// execMisc runs the 0xfc instructions: saturating truncation and
+// memory.copy/fill.
+func (inst *wasmInstance) execMisc(sub uint32, pc *int) {
+	switch {
+	case sub <= 7:
+		size := uint(32)
+		if sub >= 4 {
+			size = 64
+		}
+		var f float64
+		if sub%4 < 2 {
+			f = float64(inst.popF32())
+		} else {
+			f = inst.popF64()
+		}
+		inst.push(truncToInt(f, size, sub%2 == 0, true))
+	case sub == 10:
+		*pc += 2
+		n, src, dst := inst.popI32(), inst.popI32(), inst.popI32()
+		inst.address(src, 0, uint64(n))
+		inst.address(dst, 0, uint64(n))
+		inst.fuel -= int64(n / 64)
+		copy(inst.memory[dst:dst+n], inst.memory[src:src+n])
+	case sub == 11:
+		*pc++
+		n, value, dst := inst.popI32(), inst.popI32(), inst.popI32()
+		inst.address(dst, 0, uint64(n))
+		inst.fuel -= int64(n / 64)
+		region := inst.memory[dst : dst+n]
+		for i := range region {
+			region[i] = byte(value)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWasmFilterFuel           = 1000000
+	DefaultWasmFilterMaxMemoryPages = 256
+	MaxWasmFilterMaxMemoryPages     = 4096
+	WasmFilterCheckInterval         = 5 * time.Second
+
+	wasmVerdictContinue  = 0
+	wasmVerdictBlock     = 1
+	wasmVerdictChallenge = 2
+)
+
+// WasmFilter runs a WebAssembly module against each request once its head
+// is read. The module exports on_request() -> i32, answering 0 to let the
+// request through, 1 to block it and 2 to challenge the client, and may
+// import from "env":
+//
+//	get_property(name_ptr, name_len, buf_ptr, buf_len i32) -> i32
+//	set_reason(ptr, len i32)
+//	log(ptr, len i32)
+//
+// get_property copies up to buf_len bytes of a property into memory and
+// returns its full length, or -1 for an unknown name. The properties are
+// ip, country, asn, hostname, method, path, host, port, protocol,
+// request_id and header.<Name>. Every request gets a fresh instance, with
+// Fuel instructions and MaxMemoryPages of 64 KiB to run in; a filter that
+// fails lets the request through unless FailClosed is set. Whitelisted
+// clients are not filtered.
+type WasmFilter struct {
+	Name                string `json:"name"`
+	Path                string `json:"path"`
+	Fuel                int64  `json:"fuel"`
+	MaxMemoryPages      int    `json:"max_memory_pages"`
+	FailClosed          bool   `json:"fail_closed"`
+	Status              int    `json:"status"`
+	Message             string `json:"message"`
+	ChallengeValidHours int    `json:"challenge_valid_hours"`
+}
+
+func normalizeWasmFilters(filters []WasmFilter) []WasmFilter {
+	for i := range filters {
+		filter := &filters[i]
+		if filter.Name == "" {
+			filter.Name = strings.TrimSuffix(filepath.Base(filter.Path), ".wasm")
+		}
+		if filter.Fuel <= 0 {
+			filter.Fuel = DefaultWasmFilterFuel
+		}
+		if filter.MaxMemoryPages <= 0 {
+			filter.MaxMemoryPages = DefaultWasmFilterMaxMemoryPages
+		}
+		if filter.MaxMemoryPages > MaxWasmFilterMaxMemoryPages {
+			filter.MaxMemoryPages = MaxWasmFilterMaxMemoryPages
+		}
+		if filter.Status < 400 || filter.Status > 599 {
+			filter.Status = http.StatusForbidden
+		}
+		if filter.Message == "" {
+			filter.Message = DefaultPolicyMessage
+		}
+		if filter.ChallengeValidHours <= 0 {
+			filter.ChallengeValidHours = DefaultPolicyChallengeValidHours
+		}
+	}
+	return filters
+}
+
+func (fw *Firewall) wasmFilterConfigs() []WasmFilter {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.WasmFilters
+}
+
+// loadedWasmFilter is a decoded module and the file it came from.
+type loadedWasmFilter struct {
+	path    string
+	modTime time.Time
+	module  *wasmModule
+}
+
+// WasmFilterSet holds the modules of the configured filters, keyed by path.
+// A module that fails to reload keeps its previous version.
+type WasmFilterSet struct {
+	mutex   sync.RWMutex
+	modules map[string]*loadedWasmFilter
+}
+
+func NewWasmFilterSet() *WasmFilterSet {
+	return &WasmFilterSet{modules: make(map[string]*loadedWasmFilter)}
+}
+
+func (ws *WasmFilterSet) get(path string) *loadedWasmFilter {
+	ws.mutex.RLock()
+	defer ws.mutex.RUnlock()
+
+	return ws.modules[path]
+}
+
+// refreshWasmFilters loads modules that are new or changed on disk and
+// forgets those no longer configured.
+func (fw *Firewall) refreshWasmFilters() {
+	filters := fw.wasmFilterConfigs()
+	configured := make(map[string]bool, len(filters))
+	for _, filter := range filters {
+		configured[filter.Path] = true
+		stat, err := os.Stat(filter.Path)
+		if err != nil {
+			fw.logErrorRateLimited("wasm_"+filter.Name, "WASM", "Failed to load filter %s: %v", filter.Name, err)
+			continue
+		}
+		if current := fw.wasmFilters.get(filter.Path); current != nil && current.modTime.Equal(stat.ModTime()) {
+			continue
+		}
+		data, err := os.ReadFile(filter.Path)
+		if err == nil {
+			var module *wasmModule
+			if module, err = fw.loadWasmFilterModule(filter, data); err == nil {
+				fw.wasmFilters.mutex.Lock()
+				fw.wasmFilters.modules[filter.Path] = &loadedWasmFilter{path: filter.Path, modTime: stat.ModTime(), module: module}
+				fw.wasmFilters.mutex.Unlock()
+				if fw.logger != nil {
+					fw.logger.LogInfo("WASM", "Loaded filter %s from %s (%d functions)", filter.Name, filter.Path, len(module.functions))
+				}
+				continue
+			}
+		}
+		fw.logErrorRateLimited("wasm_"+filter.Name, "WASM", "Failed to load filter %s: %v", filter.Name, err)
+	}
+
+	fw.wasmFilters.mutex.Lock()
+	for path := range fw.wasmFilters.modules {
+		if !configured[path] {
+			delete(fw.wasmFilters.modules, path)
+		}
+	}
+	fw.wasmFilters.mutex.Unlock()
+}
+
+// loadWasmFilterModule decodes and checks a filter. Filter files come from
+// disk, possibly half-written, so a decoder bug fails this one filter
+// instead of the watcher goroutine and with it the firewall.
+func (fw *Firewall) loadWasmFilterModule(filter WasmFilter, data []byte) (module *wasmModule, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fw.logPanic(fw.logger, "wasm filter "+filter.Name, r)
+			module, err = nil, fmt.Errorf("%w: decoder panic: %v", errWasmMalformed, r)
+		}
+	}()
+
+	if module, err = decodeWasmModule(data); err != nil {
+		return nil, err
+	}
+	return module, checkWasmFilterModule(module)
+}
+
+// checkWasmFilterModule rejects modules that don't follow the filter ABI.
+func checkWasmFilterModule(m *wasmModule) error {
+	export, found := m.exports["on_request"]
+	if !found || export.kind != 0 {
+		return fmt.Errorf("no exported on_request function")
+	}
+	idx := export.index
+	var ft wasmFuncType
+	if idx < uint32(len(m.imports)) {
+		ft = m.types[m.imports[idx].typeIdx]
+	} else {
+		ft = m.types[m.functions[idx-uint32(len(m.imports))].typeIdx]
+	}
+	if len(ft.params) != 0 || len(ft.results) != 1 || ft.results[0] != wasmI32 {
+		return fmt.Errorf("on_request must take nothing and return an i32")
+	}
+	for _, imp := range m.imports {
+		want, known := wasmFilterImportTypes[imp.module+"."+imp.name]
+		if !known {
+			return fmt.Errorf("unknown import %s.%s", imp.module, imp.name)
+		}
+		if !m.types[imp.typeIdx].equal(want) {
+			return fmt.Errorf("import %s.%s has the wrong signature", imp.module, imp.name)
+		}
+	}
+	return nil
+}
+
+func (fw *Firewall) wasmFilterWatcher() {
+	fw.refreshWasmFilters()
+
+	ticker := time.NewTicker(WasmFilterCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fw.refreshWasmFilters()
+		case <-fw.shutdown:
+			return
+		}
+	}
+}
+
+// wasmFilterCall is what the host functions of one filter call work with.
+type wasmFilterCall struct {
+	fw     *Firewall
+	ms     *MiddlewareState
+	filter WasmFilter
+	reason string
+}
+
+func (call *wasmFilterCall) property(name string) (string, bool) {
+	ms := call.ms
+	if header, isHeader := strings.CutPrefix(name, "header."); isHeader {
+		return ms.Head.Header.Get(header), true
+	}
+	switch name {
+	case "ip":
+		return ms.IP, true
+	case "country":
+		if ms.Verdict.Country != "" {
+			return ms.Verdict.Country, true
+		}
+		return call.fw.lookupCountry(ms.IP), true
+	case "asn":
+		asn, _, _ := call.fw.lookupASN(ms.IP)
+		return strconv.FormatUint(uint64(asn), 10), true
+	case "hostname":
+		return ms.Hostname, true
+	case "method":
+		return ms.Head.Method, true
+	case "path":
+		return ms.Head.Path(), true
+	case "host":
+		return ms.Head.Host(), true
+	case "port":
+		return strconv.Itoa(ms.Port), true
+	case "protocol":
+		return ms.Record.Protocol, true
+	case "request_id":
+		return ms.ConnID, true
+	}
+	return "", false
+}
+
+var wasmFilterImportTypes = map[string]wasmFuncType{
+	"env.get_property": {params: []byte{wasmI32, wasmI32, wasmI32, wasmI32}, results: []byte{wasmI32}},
+	"env.set_reason":   {params: []byte{wasmI32, wasmI32}},
+	"env.log":          {params: []byte{wasmI32, wasmI32}},
+}
+
+// wasmFilterImports are the host functions a filter may import, given the
+// call they serve.
+var wasmFilterImports = map[string]func(call *wasmFilterCall) wasmHostFunc{
+	"env.get_property": func(call *wasmFilterCall) wasmHostFunc {
+		return func(inst *wasmInstance, args []uint64) []uint64 {
+			name := inst.Memory(uint32(args[0]), uint32(args[1]))
+			if name == nil {
+				panic(errWasmOutOfRange)
+			}
+			value, known := call.property(string(name))
+			if !known {
+				return []uint64{uint64(uint32(0xffffffff))}
+			}
+			buf := inst.Memory(uint32(args[2]), uint32(args[3]))
+			if buf == nil {
+				panic(errWasmOutOfRange)
+			}
+			copy(buf, value)
+			return []uint64{uint64(uint32(len(value)))}
+		}
+	},
+	"env.set_reason": func(call *wasmFilterCall) wasmHostFunc {
+		return func(inst *wasmInstance, args []uint64) []uint64 {
+			if reason := inst.Memory(uint32(args[0]), uint32(min(args[1], 256))); reason != nil {
+				call.reason = string(reason)
+			}
+			return nil
+		}
+	},
+	"env.log": func(call *wasmFilterCall) wasmHostFunc {
+		return func(inst *wasmInstance, args []uint64) []uint64 {
+			if message := inst.Memory(uint32(args[0]), uint32(min(args[1], 256))); message != nil {
+				call.ms.Record.Event("wasm filter %s: %s", call.filter.Name, message)
+			}
+			return nil
+		}
+	},
+}
+
+// runWasmFilter returns the filter's verdict for the request in ms.
+func (fw *Firewall) runWasmFilter(filter WasmFilter, module *wasmModule, ms *MiddlewareState) (int, string, error) {
+	call := &wasmFilterCall{fw: fw, ms: ms, filter: filter}
+	host := make(map[string]wasmHostFunc, len(wasmFilterImports))
+	for name, bind := range wasmFilterImports {
+		host[name] = bind(call)
+	}
+	inst, err := instantiateWasm(module, host, uint32(filter.MaxMemoryPages), filter.Fuel)
+	if err != nil {
+		return 0, "", err
+	}
+	results, err := inst.Call("on_request")
+	if err != nil {
+		return 0, "", err
+	}
+	return int(int32(uint32(results[0]))), call.reason, nil
+}
+
+func init() {
+	RegisterMiddleware(Middleware{Name: "wasm_filters", Stage: StageRequest, SkipWhitelisted: true, Handle: wasmFiltersMiddleware})
+}
+
+func wasmFiltersMiddleware(fw *Firewall, ms *MiddlewareState) bool {
+	for _, filter := range fw.wasmFilterConfigs() {
+		loaded := fw.wasmFilters.get(filter.Path)
+		if loaded == nil {
+			continue
+		}
+		verdict, reason, err := fw.runWasmFilter(filter, loaded.module, ms)
+		if err != nil {
+			fw.logErrorRateLimitedTo(ms.Logger, "wasm_"+filter.Name, "WASM", "Filter %s failed: %v", filter.Name, err)
+			if !filter.FailClosed {
+				ms.Record.Event("wasm filter %s failed open", filter.Name)
+				continue
+			}
+			verdict, reason = wasmVerdictBlock, "filter failed: "+err.Error()
+		}
+		if reason == "" {
+			reason = "no reason given"
+		}
+		details := fmt.Sprintf("wasm filter %s: %s", filter.Name, reason)
+
+		switch verdict {
+		case wasmVerdictContinue:
+			continue
+		case wasmVerdictChallenge:
+			if fw.challengePassed(ms.Head, ms.Key) {
+				continue
+			}
+			ms.Block("CHALLENGED", fmt.Sprintf("%s, no valid challenge cookie", details))
+			fw.writeChallenge(ms.Conn, ms.ConnID, ms.Key, time.Duration(filter.ChallengeValidHours)*time.Hour)
+			return false
+		default:
+			ms.Block("WASM_FILTER", details)
+			fw.writeHTTPError(ms.Conn, ms.ConnID, filter.Status, filter.Message, 0)
+			return false
+		}
+	}
+	return true
+}
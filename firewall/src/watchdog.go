@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWatchdogCheckSeconds      = 10
+	DefaultWatchdogMaxGoroutines     = 20000
+	DefaultWatchdogMaxHeapMB         = 512
+	DefaultWatchdogMaxTrackedEntries = 5 * MaxTrackedIPs
+	DefaultWatchdogThrottleAccepts   = 50
+)
+
+// WatchdogConfig has the firewall watch its own goroutine count, heap and
+// per-client maps every CheckSeconds. Past any threshold it logs a warning,
+// prunes its maps (evicting the least active clients if that isn't enough,
+// and returning freed memory to the OS when the heap is the problem) and,
+// until a check comes back clean, sheds new connections beyond
+// ThrottleAcceptsPerSecond, so a sustained flood degrades service instead of
+// getting the container OOM-killed.
+type WatchdogConfig struct {
+	Enabled                  bool `json:"enabled"`
+	CheckSeconds             int  `json:"check_seconds"`
+	MaxGoroutines            int  `json:"max_goroutines"`
+	MaxHeapMB                int  `json:"max_heap_mb"`
+	MaxTrackedEntries        int  `json:"max_tracked_entries"`
+	ThrottleAcceptsPerSecond int  `json:"throttle_accepts_per_second"`
+}
+
+func normalizeWatchdogConfig(config WatchdogConfig) WatchdogConfig {
+	if config.CheckSeconds <= 0 {
+		config.CheckSeconds = DefaultWatchdogCheckSeconds
+	}
+	if config.MaxGoroutines <= 0 {
+		config.MaxGoroutines = DefaultWatchdogMaxGoroutines
+	}
+	if config.MaxHeapMB <= 0 {
+		config.MaxHeapMB = DefaultWatchdogMaxHeapMB
+	}
+	if config.MaxTrackedEntries <= 0 {
+		config.MaxTrackedEntries = DefaultWatchdogMaxTrackedEntries
+	}
+	if config.ThrottleAcceptsPerSecond <= 0 {
+		config.ThrottleAcceptsPerSecond = DefaultWatchdogThrottleAccepts
+	}
+	return config
+}
+
+func (fw *Firewall) watchdogConfig() WatchdogConfig {
+	fw.rulesMutex.RLock()
+	defer fw.rulesMutex.RUnlock()
+
+	return fw.rules.Watchdog
+}
+
+// WatchdogReading is one check's view of the firewall's footprint.
+type WatchdogReading struct {
+	At         time.Time      `json:"at"`
+	Goroutines int            `json:"goroutines"`
+	HeapMB     float64        `json:"heap_mb"`
+	Tracked    map[string]int `json:"tracked_entries"`
+	Exceeded   []string       `json:"exceeded"`
+}
+
+func (wr WatchdogReading) trackedTotal() int {
+	total := 0
+	for _, n := range wr.Tracked {
+		total += n
+	}
+	return total
+}
+
+type WatchdogStatus struct {
+	Last          *WatchdogReading `json:"last,omitempty"`
+	Throttled     bool             `json:"throttled"`
+	ThrottledShed uint64           `json:"throttled_shed"`
+}
+
+// Watchdog holds the last reading and the accept throttle it imposes.
+type Watchdog struct {
+	mutex     sync.Mutex
+	last      *WatchdogReading
+	throttle  int
+	second    time.Time
+	accepted  int
+	throttled uint64
+}
+
+func NewWatchdog() *Watchdog {
+	return &Watchdog{}
+}
+
+// AdmitAccept reports whether a new connection fits under the throttle, if
+// one is in force.
+func (wd *Watchdog) AdmitAccept(now time.Time) bool {
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+
+	if wd.throttle == 0 {
+		return true
+	}
+	if second := now.Truncate(time.Second); !second.Equal(wd.second) {
+		wd.second, wd.accepted = second, 0
+	}
+	if wd.accepted >= wd.throttle {
+		wd.throttled++
+		return false
+	}
+	wd.accepted++
+	return true
+}
+
+func (wd *Watchdog) Status() WatchdogStatus {
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+
+	return WatchdogStatus{Last: wd.last, Throttled: wd.throttle > 0, ThrottledShed: wd.throttled}
+}
+
+func (fw *Firewall) trackedEntries() map[string]int {
+	fw.attemptsMutex.RLock()
+	tracked := map[string]int{
+		"connection_attempts": len(fw.connectionAttempts),
+		"hourly_attempts":     len(fw.hourlyAttempts),
+		"endpoint_attempts":   len(fw.endpointAttempts),
+		"login_failures":      len(fw.loginFailures),
+		"auto_blocks":         len(fw.autoBlockedIPs),
+	}
+	fw.attemptsMutex.RUnlock()
+
+	fw.synFloodMutex.RLock()
+	tracked["syn_tracker"] = len(fw.synFloodTracker)
+	tracked["active_by_ip"] = len(fw.activeConnsByIP)
+	fw.synFloodMutex.RUnlock()
+	return tracked
+}
+
+func (fw *Firewall) readWatchdog(config WatchdogConfig) WatchdogReading {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	reading := WatchdogReading{
+		At:         fw.clock.Now(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapMB:     float64(memStats.HeapAlloc) / (1 << 20),
+		Tracked:    fw.trackedEntries(),
+	}
+	if reading.Goroutines > config.MaxGoroutines {
+		reading.Exceeded = append(reading.Exceeded, fmt.Sprintf("goroutines %d/%d", reading.Goroutines, config.MaxGoroutines))
+	}
+	if reading.HeapMB > float64(config.MaxHeapMB) {
+		reading.Exceeded = append(reading.Exceeded, fmt.Sprintf("heap %.0f/%d MB", reading.HeapMB, config.MaxHeapMB))
+	}
+	if total := reading.trackedTotal(); total > config.MaxTrackedEntries {
+		reading.Exceeded = append(reading.Exceeded, fmt.Sprintf("tracked entries %d/%d", total, config.MaxTrackedEntries))
+	}
+	return reading
+}
+
+// shrinkTrackedState prunes expired entries, then evicts the least active
+// clients, with their hourly, login and SYN history, until the maps fit under
+// limit. If clients alone don't account for enough, the least recently
+// active endpoint buckets and histories go too. Auto-blocks and the live
+// connection counts are never evicted.
+func (fw *Firewall) shrinkTrackedState(limit int) int {
+	fw.cleanupOldAttempts()
+
+	excess := -limit
+	for _, n := range fw.trackedEntries() {
+		excess += n
+	}
+	if excess <= 0 {
+		return 0
+	}
+
+	// The SYN history lives under its own mutex; note which clients have
+	// one so each victim's is counted as it is chosen, and drop them after.
+	synning := make(map[string]bool)
+	fw.synFloodMutex.RLock()
+	for ip := range fw.synFloodTracker {
+		synning[ip] = true
+	}
+	fw.synFloodMutex.RUnlock()
+
+	var victims []string
+	fw.attemptsMutex.Lock()
+	for excess > 0 {
+		victim, ok := fw.evictTrackedIP()
+		if !ok {
+			break
+		}
+		victims = append(victims, victim)
+		excess--
+		for _, history := range []map[string][]time.Time{fw.hourlyAttempts, fw.loginFailures} {
+			if _, exists := history[victim]; exists {
+				delete(history, victim)
+				excess--
+			}
+		}
+		if synning[victim] {
+			excess--
+		}
+	}
+	fw.attemptsMutex.Unlock()
+
+	fw.synFloodMutex.Lock()
+	for _, victim := range victims {
+		delete(fw.synFloodTracker, victim)
+	}
+	fw.synFloodMutex.Unlock()
+
+	if excess > 0 {
+		fw.attemptsMutex.Lock()
+		excess = dropStalestHistories(excess, fw.endpointAttempts, fw.hourlyAttempts, fw.loginFailures)
+		fw.attemptsMutex.Unlock()
+	}
+	if excess > 0 {
+		fw.synFloodMutex.Lock()
+		dropStalestHistories(excess, fw.synFloodTracker)
+		fw.synFloodMutex.Unlock()
+	}
+	return len(victims)
+}
+
+// dropStalestHistories deletes up to excess entries from histories, those
+// whose last event is oldest first, and returns how many more are needed.
+// Callers hold the mutex guarding the maps.
+func dropStalestHistories(excess int, histories ...map[string][]time.Time) int {
+	type entry struct {
+		history map[string][]time.Time
+		key     string
+		last    time.Time
+	}
+	var entries []entry
+	for _, history := range histories {
+		for key, times := range history {
+			var last time.Time
+			if len(times) > 0 {
+				last = times[len(times)-1]
+			}
+			entries = append(entries, entry{history, key, last})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].last.Before(entries[j].last)
+	})
+	for _, e := range entries {
+		if excess <= 0 {
+			break
+		}
+		delete(e.history, e.key)
+		excess--
+	}
+	return excess
+}
+
+// runWatchdog takes a reading and acts on it.
+func (fw *Firewall) runWatchdog(config WatchdogConfig) WatchdogReading {
+	reading := fw.readWatchdog(config)
+
+	throttle := 0
+	if len(reading.Exceeded) > 0 {
+		throttle = config.ThrottleAcceptsPerSecond
+		if fw.logger != nil {
+			fw.logger.LogWarning("WATCHDOG", "Over threshold: %s - throttling accepts to %d/s",
+				strings.Join(reading.Exceeded, ", "), throttle)
+		}
+
+		evicted := fw.shrinkTrackedState(config.MaxTrackedEntries)
+		if reading.HeapMB > float64(config.MaxHeapMB) {
+			debug.FreeOSMemory()
+		}
+		if fw.logger != nil && evicted > 0 {
+			fw.logger.LogWarning("WATCHDOG", "Evicted %d tracked clients", evicted)
+		}
+	}
+
+	fw.watchdog.mutex.Lock()
+	if throttle == 0 && fw.watchdog.throttle > 0 && fw.logger != nil {
+		fw.logger.LogInfo("WATCHDOG", "Back under thresholds - accept throttle lifted")
+	}
+	fw.watchdog.throttle = throttle
+	fw.watchdog.last = &reading
+	fw.watchdog.mutex.Unlock()
+	return reading
+}
+
+func (fw *Firewall) watchdogWatcher() {
+	elapsed := 0
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		config := fw.watchdogConfig()
+		if !config.Enabled {
+			fw.watchdog.mutex.Lock()
+			fw.watchdog.throttle = 0
+			fw.watchdog.mutex.Unlock()
+			continue
+		}
+
+		elapsed++
+		if elapsed < config.CheckSeconds {
+			continue
+		}
+		elapsed = 0
+		fw.runWatchdog(config)
+	}
+}